@@ -0,0 +1,216 @@
+// Package analysis computes facts about IR functions that passes and the
+// backend share, such as which blocks dominate which.
+package analysis
+
+import (
+	"fmt"
+
+	"github.com/arc-language/core-builder/ir"
+)
+
+// DomTree is the dominator tree of a function's blocks reachable from its
+// entry. Block a dominates block b when every path from the entry to b
+// passes through a; b's immediate dominator is the one closest to it.
+type DomTree struct {
+	order    []*ir.BasicBlock // Reverse postorder from the entry
+	number   map[*ir.BasicBlock]int
+	idom     map[*ir.BasicBlock]*ir.BasicBlock
+	children map[*ir.BasicBlock][]*ir.BasicBlock
+	preds    map[*ir.BasicBlock][]*ir.BasicBlock
+	frontier map[*ir.BasicBlock][]*ir.BasicBlock
+}
+
+// Dominators computes fn's dominator tree with the iterative algorithm of
+// Cooper, Harvey and Kennedy, which walks the blocks in reverse postorder
+// intersecting their predecessors' dominators until nothing changes. It
+// fails at a terminator whose successors it doesn't know, or that lacks
+// one.
+func Dominators(fn *ir.Function) (*DomTree, error) {
+	t := &DomTree{
+		number:   make(map[*ir.BasicBlock]int),
+		idom:     make(map[*ir.BasicBlock]*ir.BasicBlock),
+		children: make(map[*ir.BasicBlock][]*ir.BasicBlock),
+		preds:    make(map[*ir.BasicBlock][]*ir.BasicBlock),
+		frontier: make(map[*ir.BasicBlock][]*ir.BasicBlock),
+	}
+	if len(fn.Blocks) == 0 {
+		return t, nil
+	}
+
+	// Postorder by depth-first search, then reversed
+	preds := t.preds
+	visited := make(map[*ir.BasicBlock]bool)
+	var postorder []*ir.BasicBlock
+	var visit func(*ir.BasicBlock) error
+	visit = func(block *ir.BasicBlock) error {
+		visited[block] = true
+		succs, err := Successors(fn, block)
+		if err != nil {
+			return err
+		}
+		for _, s := range succs {
+			if s == nil {
+				return fmt.Errorf("block %s: %s has no target block", block.Name(), block.Terminator().Opcode())
+			}
+			preds[s] = append(preds[s], block)
+			if !visited[s] {
+				if err := visit(s); err != nil {
+					return err
+				}
+			}
+		}
+		postorder = append(postorder, block)
+		return nil
+	}
+	if err := visit(fn.Blocks[0]); err != nil {
+		return nil, err
+	}
+	for i := len(postorder) - 1; i >= 0; i-- {
+		t.number[postorder[i]] = len(t.order)
+		t.order = append(t.order, postorder[i])
+	}
+
+	// The entry is its own dominator while iterating, which stops the
+	// intersection walk there
+	entry := t.order[0]
+	t.idom[entry] = entry
+	for changed := true; changed; {
+		changed = false
+		for _, block := range t.order[1:] {
+			var idom *ir.BasicBlock
+			for _, p := range preds[block] {
+				if _, done := t.idom[p]; !done {
+					continue // Not reached yet in this pass
+				}
+				if idom == nil {
+					idom = p
+				} else {
+					idom = t.intersect(p, idom)
+				}
+			}
+			if t.idom[block] != idom {
+				t.idom[block] = idom
+				changed = true
+			}
+		}
+	}
+	delete(t.idom, entry)
+
+	for _, block := range t.order[1:] {
+		parent := t.idom[block]
+		t.children[parent] = append(t.children[parent], block)
+	}
+
+	// A join point is in the frontier of each block on the way up from
+	// its predecessors to its immediate dominator
+	for _, block := range t.order {
+		if len(preds[block]) < 2 {
+			continue
+		}
+		for _, p := range preds[block] {
+			for runner := p; runner != nil && runner != t.idom[block]; runner = t.idom[runner] {
+				if f := t.frontier[runner]; len(f) == 0 || f[len(f)-1] != block {
+					t.frontier[runner] = append(f, block)
+				}
+			}
+		}
+	}
+	return t, nil
+}
+
+// intersect finds the nearest common dominator of a and b by walking up
+// from whichever is later in reverse postorder
+func (t *DomTree) intersect(a, b *ir.BasicBlock) *ir.BasicBlock {
+	for a != b {
+		for t.number[a] > t.number[b] {
+			a = t.idom[a]
+		}
+		for t.number[b] > t.number[a] {
+			b = t.idom[b]
+		}
+	}
+	return a
+}
+
+// Reachable reports whether control can reach block from the entry.
+// Unreachable blocks dominate and are dominated by nothing.
+func (t *DomTree) Reachable(block *ir.BasicBlock) bool {
+	_, ok := t.number[block]
+	return ok
+}
+
+// IDom returns block's immediate dominator, or nil for the entry and for
+// unreachable blocks
+func (t *DomTree) IDom(block *ir.BasicBlock) *ir.BasicBlock {
+	return t.idom[block]
+}
+
+// Children returns the blocks block immediately dominates, in reverse
+// postorder
+func (t *DomTree) Children(block *ir.BasicBlock) []*ir.BasicBlock {
+	return t.children[block]
+}
+
+// Dominates reports whether a dominates b. A block dominates itself.
+func (t *DomTree) Dominates(a, b *ir.BasicBlock) bool {
+	if !t.Reachable(a) || !t.Reachable(b) {
+		return false
+	}
+	// A dominator comes before the blocks it dominates in reverse
+	// postorder, so the walk up from b can stop once it passes a
+	for t.number[b] > t.number[a] {
+		b = t.idom[b]
+	}
+	return a == b
+}
+
+// Predecessors returns the reachable blocks that can branch to block, a
+// block once for each edge
+func (t *DomTree) Predecessors(block *ir.BasicBlock) []*ir.BasicBlock {
+	return t.preds[block]
+}
+
+// Frontier returns block's dominance frontier: the blocks where its
+// dominance ends, reached from a block it dominates but not themselves
+// strictly dominated by it. A value defined in block needs a phi there
+// to merge with those from other paths.
+func (t *DomTree) Frontier(block *ir.BasicBlock) []*ir.BasicBlock {
+	return t.frontier[block]
+}
+
+// Blocks returns the reachable blocks in reverse postorder, in which each
+// block comes after its dominators
+func (t *DomTree) Blocks() []*ir.BasicBlock {
+	return t.order
+}
+
+// Successors returns the blocks control can go to from block. A block
+// with no terminator falls through to the next block in fn, as the
+// backend lowers it.
+func Successors(fn *ir.Function, block *ir.BasicBlock) ([]*ir.BasicBlock, error) {
+	switch term := block.Terminator().(type) {
+	case nil:
+		for i, b := range fn.Blocks {
+			if b == block && i+1 < len(fn.Blocks) {
+				return []*ir.BasicBlock{fn.Blocks[i+1]}, nil
+			}
+		}
+		return nil, nil
+	case *ir.BrInst:
+		return []*ir.BasicBlock{term.Target}, nil
+	case *ir.CondBrInst:
+		return []*ir.BasicBlock{term.TrueBlock, term.FalseBlock}, nil
+	case *ir.SwitchInst:
+		succs := []*ir.BasicBlock{term.DefaultBlock}
+		for _, sc := range term.Cases {
+			succs = append(succs, sc.Block)
+		}
+		return succs, nil
+	case *ir.InvokeInst:
+		return []*ir.BasicBlock{term.NormalDest, term.UnwindDest}, nil
+	case *ir.RetInst, *ir.UnreachableInst, *ir.ResumeInst:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("block %s: unknown successors of %T", block.Name(), term)
+	}
+}
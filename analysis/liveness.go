@@ -0,0 +1,234 @@
+package analysis
+
+import (
+	"github.com/arc-language/core-builder/ir"
+)
+
+// Liveness records where a function's SSA values, its arguments and the
+// results of its instructions, are live: from their definition to their
+// last use on some path. A phi's operand is used at the end of the
+// predecessor it comes from, not in the phi's block, and the phi itself
+// is defined on entry to its block, so neither is live into that block.
+type Liveness struct {
+	fn        *ir.Function
+	liveIn    map[*ir.BasicBlock]map[ir.Value]bool
+	liveOut   map[*ir.BasicBlock]map[ir.Value]bool
+	index     map[ir.Instruction]int
+	intervals map[ir.Value]Interval
+}
+
+// Interval is the span of instruction indexes over which a value is live,
+// in the numbering of Liveness.Index. A value live in blocks laid out
+// apart, such as across a loop's back edge, spans everything between.
+type Interval struct {
+	Start, End int
+}
+
+// Overlaps reports whether the two intervals share an instruction
+func (iv Interval) Overlaps(other Interval) bool {
+	return iv.Start <= other.End && other.Start <= iv.End
+}
+
+// ComputeLiveness solves the live-in and live-out sets of fn's blocks by
+// iterating backward dataflow to a fixed point, then derives each value's
+// live interval. It fails at a terminator whose successors it doesn't
+// know.
+func ComputeLiveness(fn *ir.Function) (*Liveness, error) {
+	l := &Liveness{
+		fn:        fn,
+		liveIn:    make(map[*ir.BasicBlock]map[ir.Value]bool),
+		liveOut:   make(map[*ir.BasicBlock]map[ir.Value]bool),
+		index:     make(map[ir.Instruction]int),
+		intervals: make(map[ir.Value]Interval),
+	}
+
+	// Per block: the values used before any definition in it, those it
+	// defines, and those its successors' phis take from it
+	uses := make(map[*ir.BasicBlock]map[ir.Value]bool)
+	defs := make(map[*ir.BasicBlock]map[ir.Value]bool)
+	phiUses := make(map[*ir.BasicBlock]map[ir.Value]bool)
+	succs := make(map[*ir.BasicBlock][]*ir.BasicBlock)
+	for _, block := range fn.Blocks {
+		uses[block] = make(map[ir.Value]bool)
+		defs[block] = make(map[ir.Value]bool)
+		l.liveIn[block] = make(map[ir.Value]bool)
+		l.liveOut[block] = make(map[ir.Value]bool)
+		s, err := Successors(fn, block)
+		if err != nil {
+			return nil, err
+		}
+		succs[block] = s
+	}
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			if phi, ok := inst.(*ir.PhiInst); ok {
+				for _, in := range phi.Incoming {
+					if isTracked(in.Value) {
+						if phiUses[in.Block] == nil {
+							phiUses[in.Block] = make(map[ir.Value]bool)
+						}
+						phiUses[in.Block][in.Value] = true
+					}
+				}
+			} else {
+				for _, op := range inst.Operands() {
+					if isTracked(op) && !defs[block][op] {
+						uses[block][op] = true
+					}
+				}
+			}
+			defs[block][inst] = true
+		}
+	}
+
+	// live-out(B) = phi uses from B, and what its successors need on entry
+	// live-in(B) = uses(B), and live-out(B) less what B defines
+	for changed := true; changed; {
+		changed = false
+		for i := len(fn.Blocks) - 1; i >= 0; i-- {
+			block := fn.Blocks[i]
+			out := l.liveOut[block]
+			for v := range phiUses[block] {
+				out[v] = true
+			}
+			for _, s := range succs[block] {
+				for v := range l.liveIn[s] {
+					out[v] = true
+				}
+			}
+			in := l.liveIn[block]
+			for v := range uses[block] {
+				if !in[v] {
+					in[v] = true
+					changed = true
+				}
+			}
+			for v := range out {
+				if !defs[block][v] && !in[v] {
+					in[v] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	// Number the instructions in layout order, leaving 0 for the
+	// arguments, and stretch each value's interval over its definition,
+	// its uses and the blocks it is live through
+	n := 0
+	for _, arg := range fn.Arguments {
+		l.intervals[arg] = Interval{0, 0}
+	}
+	extend := func(v ir.Value, at int) {
+		iv, ok := l.intervals[v]
+		if !ok {
+			iv = Interval{at, at}
+		}
+		iv.Start, iv.End = min(iv.Start, at), max(iv.End, at)
+		l.intervals[v] = iv
+	}
+	for _, block := range fn.Blocks {
+		if len(block.Instructions) == 0 {
+			continue
+		}
+		first := n + 1
+		for _, inst := range block.Instructions {
+			n++
+			l.index[inst] = n
+			extend(inst, n)
+			if _, ok := inst.(*ir.PhiInst); ok {
+				continue
+			}
+			for _, op := range inst.Operands() {
+				if isTracked(op) {
+					extend(op, n)
+				}
+			}
+		}
+		for v := range l.liveIn[block] {
+			extend(v, first)
+		}
+		for v := range l.liveOut[block] {
+			extend(v, n)
+		}
+	}
+	return l, nil
+}
+
+// isTracked reports whether v is a value liveness follows: an argument or
+// an instruction's result, not a constant, global or function
+func isTracked(v ir.Value) bool {
+	switch v.(type) {
+	case *ir.Argument:
+		return true
+	case ir.Instruction:
+		return true
+	}
+	return false
+}
+
+// LiveIn returns the values live on entry to block, not counting its
+// phis. The set must not be modified.
+func (l *Liveness) LiveIn(block *ir.BasicBlock) map[ir.Value]bool {
+	return l.liveIn[block]
+}
+
+// LiveOut returns the values live on exit from block, including those
+// its successors' phis take from it. The set must not be modified.
+func (l *Liveness) LiveOut(block *ir.BasicBlock) map[ir.Value]bool {
+	return l.liveOut[block]
+}
+
+// Index returns inst's position in the function, counting from 1 in
+// block layout order
+func (l *Liveness) Index(inst ir.Instruction) int {
+	return l.index[inst]
+}
+
+// Interval returns v's live interval. It is false for values the function
+// doesn't define, and for an instruction not in it.
+func (l *Liveness) Interval(v ir.Value) (Interval, bool) {
+	iv, ok := l.intervals[v]
+	return iv, ok
+}
+
+// LiveAcross returns the values live both before and after inst, other
+// than its own result: those a call must preserve.
+func (l *Liveness) LiveAcross(inst ir.Instruction) []ir.Value {
+	block := inst.Parent()
+	live := make(map[ir.Value]bool, len(l.liveOut[block]))
+	for v := range l.liveOut[block] {
+		live[v] = true
+	}
+	for i := len(block.Instructions) - 1; i >= 0; i-- {
+		cur := block.Instructions[i]
+		delete(live, cur)
+		if cur == inst {
+			break
+		}
+		if _, ok := cur.(*ir.PhiInst); ok {
+			continue
+		}
+		for _, op := range cur.Operands() {
+			if isTracked(op) {
+				live[op] = true
+			}
+		}
+	}
+
+	// In block order, so the result doesn't depend on map iteration
+	var across []ir.Value
+	for _, arg := range l.fn.Arguments {
+		if live[arg] {
+			across = append(across, arg)
+		}
+	}
+	for _, b := range l.fn.Blocks {
+		for _, def := range b.Instructions {
+			if live[def] {
+				across = append(across, def)
+			}
+		}
+	}
+	return across
+}
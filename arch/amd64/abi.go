@@ -36,7 +36,7 @@ func SizeOf(t types.Type) int {
 		if bits == 64 {
 			return 8
 		}
-		if bits == 128 {
+		if bits == 80 || bits == 128 {
 			return 16
 		}
 		return 8
@@ -117,7 +117,7 @@ func AlignOf(t types.Type) int {
 		if bits == 64 {
 			return 8
 		}
-		if bits == 128 {
+		if bits == 80 || bits == 128 {
 			return 16
 		}
 		return 8
@@ -234,6 +234,77 @@ func GetArrayElementOffset(at *types.ArrayType, index int64) int {
 	return int(index) * elemSize
 }
 
+// IsAggregate reports whether t is a struct or array type
+func IsAggregate(t types.Type) bool {
+	switch t.Kind() {
+	case types.StructKind, types.ArrayKind:
+		return true
+	default:
+		return false
+	}
+}
+
+// isXMMVector reports whether t is a 128-bit vector, held whole in an XMM
+// register and passed like a float
+func isXMMVector(t types.Type) bool {
+	vt, ok := t.(*types.VectorType)
+	return ok && !vt.Scalable && SizeOf(vt) == 16
+}
+
+// inXMM reports whether values of type t travel in XMM registers: floats
+// but x86_fp80, which lives on the x87 stack, and 128-bit vectors
+func inXMM(t types.Type) bool {
+	return types.IsFloat(t) && !isX87(t) || isXMMVector(t)
+}
+
+// returnsInMemory reports whether a function returning t does so through
+// a buffer its caller provides: aggregates over 16 bytes. The caller
+// passes the buffer's address as a hidden first argument in RDI, and the
+// callee returns it in RAX.
+func returnsInMemory(t types.Type) bool {
+	return t != nil && IsAggregate(t) && SizeOf(t) > 16
+}
+
+// eightbyteClasses classifies each eightbyte of an aggregate of at most
+// 16 bytes as the ABI does to return it in registers: ParamSSE when only
+// float and double fields lie in it, ParamInteger otherwise
+func eightbyteClasses(t types.Type) []ParamClass {
+	n := (SizeOf(t) + 7) / 8
+	hasFloat := make([]bool, n)
+	hasOther := make([]bool, n)
+	var walk func(t types.Type, offset int)
+	walk = func(t types.Type, offset int) {
+		switch t := t.(type) {
+		case *types.StructType:
+			for i, field := range t.Fields {
+				walk(field, offset+GetStructFieldOffset(t, i))
+			}
+		case *types.ArrayType:
+			for i := int64(0); i < t.Length; i++ {
+				walk(t.ElementType, offset+int(i)*SizeOf(t.ElementType))
+			}
+		default:
+			if ft, ok := t.(*types.FloatType); ok && (ft.BitWidth == 32 || ft.BitWidth == 64) {
+				hasFloat[offset/8] = true
+				return
+			}
+			size := SizeOf(t)
+			for i := offset / 8; size > 0 && i <= (offset+size-1)/8 && i < n; i++ {
+				hasOther[i] = true
+			}
+		}
+	}
+	walk(t, 0)
+
+	classes := make([]ParamClass, n)
+	for i := range classes {
+		if hasFloat[i] && !hasOther[i] {
+			classes[i] = ParamSSE
+		}
+	}
+	return classes
+}
+
 // IsPassedInRegisters determines if a type should be passed in registers
 // following System V AMD64 ABI
 func IsPassedInRegisters(t types.Type) bool {
@@ -0,0 +1,882 @@
+package amd64
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Assemble encodes a routine written in Intel-syntax x86-64 assembly, as
+// printed by objdump -M intel. It accepts the subset of instructions the
+// backend itself emits:
+//
+//	ret nop leave ud2 int3 syscall cqo cdq endbr64
+//	push pop inc dec neg not
+//	mov movabs add or and sub xor cmp test lea imul
+//	shl shr sar (by an immediate or cl)
+//	movzx setCC cmovCC jmp jCC call
+//
+// and the SSE instructions the disassembler knows, in their legacy forms:
+//
+//	movss movsd movups movupd movaps movapd movdqa movdqu movd movq
+//	add sub mul div min max sqrt cmp, with ps, pd, ss or sd
+//	and andn or xor, with ps or pd; pxor ucomiss ucomisd comiss comisd
+//	cvtss2sd cvtsd2ss cvtps2pd cvtpd2ps cvtsi2ss cvtsi2sd
+//	cvtss2si cvtsd2si cvttss2si cvttsd2si
+//
+// Operands are 64-, 32- and 8-bit general registers, xmm0 to xmm15,
+// immediates, and memory
+// as [base + index*scale + disp] or [rip + symbol]. Memory operands paired
+// with an immediate need a size: xmmword, qword, dword or byte, optionally
+// followed by ptr. A line may start with a label ("loop:"); ; and # start comments.
+// As in GNU as, a {disp32} before the mnemonic keeps a displacement that
+// would fit in a byte at 32 bits.
+//
+// Branches and calls may name a label or an outside symbol. References to
+// outside symbols come back as relocations against the returned bytes: PLT32
+// for call and jmp, PC32 for RIP-relative memory.
+func Assemble(text string) ([]byte, []Relocation, error) {
+	a := &assembler{labels: make(map[string]int)}
+	for i, line := range strings.Split(text, "\n") {
+		if err := a.line(line); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+
+	code := a.buf.Bytes()
+	for _, fix := range a.fixups {
+		target, ok := a.labels[fix.label]
+		if !ok {
+			if !fix.external {
+				return nil, nil, fmt.Errorf("line %d: undefined label %s", fix.line, fix.label)
+			}
+			a.relocs = append(a.relocs, Relocation{
+				Offset:     uint64(fix.offset),
+				SymbolName: fix.label,
+				Type:       R_X86_64_PLT32,
+				Addend:     -4,
+			})
+			continue
+		}
+		binary.LittleEndian.PutUint32(code[fix.offset:], uint32(target-(fix.offset+4)))
+	}
+	return code, a.relocs, nil
+}
+
+type assembler struct {
+	buf    bytes.Buffer
+	labels map[string]int
+	fixups []asmFixup
+	relocs []Relocation
+	lineNo int
+	disp32 bool // The line has a {disp32} prefix
+}
+
+// asmFixup is a rel32 branch displacement at offset, to be pointed at label.
+// An external fixup may instead become a relocation against a symbol of
+// that name.
+type asmFixup struct {
+	offset   int
+	label    string
+	external bool
+	line     int
+}
+
+type operandKind int
+
+const (
+	opReg operandKind = iota
+	opImm
+	opMem
+	opSym
+)
+
+// ripBase stands for RIP as the base of a memory operand
+const ripBase = 16
+
+type operand struct {
+	kind operandKind
+	size int // In bytes; 0 for a memory operand of unstated size
+
+	reg int // opReg
+	imm int64
+
+	base, index int // opMem; -1 when absent
+	scale       int
+	disp        int64
+	sym         string // opSym, or the symbol of a RIP-relative opMem
+}
+
+var asmRegs = func() map[string]operand {
+	regs := make(map[string]operand)
+	names64 := []string{"rax", "rcx", "rdx", "rbx", "rsp", "rbp", "rsi", "rdi"}
+	names32 := []string{"eax", "ecx", "edx", "ebx", "esp", "ebp", "esi", "edi"}
+	names8 := []string{"al", "cl", "dl", "bl", "spl", "bpl", "sil", "dil"}
+	for i := 0; i < 8; i++ {
+		regs[names64[i]] = operand{kind: opReg, reg: i, size: 8}
+		regs[names32[i]] = operand{kind: opReg, reg: i, size: 4}
+		regs[names8[i]] = operand{kind: opReg, reg: i, size: 1}
+	}
+	for i := 8; i < 16; i++ {
+		regs[fmt.Sprintf("r%d", i)] = operand{kind: opReg, reg: i, size: 8}
+		regs[fmt.Sprintf("r%dd", i)] = operand{kind: opReg, reg: i, size: 4}
+		regs[fmt.Sprintf("r%db", i)] = operand{kind: opReg, reg: i, size: 1}
+	}
+	for i := 0; i < 16; i++ {
+		regs[fmt.Sprintf("xmm%d", i)] = operand{kind: opReg, reg: i, size: 16}
+	}
+	return regs
+}()
+
+// Condition code suffixes and their nibble in Jcc, SETcc and CMOVcc
+var asmConds = map[string]byte{
+	"o": 0x0, "no": 0x1, "b": 0x2, "c": 0x2, "nae": 0x2, "ae": 0x3, "nb": 0x3, "nc": 0x3,
+	"e": 0x4, "z": 0x4, "ne": 0x5, "nz": 0x5, "be": 0x6, "na": 0x6, "a": 0x7, "nbe": 0x7,
+	"s": 0x8, "ns": 0x9, "p": 0xA, "pe": 0xA, "np": 0xB, "po": 0xB,
+	"l": 0xC, "nge": 0xC, "ge": 0xD, "nl": 0xD, "le": 0xE, "ng": 0xE, "g": 0xF, "nle": 0xF,
+}
+
+// The /digit of the 0x81/0x83 group, and the opcode base of the reg forms
+var asmALU = map[string]byte{"add": 0, "or": 1, "and": 4, "sub": 5, "xor": 6, "cmp": 7}
+
+// Opcode and /digit of the single-operand instructions
+var asmUnary = map[string][2]byte{"inc": {0xFF, 0}, "dec": {0xFF, 1}, "not": {0xF7, 2}, "neg": {0xF7, 3}}
+
+var asmShifts = map[string]byte{"shl": 4, "sal": 4, "shr": 5, "sar": 7}
+
+// sseForm is an SSE instruction's mandatory prefix, 0 for none, and its
+// 0x0F-map opcodes: load with an XMM destination, store with an XMM source
+// and memory destination, 0 where there is none
+type sseForm struct {
+	prefix      byte
+	load, store byte
+}
+
+// The mandatory prefixes of the ps, pd, ss and sd forms
+var ssePrefixes = map[string]byte{"ps": 0, "pd": 0x66, "ss": 0xF3, "sd": 0xF2}
+
+// asmSSE are the SSE instructions with an XMM register and an XMM register
+// or memory operand
+var asmSSE = func() map[string]sseForm {
+	forms := map[string]sseForm{
+		"movss": {0xF3, 0x10, 0x11}, "movsd": {0xF2, 0x10, 0x11},
+		"movups": {0, 0x10, 0x11}, "movupd": {0x66, 0x10, 0x11},
+		"movaps": {0, 0x28, 0x29}, "movapd": {0x66, 0x28, 0x29},
+		"movdqa": {0x66, 0x6F, 0x7F}, "movdqu": {0xF3, 0x6F, 0x7F},
+		"cvtps2pd": {0, 0x5A, 0}, "cvtpd2ps": {0x66, 0x5A, 0},
+		"cvtss2sd": {0xF3, 0x5A, 0}, "cvtsd2ss": {0xF2, 0x5A, 0},
+		"ucomiss": {0, 0x2E, 0}, "ucomisd": {0x66, 0x2E, 0},
+		"comiss": {0, 0x2F, 0}, "comisd": {0x66, 0x2F, 0},
+		"pxor": {0x66, 0xEF, 0},
+	}
+	arith := map[string]byte{"sqrt": 0x51, "add": 0x58, "mul": 0x59, "sub": 0x5C, "min": 0x5D, "div": 0x5E, "max": 0x5F}
+	for name, op := range arith {
+		for suffix, prefix := range ssePrefixes {
+			forms[name+suffix] = sseForm{prefix, op, 0}
+		}
+	}
+	for name, op := range map[string]byte{"and": 0x54, "andn": 0x55, "or": 0x56, "xor": 0x57} {
+		forms[name+"ps"] = sseForm{0, op, 0}
+		forms[name+"pd"] = sseForm{0x66, op, 0}
+	}
+	return forms
+}()
+
+var asmNoOperand = map[string][]byte{
+	"ret":     {0xC3},
+	"nop":     {0x90},
+	"leave":   {0xC9},
+	"ud2":     {0x0F, 0x0B},
+	"int3":    {0xCC},
+	"syscall": {0x0F, 0x05},
+	"cqo":     {0x48, 0x99},
+	"cdq":     {0x99},
+	"endbr64": {0xF3, 0x0F, 0x1E, 0xFA},
+}
+
+func (a *assembler) line(line string) error {
+	a.lineNo++
+	if i := strings.IndexAny(line, ";#"); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+
+	// Leading labels
+	for {
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !isAsmIdent(strings.TrimSpace(line[:i])) {
+			break
+		}
+		name := strings.TrimSpace(line[:i])
+		if _, dup := a.labels[name]; dup {
+			return fmt.Errorf("label %s defined twice", name)
+		}
+		a.labels[name] = a.buf.Len()
+		line = strings.TrimSpace(line[i+1:])
+	}
+	if line == "" {
+		return nil
+	}
+	line, a.disp32 = strings.CutPrefix(line, "{disp32}")
+	line = strings.TrimSpace(line)
+
+	mnemonic, rest := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		mnemonic, rest = line[:i], strings.TrimSpace(line[i:])
+	}
+	mnemonic = strings.ToLower(mnemonic)
+	var ops []operand
+	if rest != "" {
+		for _, s := range strings.Split(rest, ",") {
+			op, err := parseOperand(strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			ops = append(ops, op)
+		}
+	}
+	return a.instruction(mnemonic, ops)
+}
+
+func (a *assembler) instruction(mnemonic string, ops []operand) error {
+	if ok, err := a.sse(mnemonic, ops); ok {
+		return err
+	}
+	for _, op := range ops {
+		if isXMM(op) {
+			return fmt.Errorf("%s doesn't take an XMM register", mnemonic)
+		}
+	}
+
+	if enc, ok := asmNoOperand[mnemonic]; ok {
+		if len(ops) != 0 {
+			return fmt.Errorf("%s takes no operands", mnemonic)
+		}
+		a.buf.Write(enc)
+		return nil
+	}
+
+	switch {
+	case mnemonic == "jmp" || mnemonic == "call":
+		if len(ops) != 1 {
+			return fmt.Errorf("%s takes one operand", mnemonic)
+		}
+		digit, opcode := byte(4), byte(0xE9)
+		if mnemonic == "call" {
+			digit, opcode = 2, 0xE8
+		}
+		if ops[0].kind == opSym {
+			a.buf.WriteByte(opcode)
+			a.branchTo(ops[0].sym, true)
+			return nil
+		}
+		if ops[0].kind == opReg && ops[0].size != 8 {
+			return fmt.Errorf("%s through a register takes a 64-bit register", mnemonic)
+		}
+		// Indirect; the operand is always 64-bit without REX.W
+		return a.encode(false, []byte{0xFF}, int(digit), ops[0], 0)
+
+	case strings.HasPrefix(mnemonic, "j"):
+		cc, ok := asmConds[mnemonic[1:]]
+		if !ok || len(ops) != 1 || ops[0].kind != opSym {
+			return fmt.Errorf("bad conditional jump %s", mnemonic)
+		}
+		a.buf.Write([]byte{0x0F, 0x80 | cc})
+		a.branchTo(ops[0].sym, false)
+		return nil
+
+	case strings.HasPrefix(mnemonic, "set"):
+		cc, ok := asmConds[mnemonic[3:]]
+		if !ok || len(ops) != 1 || ops[0].kind == opImm || ops[0].kind == opSym {
+			return fmt.Errorf("bad %s", mnemonic)
+		}
+		if ops[0].size != 1 && !(ops[0].kind == opMem && ops[0].size == 0) {
+			return fmt.Errorf("%s needs a byte operand", mnemonic)
+		}
+		return a.encode(false, []byte{0x0F, 0x90 | cc}, 0, ops[0], 0)
+
+	case strings.HasPrefix(mnemonic, "cmov"):
+		cc, ok := asmConds[mnemonic[4:]]
+		if !ok {
+			return fmt.Errorf("unknown instruction %s", mnemonic)
+		}
+		return a.regRM(mnemonic, []byte{0x0F, 0x40 | cc}, ops)
+	}
+
+	if digit, ok := asmALU[mnemonic]; ok {
+		return a.alu(mnemonic, digit, ops)
+	}
+	if digit, ok := asmShifts[mnemonic]; ok {
+		return a.shift(mnemonic, digit, ops)
+	}
+
+	switch mnemonic {
+	case "push", "pop":
+		if len(ops) != 1 || ops[0].kind != opReg || ops[0].size != 8 {
+			return fmt.Errorf("%s takes a 64-bit register", mnemonic)
+		}
+		if ops[0].reg >= 8 {
+			a.buf.WriteByte(0x41)
+		}
+		opcode := byte(0x50)
+		if mnemonic == "pop" {
+			opcode = 0x58
+		}
+		a.buf.WriteByte(opcode | byte(ops[0].reg&7))
+		return nil
+
+	case "inc", "dec", "neg", "not":
+		if len(ops) != 1 || ops[0].kind == opImm || ops[0].kind == opSym {
+			return fmt.Errorf("%s takes a register or memory operand", mnemonic)
+		}
+		enc := asmUnary[mnemonic]
+		opcode, digit := enc[0], enc[1]
+		size, err := operandSize(ops[0])
+		if err != nil {
+			return err
+		}
+		if size == 1 {
+			opcode &^= 1 // FE, F6: the byte forms
+		}
+		return a.encode(size == 8, []byte{opcode}, int(digit), ops[0], 0)
+
+	case "mov":
+		return a.mov(ops)
+
+	case "movabs":
+		if len(ops) != 2 || ops[0].kind != opReg || ops[0].size != 8 || ops[1].kind != opImm {
+			return fmt.Errorf("movabs takes a 64-bit register and an immediate")
+		}
+		a.buf.WriteByte(0x48 | byte(ops[0].reg>>3))
+		a.buf.WriteByte(0xB8 | byte(ops[0].reg&7))
+		binary.Write(&a.buf, binary.LittleEndian, ops[1].imm)
+		return nil
+
+	case "lea":
+		if len(ops) != 2 || ops[0].kind != opReg || ops[1].kind != opMem || ops[0].size == 1 {
+			return fmt.Errorf("lea takes a register and a memory operand")
+		}
+		return a.encode(ops[0].size == 8, []byte{0x8D}, ops[0].reg, ops[1], 0)
+
+	case "test":
+		if len(ops) != 2 || ops[1].kind != opReg || ops[0].kind == opImm || ops[0].kind == opSym {
+			return fmt.Errorf("test takes a register or memory operand and a register")
+		}
+		opcode := byte(0x85)
+		if ops[1].size == 1 {
+			opcode = 0x84
+		}
+		return a.encodeSized(ops[1].size, []byte{opcode}, ops[1], ops[0])
+
+	case "imul":
+		return a.regRM(mnemonic, []byte{0x0F, 0xAF}, ops)
+
+	case "movzx":
+		if len(ops) != 2 || ops[0].kind != opReg || ops[0].size < 4 {
+			return fmt.Errorf("movzx takes a 32- or 64-bit register destination")
+		}
+		if ops[1].size != 1 && !(ops[1].kind == opMem && ops[1].size == 0) {
+			return fmt.Errorf("movzx takes a byte source")
+		}
+		byteRegs := ops[1].kind == opReg && ops[1].reg >= 4
+		return a.encodeREX(ops[0].size == 8, byteRegs, []byte{0x0F, 0xB6}, ops[0].reg, ops[1], 0)
+	}
+	return fmt.Errorf("unknown instruction %s", mnemonic)
+}
+
+func isXMM(op operand) bool {
+	return op.kind == opReg && op.size == 16
+}
+
+// sse encodes mnemonic if it is an SSE instruction, reporting whether it
+// was
+func (a *assembler) sse(mnemonic string, ops []operand) (bool, error) {
+	// Prefix, REX.W, 0x0F-map opcode, ModRM reg and r/m, immediate size
+	emit := func(prefix byte, w bool, op byte, reg int, rm operand, immSize int) error {
+		if prefix != 0 {
+			a.buf.WriteByte(prefix)
+		}
+		return a.encodeREX(w, false, []byte{0x0F, op}, reg, rm, immSize)
+	}
+	xmmOrMem := func(op operand) bool { return isXMM(op) || op.kind == opMem }
+	// A general register or memory of 32 or 64 bits
+	gpr := func(op operand) bool {
+		return op.kind == opReg && (op.size == 4 || op.size == 8) || op.kind == opMem && (op.size == 4 || op.size == 8)
+	}
+
+	if form, ok := asmSSE[mnemonic]; ok {
+		switch {
+		case len(ops) != 2:
+		case isXMM(ops[0]) && xmmOrMem(ops[1]):
+			return true, emit(form.prefix, false, form.load, ops[0].reg, ops[1], 0)
+		case form.store != 0 && ops[0].kind == opMem && isXMM(ops[1]):
+			return true, emit(form.prefix, false, form.store, ops[1].reg, ops[0], 0)
+		}
+		return true, fmt.Errorf("bad operands for %s", mnemonic)
+	}
+
+	// cmpps, cmppd, cmpss and cmpsd, with the predicate as an immediate
+	if prefix, ok := ssePrefixes[strings.TrimPrefix(mnemonic, "cmp")]; ok && strings.HasPrefix(mnemonic, "cmp") {
+		if len(ops) != 3 || !isXMM(ops[0]) || !xmmOrMem(ops[1]) || ops[2].kind != opImm {
+			return true, fmt.Errorf("%s takes an XMM register, an XMM register or memory, and a predicate", mnemonic)
+		}
+		if err := emit(prefix, false, 0xC2, ops[0].reg, ops[1], 1); err != nil {
+			return true, err
+		}
+		a.buf.WriteByte(byte(ops[2].imm))
+		return true, nil
+	}
+
+	switch {
+	case mnemonic == "cvtsi2ss" || mnemonic == "cvtsi2sd":
+		if len(ops) != 2 || !isXMM(ops[0]) || !gpr(ops[1]) {
+			return true, fmt.Errorf("%s takes an XMM register and a 32- or 64-bit integer", mnemonic)
+		}
+		return true, emit(ssePrefixes[mnemonic[6:]], ops[1].size == 8, 0x2A, ops[0].reg, ops[1], 0)
+
+	case mnemonic == "cvtss2si" || mnemonic == "cvtsd2si" || mnemonic == "cvttss2si" || mnemonic == "cvttsd2si":
+		if len(ops) != 2 || ops[0].kind != opReg || !gpr(ops[0]) || !xmmOrMem(ops[1]) {
+			return true, fmt.Errorf("%s takes a 32- or 64-bit register and an XMM register or memory", mnemonic)
+		}
+		op := byte(0x2D)
+		if strings.HasPrefix(mnemonic, "cvtt") {
+			op = 0x2C
+		}
+		suffix := strings.TrimSuffix(mnemonic, "2si")
+		return true, emit(ssePrefixes[suffix[len(suffix)-2:]], ops[0].size == 8, op, ops[0].reg, ops[1], 0)
+
+	case mnemonic == "movd" || mnemonic == "movq":
+		size := map[string]int{"movd": 4, "movq": 8}[mnemonic]
+		isInt := func(op operand) bool { return op.kind == opReg && op.size == size || op.kind == opMem }
+		switch {
+		case len(ops) != 2:
+		case size == 8 && isXMM(ops[0]) && xmmOrMem(ops[1]):
+			return true, emit(0xF3, false, 0x7E, ops[0].reg, ops[1], 0)
+		case size == 8 && ops[0].kind == opMem && isXMM(ops[1]):
+			return true, emit(0x66, false, 0xD6, ops[1].reg, ops[0], 0)
+		case isXMM(ops[0]) && isInt(ops[1]):
+			return true, emit(0x66, size == 8, 0x6E, ops[0].reg, ops[1], 0)
+		case isInt(ops[0]) && isXMM(ops[1]):
+			return true, emit(0x66, size == 8, 0x7E, ops[1].reg, ops[0], 0)
+		}
+		return true, fmt.Errorf("bad operands for %s", mnemonic)
+	}
+	return false, nil
+}
+
+// branchTo emits a rel32 placeholder aimed at a label. An external branch
+// may leave the routine, to a symbol the linker resolves.
+func (a *assembler) branchTo(label string, external bool) {
+	a.fixups = append(a.fixups, asmFixup{
+		offset:   a.buf.Len(),
+		label:    label,
+		external: external,
+		line:     a.lineNo,
+	})
+	a.buf.Write([]byte{0, 0, 0, 0})
+}
+
+// regRM encodes a register destination and register or memory source
+// (imul, cmov)
+func (a *assembler) regRM(mnemonic string, opcode []byte, ops []operand) error {
+	if len(ops) != 2 || ops[0].kind != opReg || ops[0].size == 1 {
+		return fmt.Errorf("%s takes a 32- or 64-bit register destination", mnemonic)
+	}
+	if ops[1].kind == opImm || ops[1].kind == opSym {
+		return fmt.Errorf("%s takes a register or memory source", mnemonic)
+	}
+	if ops[1].kind == opReg && ops[1].size != ops[0].size {
+		return fmt.Errorf("%s operand sizes differ", mnemonic)
+	}
+	return a.encode(ops[0].size == 8, opcode, ops[0].reg, ops[1], 0)
+}
+
+func (a *assembler) alu(mnemonic string, digit byte, ops []operand) error {
+	if len(ops) != 2 {
+		return fmt.Errorf("%s takes two operands", mnemonic)
+	}
+	dst, src := ops[0], ops[1]
+	switch {
+	case src.kind == opImm:
+		size, err := operandSize(dst)
+		if err != nil {
+			return err
+		}
+		if dst.kind == opSym {
+			return fmt.Errorf("%s destination is a symbol", mnemonic)
+		}
+		switch {
+		case dst.kind == opReg && dst.reg == RAX && size == 1:
+			// The accumulator forms, without a ModRM byte, which as
+			// picks whenever it can
+			a.buf.Write([]byte{digit<<3 | 4, byte(src.imm)})
+			return nil
+		case size == 1:
+			return a.encodeImm(size, 0x80, digit, dst, src.imm, 1)
+		case src.imm >= -128 && src.imm <= 127:
+			return a.encodeImm(size, 0x83, digit, dst, src.imm, 1)
+		case dst.kind == opReg && dst.reg == RAX:
+			if src.imm < -1<<31 || src.imm > 1<<32-1 || size == 8 && src.imm > 1<<31-1 {
+				return fmt.Errorf("immediate %d out of range", src.imm)
+			}
+			if size == 8 {
+				a.buf.WriteByte(0x48)
+			}
+			a.buf.WriteByte(digit<<3 | 5)
+			binary.Write(&a.buf, binary.LittleEndian, uint32(src.imm))
+			return nil
+		default:
+			return a.encodeImm(size, 0x81, digit, dst, src.imm, 4)
+		}
+	case src.kind == opReg && dst.kind != opImm && dst.kind != opSym:
+		return a.encodeSized(src.size, []byte{digit<<3 | 1}, src, dst)
+	case dst.kind == opReg && src.kind == opMem:
+		return a.encodeSized(dst.size, []byte{digit<<3 | 3}, dst, src)
+	}
+	return fmt.Errorf("bad operands for %s", mnemonic)
+}
+
+func (a *assembler) shift(mnemonic string, digit byte, ops []operand) error {
+	if len(ops) != 2 || ops[0].kind == opImm || ops[0].kind == opSym {
+		return fmt.Errorf("%s takes a register or memory operand and a count", mnemonic)
+	}
+	size, err := operandSize(ops[0])
+	if err != nil {
+		return err
+	}
+	switch count := ops[1]; {
+	case count.kind == opImm && count.imm == 1:
+		// The shift-by-one form as picks
+		opcode := byte(0xD1)
+		if size == 1 {
+			opcode = 0xD0
+		}
+		return a.encode(size == 8, []byte{opcode}, int(digit), ops[0], 0)
+	case count.kind == opImm:
+		opcode := byte(0xC1)
+		if size == 1 {
+			opcode = 0xC0
+		}
+		return a.encodeImm(size, opcode, digit, ops[0], count.imm, 1)
+	case count.kind == opReg && count.reg == RCX && count.size == 1:
+		opcode := byte(0xD3)
+		if size == 1 {
+			opcode = 0xD2
+		}
+		return a.encode(size == 8, []byte{opcode}, int(digit), ops[0], 0)
+	}
+	return fmt.Errorf("%s count must be an immediate or cl", mnemonic)
+}
+
+func (a *assembler) mov(ops []operand) error {
+	if len(ops) != 2 {
+		return fmt.Errorf("mov takes two operands")
+	}
+	dst, src := ops[0], ops[1]
+	switch {
+	case src.kind == opImm && dst.kind == opReg:
+		switch {
+		case dst.size == 1:
+			if dst.reg >= 4 {
+				a.buf.WriteByte(0x40 | byte(dst.reg>>3))
+			}
+			a.buf.WriteByte(0xB0 | byte(dst.reg&7))
+			a.buf.WriteByte(byte(src.imm))
+		case dst.size == 8 && (src.imm < -1<<31 || src.imm > 1<<31-1):
+			// movabs
+			a.buf.WriteByte(0x48 | byte(dst.reg>>3))
+			a.buf.WriteByte(0xB8 | byte(dst.reg&7))
+			binary.Write(&a.buf, binary.LittleEndian, src.imm)
+		case dst.size == 8:
+			// mov r/m64, imm32 sign-extends
+			return a.encodeImm(8, 0xC7, 0, dst, src.imm, 4)
+		case src.imm < -1<<31 || src.imm > 1<<32-1:
+			return fmt.Errorf("immediate %d out of range", src.imm)
+		default:
+			if dst.reg >= 8 {
+				a.buf.WriteByte(0x41)
+			}
+			a.buf.WriteByte(0xB8 | byte(dst.reg&7))
+			binary.Write(&a.buf, binary.LittleEndian, uint32(src.imm))
+		}
+		return nil
+	case src.kind == opImm && dst.kind == opMem:
+		size, err := operandSize(dst)
+		if err != nil {
+			return err
+		}
+		if size == 1 {
+			return a.encodeImm(size, 0xC6, 0, dst, src.imm, 1)
+		}
+		return a.encodeImm(size, 0xC7, 0, dst, src.imm, 4)
+	case src.kind == opReg && (dst.kind == opReg || dst.kind == opMem):
+		opcode := byte(0x89)
+		if src.size == 1 {
+			opcode = 0x88
+		}
+		return a.encodeSized(src.size, []byte{opcode}, src, dst)
+	case dst.kind == opReg && src.kind == opMem:
+		opcode := byte(0x8B)
+		if dst.size == 1 {
+			opcode = 0x8A
+		}
+		return a.encodeSized(dst.size, []byte{opcode}, dst, src)
+	}
+	return fmt.Errorf("bad operands for mov")
+}
+
+// encodeSized encodes an instruction whose ModRM reg field is the register
+// reg, checking a register r/m operand has the same size
+func (a *assembler) encodeSized(size int, opcode []byte, reg, rm operand) error {
+	if rm.kind == opReg && rm.size != size {
+		return fmt.Errorf("operand sizes differ")
+	}
+	if rm.kind == opMem && rm.size != 0 && rm.size != size {
+		return fmt.Errorf("operand sizes differ")
+	}
+	byteRegs := size == 1 && (reg.reg >= 4 || rm.kind == opReg && rm.reg >= 4)
+	return a.encodeREX(size == 8, byteRegs, opcode, reg.reg, rm, 0)
+}
+
+// encodeImm encodes opcode /digit rm followed by an immediate of immSize
+// bytes
+func (a *assembler) encodeImm(size int, opcode, digit byte, rm operand, imm int64, immSize int) error {
+	if immSize == 4 && (imm < -1<<31 || imm > 1<<32-1 || size == 8 && imm > 1<<31-1) {
+		return fmt.Errorf("immediate %d out of range", imm)
+	}
+	byteRegs := size == 1 && rm.kind == opReg && rm.reg >= 4
+	if err := a.encodeREX(size == 8, byteRegs, []byte{opcode}, int(digit), rm, immSize); err != nil {
+		return err
+	}
+	if immSize == 1 {
+		a.buf.WriteByte(byte(imm))
+	} else {
+		binary.Write(&a.buf, binary.LittleEndian, uint32(imm))
+	}
+	return nil
+}
+
+func (a *assembler) encode(w bool, opcode []byte, reg int, rm operand, immSize int) error {
+	byteRegs := rm.kind == opReg && rm.size == 1 && rm.reg >= 4
+	return a.encodeREX(w, byteRegs, opcode, reg, rm, immSize)
+}
+
+// encodeREX emits [REX] opcode ModRM [SIB] [disp]. byteRegs forces a REX
+// prefix so register numbers 4-7 mean spl, bpl, sil and dil. immSize is the
+// length of any immediate that follows, which a RIP-relative displacement
+// must account for.
+func (a *assembler) encodeREX(w, byteRegs bool, opcode []byte, reg int, rm operand, immSize int) error {
+	rex := byte(0)
+	if w {
+		rex |= 0x08
+	}
+	rex |= byte(reg>>3) << 2
+	switch rm.kind {
+	case opReg:
+		rex |= byte(rm.reg >> 3)
+	case opMem:
+		if rm.index >= 0 {
+			rex |= byte(rm.index>>3) << 1
+		}
+		if rm.base >= 0 && rm.base != ripBase {
+			rex |= byte(rm.base >> 3)
+		}
+	default:
+		return fmt.Errorf("operand must be a register or memory")
+	}
+	if rex != 0 || byteRegs {
+		a.buf.WriteByte(0x40 | rex)
+	}
+	a.buf.Write(opcode)
+
+	regBits := byte(reg&7) << 3
+	if rm.kind == opReg {
+		a.buf.WriteByte(0xC0 | regBits | byte(rm.reg&7))
+		return nil
+	}
+
+	if rm.disp < -1<<31 || rm.disp > 1<<31-1 {
+		return fmt.Errorf("displacement %d out of range", rm.disp)
+	}
+	disp := int32(rm.disp)
+	switch {
+	case rm.base == ripBase:
+		a.buf.WriteByte(regBits | 0x05)
+		if rm.sym != "" {
+			a.relocs = append(a.relocs, Relocation{
+				Offset:     uint64(a.buf.Len()),
+				SymbolName: rm.sym,
+				Type:       R_X86_64_PC32,
+				Addend:     int64(disp) - 4 - int64(immSize),
+			})
+			disp = 0
+		}
+		binary.Write(&a.buf, binary.LittleEndian, disp)
+
+	case rm.base < 0:
+		// [index*scale + disp32], or absolute [disp32]
+		index := byte(4) // None
+		if rm.index >= 0 {
+			index = byte(rm.index & 7)
+		}
+		a.buf.WriteByte(regBits | 0x04)
+		a.buf.WriteByte(scaleBits(rm.scale)<<6 | index<<3 | 0x05)
+		binary.Write(&a.buf, binary.LittleEndian, disp)
+
+	default:
+		mod := byte(0x80)
+		switch {
+		case a.disp32:
+		case disp == 0 && rm.base&7 != RBP:
+			mod = 0x00
+		case disp >= -128 && disp <= 127:
+			mod = 0x40
+		}
+		if rm.index >= 0 || rm.base&7 == RSP {
+			index := byte(4)
+			if rm.index >= 0 {
+				index = byte(rm.index & 7)
+			}
+			a.buf.WriteByte(mod | regBits | 0x04)
+			a.buf.WriteByte(scaleBits(rm.scale)<<6 | index<<3 | byte(rm.base&7))
+		} else {
+			a.buf.WriteByte(mod | regBits | byte(rm.base&7))
+		}
+		switch mod {
+		case 0x40:
+			a.buf.WriteByte(byte(disp))
+		case 0x80:
+			binary.Write(&a.buf, binary.LittleEndian, disp)
+		}
+	}
+	return nil
+}
+
+func scaleBits(scale int) byte {
+	switch scale {
+	case 2:
+		return 1
+	case 4:
+		return 2
+	case 8:
+		return 3
+	}
+	return 0
+}
+
+// operandSize is the size of a register or explicitly sized memory operand
+func operandSize(op operand) (int, error) {
+	if op.size == 0 {
+		return 0, fmt.Errorf("operand size unspecified; use qword, dword or byte")
+	}
+	return op.size, nil
+}
+
+func parseOperand(s string) (operand, error) {
+	size := 0
+	lower := strings.ToLower(s)
+	for name, n := range map[string]int{"xmmword": 16, "qword": 8, "dword": 4, "byte": 1} {
+		if strings.HasPrefix(lower, name+" ") || strings.HasPrefix(lower, name+"[") {
+			size = n
+			s = strings.TrimSpace(s[len(name):])
+			lower = strings.ToLower(s)
+			if strings.HasPrefix(lower, "ptr") {
+				s = strings.TrimSpace(s[3:])
+			}
+			break
+		}
+	}
+
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		op, err := parseMemory(s[1 : len(s)-1])
+		op.size = size
+		return op, err
+	}
+	if size != 0 {
+		return operand{}, fmt.Errorf("size given for non-memory operand %q", s)
+	}
+	if r, ok := asmRegs[strings.ToLower(s)]; ok {
+		return r, nil
+	}
+	if n, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return operand{kind: opImm, imm: n}, nil
+	}
+	if u, err := strconv.ParseUint(s, 0, 64); err == nil {
+		return operand{kind: opImm, imm: int64(u)}, nil
+	}
+	if isAsmIdent(s) {
+		return operand{kind: opSym, sym: s}, nil
+	}
+	return operand{}, fmt.Errorf("bad operand %q", s)
+}
+
+// parseMemory parses the inside of [...]: a sum of a base register, an
+// index register with optional scale, and constants, or rip plus a symbol
+func parseMemory(s string) (operand, error) {
+	op := operand{kind: opMem, base: -1, index: -1, scale: 1}
+	s = strings.ReplaceAll(s, "-", "+-")
+	for _, term := range strings.Split(s, "+") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		if n, err := strconv.ParseInt(strings.ReplaceAll(term, " ", ""), 0, 64); err == nil {
+			op.disp += n
+			continue
+		}
+		name, scale, scaled := strings.Cut(term, "*")
+		name, scale = strings.TrimSpace(name), strings.TrimSpace(scale)
+		if _, ok := asmRegs[strings.ToLower(name)]; !ok && scaled {
+			name, scale = scale, name // 8*rcx
+		}
+		if strings.ToLower(name) == "rip" {
+			if op.base >= 0 || scaled {
+				return op, fmt.Errorf("bad rip-relative operand")
+			}
+			op.base = ripBase
+			continue
+		}
+		r, ok := asmRegs[strings.ToLower(name)]
+		switch {
+		case ok && r.size == 8 && !scaled && op.base < 0:
+			op.base = r.reg
+		case ok && r.size == 8 && op.index < 0 && r.reg != RSP:
+			op.index = r.reg
+			if scaled {
+				n, err := strconv.Atoi(scale)
+				if err != nil || n != 1 && n != 2 && n != 4 && n != 8 {
+					return op, fmt.Errorf("bad scale %q", scale)
+				}
+				op.scale = n
+			}
+		case !ok && !scaled && isAsmIdent(name) && op.sym == "":
+			op.sym = name
+		default:
+			return op, fmt.Errorf("bad memory operand term %q", term)
+		}
+	}
+	if op.sym != "" && op.base != ripBase {
+		return op, fmt.Errorf("symbol %s must be addressed relative to rip", op.sym)
+	}
+	if op.base == ripBase && op.index >= 0 {
+		return op, fmt.Errorf("rip-relative operand can't have an index")
+	}
+	return op, nil
+}
+
+func isAsmIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		switch {
+		case r == '_' || r == '.' || r == '$' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z':
+		case i > 0 && r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -4,16 +4,72 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
+	"sort"
 
 	"github.com/arc-language/core-builder/ir"
 	"github.com/arc-language/core-builder/types"
 )
 
 type Artifact struct {
-	TextBuffer  []byte
-	DataBuffer  []byte
-	Symbols     []SymbolDef
-	Relocations []Relocation
+	TextBuffer   []byte
+	ColdBuffer   []byte // Blocks outlined from their functions (.text.unlikely)
+	DataBuffer   []byte
+	RelroBuffer  []byte           // Constant data holding addresses (.data.rel.ro)
+	RodataBuffer []byte           // Read-only constants the code refers to (.rodata)
+	TDataBuffer  []byte           // Initialized thread-local data (.tdata)
+	TBSSSize     uint64           // Size of zero-initialized thread-local data (.tbss)
+	DataAlign    uint64           // Largest alignment a .data or .data.rel.ro global needs
+	TLSAlign     uint64           // Largest alignment a thread-local global needs
+	Strings      []StringConstant // Read-only C strings; the object writer places them
+	Symbols      []SymbolDef
+	Relocations  []Relocation
+	Ranges       []FunctionRange // Where each IR instruction landed in TextBuffer
+	TextSections []TextSection   // Code of the functions Options.TextSections places
+
+	EhFrameBuffer     []byte // Unwind tables (.eh_frame); see unwind.go
+	ExceptTableBuffer []byte // LSDAs of functions with invokes (.gcc_except_table)
+}
+
+// FunctionRange maps a compiled function to its bytes in .text. Bytes in
+// [Start, Blocks[0].Start) are the prologue and argument spills.
+type FunctionRange struct {
+	Func    *ir.Function
+	Start   int
+	End     int
+	Blocks  []BlockRange
+	Section string // The function's entry in TextSections; empty for .text
+}
+
+// TextSection is the code of the functions placed in a section named
+// other than .text, in the order they were compiled
+type TextSection struct {
+	Name string
+	Data []byte
+}
+
+type BlockRange struct {
+	Block        *ir.BasicBlock
+	Start        int
+	Instructions []InstructionRange
+	Cold         bool // Offsets are into ColdBuffer rather than TextBuffer
+}
+
+// InstructionRange is the half-open byte range [Start, End) one IR
+// instruction lowered to. Empty for instructions that emit nothing.
+type InstructionRange struct {
+	Inst  ir.Instruction
+	Start int
+	End   int
+}
+
+// StringConstant is a constant global holding a NUL-terminated string.
+// Value excludes the terminator. Identical strings may share storage.
+type StringConstant struct {
+	Name       string
+	Value      string
+	Visibility ir.Visibility
+	Local      bool // Internal or private linkage
 }
 
 type SymbolDef struct {
@@ -22,6 +78,14 @@ type SymbolDef struct {
 	Size     uint64
 	IsFunc   bool
 	IsGlobal bool
+	IsTLS    bool
+	IsExtern bool   // Declared here but defined in another object
+	IsWeak   bool   // With IsExtern, a reference that may stay undefined and resolve to 0
+	IsCommon bool   // Tentative definition the linker allocates; Offset is its alignment
+	Local    bool   // A function with internal or private linkage
+	Section  string // Containing section; empty means .text or .data
+
+	Visibility ir.Visibility
 }
 
 type Relocation struct {
@@ -29,94 +93,734 @@ type Relocation struct {
 	SymbolName string
 	Type       RelocationType
 	Addend     int64
+	Section    string // Section patched at Offset; empty means .text
 }
 
+// coldSection holds blocks outlined from their functions
+const coldSection = ".text.unlikely"
+
+// relroSection holds constant globals whose initializers contain addresses.
+// The dynamic loader writes those before the linker's RELRO segment makes
+// them read-only, so they can't go in .rodata.
+const relroSection = ".data.rel.ro"
+
 type RelocationType int
 
 const (
-	R_X86_64_PC32  RelocationType = 2
-	R_X86_64_PLT32 RelocationType = 4
+	R_X86_64_64        RelocationType = 1
+	R_X86_64_PC32      RelocationType = 2
+	R_X86_64_PLT32     RelocationType = 4
+	R_X86_64_GLOB_DAT  RelocationType = 6 // Dynamic: a GOT entry, set to a symbol's address
+	R_X86_64_JUMP_SLOT RelocationType = 7 // Dynamic: a PLT's GOT entry, bound on first call
+	R_X86_64_GOTPCREL  RelocationType = 9
+	R_X86_64_32S       RelocationType = 11
+	R_X86_64_TLSGD     RelocationType = 19
+	R_X86_64_TPOFF32   RelocationType = 23
 )
 
 type compiler struct {
-	text         *bytes.Buffer
-	data         *bytes.Buffer
-	currentFunc  *ir.Function
-	stackMap     map[ir.Value]int // Value -> RBP offset (negative)
-	allocaOffsets map[*ir.AllocaInst]int // AllocaInst -> RBP offset (negative)
-	blockOffsets map[*ir.BasicBlock]int
-	fixups       []jumpFixup
-	relocations  []Relocation
-	currentFrame int
-	nextTemp     int
+	text           *bytes.Buffer
+	coldText       *bytes.Buffer // Swapped with text while cold blocks are emitted
+	data           *bytes.Buffer
+	dataSection    string // Section data holds, for relocations in initializers
+	relro          *bytes.Buffer
+	rodata         *bytes.Buffer
+	tdata          *bytes.Buffer
+	tbssSize       int
+	dataAlign      int
+	tlsAlign       int
+	opts           Options
+	currentFunc    *ir.Function
+	stackMap       map[ir.Value]int       // Value -> RBP offset (negative)
+	allocaOffsets  map[*ir.AllocaInst]int // AllocaInst -> RBP offset (negative)
+	blockOffsets   map[*ir.BasicBlock]int
+	fixups         []jumpFixup
+	tableFixups    []tableFixup
+	relocations    []Relocation
+	currentFrame   int
+	omitFP         bool // Frame slots are addressed from RSP; see emitFrameDisp
+	nextTemp       int
+	tlsSlots       map[*ir.Global]int          // TLS global -> RBP offset of its cached address
+	varargs        *varargFrame                // Nil unless the function is variadic
+	sretSlot       int                         // RBP offset of the caller's return buffer address; 0 unless returning in memory
+	sretBuffers    map[*ir.CallInst]int        // Call returning in memory -> RBP offset of its buffer
+	insertBuffers  map[*ir.InsertValueInst]int // Memory-backed insertvalue -> RBP offset of its result
+	canarySlot     int                         // RBP offset of the stack protector's canary; 0 if none
+	fusedLoads     map[*ir.LoadInst]bool       // Loads folded into the extend that follows
+	fusedCompares  map[*ir.ICmpInst]bool       // Compares folded into the branch that follows
+	rodataPool     map[string]int              // Pooled constant's bytes -> its .rodata offset
+	localFuncs     map[string]bool             // CompileContext.LocalFunctions, the caller's map
+	nextBlock      *ir.BasicBlock              // Block emitted after the current one
+	lastResult     ir.Value                    // Value RAX holds while c.text ends at lastResultEnd; see loadToReg
+	lastResultEnd  int
+	coldBlocks     map[*ir.BasicBlock]bool  // Blocks emitted into coldText
+	textSection    string                   // Section text holds; empty for .text
+	sectionText    map[string]*bytes.Buffer // Code of Options.TextSections, by section
+	sectionOrder   []string
+	ranges         []FunctionRange
+	unwind         unwindInfo // The current function's frame setup and call sites
+	ehFrame        *bytes.Buffer
+	exceptTable    *bytes.Buffer
+	plainCIE       int // .eh_frame offsets of the CIEs, -1 until first used
+	personalityCIE int
 }
 
 type jumpFixup struct {
 	offset int
 	target *ir.BasicBlock
+	cold   bool // The jump is in coldText
+}
+
+// tableFixup is a jump table entry at .rodata+offset, holding the distance
+// from the table at .rodata+table to target
+type tableFixup struct {
+	offset int
+	table  int
+	target *ir.BasicBlock
+}
+
+// CompileContext is what compiling functions one at a time needs from the
+// rest of the program, shared between the calls: the code generation
+// options and the functions the static linker will find next to them.
+// Type layout needs nothing shared, being computed from the types alone,
+// and globals are referred to by name, through relocations the linker
+// resolves against wherever they were compiled.
+type CompileContext struct {
+	Options Options
+
+	// LocalFunctions names the functions that will resolve to a definition
+	// in the same component as the code being compiled, which calls and
+	// address references reach directly rather than through the PLT or
+	// GOT. A JIT adds each function as it defines it, between calls: the
+	// compiler reads the map itself rather than a copy, so it must not
+	// change while a call is compiling.
+	LocalFunctions map[string]bool
+}
+
+// NewCompileContext returns the context Compile uses for m's functions:
+// opts, with the functions of m that bind locally as local
+func NewCompileContext(m *ir.Module, opts Options) *CompileContext {
+	local := make(map[string]bool)
+	for _, fn := range m.Functions {
+		if BindsLocally(fn) {
+			local[fn.Name()] = true
+		}
+	}
+	return &CompileContext{Options: opts, LocalFunctions: local}
+}
+
+// BindsLocally reports whether references to fn always resolve within the
+// component it is linked into: when it is defined with internal or private
+// linkage, or is hidden or protected. A default-visibility function may be
+// preempted by another component's definition, so in a shared object only
+// the PLT or GOT can reach it, and the linker rejects a direct reference.
+func BindsLocally(fn *ir.Function) bool {
+	if fn.Linkage == ir.ExternalWeakLinkage {
+		return false // May stay undefined
+	}
+	if fn.Visibility != ir.DefaultVisibility {
+		return true
+	}
+	return len(fn.Blocks) > 0 && (fn.Linkage == ir.InternalLinkage || fn.Linkage == ir.PrivateLinkage)
+}
+
+func newCompiler(ctx *CompileContext) *compiler {
+	return &compiler{
+		text:        new(bytes.Buffer),
+		coldText:    new(bytes.Buffer),
+		data:        new(bytes.Buffer),
+		dataSection: ".data",
+		relro:       new(bytes.Buffer),
+		rodata:      new(bytes.Buffer),
+		tdata:       new(bytes.Buffer),
+		ehFrame:     new(bytes.Buffer),
+		exceptTable: new(bytes.Buffer),
+		opts:        ctx.Options,
+
+		plainCIE:       -1,
+		personalityCIE: -1,
+
+		rodataPool: make(map[string]int),
+		localFuncs: ctx.LocalFunctions,
+	}
 }
 
 func Compile(m *ir.Module) (*Artifact, error) {
-	c := &compiler{
-		text: new(bytes.Buffer),
-		data: new(bytes.Buffer),
+	return CompileWithOptions(m, Options{})
+}
+
+// CompileWithOptions is Compile with explicit code generation options
+func CompileWithOptions(m *ir.Module, opts Options) (*Artifact, error) {
+	for name := range opts.AsmFunctions {
+		if fn := m.GetFunction(name); fn != nil && len(fn.Blocks) > 0 {
+			return nil, fmt.Errorf("function %s is defined both in IR and in assembly", name)
+		}
 	}
+	// Calls to the module's own functions are resolved by the static
+	// linker; know them before the first call site is compiled
+	c := newCompiler(NewCompileContext(m, opts))
 
 	var symbols []SymbolDef
+	var strs []StringConstant
 
 	// Compile global variables first
 	for _, g := range m.Globals {
-		// Align to 8 bytes
-		for c.data.Len()%8 != 0 {
-			c.data.WriteByte(0)
+		if isDeclaration(g) {
+			symbols = append(symbols, SymbolDef{
+				Name:     g.Name(),
+				IsGlobal: true,
+				IsExtern: true,
+				IsWeak:   g.Linkage == ir.ExternalWeakLinkage,
+
+				Visibility: g.Visibility,
+			})
+			continue
+		}
+		if a := g.Alignment; a < 0 || a&(a-1) != 0 {
+			return nil, fmt.Errorf("in global %s: alignment %d is not a power of two", g.Name(), a)
+		}
+		if g.Linkage == ir.CommonLinkage {
+			sym, err := commonSymbol(g)
+			if err != nil {
+				return nil, fmt.Errorf("in global %s: %w", g.Name(), err)
+			}
+			symbols = append(symbols, sym)
+			continue
+		}
+		if s, ok := cString(g); ok {
+			strs = append(strs, StringConstant{
+				Name:       g.Name(),
+				Value:      s,
+				Visibility: g.Visibility,
+				Local:      g.Linkage == ir.InternalLinkage || g.Linkage == ir.PrivateLinkage,
+			})
+			continue
+		}
+		if g.ThreadLocal {
+			sym, err := c.compileTLSGlobal(g)
+			if err != nil {
+				return nil, fmt.Errorf("in global %s: %w", g.Name(), err)
+			}
+			symbols = append(symbols, sym)
+			continue
 		}
 
-		offset := c.data.Len()
-		
-		if err := c.compileGlobal(g); err != nil {
+		sym, err := c.compileDataGlobal(g)
+		if err != nil {
 			return nil, fmt.Errorf("in global %s: %w", g.Name(), err)
 		}
-		
-		size := c.data.Len() - offset
-		symbols = append(symbols, SymbolDef{
-			Name:     g.Name(),
-			Offset:   uint64(offset),
-			Size:     uint64(size),
-			IsGlobal: true,
-			IsFunc:   false,
-		})
+		symbols = append(symbols, sym)
 	}
 
 	// Compile functions
 	for _, fn := range m.Functions {
-		if len(fn.Blocks) == 0 {
-			continue // External declaration
+		syms, err := c.compileFunctionSymbols(fn)
+		if err != nil {
+			return nil, err
 		}
+		symbols = append(symbols, syms...)
+	}
 
-		startOff := c.text.Len()
-		if err := c.compileFunction(fn); err != nil {
-			return nil, fmt.Errorf("in function %s: %w", fn.Name(), err)
+	asmSyms, err := c.emitAsmFunctions(m)
+	if err != nil {
+		return nil, err
+	}
+	symbols = append(symbols, asmSyms...)
+
+	if c.opts.EmitStart {
+		sym, err := c.emitStartStub(m)
+		if err != nil {
+			return nil, err
 		}
-		
-		endOff := c.text.Len()
+		symbols = append(symbols, sym)
+	}
 
-		symbols = append(symbols, SymbolDef{
+	return c.artifact(strs, symbols), nil
+}
+
+// CompileFunction compiles fn on its own, as Compile compiles each function
+// of a module, for a JIT or to recompile one function of a program. The
+// artifact holds its code, the constants it pools in .rodata, its unwind
+// tables and its symbols; the globals it uses and the functions it calls
+// are left to its relocations. A nil ctx has every call go through the
+// PLT. The module-wide options, EmitStart and AsmFunctions, do nothing.
+func CompileFunction(fn *ir.Function, ctx *CompileContext) (*Artifact, error) {
+	if len(fn.Blocks) == 0 {
+		return nil, fmt.Errorf("function %s is a declaration, with no body to compile", fn.Name())
+	}
+	if ctx == nil {
+		ctx = &CompileContext{}
+	}
+	c := newCompiler(ctx)
+	symbols, err := c.compileFunctionSymbols(fn)
+	if err != nil {
+		return nil, err
+	}
+	return c.artifact(nil, symbols), nil
+}
+
+// artifact collects what c compiled, with the given strings and symbols
+func (c *compiler) artifact(strs []StringConstant, symbols []SymbolDef) *Artifact {
+	var sections []TextSection
+	for _, name := range c.sectionOrder {
+		sections = append(sections, TextSection{Name: name, Data: c.sectionText[name].Bytes()})
+	}
+
+	return &Artifact{
+		TextBuffer:   c.text.Bytes(),
+		ColdBuffer:   c.coldText.Bytes(),
+		DataBuffer:   c.data.Bytes(),
+		RelroBuffer:  c.relro.Bytes(),
+		RodataBuffer: c.rodata.Bytes(),
+		TDataBuffer:  c.tdata.Bytes(),
+		TBSSSize:     uint64(c.tbssSize),
+		DataAlign:    uint64(c.dataAlign),
+		TLSAlign:     uint64(c.tlsAlign),
+		Strings:      strs,
+		Symbols:      symbols,
+		Relocations:  c.relocations,
+		Ranges:       c.ranges,
+		TextSections: sections,
+
+		EhFrameBuffer:     c.ehFrame.Bytes(),
+		ExceptTableBuffer: c.exceptTable.Bytes(),
+	}
+}
+
+// compileFunctionSymbols compiles fn into c's buffers and returns the
+// symbols it defines: fn, and fn.cold for outlined blocks. A declaration
+// compiles to nothing, but a weak one needs its undefined symbol to say
+// it is weak; strong references are implied by the relocations.
+func (c *compiler) compileFunctionSymbols(fn *ir.Function) ([]SymbolDef, error) {
+	if len(fn.Blocks) == 0 {
+		if fn.Linkage != ir.ExternalWeakLinkage {
+			return nil, nil
+		}
+		return []SymbolDef{{
 			Name:     fn.Name(),
-			Offset:   uint64(startOff),
-			Size:     uint64(endOff - startOff),
 			IsFunc:   true,
-			IsGlobal: false, // Will be determined by linkage
+			IsGlobal: true,
+			IsExtern: true,
+			IsWeak:   true,
+
+			Visibility: fn.Visibility,
+		}}, nil
+	}
+
+	// A function placed in a section of its own is compiled into that
+	// section's buffer, which stands in for .text meanwhile
+	mainText := c.text
+	if name := c.opts.TextSections[fn.Name()]; name != "" && name != ".text" {
+		c.text = c.sectionBuffer(name)
+		c.textSection = name
+	}
+	if c.opts.FunctionAlign > 1 {
+		c.alignText(c.opts.FunctionAlign)
+	}
+	startOff := c.text.Len()
+	coldOff := c.coldText.Len()
+	relocs := len(c.relocations)
+	if err := c.compileFunction(fn); err != nil {
+		return nil, fmt.Errorf("in function %s: %w", fn.Name(), err)
+	}
+
+	endOff := c.text.Len()
+	coldEnd := c.coldText.Len()
+	if err := c.emitUnwindTables(startOff, endOff, coldOff, coldEnd); err != nil {
+		return nil, fmt.Errorf("in function %s: %w", fn.Name(), err)
+	}
+	section := c.textSection
+	for i := relocs; i < len(c.relocations); i++ {
+		if c.relocations[i].Section == "" {
+			c.relocations[i].Section = section
+		}
+	}
+	c.text, c.textSection = mainText, ""
+
+	var symbols []SymbolDef
+	if coldEnd > coldOff {
+		// Named like GCC's outlined parts, so backtraces stay readable
+		symbols = append(symbols, SymbolDef{
+			Name:    fn.Name() + ".cold",
+			Offset:  uint64(coldOff),
+			Size:    uint64(coldEnd - coldOff),
+			IsFunc:  true,
+			Section: coldSection,
 		})
 	}
+	return append(symbols, SymbolDef{
+		Name:     fn.Name(),
+		Offset:   uint64(startOff),
+		Size:     uint64(endOff - startOff),
+		IsFunc:   true,
+		IsGlobal: false, // Will be determined by linkage
+		Local:    fn.Linkage == ir.InternalLinkage || fn.Linkage == ir.PrivateLinkage,
+		Section:  section,
 
-	return &Artifact{
-		TextBuffer:  c.text.Bytes(),
-		DataBuffer:  c.data.Bytes(),
-		Symbols:     symbols,
-		Relocations: c.relocations,
+		Visibility: fn.Visibility,
+	}), nil
+}
+
+// emitAsmFunctions assembles the functions supplied as assembly, in name
+// order, each on a 16-byte boundary or the FunctionAlign one if larger
+func (c *compiler) emitAsmFunctions(m *ir.Module) ([]SymbolDef, error) {
+	names := make([]string, 0, len(c.opts.AsmFunctions))
+	for name := range c.opts.AsmFunctions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var symbols []SymbolDef
+	for _, name := range names {
+		code, relocs, err := Assemble(c.opts.AsmFunctions[name])
+		if err != nil {
+			return nil, fmt.Errorf("in assembly function %s: %w", name, err)
+		}
+		c.alignText(max(16, c.opts.FunctionAlign))
+		start := c.text.Len()
+		c.emitEndbr()
+		codeStart := c.text.Len()
+		c.text.Write(code)
+
+		for _, rel := range relocs {
+			rel.Offset += uint64(codeStart)
+			if rel.Type == R_X86_64_PLT32 && c.localFuncs[rel.SymbolName] {
+				rel.Type = R_X86_64_PC32
+			}
+			c.relocations = append(c.relocations, rel)
+		}
+
+		sym := SymbolDef{
+			Name:   name,
+			Offset: uint64(start),
+			Size:   uint64(c.text.Len() - start),
+			IsFunc: true,
+		}
+		if decl := m.GetFunction(name); decl != nil {
+			sym.Visibility = decl.Visibility
+		}
+		symbols = append(symbols, sym)
+	}
+	return symbols, nil
+}
+
+// emitStartStub emits a _start entry point for objects linked without libc.
+// The kernel enters with argc at [rsp], argv after it, and envp after argv's
+// terminating null; the entry function (main unless StartEntry names
+// another) receives all three and its result becomes the exit status of
+// every thread, through exit_group. A void entry function exits with 0.
+//
+// It is written out rather than lowered from IR, because no prologue
+// expects the stack the kernel provides: aligned to 16 bytes with no
+// return address pushed.
+func (c *compiler) emitStartStub(m *ir.Module) (SymbolDef, error) {
+	name := c.opts.StartEntry
+	if name == "" {
+		name = "main"
+	}
+	entry := m.GetFunction(name)
+	if entry == nil || len(entry.Blocks) == 0 {
+		return SymbolDef{}, fmt.Errorf("startup stub requires a defined %s", name)
+	}
+
+	c.alignText(max(16, c.opts.FunctionAlign))
+	start := c.text.Len()
+	c.emitEndbr()
+	if c.opts.StartLibc {
+		c.emitLibcStart(name)
+		return SymbolDef{
+			Name:   "_start",
+			Offset: uint64(start),
+			Size:   uint64(c.text.Len() - start),
+			IsFunc: true,
+		}, nil
+	}
+
+	// xor ebp, ebp (marks the outermost frame)
+	c.emitBytes(0x31, 0xED)
+	// mov rdi, [rsp] (argc)
+	c.emitBytes(0x48, 0x8B, 0x3C, 0x24)
+	// lea rsi, [rsp + 8] (argv)
+	c.emitBytes(0x48, 0x8D, 0x74, 0x24, 0x08)
+	// lea rdx, [rsi + rdi*8 + 8] (envp)
+	c.emitBytes(0x48, 0x8D, 0x54, 0xFE, 0x08)
+	// and rsp, -16
+	c.emitBytes(0x48, 0x83, 0xE4, 0xF0)
+
+	// call entry
+	c.emitBytes(0xE8)
+	c.relocations = append(c.relocations, Relocation{
+		Offset:     uint64(c.text.Len()),
+		SymbolName: name,
+		Type:       R_X86_64_PLT32,
+		Addend:     -4,
+	})
+	c.emitUint32(0)
+
+	if ft := entry.FuncType; ft != nil && (ft.ReturnType == nil || ft.ReturnType.Kind() == types.VoidKind) {
+		c.emitBytes(0x31, 0xFF) // xor edi, edi
+	} else {
+		c.emitBytes(0x89, 0xC7) // mov edi, eax
+	}
+	// mov eax, 231 (exit_group); syscall
+	c.emitBytes(0xB8, 231, 0, 0, 0)
+	c.emitBytes(0x0F, 0x05)
+
+	return SymbolDef{
+		Name:   "_start",
+		Offset: uint64(start),
+		Size:   uint64(c.text.Len() - start),
+		IsFunc: true,
 	}, nil
 }
 
+// emitLibcStart emits the body of a _start that calls
+// __libc_start_main(main, argc, argv, init, fini, rtld_fini, stack_end),
+// like glibc's own: init and fini are null, the library running the
+// program's constructors itself, and rtld_fini is what the dynamic linker
+// left in RDX. It doesn't return; main's result goes to exit.
+func (c *compiler) emitLibcStart(main string) {
+	c.emitBytes(0x31, 0xED)             // xor ebp, ebp
+	c.emitBytes(0x49, 0x89, 0xD1)       // mov r9, rdx (rtld_fini)
+	c.emitBytes(0x5E)                   // pop rsi (argc)
+	c.emitBytes(0x48, 0x89, 0xE2)       // mov rdx, rsp (argv)
+	c.emitBytes(0x48, 0x83, 0xE4, 0xF0) // and rsp, -16
+	c.emitBytes(0x50)                   // push rax (keeps the alignment)
+	c.emitBytes(0x54)                   // push rsp (stack_end)
+	c.emitBytes(0x45, 0x31, 0xC0)       // xor r8d, r8d (fini)
+	c.emitBytes(0x31, 0xC9)             // xor ecx, ecx (init)
+
+	// lea rdi, [rip + main]
+	c.emitBytes(0x48, 0x8D, 0x3D)
+	c.relocations = append(c.relocations, Relocation{
+		Offset:     uint64(c.text.Len()),
+		SymbolName: main,
+		Type:       R_X86_64_PC32,
+		Addend:     -4,
+	})
+	c.emitUint32(0)
+
+	// call __libc_start_main
+	c.emitBytes(0xE8)
+	c.relocations = append(c.relocations, Relocation{
+		Offset:     uint64(c.text.Len()),
+		SymbolName: "__libc_start_main",
+		Type:       R_X86_64_PLT32,
+		Addend:     -4,
+	})
+	c.emitUint32(0)
+	c.emitBytes(0xF4) // hlt
+}
+
+// isDeclaration reports whether g only declares a global defined in
+// another object, like C's extern: it has external linkage and no
+// initializer. A thread-local global without one is instead a zeroed
+// definition in .tbss.
+func isDeclaration(g *ir.Global) bool {
+	return g.Initializer == nil && !g.ThreadLocal &&
+		(g.Linkage == ir.ExternalLinkage || g.Linkage == ir.ExternalWeakLinkage)
+}
+
+// commonSymbol makes a COMMON symbol of a tentative definition, a global
+// with common linkage, as C compilers do for an uninitialized file-scope
+// variable. It has no storage here: the linker merges it with the other
+// objects' tentative definitions of the name, taking the largest, or
+// lets one real definition win, and otherwise allocates it in .bss.
+func commonSymbol(g *ir.Global) (SymbolDef, error) {
+	switch init := g.Initializer.(type) {
+	case nil, *ir.ConstantZero, *ir.ConstantNull, *ir.ConstantUndef:
+	case *ir.ConstantInt:
+		if init.Value != 0 {
+			return SymbolDef{}, fmt.Errorf("common global has a nonzero initializer")
+		}
+	case *ir.ConstantFloat:
+		// -0.0 has its sign bit set
+		if init.Value != 0 || math.Signbit(init.Value) {
+			return SymbolDef{}, fmt.Errorf("common global has a nonzero initializer")
+		}
+	default:
+		return SymbolDef{}, fmt.Errorf("common global has a nonzero initializer")
+	}
+	if g.ThreadLocal {
+		return SymbolDef{}, fmt.Errorf("thread-local globals can't have common linkage")
+	}
+	if g.Section != "" {
+		return SymbolDef{}, fmt.Errorf("common global can't be placed in section %s", g.Section)
+	}
+	return SymbolDef{
+		Name:     g.Name(),
+		Offset:   uint64(max(AlignOf(g.Type()), g.Alignment, 1)),
+		Size:     uint64(SizeOf(g.Type())),
+		IsGlobal: true,
+		IsCommon: true,
+
+		Visibility: g.Visibility,
+	}, nil
+}
+
+// cString reports whether g is a read-only C string literal: an i8 array
+// with a single NUL at the end and no placement requirements. Such globals
+// can be merged with identical literals.
+func cString(g *ir.Global) (string, bool) {
+	if !g.IsConstant || g.ThreadLocal || g.Section != "" || g.Alignment > 1 {
+		return "", false
+	}
+	arr, ok := g.Initializer.(*ir.ConstantArray)
+	if !ok || len(arr.Elements) == 0 {
+		return "", false
+	}
+	if et, ok := arr.Type().(*types.ArrayType); !ok || !et.ElementType.Equal(types.I8) {
+		return "", false
+	}
+
+	buf := make([]byte, len(arr.Elements))
+	for i, e := range arr.Elements {
+		ci, ok := e.(*ir.ConstantInt)
+		if !ok {
+			return "", false
+		}
+		buf[i] = byte(ci.Value)
+	}
+	last := len(buf) - 1
+	if buf[last] != 0 || bytes.IndexByte(buf[:last], 0) >= 0 {
+		return "", false
+	}
+	return string(buf[:last]), true
+}
+
+// globalAlign is the boundary a global is placed on: 8 bytes, or more
+// when the IR asks for it
+func globalAlign(g *ir.Global) int {
+	if g.Alignment > 8 {
+		return g.Alignment
+	}
+	return 8
+}
+
+// compileDataGlobal places a global in .data, or in .data.rel.ro when it is
+// constant but holds addresses
+func (c *compiler) compileDataGlobal(g *ir.Global) (SymbolDef, error) {
+	align := globalAlign(g)
+	if align > c.dataAlign {
+		c.dataAlign = align
+	}
+
+	sym := SymbolDef{
+		Name:     g.Name(),
+		IsGlobal: true,
+
+		Visibility: g.Visibility,
+	}
+	if g.IsConstant && g.Initializer != nil && hasRelocations(g.Initializer) {
+		sym.Section = relroSection
+
+		// compileGlobal writes to c.data; point it at .data.rel.ro meanwhile
+		saved := c.data
+		c.data, c.dataSection = c.relro, relroSection
+		defer func() { c.data, c.dataSection = saved, ".data" }()
+	}
+
+	for c.data.Len()%align != 0 {
+		c.data.WriteByte(0)
+	}
+	offset := c.data.Len()
+	if err := c.compileGlobal(g); err != nil {
+		return sym, err
+	}
+	sym.Offset = uint64(offset)
+	sym.Size = uint64(c.data.Len() - offset)
+	return sym, nil
+}
+
+// hasRelocations reports whether a constant contains an address, which
+// the linker or dynamic loader fills in
+func hasRelocations(constant ir.Constant) bool {
+	switch v := constant.(type) {
+	case *ir.Function, *ir.Global, *ir.ConstantExpr:
+		return true
+	case *ir.ConstantArray:
+		for _, elem := range v.Elements {
+			if hasRelocations(elem) {
+				return true
+			}
+		}
+	case *ir.ConstantStruct:
+		for _, field := range v.Fields {
+			if hasRelocations(field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// constantAddress resolves a constant that denotes an address, a function
+// or global possibly offset by a constant GEP and cast along the way, to
+// its symbol and byte offset
+func constantAddress(constant ir.Constant) (string, int64, error) {
+	switch v := constant.(type) {
+	case *ir.Function:
+		return v.Name(), 0, nil
+	case *ir.Global:
+		return v.Name(), 0, nil
+	case *ir.ConstantExpr:
+		if len(v.Ops) == 0 {
+			return "", 0, fmt.Errorf("constant %s has no operand", v.Op)
+		}
+		base, ok := v.Ops[0].(ir.Constant)
+		if !ok {
+			return "", 0, fmt.Errorf("constant %s of a non-constant", v.Op)
+		}
+		switch v.Op {
+		case ir.OpBitcast, ir.OpPtrToInt, ir.OpIntToPtr:
+			if SizeOf(v.Type()) != 8 {
+				return "", 0, fmt.Errorf("constant %s to %s can't hold an address", v.Op, v.Type())
+			}
+			return constantAddress(base)
+		case ir.OpGetElementPtr:
+			sym, addend, err := constantAddress(base)
+			if err != nil {
+				return "", 0, err
+			}
+			offset, err := constGEPOffset(v.SourceElementType, v.Indices)
+			return sym, addend + offset, err
+		}
+		return "", 0, fmt.Errorf("unsupported constant expression %s", v.Op)
+	}
+	return "", 0, fmt.Errorf("constant %T is not an address", constant)
+}
+
+// constGEPOffset is the byte offset a GEP with constant indices adds to
+// its base, walking the types the way gepOp does
+func constGEPOffset(sourceType types.Type, indices []ir.Value) (int64, error) {
+	var offset int64
+	current := sourceType
+	for i, idx := range indices {
+		ci, ok := idx.(*ir.ConstantInt)
+		if !ok {
+			return 0, fmt.Errorf("constant GEP index %d is not an integer constant", i)
+		}
+		if i == 0 {
+			offset += ci.Value * int64(SizeOf(current))
+			continue
+		}
+		switch ty := current.(type) {
+		case *types.ArrayType:
+			current = ty.ElementType
+			offset += ci.Value * int64(SizeOf(current))
+		case *types.StructType:
+			if ci.Value < 0 || int(ci.Value) >= len(ty.Fields) {
+				return 0, fmt.Errorf("constant GEP field %d of a %d-field struct", ci.Value, len(ty.Fields))
+			}
+			offset += int64(GetStructFieldOffset(ty, int(ci.Value)))
+			current = ty.Fields[ci.Value]
+		default:
+			return 0, fmt.Errorf("constant GEP into %s", current)
+		}
+	}
+	return offset, nil
+}
+
 func (c *compiler) compileGlobal(g *ir.Global) error {
 	if g.Initializer == nil {
 		// Zero-initialized
@@ -128,6 +832,48 @@ func (c *compiler) compileGlobal(g *ir.Global) error {
 	return c.emitConstant(g.Initializer)
 }
 
+// compileTLSGlobal places a thread-local global in .tdata, or in .tbss when
+// it has no initializer. The section contents are the initialization image
+// each thread's block is copied from.
+func (c *compiler) compileTLSGlobal(g *ir.Global) (SymbolDef, error) {
+	sym := SymbolDef{
+		Name:     g.Name(),
+		Size:     uint64(SizeOf(g.Type())),
+		IsGlobal: true,
+		IsTLS:    true,
+
+		Visibility: g.Visibility,
+	}
+
+	align := globalAlign(g)
+	if align > c.tlsAlign {
+		c.tlsAlign = align
+	}
+
+	if g.Initializer == nil {
+		for c.tbssSize%align != 0 {
+			c.tbssSize++
+		}
+		sym.Offset = uint64(c.tbssSize)
+		sym.Section = ".tbss"
+		c.tbssSize += int(sym.Size)
+		return sym, nil
+	}
+
+	for c.tdata.Len()%align != 0 {
+		c.tdata.WriteByte(0)
+	}
+	sym.Offset = uint64(c.tdata.Len())
+	sym.Section = ".tdata"
+
+	// emitConstant writes to c.data; point it at the TLS image meanwhile
+	saved := c.data
+	c.data, c.dataSection = c.tdata, ".tdata"
+	err := c.emitConstant(g.Initializer)
+	c.data, c.dataSection = saved, ".data"
+	return sym, err
+}
+
 func (c *compiler) emitConstant(constant ir.Constant) error {
 	switch v := constant.(type) {
 	case *ir.ConstantInt:
@@ -143,14 +889,38 @@ func (c *compiler) emitConstant(constant ir.Constant) error {
 			binary.Write(c.data, binary.LittleEndian, uint64(v.Value))
 		}
 	case *ir.ConstantFloat:
-		if v.Type().(*types.FloatType).BitWidth == 32 {
+		ft, ok := v.Type().(*types.FloatType)
+		if !ok {
+			return fmt.Errorf("float constant %v of type %s", v.Value, v.Type())
+		}
+		if ft.BitWidth == 32 {
 			binary.Write(c.data, binary.LittleEndian, float32(v.Value))
+		} else if isX87(v.Type()) {
+			enc := encodeX87(v.Value)
+			c.data.Write(enc[:])
+			c.data.Write(make([]byte, 6))
 		} else {
 			binary.Write(c.data, binary.LittleEndian, v.Value)
 		}
 	case *ir.ConstantZero:
 		size := SizeOf(v.Type())
 		c.data.Write(make([]byte, size))
+	case *ir.ConstantNull:
+		c.data.Write(make([]byte, 8))
+	case *ir.Function, *ir.Global, *ir.ConstantExpr:
+		// An address, written by the linker or dynamic loader
+		sym, addend, err := constantAddress(v)
+		if err != nil {
+			return err
+		}
+		c.relocations = append(c.relocations, Relocation{
+			Offset:     uint64(c.data.Len()),
+			SymbolName: sym,
+			Type:       R_X86_64_64,
+			Addend:     addend,
+			Section:    c.dataSection,
+		})
+		c.data.Write(make([]byte, 8))
 	case *ir.ConstantArray:
 		for _, elem := range v.Elements {
 			if err := c.emitConstant(elem); err != nil {
@@ -179,12 +949,31 @@ func (c *compiler) emitConstant(constant ir.Constant) error {
 }
 
 func (c *compiler) compileFunction(fn *ir.Function) error {
+	if err := checkOperands(fn); err != nil {
+		return err
+	}
+	if err := checkX87(fn); err != nil {
+		return err
+	}
 	c.currentFunc = fn
 	c.stackMap = make(map[ir.Value]int)
 	c.allocaOffsets = make(map[*ir.AllocaInst]int)
 	c.blockOffsets = make(map[*ir.BasicBlock]int)
 	c.fixups = nil
+	c.tableFixups = nil
+	c.coldBlocks = make(map[*ir.BasicBlock]bool)
 	c.nextTemp = 0
+	c.tlsSlots = make(map[*ir.Global]int)
+	c.varargs = nil
+	c.sretSlot = 0
+	c.sretBuffers = make(map[*ir.CallInst]int)
+	c.insertBuffers = make(map[*ir.InsertValueInst]int)
+	c.canarySlot = 0
+	uses := countUses(fn)
+	c.fusedLoads = findFusedLoads(fn, uses)
+	c.fusedCompares = findFusedCompares(fn, uses)
+	c.unwind = unwindInfo{}
+	start := c.text.Len()
 
 	// 1. Analyze and allocate stack space
 	offset := 0
@@ -192,26 +981,55 @@ func (c *compiler) compileFunction(fn *ir.Function) error {
 		if sz < 8 {
 			sz = 8 // Minimum slot size
 		}
-		// Align to natural alignment
-		if offset%sz != 0 {
-			offset += (sz - (offset % sz))
+		// Slots of 16 bytes or more are 16-byte aligned, as the frame
+		// base is, so vectors spill with movaps (see emitVecStoreToStack)
+		align := 8
+		if sz >= 16 {
+			align = 16
 		}
-		offset += sz
+		offset = (offset+align-1)&^(align-1) + sz
 		c.stackMap[v] = -offset
 	}
 
+	// With a stack protector the allocas come first, right below the
+	// canary at the top of the frame: an overrun then reaches the canary
+	// before the return address, and passes no other slot on the way
+	var allocaStart, allocaEnd int
+	if c.opts.StackProtector && hasStackBuffer(fn) {
+		c.canarySlot = -8
+		allocaStart = 8
+		offset = c.layoutAllocas(fn, allocaStart)
+		allocaEnd = offset
+	}
+
 	// Allocate space for arguments (they'll be copied from registers/stack)
 	for _, arg := range fn.Arguments {
 		alloc(arg, SizeOf(arg.Type()))
 	}
+	// Returning in memory, the buffer's address arrives as a hidden
+	// argument and is kept for ret
+	if fn.FuncType != nil && returnsInMemory(fn.FuncType.ReturnType) {
+		alloc(fn, 8)
+		c.sretSlot = c.stackMap[fn]
+		delete(c.stackMap, fn)
+	}
 
 	// Allocate space for all instructions that produce values
+	var sretCalls []*ir.CallInst
 	for _, block := range fn.Blocks {
 		for _, inst := range block.Instructions {
 			if inst.Type() != nil && inst.Type().Kind() != types.VoidKind {
 				// Special handling for alloca - it needs pointer-sized space
 				if _, ok := inst.(*ir.AllocaInst); ok {
 					alloc(inst, 8) // Store the pointer
+				} else if call, ok := inst.(*ir.CallInst); ok && returnsInMemory(call.Type()) {
+					// Memory-backed: the address of the buffer it fills
+					alloc(inst, 8)
+					sretCalls = append(sretCalls, call)
+				} else if IsAggregate(inst.Type()) {
+					// Round up to whole eightbytes so RAX:RDX can be
+					// spilled with full-width moves
+					alloc(inst, (SizeOf(inst.Type())+7)&^7)
 				} else {
 					alloc(inst, SizeOf(inst.Type()))
 				}
@@ -219,143 +1037,524 @@ func (c *compiler) compileFunction(fn *ir.Function) error {
 		}
 	}
 
-	// Handle alloca instructions - allocate their actual space
-	allocaOffset := offset
+	// Thread-local globals get a slot caching their address; the thread
+	// can't change during a call, so it is resolved once on entry
+	var tlsGlobals []*ir.Global
 	for _, block := range fn.Blocks {
 		for _, inst := range block.Instructions {
-			if allocaInst, ok := inst.(*ir.AllocaInst); ok {
-				size := SizeOf(allocaInst.AllocatedType)
-				if allocaInst.NumElements != nil {
-					// For array allocas
-					if constInt, ok := allocaInst.NumElements.(*ir.ConstantInt); ok {
-						size *= int(constInt.Value)
+			for _, op := range inst.Operands() {
+				if g, ok := op.(*ir.Global); ok && g.ThreadLocal {
+					if _, seen := c.tlsSlots[g]; !seen {
+						alloc(g, 8)
+						c.tlsSlots[g] = c.stackMap[g]
+						delete(c.stackMap, g)
+						tlsGlobals = append(tlsGlobals, g)
 					}
 				}
-				if size < 8 {
-					size = 8
-				}
-				allocaOffset += size
-				// Store the negative offset from RBP
-				// For a block of size N ending at -X, the address is RBP-X
-				// (Assuming stack grows down and we use 'lea' to get the base)
-				c.allocaOffsets[allocaInst] = -allocaOffset
 			}
 		}
 	}
 
+	// Otherwise the allocas follow the value slots
+	if c.canarySlot == 0 {
+		allocaStart = offset
+		offset = c.layoutAllocas(fn, offset)
+		allocaEnd = offset
+	}
+	allocaOffset := offset
+
+	// Each call returning in memory gets a buffer for the callee to fill
+	for _, call := range sretCalls {
+		allocaOffset = (allocaOffset + SizeOf(call.Type()) + 15) &^ 15
+		c.sretBuffers[call] = -allocaOffset
+	}
+	// So does each insertvalue into an aggregate held in memory, which
+	// leaves its source as it was
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			if iv, ok := inst.(*ir.InsertValueInst); ok && !c.isRegisterAggregate(iv) {
+				allocaOffset = (allocaOffset + SizeOf(iv.Type()) + 15) &^ 15
+				c.insertBuffers[iv] = -allocaOffset
+			}
+		}
+	}
+
+	// Variadic functions keep the argument registers for va_arg
+	if fn.FuncType != nil && fn.FuncType.Variadic {
+		allocaOffset = (allocaOffset+15)&^15 + vaSaveAreaSize
+		c.varargs = &varargFrame{saveArea: -allocaOffset}
+	}
+
 	// Align stack frame to 16 bytes (required by System V ABI)
 	if allocaOffset%16 != 0 {
 		allocaOffset += (16 - (allocaOffset % 16))
 	}
 	c.currentFrame = allocaOffset
+	c.omitFP = c.opts.OmitFramePointer && c.canOmitFramePointer(fn)
 
 	// 2. Function prologue
 	c.emitPrologue()
 
 	// 3. Save register arguments to stack
-	c.emitArgSave(fn)
+	if c.varargs != nil {
+		c.emitVarargSave()
+	}
+	if err := c.emitArgSave(fn); err != nil {
+		return fmt.Errorf("function %s: %w", fn.Name(), err)
+	}
+	if c.canarySlot != 0 {
+		// mov rax, qword ptr fs:[0x28], the thread's canary, into the
+		// frame, leaving no copy in a register
+		c.emitBytes(0x64, 0x48, 0x8B, 0x04, 0x25, 0x28, 0x00, 0x00, 0x00)
+		c.emitStoreToStack(RAX, c.canarySlot, 8)
+		c.emitXorReg(RAX, RAX)
+	}
+	if c.opts.ZeroAlloca {
+		// After the argument save: the fill may use RDI and RCX
+		c.emitZeroFrame(allocaStart, allocaEnd)
+	}
+
+	// Resolve thread-local addresses now that the argument registers are
+	// free (the general-dynamic sequence is a call)
+	for _, g := range tlsGlobals {
+		c.emitTLSAddress(g.Name())
+		c.emitStoreToStack(RAX, c.tlsSlots[g], 8)
+	}
 
 	// 4. Compile basic blocks
-	for _, block := range fn.Blocks {
+	fr := FunctionRange{Func: fn, Start: start, Section: c.textSection}
+	hot, cold := blockLayout(fn), []*ir.BasicBlock(nil)
+	// An LSDA describes one range of code, so functions with invokes
+	// keep their cold blocks
+	if c.opts.OutlineCold && !hasInvoke(fn) {
+		hot, cold = splitCold(hot)
+	}
+	for _, block := range cold {
+		c.coldBlocks[block] = true
+	}
+	if err := c.compileBlocks(&fr, hot); err != nil {
+		return err
+	}
+	if err := c.emitLandingPadStubs(); err != nil {
+		return err
+	}
+	fr.End = c.text.Len()
+
+	if len(cold) > 0 {
+		// Emit the cold blocks into their own buffer. Jumps and
+		// relocations made meanwhile are marked as belonging to it.
+		fixups, relocs := len(c.fixups), len(c.relocations)
+		c.text, c.coldText = c.coldText, c.text
+		err := c.compileBlocks(&fr, cold)
+		c.text, c.coldText = c.coldText, c.text
+		if err != nil {
+			return err
+		}
+		for i := fixups; i < len(c.fixups); i++ {
+			c.fixups[i].cold = true
+		}
+		for i := relocs; i < len(c.relocations); i++ {
+			c.relocations[i].Section = coldSection
+		}
+	}
+	c.ranges = append(c.ranges, fr)
+
+	// 5. Apply jump fixups
+	c.applyFixups()
+
+	return nil
+}
+
+// compileBlocks emits blocks one after another into c.text, each falling
+// through to the next, and records their ranges in fr
+func (c *compiler) compileBlocks(fr *FunctionRange, blocks []*ir.BasicBlock) error {
+	cold := len(blocks) > 0 && c.coldBlocks[blocks[0]]
+	for i, block := range blocks {
+		c.nextBlock = nil
+		if i+1 < len(blocks) {
+			c.nextBlock = blocks[i+1]
+		}
 		c.blockOffsets[block] = c.text.Len()
+		c.lastResult = nil // Other paths jump here with anything in RAX
+		br := BlockRange{Block: block, Start: c.text.Len(), Cold: cold}
 		for _, inst := range block.Instructions {
+			instStart := c.text.Len()
 			if err := c.compileInstruction(inst); err != nil {
 				return fmt.Errorf("in block %s: %w", block.Name(), err)
 			}
+			br.Instructions = append(br.Instructions, InstructionRange{Inst: inst, Start: instStart, End: c.text.Len()})
+		}
+		if block.Terminator() == nil {
+			c.emitImplicitFallthrough(block)
 		}
+		fr.Blocks = append(fr.Blocks, br)
 	}
+	return nil
+}
 
-	// 5. Apply jump fixups
-	c.applyFixups()
+// emitImplicitFallthrough ends a block that has no terminator, such as an
+// empty block that only exists as a phi predecessor. Control continues to
+// the block after it in the function, as it would in IR order whatever the
+// layout; there is nowhere to go after the last block.
+func (c *compiler) emitImplicitFallthrough(block *ir.BasicBlock) {
+	blocks := c.currentFunc.Blocks
+	for i, b := range blocks {
+		if b != block {
+			continue
+		}
+		if i+1 == len(blocks) {
+			break
+		}
+		next := blocks[i+1]
+		c.handlePhiForBranch(block, next)
+		if next != c.nextBlock {
+			// jmp rel32
+			c.emitBytes(0xE9)
+			c.fixups = append(c.fixups, jumpFixup{offset: c.text.Len(), target: next})
+			c.emitUint32(0)
+		}
+		return
+	}
+	c.emitBytes(0x0F, 0x0B) // ud2
+}
 
-	return nil
+// emitZeroFrame clears the frame bytes from RBP-to up to RBP-from. from is
+// eightbyte aligned, and the frame is padded so rounding up to the next
+// eightbyte stays inside it.
+func (c *compiler) emitZeroFrame(from, to int) {
+	to = (to + 7) &^ 7
+	qwords := (to - from) / 8
+	if qwords == 0 {
+		return
+	}
+
+	c.emitXorReg(RAX, RAX)
+	if qwords <= 8 {
+		for off := -to; off < -from; off += 8 {
+			c.emitStoreToStack(RAX, off, 8)
+		}
+		return
+	}
+
+	// lea rdi, [rbp - to]; mov ecx, qwords; rep stosq
+	c.emitBytes(0x48, 0x8D, 0xBD)
+	c.emitFrameDisp(-to)
+	c.emitBytes(0xB9)
+	c.emitUint32(uint32(qwords))
+	c.emitBytes(0xF3, 0x48, 0xAB)
+}
+
+// emitEndbr starts a function with endbr64 when CET is on. Under indirect
+// branch tracking an indirect call or jump must land on one, and a
+// function's address may be taken anywhere, outside this object too.
+func (c *compiler) emitEndbr() {
+	if c.opts.CET {
+		c.emitBytes(0xF3, 0x0F, 0x1E, 0xFA)
+	}
 }
 
 func (c *compiler) emitPrologue() {
+	c.emitEndbr()
+	if c.omitFP {
+		// sub rsp, frame_size+8: the 8 stand in for the pushed RBP, so
+		// RSP+frame_size lands where RBP would and the frame keeps its
+		// alignment and layout
+		c.emitFrameAdjust(5, c.currentFrame+8)
+		c.unwind.framed = c.text.Len()
+		return
+	}
 	// push rbp
 	c.emitBytes(0x55)
+	c.unwind.pushed = c.text.Len()
 	// mov rbp, rsp
 	c.emitBytes(0x48, 0x89, 0xE5)
+	c.unwind.framed = c.text.Len()
 	// sub rsp, frame_size
 	if c.currentFrame > 0 {
-		if c.currentFrame <= 127 {
-			c.emitBytes(0x48, 0x83, 0xEC, byte(c.currentFrame))
-		} else {
-			c.emitBytes(0x48, 0x81, 0xEC)
-			c.emitUint32(uint32(c.currentFrame))
+		c.emitFrameAdjust(5, c.currentFrame)
+	}
+}
+
+// emitFrameAdjust adds size to RSP (digit 0) or subtracts it (digit 5)
+func (c *compiler) emitFrameAdjust(digit byte, size int) {
+	modrm := 0xC0 | digit<<3 | RSP
+	if size <= 127 {
+		c.emitBytes(0x48, 0x83, modrm, byte(size))
+	} else {
+		c.emitBytes(0x48, 0x81, modrm)
+		c.emitUint32(uint32(size))
+	}
+}
+
+// canOmitFramePointer reports whether fn can address its frame from RSP.
+// Only leaf functions qualify: RSP must not move after the prologue, which
+// rules out calls (intrinsics included, as some are calls), variable-length
+// allocas, and thread-local accesses that call __tls_get_addr. Variadic
+// functions keep RBP too, as va_start is an intrinsic call.
+func (c *compiler) canOmitFramePointer(fn *ir.Function) bool {
+	if fn.FuncType != nil && fn.FuncType.Variadic {
+		return false
+	}
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			switch inst := inst.(type) {
+			case *ir.CallInst, *ir.InvokeInst:
+				return false
+			case *ir.AllocaInst:
+				if inst.NumElements != nil {
+					if _, ok := inst.NumElements.(*ir.ConstantInt); !ok {
+						return false
+					}
+				}
+			}
+			if c.opts.TLSModel == TLSGeneralDynamic {
+				for _, op := range inst.Operands() {
+					if g, ok := op.(*ir.Global); ok && g.ThreadLocal {
+						return false
+					}
+				}
+			}
 		}
 	}
+	return true
 }
 
-func (c *compiler) emitArgSave(fn *ir.Function) {
-	// System V AMD64 ABI: RDI, RSI, RDX, RCX, R8, R9
+// layoutAllocas gives each fixed-size alloca its space below the frame
+// offset given, and returns the offset past the last
+func (c *compiler) layoutAllocas(fn *ir.Function, offset int) int {
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			if allocaInst, ok := inst.(*ir.AllocaInst); ok {
+				size := SizeOf(allocaInst.AllocatedType)
+				if allocaInst.NumElements != nil {
+					// For array allocas
+					constInt, ok := allocaInst.NumElements.(*ir.ConstantInt)
+					if !ok {
+						// Runtime count: carved off RSP by allocaOp
+						continue
+					}
+					size *= int(constInt.Value)
+				}
+				if size < 8 {
+					size = 8
+				}
+				offset += size
+				// RBP is 16-byte aligned, so rounding the offset aligns
+				// the slot's address; stricter alignment isn't available
+				align := AlignOf(allocaInst.AllocatedType)
+				if allocaInst.Align > align {
+					align = allocaInst.Align
+				}
+				if align > 16 {
+					align = 16
+				}
+				if align > 1 && offset%align != 0 {
+					offset += align - offset%align
+				}
+				// Store the negative offset from RBP
+				// For a block of size N ending at -X, the address is RBP-X
+				// (Assuming stack grows down and we use 'lea' to get the base)
+				c.allocaOffsets[allocaInst] = -offset
+			}
+		}
+	}
+	return offset
+}
+
+// hasStackBuffer reports whether fn allocates an array on the stack, the
+// kind of local an overrun writes past, and so gets a canary
+func hasStackBuffer(fn *ir.Function) bool {
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			if a, ok := inst.(*ir.AllocaInst); ok {
+				if _, isArray := a.AllocatedType.(*types.ArrayType); isArray || a.NumElements != nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// emitArgSave copies the incoming arguments from their registers and the
+// caller's stack into their slots. It runs in the prologue, before the
+// entry block's first instruction, so a call there is free to load its
+// own arguments into the same registers.
+func (c *compiler) emitArgSave(fn *ir.Function) error {
+	// System V AMD64 ABI: RDI, RSI, RDX, RCX, R8, R9 for integers and
+	// pointers, XMM0-XMM7 for floats; whatever doesn't fit goes on the
+	// caller's stack. This must classify exactly like callOp does.
 	argRegs := []int{RDI, RSI, RDX, RCX, R8, R9}
+	numFpArgRegs := 8
+
+	intArgIdx := 0
+	fpArgIdx := 0
+	stackArgIdx := 0
 
-	for i, arg := range fn.Arguments {
+	// The return buffer's address comes first
+	if c.sretSlot != 0 {
+		c.emitStoreReg(RDI, c.sretSlot, 8)
+		intArgIdx++
+	}
+
+	for _, arg := range fn.Arguments {
 		offset := c.stackMap[arg]
 		size := SizeOf(arg.Type())
 
-		if i < len(argRegs) {
+		if inXMM(arg.Type()) {
+			if fpArgIdx < numFpArgRegs {
+				c.storeFromFpReg(fpArgIdx, arg)
+				fpArgIdx++
+				continue
+			}
+			if isXMMVector(arg.Type()) {
+				return fmt.Errorf("vector argument %s doesn't fit in XMM0-XMM7; vectors passed on the stack are not supported", arg.Name())
+			}
+		} else if intArgIdx < len(argRegs) {
 			// Load from register and store to stack
-			reg := argRegs[i]
+			reg := argRegs[intArgIdx]
 			if size <= 8 {
 				c.emitStoreReg(reg, offset, size)
 			}
+			intArgIdx++
+			continue
+		}
+
+		// Memory-class argument. Stack layout after prologue:
+		// [rbp+0]=old rbp, [rbp+8]=return addr, [rbp+16]=first stack arg,
+		// [rbp+24]=second stack arg, ... (any alignment padding the caller
+		// added sits above the arguments, not between them and the return
+		// address). The slot index counts only arguments that spilled, not
+		// the positional index, so interleaved float args don't skew it.
+		srcOffset := 16 + stackArgIdx*8
+		stackArgIdx++
+
+		// Load with appropriate size
+		if size == 4 {
+			// mov eax, [rbp + srcOffset]
+			c.emitBytes(0x8B, 0x85)
+			c.emitFrameDisp(srcOffset)
+
+			// mov [rbp + dstOffset], eax
+			c.emitBytes(0x89, 0x85)
+			c.emitFrameDisp(offset)
+		} else if size == 8 {
+			// mov rax, [rbp + srcOffset]
+			c.emitBytes(0x48, 0x8B, 0x85)
+			c.emitFrameDisp(srcOffset)
+
+			// mov [rbp + dstOffset], rax
+			c.emitBytes(0x48, 0x89, 0x85)
+			c.emitFrameDisp(offset)
 		} else {
-			// Arguments beyond 6 are on the caller's stack
-			// Stack layout after prologue: [rbp+0]=old rbp, [rbp+8]=return addr
-			// The caller may have added alignment padding before the call
-			// With 1 stack arg (8 bytes), alignment adds 8 bytes
-			// So: [rbp+16]=padding, [rbp+24]=first stack arg, [rbp+32]=second stack arg, etc.
-			
-			// Calculate number of stack args to determine if there's padding
-			numStackArgs := len(fn.Arguments) - len(argRegs)
-			stackBytesBeforeAlign := numStackArgs * 8
-			alignmentPadding := 0
-			if stackBytesBeforeAlign%16 != 0 {
-				alignmentPadding = 8
-			}
-			
-			srcOffset := 16 + alignmentPadding + (i-len(argRegs))*8
-
-			// Load with appropriate size
-			if size == 4 {
-				// mov eax, [rbp + srcOffset]
-				c.emitBytes(0x8B, 0x85)
-				c.emitInt32(int32(srcOffset))
-				
-				// mov [rbp + dstOffset], eax
-				c.emitBytes(0x89, 0x85)
-				c.emitInt32(int32(offset))
-			} else if size == 8 {
-				// mov rax, [rbp + srcOffset]
-				c.emitBytes(0x48, 0x8B, 0x85)
-				c.emitInt32(int32(srcOffset))
-				
-				// mov [rbp + dstOffset], rax
-				c.emitBytes(0x48, 0x89, 0x85)
-				c.emitInt32(int32(offset))
-			} else {
-				// For other sizes, use RAX as intermediate
-				c.emitLoadFromStack(RAX, srcOffset, size)
-				c.emitStoreToStack(RAX, offset, size)
-			}
+			// For other sizes, use RAX as intermediate
+			c.emitLoadFromStack(RAX, srcOffset, size)
+			c.emitStoreToStack(RAX, offset, size)
 		}
 	}
+
+	// va_start resumes where the named arguments left off
+	if c.varargs != nil {
+		c.varargs.gpOffset = intArgIdx * 8
+		c.varargs.fpOffset = vaGPSaveSize + fpArgIdx*16
+		c.varargs.overflow = 16 + stackArgIdx*8
+	}
+	return nil
 }
 
 func (c *compiler) applyFixups() {
-	text := c.text.Bytes()
 	for _, fix := range c.fixups {
 		targetOff, ok := c.blockOffsets[fix.target]
 		if !ok {
 			// Should not happen - all blocks should have offsets
 			continue
 		}
+		if targetCold := c.coldBlocks[fix.target]; targetCold != fix.cold {
+			// Between .text and .text.unlikely; only the linker knows how far
+			rel := Relocation{
+				Offset:     uint64(fix.offset),
+				SymbolName: c.blockSection(targetCold),
+				Type:       R_X86_64_PC32,
+				Addend:     int64(targetOff - 4),
+			}
+			if fix.cold {
+				rel.Section = coldSection
+			}
+			c.relocations = append(c.relocations, rel)
+			continue
+		}
+		text := c.text.Bytes()
+		if fix.cold {
+			text = c.coldText.Bytes()
+		}
 		// Calculate relative offset from end of instruction
 		rel := targetOff - (fix.offset + 4)
 		binary.LittleEndian.PutUint32(text[fix.offset:], uint32(rel))
 	}
+
+	// Table entries cross from .rodata to .text, so the linker fills them:
+	// S + A - P = (.text + target) - (.rodata + table) once A absorbs the
+	// entry's own distance from the table
+	for _, fix := range c.tableFixups {
+		c.relocations = append(c.relocations, Relocation{
+			Offset:     uint64(fix.offset),
+			SymbolName: c.blockSection(c.coldBlocks[fix.target]),
+			Type:       R_X86_64_PC32,
+			Addend:     int64(c.blockOffsets[fix.target] + fix.offset - fix.table),
+			Section:    ".rodata",
+		})
+	}
+}
+
+// longNops are the multi-byte nops recommended by the Intel and AMD
+// manuals, indexed by length: each decodes as a single instruction
+var longNops = [...][]byte{
+	1: {0x90},
+	2: {0x66, 0x90},
+	3: {0x0F, 0x1F, 0x00},
+	4: {0x0F, 0x1F, 0x40, 0x00},
+	5: {0x0F, 0x1F, 0x44, 0x00, 0x00},
+	6: {0x66, 0x0F, 0x1F, 0x44, 0x00, 0x00},
+	7: {0x0F, 0x1F, 0x80, 0x00, 0x00, 0x00, 0x00},
+	8: {0x0F, 0x1F, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00},
+	9: {0x66, 0x0F, 0x1F, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00},
+}
+
+// alignText pads the code with nops up to a multiple of align, using as
+// few instructions as it can
+func (c *compiler) alignText(align int) {
+	pad := (align - c.text.Len()%align) % align
+	for pad > 0 {
+		n := min(pad, len(longNops)-1)
+		c.text.Write(longNops[n])
+		pad -= n
+	}
+}
+
+// blockSection names the section a block of the current function is in
+func (c *compiler) blockSection(cold bool) string {
+	switch {
+	case cold:
+		return coldSection
+	case c.textSection != "":
+		return c.textSection
+	}
+	return ".text"
+}
+
+// sectionBuffer returns the code of the named section of
+// Options.TextSections, creating it on first use
+func (c *compiler) sectionBuffer(name string) *bytes.Buffer {
+	if buf, ok := c.sectionText[name]; ok {
+		return buf
+	}
+	if c.sectionText == nil {
+		c.sectionText = make(map[string]*bytes.Buffer)
+	}
+	buf := new(bytes.Buffer)
+	c.sectionText[name] = buf
+	c.sectionOrder = append(c.sectionOrder, name)
+	return buf
 }
 
 func (c *compiler) emitBytes(b ...byte) {
@@ -1,7 +1,9 @@
 package amd64
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
 
 	"github.com/arc-language/core-builder/ir"
 	"github.com/arc-language/core-builder/types"
@@ -9,26 +11,115 @@ import (
 
 // Return instruction
 func (c *compiler) retOp(inst *ir.RetInst) error {
-	if inst.NumOperands() > 0 && inst.Operands()[0] != nil {
-		retVal := inst.Operands()[0]
+	retVal, err := checkReturn(c.currentFunc, inst)
+	if err != nil {
+		return err
+	}
+	// A void function leaves RAX as its last instruction did
+	if retVal != nil {
 
-		// Check if it's a float return
-		if types.IsFloat(retVal.Type()) {
+		// Check if it's a float or vector return
+		if inXMM(retVal.Type()) {
 			c.loadToFpReg(0, retVal) // Return in XMM0
+		} else if c.sretSlot != 0 {
+			c.emitReturnInMemory(retVal)
+		} else if IsAggregate(retVal.Type()) && SizeOf(retVal.Type()) <= 16 {
+			c.loadRegisterPair(retVal) // Return in RAX:RDX
 		} else {
 			c.loadToReg(RAX, retVal) // Return in RAX
 		}
 	}
 
+	if c.canarySlot != 0 {
+		c.emitCanaryCheck()
+	}
+
 	// Epilogue
-	// leave (equivalent to: mov rsp, rbp; pop rbp)
-	c.emitBytes(0xC9)
+	if c.omitFP {
+		// add rsp, frame_size+8, undoing the prologue
+		c.emitFrameAdjust(0, c.currentFrame+8)
+	} else {
+		// leave (equivalent to: mov rsp, rbp; pop rbp)
+		c.emitBytes(0xC9)
+	}
+	if c.coldBlocks[inst.Parent()] {
+		c.unwind.coldReturns = append(c.unwind.coldReturns, c.text.Len())
+	} else {
+		c.unwind.returns = append(c.unwind.returns, c.text.Len())
+	}
 	// ret
 	c.emitBytes(0xC3)
 
 	return nil
 }
 
+// emitCanaryCheck compares the frame's canary with the thread's and calls
+// __stack_chk_fail, which aborts, if a buffer overrun changed it. RCX is
+// the one register free with the return value loaded.
+func (c *compiler) emitCanaryCheck() {
+	c.emitLoadFromStack(RCX, c.canarySlot, 8)
+	// sub rcx, qword ptr fs:[0x28]
+	c.emitBytes(0x64, 0x48, 0x2B, 0x0C, 0x25, 0x28, 0x00, 0x00, 0x00)
+	// je over the call
+	c.emitBytes(0x74, 0x05)
+	// call __stack_chk_fail
+	c.emitBytes(0xE8)
+	c.relocations = append(c.relocations, Relocation{
+		Offset:     uint64(c.text.Len()),
+		SymbolName: "__stack_chk_fail",
+		Type:       R_X86_64_PLT32,
+		Addend:     -4,
+	})
+	c.emitUint32(0)
+}
+
+// emitReturnInMemory copies a returned aggregate into the caller's buffer
+// and leaves the buffer's address in RAX. The aggregate is memory-backed,
+// an insertvalue chain built on undef included, or an undef or zero
+// constant, which zero-fills the buffer.
+func (c *compiler) emitReturnInMemory(retVal ir.Value) {
+	c.emitLoadFromStack(RDI, c.sretSlot, 8)
+	// mov ecx, size
+	c.emitBytes(0xB9)
+	c.emitUint32(uint32(SizeOf(retVal.Type())))
+	switch retVal.(type) {
+	case *ir.ConstantUndef, *ir.ConstantZero:
+		c.emitXorReg(RAX, RAX)
+		// rep stosb
+		c.emitBytes(0xF3, 0xAA)
+	default:
+		c.loadToReg(RSI, retVal)
+		// rep movsb
+		c.emitBytes(0xF3, 0xA4)
+	}
+	c.emitLoadFromStack(RAX, c.sretSlot, 8)
+}
+
+// checkReturn rejects a ret that doesn't match the function's return type:
+// a value from a void function, none from a non-void one, or a value of
+// another type. It returns the value returned, nil for ret void.
+func checkReturn(fn *ir.Function, inst *ir.RetInst) (ir.Value, error) {
+	var retVal ir.Value
+	if inst.NumOperands() > 0 {
+		retVal = inst.Operands()[0]
+	}
+	if fn.FuncType == nil {
+		return retVal, nil
+	}
+
+	want := fn.FuncType.ReturnType
+	void := want == nil || want.Kind() == types.VoidKind
+	switch {
+	case void && retVal != nil:
+		return nil, fmt.Errorf("ret %s in a function returning void", retVal.Type())
+	case !void && retVal == nil:
+		return nil, fmt.Errorf("ret void in a function returning %s", want)
+	case !void && !want.Equal(retVal.Type()):
+		return nil, fmt.Errorf("ret %s in a function returning %s", retVal.Type(), want)
+	}
+	return retVal, nil
+}
+
 // Unconditional branch
 func (c *compiler) brOp(inst *ir.BrInst) error {
 	// Handle phi nodes in target block before branching
@@ -47,55 +138,59 @@ func (c *compiler) brOp(inst *ir.BrInst) error {
 
 // Conditional branch
 func (c *compiler) condBrOp(inst *ir.CondBrInst) error {
-	c.loadToReg(RAX, inst.Condition)
-
-	// test rax, rax
-	c.emitBytes(0x48, 0x85, 0xC0)
-
-	// jz false_block (jump to false block if zero)
-	c.emitBytes(0x0F, 0x84)
-	c.fixups = append(c.fixups, jumpFixup{
-		offset: c.text.Len(),
-		target: inst.FalseBlock,
-	})
-	c.emitUint32(0) // Placeholder
+	// jcc opcode taken when the condition holds
+	var whenTrue byte
+	if cmp, ok := inst.Condition.(*ir.ICmpInst); ok && c.fusedCompares[cmp] {
+		cc, err := c.emitICmp(cmp)
+		if err != nil {
+			return err
+		}
+		whenTrue = 0x80 | cc
+	} else {
+		c.loadToReg(RAX, inst.Condition)
+		// test rax, rax
+		c.emitBytes(0x48, 0x85, 0xC0)
+		whenTrue = 0x85 // jnz
+	}
 
-	// True path falls through - handle phi and jump to true block
-	c.handlePhiForBranch(inst.Parent(), inst.TrueBlock)
-	c.emitBytes(0xE9)
-	c.fixups = append(c.fixups, jumpFixup{
-		offset: c.text.Len(),
-		target: inst.TrueBlock,
-	})
-	c.emitUint32(0)
+	// Branch away to one side and fall through to the other, which is the
+	// block laid out next when it is either. x86 condition codes come in
+	// complementary pairs, so cc^1 is the negation.
+	taken, cc, through := inst.FalseBlock, whenTrue^1, inst.TrueBlock
+	if c.nextBlock == inst.FalseBlock && inst.TrueBlock != inst.FalseBlock {
+		taken, cc, through = inst.TrueBlock, whenTrue, inst.FalseBlock
+	}
+	c.emitCondJump(cc, inst.Parent(), taken)
 
-	// Note: No false path handling here - the jz above jumps directly to FalseBlock
-	// If FalseBlock has phi nodes, they should be handled at the start of that block
+	c.handlePhiForBranch(inst.Parent(), through)
+	if through != c.nextBlock {
+		c.emitBytes(0xE9)
+		c.fixups = append(c.fixups, jumpFixup{
+			offset: c.text.Len(),
+			target: through,
+		})
+		c.emitUint32(0)
+	}
 
 	return nil
 }
 
 // Switch instruction
 func (c *compiler) switchOp(inst *ir.SwitchInst) error {
+	if lo, hi, ok := c.jumpTableRange(inst); ok {
+		c.emitJumpTable(inst, lo, hi)
+		return nil
+	}
+
 	c.loadToReg(RAX, inst.Condition)
 
 	// Generate comparison chain
-	for _, switchCase := range inst.Cases {
-		// cmp rax, case_value
-		if switchCase.Value.Value >= -128 && switchCase.Value.Value <= 127 {
-			c.emitBytes(0x48, 0x83, 0xF8, byte(switchCase.Value.Value))
-		} else {
-			c.emitBytes(0x48, 0x3D)
-			c.emitInt32(int32(switchCase.Value.Value))
-		}
+	size := SizeOf(inst.Condition.Type())
+	for i, switchCase := range inst.Cases {
+		c.emitCaseCompare(size, caseValue(inst, i))
 
 		// je case_block
-		c.emitBytes(0x0F, 0x84)
-		c.fixups = append(c.fixups, jumpFixup{
-			offset: c.text.Len(),
-			target: switchCase.Block,
-		})
-		c.emitUint32(0)
+		c.emitCondJump(0x84, inst.Parent(), switchCase.Block)
 	}
 
 	// Jump to default block
@@ -110,25 +205,311 @@ func (c *compiler) switchOp(inst *ir.SwitchInst) error {
 	return nil
 }
 
-// Helper function to handle phi nodes before branching
+// emitCaseCompare compares the low size bytes of RAX with v, a case value
+// sign-extended from that width. Comparing at the condition's width keeps
+// bits above it out of the match, and the sign-extended imm8 form is only
+// used where it reproduces v: 200 in an i32 switch takes the imm32 form.
+func (c *compiler) emitCaseCompare(size int, v int64) {
+	imm8 := v >= math.MinInt8 && v <= math.MaxInt8
+	switch {
+	case size == 1:
+		c.emitBytes(0x3C, byte(v)) // cmp al, imm8
+	case size == 2 && imm8:
+		c.emitBytes(0x66, 0x83, 0xF8, byte(v)) // cmp ax, imm8
+	case size == 2:
+		c.emitBytes(0x66, 0x3D, byte(v), byte(v>>8)) // cmp ax, imm16
+	case size == 4 && imm8:
+		c.emitBytes(0x83, 0xF8, byte(v)) // cmp eax, imm8
+	case size == 4:
+		c.emitBytes(0x3D) // cmp eax, imm32
+		c.emitInt32(int32(v))
+	case imm8:
+		c.emitBytes(0x48, 0x83, 0xF8, byte(v)) // cmp rax, imm8
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		c.emitBytes(0x48, 0x3D) // cmp rax, imm32
+		c.emitInt32(int32(v))
+	default:
+		// mov rcx, imm64; cmp rax, rcx
+		c.emitBytes(0x48, 0xB9)
+		c.emitUint64(uint64(v))
+		c.emitBytes(0x48, 0x39, 0xC8)
+	}
+}
+
+// Unreachable terminator
+func (c *compiler) unreachableOp(inst ir.Instruction) error {
+	// ud2 - raises #UD so reaching this point traps deterministically
+	// instead of falling through into whatever block follows
+	c.emitBytes(0x0F, 0x0B)
+	return nil
+}
+
+// phiMove copies src into a phi's slot on a control-flow edge. A nil src
+// stands for the scratch register holding a value saved to break a cycle.
+type phiMove struct {
+	dst *ir.PhiInst
+	src ir.Value
+}
+
+// Helper function to handle phi nodes before branching.
+//
+// All phis in the target block read their inputs simultaneously, so the
+// copies form a parallel move: a phi may take another phi's old value (a
+// swap at a loop back-edge) and must read it before it is overwritten.
+// Copies whose destination no other pending copy still reads are emitted
+// first; when only cycles remain, one destination's old value is parked in
+// a scratch register and its readers are redirected there, which unblocks
+// the cycle.
+//
+// The copies go between stack slots, all assigned before the first block
+// is compiled, so they don't depend on where toBlock is laid out: it may
+// come later, as a loop header does for a latch placed before it.
 func (c *compiler) handlePhiForBranch(fromBlock, toBlock *ir.BasicBlock) {
-	// Find all phi nodes in the target block
+	var moves []phiMove
 	for _, inst := range toBlock.Instructions {
 		phi, ok := inst.(*ir.PhiInst)
 		if !ok {
 			break // Phi nodes are always at the start of a block
 		}
-		
+
 		// Find the incoming value from fromBlock
 		for _, incoming := range phi.Incoming {
 			if incoming.Block == fromBlock {
-				// Copy the value to phi's location
-				c.loadToReg(RAX, incoming.Value)
-				c.storeFromReg(RAX, phi)
+				if incoming.Value != ir.Value(phi) {
+					moves = append(moves, phiMove{dst: phi, src: incoming.Value})
+				}
 				break
 			}
 		}
 	}
+
+	for len(moves) > 0 {
+		ready := -1
+		for i, m := range moves {
+			if !phiMoveRead(moves, m.dst) {
+				ready = i
+				break
+			}
+		}
+
+		if ready < 0 {
+			// Every destination is still needed: save one and retarget
+			// its readers to the scratch register
+			saved := moves[0].dst
+			if isX87(saved.Type()) {
+				c.x87Load(saved)
+			} else if inXMM(saved.Type()) {
+				c.loadToFpReg(15, saved)
+			} else {
+				c.loadToReg(R11, saved)
+			}
+			for i := range moves {
+				if moves[i].src == ir.Value(saved) {
+					moves[i].src = nil
+				}
+			}
+			continue
+		}
+
+		c.phiCopy(moves[ready])
+		moves = append(moves[:ready], moves[ready+1:]...)
+	}
+}
+
+// phiCopy emits one move of a parallel phi copy. The phi's type picks the
+// register class and the slot width: an fp80 goes through the x87 stack,
+// where its saved value waits on top, a float or vector through XMM0 and
+// its saved value waits in XMM15, anything else (integers and pointers)
+// through RAX, with R11 holding a saved value.
+func (c *compiler) phiCopy(m phiMove) {
+	if isX87(m.dst.Type()) {
+		if m.src != nil {
+			c.x87Load(m.src)
+		}
+		c.x87Store(m.dst)
+		return
+	}
+	if inXMM(m.dst.Type()) {
+		if m.src == nil {
+			c.storeFromFpReg(15, m.dst)
+			return
+		}
+		c.loadToFpReg(0, m.src)
+		c.storeFromFpReg(0, m.dst)
+		return
+	}
+	if m.src == nil {
+		c.storeFromReg(R11, m.dst)
+		return
+	}
+	c.loadToReg(RAX, m.src)
+	c.storeFromReg(RAX, m.dst)
+}
+
+// phiMoveRead reports whether any pending move still reads dst's old value
+func phiMoveRead(moves []phiMove, dst *ir.PhiInst) bool {
+	for _, m := range moves {
+		if m.src == ir.Value(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPhiCopies reports whether the edge from -> to needs phi copies
+func hasPhiCopies(from, to *ir.BasicBlock) bool {
+	for _, inst := range to.Instructions {
+		phi, ok := inst.(*ir.PhiInst)
+		if !ok {
+			break
+		}
+		for _, incoming := range phi.Incoming {
+			if incoming.Block == from {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jumpTableRange decides whether a switch is dense enough for a jump table
+// and returns its lowest and highest case values
+func (c *compiler) jumpTableRange(inst *ir.SwitchInst) (lo, hi int64, ok bool) {
+	if len(inst.Cases) < 4 {
+		return 0, 0, false
+	}
+	lo, hi = caseValue(inst, 0), caseValue(inst, 0)
+	for i := range inst.Cases {
+		lo = min(lo, caseValue(inst, i))
+		hi = max(hi, caseValue(inst, i))
+	}
+	if lo < math.MinInt32 || hi > math.MaxInt32 || hi-lo >= int64(3*len(inst.Cases)) {
+		return 0, 0, false
+	}
+	return lo, hi, true
+}
+
+// caseValue is the i'th case value sign-extended from the condition's width
+func caseValue(inst *ir.SwitchInst, i int) int64 {
+	shift := 64 - 8*SizeOf(inst.Condition.Type())
+	if shift <= 0 || shift >= 64 {
+		return inst.Cases[i].Value.Value
+	}
+	return inst.Cases[i].Value.Value << shift >> shift
+}
+
+// emitJumpTable dispatches through a table of 32-bit offsets in .rodata,
+// each the distance from the table to a case block
+func (c *compiler) emitJumpTable(inst *ir.SwitchInst, lo, hi int64) {
+	c.loadToReg(RAX, inst.Condition)
+	// Case values are sign-extended; match them at the condition's width
+	switch SizeOf(inst.Condition.Type()) {
+	case 1:
+		c.emitBytes(0x48, 0x0F, 0xBE, 0xC0) // movsx rax, al
+	case 2:
+		c.emitBytes(0x48, 0x0F, 0xBF, 0xC0) // movsx rax, ax
+	case 4:
+		c.emitBytes(0x48, 0x63, 0xC0) // movsxd rax, eax
+	}
+
+	// sub rax, lo; cmp rax, hi-lo; ja default
+	if lo != 0 {
+		c.emitBytes(0x48, 0x2D)
+		c.emitInt32(int32(lo))
+	}
+	c.emitBytes(0x48, 0x3D)
+	c.emitInt32(int32(hi - lo))
+	c.emitCondJump(0x87, inst.Parent(), inst.DefaultBlock)
+
+	targets := make([]*ir.BasicBlock, hi-lo+1)
+	for i := len(inst.Cases) - 1; i >= 0; i-- {
+		// The first case wins a duplicated value
+		targets[caseValue(inst, i)-lo] = inst.Cases[i].Block
+	}
+	table := c.addRodata(make([]byte, 4*len(targets)), 4)
+
+	// lea rcx, [rip + table]
+	c.emitBytes(0x48, 0x8D, 0x0D)
+	c.emitRodataRef(table)
+	// movsxd rax, dword [rcx + rax*4]; add rax, rcx; jmp rax
+	c.emitBytes(0x48, 0x63, 0x04, 0x81)
+	c.emitBytes(0x48, 0x01, 0xC8)
+	if c.opts.CET {
+		// notrack: the targets are blocks, which have no endbr64, and
+		// the table is read-only, so the jump needs no tracking
+		c.emitBytes(0x3E)
+	}
+	c.emitBytes(0xFF, 0xE0)
+
+	// Entries for edges with phi copies go to a block split into the
+	// edge, one per target, laid out here where nothing falls through
+	split := make(map[*ir.BasicBlock]*ir.BasicBlock)
+	for i, target := range targets {
+		if target == nil {
+			target = inst.DefaultBlock
+		}
+		if hasPhiCopies(inst.Parent(), target) {
+			if split[target] == nil {
+				split[target] = c.splitEdge(inst.Parent(), target)
+			}
+			target = split[target]
+		}
+		c.tableFixups = append(c.tableFixups, tableFixup{offset: table + 4*i, table: table, target: target})
+	}
+}
+
+// splitEdge emits a block for the edge from -> to that does its phi
+// copies and jumps on to to, and returns it for branches to target
+// instead. The edge must be critical: from has other successors, which
+// may need the old values of to's phis, so the copies can't be done
+// before branching, and to has other predecessors, so they can't be done
+// there. The block is placed at the current position, which control must
+// not fall through to. It exists only in the block offsets jumps resolve
+// against, not in the function.
+func (c *compiler) splitEdge(from, to *ir.BasicBlock) *ir.BasicBlock {
+	edge := &ir.BasicBlock{Parent: from.Parent}
+	c.blockOffsets[edge] = c.text.Len()
+	if c.coldBlocks[from] {
+		c.coldBlocks[edge] = true
+	}
+	c.handlePhiForBranch(from, to)
+	c.emitBytes(0xE9)
+	c.fixups = append(c.fixups, jumpFixup{
+		offset: c.text.Len(),
+		target: to,
+	})
+	c.emitUint32(0)
+	return edge
+}
+
+// Emit a conditional jump (0F cc rel32) to target. If the edge carries phi
+// copies they can't run before the jump is taken, so the condition is
+// inverted to skip over an edge stub that does the copies and then jumps.
+func (c *compiler) emitCondJump(cc byte, from, target *ir.BasicBlock) {
+	if !hasPhiCopies(from, target) {
+		c.emitBytes(0x0F, cc)
+		c.fixups = append(c.fixups, jumpFixup{
+			offset: c.text.Len(),
+			target: target,
+		})
+		c.emitUint32(0)
+		return
+	}
+
+	// j!cc skip (x86 condition codes come in complementary pairs)
+	c.emitBytes(0x0F, cc^1)
+	skip := c.text.Len()
+	c.emitUint32(0)
+
+	c.handlePhiForBranch(from, target)
+	c.emitBytes(0xE9)
+	c.fixups = append(c.fixups, jumpFixup{
+		offset: c.text.Len(),
+		target: target,
+	})
+	c.emitUint32(0)
+
+	binary.LittleEndian.PutUint32(c.text.Bytes()[skip:], uint32(c.text.Len()-(skip+4)))
 }
 
 // Phi node - now properly handled before branches
@@ -139,6 +520,28 @@ func (c *compiler) phiOp(inst *ir.PhiInst) error {
 	return nil
 }
 
+// Freeze - pin an undef/poison operand to one concrete value
+func (c *compiler) freezeOp(inst ir.Instruction) error {
+	src := inst.Operands()[0]
+
+	// Undef already materializes as zero in loadToReg/loadToFpReg, so
+	// freeze reduces to a copy into the result slot
+	switch {
+	case isX87(inst.Type()):
+		c.x87Load(src)
+		c.x87Store(inst)
+	case inXMM(inst.Type()):
+		c.loadToFpReg(0, src)
+		c.storeFromFpReg(0, inst)
+	case c.isRegisterAggregate(inst):
+		return c.materializeAggregate(src, c.stackMap[inst])
+	default:
+		c.loadToReg(RAX, src)
+		c.storeFromReg(RAX, inst)
+	}
+	return nil
+}
+
 // Select (ternary operator)
 func (c *compiler) selectOp(inst *ir.SelectInst) error {
 	ops := inst.Operands()
@@ -146,6 +549,10 @@ func (c *compiler) selectOp(inst *ir.SelectInst) error {
 	trueVal := ops[1]
 	falseVal := ops[2]
 
+	if IsAggregate(inst.Type()) {
+		return c.selectAggregateOp(inst)
+	}
+
 	c.loadToReg(RAX, cond)
 	c.loadToReg(RCX, trueVal)
 	c.loadToReg(RDX, falseVal)
@@ -161,14 +568,140 @@ func (c *compiler) selectOp(inst *ir.SelectInst) error {
 	return nil
 }
 
+// Select between two aggregates. A register-resident result gets a copy of
+// the chosen operand's bytes; otherwise the result is the chosen address.
+func (c *compiler) selectAggregateOp(inst *ir.SelectInst) error {
+	ops := inst.Operands()
+
+	if c.isRegisterAggregate(inst) {
+		dst := c.stackMap[inst]
+		c.loadToReg(RAX, ops[0])
+		// test rax, rax; je false
+		c.emitBytes(0x48, 0x85, 0xC0, 0x74, 0x00)
+		falseFrom := c.text.Len()
+		if err := c.materializeAggregate(ops[1], dst); err != nil {
+			return fmt.Errorf("select: %w", err)
+		}
+		// jmp end
+		c.emitBytes(0xEB, 0x00)
+		endFrom := c.text.Len()
+		c.text.Bytes()[falseFrom-1] = byte(endFrom - falseFrom)
+		if err := c.materializeAggregate(ops[2], dst); err != nil {
+			return fmt.Errorf("select: %w", err)
+		}
+		c.text.Bytes()[endFrom-1] = byte(c.text.Len() - endFrom)
+		return nil
+	}
+
+	if err := c.aggregateAddress(RCX, ops[1]); err != nil {
+		return fmt.Errorf("select: %w", err)
+	}
+	if err := c.aggregateAddress(RDX, ops[2]); err != nil {
+		return fmt.Errorf("select: %w", err)
+	}
+	c.loadToReg(RAX, ops[0])
+	// test rax, rax; cmovz rcx, rdx
+	c.emitBytes(0x48, 0x85, 0xC0)
+	c.emitBytes(0x48, 0x0F, 0x44, 0xCA)
+	c.storeFromReg(RCX, inst)
+	return nil
+}
+
+// aggregateAddress loads the address of an aggregate's bytes into reg: its
+// own slot when register-resident, else the pointer the value holds
+func (c *compiler) aggregateAddress(reg int, agg ir.Value) error {
+	switch agg.(type) {
+	case *ir.ConstantUndef, *ir.ConstantZero:
+		return fmt.Errorf("constant aggregate %s has no address", agg.Type())
+	}
+	if !c.isRegisterAggregate(agg) {
+		c.loadToReg(reg, agg)
+		return nil
+	}
+
+	rex := byte(0x48)
+	regNum := reg
+	if regNum >= 8 {
+		rex |= 0x04
+		regNum -= 8
+	}
+	// lea reg, [rbp + offset]
+	c.emitBytes(rex, 0x8D, byte(0x85|(regNum<<3)))
+	c.emitFrameDisp(c.stackMap[agg])
+	return nil
+}
+
 // Function call
+// callSignature is the callee's type, or nil for a call made by name alone
+func callSignature(inst *ir.CallInst) *types.FunctionType {
+	if inst.FuncType == nil && inst.Callee != nil {
+		return inst.Callee.FuncType
+	}
+	return inst.FuncType
+}
+
+// checkCallArgs rejects a call whose arguments don't fit the callee's
+// signature. Calls made by name alone carry no signature and pass.
+func checkCallArgs(inst *ir.CallInst, calleeName string, args []ir.Value) error {
+	ft := callSignature(inst)
+	if ft == nil {
+		return nil
+	}
+	if calleeName == "" {
+		calleeName = "<indirect>"
+	}
+
+	fixed := len(ft.ParamTypes)
+	if ft.Variadic && len(args) < fixed {
+		return fmt.Errorf("call to %s: variadic callee needs at least %d arguments, got %d", calleeName, fixed, len(args))
+	}
+	if !ft.Variadic && len(args) != fixed {
+		return fmt.Errorf("call to %s: expected %d arguments, got %d", calleeName, fixed, len(args))
+	}
+	for i, param := range ft.ParamTypes {
+		if !param.Equal(args[i].Type()) {
+			return fmt.Errorf("call to %s: argument %d has type %s, expected %s", calleeName, i, args[i].Type(), param)
+		}
+	}
+	return nil
+}
+
 func (c *compiler) callOp(inst *ir.CallInst) error {
+	_, err := c.emitCall(inst)
+	return err
+}
+
+// emitCall lowers a call and returns how many bytes of stack arguments it
+// pushed, which were popped again once the callee returned
+func (c *compiler) emitCall(inst *ir.CallInst) (int, error) {
 	ops := inst.Operands()
 
+	calleeName := inst.CalleeName
+	if inst.Callee != nil {
+		calleeName = inst.Callee.Name()
+	}
+	if handled, err := c.compileIntrinsic(inst, calleeName); handled {
+		return 0, err
+	}
+
+	// With neither a callee nor a name, operand 0 is a function pointer
+	// and the rest are the arguments
+	var target ir.Value
+	if inst.Callee == nil && calleeName == "" {
+		if len(ops) == 0 {
+			return 0, fmt.Errorf("indirect call has no target operand")
+		}
+		target = ops[0]
+		ops = ops[1:]
+	}
+	if err := checkCallArgs(inst, calleeName, ops); err != nil {
+		return 0, err
+	}
+
 	// System V AMD64 ABI calling convention
 	// Integer/pointer args: RDI, RSI, RDX, RCX, R8, R9, then stack
-	// Float args: XMM0-XMM7, then stack
-	// Return: RAX (integer), XMM0 (float)
+	// Float and vector args: XMM0-XMM7, then stack
+	// Return: RAX (integer), XMM0 (float and vector)
 
 	intArgRegs := []int{RDI, RSI, RDX, RCX, R8, R9}
 	fpArgRegs := []int{0, 1, 2, 3, 4, 5, 6, 7} // XMM0-XMM7
@@ -177,12 +710,21 @@ func (c *compiler) callOp(inst *ir.CallInst) error {
 	fpArgIdx := 0
 	stackArgs := []ir.Value{}
 
+	// A result returned in memory takes RDI for its buffer's address,
+	// moving the other integer arguments along by one register
+	sret := returnsInMemory(inst.Type())
+	if sret {
+		intArgIdx++
+	}
+
 	// Classify and place arguments
 	for _, arg := range ops {
-		if types.IsFloat(arg.Type()) {
+		if inXMM(arg.Type()) {
 			if fpArgIdx < len(fpArgRegs) {
 				c.loadToFpReg(fpArgRegs[fpArgIdx], arg)
 				fpArgIdx++
+			} else if isXMMVector(arg.Type()) {
+				return 0, fmt.Errorf("call to %s: vector argument %s doesn't fit in XMM0-XMM7; vectors passed on the stack are not supported", calleeName, arg.Name())
 			} else {
 				stackArgs = append(stackArgs, arg)
 			}
@@ -196,14 +738,9 @@ func (c *compiler) callOp(inst *ir.CallInst) error {
 		}
 	}
 
-	// Push stack arguments in reverse order
-	for i := len(stackArgs) - 1; i >= 0; i-- {
-		c.loadToReg(RAX, stackArgs[i])
-		// push rax
-		c.emitBytes(0x50)
-	}
-
-	// Align stack to 16 bytes if needed (ABI requirement)
+	// Align stack to 16 bytes if needed (ABI requirement). The padding
+	// must go above the arguments so the first stack argument sits
+	// directly at [rsp] when the call executes.
 	stackAdjust := len(stackArgs) * 8
 	if stackAdjust%16 != 0 {
 		// sub rsp, 8
@@ -211,23 +748,58 @@ func (c *compiler) callOp(inst *ir.CallInst) error {
 		stackAdjust += 8
 	}
 
-	// Emit call
-	calleeName := inst.CalleeName
-	if inst.Callee != nil {
-		calleeName = inst.Callee.Name()
+	// Push stack arguments in reverse order
+	for i := len(stackArgs) - 1; i >= 0; i-- {
+		if cf, ok := stackArgs[i].(*ir.ConstantFloat); ok {
+			// Float constants have no stack slot; push their raw bits
+			c.loadConstInt(RAX, int64(floatBits(cf)))
+		} else {
+			c.loadToReg(RAX, stackArgs[i])
+		}
+		// push rax
+		c.emitBytes(0x50)
 	}
 
-	// call rel32
-	c.emitBytes(0xE8)
+	if sret {
+		// lea rdi, [rbp + buffer]
+		c.emitBytes(0x48, 0x8D, 0xBD)
+		c.emitFrameDisp(c.sretBuffers[inst])
+	}
 
-	// Add relocation for the call
-	c.relocations = append(c.relocations, Relocation{
-		Offset:     uint64(c.text.Len()),
-		SymbolName: calleeName,
-		Type:       R_X86_64_PLT32,
-		Addend:     -4,
-	})
-	c.emitUint32(0) // Placeholder
+	// A variadic callee reads the number of vector registers holding
+	// arguments from AL. Set it too when the signature is unknown; AL is
+	// free at a call either way.
+	if ft := callSignature(inst); ft == nil || ft.Variadic {
+		// mov eax, imm32
+		c.emitBytes(0xB8)
+		c.emitUint32(uint32(fpArgIdx))
+	}
+
+	// Emit call
+	if target != nil {
+		// R11 is caller-saved and carries no argument
+		c.loadToReg(R11, target)
+		// call r11
+		c.emitBytes(0x41, 0xFF, 0xD3)
+	} else {
+		// call rel32
+		c.emitBytes(0xE8)
+
+		// A callee that binds locally is reached directly; anything
+		// else may live in, or be preempted by, a shared library and
+		// goes through the PLT
+		relType := R_X86_64_PLT32
+		if c.localFuncs[calleeName] {
+			relType = R_X86_64_PC32
+		}
+		c.relocations = append(c.relocations, Relocation{
+			Offset:     uint64(c.text.Len()),
+			SymbolName: calleeName,
+			Type:       relType,
+			Addend:     -4,
+		})
+		c.emitUint32(0) // Placeholder
+	}
 
 	// Clean up stack
 	if stackAdjust > 0 {
@@ -241,39 +813,131 @@ func (c *compiler) callOp(inst *ir.CallInst) error {
 
 	// Store return value
 	if inst.Type() != nil && inst.Type().Kind() != types.VoidKind {
-		if types.IsFloat(inst.Type()) {
+		if inXMM(inst.Type()) {
 			c.storeFromFpReg(0, inst)
+		} else if IsAggregate(inst.Type()) && SizeOf(inst.Type()) <= 16 {
+			c.storeRegisterPair(inst)
 		} else {
+			// Also the buffer address of a result returned in memory,
+			// which is what the memory-backed value holds
 			c.storeFromReg(RAX, inst)
 		}
 	}
 
-	return nil
+	return stackAdjust, nil
+}
+
+// Spill a small aggregate returned in registers into its (eightbyte-rounded)
+// slot: each integer eightbyte from the next of RAX and RDX, each SSE one
+// from the next of XMM0 and XMM1
+func (c *compiler) storeRegisterPair(dest ir.Value) {
+	offset, ok := c.stackMap[dest]
+	if !ok {
+		return
+	}
+
+	ints, sse := 0, 0
+	for i, class := range eightbyteClasses(dest.Type()) {
+		if class == ParamSSE {
+			c.emitFpStoreToStack(sse, offset+8*i, true)
+			sse++
+		} else {
+			c.emitStoreToStack([]int{RAX, RDX}[ints], offset+8*i, 8)
+			ints++
+		}
+	}
+}
+
+// Load a small aggregate into the registers it is returned in, as
+// storeRegisterPair takes them
+func (c *compiler) loadRegisterPair(value ir.Value) {
+	size := SizeOf(value.Type())
+	register := c.isRegisterAggregate(value)
+	if !register {
+		// Memory-backed: the value is a pointer to the aggregate
+		c.loadToReg(RCX, value)
+	}
+
+	ints, sse := 0, 0
+	for i, class := range eightbyteClasses(value.Type()) {
+		n := min(8, size-8*i)
+		switch {
+		case class == ParamSSE && register:
+			c.emitFpLoadFromStack(sse, c.stackMap[value]+8*i, true)
+		case class == ParamSSE:
+			// movss/movsd xmm, [rcx + 8*i]
+			prefix := byte(0xF2)
+			if n == 4 {
+				prefix = 0xF3
+			}
+			c.emitSSE(prefix, 0, 0x10, 0, byte(0x41|sse<<3), byte(8*i))
+		case register:
+			c.emitLoadFromStack([]int{RAX, RDX}[ints], c.stackMap[value]+8*i, 8)
+		default:
+			// Only the aggregate's own bytes: the last eightbyte may end
+			// where the memory does
+			c.emitLoadBytes([]int{RAX, RDX}[ints], 8*i, n)
+		}
+		if class == ParamSSE {
+			sse++
+		} else {
+			ints++
+		}
+	}
+}
+
+// emitLoadBytes loads the n bytes, 1 to 8, at [rcx + disp] into reg,
+// zero-extended, without reading past them. A size that isn't a power of
+// two takes a second load, into RSI, of the top bytes, overlapping the
+// first, which is shifted into place and merged.
+func (c *compiler) emitLoadBytes(reg, disp, n int) {
+	load := func(reg, disp, width int) {
+		modrm := byte(0x41 | reg<<3) // [rcx + disp8]
+		switch width {
+		case 1:
+			c.emitBytes(0x0F, 0xB6, modrm, byte(disp)) // movzx r32, byte ptr
+		case 2:
+			c.emitBytes(0x0F, 0xB7, modrm, byte(disp)) // movzx r32, word ptr
+		case 4:
+			c.emitBytes(0x8B, modrm, byte(disp)) // mov r32, dword ptr
+		default:
+			c.emitBytes(0x48, 0x8B, modrm, byte(disp)) // mov r64, qword ptr
+		}
+	}
+
+	chunk := copyChunk(n)
+	load(reg, disp, chunk)
+	if chunk == n {
+		return
+	}
+	load(RSI, disp+n-chunk, chunk)
+	// shl rsi, imm8
+	c.emitBytes(0x48, 0xC1, 0xE6, byte(8*(n-chunk)))
+	// or reg, rsi
+	c.emitBytes(0x48, 0x09, byte(0xF0|reg))
 }
 
 // Extract value from aggregate
 func (c *compiler) extractValueOp(inst *ir.ExtractValueInst) error {
 	agg := inst.Operands()[0]
-	c.loadToReg(RAX, agg)
 
-	// Calculate offset based on indices
-	currentType := agg.Type()
-	offset := 0
+	offset, _, err := aggregateOffset(agg.Type(), inst.Indices)
+	if err != nil {
+		return fmt.Errorf("extractvalue: %w", err)
+	}
+	size := SizeOf(inst.Type())
 
-	for _, idx := range inst.Indices {
-		switch ty := currentType.(type) {
-		case *types.StructType:
-			offset += GetStructFieldOffset(ty, idx)
-			currentType = ty.Fields[idx]
-		case *types.ArrayType:
-			elemSize := SizeOf(ty.ElementType)
-			offset += idx * elemSize
-			currentType = ty.ElementType
-		default:
-			return fmt.Errorf("extractvalue on non-aggregate type: %T", ty)
-		}
+	if c.isRegisterAggregate(agg) {
+		// The aggregate's bytes live directly in its stack slot (RAX:RDX
+		// of the producing call), so the field is just a narrower load
+		c.emitLoadFromStack(RAX, c.stackMap[agg]+offset, size)
+		c.storeFromReg(RAX, inst)
+		return nil
 	}
 
+	// Memory-backed aggregate: the value is the address of the storage
+	c.loadToReg(RAX, agg)
+
 	// Load from aggregate + offset
 	if offset > 0 {
 		if offset <= 127 {
@@ -285,7 +949,6 @@ func (c *compiler) extractValueOp(inst *ir.ExtractValueInst) error {
 	}
 
 	// Load the value
-	size := SizeOf(inst.Type())
 	switch size {
 	case 1:
 		c.emitBytes(0x48, 0x0F, 0xB6, 0x00) // movzx rax, byte ptr [rax]
@@ -307,79 +970,188 @@ func (c *compiler) insertValueOp(inst *ir.InsertValueInst) error {
 	agg := ops[0]
 	value := ops[1]
 
-	// This is complex - need to copy aggregate and modify one field
-	// For simplicity, we'll load the aggregate, modify it, and store back
-	// A proper implementation would use temporary storage
+	offset, _, err := aggregateOffset(agg.Type(), inst.Indices)
+	if err != nil {
+		return fmt.Errorf("insertvalue: %w", err)
+	}
+	size := SizeOf(value.Type())
 
-	c.loadToReg(RCX, agg) // Aggregate address/value
+	if c.isRegisterAggregate(inst) {
+		// Copy the source aggregate into our own slot, then overwrite
+		// the selected field in place
+		dst := c.stackMap[inst]
+		if err := c.materializeAggregate(agg, dst); err != nil {
+			return fmt.Errorf("insertvalue: %w", err)
+		}
+		c.loadToReg(RAX, value)
+		c.emitStoreToStack(RAX, dst+offset, size)
+		return nil
+	}
+
+	// Held in memory, the result is the address of its own buffer: a
+	// copy of the source, or zeros for an undef one, with the field
+	// stored over it
+	buf := c.insertBuffers[inst]
+	switch agg.(type) {
+	case *ir.ConstantUndef, *ir.ConstantZero:
+		c.emitZeroFrame(-buf-(SizeOf(inst.Type())+7)&^7, -buf)
+	default:
+		c.loadToReg(RSI, agg)
+		// lea rdi, [rbp + buffer]; mov ecx, size; rep movsb
+		c.emitBytes(0x48, 0x8D, 0xBD)
+		c.emitFrameDisp(buf)
+		c.emitBytes(0xB9)
+		c.emitUint32(uint32(SizeOf(inst.Type())))
+		c.emitBytes(0xF3, 0xA4)
+	}
 	c.loadToReg(RAX, value)
+	c.emitStoreToStack(RAX, buf+offset, size)
+	// lea rax, [rbp + buffer]
+	c.emitBytes(0x48, 0x8D, 0x85)
+	c.emitFrameDisp(buf)
+	c.storeFromReg(RAX, inst)
+	return nil
+}
 
-	// Calculate offset
-	currentType := agg.Type()
+// aggregateOffset walks an extractvalue/insertvalue index list and returns
+// the byte offset of the selected element along with its type
+func aggregateOffset(t types.Type, indices []int) (int, types.Type, error) {
+	currentType := t
 	offset := 0
 
-	for _, idx := range inst.Indices {
+	for _, idx := range indices {
 		switch ty := currentType.(type) {
 		case *types.StructType:
+			if idx < 0 || idx >= len(ty.Fields) {
+				return 0, nil, fmt.Errorf("index %d out of range for %s with %d fields", idx, ty, len(ty.Fields))
+			}
 			offset += GetStructFieldOffset(ty, idx)
 			currentType = ty.Fields[idx]
 		case *types.ArrayType:
+			if idx < 0 || int64(idx) >= ty.Length {
+				return 0, nil, fmt.Errorf("index %d out of range for %s", idx, ty)
+			}
 			elemSize := SizeOf(ty.ElementType)
 			offset += idx * elemSize
 			currentType = ty.ElementType
+		default:
+			return 0, nil, fmt.Errorf("index into non-aggregate type: %T", ty)
 		}
 	}
 
-	// Store value at aggregate + offset
-	if offset > 0 {
-		if offset <= 127 {
-			c.emitBytes(0x48, 0x83, 0xC1, byte(offset))
-		} else {
-			c.emitBytes(0x48, 0x81, 0xC1)
-			c.emitInt32(int32(offset))
+	return offset, currentType, nil
+}
+
+// isRegisterAggregate reports whether v is a small aggregate whose bytes are
+// held by value in its stack slot rather than behind a pointer. This is the
+// case for aggregates returned in RAX:RDX, for insertvalue/freeze chains
+// built on top of them (or on undef/zeroinitializer) and for selects
+// between two such values.
+func (c *compiler) isRegisterAggregate(v ir.Value) bool {
+	if !IsAggregate(v.Type()) || SizeOf(v.Type()) > 16 {
+		return false
+	}
+	if _, ok := c.stackMap[v]; !ok {
+		return false
+	}
+
+	switch v := v.(type) {
+	case *ir.CallInst, *ir.InvokeInst, *ir.LandingPadInst:
+		return true
+	case *ir.SelectInst:
+		// By value only if both choices are
+		return c.isRegisterAggregateOrConst(v.Operands()[1]) &&
+			c.isRegisterAggregateOrConst(v.Operands()[2])
+	case ir.Instruction:
+		// insertvalue and freeze produce a by-value copy of operand 0
+		if v.Opcode() != ir.OpInsertValue && v.Opcode() != ir.OpFreeze {
+			return false
 		}
+		return c.isRegisterAggregateOrConst(v.Operands()[0])
 	}
+	return false
+}
 
-	size := SizeOf(value.Type())
-	switch size {
-	case 1:
-		c.emitBytes(0x88, 0x01) // mov byte ptr [rcx], al
-	case 2:
-		c.emitBytes(0x66, 0x89, 0x01) // mov word ptr [rcx], ax
-	case 4:
-		c.emitBytes(0x89, 0x01) // mov dword ptr [rcx], eax
-	case 8:
-		c.emitBytes(0x48, 0x89, 0x01) // mov qword ptr [rcx], rax
+// isRegisterAggregateOrConst is isRegisterAggregate, also accepting the
+// undef and zero constants materializeAggregate can write
+func (c *compiler) isRegisterAggregateOrConst(v ir.Value) bool {
+	switch v.(type) {
+	case *ir.ConstantUndef, *ir.ConstantZero:
+		return true
 	}
+	return c.isRegisterAggregate(v)
+}
 
-	c.storeFromReg(RCX, inst)
+// materializeAggregate writes the bytes of a register-resident aggregate (or
+// an undef/zero constant) into the stack slot at dst
+func (c *compiler) materializeAggregate(agg ir.Value, dst int) error {
+	size := SizeOf(agg.Type())
+
+	switch agg.(type) {
+	case *ir.ConstantUndef, *ir.ConstantZero:
+		c.emitXorReg(RAX, RAX)
+		for off := 0; off < size; {
+			chunk := copyChunk(size - off)
+			c.emitStoreToStack(RAX, dst+off, chunk)
+			off += chunk
+		}
+		return nil
+	}
+
+	if !c.isRegisterAggregate(agg) {
+		return fmt.Errorf("aggregate %s is not register-resident", agg.Name())
+	}
+	c.emitStackCopy(dst, c.stackMap[agg], size)
 	return nil
 }
 
+// emitStackCopy copies size bytes between two RBP-relative slots via RAX
+func (c *compiler) emitStackCopy(dst, src, size int) {
+	for off := 0; off < size; {
+		chunk := copyChunk(size - off)
+		c.emitLoadFromStack(RAX, src+off, chunk)
+		c.emitStoreToStack(RAX, dst+off, chunk)
+		off += chunk
+	}
+}
+
+// copyChunk returns the widest move size (8/4/2/1) that fits in remaining
+func copyChunk(remaining int) int {
+	chunk := 8
+	for chunk > remaining {
+		chunk /= 2
+	}
+	return chunk
+}
+
 // Integer cast operations
 func (c *compiler) intCastOp(inst *ir.CastInst) error {
 	src := inst.Operands()[0]
+	if load, ok := src.(*ir.LoadInst); ok && c.fusedLoads[load] {
+		return c.extendLoadOp(inst, load)
+	}
 	c.loadToReg(RAX, src)
 
-	srcSize := SizeOf(src.Type())
-
-	switch inst.Opcode() {
-	case ir.OpTrunc:
-		// Truncation - just take lower bits (already in RAX)
-		// No operation needed, storing will handle it
-
-	case ir.OpZExt:
-		// Zero extension
-		switch srcSize {
-		case 1:
-			c.emitBytes(0x48, 0x0F, 0xB6, 0xC0) // movzx rax, al
-		case 2:
-			c.emitBytes(0x48, 0x0F, 0xB7, 0xC0) // movzx rax, ax
-		case 4:
-			c.emitBytes(0x89, 0xC0) // mov eax, eax (zero-extends)
+	srcSize, dstSize := SizeOf(src.Type()), SizeOf(inst.Type())
+
+	switch {
+	case srcSize >= dstSize:
+		// A truncation, or a cast that keeps the width (which front ends
+		// may emit for uniformity, whatever the opcode), is a move of the
+		// low bits. Clearing the rest leaves RAX as a load of the result
+		// would.
+		c.emitZeroExtendRAX(dstSize)
+		if it, ok := inst.Type().(*types.IntType); ok && it.BitWidth < 8 {
+			// A byte holds more than an i1 (or other sub-byte type):
+			// keep only its bits, so a truncation of 2 to i1 is false
+			// and what is stored reads back as 0 or 1
+			c.emitBytes(0x83, 0xE0, byte(1<<it.BitWidth-1)) // and eax, mask
 		}
 
-	case ir.OpSExt:
+	case inst.Opcode() == ir.OpZExt:
+		c.emitZeroExtendRAX(srcSize)
+
+	case inst.Opcode() == ir.OpSExt:
 		// Sign extension
 		switch srcSize {
 		case 1:
@@ -395,60 +1167,215 @@ func (c *compiler) intCastOp(inst *ir.CastInst) error {
 	return nil
 }
 
+// emitZeroExtendRAX clears the bits of RAX above its low size bytes
+func (c *compiler) emitZeroExtendRAX(size int) {
+	switch size {
+	case 1:
+		c.emitBytes(0x48, 0x0F, 0xB6, 0xC0) // movzx rax, al
+	case 2:
+		c.emitBytes(0x48, 0x0F, 0xB7, 0xC0) // movzx rax, ax
+	case 4:
+		c.emitBytes(0x89, 0xC0) // mov eax, eax (zero-extends)
+	default:
+		// Eight bytes fill RAX: there is nothing above them
+	}
+}
+
+// extendLoadOp lowers a zext/sext of a fused load to a single extending
+// move from memory
+func (c *compiler) extendLoadOp(inst *ir.CastInst, load *ir.LoadInst) error {
+	c.loadToReg(RAX, load.Operands()[0])
+
+	signed := inst.Opcode() == ir.OpSExt
+	switch SizeOf(load.Type()) {
+	case 1:
+		if signed {
+			c.emitBytes(0x48, 0x0F, 0xBE, 0x00) // movsx rax, byte ptr [rax]
+		} else {
+			c.emitBytes(0x48, 0x0F, 0xB6, 0x00) // movzx rax, byte ptr [rax]
+		}
+	case 2:
+		if signed {
+			c.emitBytes(0x48, 0x0F, 0xBF, 0x00) // movsx rax, word ptr [rax]
+		} else {
+			c.emitBytes(0x48, 0x0F, 0xB7, 0x00) // movzx rax, word ptr [rax]
+		}
+	case 4:
+		if signed {
+			c.emitBytes(0x48, 0x63, 0x00) // movsxd rax, dword ptr [rax]
+		} else {
+			c.emitBytes(0x8B, 0x00) // mov eax, [rax] (zero-extends)
+		}
+	}
+
+	c.storeFromReg(RAX, inst)
+	return nil
+}
+
 // Floating point cast operations
 func (c *compiler) fpCastOp(inst *ir.CastInst) error {
 	src := inst.Operands()[0]
-	srcType := src.Type().(*types.FloatType)
-	dstType := inst.Type().(*types.FloatType)
+	srcType, err := scalarFloat(src.Type())
+	if err != nil {
+		return err
+	}
+	dstType, err := scalarFloat(inst.Type())
+	if err != nil {
+		return err
+	}
+
+	if srcType.BitWidth == 80 || dstType.BitWidth == 80 {
+		return c.x87CastOp(inst, srcType, dstType)
+	}
 
 	c.loadToFpReg(0, src)
 
 	if srcType.BitWidth == 32 && dstType.BitWidth == 64 {
 		// cvtss2sd xmm0, xmm0
-		c.emitBytes(0xF3, 0x0F, 0x5A, 0xC0)
+		c.emitSSE(0xF3, 0, 0x5A, 0, 0xC0)
 	} else if srcType.BitWidth == 64 && dstType.BitWidth == 32 {
 		// cvtsd2ss xmm0, xmm0
-		c.emitBytes(0xF2, 0x0F, 0x5A, 0xC0)
+		c.emitSSE(0xF2, 0, 0x5A, 0, 0xC0)
 	}
+	c.emitCanonicalizeNaN(dstType.BitWidth)
 
 	c.storeFromFpReg(0, inst)
 	return nil
 }
 
+// scalarFloat returns t as a scalar float type. The fp casts only lower
+// scalars; vectors get an error instead of a failed type assertion.
+func scalarFloat(t types.Type) (*types.FloatType, error) {
+	ft, ok := t.(*types.FloatType)
+	if !ok {
+		return nil, fmt.Errorf("fp cast on %s: only scalar conversions are supported", t)
+	}
+	return ft, nil
+}
+
 // Float to integer conversion
 func (c *compiler) fpToIntOp(inst *ir.CastInst) error {
 	src := inst.Operands()[0]
-	srcType := src.Type().(*types.FloatType)
-
-	c.loadToFpReg(0, src)
+	srcType, err := scalarFloat(src.Type())
+	if err != nil {
+		return err
+	}
+	if inst.Type().Kind() != types.IntegerKind {
+		return fmt.Errorf("fp-to-int cast to %s: only scalar conversions are supported", inst.Type())
+	}
 
+	// ss/sd forms share opcodes and differ only in the prefix
+	prefix := byte(0xF2)
 	if srcType.BitWidth == 32 {
-		// cvttss2si rax, xmm0
-		c.emitBytes(0xF3, 0x48, 0x0F, 0x2C, 0xC0)
-	} else {
-		// cvttsd2si rax, xmm0
-		c.emitBytes(0xF2, 0x48, 0x0F, 0x2C, 0xC0)
+		prefix = 0xF3
 	}
 
+	// The signed 64-bit conversion covers every narrower unsigned result,
+	// so only u64 needs the out-of-range path
+	if inst.Opcode() == ir.OpFPToUI && SizeOf(inst.Type()) == 8 {
+		// Values >= 2^63 overflow cvttsd2si. Subtract 2^63 first and
+		// put the top bit back afterwards.
+		c.loadConstFloat(1, 9223372036854775808.0, srcType.BitWidth)
+		c.loadToFpReg(0, src)
+
+		// comisd/comiss xmm0, xmm1
+		comisPrefix := byte(0)
+		if srcType.BitWidth == 64 {
+			comisPrefix = 0x66
+		}
+		c.emitSSE(comisPrefix, 0, 0x2F, 0, 0xC1)
+		// jae big
+		c.emitBytes(0x73, 0x00)
+		bigFrom := c.text.Len()
+		// cvtt*2si rax, xmm0; jmp done
+		c.emitSSE(prefix, rexW, 0x2C, 0, 0xC0)
+		c.emitBytes(0xEB, 0x00)
+		doneFrom := c.text.Len()
+		c.text.Bytes()[bigFrom-1] = byte(doneFrom - bigFrom)
+		// big: sub* xmm0, xmm1; cvtt*2si rax, xmm0; btc rax, 63
+		c.emitSSE(prefix, 0, 0x5C, 0, 0xC1)
+		c.emitSSE(prefix, rexW, 0x2C, 0, 0xC0)
+		c.emitBytes(0x48, 0x0F, 0xBA, 0xF8, 63)
+		// done:
+		c.text.Bytes()[doneFrom-1] = byte(c.text.Len() - doneFrom)
+
+		c.storeFromReg(RAX, inst)
+		return nil
+	}
+
+	c.loadToFpReg(0, src)
+
+	// cvttss2si/cvttsd2si rax, xmm0
+	c.emitSSE(prefix, rexW, 0x2C, 0, 0xC0)
+
 	c.storeFromReg(RAX, inst)
 	return nil
 }
 
-// Integer to float conversion
 func (c *compiler) intToFpOp(inst *ir.CastInst) error {
 	src := inst.Operands()[0]
-	dstType := inst.Type().(*types.FloatType)
+	dstType, err := scalarFloat(inst.Type())
+	if err != nil {
+		return err
+	}
+	if src.Type().Kind() != types.IntegerKind {
+		return fmt.Errorf("int-to-fp cast from %s: only scalar conversions are supported", src.Type())
+	}
+
+	prefix := byte(0xF2)
+	if dstType.BitWidth == 32 {
+		prefix = 0xF3
+	}
+	unsigned := inst.Opcode() == ir.OpUIToFP
 
 	c.loadToReg(RAX, src)
 
-	if dstType.BitWidth == 32 {
-		// cvtsi2ss xmm0, rax
-		c.emitBytes(0xF3, 0x48, 0x0F, 0x2A, 0xC0)
-	} else {
-		// cvtsi2sd xmm0, rax
-		c.emitBytes(0xF2, 0x48, 0x0F, 0x2A, 0xC0)
+	// Widen to 64 bits with the conversion's signedness; stack slots load
+	// zero-extended and constants sign-extended, so neither can be trusted
+	switch size := SizeOf(src.Type()); {
+	case size == 1 && unsigned:
+		c.emitBytes(0x48, 0x0F, 0xB6, 0xC0) // movzx rax, al
+	case size == 1:
+		c.emitBytes(0x48, 0x0F, 0xBE, 0xC0) // movsx rax, al
+	case size == 2 && unsigned:
+		c.emitBytes(0x48, 0x0F, 0xB7, 0xC0) // movzx rax, ax
+	case size == 2:
+		c.emitBytes(0x48, 0x0F, 0xBF, 0xC0) // movsx rax, ax
+	case size == 4 && unsigned:
+		c.emitBytes(0x89, 0xC0) // mov eax, eax
+	case size == 4:
+		c.emitBytes(0x48, 0x63, 0xC0) // movsxd rax, eax
+	case size == 8 && unsigned:
+		// cvtsi2sd is signed. With the top bit set, halve the value
+		// (folding the lost low bit back in so rounding is unchanged),
+		// convert, then double.
+		// test rax, rax; js big
+		c.emitBytes(0x48, 0x85, 0xC0)
+		c.emitBytes(0x78, 0x00)
+		bigFrom := c.text.Len()
+		// cvtsi2s* xmm0, rax; jmp done
+		c.emitSSE(prefix, rexW, 0x2A, 0, 0xC0)
+		c.emitBytes(0xEB, 0x00)
+		doneFrom := c.text.Len()
+		c.text.Bytes()[bigFrom-1] = byte(doneFrom - bigFrom)
+		// big: mov rcx, rax; shr rcx, 1; and eax, 1; or rcx, rax
+		c.emitBytes(0x48, 0x89, 0xC1)
+		c.emitBytes(0x48, 0xD1, 0xE9)
+		c.emitBytes(0x83, 0xE0, 0x01)
+		c.emitBytes(0x48, 0x09, 0xC1)
+		// cvtsi2s* xmm0, rcx; adds* xmm0, xmm0
+		c.emitSSE(prefix, rexW, 0x2A, 0, 0xC1)
+		c.emitSSE(prefix, 0, 0x58, 0, 0xC0)
+		// done:
+		c.text.Bytes()[doneFrom-1] = byte(c.text.Len() - doneFrom)
+
+		c.storeFromFpReg(0, inst)
+		return nil
 	}
 
+	// cvtsi2ss/cvtsi2sd xmm0, rax
+	c.emitSSE(prefix, rexW, 0x2A, 0, 0xC0)
+
 	c.storeFromFpReg(0, inst)
 	return nil
 }
@@ -458,8 +1385,17 @@ func (c *compiler) bitcastOp(inst *ir.CastInst) error {
 	src := inst.Operands()[0]
 
 	// For bitcast, just copy the bits
-	// For pointer/int conversions, also just copy
 	c.loadToReg(RAX, src)
+
+	// Pointers are 64 bits; an integer on the other side may be narrower.
+	// ptrtoint truncates to it and inttoptr zero-extends from it, as
+	// trunc and zext would.
+	switch inst.Opcode() {
+	case ir.OpPtrToInt:
+		c.emitZeroExtendRAX(SizeOf(inst.Type()))
+	case ir.OpIntToPtr:
+		c.emitZeroExtendRAX(SizeOf(src.Type()))
+	}
 	c.storeFromReg(RAX, inst)
 
 	return nil
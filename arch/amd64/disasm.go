@@ -0,0 +1,829 @@
+package amd64
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Disassemble decodes machine code into Intel-syntax instructions, one per
+// string, formatted like objdump -M intel prints them but with a space
+// after each comma:
+//
+//	add rax, rcx
+//	mov qword ptr [rbp-0x8], rax
+//	jne 0x2f
+//
+// It knows the instructions the backend emits: the general-purpose integer
+// instructions, the SSE scalar and bitwise instructions and their VEX
+// forms, the x87 instructions of long double arithmetic, and fences.
+// Immediates and displacements are signed hex. Branch targets are offsets
+// into code, and RIP-relative operands show the raw displacement, as
+// relocations aren't applied. Anything else, and code that ends
+// mid-instruction, is an error naming its offset.
+func Disassemble(code []byte) ([]string, error) {
+	var out []string
+	for pos := 0; pos < len(code); {
+		inst, size, err := DisassembleAt(code, pos)
+		if err != nil {
+			return out, err
+		}
+		out = append(out, inst)
+		pos += size
+	}
+	return out, nil
+}
+
+// DisassembleAt decodes the one instruction at code[pos:] like Disassemble
+// and returns it with its length in bytes
+func DisassembleAt(code []byte, pos int) (string, int, error) {
+	d := &decoder{code: code, pos: pos}
+	inst, err := d.instruction()
+	if err == nil {
+		err = d.err
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("offset %#x: %w", pos, err)
+	}
+	return inst, d.pos - pos, nil
+}
+
+// decoder holds the state of decoding one instruction
+type decoder struct {
+	code []byte
+	pos  int
+	err  error // Set when the code ends mid-instruction
+
+	rex     byte
+	hasREX  bool // Even an empty REX changes ah-bh to spl-dil
+	opsize  bool // 0x66 prefix
+	rep     byte // 0xF2 or 0xF3 prefix
+	lock    bool
+	fs      bool
+	notrack bool // 0x3E prefix on an indirect jmp or call
+
+	vex  bool // Operands come from a VEX prefix; vvvv names the extra source
+	vvvv int
+
+	mod, reg, rm int // ModRM fields; reg is extended by REX.R
+}
+
+var gprNames = [4][16]string{
+	{"al", "cl", "dl", "bl", "spl", "bpl", "sil", "dil", "r8b", "r9b", "r10b", "r11b", "r12b", "r13b", "r14b", "r15b"},
+	{"ax", "cx", "dx", "bx", "sp", "bp", "si", "di", "r8w", "r9w", "r10w", "r11w", "r12w", "r13w", "r14w", "r15w"},
+	{"eax", "ecx", "edx", "ebx", "esp", "ebp", "esi", "edi", "r8d", "r9d", "r10d", "r11d", "r12d", "r13d", "r14d", "r15d"},
+	{"rax", "rcx", "rdx", "rbx", "rsp", "rbp", "rsi", "rdi", "r8", "r9", "r10", "r11", "r12", "r13", "r14", "r15"},
+}
+
+var ptrNames = map[int]string{1: "byte", 2: "word", 4: "dword", 8: "qword", 10: "tbyte", 16: "xmmword"}
+
+// The 0x00-0x3F arithmetic group and the 0x80-0x83 immediate forms, by
+// /digit
+var aluNames = [8]string{"add", "or", "adc", "sbb", "and", "sub", "xor", "cmp"}
+
+var shiftNames = [8]string{"rol", "ror", "rcl", "rcr", "shl", "shr", "sal", "sar"}
+
+var unaryNames = [8]string{"test", "test", "not", "neg", "mul", "imul", "div", "idiv"}
+
+// Condition code suffixes by the nibble in Jcc, SETcc and CMOVcc
+var condNames = [16]string{"o", "no", "b", "ae", "e", "ne", "be", "a", "s", "ns", "p", "np", "l", "ge", "le", "g"}
+
+func (d *decoder) u8() byte {
+	if d.pos >= len(d.code) {
+		d.err = fmt.Errorf("truncated instruction")
+		return 0
+	}
+	b := d.code[d.pos]
+	d.pos++
+	return b
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.pos+n > len(d.code) {
+		d.err = fmt.Errorf("truncated instruction")
+		d.pos = len(d.code)
+		return make([]byte, n)
+	}
+	b := d.code[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *decoder) imm(size int) int64 {
+	switch size {
+	case 1:
+		return int64(int8(d.u8()))
+	case 2:
+		return int64(int16(binary.LittleEndian.Uint16(d.bytes(2))))
+	case 8:
+		return int64(binary.LittleEndian.Uint64(d.bytes(8)))
+	}
+	return int64(int32(binary.LittleEndian.Uint32(d.bytes(4))))
+}
+
+// hex formats a signed value the way Assemble parses it
+func hex(v int64) string {
+	if v < 0 {
+		return fmt.Sprintf("-%#x", uint64(-v))
+	}
+	return fmt.Sprintf("%#x", v)
+}
+
+// size is the operand size of a non-byte integer instruction
+func (d *decoder) size() int {
+	switch {
+	case d.rex&rexW != 0:
+		return 8
+	case d.opsize:
+		return 2
+	}
+	return 4
+}
+
+func (d *decoder) gpr(n, size int) string {
+	if size == 1 && n >= 4 && n < 8 && !d.hasREX && !d.vex {
+		return [4]string{"ah", "ch", "dh", "bh"}[n-4]
+	}
+	switch size {
+	case 1:
+		return gprNames[0][n]
+	case 2:
+		return gprNames[1][n]
+	case 4:
+		return gprNames[2][n]
+	}
+	return gprNames[3][n]
+}
+
+func (d *decoder) modRM() {
+	b := d.u8()
+	d.mod = int(b >> 6)
+	d.reg = int(b>>3&7) | int(d.rex&rexR)<<1
+	d.rm = int(b & 7)
+}
+
+// regOp is the ModRM reg operand as a general register of size bytes
+func (d *decoder) regOp(size int) string {
+	return d.gpr(d.reg, size)
+}
+
+// rmOp is the ModRM r/m operand: a general register of size bytes, or
+// memory of that size
+func (d *decoder) rmOp(size int) string {
+	if d.mod == 3 {
+		return d.gpr(d.rm|int(d.rex&rexB)<<3, size)
+	}
+	return d.memory(size)
+}
+
+// xmmRM is the ModRM r/m operand as an XMM register, or memory of size
+// bytes
+func (d *decoder) xmmRM(size int) string {
+	if d.mod == 3 {
+		return fmt.Sprintf("xmm%d", d.rm|int(d.rex&rexB)<<3)
+	}
+	return d.memory(size)
+}
+
+func (d *decoder) xmmReg() string {
+	return fmt.Sprintf("xmm%d", d.reg)
+}
+
+// memory decodes the addressing form of the ModRM byte just read. A size
+// of 0 leaves out the "ptr" annotation, as lea has none.
+func (d *decoder) memory(size int) string {
+	var base, index string
+	scale := 1
+	var disp int64
+	switch {
+	case d.rm == 4:
+		sib := d.u8()
+		idx := int(sib>>3&7) | int(d.rex&rexX)<<2
+		if idx != 4 {
+			index = gprNames[3][idx]
+			scale = 1 << (sib >> 6)
+		}
+		if sib&7 == 5 && d.mod == 0 {
+			disp = d.imm(4)
+		} else {
+			base = gprNames[3][int(sib&7)|int(d.rex&rexB)<<3]
+		}
+	case d.rm == 5 && d.mod == 0:
+		base = "rip"
+		disp = d.imm(4)
+	default:
+		base = gprNames[3][d.rm|int(d.rex&rexB)<<3]
+	}
+	switch d.mod {
+	case 1:
+		disp = d.imm(1)
+	case 2:
+		disp = d.imm(4)
+	}
+
+	var sb strings.Builder
+	if size != 0 {
+		sb.WriteString(ptrNames[size] + " ptr ")
+	}
+	if d.fs {
+		sb.WriteString("fs:")
+	}
+	sb.WriteByte('[')
+	sb.WriteString(base)
+	if index != "" {
+		if base != "" {
+			sb.WriteByte('+')
+		}
+		fmt.Fprintf(&sb, "%s*%d", index, scale)
+	}
+	switch {
+	case base == "" && index == "":
+		sb.WriteString(hex(disp))
+	case disp < 0:
+		sb.WriteString(hex(disp))
+	case disp > 0 || d.mod != 0 || base == "rip":
+		sb.WriteString("+" + hex(disp))
+	}
+	sb.WriteByte(']')
+	return sb.String()
+}
+
+// target reads a branch displacement of size bytes and returns the offset
+// it lands on
+func (d *decoder) target(size int) string {
+	rel := d.imm(size)
+	return fmt.Sprintf("%#x", int64(d.pos)+rel)
+}
+
+func (d *decoder) instruction() (string, error) {
+	// Legacy prefixes, then REX
+prefixes:
+	for d.pos < len(d.code) {
+		switch b := d.code[d.pos]; b {
+		case 0x66:
+			d.opsize = true
+		case 0xF2, 0xF3:
+			d.rep = b
+		case 0xF0:
+			d.lock = true
+		case 0x64:
+			d.fs = true
+		case 0x3E:
+			d.notrack = true
+		default:
+			break prefixes
+		}
+		d.pos++
+	}
+	if d.pos < len(d.code) && d.code[d.pos]&0xF0 == 0x40 {
+		d.rex = d.u8() & 0x0F
+		d.hasREX = true
+	}
+
+	inst, err := d.opcode(d.u8())
+	if d.lock && err == nil {
+		inst = "lock " + inst
+	}
+	if d.notrack && err == nil {
+		inst = "notrack " + inst
+	}
+	return inst, err
+}
+
+func (d *decoder) opcode(op byte) (string, error) {
+	switch {
+	case op < 0x40 && op&7 < 6:
+		name := aluNames[op>>3]
+		size := d.size()
+		if op&1 == 0 {
+			size = 1
+		}
+		switch op & 7 {
+		case 0, 1:
+			d.modRM()
+			return name + " " + d.rmOp(size) + ", " + d.regOp(size), nil
+		case 2, 3:
+			d.modRM()
+			return name + " " + d.regOp(size) + ", " + d.rmOp(size), nil
+		}
+		return name + " " + d.gpr(RAX, size) + ", " + hex(d.imm(min(size, 4))), nil
+
+	case op >= 0x50 && op <= 0x5F:
+		name := "push"
+		if op >= 0x58 {
+			name = "pop"
+		}
+		return name + " " + gprNames[3][int(op&7)|int(d.rex&rexB)<<3], nil
+
+	case op >= 0x70 && op <= 0x7F:
+		return "j" + condNames[op&0xF] + " " + d.target(1), nil
+
+	case op >= 0xB0 && op <= 0xB7:
+		return "mov " + d.gpr(int(op&7)|int(d.rex&rexB)<<3, 1) + ", " + hex(d.imm(1)), nil
+
+	case op >= 0xB8 && op <= 0xBF:
+		reg := int(op&7) | int(d.rex&rexB)<<3
+		if d.rex&rexW != 0 {
+			return "movabs " + d.gpr(reg, 8) + ", " + hex(d.imm(8)), nil
+		}
+		size := d.size()
+		return "mov " + d.gpr(reg, size) + ", " + hex(d.imm(size)), nil
+	}
+
+	switch op {
+	case 0x0F:
+		return d.twoByte(d.u8())
+
+	case 0xC4, 0xC5:
+		return d.vexOpcode(op)
+
+	case 0x63:
+		d.modRM()
+		return "movsxd " + d.regOp(d.size()) + ", " + d.rmOp(4), nil
+
+	case 0x69, 0x6B:
+		d.modRM()
+		size := d.size()
+		src := d.rmOp(size)
+		immSize := min(size, 4)
+		if op == 0x6B {
+			immSize = 1
+		}
+		return "imul " + d.regOp(size) + ", " + src + ", " + hex(d.imm(immSize)), nil
+
+	case 0x80, 0x81, 0x83:
+		d.modRM()
+		size := d.size()
+		immSize := min(size, 4)
+		if op == 0x80 {
+			size, immSize = 1, 1
+		} else if op == 0x83 {
+			immSize = 1
+		}
+		dst := d.rmOp(size)
+		return aluNames[d.reg&7] + " " + dst + ", " + hex(d.imm(immSize)), nil
+
+	case 0x84, 0x85, 0x86, 0x87, 0x88, 0x89:
+		d.modRM()
+		size := d.size()
+		if op&1 == 0 {
+			size = 1
+		}
+		name := map[byte]string{0x84: "test", 0x86: "xchg", 0x88: "mov"}[op&^1]
+		return name + " " + d.rmOp(size) + ", " + d.regOp(size), nil
+
+	case 0x8A, 0x8B:
+		d.modRM()
+		size := d.size()
+		if op == 0x8A {
+			size = 1
+		}
+		return "mov " + d.regOp(size) + ", " + d.rmOp(size), nil
+
+	case 0x8D:
+		d.modRM()
+		if d.mod == 3 {
+			return "", fmt.Errorf("lea with a register operand")
+		}
+		return "lea " + d.regOp(d.size()) + ", " + d.memory(0), nil
+
+	case 0x90:
+		if d.rep == 0xF3 {
+			return "pause", nil
+		}
+		return "nop", nil
+
+	case 0x98:
+		return map[int]string{2: "cbw", 4: "cwde", 8: "cdqe"}[d.size()], nil
+
+	case 0x99:
+		return map[int]string{2: "cwd", 4: "cdq", 8: "cqo"}[d.size()], nil
+
+	case 0xA4, 0xA5, 0xAA, 0xAB:
+		name := "movs"
+		if op >= 0xAA {
+			name = "stos"
+		}
+		suffix := map[int]string{2: "w", 4: "d", 8: "q"}[d.size()]
+		if op&1 == 0 {
+			suffix = "b"
+		}
+		if d.rep != 0 {
+			name = "rep " + name
+		}
+		return name + suffix, nil
+
+	case 0xC0, 0xC1, 0xD0, 0xD1, 0xD2, 0xD3:
+		d.modRM()
+		size := d.size()
+		if op&1 == 0 {
+			size = 1
+		}
+		dst := d.rmOp(size)
+		var count string
+		switch op &^ 1 {
+		case 0xC0:
+			count = hex(d.imm(1))
+		case 0xD0:
+			count = "1"
+		default:
+			count = "cl"
+		}
+		return shiftNames[d.reg&7] + " " + dst + ", " + count, nil
+
+	case 0xC3:
+		return "ret", nil
+	case 0xC9:
+		return "leave", nil
+	case 0xCC:
+		return "int3", nil
+	case 0xF4:
+		return "hlt", nil
+	case 0xFC:
+		return "cld", nil
+	case 0xFD:
+		return "std", nil
+
+	case 0xC6, 0xC7:
+		d.modRM()
+		size, immSize := d.size(), min(d.size(), 4)
+		if op == 0xC6 {
+			size, immSize = 1, 1
+		}
+		dst := d.rmOp(size)
+		return "mov " + dst + ", " + hex(d.imm(immSize)), nil
+
+	case 0xD9, 0xDB, 0xDD, 0xDE:
+		return d.x87(op)
+
+	case 0xE8:
+		return "call " + d.target(4), nil
+	case 0xE9:
+		return "jmp " + d.target(4), nil
+	case 0xEB:
+		return "jmp " + d.target(1), nil
+
+	case 0xF6, 0xF7:
+		d.modRM()
+		size := d.size()
+		if op == 0xF6 {
+			size = 1
+		}
+		dst := d.rmOp(size)
+		name := unaryNames[d.reg&7]
+		if d.reg&7 < 2 {
+			return name + " " + dst + ", " + hex(d.imm(min(size, 4))), nil
+		}
+		return name + " " + dst, nil
+
+	case 0xFE, 0xFF:
+		d.modRM()
+		switch digit := d.reg & 7; {
+		case digit < 2:
+			size := d.size()
+			if op == 0xFE {
+				size = 1
+			}
+			return [2]string{"inc", "dec"}[digit] + " " + d.rmOp(size), nil
+		case op == 0xFF && (digit == 2 || digit == 4 || digit == 6):
+			// Always 64-bit, without REX.W
+			return map[int]string{2: "call", 4: "jmp", 6: "push"}[digit] + " " + d.rmOp(8), nil
+		}
+	}
+	return "", fmt.Errorf("unsupported opcode %#02x", op)
+}
+
+// x87Memory names the x87 loads and stores by opcode and /digit, with
+// their operand size
+var x87Memory = map[[2]int]struct {
+	name string
+	size int
+}{
+	{0xD9, 0}: {"fld", 4}, {0xD9, 3}: {"fstp", 4},
+	{0xDD, 0}: {"fld", 8}, {0xDD, 3}: {"fstp", 8},
+	{0xDB, 5}: {"fld", 10}, {0xDB, 7}: {"fstp", 10},
+}
+
+// x87 decodes the x87 instructions long double arithmetic uses: fld and
+// fstp of each width, fldz, fchs, and the popping arithmetic forms
+func (d *decoder) x87(op byte) (string, error) {
+	d.modRM()
+	digit := d.reg & 7
+	if d.mod != 3 {
+		if form, ok := x87Memory[[2]int{int(op), digit}]; ok {
+			return form.name + " " + d.memory(form.size), nil
+		}
+		return "", fmt.Errorf("unsupported x87 instruction %#02x /%d", op, digit)
+	}
+	arith := map[int]string{0: "faddp", 1: "fmulp", 5: "fsubp", 7: "fdivp"}
+	switch {
+	case op == 0xD9 && digit == 5 && d.rm == 6:
+		return "fldz", nil
+	case op == 0xD9 && digit == 4 && d.rm == 0:
+		return "fchs", nil
+	case op == 0xDD && digit == 3:
+		return fmt.Sprintf("fstp st(%d)", d.rm), nil
+	case op == 0xDE && arith[digit] != "":
+		return fmt.Sprintf("%s st(%d), st", arith[digit], d.rm), nil
+	}
+	return "", fmt.Errorf("unsupported x87 instruction %#02x %#02x", op, 0xC0|digit<<3|d.rm)
+}
+
+func (d *decoder) twoByte(op byte) (string, error) {
+	switch {
+	case op >= 0x40 && op <= 0x4F:
+		d.modRM()
+		size := d.size()
+		return "cmov" + condNames[op&0xF] + " " + d.regOp(size) + ", " + d.rmOp(size), nil
+	case op >= 0x80 && op <= 0x8F:
+		return "j" + condNames[op&0xF] + " " + d.target(4), nil
+	case op >= 0x90 && op <= 0x9F:
+		d.modRM()
+		return "set" + condNames[op&0xF] + " " + d.rmOp(1), nil
+	case op >= 0xC8 && op <= 0xCF:
+		return "bswap " + d.gpr(int(op&7)|int(d.rex&rexB)<<3, d.size()), nil
+	}
+
+	switch op {
+	case 0x05:
+		return "syscall", nil
+	case 0x0B:
+		return "ud2", nil
+	case 0xA2:
+		return "cpuid", nil
+
+	case 0x1E:
+		d.modRM()
+		if d.rep == 0xF3 && d.mod == 3 && d.reg == 7 && d.rm == 2 {
+			return "endbr64", nil
+		}
+		return "nop " + d.rmOp(d.size()), nil
+
+	case 0x1F:
+		d.modRM()
+		return "nop " + d.rmOp(d.size()), nil
+
+	case 0xAE:
+		d.modRM()
+		if fence, ok := map[int]string{5: "lfence", 6: "mfence", 7: "sfence"}[d.reg&7]; ok && d.mod == 3 {
+			return fence, nil
+		}
+
+	case 0xAF:
+		d.modRM()
+		size := d.size()
+		return "imul " + d.regOp(size) + ", " + d.rmOp(size), nil
+
+	case 0xA3, 0xAB, 0xB0, 0xB1, 0xC0, 0xC1:
+		d.modRM()
+		size := d.size()
+		if op == 0xB0 || op == 0xC0 {
+			size = 1
+		}
+		name := map[byte]string{0xA3: "bt", 0xAB: "bts", 0xB0: "cmpxchg", 0xB1: "cmpxchg", 0xC0: "xadd", 0xC1: "xadd"}[op]
+		return name + " " + d.rmOp(size) + ", " + d.regOp(size), nil
+
+	case 0xB6, 0xB7, 0xBE, 0xBF:
+		d.modRM()
+		name := "movzx"
+		if op >= 0xBE {
+			name = "movsx"
+		}
+		srcSize := 1
+		if op&1 != 0 {
+			srcSize = 2
+		}
+		return name + " " + d.regOp(d.size()) + ", " + d.rmOp(srcSize), nil
+
+	case 0xB8, 0xBC, 0xBD:
+		d.modRM()
+		var name string
+		switch {
+		case op == 0xB8 && d.rep == 0xF3:
+			name = "popcnt"
+		case op == 0xBC:
+			name = map[bool]string{false: "bsf", true: "tzcnt"}[d.rep == 0xF3]
+		case op == 0xBD:
+			name = map[bool]string{false: "bsr", true: "lzcnt"}[d.rep == 0xF3]
+		default:
+			return "", fmt.Errorf("unsupported opcode 0x0f 0xb8")
+		}
+		size := d.size()
+		return name + " " + d.regOp(size) + ", " + d.rmOp(size), nil
+
+	case 0xBA:
+		d.modRM()
+		if d.reg&7 >= 4 {
+			size := d.size()
+			dst := d.rmOp(size)
+			name := [4]string{"bt", "bts", "btr", "btc"}[d.reg&7-4]
+			return name + " " + dst + ", " + hex(d.imm(1)), nil
+		}
+
+	default:
+		if inst, ok := d.sse(op); ok {
+			return inst, nil
+		}
+	}
+	return "", fmt.Errorf("unsupported opcode 0x0f %#02x", op)
+}
+
+// ssePrefix picks the form of an SSE instruction by its mandatory prefix:
+// none, 0x66, 0xF3 or 0xF2
+func (d *decoder) ssePrefix() int {
+	switch {
+	case d.rep == 0xF3:
+		return 2
+	case d.rep == 0xF2:
+		return 3
+	case d.opsize:
+		return 1
+	}
+	return 0
+}
+
+// sse decodes the 0x0F-map SSE instructions, in legacy or VEX form
+func (d *decoder) sse(op byte) (string, bool) {
+	p := d.ssePrefix()
+	v := ""
+	if d.vex {
+		v = "v"
+	}
+	// Size of a memory operand of the ps, pd, ss and sd forms
+	elem := [4]int{16, 16, 4, 8}[p]
+	suffix := [4]string{"ps", "pd", "ss", "sd"}[p]
+	// Three-operand VEX form, with vvvv the first source
+	three := func(dst, src string) string {
+		if d.vex {
+			return v + dst + fmt.Sprintf(", xmm%d, ", d.vvvv) + src
+		}
+		return dst + ", " + src
+	}
+
+	switch op {
+	case 0x10, 0x11, 0x28, 0x29:
+		name := "movu"
+		if op >= 0x28 {
+			if p >= 2 {
+				return "", false
+			}
+			name = "mova"
+		}
+		name += suffix
+		if p >= 2 {
+			name = "mov" + suffix
+		}
+		d.modRM()
+		rm := d.xmmRM(elem)
+		if op&1 != 0 {
+			return v + name + " " + rm + ", " + d.xmmReg(), true
+		}
+		if d.vex && d.mod == 3 && p >= 2 {
+			return three(name+" "+d.xmmReg(), rm), true
+		}
+		return v + name + " " + d.xmmReg() + ", " + rm, true
+
+	case 0x2A:
+		if p < 2 {
+			return "", false
+		}
+		d.modRM()
+		size := 4
+		if d.rex&rexW != 0 {
+			size = 8
+		}
+		return three("cvtsi2"+suffix+" "+d.xmmReg(), d.rmOp(size)), true
+
+	case 0x2C, 0x2D:
+		if p < 2 {
+			return "", false
+		}
+		d.modRM()
+		size := 4
+		if d.rex&rexW != 0 {
+			size = 8
+		}
+		name := "cvt" + suffix + "2si"
+		if op == 0x2C {
+			name = "cvtt" + suffix + "2si"
+		}
+		return v + name + " " + d.gpr(d.reg, size) + ", " + d.xmmRM(elem), true
+
+	case 0x2E, 0x2F:
+		if p >= 2 {
+			return "", false
+		}
+		d.modRM()
+		name := [2]string{"ucomis", "comis"}[op-0x2E] + suffix[1:]
+		return v + name + " " + d.xmmReg() + ", " + d.xmmRM([2]int{4, 8}[p]), true
+
+	case 0x51, 0x58, 0x59, 0x5C, 0x5D, 0x5E, 0x5F:
+		d.modRM()
+		name := map[byte]string{0x51: "sqrt", 0x58: "add", 0x59: "mul", 0x5C: "sub", 0x5D: "min", 0x5E: "div", 0x5F: "max"}[op]
+		return three(name+suffix+" "+d.xmmReg(), d.xmmRM(elem)), true
+
+	case 0x54, 0x55, 0x56, 0x57:
+		if p >= 2 {
+			return "", false
+		}
+		d.modRM()
+		name := [4]string{"and", "andn", "or", "xor"}[op-0x54]
+		return three(name+suffix+" "+d.xmmReg(), d.xmmRM(16)), true
+
+	case 0x5A:
+		d.modRM()
+		name := [4]string{"cvtps2pd", "cvtpd2ps", "cvtss2sd", "cvtsd2ss"}[p]
+		return three(name+" "+d.xmmReg(), d.xmmRM([4]int{8, 16, 4, 8}[p])), true
+
+	case 0x6E, 0x7E:
+		if p == 2 && op == 0x7E {
+			d.modRM()
+			return v + "movq " + d.xmmReg() + ", " + d.xmmRM(8), true
+		}
+		if p != 1 {
+			return "", false
+		}
+		d.modRM()
+		name, size := "movd", 4
+		if d.rex&rexW != 0 {
+			name, size = "movq", 8
+		}
+		if op == 0x6E {
+			return v + name + " " + d.xmmReg() + ", " + d.rmOp(size), true
+		}
+		return v + name + " " + d.rmOp(size) + ", " + d.xmmReg(), true
+
+	case 0xD6:
+		if p != 1 {
+			return "", false
+		}
+		d.modRM()
+		return v + "movq " + d.xmmRM(8) + ", " + d.xmmReg(), true
+
+	case 0x6F, 0x7F:
+		name := map[int]string{1: "movdqa", 2: "movdqu"}[p]
+		if name == "" {
+			return "", false
+		}
+		d.modRM()
+		if op == 0x7F {
+			return v + name + " " + d.xmmRM(16) + ", " + d.xmmReg(), true
+		}
+		return v + name + " " + d.xmmReg() + ", " + d.xmmRM(16), true
+
+	case 0xEF:
+		if p != 1 {
+			return "", false
+		}
+		d.modRM()
+		return three("pxor "+d.xmmReg(), d.xmmRM(16)), true
+
+	case 0xC2:
+		d.modRM()
+		src := d.xmmRM(elem)
+		return three("cmp"+suffix+" "+d.xmmReg(), src) + ", " + hex(d.imm(1)), true
+	}
+	return "", false
+}
+
+// vexOpcode decodes a VEX-prefixed instruction: the AVX forms of the SSE
+// instructions, and FMA
+func (d *decoder) vexOpcode(prefix byte) (string, error) {
+	d.vex = true
+	b1 := d.u8()
+	opMap, pp := byte(1), byte(0)
+	var b2 byte
+	if prefix == 0xC5 {
+		// C5 [R vvvv L pp]
+		b2 = b1
+		d.rex = ^b1 >> 5 & 0x04
+	} else {
+		// C4 [R X B m-mmmm] [W vvvv L pp]
+		b2 = d.u8()
+		d.rex = ^b1>>5&0x07 | b2>>4&0x08
+		opMap = b1 & 0x1F
+	}
+	d.vvvv = int(^b2 >> 3 & 0xF)
+	pp = b2 & 3
+	if b2&0x04 != 0 {
+		return "", fmt.Errorf("256-bit VEX instructions are not supported")
+	}
+	d.opsize = pp == 1
+	d.rep = [4]byte{0, 0, 0xF3, 0xF2}[pp]
+
+	op := d.u8()
+	switch {
+	case opMap == 1:
+		if inst, ok := d.sse(op); ok {
+			return inst, nil
+		}
+	case opMap == 2 && op == 0xA9 && pp == 1:
+		d.modRM()
+		name, size := "vfmadd213ss", 4
+		if d.rex&rexW != 0 {
+			name, size = "vfmadd213sd", 8
+		}
+		return fmt.Sprintf("%s %s, xmm%d, %s", name, d.xmmReg(), d.vvvv, d.xmmRM(size)), nil
+	}
+	return "", fmt.Errorf("unsupported VEX opcode %#02x in map %d", op, opMap)
+}
@@ -1,32 +1,76 @@
 package amd64
 
 import (
-	"unsafe"
+	"encoding/binary"
+	"math"
 
 	"github.com/arc-language/core-builder/ir"
 	"github.com/arc-language/core-builder/types"
 )
 
-// Load a value into a register
+// Load a value into a register.
+//
+// Undef loads as zero: every use observes the same concrete value, so a
+// later freeze or store never sees two different results for one undef.
+// The IR has no poison constant of its own; what a front end means as
+// poison arrives as undef and loads the same way. The one use that picks
+// another value is a divisor, where divOp loads 1 so the division can't
+// trap.
 func (c *compiler) loadToReg(reg int, value ir.Value) {
 	// Handle constants
 	switch v := value.(type) {
 	case *ir.ConstantInt:
 		c.loadConstInt(reg, v.Value)
 		return
+	case *ir.ConstantFloat:
+		// The raw bits at the constant's own width, for stores and moves
+		// that carry a float through a general-purpose register
+		c.loadConstInt(reg, int64(floatBits(v)))
+		return
 	case *ir.ConstantNull:
 		// xor reg, reg
 		c.emitXorReg(reg, reg)
 		return
 	case *ir.ConstantUndef:
-		// Leave undefined - just xor to zero
+		// Undef lowers to zero (see above)
 		c.emitXorReg(reg, reg)
 		return
 	case *ir.Global:
-		// Load address of global
-		// lea reg, [rip + offset]
-		// This requires a relocation
-		c.emitLeaRipRelative(reg, v.Name())
+		if offset, ok := c.tlsSlots[v]; ok {
+			// Thread-local: address was resolved in the prologue
+			c.emitLoadFromStack(reg, offset, 8)
+			return
+		}
+		if (isDeclaration(v) || v.Linkage == ir.CommonLinkage) && v.Visibility == ir.DefaultVisibility ||
+			v.Linkage == ir.ExternalWeakLinkage {
+			// Defined elsewhere, possibly in a shared library: take the
+			// address from the GOT, as for an external function. So may
+			// a common global be, if another object initializes it, and
+			// a weak reference must be: if it stays undefined, only a GOT
+			// entry can hold its address of 0.
+			c.emitLoadGotEntry(reg, v.Name())
+			return
+		}
+		// Load address of global. This requires a relocation.
+		c.emitGlobalAddress(reg, v.Name())
+		return
+	case *ir.Function:
+		// Function address (a callback or vtable entry)
+		if c.localFuncs[v.Name()] || BindsLocally(v) {
+			// Local to this component: it can't be preempted, address
+			// it directly
+			c.emitGlobalAddress(reg, v.Name())
+		} else {
+			// Possibly defined in, or preempted by, a shared library:
+			// take the address from the GOT so it is the canonical one,
+			// or 0 for a weak reference left undefined
+			c.emitLoadGotEntry(reg, v.Name())
+		}
+		return
+	}
+
+	if reg == RAX && value == c.lastResult && c.text.Len() == c.lastResultEnd {
+		// Stored from RAX and nothing emitted since: still there
 		return
 	}
 
@@ -48,7 +92,11 @@ func (c *compiler) loadToFpReg(xmmReg int, value ir.Value) {
 	// Handle constants
 	switch v := value.(type) {
 	case *ir.ConstantFloat:
-		c.loadConstFloat(xmmReg, v.Value, v.Type().(*types.FloatType).BitWidth)
+		c.loadConstFloat(xmmReg, v.Value, floatWidth(v))
+		return
+	case *ir.ConstantUndef, *ir.ConstantZero:
+		// Undef lowers to +0.0, matching the integer path
+		c.emitXorps(xmmReg, xmmReg)
 		return
 	}
 
@@ -60,8 +108,11 @@ func (c *compiler) loadToFpReg(xmmReg int, value ir.Value) {
 		return
 	}
 
-	fpType := value.Type().(*types.FloatType)
-	if fpType.BitWidth == 32 {
+	if isXMMVector(value.Type()) {
+		c.emitVecLoadFromStack(xmmReg, offset)
+		return
+	}
+	if isSingle(value.Type()) {
 		// movss xmm, [rbp + offset]
 		c.emitFpLoadFromStack(xmmReg, offset, false)
 	} else {
@@ -79,6 +130,22 @@ func (c *compiler) storeFromReg(reg int, dest ir.Value) {
 
 	size := SizeOf(dest.Type())
 	c.emitStoreToStack(reg, offset, size)
+	if reg == RAX && size == 8 && c.opts.ReuseLastResult {
+		// A narrower value may have garbage above it in RAX, where a
+		// reload would zero-extend
+		c.lastResult, c.lastResultEnd = dest, c.text.Len()
+	}
+}
+
+// isSingle reports whether a value of type t moves between an XMM register
+// and its slot as 4 bytes, by movss, rather than as 8 by movsd: a float by
+// its width, and anything else, which only malformed IR puts in an XMM
+// register, by its size
+func isSingle(t types.Type) bool {
+	if ft, ok := t.(*types.FloatType); ok {
+		return ft.BitWidth == 32
+	}
+	return SizeOf(t) <= 4
 }
 
 // Store an XMM register value
@@ -88,8 +155,11 @@ func (c *compiler) storeFromFpReg(xmmReg int, dest ir.Value) {
 		return
 	}
 
-	fpType := dest.Type().(*types.FloatType)
-	if fpType.BitWidth == 32 {
+	if isXMMVector(dest.Type()) {
+		c.emitVecStoreToStack(xmmReg, offset)
+		return
+	}
+	if isSingle(dest.Type()) {
 		// movss [rbp + offset], xmm
 		c.emitFpStoreToStack(xmmReg, offset, false)
 	} else {
@@ -116,24 +186,68 @@ func (c *compiler) loadConstInt(reg int, value int64) {
 	c.emitUint64(uint64(value))
 }
 
-// Load constant float into XMM register
+// Load constant float into XMM register. With PoolFloatConsts it is one
+// movss/movsd from a .rodata slot shared by equal constants, and +0.0 is
+// an xorps; otherwise the bits go through RAX (clobbering it) and movd/movq.
 func (c *compiler) loadConstFloat(xmmReg int, value float64, bits int) {
-	// We need to materialize the constant in memory first
-	// For now, use a simple approach: load via integer register
+	raw := encodeFloat(value, bits)
 
+	if c.opts.PoolFloatConsts {
+		if raw == 0 {
+			c.emitXorps(xmmReg, xmmReg)
+			return
+		}
+		b := make([]byte, bits/8)
+		prefix := byte(0xF2) // movsd
+		if bits == 32 {
+			binary.LittleEndian.PutUint32(b, uint32(raw))
+			prefix = 0xF3 // movss
+		} else {
+			binary.LittleEndian.PutUint64(b, raw)
+		}
+		rex := byte(0)
+		regNum := xmmReg
+		if regNum >= 8 {
+			rex = rexR
+			regNum -= 8
+		}
+		// movs* xmm, [rip + constant]
+		c.emitSSE(prefix, rex, 0x10, 0, byte(0x05|(regNum<<3)))
+		c.emitRodataRef(c.pooledRodata(b))
+		return
+	}
+
+	c.loadConstInt(RAX, int64(raw))
 	if bits == 32 {
-		// Load as 32-bit int, then movd to xmm
-		bits32 := *(*uint32)(unsafe.Pointer(&value))
-		c.loadConstInt(RAX, int64(bits32))
 		c.emitMovdToXmm(xmmReg, RAX)
 	} else {
-		// Load as 64-bit int, then movq to xmm
-		bits64 := *(*uint64)(unsafe.Pointer(&value))
-		c.loadConstInt(RAX, int64(bits64))
 		c.emitMovqToXmm(xmmReg, RAX)
 	}
 }
 
+// encodeFloat returns the IEEE-754 encoding of value at the given width
+func encodeFloat(value float64, bits int) uint64 {
+	if bits == 32 {
+		return uint64(math.Float32bits(float32(value)))
+	}
+	return math.Float64bits(value)
+}
+
+// floatBits returns the IEEE-754 encoding of a float constant at its width
+func floatBits(cf *ir.ConstantFloat) uint64 {
+	return encodeFloat(cf.Value, floatWidth(cf))
+}
+
+// floatWidth returns a float constant's width. checkOperands rejects one
+// whose type isn't a float before anything loads it; should one get
+// through, it is encoded at its type's size.
+func floatWidth(cf *ir.ConstantFloat) int {
+	if ft, ok := cf.Type().(*types.FloatType); ok {
+		return ft.BitWidth
+	}
+	return 8 * SizeOf(cf.Type())
+}
+
 // Emit XOR reg, reg
 func (c *compiler) emitXorReg(dst, src int) {
 	rex := byte(0x48)
@@ -173,7 +287,7 @@ func (c *compiler) emitLoadFromStack(reg int, offset int, size int) {
 		} else {
 			c.emitBytes(0x0F, 0xB6, byte(0x85|(regNum<<3)))
 		}
-		c.emitInt32(int32(offset))
+		c.emitFrameDisp(offset)
 
 	case 2:
 		// movzx r32, word ptr [rbp + offset] (zero-extends to 64)
@@ -183,7 +297,7 @@ func (c *compiler) emitLoadFromStack(reg int, offset int, size int) {
 		} else {
 			c.emitBytes(0x0F, 0xB7, byte(0x85|(regNum<<3)))
 		}
-		c.emitInt32(int32(offset))
+		c.emitFrameDisp(offset)
 
 	case 4:
 		// mov r32, [rbp + offset] (zero-extends to 64)
@@ -192,19 +306,19 @@ func (c *compiler) emitLoadFromStack(reg int, offset int, size int) {
 		} else {
 			c.emitBytes(0x8B, byte(0x85|(regNum<<3)))
 		}
-		c.emitInt32(int32(offset))
+		c.emitFrameDisp(offset)
 
 	case 8:
 		// mov r64, [rbp + offset]
 		rex |= 0x08 // REX.W for 64-bit operand
 		c.emitBytes(rex, 0x8B, byte(0x85|(regNum<<3)))
-		c.emitInt32(int32(offset))
+		c.emitFrameDisp(offset)
 
 	default:
 		// Fallback to 8-byte load
 		rex |= 0x08 // REX.W
 		c.emitBytes(rex, 0x8B, byte(0x85|(regNum<<3)))
-		c.emitInt32(int32(offset))
+		c.emitFrameDisp(offset)
 	}
 }
 
@@ -228,7 +342,7 @@ func (c *compiler) emitStoreToStack(reg int, offset int, size int) {
 		} else {
 			c.emitBytes(0x88, byte(0x85|(regNum<<3)))
 		}
-		c.emitInt32(int32(offset))
+		c.emitFrameDisp(offset)
 
 	case 2:
 		// mov word ptr [rbp + offset], r16
@@ -237,7 +351,7 @@ func (c *compiler) emitStoreToStack(reg int, offset int, size int) {
 		} else {
 			c.emitBytes(0x66, 0x89, byte(0x85|(regNum<<3)))
 		}
-		c.emitInt32(int32(offset))
+		c.emitFrameDisp(offset)
 
 	case 4:
 		// mov dword ptr [rbp + offset], r32d
@@ -247,19 +361,19 @@ func (c *compiler) emitStoreToStack(reg int, offset int, size int) {
 		} else {
 			c.emitBytes(0x89, byte(0x85|(regNum<<3)))
 		}
-		c.emitInt32(int32(offset))
+		c.emitFrameDisp(offset)
 
 	case 8:
 		// mov qword ptr [rbp + offset], r64
 		rex |= 0x08 // REX.W bit for 64-bit operand
 		c.emitBytes(rex, 0x89, byte(0x85|(regNum<<3)))
-		c.emitInt32(int32(offset))
+		c.emitFrameDisp(offset)
 
 	default:
 		// Fallback to 8-byte
 		rex |= 0x08 // REX.W bit
 		c.emitBytes(rex, 0x89, byte(0x85|(regNum<<3)))
-		c.emitInt32(int32(offset))
+		c.emitFrameDisp(offset)
 	}
 }
 
@@ -274,16 +388,12 @@ func (c *compiler) emitFpLoadFromStack(xmmReg int, offset int, isDouble bool) {
 	regNum := xmmReg
 	
 	if regNum >= 8 {
-		rex = 0x44
+		rex = rexR
 		regNum -= 8
 	}
 
-	if rex != 0 {
-		c.emitBytes(prefix, rex, 0x0F, 0x10, byte(0x85|(regNum<<3)))
-	} else {
-		c.emitBytes(prefix, 0x0F, 0x10, byte(0x85|(regNum<<3)))
-	}
-	c.emitInt32(int32(offset))
+	c.emitSSE(prefix, rex, 0x10, 0, byte(0x85|(regNum<<3)))
+	c.emitFrameDisp(offset)
 }
 
 // Floating point store to stack
@@ -297,14 +407,54 @@ func (c *compiler) emitFpStoreToStack(xmmReg int, offset int, isDouble bool) {
 	regNum := xmmReg
 	
 	if regNum >= 8 {
-		rex = 0x44
+		rex = rexR
 		regNum -= 8
 	}
 
-	if rex != 0 {
-		c.emitBytes(prefix, rex, 0x0F, 0x11, byte(0x85|(regNum<<3)))
-	} else {
-		c.emitBytes(prefix, 0x0F, 0x11, byte(0x85|(regNum<<3)))
+	c.emitSSE(prefix, rex, 0x11, 0, byte(0x85|(regNum<<3)))
+	c.emitFrameDisp(offset)
+}
+
+// emitVecLoadFromStack loads the 16 bytes of a vector slot into an XMM
+// register: movaps when the slot is 16-byte aligned, which movaps requires
+// on pain of a fault, else movups. The frame base is 16-byte aligned with
+// or without a frame pointer, so the slot's offset decides.
+func (c *compiler) emitVecLoadFromStack(xmmReg int, offset int) {
+	c.emitVecStackMove(xmmReg, offset, 0x10)
+}
+
+// emitVecStoreToStack stores an XMM register to a vector slot, aligned
+// like emitVecLoadFromStack
+func (c *compiler) emitVecStoreToStack(xmmReg int, offset int) {
+	c.emitVecStackMove(xmmReg, offset, 0x11)
+}
+
+// emitVecStackMove emits movups (opcode 0x10 load, 0x11 store) or, for an
+// aligned slot, the movaps with the same direction
+func (c *compiler) emitVecStackMove(xmmReg int, offset int, opcode byte) {
+	if offset%16 == 0 {
+		opcode += 0x28 - 0x10 // movaps
+	}
+	rex := byte(0)
+	regNum := xmmReg
+	if regNum >= 8 {
+		rex = rexR
+		regNum -= 8
+	}
+	c.emitSSE(0, rex, opcode, 0, byte(0x85|(regNum<<3)))
+	c.emitFrameDisp(offset)
+}
+
+// emitFrameDisp finishes an instruction addressing the frame slot at
+// offset, whose ModRM byte (mod=10, rm=101: [rbp+disp32]) was just emitted.
+// Without a frame pointer the same slot is RSP-relative, as RBP would
+// point currentFrame bytes above RSP: the ModRM is rewritten to take a SIB
+// byte naming RSP as the base.
+func (c *compiler) emitFrameDisp(offset int) {
+	if c.omitFP {
+		c.text.Bytes()[c.text.Len()-1] &^= 0x01 // rm=100: SIB follows
+		c.emitBytes(0x24)                     // [rsp]
+		offset += c.currentFrame
 	}
 	c.emitInt32(int32(offset))
 }
@@ -332,42 +482,170 @@ func (c *compiler) emitLeaRipRelative(reg int, symbolName string) {
 	c.emitUint32(0) // Placeholder
 }
 
+// emitGlobalAddress loads the address of a symbol defined in this object,
+// in the form the code model allows
+func (c *compiler) emitGlobalAddress(reg int, symbolName string) {
+	rex := byte(0x48)
+	regNum := reg
+	if regNum >= 8 {
+		rex |= 0x01
+		regNum -= 8
+	}
+
+	switch {
+	case c.opts.CodeModel == CodeModelLarge:
+		// movabs reg, imm64
+		c.emitBytes(rex, byte(0xB8+regNum))
+		c.relocations = append(c.relocations, Relocation{
+			Offset:     uint64(c.text.Len()),
+			SymbolName: symbolName,
+			Type:       R_X86_64_64,
+		})
+		c.emitUint64(0)
+	case c.opts.NoPIC:
+		// mov reg, imm32 (sign-extended)
+		c.emitBytes(rex, 0xC7, byte(0xC0|regNum))
+		c.relocations = append(c.relocations, Relocation{
+			Offset:     uint64(c.text.Len()),
+			SymbolName: symbolName,
+			Type:       R_X86_64_32S,
+		})
+		c.emitUint32(0)
+	default:
+		// lea reg, [rip + disp32]
+		c.emitLeaRipRelative(reg, symbolName)
+	}
+}
+
+// Emit mov reg, [rip + sym@GOTPCREL]
+func (c *compiler) emitLoadGotEntry(reg int, symbolName string) {
+	rex := byte(0x48)
+	regNum := reg
+	if regNum >= 8 {
+		rex |= 0x04
+		regNum -= 8
+	}
+
+	c.emitBytes(rex, 0x8B, byte(0x05|(regNum<<3)))
+	c.relocations = append(c.relocations, Relocation{
+		Offset:     uint64(c.text.Len()),
+		SymbolName: symbolName,
+		Type:       R_X86_64_GOTPCREL,
+		Addend:     -4,
+	})
+	c.emitUint32(0)
+}
+
+// Append b to .rodata at the given alignment and return its offset
+func (c *compiler) addRodata(b []byte, align int) int {
+	for c.rodata.Len()%align != 0 {
+		c.rodata.WriteByte(0)
+	}
+	offset := c.rodata.Len()
+	c.rodata.Write(b)
+	return offset
+}
+
+// pooledRodata returns the .rodata offset of a constant of len(b) bytes,
+// aligned to its size, adding it only if an equal one isn't there yet
+func (c *compiler) pooledRodata(b []byte) int {
+	if offset, ok := c.rodataPool[string(b)]; ok {
+		return offset
+	}
+	offset := c.addRodata(b, len(b))
+	c.rodataPool[string(b)] = offset
+	return offset
+}
+
+// Emit the disp32 of a RIP-relative operand that addresses .rodata+offset.
+// Must be the last bytes of the instruction; the reference goes through the
+// section symbol so the constant needs no name of its own.
+func (c *compiler) emitRodataRef(offset int) {
+	c.relocations = append(c.relocations, Relocation{
+		Offset:     uint64(c.text.Len()),
+		SymbolName: ".rodata",
+		Type:       R_X86_64_PC32,
+		Addend:     int64(offset) - 4,
+	})
+	c.emitUint32(0)
+}
+
+// Emit the address of a thread-local symbol into RAX using the configured
+// TLS model. General dynamic is a call and clobbers caller-saved registers.
+func (c *compiler) emitTLSAddress(symbolName string) {
+	if c.opts.TLSModel == TLSGeneralDynamic {
+		// The linker pattern-matches this exact sequence to relax it:
+		// data16 lea rdi, [rip + sym@tlsgd]
+		c.emitBytes(0x66, 0x48, 0x8D, 0x3D)
+		c.relocations = append(c.relocations, Relocation{
+			Offset:     uint64(c.text.Len()),
+			SymbolName: symbolName,
+			Type:       R_X86_64_TLSGD,
+			Addend:     -4,
+		})
+		c.emitUint32(0)
+		// data16 data16 rex.W call __tls_get_addr@plt
+		c.emitBytes(0x66, 0x66, 0x48, 0xE8)
+		c.relocations = append(c.relocations, Relocation{
+			Offset:     uint64(c.text.Len()),
+			SymbolName: "__tls_get_addr",
+			Type:       R_X86_64_PLT32,
+			Addend:     -4,
+		})
+		c.emitUint32(0)
+		return
+	}
+
+	// mov rax, qword ptr fs:[0]
+	c.emitBytes(0x64, 0x48, 0x8B, 0x04, 0x25)
+	c.emitUint32(0)
+
+	// lea rax, [rax + sym@tpoff]
+	c.emitBytes(0x48, 0x8D, 0x80)
+	c.relocations = append(c.relocations, Relocation{
+		Offset:     uint64(c.text.Len()),
+		SymbolName: symbolName,
+		Type:       R_X86_64_TPOFF32,
+	})
+	c.emitUint32(0)
+}
+
 // Move GPR to XMM
 func (c *compiler) emitMovdToXmm(xmmReg, gprReg int) {
 	// movd xmm, reg
-	rex := byte(0x48)
+	rex := byte(rexW)
 	xmmNum := xmmReg
 	gprNum := gprReg
 	
 	if xmmNum >= 8 {
-		rex |= 0x04
+		rex |= rexR
 		xmmNum -= 8
 	}
 	if gprNum >= 8 {
-		rex |= 0x01
+		rex |= rexB
 		gprNum -= 8
 	}
 
-	c.emitBytes(0x66, rex, 0x0F, 0x6E, byte(0xC0|(xmmNum<<3)|gprNum))
+	c.emitSSE(0x66, rex, 0x6E, 0, byte(0xC0|(xmmNum<<3)|gprNum))
 }
 
 // Move GPR to XMM (64-bit)
 func (c *compiler) emitMovqToXmm(xmmReg, gprReg int) {
 	// movq xmm, reg
-	rex := byte(0x48)
+	rex := byte(rexW)
 	xmmNum := xmmReg
 	gprNum := gprReg
 	
 	if xmmNum >= 8 {
-		rex |= 0x04
+		rex |= rexR
 		xmmNum -= 8
 	}
 	if gprNum >= 8 {
-		rex |= 0x01
+		rex |= rexB
 		gprNum -= 8
 	}
 
-	c.emitBytes(0x66, rex, 0x0F, 0x6E, byte(0xC0|(xmmNum<<3)|gprNum))
+	c.emitSSE(0x66, rex, 0x6E, 0, byte(0xC0|(xmmNum<<3)|gprNum))
 }
 
 // XOR XMM registers
@@ -377,19 +655,68 @@ func (c *compiler) emitXorps(dst, src int) {
 	srcNum := src
 	
 	if dstNum >= 8 {
-		rex |= 0x04
+		rex |= rexR
 		dstNum -= 8
 	}
 	if srcNum >= 8 {
-		rex |= 0x01
+		rex |= rexB
 		srcNum -= 8
 	}
 
-	if rex != 0 {
-		c.emitBytes(rex, 0x0F, 0x57, byte(0xC0|(dstNum<<3)|srcNum))
+	c.emitSSE(0, rex, 0x57, dst, byte(0xC0|(dstNum<<3)|srcNum))
+}
+
+// REX bits for emitSSE
+const (
+	rexW = 0x08 // 64-bit general-purpose operand
+	rexR = 0x04 // ModRM.reg is xmm8-15 / r8-r15
+	rexX = 0x02 // SIB.index extension
+	rexB = 0x01 // ModRM.rm is xmm8-15 / r8-r15
+)
+
+// emitSSE emits a 0F-map SSE instruction: the mandatory prefix (0, 0x66,
+// 0xF3 or 0xF2), a REX prefix built from the rex bits, the opcode and then
+// the ModRM byte and any displacement.
+//
+// With AVX the VEX form is emitted instead. VEX instructions take a second
+// source, vvvv, and compute reg = vvvv op rm; passing the destination as
+// vvvv keeps the two-operand meaning. Instructions without a second source
+// (moves, compares, float-to-int conversions) pass 0, which encodes as
+// "unused". VEX scalar ops also merge into a register they don't otherwise
+// read, so they avoid SSE's partial-register dependency.
+func (c *compiler) emitSSE(prefix, rex, opcode byte, vvvv int, modrm ...byte) {
+	if !c.opts.hasFeature("avx") {
+		if prefix != 0 {
+			c.emitBytes(prefix)
+		}
+		if rex != 0 {
+			c.emitBytes(0x40 | rex)
+		}
+		c.emitBytes(0x0F, opcode)
+		c.emitBytes(modrm...)
+		return
+	}
+
+	var pp byte
+	switch prefix {
+	case 0x66:
+		pp = 1
+	case 0xF3:
+		pp = 2
+	case 0xF2:
+		pp = 3
+	}
+	// R, X, B and vvvv are stored inverted
+	v := byte(^vvvv&0xF)<<3 | pp
+	if rex&(rexW|rexX|rexB) == 0 {
+		// Two-byte VEX: C5 [R vvvv L pp]
+		c.emitBytes(0xC5, byte(^rex&rexR)<<5|v)
 	} else {
-		c.emitBytes(0x0F, 0x57, byte(0xC0|(dstNum<<3)|srcNum))
+		// Three-byte VEX: C4 [R X B m-mmmm=0F] [W vvvv L pp]
+		c.emitBytes(0xC4, byte(^rex&(rexR|rexX|rexB))<<5|0x01, (rex&rexW)<<4|v)
 	}
+	c.emitBytes(opcode)
+	c.emitBytes(modrm...)
 }
 
 // Store register with appropriate size encoding
@@ -0,0 +1,206 @@
+package amd64
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+)
+
+// Calls to llvm.* intrinsics are lowered inline rather than through a
+// relocation, since no object defines them. compileIntrinsic reports
+// whether the call was one it handles.
+func (c *compiler) compileIntrinsic(inst *ir.CallInst, name string) (bool, error) {
+	switch {
+	case strings.HasPrefix(name, "llvm.ctpop."):
+		return true, c.ctpopIntrinsic(inst)
+	case strings.HasPrefix(name, "llvm.va_start"):
+		return true, c.vaStartIntrinsic(inst)
+	case strings.HasPrefix(name, "llvm.va_copy"):
+		return true, c.vaCopyIntrinsic(inst)
+	case strings.HasPrefix(name, "llvm.va_end"):
+		return true, nil // Nothing to release
+	case strings.HasPrefix(name, "llvm.fma."):
+		return true, c.fmaIntrinsic(inst)
+	case strings.HasPrefix(name, "llvm.memmove."):
+		return true, c.memmoveIntrinsic(inst)
+	case name == "llvm.trap":
+		// ud2, as for unreachable: control never continues past it
+		c.emitBytes(0x0F, 0x0B)
+		return true, nil
+	case name == "llvm.debugtrap":
+		// int3 stops in an attached debugger, which can resume after it
+		c.emitBytes(0xCC)
+		return true, nil
+	}
+	return false, nil
+}
+
+// Population count. popcnt needs the POPCNT extension; the baseline
+// fallback clears the lowest set bit until none remain.
+func (c *compiler) ctpopIntrinsic(inst *ir.CallInst) error {
+	if inst.NumOperands() != 1 || !types.IsInteger(inst.Type()) {
+		return fmt.Errorf("llvm.ctpop takes one integer of its result type")
+	}
+	c.loadToReg(RAX, inst.Operands()[0])
+
+	// Constants load sign-extended; only the operand's own bits count
+	switch SizeOf(inst.Type()) {
+	case 1:
+		c.emitBytes(0x48, 0x0F, 0xB6, 0xC0) // movzx rax, al
+	case 2:
+		c.emitBytes(0x48, 0x0F, 0xB7, 0xC0) // movzx rax, ax
+	case 4:
+		c.emitBytes(0x89, 0xC0) // mov eax, eax
+	}
+
+	if c.opts.hasFeature("popcnt") {
+		// popcnt rax, rax
+		c.emitBytes(0xF3, 0x48, 0x0F, 0xB8, 0xC0)
+	} else {
+		// xor ecx, ecx
+		c.emitBytes(0x31, 0xC9)
+		// test rax, rax; jz done
+		c.emitBytes(0x48, 0x85, 0xC0)
+		c.emitBytes(0x74, 0x0F)
+		// loop: lea rdx, [rax - 1]; and rax, rdx; inc rcx
+		c.emitBytes(0x48, 0x8D, 0x50, 0xFF)
+		c.emitBytes(0x48, 0x21, 0xD0)
+		c.emitBytes(0x48, 0xFF, 0xC1)
+		// test rax, rax; jnz loop
+		c.emitBytes(0x48, 0x85, 0xC0)
+		c.emitBytes(0x75, 0xF1)
+		// done: mov rax, rcx
+		c.emitBytes(0x48, 0x89, 0xC8)
+	}
+
+	c.storeFromReg(RAX, inst)
+	return nil
+}
+
+// Fused multiply-add, a*b+c rounded once. Without the FMA extension it
+// calls libm's fma or fmaf: a separate multiply and add would round twice.
+func (c *compiler) fmaIntrinsic(inst *ir.CallInst) error {
+	args := inst.Operands()
+	ft, err := scalarFloat(inst.Type())
+	if err != nil || len(args) != 3 {
+		return fmt.Errorf("llvm.fma takes three scalar floats of its result type")
+	}
+	for _, arg := range args {
+		if !arg.Type().Equal(ft) {
+			return fmt.Errorf("llvm.fma takes three scalar floats of its result type")
+		}
+	}
+	c.loadToFpReg(0, args[0])
+	c.loadToFpReg(1, args[1])
+	c.loadToFpReg(2, args[2])
+
+	if c.opts.hasFeature("fma") {
+		// vfmadd213sd/ss xmm0, xmm1, xmm2: xmm0 = xmm1*xmm0 + xmm2. VEX.W
+		// selects the double form.
+		w := byte(0x00)
+		if ft.BitWidth == 64 {
+			w = 0x80
+		}
+		c.emitBytes(0xC4, 0xE2, w|0x71, 0xA9, 0xC2)
+	} else {
+		callee := "fma"
+		if ft.BitWidth == 32 {
+			callee = "fmaf"
+		}
+		// call fma@plt; the arguments are already in xmm0-xmm2
+		c.emitBytes(0xE8)
+		c.relocations = append(c.relocations, Relocation{
+			Offset:     uint64(c.text.Len()),
+			SymbolName: callee,
+			Type:       R_X86_64_PLT32,
+			Addend:     -4,
+		})
+		c.emitUint32(0)
+	}
+
+	c.storeFromFpReg(0, inst)
+	return nil
+}
+
+// Copy between possibly overlapping regions. Up to 16 constant bytes are
+// loaded into registers before any is stored; otherwise rep movsb runs
+// backwards when the destination starts inside the source, so no byte is
+// overwritten before it is read.
+func (c *compiler) memmoveIntrinsic(inst *ir.CallInst) error {
+	args := inst.Operands()
+	if len(args) < 3 {
+		return fmt.Errorf("llvm.memmove takes a destination, source and length")
+	}
+	dst, src, length := args[0], args[1], args[2]
+
+	if n, ok := length.(*ir.ConstantInt); ok && n.Value >= 0 && n.Value <= 16 {
+		c.loadToReg(RDI, dst)
+		c.loadToReg(RSI, src)
+		c.emitSmallMove(int(n.Value))
+		return nil
+	}
+
+	c.loadToReg(RCX, length)
+	if SizeOf(length.Type()) < 8 {
+		c.emitBytes(0x89, 0xC9) // mov ecx, ecx
+	}
+	c.loadToReg(RDI, dst)
+	c.loadToReg(RSI, src)
+
+	// Unsigned dst - src < length exactly when dst lies in [src, src+length)
+	// mov rax, rdi; sub rax, rsi; cmp rax, rcx; jb backward
+	c.emitBytes(0x48, 0x89, 0xF8)
+	c.emitBytes(0x48, 0x29, 0xF0)
+	c.emitBytes(0x48, 0x39, 0xC8)
+	c.emitBytes(0x72, 0x00)
+	backward := c.text.Len()
+	// rep movsb; jmp done
+	c.emitBytes(0xF3, 0xA4)
+	c.emitBytes(0xEB, 0x00)
+	done := c.text.Len()
+	c.text.Bytes()[backward-1] = byte(done - backward)
+
+	// backward: lea rsi, [rsi + rcx - 1]; lea rdi, [rdi + rcx - 1]
+	c.emitBytes(0x48, 0x8D, 0x74, 0x0E, 0xFF)
+	c.emitBytes(0x48, 0x8D, 0x7C, 0x0F, 0xFF)
+	// std; rep movsb; cld
+	c.emitBytes(0xFD)
+	c.emitBytes(0xF3, 0xA4)
+	c.emitBytes(0xFC)
+	c.text.Bytes()[done-1] = byte(c.text.Len() - done)
+	return nil
+}
+
+// emitSmallMove copies n <= 16 bytes from [rsi] to [rdi] as two possibly
+// overlapping chunks, the first and last chunk-sized pieces, both read
+// before either is written
+func (c *compiler) emitSmallMove(n int) {
+	if n == 0 {
+		return
+	}
+	if n == 1 {
+		c.emitBytes(0x8A, 0x06) // mov al, [rsi]
+		c.emitBytes(0x88, 0x07) // mov [rdi], al
+		return
+	}
+
+	var prefix []byte
+	switch {
+	case n < 4:
+		prefix = []byte{0x66}
+		n -= 2
+	case n < 8:
+		n -= 4
+	default:
+		prefix = []byte{0x48}
+		n -= 8
+	}
+	// n is now the offset of the last chunk
+	emit := func(b ...byte) { c.emitBytes(append(append([]byte{}, prefix...), b...)...) }
+	emit(0x8B, 0x06)          // mov eax, [rsi]
+	emit(0x8B, 0x56, byte(n)) // mov edx, [rsi + n]
+	emit(0x89, 0x07)          // mov [rdi], eax
+	emit(0x89, 0x57, byte(n)) // mov [rdi + n], edx
+}
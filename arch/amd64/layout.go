@@ -0,0 +1,84 @@
+package amd64
+
+import "github.com/arc-language/core-builder/ir"
+
+// blockLayout orders a function's blocks for emission. It follows the IR
+// order, except that a conditional branch with weights pulls its likely
+// successor up to directly after it, where it falls through, and pushes
+// its unlikely one to the end of the function.
+func blockLayout(fn *ir.Function) []*ir.BasicBlock {
+	if len(fn.Blocks) == 0 {
+		return nil
+	}
+	entry := fn.Blocks[0]
+
+	cold := make(map[*ir.BasicBlock]bool)
+	for _, block := range fn.Blocks {
+		if hot, unlikely := branchBias(block); hot != nil && unlikely != entry {
+			cold[unlikely] = true
+		}
+	}
+	// A block that is the likely side of some other branch isn't cold
+	for _, block := range fn.Blocks {
+		if hot, _ := branchBias(block); hot != nil {
+			delete(cold, hot)
+		}
+	}
+
+	order := make([]*ir.BasicBlock, 0, len(fn.Blocks))
+	placed := make(map[*ir.BasicBlock]bool)
+	place := func(start *ir.BasicBlock) {
+		// Follow the chain of likely successors from start
+		for block := start; block != nil && !placed[block]; {
+			order = append(order, block)
+			placed[block] = true
+			hot, _ := branchBias(block)
+			if hot == entry {
+				break
+			}
+			block = hot
+		}
+	}
+	for _, block := range fn.Blocks {
+		if !cold[block] {
+			place(block)
+		}
+	}
+	for _, block := range fn.Blocks {
+		place(block)
+	}
+	return order
+}
+
+// branchBias returns the likely and unlikely successors of a block ending
+// in a weighted conditional branch, or nils when neither side is favoured
+func branchBias(block *ir.BasicBlock) (likely, unlikely *ir.BasicBlock) {
+	if len(block.Instructions) == 0 {
+		return nil, nil
+	}
+	br, ok := block.Instructions[len(block.Instructions)-1].(*ir.CondBrInst)
+	if !ok || br.TrueBlock == br.FalseBlock {
+		return nil, nil
+	}
+	switch {
+	case br.TrueWeight > br.FalseWeight:
+		return br.TrueBlock, br.FalseBlock
+	case br.FalseWeight > br.TrueWeight:
+		return br.FalseBlock, br.TrueBlock
+	}
+	return nil, nil
+}
+
+// splitCold separates the blocks marked cold by "cold" metadata from the
+// rest of a layout, keeping the order within each. The entry block always
+// stays.
+func splitCold(layout []*ir.BasicBlock) (hot, cold []*ir.BasicBlock) {
+	for i, block := range layout {
+		if _, ok := block.Metadata["cold"]; ok && i > 0 {
+			cold = append(cold, block)
+		} else {
+			hot = append(hot, block)
+		}
+	}
+	return hot, cold
+}
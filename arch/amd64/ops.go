@@ -1,12 +1,87 @@
 package amd64
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
 
 	"github.com/arc-language/core-builder/ir"
 	"github.com/arc-language/core-builder/types"
 )
 
+// minOperands is how many operands an instruction needs for its opcode's
+// lowering to read. Terminators that keep their targets and condition in
+// fields, and calls, whose arguments checkCallArgs matches against the
+// callee, are not listed.
+var minOperands = map[ir.Opcode]int{
+	ir.OpAdd: 2, ir.OpSub: 2, ir.OpMul: 2,
+	ir.OpUDiv: 2, ir.OpSDiv: 2, ir.OpURem: 2, ir.OpSRem: 2,
+	ir.OpFAdd: 2, ir.OpFSub: 2, ir.OpFMul: 2, ir.OpFDiv: 2, ir.OpFRem: 2,
+	ir.OpFNeg: 1,
+	ir.OpShl: 2, ir.OpLShr: 2, ir.OpAShr: 2,
+	ir.OpAnd: 2, ir.OpOr: 2, ir.OpXor: 2,
+	ir.OpLoad: 1, ir.OpStore: 2, ir.OpGetElementPtr: 1,
+	ir.OpICmp: 2, ir.OpFCmp: 2,
+	ir.OpTrunc: 1, ir.OpZExt: 1, ir.OpSExt: 1, ir.OpFPTrunc: 1, ir.OpFPExt: 1,
+	ir.OpFPToUI: 1, ir.OpFPToSI: 1, ir.OpUIToFP: 1, ir.OpSIToFP: 1,
+	ir.OpPtrToInt: 1, ir.OpIntToPtr: 1, ir.OpBitcast: 1,
+	ir.OpSelect: 3, ir.OpFreeze: 1,
+	ir.OpExtractValue: 1, ir.OpInsertValue: 2, ir.OpVAArg: 1,
+}
+
+// checkOperands rejects instructions in fn too malformed to lower: short
+// of operands, using a value that has no type or a float constant whose
+// type isn't a float, or with a phi merging values of another type. It runs before anything in fn is compiled,
+// since a phi's copies are made in its predecessors and fused loads and
+// compares are found by looking ahead.
+func checkOperands(fn *ir.Function) error {
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			n, known := minOperands[inst.Opcode()]
+			if inst.NumOperands() < n {
+				return fmt.Errorf("in block %s: %s instruction %s has %d operands, needs %d",
+					block.Name(), inst.Opcode(), inst.Name(), inst.NumOperands(), n)
+			}
+			if known && inst.Opcode() != ir.OpStore && inst.Type() == nil {
+				return fmt.Errorf("in block %s: %s instruction %s has no type", block.Name(), inst.Opcode(), inst.Name())
+			}
+			for i, op := range inst.Operands() {
+				if op == nil || op.Type() == nil || op.Type().Kind() == types.VoidKind {
+					return fmt.Errorf("in block %s: operand %d of %s instruction %s has no value",
+						block.Name(), i, inst.Opcode(), inst.Name())
+				}
+				if err := checkFloatConstant(op); err != nil {
+					return fmt.Errorf("in block %s: operand %d of %s instruction %s: %w",
+						block.Name(), i, inst.Opcode(), inst.Name(), err)
+				}
+			}
+			if phi, ok := inst.(*ir.PhiInst); ok {
+				for _, in := range phi.Incoming {
+					if in.Value == nil || in.Value.Type() == nil || !in.Value.Type().Equal(phi.Type()) {
+						return fmt.Errorf("in block %s: phi %s of type %s has an incoming value from %s of another type",
+							block.Name(), phi.Name(), phi.Type(), in.Block.Name())
+					}
+					if err := checkFloatConstant(in.Value); err != nil {
+						return fmt.Errorf("in block %s: phi %s: %w", block.Name(), phi.Name(), err)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkFloatConstant rejects a float constant of a type that isn't a
+// float, which has no width to encode it at
+func checkFloatConstant(v ir.Value) error {
+	if cf, ok := v.(*ir.ConstantFloat); ok {
+		if _, ok := cf.Type().(*types.FloatType); !ok {
+			return fmt.Errorf("float constant %v of type %s", cf.Value, cf.Type())
+		}
+	}
+	return nil
+}
+
 func (c *compiler) compileInstruction(inst ir.Instruction) error {
 	switch inst.Opcode() {
 	// Arithmetic
@@ -26,6 +101,8 @@ func (c *compiler) compileInstruction(inst ir.Instruction) error {
 		return c.fpBinOp(inst, 0x58)
 	case ir.OpFSub:
 		return c.fpBinOp(inst, 0x5C)
+	case ir.OpFNeg:
+		return c.fnegOp(inst)
 	case ir.OpFMul:
 		return c.fpBinOp(inst, 0x59)
 	case ir.OpFDiv:
@@ -47,61 +124,88 @@ func (c *compiler) compileInstruction(inst ir.Instruction) error {
 
 	// Memory
 	case ir.OpAlloca:
-		return c.allocaOp(inst.(*ir.AllocaInst))
+		return dispatch(inst, c.allocaOp)
 	case ir.OpLoad:
-		return c.loadOp(inst.(*ir.LoadInst))
+		return dispatch(inst, c.loadOp)
 	case ir.OpStore:
-		return c.storeOp(inst.(*ir.StoreInst))
+		return dispatch(inst, c.storeOp)
 	case ir.OpGetElementPtr:
-		return c.gepOp(inst.(*ir.GetElementPtrInst))
+		return dispatch(inst, c.gepOp)
+	case ir.OpFence:
+		return dispatch(inst, c.fenceOp)
 
 	// Comparison
 	case ir.OpICmp:
-		return c.icmpOp(inst.(*ir.ICmpInst))
+		return dispatch(inst, c.icmpOp)
 	case ir.OpFCmp:
-		return c.fcmpOp(inst.(*ir.FCmpInst))
+		return dispatch(inst, c.fcmpOp)
 
 	// Control flow
 	case ir.OpRet:
-		return c.retOp(inst.(*ir.RetInst))
+		return dispatch(inst, c.retOp)
 	case ir.OpBr:
-		return c.brOp(inst.(*ir.BrInst))
+		return dispatch(inst, c.brOp)
 	case ir.OpCondBr:
-		return c.condBrOp(inst.(*ir.CondBrInst))
+		return dispatch(inst, c.condBrOp)
 	case ir.OpSwitch:
-		return c.switchOp(inst.(*ir.SwitchInst))
+		return dispatch(inst, c.switchOp)
+	case ir.OpUnreachable:
+		return c.unreachableOp(inst)
+	case ir.OpInvoke:
+		return dispatch(inst, c.invokeOp)
+	case ir.OpResume:
+		return dispatch(inst, c.resumeOp)
+	case ir.OpLandingPad:
+		// Its value is stored by the stub each invoke unwinds to
+		return nil
 
 	// Casts
 	case ir.OpTrunc, ir.OpZExt, ir.OpSExt:
-		return c.intCastOp(inst.(*ir.CastInst))
+		return dispatch(inst, c.intCastOp)
 	case ir.OpFPTrunc, ir.OpFPExt:
-		return c.fpCastOp(inst.(*ir.CastInst))
+		return dispatch(inst, c.fpCastOp)
 	case ir.OpFPToUI, ir.OpFPToSI:
-		return c.fpToIntOp(inst.(*ir.CastInst))
+		return dispatch(inst, c.fpToIntOp)
 	case ir.OpUIToFP, ir.OpSIToFP:
-		return c.intToFpOp(inst.(*ir.CastInst))
+		return dispatch(inst, c.intToFpOp)
 	case ir.OpPtrToInt, ir.OpIntToPtr, ir.OpBitcast:
-		return c.bitcastOp(inst.(*ir.CastInst))
+		return dispatch(inst, c.bitcastOp)
 
 	// Other
 	case ir.OpPhi:
-		return c.phiOp(inst.(*ir.PhiInst))
+		return dispatch(inst, c.phiOp)
 	case ir.OpSelect:
-		return c.selectOp(inst.(*ir.SelectInst))
+		return dispatch(inst, c.selectOp)
+	case ir.OpFreeze:
+		return c.freezeOp(inst)
 	case ir.OpCall:
-		return c.callOp(inst.(*ir.CallInst))
+		return dispatch(inst, c.callOp)
 	case ir.OpSyscall:
-		return c.syscallOp(inst.(*ir.SyscallInst))
+		return dispatch(inst, c.syscallOp)
 	case ir.OpExtractValue:
-		return c.extractValueOp(inst.(*ir.ExtractValueInst))
+		return dispatch(inst, c.extractValueOp)
 	case ir.OpInsertValue:
-		return c.insertValueOp(inst.(*ir.InsertValueInst))
+		return dispatch(inst, c.insertValueOp)
+	case ir.OpVAArg:
+		return dispatch(inst, c.vaArgOp)
 
 	default:
 		return fmt.Errorf("unsupported opcode: %s", inst.Opcode())
 	}
 }
 
+// dispatch hands inst to the compile function for its opcode, checking
+// that it is the instruction type the opcode implies. An opcode set on
+// the wrong kind of instruction is malformed IR, not a backend bug.
+func dispatch[T ir.Instruction](inst ir.Instruction, compile func(T) error) error {
+	typed, ok := inst.(T)
+	if !ok {
+		var want T
+		return fmt.Errorf("%s instruction %s is a %T, not a %T", inst.Opcode(), inst.Name(), inst, want)
+	}
+	return compile(typed)
+}
+
 // Addition
 func (c *compiler) addOp(inst ir.Instruction) error {
 	ops := inst.Operands()
@@ -112,14 +216,8 @@ func (c *compiler) addOp(inst ir.Instruction) error {
 
 	// Check if rhs is a constant
 	if constInt, ok := rhs.(*ir.ConstantInt); ok {
-		if constInt.Value >= -128 && constInt.Value <= 127 {
-			// 8-bit immediate: add rax, imm8 (48 83 C0 ib)
-			c.emitBytes(0x48, 0x83, 0xC0, byte(constInt.Value))
-		} else {
-			// 32-bit immediate: add rax, imm32 (48 81 C0 id)
-			c.emitBytes(0x48, 0x81, 0xC0)
-			c.emitInt32(int32(constInt.Value))
-		}
+		// add rax, imm
+		c.emitRAXImm(0, 0x01, constInt.Value)
 	} else {
 		// Register form: add rax, rcx
 		c.loadToReg(RCX, rhs)
@@ -140,14 +238,8 @@ func (c *compiler) subOp(inst ir.Instruction) error {
 
 	// Check if rhs is a constant
 	if constInt, ok := rhs.(*ir.ConstantInt); ok {
-		if constInt.Value >= -128 && constInt.Value <= 127 {
-			// 8-bit immediate: sub rax, imm8 (48 83 E8 ib)
-			c.emitBytes(0x48, 0x83, 0xE8, byte(constInt.Value))
-		} else {
-			// 32-bit immediate: sub rax, imm32 (48 81 E8 id)
-			c.emitBytes(0x48, 0x81, 0xE8)
-			c.emitInt32(int32(constInt.Value))
-		}
+		// sub rax, imm
+		c.emitRAXImm(5, 0x29, constInt.Value)
 	} else {
 		// Register form: sub rax, rcx
 		c.loadToReg(RCX, rhs)
@@ -168,14 +260,8 @@ func (c *compiler) andOp(inst ir.Instruction) error {
 
 	// Check if rhs is a constant
 	if constInt, ok := rhs.(*ir.ConstantInt); ok {
-		if constInt.Value >= -128 && constInt.Value <= 127 {
-			// 8-bit immediate: and rax, imm8 (48 83 E0 ib)
-			c.emitBytes(0x48, 0x83, 0xE0, byte(constInt.Value))
-		} else {
-			// 32-bit immediate: and rax, imm32 (48 81 E0 id)
-			c.emitBytes(0x48, 0x81, 0xE0)
-			c.emitInt32(int32(constInt.Value))
-		}
+		// and rax, imm
+		c.emitRAXImm(4, 0x21, constInt.Value)
 	} else {
 		// Register form: and rax, rcx
 		c.loadToReg(RCX, rhs)
@@ -196,14 +282,8 @@ func (c *compiler) orOp(inst ir.Instruction) error {
 
 	// Check if rhs is a constant
 	if constInt, ok := rhs.(*ir.ConstantInt); ok {
-		if constInt.Value >= -128 && constInt.Value <= 127 {
-			// 8-bit immediate: or rax, imm8 (48 83 C8 ib)
-			c.emitBytes(0x48, 0x83, 0xC8, byte(constInt.Value))
-		} else {
-			// 32-bit immediate: or rax, imm32 (48 81 C8 id)
-			c.emitBytes(0x48, 0x81, 0xC8)
-			c.emitInt32(int32(constInt.Value))
-		}
+		// or rax, imm
+		c.emitRAXImm(1, 0x09, constInt.Value)
 	} else {
 		// Register form: or rax, rcx
 		c.loadToReg(RCX, rhs)
@@ -224,14 +304,8 @@ func (c *compiler) xorOp(inst ir.Instruction) error {
 
 	// Check if rhs is a constant
 	if constInt, ok := rhs.(*ir.ConstantInt); ok {
-		if constInt.Value >= -128 && constInt.Value <= 127 {
-			// 8-bit immediate: xor rax, imm8 (48 83 F0 ib)
-			c.emitBytes(0x48, 0x83, 0xF0, byte(constInt.Value))
-		} else {
-			// 32-bit immediate: xor rax, imm32 (48 81 F0 id)
-			c.emitBytes(0x48, 0x81, 0xF0)
-			c.emitInt32(int32(constInt.Value))
-		}
+		// xor rax, imm
+		c.emitRAXImm(6, 0x31, constInt.Value)
 	} else {
 		// Register form: xor rax, rcx
 		c.loadToReg(RCX, rhs)
@@ -260,19 +334,74 @@ func (c *compiler) divOp(inst ir.Instruction, remainder bool) error {
 	ops := inst.Operands()
 	signed := inst.Opcode() == ir.OpSDiv || inst.Opcode() == ir.OpSRem
 
+	if shift, ok := ptrDiffShift(inst); ok {
+		// An arithmetic shift rounds toward negative infinity and sdiv
+		// toward zero, so a negative dividend is first biased by
+		// size-1. The distance is usually an exact multiple of the size,
+		// but nothing in the IR says so.
+		c.loadToReg(RAX, ops[0])
+		if shift > 0 {
+			c.emitBytes(0x48, 0x89, 0xC1)                 // mov rcx, rax
+			c.emitBytes(0x48, 0xC1, 0xF9, 63)             // sar rcx, 63
+			c.emitBytes(0x48, 0xC1, 0xE9, byte(64-shift)) // shr rcx, 64-shift
+			c.emitBytes(0x48, 0x01, 0xC8)                 // add rax, rcx
+			c.emitBytes(0x48, 0xC1, 0xF8, byte(shift))    // sar rax, shift
+		}
+		c.storeFromReg(RAX, inst)
+		return nil
+	}
+
 	c.loadToReg(RAX, ops[0]) // Dividend in RAX
-	c.loadToReg(RCX, ops[1]) // Divisor in RCX
 
-	if signed {
+	if _, ok := ops[1].(*ir.ConstantUndef); ok {
+		// An undef divisor may be any value; pick 1 rather than the usual
+		// zero so the division can't raise #DE
+		c.loadConstInt(RCX, 1)
+	} else {
+		c.loadToReg(RCX, ops[1]) // Divisor in RCX
+	}
+
+	// Divide at the operands' width: a 64-bit divide of 32-bit values is
+	// slower and, for signed ones, wrong, since stack loads zero-extend.
+	// i8 and i16 values are extended to 32 bits first, as constants load
+	// with all 64 bits set from their sign.
+	switch size := SizeOf(inst.Type()); {
+	case size == 8 && signed:
 		// cqo - sign extend RAX into RDX:RAX
 		c.emitBytes(0x48, 0x99)
 		// idiv rcx
 		c.emitBytes(0x48, 0xF7, 0xF9)
-	} else {
-		// xor rdx, rdx - zero out RDX
-		c.emitBytes(0x48, 0x31, 0xD2)
+	case size == 8:
+		// xor edx, edx - zero out RDX
+		c.emitBytes(0x31, 0xD2)
 		// div rcx
 		c.emitBytes(0x48, 0xF7, 0xF1)
+	case signed:
+		switch size {
+		case 1:
+			c.emitBytes(0x0F, 0xBE, 0xC0) // movsx eax, al
+			c.emitBytes(0x0F, 0xBE, 0xC9) // movsx ecx, cl
+		case 2:
+			c.emitBytes(0x0F, 0xBF, 0xC0) // movsx eax, ax
+			c.emitBytes(0x0F, 0xBF, 0xC9) // movsx ecx, cx
+		}
+		// cdq - sign extend EAX into EDX:EAX
+		c.emitBytes(0x99)
+		// idiv ecx
+		c.emitBytes(0xF7, 0xF9)
+	default:
+		switch size {
+		case 1:
+			c.emitBytes(0x0F, 0xB6, 0xC0) // movzx eax, al
+			c.emitBytes(0x0F, 0xB6, 0xC9) // movzx ecx, cl
+		case 2:
+			c.emitBytes(0x0F, 0xB7, 0xC0) // movzx eax, ax
+			c.emitBytes(0x0F, 0xB7, 0xC9) // movzx ecx, cx
+		}
+		// xor edx, edx
+		c.emitBytes(0x31, 0xD2)
+		// div ecx
+		c.emitBytes(0xF7, 0xF1)
 	}
 
 	// Quotient in RAX, remainder in RDX
@@ -284,23 +413,144 @@ func (c *compiler) divOp(inst ir.Instruction, remainder bool) error {
 	return nil
 }
 
+// ptrDiffShift recognizes C pointer subtraction,
+//
+//	sdiv (sub (ptrtoint p), (ptrtoint q)), size
+//
+// with a power-of-two element size, and returns log2(size)
+func ptrDiffShift(inst ir.Instruction) (int, bool) {
+	if inst.Opcode() != ir.OpSDiv || SizeOf(inst.Type()) != 8 {
+		return 0, false
+	}
+	size, ok := inst.Operands()[1].(*ir.ConstantInt)
+	if !ok || size.Value <= 0 || size.Value&(size.Value-1) != 0 {
+		return 0, false
+	}
+	sub, ok := inst.Operands()[0].(ir.Instruction)
+	if !ok || sub.Opcode() != ir.OpSub {
+		return 0, false
+	}
+	for _, op := range sub.Operands() {
+		if cast, ok := op.(ir.Instruction); !ok || cast.Opcode() != ir.OpPtrToInt {
+			return 0, false
+		}
+	}
+
+	shift := 0
+	for int64(1)<<shift != size.Value {
+		shift++
+	}
+	return shift, true
+}
+
 // Floating point binary operations
 func (c *compiler) fpBinOp(inst ir.Instruction, opcode byte) error {
 	ops := inst.Operands()
+	if isX87(inst.Type()) {
+		return c.x87BinOp(inst)
+	}
+
+	// A 128-bit float vector takes the packed form of the scalar op
+	fpType, _ := inst.Type().(*types.FloatType)
+	packed := false
+	if vt, ok := inst.Type().(*types.VectorType); ok && isXMMVector(vt) {
+		fpType, packed = vt.ElementType.(*types.FloatType)
+	}
+	if fpType == nil {
+		return fmt.Errorf("%s on %s: only floats and 128-bit float vectors are supported", inst.Opcode(), inst.Type())
+	}
+	for _, op := range ops[:2] {
+		if !op.Type().Equal(inst.Type()) {
+			return fmt.Errorf("%s %s has a %s operand", inst.Opcode(), inst.Type(), op.Type())
+		}
+	}
 
 	// Load operands to XMM registers
 	c.loadToFpReg(0, ops[0]) // XMM0
 	c.loadToFpReg(1, ops[1]) // XMM1
 
 	// Determine if single or double precision
-	fpType := inst.Type().(*types.FloatType)
 	prefix := byte(0xF2) // Default to double (sd)
 	if fpType.BitWidth == 32 {
 		prefix = 0xF3 // Single precision (ss)
 	}
+	if packed {
+		prefix = 0x66 // pd
+		if fpType.BitWidth == 32 {
+			prefix = 0 // ps
+		}
+	}
 
 	// Execute operation: XMM0 = XMM0 op XMM1
-	c.emitBytes(prefix, 0x0F, opcode, 0xC1)
+	c.emitSSE(prefix, 0, opcode, 0, 0xC1)
+	if !packed {
+		// Canonicalizing checks the low lane alone
+		c.emitCanonicalizeNaN(fpType.BitWidth)
+	}
+
+	c.storeFromFpReg(0, inst)
+	return nil
+}
+
+// emitCanonicalizeNaN replaces a NaN in XMM0 with the canonical quiet NaN
+// when the option asks for it. x86 itself produces the negative "real
+// indefinite" NaN and passes input payloads through, so results would
+// otherwise depend on the operands.
+func (c *compiler) emitCanonicalizeNaN(bits int) {
+	if !c.opts.CanonicalizeNaN {
+		return
+	}
+
+	prefix, comisPrefix := byte(0xF2), byte(0x66)
+	if bits == 32 {
+		prefix, comisPrefix = 0xF3, 0
+	}
+	nan := make([]byte, 8)
+	binary.LittleEndian.PutUint64(nan, 0x7FF8000000000000)
+	if bits == 32 {
+		nan = nan[:4]
+		binary.LittleEndian.PutUint32(nan, 0x7FC00000)
+	}
+	nanOff := c.pooledRodata(nan)
+
+	// ucomis* xmm0, xmm0 sets PF only for NaN; jnp done
+	c.emitSSE(comisPrefix, 0, 0x2E, 0, 0xC0)
+	c.emitBytes(0x7B, 0x00)
+	skipFrom := c.text.Len()
+	// movs* xmm0, [rip + nan]
+	c.emitSSE(prefix, 0, 0x10, 0, 0x05)
+	c.emitRodataRef(nanOff)
+	c.text.Bytes()[skipFrom-1] = byte(c.text.Len() - skipFrom)
+}
+
+// Floating point negation: flip the sign bit. Unlike 0.0 - x this negates
+// zeros and NaNs too.
+func (c *compiler) fnegOp(inst ir.Instruction) error {
+	if isX87(inst.Type()) {
+		return c.x87NegOp(inst)
+	}
+	fpType, ok := inst.Type().(*types.FloatType)
+	if !ok || !inst.Operands()[0].Type().Equal(fpType) {
+		return fmt.Errorf("fneg %s of %s: only floats are supported", inst.Type(), inst.Operands()[0].Type())
+	}
+	c.loadToFpReg(0, inst.Operands()[0])
+
+	// Sign mask in the low lane, one per width and shared by every fneg;
+	// the 16-byte width and alignment are what a packed XOR memory
+	// operand requires, and pooledRodata aligns a constant to its size
+	mask := make([]byte, 16)
+	prefix := byte(0)
+	if fpType.BitWidth == 32 {
+		mask[3] = 0x80
+	} else {
+		mask[7] = 0x80
+		prefix = 0x66 // xorpd
+	}
+	maskOff := c.pooledRodata(mask)
+
+	// xorps/xorpd xmm0, [rip + mask]
+	c.emitSSE(prefix, 0, 0x57, 0, 0x05)
+	c.emitRodataRef(maskOff)
 
 	c.storeFromFpReg(0, inst)
 	return nil
@@ -312,21 +562,70 @@ func (c *compiler) shiftOp(inst ir.Instruction, opext byte) error {
 	value := ops[0]
 	amount := ops[1]
 
+	// Shift at the value's width, so an i8's bits neither come from nor
+	// go above bit 7 and sar takes the sign from its top bit. x86 masks
+	// the count to 5 bits (6 at 64 bits), but shifting by the operand
+	// width or more is defined here to shift every bit out: zero for
+	// shl/shr, a fill of the sign bit for sar.
+	size := SizeOf(inst.Type())
+	width := int64(size * 8)
+	isSar := opext == 0x18
+	var prefix []byte
+	var narrow byte // The 8-bit forms are D0/C0/D2, one below the others
+	switch size {
+	case 1:
+		narrow = 1
+	case 2:
+		prefix = []byte{0x66}
+	case 4:
+	default:
+		prefix = []byte{0x48}
+	}
+	shift := func(op byte, rest ...byte) {
+		c.emitBytes(append(append(append([]byte{}, prefix...), op-narrow), rest...)...)
+	}
+
 	c.loadToReg(RAX, value)
 
 	if constInt, ok := amount.(*ir.ConstantInt); ok {
-		// Immediate shift
-		if constInt.Value == 1 {
-			// Special encoding for shift by 1: 48 D1 E0+opext
-			c.emitBytes(0x48, 0xD1, 0xE0|opext)
+		count := constInt.Value
+		if count < 0 {
+			return fmt.Errorf("negative shift count %d", count)
+		}
+		if count >= width {
+			if !isSar {
+				c.emitXorReg(RAX, RAX)
+				c.storeFromReg(RAX, inst)
+				return nil
+			}
+			count = width - 1 // Sign fill
+		}
+
+		if count == 1 {
+			shift(0xD1, 0xE0|opext) // shift by 1
 		} else {
-			// Shift by immediate: 48 C1 E0+opext imm8
-			c.emitBytes(0x48, 0xC1, 0xE0|opext, byte(constInt.Value))
+			shift(0xC1, 0xE0|opext, byte(count)) // shift by imm8
 		}
 	} else {
-		// Variable shift (amount in CL): 48 D3 E0+opext
+		// The count is treated as unsigned, so a negative one is
+		// out of range too
 		c.loadToReg(RCX, amount)
-		c.emitBytes(0x48, 0xD3, 0xE0|opext)
+		if isSar {
+			// Clamp the count to width-1: mov edx, width-1; cmp rcx, rdx; cmova rcx, rdx
+			c.emitBytes(0xBA, byte(width-1), 0, 0, 0)
+			c.emitBytes(0x48, 0x39, 0xD1)
+			c.emitBytes(0x48, 0x0F, 0x47, 0xCA)
+		}
+
+		shift(0xD3, 0xE0|opext) // shift by cl
+
+		if !isSar {
+			// Zero the result if count >= width:
+			// xor edx, edx; cmp rcx, width; cmovae rax, rdx
+			c.emitBytes(0x31, 0xD2)
+			c.emitBytes(0x48, 0x83, 0xF9, byte(width))
+			c.emitBytes(0x48, 0x0F, 0x43, 0xC2)
+		}
 	}
 
 	c.storeFromReg(RAX, inst)
@@ -335,6 +634,12 @@ func (c *compiler) shiftOp(inst ir.Instruction, opext byte) error {
 
 // Alloca - stack allocation
 func (c *compiler) allocaOp(inst *ir.AllocaInst) error {
+	if inst.NumElements != nil {
+		if _, ok := inst.NumElements.(*ir.ConstantInt); !ok {
+			return c.dynamicAllocaOp(inst)
+		}
+	}
+
 	// Retrieve pre-calculated offset
 	allocOffset, ok := c.allocaOffsets[inst]
 	if !ok {
@@ -343,18 +648,115 @@ func (c *compiler) allocaOp(inst *ir.AllocaInst) error {
 
 	// lea rax, [rbp + allocOffset] (allocOffset is negative)
 	c.emitBytes(0x48, 0x8D, 0x85)
-	c.emitInt32(int32(allocOffset))
+	c.emitFrameDisp(allocOffset)
 
 	// Store the address
 	c.storeFromReg(RAX, inst)
 	return nil
 }
 
+// Variable-length alloca: grow the stack below the fixed frame. Locals stay
+// RBP-relative and the epilogue's leave restores RSP, so the space lives
+// until the function returns.
+func (c *compiler) dynamicAllocaOp(inst *ir.AllocaInst) error {
+	count := inst.NumElements
+	c.loadToReg(RAX, count)
+
+	// Counts are unsigned; widen from the count's type
+	switch SizeOf(count.Type()) {
+	case 1:
+		c.emitBytes(0x48, 0x0F, 0xB6, 0xC0) // movzx rax, al
+	case 2:
+		c.emitBytes(0x48, 0x0F, 0xB7, 0xC0) // movzx rax, ax
+	case 4:
+		c.emitBytes(0x89, 0xC0) // mov eax, eax
+	}
+
+	// imul rax, rax, elemSize
+	elemSize := SizeOf(inst.AllocatedType)
+	if elemSize <= 127 {
+		c.emitBytes(0x48, 0x6B, 0xC0, byte(elemSize))
+	} else {
+		c.emitBytes(0x48, 0x69, 0xC0)
+		c.emitInt32(int32(elemSize))
+	}
+
+	// Round up to keep RSP 16-byte aligned: add rax, 15; and rax, -16
+	c.emitBytes(0x48, 0x83, 0xC0, 0x0F)
+	c.emitBytes(0x48, 0x83, 0xE0, 0xF0)
+
+	// sub rsp, rax
+	c.emitBytes(0x48, 0x29, 0xC4)
+	if c.opts.ZeroAlloca {
+		// The rounded size is whole qwords:
+		// mov rcx, rax; shr rcx, 3; mov rdi, rsp; xor eax, eax; rep stosq
+		c.emitBytes(0x48, 0x89, 0xC1, 0x48, 0xC1, 0xE9, 0x03)
+		c.emitBytes(0x48, 0x89, 0xE7, 0x31, 0xC0)
+		c.emitBytes(0xF3, 0x48, 0xAB)
+	}
+	// mov rax, rsp
+	c.emitBytes(0x48, 0x89, 0xE0)
+
+	c.storeFromReg(RAX, inst)
+	return nil
+}
+
+// countUses returns how many operands in fn refer to each value, for the
+// analyses that fold a single-use instruction into its user.
+func countUses(fn *ir.Function) map[ir.Value]int {
+	uses := make(map[ir.Value]int)
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			for _, op := range inst.Operands() {
+				uses[op]++
+			}
+		}
+	}
+	return uses
+}
+
+// findFusedLoads picks out narrow integer loads whose only use is a zext
+// or sext directly after them. The extend then reads memory itself with
+// movzx/movsx, and the load emits nothing.
+func findFusedLoads(fn *ir.Function, uses map[ir.Value]int) map[*ir.LoadInst]bool {
+	fused := make(map[*ir.LoadInst]bool)
+	for _, block := range fn.Blocks {
+		insts := block.Instructions
+		for i := 0; i+1 < len(insts); i++ {
+			load, ok := insts[i].(*ir.LoadInst)
+			if !ok || !types.IsInteger(load.Type()) || SizeOf(load.Type()) > 4 || uses[load] != 1 {
+				continue
+			}
+			next := insts[i+1]
+			if op := next.Opcode(); (op == ir.OpZExt || op == ir.OpSExt) && next.Operands()[0] == load {
+				fused[load] = true
+			}
+		}
+	}
+	return fused
+}
+
 // Load from memory
 func (c *compiler) loadOp(inst *ir.LoadInst) error {
+	if c.fusedLoads[inst] {
+		return nil // intCastOp performs it
+	}
+
+	if isX87(inst.Type()) {
+		return c.x87LoadOp(inst)
+	}
+
 	ptr := inst.Operands()[0]
 	c.loadToReg(RAX, ptr) // Load pointer address
 
+	if isXMMVector(inst.Type()) {
+		// xmm0 = [rax]
+		prefix, opcode := vecMemMove(inst.Type(), inst.Align, false)
+		c.emitSSE(prefix, 0, opcode, 0, 0x00)
+		c.storeFromFpReg(0, inst)
+		return nil
+	}
+
 	// Determine size
 	size := SizeOf(inst.Type())
 
@@ -380,12 +782,50 @@ func (c *compiler) loadOp(inst *ir.LoadInst) error {
 	return nil
 }
 
+// vecMemMove picks the SSE move for a 128-bit vector load or store through
+// a pointer with the given declared alignment: movaps/movdqa, which fault
+// on an address that isn't 16-byte aligned, only when the alignment says
+// it is, otherwise movups/movdqu. An alignment of 0 declares nothing. Float
+// vectors use the ps forms and integer and pointer ones the dq forms, to
+// stay in their execution domain.
+func vecMemMove(t types.Type, align int, store bool) (prefix, opcode byte) {
+	aligned := align >= 16
+	isFloat := types.IsFloat(t.(*types.VectorType).ElementType)
+	var load, st byte
+	switch {
+	case !isFloat && aligned:
+		prefix, load, st = 0x66, 0x6F, 0x7F // movdqa
+	case !isFloat:
+		prefix, load, st = 0xF3, 0x6F, 0x7F // movdqu
+	case aligned:
+		load, st = 0x28, 0x29 // movaps
+	default:
+		load, st = 0x10, 0x11 // movups
+	}
+	if store {
+		return prefix, st
+	}
+	return prefix, load
+}
+
 // Store to memory
 func (c *compiler) storeOp(inst *ir.StoreInst) error {
 	ops := inst.Operands()
 	value := ops[0]
 	ptr := ops[1]
 
+	if isX87(value.Type()) {
+		return c.x87StoreOp(inst)
+	}
+	if isXMMVector(value.Type()) {
+		c.loadToFpReg(0, value)
+		c.loadToReg(RCX, ptr)
+		// [rcx] = xmm0
+		prefix, opcode := vecMemMove(value.Type(), inst.Align, true)
+		c.emitSSE(prefix, 0, opcode, 0, 0x01)
+		return nil
+	}
+
 	c.loadToReg(RAX, value) // Value to store
 	c.loadToReg(RCX, ptr)   // Pointer
 
@@ -415,6 +855,13 @@ func (c *compiler) storeOp(inst *ir.StoreInst) error {
 // GetElementPtr - pointer arithmetic
 func (c *compiler) gepOp(inst *ir.GetElementPtrInst) error {
 	ops := inst.Operands()
+	// A vector base or index makes a vector of addresses, one per lane,
+	// which the scalar lowering below would collapse into one
+	for _, op := range append([]ir.Value{inst}, ops...) {
+		if op.Type().Kind() == types.VectorKind {
+			return fmt.Errorf("vector GEP (%s operand): only scalar base pointers and indices are supported", op.Type())
+		}
+	}
 	c.loadToReg(RAX, ops[0]) // Base pointer
 
 	currentType := inst.SourceElementType
@@ -435,15 +882,12 @@ func (c *compiler) gepOp(inst *ir.GetElementPtrInst) error {
 			case *types.StructType:
 				// For structs, index must be constant
 				if constIdx, ok := idx.(*ir.ConstantInt); ok {
+					if constIdx.Value < 0 || constIdx.Value >= int64(len(ty.Fields)) {
+						return fmt.Errorf("GEP field %d of a %d-field struct", constIdx.Value, len(ty.Fields))
+					}
 					fieldIdx := int(constIdx.Value)
-					offset := GetStructFieldOffset(ty, fieldIdx)
-
-					// add rax, offset
-					if offset <= 127 {
-						c.emitBytes(0x48, 0x83, 0xC0, byte(offset))
-					} else {
-						c.emitBytes(0x48, 0x05)
-						c.emitInt32(int32(offset))
+					if offset := GetStructFieldOffset(ty, fieldIdx); offset != 0 {
+						c.emitRAXImm(0, 0x01, int64(offset)) // add
 					}
 
 					currentType = ty.Fields[fieldIdx]
@@ -461,19 +905,23 @@ func (c *compiler) gepOp(inst *ir.GetElementPtrInst) error {
 		// Load index and multiply by element size
 		if constIdx, ok := idx.(*ir.ConstantInt); ok {
 			// Constant offset
-			offset := int(constIdx.Value) * elemSize
-			if offset != 0 {
-				if offset >= -128 && offset <= 127 {
-					c.emitBytes(0x48, 0x83, 0xC0, byte(offset))
-				} else {
-					c.emitBytes(0x48, 0x05)
-					c.emitInt32(int32(offset))
-				}
+			if offset := constIdx.Value * int64(elemSize); offset != 0 {
+				c.emitRAXImm(0, 0x01, offset) // add
 			}
 		} else {
 			// Variable offset
 			c.loadToReg(RCX, idx)
 
+			// GEP indices are signed; widen narrow ones before scaling
+			switch SizeOf(idx.Type()) {
+			case 1:
+				c.emitBytes(0x48, 0x0F, 0xBE, 0xC9) // movsx rcx, cl
+			case 2:
+				c.emitBytes(0x48, 0x0F, 0xBF, 0xC9) // movsx rcx, cx
+			case 4:
+				c.emitBytes(0x48, 0x63, 0xC9) // movsxd rcx, ecx
+			}
+
 			// imul rcx, elemSize
 			if elemSize == 1 {
 				// No scaling needed
@@ -493,66 +941,186 @@ func (c *compiler) gepOp(inst *ir.GetElementPtrInst) error {
 	return nil
 }
 
+// emitRAXImm applies an ALU operation to RAX and the constant v: the one
+// with ModRM digit in the 0x83/0x81 immediate group, whose register form
+// "op r/m64, r64" is opcode regOp. Both immediate forms sign-extend, so
+// they only reproduce v within their ranges: and rax, -1 keeps every bit,
+// and an i64 mask of 0xFFFFFFFF, which as an imm32 would read as -1 too,
+// goes through RCX. An imm32 takes RAX's short form, with no ModRM byte.
+func (c *compiler) emitRAXImm(digit, regOp byte, v int64) {
+	switch {
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		c.emitBytes(0x48, 0x83, 0xC0|digit<<3, byte(v)) // op rax, imm8
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		c.emitBytes(0x48, digit<<3|0x05) // op rax, imm32
+		c.emitInt32(int32(v))
+	default:
+		c.loadConstInt(RCX, v)
+		c.emitBytes(0x48, regOp, 0xC8) // op rax, rcx
+	}
+}
+
+// Memory fence. x86-64 is TSO: loads aren't reordered with other loads,
+// nor stores with other stores, so acquire, release and acq_rel fences need
+// no instruction, only that the compiler not move memory accesses across
+// them, which this backend never does. Only a store followed by a load may
+// be reordered, and seq_cst forbids that with mfence.
+func (c *compiler) fenceOp(inst *ir.FenceInst) error {
+	switch inst.Ordering {
+	case ir.Acquire, ir.Release, ir.AcquireRelease:
+	case ir.SequentiallyConsistent:
+		c.emitBytes(0x0F, 0xAE, 0xF0) // mfence
+	default:
+		return fmt.Errorf("fence with ordering %d: must be acquire, release, acq_rel or seq_cst", inst.Ordering)
+	}
+	return nil
+}
+
 // Integer comparison
 func (c *compiler) icmpOp(inst *ir.ICmpInst) error {
-	ops := inst.Operands()
-	c.loadToReg(RAX, ops[0])
-	c.loadToReg(RCX, ops[1])
+	if c.fusedCompares[inst] {
+		return nil // condBrOp compares and branches on the flags
+	}
 
-	// cmp rax, rcx
-	c.emitBytes(0x48, 0x39, 0xC8)
+	cc, err := c.emitICmp(inst)
+	if err != nil {
+		return err
+	}
 
-	// SETcc al
-	var setcc byte
+	// setcc al
+	c.emitBytes(0x0F, 0x90|cc, 0xC0)
+
+	// movzx rax, al
+	c.emitBytes(0x48, 0x0F, 0xB6, 0xC0)
+
+	c.storeFromReg(RAX, inst)
+	return nil
+}
+
+// emitICmp compares the operands of inst and returns the x86 condition
+// code (the low nibble of setcc/jcc) that holds when the predicate does
+func (c *compiler) emitICmp(inst *ir.ICmpInst) (byte, error) {
+	var cc byte
 	switch inst.Predicate {
 	case ir.ICmpEQ:
-		setcc = 0x94 // sete
+		cc = 0x4 // e
 	case ir.ICmpNE:
-		setcc = 0x95 // setne
+		cc = 0x5 // ne
 	case ir.ICmpSLT:
-		setcc = 0x9C // setl
+		cc = 0xC // l
 	case ir.ICmpSLE:
-		setcc = 0x9E // setle
+		cc = 0xE // le
 	case ir.ICmpSGT:
-		setcc = 0x9F // setg
+		cc = 0xF // g
 	case ir.ICmpSGE:
-		setcc = 0x9D // setge
+		cc = 0xD // ge
 	case ir.ICmpULT:
-		setcc = 0x92 // setb
+		cc = 0x2 // b
 	case ir.ICmpULE:
-		setcc = 0x96 // setbe
+		cc = 0x6 // be
 	case ir.ICmpUGT:
-		setcc = 0x97 // seta
+		cc = 0x7 // a
 	case ir.ICmpUGE:
-		setcc = 0x93 // setae
+		cc = 0x3 // ae
 	default:
-		return fmt.Errorf("unsupported icmp predicate: %v", inst.Predicate)
+		return 0, fmt.Errorf("unsupported icmp predicate: %v", inst.Predicate)
 	}
 
-	c.emitBytes(0x0F, setcc, 0xC0)
+	ops := inst.Operands()
+	c.loadToReg(RAX, ops[0])
+	if isZeroConstant(ops[1]) {
+		// test sets the flags as cmp with 0 would, OF and CF clear, so
+		// every predicate reads them the same; no need to load the 0
+		switch SizeOf(ops[0].Type()) {
+		case 1:
+			c.emitBytes(0x84, 0xC0) // test al, al
+		case 2:
+			c.emitBytes(0x66, 0x85, 0xC0) // test ax, ax
+		case 4:
+			c.emitBytes(0x85, 0xC0) // test eax, eax
+		default:
+			c.emitBytes(0x48, 0x85, 0xC0) // test rax, rax
+		}
+		return cc, nil
+	}
+	c.loadToReg(RCX, ops[1])
 
-	// movzx rax, al
-	c.emitBytes(0x48, 0x0F, 0xB6, 0xC0)
+	// Compare at the operand width: stack slots load zero-extended but
+	// constants load sign-extended, so the upper bits can disagree
+	switch SizeOf(ops[0].Type()) {
+	case 1:
+		c.emitBytes(0x38, 0xC8) // cmp al, cl
+	case 2:
+		c.emitBytes(0x66, 0x39, 0xC8) // cmp ax, cx
+	case 4:
+		c.emitBytes(0x39, 0xC8) // cmp eax, ecx
+	default:
+		c.emitBytes(0x48, 0x39, 0xC8) // cmp rax, rcx
+	}
+	return cc, nil
+}
 
-	c.storeFromReg(RAX, inst)
-	return nil
+// isZeroConstant reports whether v is an integer 0 or a null pointer
+func isZeroConstant(v ir.Value) bool {
+	switch v := v.(type) {
+	case *ir.ConstantInt:
+		return v.Value == 0
+	case *ir.ConstantNull, *ir.ConstantZero:
+		return true
+	}
+	return false
+}
+
+// findFusedCompares returns the integer compares whose only use is the
+// conditional branch right after them. Those branch on the flags of the
+// cmp instead of materializing a 0/1 byte and testing it.
+func findFusedCompares(fn *ir.Function, uses map[ir.Value]int) map[*ir.ICmpInst]bool {
+	fused := make(map[*ir.ICmpInst]bool)
+	for _, block := range fn.Blocks {
+		insts := block.Instructions
+		if len(insts) < 2 {
+			continue
+		}
+		br, ok := insts[len(insts)-1].(*ir.CondBrInst)
+		if !ok {
+			continue
+		}
+		cmp, ok := insts[len(insts)-2].(*ir.ICmpInst)
+		if ok && br.Condition == ir.Value(cmp) && uses[cmp] == 1 {
+			fused[cmp] = true
+		}
+	}
+	return fused
 }
 
 // Floating point comparison
 func (c *compiler) fcmpOp(inst *ir.FCmpInst) error {
 	ops := inst.Operands()
+	fpType, ok := ops[0].Type().(*types.FloatType)
+	if !ok || !ops[1].Type().Equal(fpType) {
+		return fmt.Errorf("fcmp of %s and %s: only floats of one type can be compared", ops[0].Type(), ops[1].Type())
+	}
+
+	// false and true hold whatever the operands are, NaNs included
+	if inst.Predicate == ir.FCmpFalse || inst.Predicate == ir.FCmpTrue {
+		result := int64(0)
+		if inst.Predicate == ir.FCmpTrue {
+			result = 1
+		}
+		c.loadConstInt(RAX, result)
+		c.storeFromReg(RAX, inst)
+		return nil
+	}
 
 	c.loadToFpReg(0, ops[0]) // XMM0
 	c.loadToFpReg(1, ops[1]) // XMM1
 
-	fpType := ops[0].Type().(*types.FloatType)
-	prefix := byte(0xF2)
-	if fpType.BitWidth == 32 {
-		prefix = 0xF3
+	// ucomiss/ucomisd xmm0, xmm1 (ucomisd carries the 66 prefix, ucomiss none)
+	prefix := byte(0)
+	if fpType.BitWidth != 32 {
+		prefix = 0x66
 	}
-
-	// ucomiss/ucomisd xmm0, xmm1
-	c.emitBytes(prefix, 0x0F, 0x2E, 0xC1)
+	c.emitSSE(prefix, 0, 0x2E, 0, 0xC1)
 
 	// Map FCmp predicates to x86 condition codes
 	var setcc byte
@@ -569,6 +1137,10 @@ func (c *compiler) fcmpOp(inst *ir.FCmpInst) error {
 		setcc = 0x97 // seta (above)
 	case ir.FCmpOGE:
 		setcc = 0x93 // setae
+	case ir.FCmpORD:
+		setcc = 0x9B // setnp (neither is NaN)
+	case ir.FCmpUNO:
+		setcc = 0x9A // setp (either is NaN)
 	default:
 		return fmt.Errorf("unsupported fcmp predicate: %v", inst.Predicate)
 	}
@@ -0,0 +1,117 @@
+package amd64
+
+// TLSModel selects how thread-local globals are addressed
+type TLSModel int
+
+const (
+	// TLSLocalExec reads the thread pointer from %fs:0 and adds a
+	// link-time constant offset. Only valid in the main executable.
+	TLSLocalExec TLSModel = iota
+	// TLSGeneralDynamic resolves the address through __tls_get_addr and
+	// works from any module, including shared objects.
+	TLSGeneralDynamic
+)
+
+// CodeModel bounds where code and data may be placed, and so which
+// addressing forms reach them
+type CodeModel int
+
+const (
+	// CodeModelSmall assumes everything lies in the low 2GB of the
+	// address space
+	CodeModelSmall CodeModel = iota
+	// CodeModelMedium keeps code in the low 2GB but lets data go anywhere.
+	// Without large data sections it addresses like the small model.
+	CodeModelMedium
+	// CodeModelLarge makes no assumption and takes every global's address
+	// with a 64-bit immediate
+	CodeModelLarge
+)
+
+// Options tunes code generation. The zero value matches Compile.
+type Options struct {
+	TLSModel  TLSModel
+	CodeModel CodeModel
+
+	// NoPIC permits absolute addresses in code. The object can then only
+	// be linked into a position-dependent executable.
+	NoPIC bool
+
+	// EmitStart appends a _start that calls main and exits with its
+	// result, for linking with ld -nostdlib
+	EmitStart bool
+
+	// StartEntry names the function the _start of EmitStart calls in
+	// place of main
+	StartEntry string
+
+	// StartLibc has the _start of EmitStart pass main to the C library's
+	// __libc_start_main, as crt1.o's does, for an executable dynamically
+	// linked with libc: the library then initializes itself, and exit
+	// flushes its streams.
+	StartLibc bool
+
+	// Features lists the CPU extensions instructions may be selected
+	// from, by their lowercase names ("popcnt", "sse4.2", "avx2"). Nil is
+	// the x86-64 baseline: SSE2 and nothing newer.
+	Features map[string]bool
+
+	// CanonicalizeNaN replaces every NaN a float operation produces with
+	// the positive quiet NaN, hiding payload and sign differences
+	CanonicalizeNaN bool
+
+	// ZeroAlloca clears alloca memory before the function can read it
+	ZeroAlloca bool
+
+	// OutlineCold moves blocks with "cold" metadata into .text.unlikely
+	OutlineCold bool
+
+	// AsmFunctions maps function names to bodies in the assembly syntax
+	// Assemble accepts
+	AsmFunctions map[string]string
+
+	// TextSections maps function names to the section their code goes in
+	// instead of .text; their outlined cold blocks still go in
+	// .text.unlikely
+	TextSections map[string]string
+
+	// OmitFramePointer addresses the frames of leaf functions from RSP
+	// and leaves RBP untouched, dropping push rbp, mov rbp, rsp and leave
+	OmitFramePointer bool
+
+	// FunctionAlign starts every function on a multiple of this many
+	// bytes, a power of two, padding with nops. 0 or 1 packs them.
+	FunctionAlign int
+
+	// PoolFloatConsts loads float constants from .rodata, one slot per
+	// distinct value, instead of building them in RAX
+	PoolFloatConsts bool
+
+	// CET starts every function with endbr64, making it a valid target
+	// of indirect calls under CET's indirect branch tracking, and marks
+	// jump-table jumps notrack
+	CET bool
+
+	// UnwindTables gives every function an FDE in .eh_frame, not only
+	// those with invokes or resumes, so exceptions can unwind through
+	// all of them
+	UnwindTables bool
+
+	// Personality names the personality routine of functions with
+	// invokes; empty means __gxx_personality_v0, whose LSDA format the
+	// tables use
+	Personality string
+
+	// StackProtector guards functions with stack arrays with a canary
+	// from fs:[0x28], checked before each return
+	StackProtector bool
+
+	// ReuseLastResult skips reloading a 64-bit value into RAX right after
+	// storing it from there
+	ReuseLastResult bool
+}
+
+// hasFeature reports whether the target CPU supports the named extension
+func (o Options) hasFeature(name string) bool {
+	return o.Features[name]
+}
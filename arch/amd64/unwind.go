@@ -0,0 +1,511 @@
+package amd64
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/arc-language/core-builder/ir"
+)
+
+// Unwind tables. Every function that an exception may unwind through gets
+// a frame description entry (FDE) in .eh_frame saying how to find its
+// caller's frame from any instruction; one with invokes also gets a
+// language-specific data area (LSDA) in .gcc_except_table, which tells the
+// personality routine where its call sites and landing pads are. Both
+// follow the LSB and the Itanium C++ ABI, as GCC and Clang emit them.
+
+// DWARF call frame instructions
+const (
+	dwCFAAdvanceLoc     = 0x40 // Low 6 bits hold the delta
+	dwCFAOffset         = 0x80 // Low 6 bits hold the register
+	dwCFAAdvanceLoc1    = 0x02
+	dwCFAAdvanceLoc2    = 0x03
+	dwCFAAdvanceLoc4    = 0x04
+	dwCFADefCFA         = 0x0c
+	dwCFADefCFARegister = 0x0d
+	dwCFADefCFAOffset   = 0x0e
+	dwCFANop            = 0x00
+)
+
+// DWARF register numbers, which differ from the encoding's
+const (
+	dwRegRBP = 6
+	dwRegRSP = 7
+	dwRegRA  = 16 // The return address column
+)
+
+// Pointer encodings (DW_EH_PE_*)
+const (
+	dwEHPEuleb128  = 0x01
+	dwEHPEpcrel    = 0x10
+	dwEHPEsdata4   = 0x0b
+	dwEHPEindirect = 0x80
+	dwEHPEomit     = 0xff
+
+	// Code addresses are 32-bit offsets from where they are stored;
+	// symbols other objects define go through a GOT slot
+	dwEHPEcode        = dwEHPEpcrel | dwEHPEsdata4
+	dwEHPEindirectRef = dwEHPEindirect | dwEHPEpcrel | dwEHPEsdata4
+)
+
+// defaultPersonality is the personality routine of C++, whose LSDA format
+// the tables follow
+const defaultPersonality = "__gxx_personality_v0"
+
+// unwindInfo is what compileFunction learns about a function's frame and
+// call sites as it emits it, for its FDE and LSDA
+type unwindInfo struct {
+	needed      bool  // Has invokes or resumes, so exceptions pass through it
+	pushed      int   // Offset after push rbp
+	framed      int   // Offset after mov rbp, rsp, or after sub rsp under omitFP
+	returns     []int // Offsets of hot ret instructions, reached with the frame popped
+	coldReturns []int
+	callSites   []callSite
+}
+
+// callSite is the code of an invoke's call, [start, end), and the stub the
+// unwinder enters instead of returning when the callee throws
+type callSite struct {
+	start, end  int
+	invoke      *ir.InvokeInst
+	pad         int
+	stackAdjust int // Bytes of stack arguments still pushed on entry to pad
+}
+
+// landingPad finds the landingpad instruction an invoke unwinds to, which
+// must be the first instruction of its unwind destination after any phis
+func landingPad(inst *ir.InvokeInst) (*ir.LandingPadInst, error) {
+	if inst.UnwindDest == nil {
+		return nil, fmt.Errorf("invoke has no unwind destination")
+	}
+	for _, i := range inst.UnwindDest.Instructions {
+		if lp, ok := i.(*ir.LandingPadInst); ok {
+			return lp, nil
+		}
+		if _, ok := i.(*ir.PhiInst); !ok {
+			break
+		}
+	}
+	return nil, fmt.Errorf("unwind destination %s doesn't start with a landingpad", inst.UnwindDest.Name())
+}
+
+// clauseType names the type info a catch clause matches: a global, or the
+// empty string for a null pointer, which catches everything
+func clauseType(clause ir.Value) (string, error) {
+	switch clause := clause.(type) {
+	case *ir.Global:
+		return clause.Name(), nil
+	case *ir.ConstantNull, *ir.ConstantZero:
+		return "", nil
+	}
+	return "", fmt.Errorf("landingpad clause %s is not a type info global or null; filter clauses are not supported", clause.Name())
+}
+
+// hasInvoke reports whether fn contains an invoke
+func hasInvoke(fn *ir.Function) bool {
+	for _, block := range fn.Blocks {
+		if _, ok := block.Terminator().(*ir.InvokeInst); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// emitLandingPadStubs emits the code the unwinder jumps to for each invoke
+// that throws, after the function's hot blocks. It arrives with RSP as it
+// was just after the call and the exception in RAX:RDX; it drops any stack
+// arguments, stores the pair as the landingpad's value, makes the phi
+// copies of the edge and jumps to the unwind destination.
+func (c *compiler) emitLandingPadStubs() error {
+	for i := range c.unwind.callSites {
+		site := &c.unwind.callSites[i]
+		lp, err := landingPad(site.invoke)
+		if err != nil {
+			return err
+		}
+		site.pad = c.text.Len()
+		if site.stackAdjust > 0 {
+			c.emitFrameAdjust(0, site.stackAdjust)
+		}
+		c.storeRegisterPair(lp)
+		c.handlePhiForBranch(site.invoke.Parent(), site.invoke.UnwindDest)
+		// jmp rel32
+		c.emitBytes(0xE9)
+		c.fixups = append(c.fixups, jumpFixup{offset: c.text.Len(), target: site.invoke.UnwindDest})
+		c.emitUint32(0)
+	}
+	return nil
+}
+
+// emitUnwindTables adds the FDEs of the function just compiled, whose hot
+// code is text[start:end) and cold code coldText[coldStart:coldEnd), and
+// its LSDA if it has invokes
+func (c *compiler) emitUnwindTables(start, end, coldStart, coldEnd int) error {
+	if !c.opts.UnwindTables && !c.unwind.needed {
+		return nil
+	}
+	lsda := -1
+	if len(c.unwind.callSites) > 0 {
+		var err error
+		if lsda, err = c.emitLSDA(start, end); err != nil {
+			return err
+		}
+	}
+	c.emitFDE(start, end, false, lsda)
+	if coldEnd > coldStart {
+		c.emitFDE(coldStart, coldEnd, true, -1)
+	}
+	return nil
+}
+
+// emitFDE describes code from start to end. Hot code starts at the
+// function's entry, where the CFA is RSP+8 with the return address below
+// it; cold code starts with the frame already set up. lsda is the offset
+// of the function's LSDA in .gcc_except_table, or -1 for none.
+func (c *compiler) emitFDE(start, end int, cold bool, lsda int) {
+	// The rule once the frame is set up, and after a ret in the middle
+	// of the code brings it back
+	body := []byte{dwCFADefCFA, dwRegRBP, 16}
+	if c.omitFP {
+		body = appendULEB([]byte{dwCFADefCFAOffset}, uint64(c.currentFrame+16))
+	}
+	popped := []byte{dwCFADefCFA, dwRegRSP, 8}
+
+	var insns []byte
+	pos := start
+	advance := func(to int) {
+		insns = appendAdvance(insns, to-pos)
+		pos = to
+	}
+	returns := c.unwind.returns
+	if cold {
+		insns = append(insns, body...)
+		if !c.omitFP {
+			insns = append(insns, dwCFAOffset|dwRegRBP, 2)
+		}
+		returns = c.unwind.coldReturns
+	} else if c.omitFP {
+		advance(c.unwind.framed)
+		insns = append(insns, body...)
+	} else {
+		// push rbp; mov rbp, rsp
+		advance(c.unwind.pushed)
+		insns = append(insns, dwCFADefCFAOffset, 16, dwCFAOffset|dwRegRBP, 2)
+		advance(c.unwind.framed)
+		insns = append(insns, dwCFADefCFARegister, dwRegRBP)
+	}
+	for _, ret := range returns {
+		advance(ret)
+		insns = append(insns, popped...)
+		if ret+1 < end {
+			advance(ret + 1)
+			insns = append(insns, body...)
+		}
+	}
+
+	cie := c.cieFor(lsda >= 0)
+	fde := c.ehFrame.Len()
+	var entry []byte
+	entry = binary.LittleEndian.AppendUint32(entry, 0) // Length, filled below
+	entry = binary.LittleEndian.AppendUint32(entry, uint32(fde+4-cie))
+	c.relocations = append(c.relocations, Relocation{
+		Offset:     uint64(fde + len(entry)),
+		SymbolName: c.blockSection(cold),
+		Type:       R_X86_64_PC32,
+		Addend:     int64(start),
+		Section:    ".eh_frame",
+	})
+	entry = binary.LittleEndian.AppendUint32(entry, 0) // pc_begin
+	entry = binary.LittleEndian.AppendUint32(entry, uint32(end-start))
+	if lsda >= 0 {
+		entry = append(entry, 4)
+		c.relocations = append(c.relocations, Relocation{
+			Offset:     uint64(fde + len(entry)),
+			SymbolName: ".gcc_except_table",
+			Type:       R_X86_64_PC32,
+			Addend:     int64(lsda),
+			Section:    ".eh_frame",
+		})
+		entry = binary.LittleEndian.AppendUint32(entry, 0)
+	} else {
+		entry = append(entry, 0)
+	}
+	entry = append(entry, insns...)
+	c.ehFrame.Write(padEntry(entry))
+}
+
+// cieFor returns the .eh_frame offset of the common information entry
+// for FDEs with an LSDA or without, adding it on first use. The one with
+// an LSDA names the personality routine, which the unwinder then calls
+// for every frame described by it.
+func (c *compiler) cieFor(lsda bool) int {
+	if lsda && c.personalityCIE >= 0 {
+		return c.personalityCIE
+	}
+	if !lsda && c.plainCIE >= 0 {
+		return c.plainCIE
+	}
+
+	off := c.ehFrame.Len()
+	var entry []byte
+	entry = binary.LittleEndian.AppendUint32(entry, 0) // Length, filled below
+	entry = binary.LittleEndian.AppendUint32(entry, 0) // CIE id
+	entry = append(entry, 1)                           // Version
+	if lsda {
+		entry = append(entry, "zPLR\x00"...)
+	} else {
+		entry = append(entry, "zR\x00"...)
+	}
+	entry = appendULEB(entry, 1)       // Code alignment factor
+	entry = appendSLEB(entry, -8)      // Data alignment factor
+	entry = appendULEB(entry, dwRegRA) // Return address column
+	if lsda {
+		personality := c.opts.Personality
+		if personality == "" {
+			personality = defaultPersonality
+		}
+		entry = append(entry, 7, dwEHPEindirectRef)
+		// The personality routine may be in a shared library, so the
+		// pointer is to its GOT slot
+		c.relocations = append(c.relocations, Relocation{
+			Offset:     uint64(off + len(entry)),
+			SymbolName: personality,
+			Type:       R_X86_64_GOTPCREL,
+			Section:    ".eh_frame",
+		})
+		entry = binary.LittleEndian.AppendUint32(entry, 0)
+		entry = append(entry, dwEHPEcode, dwEHPEcode) // LSDA and code pointers
+		c.personalityCIE = off
+	} else {
+		entry = append(entry, 1, dwEHPEcode)
+		c.plainCIE = off
+	}
+	// At a function's entry the CFA is RSP+8 and the return address is
+	// stored just below it
+	entry = append(entry, dwCFADefCFA, dwRegRSP, 8, dwCFAOffset|dwRegRA, 1)
+	c.ehFrame.Write(padEntry(entry))
+	return off
+}
+
+// padEntry pads a CIE or FDE with nops to a multiple of eight bytes and
+// fills in its length, which excludes the length field itself
+func padEntry(entry []byte) []byte {
+	for len(entry)%8 != 0 {
+		entry = append(entry, dwCFANop)
+	}
+	binary.LittleEndian.PutUint32(entry, uint32(len(entry)-4))
+	return entry
+}
+
+// appendAdvance moves the location of the CFA rules delta bytes forward
+func appendAdvance(b []byte, delta int) []byte {
+	switch {
+	case delta == 0:
+		return b
+	case delta < 0x40:
+		return append(b, dwCFAAdvanceLoc|byte(delta))
+	case delta <= 0xff:
+		return append(b, dwCFAAdvanceLoc1, byte(delta))
+	case delta <= 0xffff:
+		return binary.LittleEndian.AppendUint16(append(b, dwCFAAdvanceLoc2), uint16(delta))
+	}
+	return binary.LittleEndian.AppendUint32(append(b, dwCFAAdvanceLoc4), uint32(delta))
+}
+
+// emitLSDA writes the LSDA of the function at text[start:end) and returns
+// its offset in .gcc_except_table. Its call-site table covers the whole
+// function: the personality routine terminates the program when a frame
+// is unwound from a call it doesn't list, so ordinary calls get entries
+// with no landing pad between the invokes' ones. Landing pads and call
+// sites are offsets from the function's start.
+//
+// A landing pad's clauses become a chain of actions, each selecting a
+// type from the function's type table by its index, numbered from 1 in
+// order of first appearance. That index is what the personality routine
+// leaves in the landingpad's second field when a clause matches; zero
+// means cleanup.
+func (c *compiler) emitLSDA(start, end int) (int, error) {
+	var types []string
+	typeIndex := make(map[string]int)
+	var actions []byte
+	actionOf := make(map[*ir.LandingPadInst]uint64)
+
+	var sites []byte
+	pos := start
+	addSite := func(from, to, pad int, action uint64) {
+		sites = appendULEB(sites, uint64(from-start))
+		sites = appendULEB(sites, uint64(to-from))
+		if pad != 0 {
+			pad -= start
+		}
+		sites = appendULEB(sites, uint64(pad))
+		sites = appendULEB(sites, action)
+	}
+	for _, site := range c.unwind.callSites {
+		lp, err := landingPad(site.invoke)
+		if err != nil {
+			return 0, err
+		}
+		action, seen := actionOf[lp]
+		if !seen && len(lp.Clauses) > 0 {
+			// Records are filter, then the distance from the next field
+			// to the next record, which follows directly: one byte
+			action = uint64(len(actions)) + 1
+			for i, clause := range lp.Clauses {
+				name, err := clauseType(clause)
+				if err != nil {
+					return 0, err
+				}
+				if typeIndex[name] == 0 {
+					types = append(types, name)
+					typeIndex[name] = len(types)
+				}
+				actions = appendSLEB(actions, int64(typeIndex[name]))
+				if i+1 < len(lp.Clauses) || lp.Cleanup {
+					actions = append(actions, 1)
+				} else {
+					actions = append(actions, 0)
+				}
+			}
+			if lp.Cleanup {
+				actions = append(actions, 0, 0)
+			}
+		}
+		actionOf[lp] = action
+
+		if site.start > pos {
+			addSite(pos, site.start, 0, 0)
+		}
+		addSite(site.start, site.end, site.pad, action)
+		pos = site.end
+	}
+	if end > pos {
+		addSite(pos, end, 0, 0)
+	}
+
+	for c.exceptTable.Len()%4 != 0 {
+		c.exceptTable.WriteByte(0)
+	}
+	off := c.exceptTable.Len()
+	lsda := []byte{dwEHPEomit} // Landing pads are relative to the function
+	if len(types) == 0 {
+		lsda = append(lsda, dwEHPEomit)
+	} else {
+		// The type table ends the LSDA and is indexed backwards from its
+		// end, which the offset here locates
+		lsda = append(lsda, dwEHPEindirectRef)
+		tail := 1 + len(appendULEB(nil, uint64(len(sites)))) + len(sites) + len(actions) + 4*len(types)
+		lsda = appendULEB(lsda, uint64(tail))
+	}
+	lsda = append(lsda, dwEHPEuleb128)
+	lsda = appendULEB(lsda, uint64(len(sites)))
+	lsda = append(lsda, sites...)
+	lsda = append(lsda, actions...)
+	for i := len(types) - 1; i >= 0; i-- {
+		if types[i] != "" {
+			// Type info of another object, through its GOT slot
+			c.relocations = append(c.relocations, Relocation{
+				Offset:     uint64(off + len(lsda)),
+				SymbolName: types[i],
+				Type:       R_X86_64_GOTPCREL,
+				Section:    ".gcc_except_table",
+			})
+		}
+		lsda = binary.LittleEndian.AppendUint32(lsda, 0)
+	}
+	c.exceptTable.Write(lsda)
+	return off, nil
+}
+
+// appendULEB appends v in unsigned LEB128, which is Go's uvarint encoding
+func appendULEB(b []byte, v uint64) []byte {
+	return binary.AppendUvarint(b, v)
+}
+
+// appendSLEB appends v in signed LEB128
+func appendSLEB(b []byte, v int64) []byte {
+	for {
+		low := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 && low&0x40 == 0 || v == -1 && low&0x40 != 0 {
+			return append(b, low)
+		}
+		b = append(b, low|0x80)
+	}
+}
+
+// invokeOp lowers an invoke: the call, with its code recorded as a call
+// site whose landing pad is a stub emitted after the function's blocks,
+// then a branch to the normal destination
+func (c *compiler) invokeOp(inst *ir.InvokeInst) error {
+	if inst.NormalDest == nil {
+		return fmt.Errorf("invoke has no normal destination")
+	}
+	if _, err := landingPad(inst); err != nil {
+		return err
+	}
+	if returnsInMemory(inst.Type()) {
+		return fmt.Errorf("invoke of a function returning %s in memory is not supported", inst.Type())
+	}
+
+	// The call it makes, with the invoke's operands and result slot
+	call := &ir.CallInst{
+		BaseInstruction: inst.BaseInstruction,
+		Callee:          inst.Callee,
+		CalleeName:      inst.CalleeName,
+	}
+	call.Op = ir.OpCall
+	if slot, ok := c.stackMap[inst]; ok {
+		c.stackMap[call] = slot
+	}
+
+	start := c.text.Len()
+	stackAdjust, err := c.emitCall(call)
+	if err != nil {
+		return err
+	}
+	c.unwind.needed = true
+	c.unwind.callSites = append(c.unwind.callSites, callSite{
+		start:       start,
+		end:         c.text.Len(),
+		invoke:      inst,
+		stackAdjust: stackAdjust,
+	})
+
+	c.handlePhiForBranch(inst.Parent(), inst.NormalDest)
+	if inst.NormalDest != c.nextBlock {
+		// jmp rel32
+		c.emitBytes(0xE9)
+		c.fixups = append(c.fixups, jumpFixup{offset: c.text.Len(), target: inst.NormalDest})
+		c.emitUint32(0)
+	}
+	return nil
+}
+
+// resumeOp continues unwinding an exception a landing pad didn't handle,
+// passing _Unwind_Resume the exception object from the landingpad value
+func (c *compiler) resumeOp(inst *ir.ResumeInst) error {
+	if inst.NumOperands() == 0 {
+		return fmt.Errorf("resume has no exception operand")
+	}
+	exc := inst.Operands()[0]
+	if IsAggregate(exc.Type()) {
+		c.loadRegisterPair(exc)
+		// mov rdi, rax
+		c.emitBytes(0x48, 0x89, 0xC7)
+	} else {
+		c.loadToReg(RDI, exc)
+	}
+	c.unwind.needed = true
+	// call _Unwind_Resume, which doesn't return
+	c.emitBytes(0xE8)
+	c.relocations = append(c.relocations, Relocation{
+		Offset:     uint64(c.text.Len()),
+		SymbolName: "_Unwind_Resume",
+		Type:       R_X86_64_PLT32,
+		Addend:     -4,
+	})
+	c.emitUint32(0)
+	c.emitBytes(0x0F, 0x0B) // ud2
+	return nil
+}
@@ -0,0 +1,154 @@
+package amd64
+
+import (
+	"fmt"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+)
+
+// System V va_list is a single-element array of
+//
+//	struct {
+//		uint32 gp_offset;         // next integer register in the save area
+//		uint32 fp_offset;         // next XMM register in the save area
+//		void  *overflow_arg_area; // next argument passed on the stack
+//		void  *reg_save_area;
+//	}
+//
+// A variadic function spills every argument register into the save area
+// on entry; va_arg walks the offsets until the registers are used up and
+// then moves on to the caller's stack.
+const (
+	vaGPSaveSize   = 6 * 8      // RDI, RSI, RDX, RCX, R8, R9
+	vaSaveAreaSize = 6*8 + 8*16 // plus XMM0-XMM7, 16 bytes each
+)
+
+// varargFrame locates the variadic state of the function being compiled
+type varargFrame struct {
+	saveArea int // RBP offset of the register save area
+	gpOffset int // gp_offset just past the named arguments
+	fpOffset int // fp_offset just past the named arguments
+	overflow int // RBP offset of the first stack-passed variadic argument
+}
+
+// emitVarargSave spills the argument registers into the save area. AL
+// holds an upper bound on the vector registers the caller used, so the
+// XMM stores are skipped when it is zero.
+func (c *compiler) emitVarargSave() {
+	argRegs := []int{RDI, RSI, RDX, RCX, R8, R9}
+	for i, reg := range argRegs {
+		c.emitStoreToStack(reg, c.varargs.saveArea+i*8, 8)
+	}
+
+	// test al, al; je past the movaps
+	c.emitBytes(0x84, 0xC0, 0x74, 0x00)
+	skipFrom := c.text.Len()
+	for i := 0; i < 8; i++ {
+		// movaps [rbp + disp32], xmmi (the save area is 16-byte aligned)
+		c.emitSSE(0, 0, 0x29, 0, byte(0x85|i<<3))
+		c.emitFrameDisp(c.varargs.saveArea + vaGPSaveSize + i*16)
+	}
+	c.text.Bytes()[skipFrom-1] = byte(c.text.Len() - skipFrom)
+}
+
+// llvm.va_start(ptr): point the va_list at the first variadic argument
+func (c *compiler) vaStartIntrinsic(inst *ir.CallInst) error {
+	if c.varargs == nil {
+		return fmt.Errorf("va_start in non-variadic function %s", c.currentFunc.Name())
+	}
+	if inst.NumOperands() != 1 {
+		return fmt.Errorf("llvm.va_start takes the va_list's address")
+	}
+	c.loadToReg(RCX, inst.Operands()[0])
+
+	// mov dword [rcx], gp_offset
+	c.emitBytes(0xC7, 0x01)
+	c.emitUint32(uint32(c.varargs.gpOffset))
+	// mov dword [rcx+4], fp_offset
+	c.emitBytes(0xC7, 0x41, 0x04)
+	c.emitUint32(uint32(c.varargs.fpOffset))
+	// lea rax, [rbp + overflow]; mov [rcx+8], rax
+	c.emitBytes(0x48, 0x8D, 0x85)
+	c.emitFrameDisp(c.varargs.overflow)
+	c.emitBytes(0x48, 0x89, 0x41, 0x08)
+	// lea rax, [rbp + saveArea]; mov [rcx+16], rax
+	c.emitBytes(0x48, 0x8D, 0x85)
+	c.emitFrameDisp(c.varargs.saveArea)
+	c.emitBytes(0x48, 0x89, 0x41, 0x10)
+	return nil
+}
+
+// llvm.va_copy(dst, src): the va_list is plain data, copy its 24 bytes
+func (c *compiler) vaCopyIntrinsic(inst *ir.CallInst) error {
+	ops := inst.Operands()
+	if len(ops) != 2 {
+		return fmt.Errorf("llvm.va_copy takes a destination and source va_list")
+	}
+	c.loadToReg(RDX, ops[1])
+	c.loadToReg(RCX, ops[0])
+	for off := byte(0); off < 24; off += 8 {
+		// mov rax, [rdx+off]; mov [rcx+off], rax
+		c.emitBytes(0x48, 0x8B, 0x42, off)
+		c.emitBytes(0x48, 0x89, 0x41, off)
+	}
+	return nil
+}
+
+// va_arg: fetch the next argument of the given type and advance the list
+func (c *compiler) vaArgOp(inst *ir.VAArgInst) error {
+	t := inst.Type()
+	isFloat := types.IsFloat(t)
+	size := SizeOf(t)
+	if IsAggregate(t) || size > 8 || (isFloat && size != 4 && size != 8) {
+		return fmt.Errorf("va_arg of type %s is not supported", t)
+	}
+
+	c.loadToReg(RCX, inst.Operands()[0])
+
+	// RDX <- address of the argument
+	if isFloat {
+		// mov eax, [rcx+4]; cmp eax, 176; jae overflow
+		c.emitBytes(0x8B, 0x41, 0x04)
+		c.emitBytes(0x3D)
+		c.emitUint32(vaSaveAreaSize)
+		c.emitBytes(0x73, 0x0F)
+		// mov rdx, rax; add rdx, [rcx+16]
+		c.emitBytes(0x48, 0x89, 0xC2, 0x48, 0x03, 0x51, 0x10)
+		// add eax, 16; mov [rcx+4], eax; jmp load
+		c.emitBytes(0x83, 0xC0, 0x10, 0x89, 0x41, 0x04, 0xEB, 0x0C)
+	} else {
+		// mov eax, [rcx]; cmp eax, 48; jae overflow
+		c.emitBytes(0x8B, 0x01, 0x83, 0xF8, vaGPSaveSize, 0x73, 0x0E)
+		// mov rdx, rax; add rdx, [rcx+16]
+		c.emitBytes(0x48, 0x89, 0xC2, 0x48, 0x03, 0x51, 0x10)
+		// add eax, 8; mov [rcx], eax; jmp load
+		c.emitBytes(0x83, 0xC0, 0x08, 0x89, 0x01, 0xEB, 0x0C)
+	}
+	// overflow: every stack argument takes an eightbyte
+	// mov rdx, [rcx+8]; lea rax, [rdx+8]; mov [rcx+8], rax
+	c.emitBytes(0x48, 0x8B, 0x51, 0x08, 0x48, 0x8D, 0x42, 0x08, 0x48, 0x89, 0x41, 0x08)
+
+	// load:
+	if isFloat {
+		prefix := byte(0xF2) // movsd xmm0, [rdx]
+		if size == 4 {
+			prefix = 0xF3 // movss xmm0, [rdx]
+		}
+		c.emitSSE(prefix, 0, 0x10, 0, 0x02)
+		c.storeFromFpReg(0, inst)
+		return nil
+	}
+	switch size {
+	case 1:
+		c.emitBytes(0x0F, 0xB6, 0x02) // movzx eax, byte [rdx]
+	case 2:
+		c.emitBytes(0x0F, 0xB7, 0x02) // movzx eax, word [rdx]
+	case 4:
+		c.emitBytes(0x8B, 0x02) // mov eax, [rdx]
+	default:
+		c.emitBytes(0x48, 0x8B, 0x02) // mov rax, [rdx]
+	}
+	c.storeFromReg(RAX, inst)
+	return nil
+}
@@ -0,0 +1,236 @@
+package amd64
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+)
+
+// x86_fp80, C's long double, has no SSE form: its values are computed on
+// the x87 register stack. Each lives in a 16-byte frame slot, of which the
+// first 10 bytes hold the extended-precision value, and an operation loads
+// its operands onto the stack with fld, combines them with one of the
+// popping forms and stores the result back with fstp, leaving the stack
+// empty again. Only arithmetic, negation, conversions to and from the
+// other float types, loads, stores, phis and freeze take fp80 values;
+// checkX87 rejects anything else before a function is compiled.
+
+// isX87 reports whether values of type t are computed on the x87 stack
+func isX87(t types.Type) bool {
+	ft, ok := t.(*types.FloatType)
+	return ok && ft.BitWidth == 80
+}
+
+// x87Ops are the instructions that may produce or use an fp80 value
+var x87Ops = map[ir.Opcode]bool{
+	ir.OpFAdd: true, ir.OpFSub: true, ir.OpFMul: true, ir.OpFDiv: true,
+	ir.OpFNeg: true, ir.OpFPExt: true, ir.OpFPTrunc: true,
+	ir.OpLoad: true, ir.OpStore: true, ir.OpPhi: true, ir.OpFreeze: true,
+}
+
+// checkX87 rejects the uses of fp80 values the backend can't lower: as
+// arguments or results of functions, which the ABI passes in memory and
+// returns in st(0), and in any instruction outside x87Ops
+func checkX87(fn *ir.Function) error {
+	if ft := fn.FuncType; ft != nil {
+		for _, t := range append([]types.Type{ft.ReturnType}, ft.ParamTypes...) {
+			if isX87(t) {
+				return fmt.Errorf("x86_fp80 arguments and return values are not supported")
+			}
+		}
+	}
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			if x87Ops[inst.Opcode()] {
+				continue
+			}
+			uses := inst.Type() != nil && isX87(inst.Type())
+			for _, op := range inst.Operands() {
+				uses = uses || isX87(op.Type())
+			}
+			if uses {
+				return fmt.Errorf("in block %s: %s on x86_fp80 is not supported", block.Name(), inst.Opcode())
+			}
+		}
+	}
+	return nil
+}
+
+// encodeX87 returns the 80-bit extended-precision encoding of value, which
+// holds every double exactly: a 64-bit significand with an explicit
+// integer bit, then the sign and a 15-bit exponent biased by 16383
+func encodeX87(value float64) [10]byte {
+	raw := math.Float64bits(value)
+	sign := uint16(raw>>63) << 15
+	exp := int(raw >> 52 & 0x7FF)
+	frac := raw & (1<<52 - 1)
+
+	var e uint16
+	var m uint64
+	switch {
+	case exp == 0x7FF:
+		// Infinity or NaN, keeping the payload
+		e, m = 0x7FFF, 1<<63|frac<<11
+	case exp != 0:
+		e, m = uint16(exp-1023+16383), 1<<63|frac<<11
+	case frac != 0:
+		// A subnormal double is a normal extended value
+		lz := bits.LeadingZeros64(frac)
+		e, m = uint16(63-lz-1074+16383), frac<<lz
+	}
+
+	var b [10]byte
+	binary.LittleEndian.PutUint64(b[:8], m)
+	binary.LittleEndian.PutUint16(b[8:], sign|e)
+	return b
+}
+
+// x87Load pushes an fp80 value onto the x87 stack: a constant from a
+// .rodata slot shared by equal constants, undef, zero and values without a
+// slot as +0.0, anything else from its frame slot
+func (c *compiler) x87Load(value ir.Value) {
+	if cf, ok := value.(*ir.ConstantFloat); ok {
+		enc := encodeX87(cf.Value)
+		// fld tbyte [rip + constant]
+		c.emitBytes(0xDB, 0x2D)
+		c.emitRodataRef(c.pooledRodata(enc[:]))
+		return
+	}
+	offset, ok := c.stackMap[value]
+	if _, isConst := value.(ir.Constant); isConst || !ok {
+		c.emitBytes(0xD9, 0xEE) // fldz
+		return
+	}
+	// fld tbyte [rbp + offset]
+	c.emitBytes(0xDB, 0xAD)
+	c.emitFrameDisp(offset)
+}
+
+// x87Store pops the top of the x87 stack into dest's frame slot, or
+// discards it when dest has none
+func (c *compiler) x87Store(dest ir.Value) {
+	offset, ok := c.stackMap[dest]
+	if !ok {
+		c.emitBytes(0xDD, 0xD8) // fstp st(0)
+		return
+	}
+	// fstp tbyte [rbp + offset]
+	c.emitBytes(0xDB, 0xBD)
+	c.emitFrameDisp(offset)
+}
+
+// x87BinOp lowers fadd, fsub, fmul and fdiv on fp80: with the first
+// operand in st(1) and the second in st(0), the popping form leaves
+// st(1) op st(0) on top
+func (c *compiler) x87BinOp(inst ir.Instruction) error {
+	ops := inst.Operands()
+	for _, op := range ops[:2] {
+		if !op.Type().Equal(inst.Type()) {
+			return fmt.Errorf("%s %s has a %s operand", inst.Opcode(), inst.Type(), op.Type())
+		}
+	}
+
+	c.x87Load(ops[0])
+	c.x87Load(ops[1])
+	switch inst.Opcode() {
+	case ir.OpFAdd:
+		c.emitBytes(0xDE, 0xC1) // faddp st(1), st
+	case ir.OpFSub:
+		c.emitBytes(0xDE, 0xE9) // fsubp st(1), st
+	case ir.OpFMul:
+		c.emitBytes(0xDE, 0xC9) // fmulp st(1), st
+	case ir.OpFDiv:
+		c.emitBytes(0xDE, 0xF9) // fdivp st(1), st
+	default:
+		return fmt.Errorf("%s on x86_fp80 is not supported", inst.Opcode())
+	}
+	c.x87Store(inst)
+	return nil
+}
+
+// x87NegOp flips the sign of an fp80 value with fchs
+func (c *compiler) x87NegOp(inst ir.Instruction) error {
+	if !inst.Operands()[0].Type().Equal(inst.Type()) {
+		return fmt.Errorf("fneg %s of %s: only floats are supported", inst.Type(), inst.Operands()[0].Type())
+	}
+	c.x87Load(inst.Operands()[0])
+	c.emitBytes(0xD9, 0xE0) // fchs
+	c.x87Store(inst)
+	return nil
+}
+
+// x87CastOp converts between fp80 and float or double. Widening is exact:
+// the narrower value is stored to the low bytes of the result's own slot,
+// reloaded onto the x87 stack in its width, and stored back over itself as
+// fp80. Narrowing rounds as fstp does, to nearest by default.
+func (c *compiler) x87CastOp(inst *ir.CastInst, srcType, dstType *types.FloatType) error {
+	src := inst.Operands()[0]
+	if srcType.BitWidth == 80 && dstType.BitWidth == 80 {
+		c.x87Load(src)
+		c.x87Store(inst)
+		return nil
+	}
+	narrow := srcType
+	if srcType.BitWidth == 80 {
+		narrow = dstType
+	}
+	if narrow.BitWidth != 32 && narrow.BitWidth != 64 {
+		return fmt.Errorf("fp cast from %s to %s is not supported", srcType, dstType)
+	}
+
+	offset, ok := c.stackMap[inst]
+	if !ok {
+		return nil // Nothing reads the result
+	}
+
+	if dstType.BitWidth == 80 {
+		c.loadToFpReg(0, src)
+		c.emitFpStoreToStack(0, offset, srcType.BitWidth == 64)
+		// fld dword/qword [rbp + offset]
+		if srcType.BitWidth == 32 {
+			c.emitBytes(0xD9, 0x85)
+		} else {
+			c.emitBytes(0xDD, 0x85)
+		}
+		c.emitFrameDisp(offset)
+		c.x87Store(inst)
+		return nil
+	}
+
+	c.x87Load(src)
+	// fstp dword/qword [rbp + offset]
+	if dstType.BitWidth == 32 {
+		c.emitBytes(0xD9, 0x9D)
+	} else {
+		c.emitBytes(0xDD, 0x9D)
+	}
+	c.emitFrameDisp(offset)
+	if c.opts.CanonicalizeNaN {
+		c.loadToFpReg(0, inst)
+		c.emitCanonicalizeNaN(dstType.BitWidth)
+		c.storeFromFpReg(0, inst)
+	}
+	return nil
+}
+
+// x87LoadOp loads an fp80 value through a pointer: fld tbyte [rax]
+func (c *compiler) x87LoadOp(inst *ir.LoadInst) error {
+	c.loadToReg(RAX, inst.Operands()[0])
+	c.emitBytes(0xDB, 0x28)
+	c.x87Store(inst)
+	return nil
+}
+
+// x87StoreOp stores an fp80 value through a pointer: its 10 bytes, by
+// fstp tbyte [rcx], and not the slot's padding
+func (c *compiler) x87StoreOp(inst *ir.StoreInst) error {
+	ops := inst.Operands()
+	c.loadToReg(RCX, ops[1])
+	c.x87Load(ops[0])
+	c.emitBytes(0xDB, 0x39)
+	return nil
+}
@@ -0,0 +1,852 @@
+package codegen
+
+import (
+	"bytes"
+	delf "debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-codegen/arch/amd64"
+)
+
+// GenerateAssemblyFile compiles m like GenerateObjectWithOptions and
+// returns the object as GNU as source: one .section per section, with its
+// flags and alignment, and each symbol's .globl/.weak, visibility, .type,
+// .size and label where it is defined. Assembling it with as gives the
+// same section contents, symbols and relocations.
+//
+// Code is written in Intel syntax, one instruction per line, with {disp32}
+// where the backend chose a 32-bit displacement as would shorten. A code
+// offset anything refers to gets a local label, and the reference names
+// it: a branch's target, a relocation's, the end of a function for its
+// .size, and in .eh_frame and .gcc_except_table the address ranges and
+// advances of the unwind rules and the call-site ranges of the LSDAs,
+// written as differences of labels. Calls through the PLT and RIP-relative
+// references name their symbols; a symbol as would read as a register or
+// an operator, like ds or and, is referred to through a .set alias. An
+// instruction the disassembler doesn't know, or that wouldn't encode back
+// to the same bytes and relocations, stays the bytes the backend chose: a
+// .byte line with the disassembly as a comment, after a .reloc for each
+// relocation.
+func GenerateAssemblyFile(m *ir.Module, opts CompileOptions) (string, error) {
+	obj, err := GenerateObjectWithOptions(m, opts)
+	if err != nil {
+		return "", err
+	}
+	f, err := delf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return "", fmt.Errorf("reading back the object: %w", err)
+	}
+	return assemblySource(f)
+}
+
+// asmReloc is a relocation as a .reloc directive writes it
+type asmReloc struct {
+	offset uint64
+	typ    delf.R_X86_64
+
+	symbol  string
+	section int // For a section symbol, the section's index
+	addend  int64
+	// as leaves a reference to symbol as this relocation rather than
+	// resolving it: symbol is global or names another section's start
+	kept bool
+}
+
+// asmField is bytes of a data section written as an expression of labels
+type asmField struct {
+	size uint64
+	text string
+}
+
+// asmFile writes an object as source in two passes: the first finds the
+// code offsets referred to, the second labels them
+type asmFile struct {
+	f      *delf.File
+	syms   []delf.Symbol
+	relocs map[int][]asmReloc // By the index of the section they patch
+
+	final bool
+	// Each code section's instruction starts, ascending, then its end
+	bounds map[int][]uint64
+	refs   map[int]map[uint64]bool // Code offsets referred to
+	labels map[int]map[uint64]bool // Code offsets labelled
+	fields map[int]map[uint64]asmField
+
+	aliases map[string]string // Symbol names by their .set alias
+	aliased []string
+}
+
+func assemblySource(f *delf.File) (string, error) {
+	syms, err := f.Symbols()
+	if err != nil && !errors.Is(err, delf.ErrNoSymbols) {
+		return "", err
+	}
+
+	relocs := make(map[int][]asmReloc)
+	for _, sec := range f.Sections {
+		if sec.Type != delf.SHT_RELA {
+			continue
+		}
+		data, err := sec.Data()
+		if err != nil {
+			return "", err
+		}
+		for ; len(data) >= 24; data = data[24:] {
+			info := binary.LittleEndian.Uint64(data[8:])
+			idx := int(info >> 32)
+			if idx == 0 || idx > len(syms) {
+				return "", fmt.Errorf("%s: relocation against symbol %d of %d", sec.Name, idx, len(syms))
+			}
+			sym := syms[idx-1]
+			r := asmReloc{
+				offset: binary.LittleEndian.Uint64(data),
+				typ:    delf.R_X86_64(uint32(info)),
+				symbol: sym.Name,
+				addend: int64(binary.LittleEndian.Uint64(data[16:])),
+				kept:   delf.ST_BIND(sym.Info) != delf.STB_LOCAL,
+			}
+			if delf.ST_TYPE(sym.Info) == delf.STT_SECTION {
+				r.symbol, r.section = sectionLabel(int(sym.Section)), int(sym.Section)
+				r.kept = int(sym.Section) != int(sec.Info)
+			}
+			relocs[int(sec.Info)] = append(relocs[int(sec.Info)], r)
+		}
+	}
+	for _, rs := range relocs {
+		sort.SliceStable(rs, func(a, b int) bool { return rs[a].offset < rs[b].offset })
+	}
+
+	a := &asmFile{
+		f:       f,
+		syms:    syms,
+		relocs:  relocs,
+		bounds:  make(map[int][]uint64),
+		refs:    make(map[int]map[uint64]bool),
+		labels:  make(map[int]map[uint64]bool),
+		aliases: make(map[string]string),
+	}
+	if _, err := a.source(); err != nil {
+		return "", err
+	}
+	a.final = true
+	for index, offsets := range a.refs {
+		a.labels[index] = make(map[uint64]bool)
+		for off := range offsets {
+			a.labels[index][a.bounds[index][a.base(index, off)]] = true
+		}
+	}
+	body, err := a.source()
+	if err != nil {
+		return "", err
+	}
+
+	// Set in AT&T syntax, where a register name needs a %
+	var sb strings.Builder
+	for i, name := range a.aliased {
+		fmt.Fprintf(&sb, "\t.set\t%s, %s\n", aliasLabel(i), name)
+	}
+	return sb.String() + body, nil
+}
+
+func (a *asmFile) source() (string, error) {
+	var sb strings.Builder
+	sb.WriteString("\t.intel_syntax noprefix\n")
+	for _, sym := range a.syms {
+		if delf.ST_TYPE(sym.Info) == delf.STT_FILE {
+			fmt.Fprintf(&sb, "\t.file\t%q\n", sym.Name)
+		}
+	}
+	// References create undefined symbols; declare what they can't imply
+	for _, sym := range a.syms {
+		if sym.Section == delf.SHN_UNDEF && sym.Name != "" {
+			writeSymbolAttributes(&sb, sym, false, "")
+		}
+	}
+	for _, sym := range a.syms {
+		if sym.Section == delf.SHN_COMMON {
+			writeSymbolAttributes(&sb, sym, false, "")
+			fmt.Fprintf(&sb, "\t.comm\t%s, %d, %d\n", sym.Name, sym.Size, sym.Value)
+		}
+	}
+
+	a.fields = make(map[int]map[uint64]asmField)
+	if err := a.unwindFields(); err != nil {
+		return "", err
+	}
+	for i, sec := range a.f.Sections {
+		switch {
+		case sec.Name == ".comment":
+			// as warns at .comment's flags set by hand; .ident builds it
+			data, err := sec.Data()
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString("\n")
+			for _, s := range strings.Split(string(data), "\x00") {
+				if s != "" {
+					fmt.Fprintf(&sb, "\t.ident\t%q\n", s)
+				}
+			}
+			continue
+		case sec.Type != delf.SHT_PROGBITS && sec.Type != delf.SHT_NOBITS && sec.Type != delf.SHT_NOTE:
+			continue
+		}
+		var defined []delf.Symbol
+		for _, sym := range a.syms {
+			t := delf.ST_TYPE(sym.Info)
+			if int(sym.Section) == i && t != delf.STT_SECTION && t != delf.STT_FILE {
+				defined = append(defined, sym)
+			}
+		}
+		sort.SliceStable(defined, func(a, b int) bool { return defined[a].Value < defined[b].Value })
+		if err := a.writeSection(&sb, i, sec, defined); err != nil {
+			return "", err
+		}
+	}
+	return sb.String(), nil
+}
+
+// sectionLabel names the start of a section, for relocations against its
+// section symbol
+func sectionLabel(index int) string {
+	return fmt.Sprintf(".Lsection%d", index)
+}
+
+// codeLabel names an instruction's start, or a code section's end
+func codeLabel(index int, offset uint64) string {
+	return fmt.Sprintf(".Lsection%d_%x", index, offset)
+}
+
+func aliasLabel(i int) string {
+	return fmt.Sprintf(".Lsym%d", i)
+}
+
+func (a *asmFile) isCode(index int) bool {
+	return index > 0 && index < len(a.f.Sections) && a.f.Sections[index].Flags&delf.SHF_EXECINSTR != 0
+}
+
+// base finds the last instruction start in bounds at or before offset
+func (a *asmFile) base(index int, offset uint64) int {
+	bounds := a.bounds[index]
+	return sort.Search(len(bounds), func(i int) bool { return bounds[i] > offset }) - 1
+}
+
+// codeRef refers to an offset into a code section: as the label of the
+// instruction it starts, or counted from the one it falls in
+func (a *asmFile) codeRef(index int, offset uint64) string {
+	if a.refs[index] == nil {
+		a.refs[index] = make(map[uint64]bool)
+	}
+	a.refs[index][offset] = true
+	i := a.base(index, offset)
+	if !a.final || i < 0 {
+		return fmt.Sprintf("%s+%d", sectionLabel(index), offset)
+	}
+	ref := codeLabel(index, a.bounds[index][i])
+	if d := offset - a.bounds[index][i]; d != 0 {
+		ref += fmt.Sprintf("+%d", d)
+	}
+	return ref
+}
+
+// symbolRef spells a symbol for an operand or an expression
+func (a *asmFile) symbolRef(name string) string {
+	if !isAsmReserved(name) {
+		return name
+	}
+	alias, ok := a.aliases[name]
+	if !ok {
+		alias = aliasLabel(len(a.aliased))
+		a.aliases[name] = alias
+		a.aliased = append(a.aliased, name)
+	}
+	return alias
+}
+
+// target spells what a relocation refers to, its symbol plus its addend
+func (a *asmFile) target(r asmReloc) string {
+	if a.isCode(r.section) && r.addend >= 0 {
+		return a.codeRef(r.section, uint64(r.addend))
+	}
+	t := r.symbol
+	if r.section == 0 {
+		t = a.symbolRef(r.symbol)
+	}
+	if r.addend != 0 {
+		t += fmt.Sprintf("%+d", r.addend)
+	}
+	return t
+}
+
+func (a *asmFile) writeSection(sb *strings.Builder, index int, sec *delf.Section, defined []delf.Symbol) error {
+	var flags strings.Builder
+	for _, fl := range []struct {
+		bit  delf.SectionFlag
+		name byte
+	}{
+		{delf.SHF_ALLOC, 'a'}, {delf.SHF_WRITE, 'w'}, {delf.SHF_EXECINSTR, 'x'},
+		{delf.SHF_MERGE, 'M'}, {delf.SHF_STRINGS, 'S'}, {delf.SHF_TLS, 'T'},
+	} {
+		if sec.Flags&fl.bit != 0 {
+			flags.WriteByte(fl.name)
+		}
+	}
+	kind := "@progbits"
+	switch sec.Type {
+	case delf.SHT_NOBITS:
+		kind = "@nobits"
+	case delf.SHT_NOTE:
+		kind = "@note"
+	}
+	fmt.Fprintf(sb, "\n\t.section\t%s,\"%s\",%s", sec.Name, flags.String(), kind)
+	if sec.Flags&delf.SHF_MERGE != 0 {
+		fmt.Fprintf(sb, ",%d", sec.Entsize)
+	}
+	sb.WriteString("\n")
+	if sec.Addralign > 1 {
+		fmt.Fprintf(sb, "\t.balign\t%d\n", sec.Addralign)
+	}
+	fmt.Fprintf(sb, "%s:\n", sectionLabel(index))
+
+	var data []byte
+	if sec.Type != delf.SHT_NOBITS {
+		var err error
+		if data, err = sec.Data(); err != nil {
+			return err
+		}
+	}
+	code := a.isCode(index)
+	relocs := a.relocs[index]
+	fields := a.fields[index]
+	var fieldAt []uint64
+	for off := range fields {
+		fieldAt = append(fieldAt, off)
+	}
+	sort.Slice(fieldAt, func(i, j int) bool { return fieldAt[i] < fieldAt[j] })
+
+	for pos := uint64(0); ; {
+		for len(defined) > 0 && defined[0].Value <= pos {
+			sym := defined[0]
+			size := ""
+			if code && sym.Size > 0 {
+				size = a.codeRef(index, sym.Value+sym.Size) + "-" + a.codeRef(index, sym.Value)
+			}
+			writeSymbolAttributes(sb, sym, true, size)
+			defined = defined[1:]
+		}
+		if code {
+			if !a.final {
+				a.bounds[index] = append(a.bounds[index], pos)
+			}
+			if a.labels[index][pos] {
+				fmt.Fprintf(sb, "%s:\n", codeLabel(index, pos))
+			}
+		}
+		if pos >= sec.Size {
+			break
+		}
+		// Up to the next label
+		end := sec.Size
+		if len(defined) > 0 {
+			end = defined[0].Value
+		}
+
+		if sec.Type == delf.SHT_NOBITS {
+			fmt.Fprintf(sb, "\t.zero\t%d\n", end-pos)
+			pos = end
+			continue
+		}
+
+		for len(fieldAt) > 0 && fieldAt[0] < pos {
+			fieldAt = fieldAt[1:]
+		}
+		if len(fieldAt) > 0 && fieldAt[0] == pos {
+			if fl := fields[pos]; pos+fl.size <= end && (len(relocs) == 0 || relocs[0].offset >= pos+fl.size) {
+				sb.WriteString(fl.text)
+				pos += fl.size
+				continue
+			}
+			fieldAt = fieldAt[1:]
+		}
+		if len(fieldAt) > 0 {
+			end = min(end, fieldAt[0])
+		}
+
+		// One instruction, or up to eight bytes of data or of code the
+		// disassembler doesn't know
+		n, comment := min(end-pos, 8), ""
+		if code {
+			if inst, size, err := amd64.DisassembleAt(data[:end], int(pos)); err == nil {
+				n, comment = uint64(size), inst
+			}
+		}
+		var within []asmReloc
+		for len(relocs) > 0 && relocs[0].offset < pos+n {
+			r := relocs[0]
+			r.offset -= pos
+			within = append(within, r)
+			relocs = relocs[1:]
+		}
+		if comment != "" {
+			if inst, ok := a.instruction(comment, data[pos:pos+n], index, within); ok {
+				fmt.Fprintf(sb, "\t%s\n", inst)
+				pos += n
+				continue
+			}
+		}
+		for _, r := range within {
+			fmt.Fprintf(sb, "\t.reloc\t.+%d, %s, %s\n", r.offset, r.typ, a.target(r))
+		}
+		line := "\t.byte\t"
+		for i, b := range data[pos : pos+n] {
+			if i > 0 {
+				line += ", "
+			}
+			line += fmt.Sprintf("%#02x", b)
+		}
+		if comment != "" {
+			line = fmt.Sprintf("%-47s # %s", line, comment)
+		}
+		sb.WriteString(line + "\n")
+		pos += n
+	}
+	return nil
+}
+
+// instruction spells the disassembled instruction inst for as, if
+// Assemble, which picks the encodings as does, gives back exactly code and
+// relocs, offsets into it. A branch's target, an offset into the section,
+// becomes a label; the disassembler only prints branches with 32-bit
+// displacements. A relocation as can write is a call or jump through the
+// PLT or a RIP-relative PC32.
+func (a *asmFile) instruction(inst string, code []byte, section int, relocs []asmReloc) (string, bool) {
+	mnemonic, operand, _ := strings.Cut(inst, " ")
+	if len(relocs) > 0 {
+		r := relocs[0]
+		if len(relocs) > 1 || !r.kept || !isAsmSymbol(r.symbol) {
+			return "", false
+		}
+		// Assemble checks the encoding against a stand-in for the symbol
+		var check, spelled string
+		switch {
+		case r.typ == delf.R_X86_64_PLT32 && (mnemonic == "call" || mnemonic == "jmp") &&
+			r.offset == uint64(len(code)-4) && r.addend == -4:
+			check, spelled = mnemonic+" sym", mnemonic+" "+a.symbolRef(r.symbol)+"@PLT"
+		case r.typ == delf.R_X86_64_PC32 && strings.Contains(inst, "[rip+0x0]"):
+			// The addend counts back from the end of the instruction
+			disp := r.addend + int64(len(code)) - int64(r.offset)
+			check = strings.Replace(inst, "[rip+0x0]", fmt.Sprintf("[rip+sym%+d]", disp), 1)
+			ref := a.target(asmReloc{symbol: r.symbol, section: r.section, addend: disp})
+			spelled = strings.Replace(inst, "[rip+0x0]", "[rip+"+ref+"]", 1)
+		default:
+			return "", false
+		}
+		for _, prefix := range []string{"", "{disp32} "} {
+			got, rs, err := amd64.Assemble(prefix + check)
+			if err == nil && bytes.Equal(got, code) && len(rs) == 1 && rs[0].Offset == r.offset &&
+				uint32(rs[0].Type) == uint32(r.typ) && rs[0].Addend == r.addend {
+				return prefix + spelled, true
+			}
+		}
+		return "", false
+	}
+	if target, err := strconv.ParseUint(operand, 0, 64); err == nil && strings.HasPrefix(operand, "0x") &&
+		(mnemonic == "call" || strings.HasPrefix(mnemonic, "j")) {
+		// Check the opcode against a branch to the next instruction
+		got, relocs, err := amd64.Assemble(mnemonic + " next\nnext:")
+		if err != nil || len(relocs) != 0 || len(got) != len(code) || !bytes.Equal(got[:len(got)-4], code[:len(code)-4]) {
+			return "", false
+		}
+		inst = mnemonic + " " + a.codeRef(section, target)
+		if mnemonic != "call" {
+			inst = "{disp32} " + inst // Not the short form
+		}
+		return inst, true
+	}
+	for _, inst := range []string{inst, "{disp32} " + inst} {
+		if got, relocs, err := amd64.Assemble(inst); err == nil && len(relocs) == 0 && bytes.Equal(got, code) {
+			return inst, true
+		}
+	}
+	return "", false
+}
+
+// unwindFields finds in .eh_frame each FDE's address range and the
+// advances of its CFA instructions, and in .gcc_except_table the
+// call-site ranges of its LSDA, to write as differences of code labels
+func (a *asmFile) unwindFields() error {
+	index := -1
+	for i, sec := range a.f.Sections {
+		if sec.Name == ".eh_frame" && sec.Type == delf.SHT_PROGBITS {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+	data, err := a.f.Sections[index].Data()
+	if err != nil {
+		return err
+	}
+	relocAt := make(map[uint64]asmReloc)
+	for _, r := range a.relocs[index] {
+		relocAt[r.offset] = r
+	}
+
+	cies := make(map[uint64]asmCIE)
+	for p := uint64(0); p+8 <= uint64(len(data)); {
+		length := uint64(binary.LittleEndian.Uint32(data[p:]))
+		if length == 0 || length == 0xffffffff || p+4+length > uint64(len(data)) {
+			break
+		}
+		end := p + 4 + length
+		id := uint64(binary.LittleEndian.Uint32(data[p+4:]))
+		if id == 0 {
+			cies[p] = parseCIE(data[p+8 : end])
+			p = end
+			continue
+		}
+		c := cies[p+4-id]
+		r, found := relocAt[p+8]
+		if !c.ok || c.codeAlign != 1 || !found || r.typ != delf.R_X86_64_PC32 || !a.isCode(r.section) || r.addend < 0 || p+16 > end {
+			p = end
+			continue
+		}
+		section, start := r.section, uint64(r.addend)
+		rangeEnd := start + uint64(binary.LittleEndian.Uint32(data[p+12:]))
+		a.addField(index, p+12, 4, "\t.long\t%s-%s\n", a.codeRef(section, rangeEnd), a.codeRef(section, start))
+
+		q := p + 16
+		if c.aug {
+			n, size := readULEB(data[:end], q)
+			if size == 0 {
+				p = end
+				continue
+			}
+			for off := q + uint64(size); off < q+uint64(size)+n; off++ {
+				if r, ok := relocAt[off]; ok && r.typ == delf.R_X86_64_PC32 && r.section > 0 && r.addend >= 0 {
+					if err := a.lsdaFields(r.section, uint64(r.addend), section, start); err != nil {
+						return err
+					}
+				}
+			}
+			q += uint64(size) + n
+		}
+		a.cfaFields(index, data[:end], q, section, start)
+		p = end
+	}
+	return nil
+}
+
+// asmCIE is what unwindFields needs of a CIE
+type asmCIE struct {
+	codeAlign uint64
+	aug       bool // Augmentation data follows each FDE's range
+	ok        bool // Code pointers are PC-relative and 4 bytes
+}
+
+// parseCIE reads a CIE after its id
+func parseCIE(b []byte) (c asmCIE) {
+	if len(b) < 2 {
+		return c
+	}
+	augmentation, rest, found := strings.Cut(string(b[1:]), "\x00")
+	if !found || !strings.HasPrefix(augmentation, "z") {
+		return c
+	}
+	q := uint64(len(b) - len(rest))
+	var size int
+	if c.codeAlign, size = readULEB(b, q); size == 0 {
+		return c
+	}
+	q += uint64(size)
+	if _, size = readULEB(b, q); size == 0 { // Data alignment, signed
+		return c
+	}
+	q += uint64(size)
+	if _, size = readULEB(b, q); size == 0 { // Return address column
+		return c
+	}
+	q += uint64(size)
+	if _, size = readULEB(b, q); size == 0 { // Augmentation data length
+		return c
+	}
+	q += uint64(size)
+	c.aug = true
+	for _, ch := range augmentation[1:] {
+		if q >= uint64(len(b)) {
+			return c
+		}
+		enc := b[q]
+		q++
+		switch ch {
+		case 'P':
+			switch enc & 0x0f {
+			case 0x03, 0x0b:
+				q += 4
+			case 0x00, 0x04, 0x0c:
+				q += 8
+			default:
+				return c
+			}
+		case 'L':
+		case 'R':
+			c.ok = enc == 0x1b // pcrel sdata4
+		default:
+			return c
+		}
+	}
+	return c
+}
+
+// cfaFields finds the advances among the CFA instructions at q, which
+// move the location on from start
+func (a *asmFile) cfaFields(index int, data []byte, q uint64, section int, loc uint64) {
+	leb := func(q uint64) uint64 {
+		_, size := readULEB(data, q)
+		return uint64(size)
+	}
+	for q < uint64(len(data)) {
+		op := data[q]
+		var delta, n uint64
+		switch {
+		case op&0xc0 == 0x40:
+			delta, n = uint64(op&0x3f), 1
+		case op&0xc0 == 0x80:
+			n = 1 + leb(q+1)
+		case op&0xc0 == 0xc0, op == 0x00, op == 0x0a, op == 0x0b:
+			n = 1
+		case op == 0x02 && q+2 <= uint64(len(data)):
+			delta, n = uint64(data[q+1]), 2
+		case op == 0x03 && q+3 <= uint64(len(data)):
+			delta, n = uint64(binary.LittleEndian.Uint16(data[q+1:])), 3
+		case op == 0x04 && q+5 <= uint64(len(data)):
+			delta, n = uint64(binary.LittleEndian.Uint32(data[q+1:])), 5
+		case op == 0x06, op == 0x07, op == 0x08, op == 0x0d, op == 0x0e, op == 0x13, op == 0x2e:
+			n = 1 + leb(q+1)
+		case op == 0x05, op == 0x09, op == 0x0c, op == 0x11, op == 0x12, op == 0x14, op == 0x15, op == 0x2f:
+			first := leb(q + 1)
+			n = 1 + first + leb(q+1+first)
+		case op == 0x0f:
+			block, size := readULEB(data, q+1)
+			n = 1 + uint64(size) + block
+		case op == 0x10, op == 0x16:
+			reg := leb(q + 1)
+			block, size := readULEB(data, q+1+reg)
+			n = 1 + reg + uint64(size) + block
+		}
+		if n == 0 || op >= 0x05 && op < 0x40 && n == 1 {
+			return // Not an instruction this knows, or cut short
+		}
+		if delta > 0 || op == 0x02 || op == 0x03 || op == 0x04 || op&0xc0 == 0x40 {
+			from, to := a.codeRef(section, loc), a.codeRef(section, loc+delta)
+			switch op {
+			case 0x02:
+				a.addField(index, q, n, "\t.byte\t0x02, %s-%s\n", to, from)
+			case 0x03:
+				a.addField(index, q, n, "\t.byte\t0x03\n\t.short\t%s-%s\n", to, from)
+			case 0x04:
+				a.addField(index, q, n, "\t.byte\t0x04\n\t.long\t%s-%s\n", to, from)
+			default:
+				a.addField(index, q, n, "\t.byte\t0x40+%s-%s\n", to, from)
+			}
+		}
+		loc += delta
+		q += n
+	}
+}
+
+// lsdaFields finds the call-site ranges and landing pads of the LSDA at
+// offset in section, for a function at start in code
+func (a *asmFile) lsdaFields(section int, offset uint64, code int, start uint64) error {
+	if _, ok := a.fields[section][offset]; ok || section >= len(a.f.Sections) {
+		return nil
+	}
+	data, err := a.f.Sections[section].Data()
+	if err != nil {
+		return err
+	}
+	q := offset
+	if q+3 > uint64(len(data)) || data[q] != 0xff { // Landing pads count from start
+		return nil
+	}
+	q++
+	if data[q] != 0xff { // Type table offset
+		q++
+		_, size := readULEB(data, q)
+		if size == 0 {
+			return nil
+		}
+		q += uint64(size)
+	} else {
+		q++
+	}
+	if q >= uint64(len(data)) || data[q] != 0x01 { // Call sites in uleb128
+		return nil
+	}
+	q++
+	length, size := readULEB(data, q)
+	if size == 0 || q+uint64(size)+length > uint64(len(data)) {
+		return nil
+	}
+	q += uint64(size)
+	table := data[:q+length]
+
+	fn := a.codeRef(code, start)
+	for q < uint64(len(table)) {
+		var entry [4]uint64
+		var sizes [4]int
+		for i := range entry {
+			if entry[i], sizes[i] = readULEB(table, q+uint64(sum(sizes[:i]))); sizes[i] == 0 {
+				return nil
+			}
+		}
+		site, end := a.codeRef(code, start+entry[0]), a.codeRef(code, start+entry[0]+entry[1])
+		// as writes each the shortest way; leave any other as bytes
+		if sizes[0] == ulebSize(entry[0]) {
+			a.addField(section, q, uint64(sizes[0]), "\t.uleb128\t%s-%s\n", site, fn)
+		}
+		if sizes[1] == ulebSize(entry[1]) {
+			a.addField(section, q+uint64(sizes[0]), uint64(sizes[1]), "\t.uleb128\t%s-%s\n", end, site)
+		}
+		if entry[2] != 0 && sizes[2] == ulebSize(entry[2]) {
+			pad := a.codeRef(code, start+entry[2])
+			a.addField(section, q+uint64(sum(sizes[:2])), uint64(sizes[2]), "\t.uleb128\t%s-%s\n", pad, fn)
+		}
+		q += uint64(sum(sizes[:]))
+	}
+	return nil
+}
+
+func (a *asmFile) addField(section int, offset, size uint64, format string, args ...any) {
+	if a.fields[section] == nil {
+		a.fields[section] = make(map[uint64]asmField)
+	}
+	a.fields[section][offset] = asmField{size, fmt.Sprintf(format, args...)}
+}
+
+// readULEB decodes a ULEB128 at q, returning its size as 0 if it runs off
+// the end of b
+func readULEB(b []byte, q uint64) (uint64, int) {
+	var v uint64
+	for i := 0; q+uint64(i) < uint64(len(b)) && i < 10; i++ {
+		c := b[q+uint64(i)]
+		v |= uint64(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// ulebSize is the length of the shortest ULEB128 for v
+func ulebSize(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+func sum(sizes []int) int {
+	n := 0
+	for _, s := range sizes {
+		n += s
+	}
+	return n
+}
+
+// isAsmSymbol reports whether as and Assemble both take name as a bare
+// symbol
+func isAsmSymbol(name string) bool {
+	if name == "" || name[0] >= '0' && name[0] <= '9' {
+		return false
+	}
+	for _, r := range name {
+		if r != '_' && r != '.' && r != '$' && !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// isAsmReserved reports whether as, in Intel syntax, reads name in an
+// operand or expression as a register or an operator, quoted or not
+func isAsmReserved(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "rax", "rbx", "rcx", "rdx", "rsi", "rdi", "rbp", "rsp",
+		"eax", "ebx", "ecx", "edx", "esi", "edi", "ebp", "esp",
+		"ax", "bx", "cx", "dx", "si", "di", "bp", "sp",
+		"al", "bl", "cl", "dl", "ah", "bh", "ch", "dh", "sil", "dil", "bpl", "spl",
+		"rip", "eip", "cs", "ds", "es", "fs", "gs", "ss", "st",
+		"and", "or", "xor", "not", "mod", "shl", "shr", "eq", "ne", "lt", "le", "gt", "ge",
+		"offset", "short", "flat", "near", "far",
+		"byte", "word", "dword", "fword", "qword", "tbyte", "oword", "xmmword", "ymmword", "zmmword":
+		return true
+	}
+	for _, file := range []struct {
+		prefix   string
+		first, n int
+		suffixes string
+	}{
+		{"r", 8, 8, "dwb"}, {"mm", 0, 8, ""}, {"xmm", 0, 32, ""}, {"ymm", 0, 32, ""}, {"zmm", 0, 32, ""},
+		{"k", 0, 8, ""}, {"cr", 0, 16, ""}, {"dr", 0, 16, ""}, {"bnd", 0, 4, ""}, {"tmm", 0, 8, ""},
+	} {
+		rest, ok := strings.CutPrefix(name, file.prefix)
+		if !ok {
+			continue
+		}
+		if last := len(rest) - 1; last > 0 && strings.IndexByte(file.suffixes, rest[last]) >= 0 {
+			rest = rest[:last]
+		}
+		if n, err := strconv.Atoi(rest); err == nil && strconv.Itoa(n) == rest && n >= file.first && n < file.first+file.n {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSymbolAttributes declares a symbol's binding, visibility, type and
+// size, as an expression if size isn't empty, and for a defined one
+// places its label
+func writeSymbolAttributes(sb *strings.Builder, sym delf.Symbol, defined bool, size string) {
+	switch delf.ST_BIND(sym.Info) {
+	case delf.STB_GLOBAL:
+		if defined {
+			fmt.Fprintf(sb, "\t.globl\t%s\n", sym.Name)
+		}
+	case delf.STB_WEAK:
+		fmt.Fprintf(sb, "\t.weak\t%s\n", sym.Name)
+	}
+	switch delf.ST_VISIBILITY(sym.Other) {
+	case delf.STV_HIDDEN:
+		fmt.Fprintf(sb, "\t.hidden\t%s\n", sym.Name)
+	case delf.STV_PROTECTED:
+		fmt.Fprintf(sb, "\t.protected\t%s\n", sym.Name)
+	case delf.STV_INTERNAL:
+		fmt.Fprintf(sb, "\t.internal\t%s\n", sym.Name)
+	}
+	switch delf.ST_TYPE(sym.Info) {
+	case delf.STT_FUNC:
+		fmt.Fprintf(sb, "\t.type\t%s, @function\n", sym.Name)
+	case delf.STT_OBJECT:
+		fmt.Fprintf(sb, "\t.type\t%s, @object\n", sym.Name)
+	case delf.STT_TLS:
+		fmt.Fprintf(sb, "\t.type\t%s, @tls_object\n", sym.Name)
+	}
+	if defined {
+		if size != "" {
+			fmt.Fprintf(sb, "\t.size\t%s, %s\n", sym.Name, size)
+		} else if sym.Size > 0 {
+			fmt.Fprintf(sb, "\t.size\t%s, %d\n", sym.Name, sym.Size)
+		}
+		fmt.Fprintf(sb, "%s:\n", sym.Name)
+	}
+}
@@ -2,7 +2,14 @@ package codegen
 
 import (
 	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/binary"
 	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
 
 	"github.com/arc-language/core-builder/ir"
 	"github.com/arc-language/core-codegen/arch/amd64"
@@ -11,44 +18,217 @@ import (
 
 // GenerateObject compiles an IR module to an ELF object file for AMD64
 func GenerateObject(m *ir.Module) ([]byte, error) {
-	// 1. Compile IR to machine code
-	artifact, err := amd64.Compile(m)
+	return GenerateObjectWithOptions(m, DefaultOptions())
+}
+
+// GenerateObjectWithOptions compiles an IR module to an ELF object file for
+// AMD64 using the given options
+func GenerateObjectWithOptions(m *ir.Module, opts CompileOptions) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := WriteObject(buf, m, opts); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteObject compiles an IR module and streams the ELF object to w, for
+// piping into a linker or writing a large module straight to disk. Nothing
+// is written if compilation fails.
+func WriteObject(w io.Writer, m *ir.Module, opts CompileOptions) error {
+	f, _, err := buildObject(m, opts)
+	if err != nil {
+		return err
+	}
+	if err := f.WriteTo(w); err != nil {
+		return fmt.Errorf("ELF generation failed: %w", err)
+	}
+	return nil
+}
+
+// GenerateFunctionObject compiles one function to an ELF object of its
+// own, for recompiling a program a function at a time. Calls to the
+// functions named in local are direct, as between functions of one module,
+// so they must be linked statically; other callees go through the PLT.
+// Globals, wherever they are defined, are referred to by name.
+func GenerateFunctionObject(fn *ir.Function, local []string, opts CompileOptions) ([]byte, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	ctx := &amd64.CompileContext{Options: opts.backend(), LocalFunctions: make(map[string]bool)}
+	for _, name := range local {
+		ctx.LocalFunctions[name] = true
+	}
+	artifact, err := amd64.CompileFunction(fn, ctx)
 	if err != nil {
 		return nil, fmt.Errorf("compilation failed: %w", err)
 	}
 
-	// 2. Create ELF object file
-	f := elf.NewFile()
+	noDecls := func(string) *ir.Function { return nil }
+	f, err := objectFile(artifact, "", noDecls, opts)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := f.WriteTo(buf); err != nil {
+		return nil, fmt.Errorf("ELF generation failed: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// buildObject compiles m and lays out the sections and symbols of its
+// object file, returning it with the compiled artifact
+func buildObject(m *ir.Module, opts CompileOptions) (*elf.File, *amd64.Artifact, error) {
+	if err := opts.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	// 1. Compile IR to machine code
+	artifact, err := amd64.CompileWithOptions(m, opts.backend())
+	if err != nil {
+		return nil, nil, fmt.Errorf("compilation failed: %w", err)
+	}
 
 	// Set target triple info if available
 	if m.TargetTriple != "" {
 		// Could parse and validate target triple
 	}
 
-	// 3. Add .text section (executable code)
-	textSec := f.AddSection(".text", elf.SHT_PROGBITS, elf.SHF_ALLOC|elf.SHF_EXECINSTR, artifact.TextBuffer)
-	textSec.Addralign = 16
+	f, err := objectFile(artifact, m.Name, m.GetFunction, opts)
+	return f, artifact, err
+}
+
+// objectFile lays out the sections and symbols of an object holding the
+// compiled artifact. fileName names the STT_FILE symbol, and lookup finds
+// the declaration behind an undefined reference.
+func objectFile(artifact *amd64.Artifact, fileName string, lookup func(string) *ir.Function, opts CompileOptions) (*elf.File, error) {
+	// 2. Create ELF object file
+	f := elf.NewFile()
+
+	// 3. Add .text section (executable code). A module of declarations
+	// only has no code and gets no .text.
+	var textSec *elf.Section
+	if len(artifact.TextBuffer) > 0 {
+		textSec = f.AddSection(".text", elf.SHT_PROGBITS, elf.SHF_ALLOC|elf.SHF_EXECINSTR, artifact.TextBuffer)
+		textSec.Addralign = 16
+		if opts.TextAlign != 0 {
+			textSec.Addralign = opts.TextAlign
+		}
+		textSec.Addralign = max(textSec.Addralign, opts.FunctionAlign)
+	}
+
+	// Blocks outlined as cold, kept apart so the hot path packs densely
+	var coldSec *elf.Section
+	if len(artifact.ColdBuffer) > 0 {
+		coldSec = f.AddSection(".text.unlikely", elf.SHT_PROGBITS, elf.SHF_ALLOC|elf.SHF_EXECINSTR, artifact.ColdBuffer)
+		coldSec.Addralign = 1
+	}
+
+	// Functions placed in sections of their own, for a linker script to
+	// put at the addresses it chooses
+	namedSecs := make(map[string]*elf.Section)
+	for _, ts := range artifact.TextSections {
+		sec := f.AddSection(ts.Name, elf.SHT_PROGBITS, elf.SHF_ALLOC|elf.SHF_EXECINSTR, ts.Data)
+		sec.Addralign = max(16, opts.FunctionAlign)
+		namedSecs[ts.Name] = sec
+	}
 
 	// 4. Add .data section (initialized global data)
 	var dataSec *elf.Section
 	if len(artifact.DataBuffer) > 0 {
 		dataSec = f.AddSection(".data", elf.SHT_PROGBITS, elf.SHF_WRITE|elf.SHF_ALLOC, artifact.DataBuffer)
 		dataSec.Addralign = 8
+		if opts.DataAlign != 0 {
+			dataSec.Addralign = opts.DataAlign
+		}
+		if artifact.DataAlign > dataSec.Addralign {
+			dataSec.Addralign = artifact.DataAlign
+		}
+	}
+
+	// Constant data holding addresses, which the dynamic loader relocates
+	// before the linker's RELRO segment makes it read-only
+	var relroSec *elf.Section
+	if len(artifact.RelroBuffer) > 0 {
+		relroSec = f.AddSection(".data.rel.ro", elf.SHT_PROGBITS, elf.SHF_WRITE|elf.SHF_ALLOC, artifact.RelroBuffer)
+		relroSec.Addralign = max(8, artifact.DataAlign)
+	}
+
+	// Thread-local data: .tdata holds the initialization image, .tbss the
+	// zero-filled tail of each thread's block
+	var tdataSec, tbssSec *elf.Section
+	if len(artifact.TDataBuffer) > 0 {
+		tdataSec = f.AddSection(".tdata", elf.SHT_PROGBITS, elf.SHF_WRITE|elf.SHF_ALLOC|elf.SHF_TLS, artifact.TDataBuffer)
+		tdataSec.Addralign = max(8, artifact.TLSAlign)
+	}
+	if artifact.TBSSSize > 0 {
+		tbssSec = f.AddNobitsSection(".tbss", elf.SHF_WRITE|elf.SHF_ALLOC|elf.SHF_TLS, artifact.TBSSSize)
+		tbssSec.Addralign = max(8, artifact.TLSAlign)
 	}
 
 	// 5. Add .bss section for uninitialized data (if needed)
 	// For now we initialize everything, but could optimize later
 
-	// 6. Add .rodata section for read-only data (if needed)
-	// Could separate string literals and constants here
+	// 6. Add .rodata section for read-only constants referenced by code
+	var rodataSec *elf.Section
+	if len(artifact.RodataBuffer) > 0 {
+		rodataSec = f.AddSection(".rodata", elf.SHT_PROGBITS, elf.SHF_ALLOC, artifact.RodataBuffer)
+		rodataSec.Addralign = 16
+	}
+
+	// String literals go in a mergeable section: identical ones share
+	// storage here, and the linker merges them across objects too
+	var strSec *elf.Section
+	var strOffsets []uint32
+	if len(artifact.Strings) > 0 {
+		var strData []byte
+		strData, strOffsets = mergeStrings(artifact.Strings)
+		strSec = f.AddSection(".rodata.str1.1", elf.SHT_PROGBITS, elf.SHF_ALLOC|elf.SHF_MERGE|elf.SHF_STRINGS, strData)
+		strSec.Entsize = 1
+		strSec.Addralign = 1
+	}
+
+	// Unwind tables, and the LSDAs they point the personality routine at.
+	// The LSB gives .eh_frame its own section type; as still marks it
+	// progbits when told to, as GCC's assembly output does.
+	var ehFrameSec, exceptSec *elf.Section
+	if len(artifact.ExceptTableBuffer) > 0 {
+		exceptSec = f.AddSection(".gcc_except_table", elf.SHT_PROGBITS, elf.SHF_ALLOC, artifact.ExceptTableBuffer)
+		exceptSec.Addralign = 4
+	}
+	if len(artifact.EhFrameBuffer) > 0 {
+		ehFrameSec = f.AddSection(".eh_frame", elf.SHT_PROGBITS, elf.SHF_ALLOC, artifact.EhFrameBuffer)
+		ehFrameSec.Addralign = 8
+	}
 
 	// 7. Add .note.GNU-stack section (prevents executable stack warning)
 	stackSec := f.AddSection(".note.GNU-stack", elf.SHT_PROGBITS, 0, []byte{})
 	stackSec.Addralign = 1
 
+	// Add .comment section identifying the producer
+	if opts.Producer != "" {
+		f.AddStringSection(".comment", 0, []string{opts.Producer})
+	}
+
+	if id := buildID(opts.BuildID, artifact); id != nil {
+		f.AddNoteSection(".note.gnu.build-id", "GNU", elf.NT_GNU_BUILD_ID, id)
+	}
+
+	if opts.CET {
+		// One property: type, data size, the feature bits, and padding
+		// to the 8-byte alignment ELF64 property notes have
+		prop := make([]byte, 16)
+		binary.LittleEndian.PutUint32(prop, elf.GNU_PROPERTY_X86_FEATURE_1_AND)
+		binary.LittleEndian.PutUint32(prop[4:], 4)
+		binary.LittleEndian.PutUint32(prop[8:], elf.GNU_PROPERTY_X86_FEATURE_1_IBT)
+		f.AddNoteSection(".note.gnu.property", "GNU", elf.NT_GNU_PROPERTY_TYPE_0, prop).Addralign = 8
+	}
+
 	// 8. Build symbol table
-	// Add file symbol
-	f.AddSymbol(m.Name, elf.MakeSymbolInfo(elf.STB_LOCAL, elf.STT_FILE), nil, 0, 0)
+	// Add file symbol (absolute, like the one assemblers emit)
+	if fileName != "" {
+		fileSym := f.AddSymbol(fileName, elf.MakeSymbolInfo(elf.STB_LOCAL, elf.STT_FILE), nil, 0, 0)
+		fileSym.Shndx = elf.SHN_ABS
+	}
 
 	// Track symbol objects for relocations
 	symbolMap := make(map[string]*elf.Symbol)
@@ -58,24 +238,78 @@ func GenerateObject(m *ir.Module) ([]byte, error) {
 		sym := f.AddSymbol("", elf.MakeSymbolInfo(elf.STB_LOCAL, elf.STT_SECTION), textSec, 0, 0)
 		symbolMap[".text"] = sym
 	}
+	if coldSec != nil {
+		sym := f.AddSymbol("", elf.MakeSymbolInfo(elf.STB_LOCAL, elf.STT_SECTION), coldSec, 0, 0)
+		symbolMap[".text.unlikely"] = sym
+	}
+	for _, ts := range artifact.TextSections {
+		sym := f.AddSymbol("", elf.MakeSymbolInfo(elf.STB_LOCAL, elf.STT_SECTION), namedSecs[ts.Name], 0, 0)
+		symbolMap[ts.Name] = sym
+	}
 	if dataSec != nil {
 		sym := f.AddSymbol("", elf.MakeSymbolInfo(elf.STB_LOCAL, elf.STT_SECTION), dataSec, 0, 0)
 		symbolMap[".data"] = sym
 	}
+	if rodataSec != nil {
+		sym := f.AddSymbol("", elf.MakeSymbolInfo(elf.STB_LOCAL, elf.STT_SECTION), rodataSec, 0, 0)
+		symbolMap[".rodata"] = sym
+	}
+	if exceptSec != nil {
+		sym := f.AddSymbol("", elf.MakeSymbolInfo(elf.STB_LOCAL, elf.STT_SECTION), exceptSec, 0, 0)
+		symbolMap[".gcc_except_table"] = sym
+	}
 
-	// Add symbols from compilation
+	// Add symbols from compilation. Declared globals become undefined
+	// symbols once something refers to them.
+	externs := make(map[string]amd64.SymbolDef)
 	for _, sym := range artifact.Symbols {
+		if sym.IsExtern {
+			externs[sym.Name] = sym
+			continue
+		}
+		if sym.IsCommon {
+			// STT_OBJECT rather than STT_COMMON, as GNU as emits it;
+			// the section index is what makes it common
+			elfSym := f.AddSymbol(sym.Name, elf.MakeSymbolInfo(elf.STB_GLOBAL, elf.STT_OBJECT), nil, sym.Offset, sym.Size)
+			elfSym.Shndx = elf.SHN_COMMON
+			elfSym.Other = symbolVisibility(sym.Visibility)
+			symbolMap[sym.Name] = elfSym
+			continue
+		}
+
 		var section *elf.Section
 		var symType byte
 		var binding byte
 
-		if sym.IsFunc {
+		if sym.IsFunc && sym.Section == ".text.unlikely" {
+			// The outlined part of a function is private to it
+			section = coldSec
+			symType = elf.STT_FUNC
+			binding = elf.STB_LOCAL
+		} else if sym.IsFunc {
 			section = textSec
+			if sym.Section != "" {
+				section = namedSecs[sym.Section]
+			}
 			symType = elf.STT_FUNC
-			// Functions are global by default (unless marked as internal/private in IR)
+			// Calls to an internal or private function are PC32, which
+			// only a local symbol may take in a shared object
+			binding = elf.STB_GLOBAL
+			if sym.Local {
+				binding = elf.STB_LOCAL
+			}
+		} else if sym.IsTLS {
+			section = tdataSec
+			if sym.Section == ".tbss" {
+				section = tbssSec
+			}
+			symType = elf.STT_TLS
 			binding = elf.STB_GLOBAL
 		} else if sym.IsGlobal {
 			section = dataSec
+			if sym.Section == ".data.rel.ro" {
+				section = relroSec
+			}
 			symType = elf.STT_OBJECT
 			binding = elf.STB_GLOBAL
 		} else {
@@ -87,20 +321,90 @@ func GenerateObject(m *ir.Module) ([]byte, error) {
 
 		info := elf.MakeSymbolInfo(binding, symType)
 		elfSym := f.AddSymbol(sym.Name, info, section, sym.Offset, sym.Size)
+		elfSym.Other = symbolVisibility(sym.Visibility)
 		symbolMap[sym.Name] = elfSym
 	}
 
-	// 9. Add relocations
+	for i, s := range artifact.Strings {
+		binding := byte(elf.STB_GLOBAL)
+		if s.Local {
+			binding = elf.STB_LOCAL
+		}
+		info := elf.MakeSymbolInfo(binding, elf.STT_OBJECT)
+		sym := f.AddSymbol(s.Name, info, strSec, uint64(strOffsets[i]), uint64(len(s.Value)+1))
+		sym.Other = symbolVisibility(s.Visibility)
+		symbolMap[s.Name] = sym
+	}
+
+	// Aliases share everything with their target but the name and binding
+	for _, a := range opts.Aliases {
+		target, ok := symbolMap[a.Target]
+		if !ok || target.Name == "" {
+			return nil, fmt.Errorf("alias %s: %s is not defined in this object", a.Name, a.Target)
+		}
+		if _, dup := symbolMap[a.Name]; dup {
+			return nil, fmt.Errorf("alias %s: the name is already defined", a.Name)
+		}
+		binding := byte(elf.STB_GLOBAL)
+		if a.Weak {
+			binding = elf.STB_WEAK
+		}
+		sym := f.AddSymbol(a.Name, elf.MakeSymbolInfo(binding, target.Info&0xf), target.Section, target.Value, target.Size)
+		sym.Other = target.Other
+		symbolMap[a.Name] = sym
+	}
+
+	if opts.BlockSymbols {
+		info := elf.MakeSymbolInfo(elf.STB_LOCAL, elf.STT_NOTYPE)
+		for _, fr := range artifact.Ranges {
+			for i, br := range fr.Blocks {
+				name := br.Block.Name()
+				if name == "" {
+					name = fmt.Sprint(i)
+				}
+				section := textSec
+				if br.Cold {
+					section = coldSec
+				} else if fr.Section != "" {
+					section = namedSecs[fr.Section]
+				}
+				f.AddSymbol(fr.Func.Name()+"."+name, info, section, uint64(br.Start), 0)
+			}
+		}
+	}
+
+	// 9. Add relocations, one .rela section per section they patch
 	if len(artifact.Relocations) > 0 {
-		relaBuf := new(bytes.Buffer)
+		relaBufs := make(map[string]*bytes.Buffer)
+		var patched []string
 
 		for _, rel := range artifact.Relocations {
 			// Find the symbol
 			sym, ok := symbolMap[rel.SymbolName]
 			if !ok {
 				// External symbol - add as undefined
-				info := elf.MakeSymbolInfo(elf.STB_GLOBAL, elf.STT_NOTYPE)
+				symType := byte(elf.STT_NOTYPE)
+				extern, declared := externs[rel.SymbolName]
+				isObject := declared && !extern.IsFunc
+				if isObject {
+					symType = elf.STT_OBJECT
+				}
+				if rel.Type == amd64.R_X86_64_TLSGD || rel.Type == amd64.R_X86_64_TPOFF32 {
+					symType = elf.STT_TLS
+				}
+				binding := byte(elf.STB_GLOBAL)
+				if extern.IsWeak {
+					// The link succeeds without a definition, which is 0
+					binding = elf.STB_WEAK
+				}
+				info := elf.MakeSymbolInfo(binding, symType)
 				sym = f.AddSymbol(rel.SymbolName, info, nil, 0, 0)
+				if decl := lookup(rel.SymbolName); decl != nil {
+					// A hidden reference must resolve within the component
+					sym.Other = symbolVisibility(decl.Visibility)
+				} else if isObject {
+					sym.Other = symbolVisibility(extern.Visibility)
+				}
 				symbolMap[rel.SymbolName] = sym
 			}
 
@@ -108,48 +412,148 @@ func GenerateObject(m *ir.Module) ([]byte, error) {
 			// We need to account for the null symbol at index 0
 			symIdx := findSymbolIndex(f.Symbols, sym)
 
+			section := rel.Section
+			if section == "" {
+				section = ".text"
+			}
+			relaBuf, ok := relaBufs[section]
+			if !ok {
+				relaBuf = new(bytes.Buffer)
+				relaBufs[section] = relaBuf
+				patched = append(patched, section)
+			}
+
 			// Write Elf64_Rela entry
 			writeRela(relaBuf, rel.Offset, uint32(symIdx), uint32(rel.Type), rel.Addend)
 		}
 
-		// Add .rela.text section
-		relaSec := f.AddSection(".rela.text", elf.SHT_RELA, elf.SHF_INFO_LINK, relaBuf.Bytes())
-		relaSec.Link = 0      // Will be set to .symtab index after it's created
-		relaSec.Info = uint32(textSec.Index)  // Applies to .text section
-		relaSec.Entsize = 24  // sizeof(Elf64_Rela)
-		relaSec.Addralign = 8
-		
-		// Store rela section for later link update
-		f.RelaSections = append(f.RelaSections, relaSec)
+		targets := map[string]*elf.Section{
+			".text": textSec, ".text.unlikely": coldSec, ".rodata": rodataSec,
+			".data": dataSec, ".data.rel.ro": relroSec, ".tdata": tdataSec,
+			".eh_frame": ehFrameSec, ".gcc_except_table": exceptSec,
+		}
+		for name, sec := range namedSecs {
+			targets[name] = sec
+		}
+		for _, section := range patched {
+			relaSec := f.AddSection(".rela"+section, elf.SHT_RELA, elf.SHF_INFO_LINK, relaBufs[section].Bytes())
+			relaSec.Link = 0 // Will be set to .symtab index after it's created
+			relaSec.Info = uint32(targets[section].Index)
+			relaSec.Entsize = 24 // sizeof(Elf64_Rela)
+			relaSec.Addralign = 8
+
+			// Store rela section for later link update
+			f.RelaSections = append(f.RelaSections, relaSec)
+		}
 	}
 
-	// 10. Write to buffer
-	buf := new(bytes.Buffer)
-	if err := f.WriteTo(buf); err != nil {
-		return nil, fmt.Errorf("ELF generation failed: %w", err)
+	if opts.CompressDebug {
+		for _, sec := range f.Sections {
+			if strings.HasPrefix(sec.Name, ".debug_") {
+				sec.Compress = true
+			}
+		}
 	}
 
-	return buf.Bytes(), nil
+	return f, nil
+}
+
+// mergeStrings lays out NUL-terminated string literals with identical ones
+// sharing storage, and returns the data and each string's offset in it.
+// Longest first, so shorter strings can land on the tail of a longer one.
+func mergeStrings(strs []amd64.StringConstant) ([]byte, []uint32) {
+	byLength := make([]string, len(strs))
+	for i, s := range strs {
+		byLength[i] = s.Value
+	}
+	sort.SliceStable(byLength, func(i, j int) bool { return len(byLength[i]) > len(byLength[j]) })
+
+	st := elf.NewMergeStringTable()
+	for _, s := range byLength {
+		st.Add(s)
+	}
+	offsets := make([]uint32, len(strs))
+	for i, s := range strs {
+		offsets[i] = st.Add(s.Value)
+	}
+	return st.Data, offsets
 }
 
-// GenerateExecutable compiles an IR module to an executable ELF binary
-// This is more complex as it requires linking and setting up program headers
-func GenerateExecutable(m *ir.Module, entryPoint string) ([]byte, error) {
-	// For a simple executable:
-	// 1. Generate object file
-	// 2. Add program headers for loadable segments
-	// 3. Set entry point
-	// 4. Potentially link with libc/runtime
-	
-	// This is a more advanced feature - for now return error
-	return nil, fmt.Errorf("executable generation not yet implemented - use object files with external linker")
+// buildID hashes everything the object is made from with the given style,
+// or returns nil when no build ID is wanted: the contents of each section,
+// the C strings, and the relocations, without which code differing only
+// in what it calls would share an ID. Every part goes in after its length,
+// so no bytes can move from one part to the next unnoticed.
+func buildID(style string, artifact *amd64.Artifact) []byte {
+	var h hash.Hash
+	switch style {
+	case "sha1":
+		h = sha1.New()
+	case "md5":
+		h = md5.New()
+	default:
+		return nil
+	}
+	part := func(b []byte) {
+		binary.Write(h, binary.LittleEndian, uint64(len(b)))
+		h.Write(b)
+	}
+	part(artifact.TextBuffer)
+	part(artifact.ColdBuffer)
+	for _, ts := range artifact.TextSections {
+		part([]byte(ts.Name))
+		part(ts.Data)
+	}
+	part(artifact.DataBuffer)
+	part(artifact.RelroBuffer)
+	part(artifact.RodataBuffer)
+	part(artifact.TDataBuffer)
+	part(artifact.EhFrameBuffer)
+	part(artifact.ExceptTableBuffer)
+	binary.Write(h, binary.LittleEndian, artifact.TBSSSize)
+	for _, str := range artifact.Strings {
+		part([]byte(str.Name))
+		part([]byte(str.Value))
+	}
+	for _, rel := range artifact.Relocations {
+		part([]byte(rel.Section))
+		part([]byte(rel.SymbolName))
+		binary.Write(h, binary.LittleEndian, []uint64{rel.Offset, uint64(rel.Type), uint64(rel.Addend)})
+	}
+	return h.Sum(nil)
 }
 
-// Helper to find symbol index
+// symbolVisibility maps IR visibility to an ELF st_other value
+func symbolVisibility(v ir.Visibility) byte {
+	switch v {
+	case ir.HiddenVisibility:
+		return elf.STV_HIDDEN
+	case ir.ProtectedVisibility:
+		return elf.STV_PROTECTED
+	}
+	return elf.STV_DEFAULT
+}
+
+// findSymbolIndex returns target's index in the symbol table the writer
+// builds: the null symbol, then the local symbols, then the rest, each in
+// the order they were added. Every local symbol must already be added.
 func findSymbolIndex(symbols []*elf.Symbol, target *elf.Symbol) int {
-	for i, sym := range symbols {
+	isLocal := func(sym *elf.Symbol) bool { return sym.Info>>4 == elf.STB_LOCAL }
+	locals, before := 0, 0
+	for _, sym := range symbols {
+		if isLocal(sym) {
+			locals++
+		}
+	}
+	for _, sym := range symbols {
 		if sym == target {
-			return i + 1 // +1 because null symbol is at index 0
+			if isLocal(target) {
+				return before + 1 // +1 because null symbol is at index 0
+			}
+			return locals + before + 1
+		}
+		if isLocal(sym) == isLocal(target) {
+			before++
 		}
 	}
 	return 0
@@ -193,12 +597,8 @@ func GenerateAssembly(m *ir.Module) (string, error) {
 	return m.String(), nil
 }
 
-// Optimize performs architecture-specific optimizations
+// Optimize runs the built-in IR passes for an optimization level over m;
+// see DefaultPipeline
 func Optimize(m *ir.Module, level int) error {
-	// Future: implement peephole optimizations, instruction selection improvements
-	// Level 0: no optimization
-	// Level 1: basic optimizations
-	// Level 2: aggressive optimizations
-	// Level 3: maximum optimizations (may increase compile time)
-	return nil
+	return DefaultPipeline(level).Run(m)
 }
\ No newline at end of file
@@ -0,0 +1,70 @@
+package codegen
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"github.com/arc-language/core-builder/builder"
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+)
+
+// BuildCString returns a read-only global in m holding s and a NUL
+// terminator, creating it with b, which must be building m, on first use.
+// The global is named after a hash of s, so equal strings share one global
+// however often they are asked for, and is private, so objects built from
+// other modules don't clash with it. Such globals land in the mergeable
+// string section.
+func BuildCString(b *builder.Builder, m *ir.Module, s string) *ir.Global {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	base := fmt.Sprintf(".str.%08x", h.Sum32())
+
+	name := base
+	for n := 1; ; n++ {
+		g := findGlobal(m, name)
+		if g == nil {
+			break
+		}
+		if holdsCString(g, s) {
+			return g
+		}
+		name = fmt.Sprintf("%s.%d", base, n) // A hash collision
+	}
+
+	arr := types.NewArray(types.I8, int64(len(s)+1))
+	elems := make([]ir.Constant, 0, len(s)+1)
+	for _, c := range []byte(s + "\x00") {
+		elems = append(elems, b.ConstInt(types.I8, int64(c)))
+	}
+	g := b.CreateGlobalConstant(name, b.ConstArray(arr, elems))
+	g.Linkage = ir.PrivateLinkage
+	return g
+}
+
+func findGlobal(m *ir.Module, name string) *ir.Global {
+	for _, g := range m.Globals {
+		if g.Name() == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// holdsCString reports whether g is a constant initialized to s and a NUL
+func holdsCString(g *ir.Global, s string) bool {
+	arr, ok := g.Initializer.(*ir.ConstantArray)
+	if !ok || !g.IsConstant || len(arr.Elements) != len(s)+1 {
+		return false
+	}
+	for i, e := range arr.Elements {
+		ci, ok := e.(*ir.ConstantInt)
+		if !ok {
+			return false
+		}
+		if i < len(s) && byte(ci.Value) != s[i] || i == len(s) && ci.Value != 0 {
+			return false
+		}
+	}
+	return true
+}
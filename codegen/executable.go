@@ -0,0 +1,591 @@
+package codegen
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-codegen/arch/amd64"
+	"github.com/arc-language/core-codegen/format/elf"
+)
+
+// execBase is where an executable's first segment is mapped, the address
+// GNU ld uses for non-PIE x86-64 executables
+const execBase = 0x400000
+
+// GenerateExecutable compiles an IR module to a statically linked x86-64
+// Linux executable, resolving every relocation itself: the module must
+// define all it refers to, since no libraries are linked. With no C
+// runtime to call exit, a _start is added that calls entryPoint (main if
+// empty) and passes its return value to the exit_group syscall, so it
+// becomes the process's exit status. An entryPoint of _start instead runs
+// the module's own _start, which must not return.
+//
+// Code, read-only data and string literals share a read-execute segment
+// right after the headers, in the same page; .data and .data.rel.ro follow
+// in a read-write segment starting on the next page. Zero bytes ending the
+// read-write segment are left out of the file and zero-filled by the
+// loader, as .bss would be, and globals with common linkage are placed
+// among them. Thread-local globals are rejected: nothing sets up the
+// thread pointer without a C runtime.
+func GenerateExecutable(m *ir.Module, entryPoint string) ([]byte, error) {
+	backend := DefaultOptions().backend()
+	if entryPoint != "_start" {
+		backend.EmitStart = true
+		backend.StartEntry = entryPoint
+	}
+	return linkExecutable(m, backend, nil)
+}
+
+// dynamicLinker is the program interpreter of x86-64 Linux executables
+// linked with glibc
+const dynamicLinker = "/lib64/ld-linux-x86-64.so.2"
+
+// GenerateDynamicExecutable compiles an IR module to an x86-64 Linux
+// executable linked at run time with libc.so.6 and the other shared
+// libraries named, which the dynamic linker loads before the program
+// starts. Whatever the module refers to and doesn't define must come from
+// one of them. The added _start passes main to libc's __libc_start_main,
+// which initializes the library, calls main and exits with its result.
+//
+// Calls to a library go through the PLT: lazily, binding each function on
+// its first call, or with opts.BindNow through GOT entries filled in when
+// the program loads. Globals a library defines must be addressed through
+// the GOT, as is code compiled without NoPIC; a copy relocation for an
+// absolute reference isn't supported. The layout is GenerateExecutable's,
+// with the dynamic linking tables ahead of the code and the GOT ahead of
+// the data.
+func GenerateDynamicExecutable(m *ir.Module, libraries []string, opts CompileOptions) ([]byte, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	backend := opts.backend()
+	backend.EmitStart = true
+	backend.StartLibc = true
+	needed := []string{"libc.so.6"}
+	for _, lib := range libraries {
+		if lib != "libc.so.6" {
+			needed = append(needed, lib)
+		}
+	}
+	return linkExecutable(m, backend, &dynamicLink{needed: needed, bindNow: opts.BindNow})
+}
+
+// dynamicLink is what a dynamically linked executable adds
+type dynamicLink struct {
+	needed  []string // Shared libraries, for DT_NEEDED
+	bindNow bool
+}
+
+// dynamicImport is a symbol a dynamically linked executable takes from a
+// shared library, and the PLT and GOT entries it needs
+type dynamicImport struct {
+	name  string
+	weak  bool
+	index int // In .dynsym
+	plt   int // Index of its PLT entry, or -1
+	got   int // Index of its .got entry, or -1
+}
+
+// linkExecutable compiles m with backend and lays it out as an executable,
+// statically linked when dyn is nil
+func linkExecutable(m *ir.Module, backend amd64.Options, dyn *dynamicLink) ([]byte, error) {
+	artifact, err := amd64.CompileWithOptions(m, backend)
+	if err != nil {
+		return nil, fmt.Errorf("compilation failed: %w", err)
+	}
+	if len(artifact.TDataBuffer) > 0 || artifact.TBSSSize > 0 {
+		return nil, fmt.Errorf("thread-local globals need a C runtime; link an object file instead")
+	}
+	if len(artifact.EhFrameBuffer) > 0 {
+		return nil, fmt.Errorf("invoke and resume need an unwinder from the C runtime; link an object file instead")
+	}
+
+	// With one module there is nothing to merge COMMON symbols with: they
+	// are zeroed space after the data, as the linker's .bss
+	var bss []byte
+	bssAlign := uint64(1)
+	commons := make(map[string]uint64)
+	for _, sym := range artifact.Symbols {
+		if sym.IsCommon {
+			off := alignUp(uint64(len(bss)), sym.Offset)
+			commons[sym.Name] = off
+			bss = append(bss, make([]byte, off+sym.Size-uint64(len(bss)))...)
+			bssAlign = max(bssAlign, sym.Offset)
+		}
+	}
+
+	// Linked dynamically, what the module doesn't define is imported, and
+	// each kind of reference to an import needs its own entry
+	var imports []*dynamicImport
+	importOf := make(map[string]*dynamicImport)
+	var absRelocs []amd64.Relocation // R_X86_64_64 against imports, applied at load
+	nPLT, nGOT := 0, 0
+	if dyn != nil {
+		defined := make(map[string]bool)
+		weak := make(map[string]bool)
+		for _, sym := range artifact.Symbols {
+			if sym.IsExtern {
+				weak[sym.Name] = weak[sym.Name] || sym.IsWeak
+			} else {
+				defined[sym.Name] = true
+			}
+		}
+		for _, s := range artifact.Strings {
+			defined[s.Name] = true
+		}
+		for _, rel := range artifact.Relocations {
+			if defined[rel.SymbolName] || sectionSymbol(artifact, rel.SymbolName) {
+				continue
+			}
+			imp := importOf[rel.SymbolName]
+			if imp == nil {
+				imp = &dynamicImport{name: rel.SymbolName, weak: weak[rel.SymbolName], index: len(imports) + 1, plt: -1, got: -1}
+				importOf[imp.name] = imp
+				imports = append(imports, imp)
+			}
+			switch rel.Type {
+			case amd64.R_X86_64_PLT32:
+				if imp.plt < 0 {
+					imp.plt = nPLT
+					nPLT++
+				}
+				if dyn.bindNow && imp.got < 0 {
+					// The PLT entry jumps through the GOT
+					imp.got = nGOT
+					nGOT++
+				}
+			case amd64.R_X86_64_GOTPCREL:
+				if imp.got < 0 {
+					imp.got = nGOT
+					nGOT++
+				}
+			case amd64.R_X86_64_64:
+				if rel.Section == "" || rel.Section == ".text.unlikely" || rel.Section == ".rodata" || textSection(artifact, rel.Section) {
+					return nil, fmt.Errorf("the address of %s, from a shared library, can't be written into read-only %s", rel.SymbolName, cmp.Or(rel.Section, ".text"))
+				}
+				absRelocs = append(absRelocs, rel)
+			default:
+				return nil, fmt.Errorf("relocation type %d against %s, from a shared library, needs a copy relocation; compile without NoPIC", rel.Type, rel.SymbolName)
+			}
+		}
+	}
+
+	exe := &elf.Executable{Machine: elf.EM_X86_64}
+	rx := &elf.Segment{Flags: elf.PF_R | elf.PF_X}
+	exe.Segments = append(exe.Segments, rx)
+	hasData := dyn != nil || len(artifact.DataBuffer) > 0 || len(artifact.RelroBuffer) > 0 || len(bss) > 0
+	var rw *elf.Segment
+	if hasData {
+		rw = &elf.Segment{Flags: elf.PF_R | elf.PF_W}
+		exe.Segments = append(exe.Segments, rw)
+	}
+	if dyn != nil {
+		// Their addresses are filled in once the sections are placed
+		exe.Headers = []elf.ProgramHeader{
+			{Type: elf.PT_PHDR, Flags: elf.PF_R, Align: 8},
+			{Type: elf.PT_INTERP, Flags: elf.PF_R, Align: 1},
+			{Type: elf.PT_DYNAMIC, Flags: elf.PF_R | elf.PF_W, Align: 8},
+		}
+	}
+
+	// Lay out the sections, each at its address in its segment's image.
+	// Segment addresses are at least as aligned as their sections need.
+	sections := make(map[string]*execSection)
+	images := make([]*bytes.Buffer, len(exe.Segments))
+	place := func(seg int, name string, data []byte, align uint64, fill byte) {
+		if images[seg] == nil {
+			images[seg] = new(bytes.Buffer)
+		}
+		pos := padTo(images[seg], align, fill)
+		sections[name] = &execSection{addr: exe.Segments[seg].Vaddr + pos, seg: seg, pos: int(pos), size: len(data)}
+		images[seg].Write(data)
+	}
+
+	rx.Vaddr = execBase + alignUp(exe.HeaderSize(), 16)
+	var dynstr *elf.StringTable
+	var dynamic []uint64 // Tag and value pairs; see writeDynamic
+	if dyn != nil {
+		dynstr = elf.NewStringTable()
+		for _, lib := range dyn.needed {
+			dynstr.Add(lib)
+		}
+		dynsym := make([]byte, 24) // The null symbol
+		for _, imp := range imports {
+			bind, typ := byte(elf.STB_GLOBAL), byte(elf.STT_NOTYPE)
+			if imp.weak {
+				bind = elf.STB_WEAK
+			}
+			if imp.plt >= 0 {
+				typ = elf.STT_FUNC
+			}
+			dynsym = binary.LittleEndian.AppendUint32(dynsym, dynstr.Add(imp.name))
+			dynsym = append(dynsym, elf.MakeSymbolInfo(bind, typ), 0)
+			dynsym = append(dynsym, make([]byte, 2+8+8)...) // SHN_UNDEF, no value or size
+		}
+
+		place(0, ".interp", append([]byte(dynamicLinker), 0), 1, 0)
+		place(0, ".hash", symbolHash(len(imports)+1), 8, 0)
+		place(0, ".dynsym", dynsym, 8, 0)
+		place(0, ".dynstr", dynstr.Data, 1, 0)
+		place(0, ".rela.dyn", make([]byte, 24*(nGOT+len(absRelocs))), 8, 0)
+		if dyn.bindNow {
+			place(0, ".plt", make([]byte, 8*nPLT), 16, 0xCC)
+		} else {
+			place(0, ".rela.plt", make([]byte, 24*nPLT), 8, 0)
+			place(0, ".plt", make([]byte, 16*(nPLT+1)), 16, 0xCC)
+		}
+	}
+	place(0, ".text", artifact.TextBuffer, 16, 0xCC)
+	place(0, ".text.unlikely", artifact.ColdBuffer, 1, 0xCC)
+	for _, ts := range artifact.TextSections {
+		place(0, ts.Name, ts.Data, uint64(max(16, backend.FunctionAlign)), 0xCC)
+	}
+	place(0, ".rodata", artifact.RodataBuffer, 16, 0)
+	strData, strOffsets := mergeStrings(artifact.Strings)
+	place(0, ".rodata.str1.1", strData, 1, 0)
+
+	if hasData {
+		rw.Vaddr = alignUp(rx.Vaddr+uint64(images[0].Len()), elf.PageSize)
+		if dyn != nil {
+			dynamic = dynamicEntries(dyn, len(absRelocs) > 0 || nGOT > 0, nPLT > 0)
+			place(1, ".dynamic", make([]byte, 8*len(dynamic)), 8, 0)
+			place(1, ".got", make([]byte, 8*nGOT), 8, 0)
+			if !dyn.bindNow && nPLT > 0 {
+				place(1, ".got.plt", make([]byte, 8*(3+nPLT)), 8, 0)
+			}
+		}
+		align := max(8, artifact.DataAlign)
+		place(1, ".data", artifact.DataBuffer, align, 0)
+		place(1, ".data.rel.ro", artifact.RelroBuffer, align, 0)
+		place(1, ".bss", bss, bssAlign, 0)
+	}
+	contents := func(name string) []byte {
+		sec := sections[name]
+		return images[sec.seg].Bytes()[sec.pos : sec.pos+sec.size]
+	}
+
+	// Every name a relocation can refer to, by address
+	addrs := map[string]uint64{
+		".text":          sections[".text"].addr,
+		".text.unlikely": sections[".text.unlikely"].addr,
+		".rodata":        sections[".rodata"].addr,
+	}
+	for _, ts := range artifact.TextSections {
+		addrs[ts.Name] = sections[ts.Name].addr
+	}
+	if hasData {
+		addrs[".data"] = sections[".data"].addr
+	}
+	for _, sym := range artifact.Symbols {
+		if sym.IsExtern {
+			if sym.IsWeak && dyn == nil {
+				addrs[sym.Name] = 0 // Left undefined, as the linker would
+			}
+			continue
+		}
+		if sym.IsCommon {
+			addrs[sym.Name] = sections[".bss"].addr + commons[sym.Name]
+			continue
+		}
+		section := sym.Section
+		switch {
+		case section != "":
+		case sym.IsFunc:
+			section = ".text"
+		default:
+			section = ".data"
+		}
+		sec := sections[section]
+		if sec == nil {
+			// A global of no size, the only data, leaves its section
+			// empty and unplaced; it goes at the end of the image
+			addrs[sym.Name] = rx.Vaddr + uint64(images[0].Len())
+			continue
+		}
+		addrs[sym.Name] = sec.addr + sym.Offset
+	}
+	for i, s := range artifact.Strings {
+		addrs[s.Name] = sections[".rodata.str1.1"].addr + uint64(strOffsets[i])
+	}
+
+	if dyn != nil {
+		exe.Headers[0].Vaddr, exe.Headers[0].Size = execBase+64, 56*uint64(len(exe.Segments)+len(exe.Headers)+1)
+		exe.Headers[1].Vaddr, exe.Headers[1].Size = sections[".interp"].addr, uint64(sections[".interp"].size)
+		exe.Headers[2].Vaddr, exe.Headers[2].Size = sections[".dynamic"].addr, uint64(sections[".dynamic"].size)
+		linkDynamic(dyn, imports, absRelocs, sections, contents, dynamic, dynstr)
+	}
+
+	for _, rel := range artifact.Relocations {
+		section := rel.Section
+		if section == "" {
+			section = ".text"
+		}
+		sec := sections[section]
+		target, ok := addrs[rel.SymbolName]
+		if imp := importOf[rel.SymbolName]; imp != nil {
+			// To the import's PLT entry or GOT entry; an absolute address
+			// is left for the dynamic linker
+			switch rel.Type {
+			case amd64.R_X86_64_PLT32:
+				target = sections[".plt"].addr + pltEntryOffset(dyn, imp.plt)
+			case amd64.R_X86_64_GOTPCREL:
+				target, rel.Type = sections[".got"].addr+8*uint64(imp.got), amd64.R_X86_64_PC32
+			default:
+				continue
+			}
+			ok = true
+		}
+		if !ok {
+			return nil, fmt.Errorf("undefined symbol %s: executables are linked with no libraries", rel.SymbolName)
+		}
+		image := images[sec.seg].Bytes()
+		loc := image[sec.pos+int(rel.Offset):]
+		if at := sec.pos + int(rel.Offset) - 2; rel.Type == amd64.R_X86_64_GOTPCREL && at >= 0 && image[at] == 0x8B {
+			// There is no GOT: relax the load of the address from it to
+			// an LEA of the address, as the linker does for a common
+			// global it allocates locally
+			image[at] = 0x8D
+			rel.Type = amd64.R_X86_64_PC32
+		}
+		if err := applyRelocation(loc, rel, target, sec.addr+rel.Offset); err != nil {
+			return nil, err
+		}
+	}
+
+	entry, ok := addrs["_start"]
+	if !ok {
+		return nil, fmt.Errorf("entry point _start is not defined")
+	}
+	exe.Entry = entry
+
+	rx.Data = images[0].Bytes()
+	if hasData {
+		rw.MemSize = uint64(images[1].Len())
+		rw.Data = bytes.TrimRight(images[1].Bytes(), "\x00")
+		if dyn != nil {
+			// The dynamic linker's PT_DYNAMIC is read from the file whole
+			dynamic := sections[".dynamic"]
+			rw.Data = images[1].Bytes()[:max(len(rw.Data), dynamic.pos+dynamic.size)]
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := exe.WriteTo(buf); err != nil {
+		return nil, fmt.Errorf("ELF generation failed: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// sectionSymbol reports whether a relocation's symbol name is one of the
+// sections an artifact's code refers to by name, its text sections
+// included
+func sectionSymbol(artifact *amd64.Artifact, name string) bool {
+	switch name {
+	case ".text", ".text.unlikely", ".rodata", ".data":
+		return true
+	}
+	return textSection(artifact, name)
+}
+
+// textSection reports whether name is one of the sections
+// Options.TextSections placed code in
+func textSection(artifact *amd64.Artifact, name string) bool {
+	for _, ts := range artifact.TextSections {
+		if ts.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dynamicEntries returns the tags of an executable's .dynamic, each
+// followed by a zero for linkDynamic to replace with its value
+func dynamicEntries(dyn *dynamicLink, rela, plt bool) []uint64 {
+	var tags []uint64
+	for range dyn.needed {
+		tags = append(tags, elf.DT_NEEDED, 0)
+	}
+	tags = append(tags, elf.DT_HASH, 0, elf.DT_STRTAB, 0, elf.DT_SYMTAB, 0, elf.DT_STRSZ, 0, elf.DT_SYMENT, 0, elf.DT_DEBUG, 0)
+	if rela {
+		tags = append(tags, elf.DT_RELA, 0, elf.DT_RELASZ, 0, elf.DT_RELAENT, 0)
+	}
+	if plt && !dyn.bindNow {
+		tags = append(tags, elf.DT_PLTGOT, 0, elf.DT_PLTRELSZ, 0, elf.DT_PLTREL, 0, elf.DT_JMPREL, 0)
+	}
+	if dyn.bindNow {
+		tags = append(tags, elf.DT_FLAGS, 0, elf.DT_FLAGS_1, 0)
+	}
+	return append(tags, elf.DT_NULL, 0)
+}
+
+// linkDynamic fills in the dynamic linking sections once they are placed:
+// the PLT and its GOT, the relocations the dynamic linker applies, and
+// .dynamic, which tells it where to find them
+func linkDynamic(dyn *dynamicLink, imports []*dynamicImport, absRelocs []amd64.Relocation,
+	sections map[string]*execSection, contents func(string) []byte, dynamic []uint64, dynstr *elf.StringTable) {
+	rela := func(buf []byte, offset uint64, sym int, typ amd64.RelocationType, addend int64) []byte {
+		buf = binary.LittleEndian.AppendUint64(buf, offset)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(sym)<<32|uint64(typ))
+		return binary.LittleEndian.AppendUint64(buf, uint64(addend))
+	}
+	// jmp qword ptr [rip + slot] at address at
+	jmpSlot := func(code []byte, at, slot uint64) {
+		code[0], code[1] = 0xFF, 0x25
+		binary.LittleEndian.PutUint32(code[2:], uint32(slot-(at+6)))
+	}
+	got := sections[".got"].addr
+	plt := sections[".plt"]
+
+	relaDyn := contents(".rela.dyn")[:0]
+	for _, imp := range imports {
+		if imp.got >= 0 {
+			relaDyn = rela(relaDyn, got+8*uint64(imp.got), imp.index, amd64.R_X86_64_GLOB_DAT, 0)
+		}
+	}
+	for _, rel := range absRelocs {
+		relaDyn = rela(relaDyn, sections[rel.Section].addr+rel.Offset, importIndex(imports, rel.SymbolName), amd64.R_X86_64_64, rel.Addend)
+	}
+
+	code := contents(".plt")
+	var gotPLT uint64
+	for _, imp := range imports {
+		if imp.plt < 0 {
+			continue
+		}
+		off := pltEntryOffset(dyn, imp.plt)
+		at := plt.addr + off
+		if dyn.bindNow {
+			jmpSlot(code[off:], at, got+8*uint64(imp.got))
+			continue
+		}
+
+		// jmp [its .got.plt slot], which first holds the address of the
+		// push after it; push its index in .rela.plt; jmp to PLT0, which
+		// calls the dynamic linker to bind it
+		gotPLT = sections[".got.plt"].addr
+		slot := gotPLT + 8*uint64(3+imp.plt)
+		jmpSlot(code[off:], at, slot)
+		code[off+6] = 0x68
+		binary.LittleEndian.PutUint32(code[off+7:], uint32(imp.plt))
+		code[off+11] = 0xE9
+		binary.LittleEndian.PutUint32(code[off+12:], uint32(plt.addr-(at+16)))
+		binary.LittleEndian.PutUint64(contents(".got.plt")[8*(3+imp.plt):], at+6)
+		rela(contents(".rela.plt")[:24*imp.plt], slot, imp.index, amd64.R_X86_64_JUMP_SLOT, 0)
+	}
+	if gotPLT != 0 {
+		// PLT0: push [.got.plt+8], the executable's link map, and jmp
+		// [.got.plt+16], the dynamic linker's resolver; .got.plt's first
+		// entry is the address of .dynamic
+		code[0], code[1] = 0xFF, 0x35
+		binary.LittleEndian.PutUint32(code[2:], uint32(gotPLT+8-(plt.addr+6)))
+		jmpSlot(code[6:], plt.addr+6, gotPLT+16)
+		copy(code[12:], []byte{0x0F, 0x1F, 0x40, 0x00}) // nop dword ptr [rax]
+		binary.LittleEndian.PutUint64(contents(".got.plt"), sections[".dynamic"].addr)
+	}
+
+	for i := 0; i < len(dynamic); i += 2 {
+		switch dynamic[i] {
+		case elf.DT_NEEDED:
+			// The libraries come first, in order, and are already in
+			// .dynstr: Add finds each again
+			dynamic[i+1] = uint64(dynstr.Add(dyn.needed[i/2]))
+		case elf.DT_HASH:
+			dynamic[i+1] = sections[".hash"].addr
+		case elf.DT_STRTAB:
+			dynamic[i+1] = sections[".dynstr"].addr
+		case elf.DT_SYMTAB:
+			dynamic[i+1] = sections[".dynsym"].addr
+		case elf.DT_STRSZ:
+			dynamic[i+1] = uint64(sections[".dynstr"].size)
+		case elf.DT_SYMENT, elf.DT_RELAENT:
+			dynamic[i+1] = 24
+		case elf.DT_RELA:
+			dynamic[i+1] = sections[".rela.dyn"].addr
+		case elf.DT_RELASZ:
+			dynamic[i+1] = uint64(sections[".rela.dyn"].size)
+		case elf.DT_PLTGOT:
+			dynamic[i+1] = gotPLT
+		case elf.DT_PLTRELSZ:
+			dynamic[i+1] = uint64(sections[".rela.plt"].size)
+		case elf.DT_PLTREL:
+			dynamic[i+1] = elf.DT_RELA
+		case elf.DT_JMPREL:
+			dynamic[i+1] = sections[".rela.plt"].addr
+		case elf.DT_FLAGS:
+			dynamic[i+1] = elf.DF_BIND_NOW
+		case elf.DT_FLAGS_1:
+			dynamic[i+1] = elf.DF_1_NOW
+		}
+	}
+	out := contents(".dynamic")[:0]
+	for _, v := range dynamic {
+		out = binary.LittleEndian.AppendUint64(out, v)
+	}
+}
+
+// pltEntryOffset is where PLT entry i is in .plt: after PLT0 when calls
+// bind lazily, and with BindNow in an 8-byte entry that only jumps through
+// the GOT
+func pltEntryOffset(dyn *dynamicLink, i int) uint64 {
+	if dyn.bindNow {
+		return 8 * uint64(i)
+	}
+	return 16 * uint64(i+1)
+}
+
+func importIndex(imports []*dynamicImport, name string) int {
+	for _, imp := range imports {
+		if imp.name == name {
+			return imp.index
+		}
+	}
+	return 0
+}
+
+// symbolHash builds the SysV .hash table of a .dynsym of n symbols, with
+// one bucket chaining them all: the dynamic linker wants a table, but
+// looks up nothing in an executable that only imports
+func symbolHash(n int) []byte {
+	var buf []byte
+	buf = binary.LittleEndian.AppendUint32(buf, 1) // nbucket
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(n))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(n-1)) // The bucket
+	for i := 0; i < n; i++ {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(max(i-1, 0)))
+	}
+	return buf
+}
+
+// execSection is a section placed in an executable: its address, and
+// where its data begins in the image of segment seg
+type execSection struct {
+	addr uint64
+	seg  int
+	pos  int
+	size int
+}
+
+// applyRelocation patches loc, at address place, to refer to target
+func applyRelocation(loc []byte, rel amd64.Relocation, target, place uint64) error {
+	value := int64(target) + rel.Addend
+	switch rel.Type {
+	case amd64.R_X86_64_64:
+		binary.LittleEndian.PutUint64(loc, uint64(value))
+		return nil
+	case amd64.R_X86_64_PC32, amd64.R_X86_64_PLT32:
+		// Statically linked, a call goes straight to its target
+		value -= int64(place)
+	case amd64.R_X86_64_32S:
+	default:
+		return fmt.Errorf("relocation type %d against %s can't be resolved in an executable", rel.Type, rel.SymbolName)
+	}
+	if value < math.MinInt32 || value > math.MaxInt32 {
+		return fmt.Errorf("relocation against %s: %#x is out of range", rel.SymbolName, value)
+	}
+	binary.LittleEndian.PutUint32(loc, uint32(value))
+	return nil
+}
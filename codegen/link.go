@@ -0,0 +1,403 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-codegen/arch/amd64"
+)
+
+// GenerateObjectMulti compiles several IR modules into a single ELF object.
+// References between the modules resolve within the object. A symbol
+// defined by more than one module is an error unless all but one of the
+// definitions are weak; internal and private symbols that collide with
+// another module's are renamed instead. The functions of opts.AsmFunctions
+// are emitted once, and no module may define one of them.
+func GenerateObjectMulti(mods []*ir.Module, opts CompileOptions) ([]byte, error) {
+	if len(mods) == 0 {
+		return nil, fmt.Errorf("no modules to compile")
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	// Each module is compiled on its own, so only here can an assembly
+	// function clash with another module's definition
+	for name := range opts.AsmFunctions {
+		for _, m := range mods {
+			if definesFunction(m, name) {
+				return nil, fmt.Errorf("function %s is defined both in assembly and in module %s", name, m.Name)
+			}
+		}
+	}
+
+	arts := make([]*amd64.Artifact, len(mods))
+	for i, m := range mods {
+		backend := opts.backend()
+		// Only the module defining main can get the _start stub
+		backend.EmitStart = opts.EmitStart && definesFunction(m, "main")
+		if i > 0 {
+			backend.AsmFunctions = nil // Emitted once, with the first module
+		}
+		artifact, err := amd64.CompileWithOptions(m, backend)
+		if err != nil {
+			return nil, fmt.Errorf("compilation of module %s failed: %w", m.Name, err)
+		}
+		arts[i] = artifact
+	}
+	if opts.EmitStart && !anyDefines(mods, "main") {
+		return nil, fmt.Errorf("EmitStart requires a main function")
+	}
+
+	artifact, err := linkArtifacts(mods, arts, max(16, opts.FunctionAlign))
+	if err != nil {
+		return nil, err
+	}
+
+	lookup := func(name string) *ir.Function {
+		for _, m := range mods {
+			if fn := m.GetFunction(name); fn != nil {
+				return fn
+			}
+		}
+		return nil
+	}
+	f, err := objectFile(artifact, mods[0].Name, lookup, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := f.WriteTo(buf); err != nil {
+		return nil, fmt.Errorf("ELF generation failed: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func definesFunction(m *ir.Module, name string) bool {
+	fn := m.GetFunction(name)
+	return fn != nil && len(fn.Blocks) > 0
+}
+
+func anyDefines(mods []*ir.Module, name string) bool {
+	for _, m := range mods {
+		if definesFunction(m, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyBindsLocally reports whether a module defines the function name in a
+// way no other component can preempt; see amd64.BindsLocally
+func anyBindsLocally(mods []*ir.Module, name string) bool {
+	for _, m := range mods {
+		if fn := m.GetFunction(name); fn != nil && len(fn.Blocks) > 0 && amd64.BindsLocally(fn) {
+			return true
+		}
+	}
+	return false
+}
+
+// definition is one module's claim on a symbol name
+type definition struct {
+	module  int
+	linkage ir.Linkage
+}
+
+// linkArtifacts concatenates the sections of the artifacts, in module
+// order, and rebases their symbols, relocations and ranges to match. Each
+// module's code starts on a multiple of funcAlign.
+func linkArtifacts(mods []*ir.Module, arts []*amd64.Artifact, funcAlign uint64) (*amd64.Artifact, error) {
+	// Decide which module's definition each name refers to
+	linkages := make([]map[string]ir.Linkage, len(mods))
+	winners := make(map[string]definition)
+	for i, m := range mods {
+		linkages[i] = moduleLinkages(m)
+		for name, linkage := range linkages[i] {
+			if isLocalLinkage(linkage) {
+				continue
+			}
+			prev, ok := winners[name]
+			switch {
+			case !ok || yields(prev.linkage) && !yields(linkage):
+				winners[name] = definition{module: i, linkage: linkage}
+			case !yields(linkage) && !yields(prev.linkage):
+				return nil, fmt.Errorf("symbol %s is defined in both module %s and module %s",
+					name, mods[prev.module].Name, mods[i].Name)
+			}
+		}
+	}
+
+	// Tentative definitions merge into the largest and most aligned one
+	commons := make(map[string]amd64.SymbolDef)
+	for _, a := range arts {
+		for _, sym := range a.Symbols {
+			if sym.IsCommon {
+				c := commons[sym.Name]
+				c.Size, c.Offset = max(c.Size, sym.Size), max(c.Offset, sym.Offset)
+				commons[sym.Name] = c
+			}
+		}
+	}
+
+	out := &amd64.Artifact{}
+	externs := make(map[string]int) // Index in out.Symbols
+	var text, cold, data, relro, rodata, tdata, ehFrame, except bytes.Buffer
+	named := make(map[string]*bytes.Buffer) // Options.TextSections, by section
+	var namedOrder []string
+	for i, a := range arts {
+		textBase := padTo(&text, funcAlign, 0xCC)
+		coldBase := uint64(cold.Len())
+		dataBase := padTo(&data, max(8, a.DataAlign), 0)
+		relroBase := padTo(&relro, max(8, a.DataAlign), 0)
+		rodataBase := padTo(&rodata, 16, 0)
+		tdataBase := padTo(&tdata, max(8, a.TLSAlign), 0)
+		tbssBase := alignUp(out.TBSSSize, max(8, a.TLSAlign))
+		// CIEs and FDEs are padded to eight bytes, and a zero pad
+		// would read as the end of the table
+		ehFrameBase := uint64(ehFrame.Len())
+		exceptBase := padTo(&except, 4, 0)
+
+		text.Write(a.TextBuffer)
+		cold.Write(a.ColdBuffer)
+		data.Write(a.DataBuffer)
+		relro.Write(a.RelroBuffer)
+		rodata.Write(a.RodataBuffer)
+		tdata.Write(a.TDataBuffer)
+		ehFrame.Write(a.EhFrameBuffer)
+		except.Write(a.ExceptTableBuffer)
+		namedBase := make(map[string]uint64)
+		for _, ts := range a.TextSections {
+			buf, ok := named[ts.Name]
+			if !ok {
+				buf = new(bytes.Buffer)
+				named[ts.Name] = buf
+				namedOrder = append(namedOrder, ts.Name)
+			}
+			namedBase[ts.Name] = padTo(buf, funcAlign, 0xCC)
+			buf.Write(ts.Data)
+		}
+		out.TBSSSize = tbssBase + a.TBSSSize
+		out.DataAlign = max(out.DataAlign, a.DataAlign)
+		out.TLSAlign = max(out.TLSAlign, a.TLSAlign)
+
+		// A local symbol keeps its name unless another module uses it
+		rename := make(map[string]string)
+		for name, linkage := range linkages[i] {
+			if isLocalLinkage(linkage) && mentionedElsewhere(mods, i, name) {
+				rename[name] = fmt.Sprintf("%s.%d", name, i)
+			}
+		}
+		renamed := func(name string) string {
+			if r, ok := rename[name]; ok {
+				return r
+			}
+			return name
+		}
+		defines := func(name string) bool {
+			if isLocalLinkage(linkages[i][name]) {
+				return true
+			}
+			w, ok := winners[name]
+			return !ok || w.module == i
+		}
+
+		for _, sym := range a.Symbols {
+			if sym.IsExtern {
+				// Declared once, unless some module defines it, and
+				// weak only if every module's reference is
+				if j, seen := externs[sym.Name]; seen {
+					out.Symbols[j].IsWeak = out.Symbols[j].IsWeak && sym.IsWeak
+				} else if _, defined := winners[sym.Name]; !defined {
+					externs[sym.Name] = len(out.Symbols)
+					out.Symbols = append(out.Symbols, sym)
+				}
+				continue
+			}
+			if !defines(sym.Name) {
+				continue // Overridden by another module's definition
+			}
+			switch {
+			case sym.IsCommon:
+				sym.Size, sym.Offset = commons[sym.Name].Size, commons[sym.Name].Offset
+			case sym.Section == ".text.unlikely":
+				sym.Offset += coldBase
+			case sym.IsFunc && sym.Section != "":
+				sym.Offset += namedBase[sym.Section]
+			case sym.IsFunc:
+				sym.Offset += textBase
+			case sym.Section == ".tbss":
+				sym.Offset += tbssBase
+			case sym.IsTLS:
+				sym.Offset += tdataBase
+			case sym.Section == ".data.rel.ro":
+				sym.Offset += relroBase
+			default:
+				sym.Offset += dataBase
+			}
+			sym.Name = renamed(sym.Name)
+			out.Symbols = append(out.Symbols, sym)
+		}
+		for _, s := range a.Strings {
+			if defines(s.Name) {
+				s.Name = renamed(s.Name)
+				out.Strings = append(out.Strings, s)
+			}
+		}
+
+		for _, rel := range a.Relocations {
+			switch rel.Section {
+			case ".rodata":
+				rel.Offset += rodataBase
+			case ".text.unlikely":
+				rel.Offset += coldBase
+			case ".data":
+				rel.Offset += dataBase
+			case ".data.rel.ro":
+				rel.Offset += relroBase
+			case ".tdata":
+				rel.Offset += tdataBase
+			case ".eh_frame":
+				rel.Offset += ehFrameBase
+			case ".gcc_except_table":
+				rel.Offset += exceptBase
+			default:
+				if base, ok := namedBase[rel.Section]; ok {
+					rel.Offset += base
+				} else {
+					rel.Offset += textBase
+				}
+			}
+			switch rel.SymbolName {
+			case ".rodata":
+				rel.Addend += int64(rodataBase)
+			case ".text":
+				rel.Addend += int64(textBase)
+			case ".text.unlikely":
+				rel.Addend += int64(coldBase)
+			case ".gcc_except_table":
+				rel.Addend += int64(exceptBase)
+			default:
+				if base, ok := namedBase[rel.SymbolName]; ok {
+					rel.Addend += int64(base)
+				}
+			}
+			rel.SymbolName = renamed(rel.SymbolName)
+			if rel.Type == amd64.R_X86_64_PLT32 && anyBindsLocally(mods, rel.SymbolName) {
+				// Defined in the set now, and not preemptible; call it
+				// directly, as within a module
+				rel.Type = amd64.R_X86_64_PC32
+			}
+			out.Relocations = append(out.Relocations, rel)
+		}
+
+		for _, fr := range a.Ranges {
+			base := textBase
+			if fr.Section != "" {
+				base = namedBase[fr.Section]
+			}
+			out.Ranges = append(out.Ranges, rebaseRange(fr, int(base), int(coldBase)))
+		}
+	}
+	// A strong function reference has no symbol to say so, only its
+	// declaration; it makes another module's weak reference strong
+	for _, m := range mods {
+		for _, fn := range m.Functions {
+			if j, ok := externs[fn.Name()]; ok && len(fn.Blocks) == 0 && fn.Linkage != ir.ExternalWeakLinkage {
+				out.Symbols[j].IsWeak = false
+			}
+		}
+	}
+
+	out.TextBuffer = text.Bytes()
+	out.ColdBuffer = cold.Bytes()
+	out.DataBuffer = data.Bytes()
+	out.RelroBuffer = relro.Bytes()
+	out.RodataBuffer = rodata.Bytes()
+	out.TDataBuffer = tdata.Bytes()
+	out.EhFrameBuffer = ehFrame.Bytes()
+	out.ExceptTableBuffer = except.Bytes()
+	for _, name := range namedOrder {
+		out.TextSections = append(out.TextSections, amd64.TextSection{Name: name, Data: named[name].Bytes()})
+	}
+	return out, nil
+}
+
+// moduleLinkages lists the symbols a module defines with their linkage
+func moduleLinkages(m *ir.Module) map[string]ir.Linkage {
+	defs := make(map[string]ir.Linkage)
+	for _, g := range m.Globals {
+		if g.Initializer != nil || g.Linkage != ir.ExternalLinkage || g.ThreadLocal {
+			defs[g.Name()] = g.Linkage // Not a declaration
+		}
+	}
+	for _, fn := range m.Functions {
+		if len(fn.Blocks) > 0 {
+			defs[fn.Name()] = fn.Linkage
+		}
+	}
+	return defs
+}
+
+// yields reports whether a definition with linkage l gives way to one
+// that is neither weak nor common
+func yields(l ir.Linkage) bool {
+	return l == ir.WeakLinkage || l == ir.CommonLinkage
+}
+
+func isLocalLinkage(l ir.Linkage) bool {
+	return l == ir.InternalLinkage || l == ir.PrivateLinkage
+}
+
+// mentionedElsewhere reports whether a module other than self defines or
+// declares name
+func mentionedElsewhere(mods []*ir.Module, self int, name string) bool {
+	for i, m := range mods {
+		if i == self {
+			continue
+		}
+		if m.GetFunction(name) != nil {
+			return true
+		}
+		for _, g := range m.Globals {
+			if g.Name() == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// padTo pads buf to a multiple of align with fill and returns its length
+func padTo(buf *bytes.Buffer, align uint64, fill byte) uint64 {
+	for uint64(buf.Len())%align != 0 {
+		buf.WriteByte(fill)
+	}
+	return uint64(buf.Len())
+}
+
+func alignUp(n, align uint64) uint64 {
+	return (n + align - 1) &^ (align - 1)
+}
+
+// rebaseRange shifts a function's ranges by base bytes, and those of its
+// cold blocks by coldBase
+func rebaseRange(fr amd64.FunctionRange, base, coldBase int) amd64.FunctionRange {
+	out := amd64.FunctionRange{Func: fr.Func, Start: fr.Start + base, End: fr.End + base, Section: fr.Section}
+	for _, br := range fr.Blocks {
+		base := base
+		if br.Cold {
+			base = coldBase
+		}
+		nb := amd64.BlockRange{Block: br.Block, Start: br.Start + base, Cold: br.Cold}
+		for _, inst := range br.Instructions {
+			inst.Start += base
+			inst.End += base
+			nb.Instructions = append(nb.Instructions, inst)
+		}
+		out.Blocks = append(out.Blocks, nb)
+	}
+	return out
+}
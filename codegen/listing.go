@@ -0,0 +1,116 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-codegen/arch/amd64"
+)
+
+// Listing maps every IR instruction to the machine code it produced
+type Listing struct {
+	Text      []byte // The complete .text section, before relocation
+	Functions []ListingFunction
+}
+
+type ListingFunction struct {
+	Name     string
+	Start    int // Offset of the function in Text
+	End      int
+	Prologue []byte // Frame setup and argument spills before the first block
+	Blocks   []ListingBlock
+}
+
+type ListingBlock struct {
+	Name         string
+	Start        int
+	Instructions []ListingInstruction
+}
+
+// ListingInstruction is one IR instruction and the bytes Text[Start:End]
+// it lowered to
+type ListingInstruction struct {
+	IR    string
+	Start int
+	End   int
+	Bytes []byte
+}
+
+// GenerateListing compiles m and reports which bytes of .text each IR
+// instruction produced
+func GenerateListing(m *ir.Module) (*Listing, error) {
+	artifact, err := amd64.Compile(m)
+	if err != nil {
+		return nil, fmt.Errorf("compilation failed: %w", err)
+	}
+
+	text := artifact.TextBuffer
+	l := &Listing{Text: text}
+	for _, fr := range artifact.Ranges {
+		lf := ListingFunction{
+			Name:  fr.Func.Name(),
+			Start: fr.Start,
+			End:   fr.End,
+		}
+		prologueEnd := fr.End
+		if len(fr.Blocks) > 0 {
+			prologueEnd = fr.Blocks[0].Start
+		}
+		lf.Prologue = text[fr.Start:prologueEnd]
+
+		for _, br := range fr.Blocks {
+			lb := ListingBlock{Name: br.Block.Name(), Start: br.Start}
+			for _, r := range br.Instructions {
+				lb.Instructions = append(lb.Instructions, ListingInstruction{
+					IR:    r.Inst.String(),
+					Start: r.Start,
+					End:   r.End,
+					Bytes: text[r.Start:r.End],
+				})
+			}
+			lf.Blocks = append(lf.Blocks, lb)
+		}
+		l.Functions = append(l.Functions, lf)
+	}
+
+	return l, nil
+}
+
+// String formats the listing like a compiler -S dump: each IR instruction
+// followed by its offset and hex bytes
+func (l *Listing) String() string {
+	var sb strings.Builder
+	for _, fn := range l.Functions {
+		fmt.Fprintf(&sb, "%s:\n", fn.Name)
+		fmt.Fprintf(&sb, "  ; prologue\n")
+		writeHexLine(&sb, fn.Start, fn.Prologue)
+		for _, b := range fn.Blocks {
+			fmt.Fprintf(&sb, "%s:\n", b.Name)
+			for _, inst := range b.Instructions {
+				fmt.Fprintf(&sb, "  ; %s\n", inst.IR)
+				writeHexLine(&sb, inst.Start, inst.Bytes)
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func writeHexLine(sb *strings.Builder, offset int, b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	fmt.Fprintf(sb, "  %06x:", offset)
+	for _, x := range b {
+		fmt.Fprintf(sb, " %02x", x)
+	}
+	sb.WriteString("\n")
+}
+
+// DisassembleText decodes machine code, such as Listing.Text or the bytes
+// of one ListingInstruction, into Intel-syntax instructions without IR or
+// an external disassembler; see amd64.Disassemble for the format
+func DisassembleText(text []byte) ([]string, error) {
+	return amd64.Disassemble(text)
+}
@@ -0,0 +1,107 @@
+package codegen
+
+import (
+	"bytes"
+	delf "debug/elf"
+	"fmt"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-codegen/arch/amd64"
+	"github.com/arc-language/core-codegen/format/elf"
+)
+
+// ObjectMetadata describes an object file for build systems and
+// incremental linkers that would rather not parse ELF: the symbols it
+// defines, those it needs from elsewhere and the places the linker
+// patches. Its JSON form is the side-band file such tools read.
+type ObjectMetadata struct {
+	Defined     []MetadataSymbol     `json:"defined"`
+	Undefined   []MetadataSymbol     `json:"undefined"`
+	Relocations []MetadataRelocation `json:"relocations"`
+}
+
+// MetadataSymbol is a named symbol of the object's symbol table
+type MetadataSymbol struct {
+	Name    string `json:"name"`
+	Section string `json:"section,omitempty"` // Empty if undefined; *COM* for a COMMON symbol
+	Value   uint64 `json:"value"`             // Offset in the section; a COMMON symbol's alignment
+	Size    uint64 `json:"size"`
+	Binding string `json:"binding"` // local, global or weak
+	Type    string `json:"type"`    // func, object, tls or notype
+}
+
+// MetadataRelocation is a place the linker patches: Offset bytes into
+// Section, with Target, a symbol or section name, plus Addend
+type MetadataRelocation struct {
+	Section string `json:"section"`
+	Offset  uint64 `json:"offset"`
+	Target  string `json:"target"`
+	Type    string `json:"type"` // As the ELF ABI names it, such as R_X86_64_PLT32
+	Addend  int64  `json:"addend"`
+}
+
+// GenerateObjectWithMetadata is GenerateObjectWithOptions that also
+// describes the object it returns
+func GenerateObjectWithMetadata(m *ir.Module, opts CompileOptions) ([]byte, *ObjectMetadata, error) {
+	f, artifact, err := buildObject(m, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := f.WriteTo(buf); err != nil {
+		return nil, nil, fmt.Errorf("ELF generation failed: %w", err)
+	}
+	return buf.Bytes(), objectMetadata(f, artifact), nil
+}
+
+var (
+	bindingNames    = map[byte]string{elf.STB_LOCAL: "local", elf.STB_GLOBAL: "global", elf.STB_WEAK: "weak"}
+	symbolTypeNames = map[byte]string{elf.STT_NOTYPE: "notype", elf.STT_FUNC: "func", elf.STT_OBJECT: "object", elf.STT_TLS: "tls"}
+)
+
+// objectMetadata lists f's symbols, as objectFile bound them, and the
+// artifact's relocations, which objectFile writes unchanged
+func objectMetadata(f *elf.File, artifact *amd64.Artifact) *ObjectMetadata {
+	md := &ObjectMetadata{
+		Defined:     []MetadataSymbol{},
+		Undefined:   []MetadataSymbol{},
+		Relocations: []MetadataRelocation{},
+	}
+	for _, sym := range f.Symbols {
+		typ := sym.Info & 0xf
+		if sym.Name == "" || typ == elf.STT_SECTION || typ == elf.STT_FILE {
+			continue
+		}
+		ms := MetadataSymbol{
+			Name:    sym.Name,
+			Value:   sym.Value,
+			Size:    sym.Size,
+			Binding: bindingNames[sym.Info>>4],
+			Type:    symbolTypeNames[typ],
+		}
+		switch {
+		case sym.Section != nil:
+			ms.Section = sym.Section.Name
+		case sym.Shndx == elf.SHN_COMMON:
+			ms.Section = "*COM*"
+		case sym.Shndx == elf.SHN_UNDEF:
+			md.Undefined = append(md.Undefined, ms)
+			continue
+		}
+		md.Defined = append(md.Defined, ms)
+	}
+	for _, rel := range artifact.Relocations {
+		section := rel.Section
+		if section == "" {
+			section = ".text"
+		}
+		md.Relocations = append(md.Relocations, MetadataRelocation{
+			Section: section,
+			Offset:  rel.Offset,
+			Target:  rel.SymbolName,
+			Type:    delf.R_X86_64(rel.Type).String(),
+			Addend:  rel.Addend,
+		})
+	}
+	return md
+}
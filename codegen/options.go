@@ -0,0 +1,262 @@
+package codegen
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/arc-language/core-codegen/arch/amd64"
+)
+
+// Version identifies this code generator in emitted objects
+const Version = "0.1.0"
+
+// CompileOptions controls how an IR module is lowered to an object file.
+// The zero value is usable; DefaultOptions fills in the conventional values.
+type CompileOptions struct {
+	// Producer is recorded in the .comment section to identify the tool
+	// that generated the object. Empty omits the section.
+	Producer string
+
+	// TLSModel selects how thread-local globals are accessed. The zero
+	// value is TLSLocalExec, which is only valid in executables; objects
+	// destined for shared libraries need TLSGeneralDynamic.
+	TLSModel TLSModel
+
+	// CodeModel states how far apart code and data may be placed. The
+	// small and medium models address globals RIP-relative, or with a
+	// 32-bit absolute address under NoPIC; the large model loads every
+	// global address as a 64-bit immediate, which needs a non-PIE link.
+	CodeModel CodeModel
+
+	// NoPIC allows absolute addressing, for objects linked into
+	// position-dependent executables only (gcc -no-pie)
+	NoPIC bool
+
+	// EmitStart adds a _start entry point that calls main and passes its
+	// return value to the exit_group syscall, so the object links with
+	// `ld -nostdlib` and no C runtime. Don't combine with a libc link,
+	// which supplies its own _start.
+	EmitStart bool
+
+	// CPUFeatures names the instruction set extensions the target CPU is
+	// known to have, e.g. {"popcnt", "sse4.2", "bmi1", "avx2"}. Code only
+	// uses an extension listed here and falls back to baseline x86-64
+	// (SSE2) sequences otherwise.
+	CPUFeatures []string
+
+	// BlockSymbols adds a local symbol named <function>.<block> at the
+	// start of every basic block, for profilers and coverage tools.
+	// Unnamed blocks use their index within the function.
+	BlockSymbols bool
+
+	// CanonicalizeNaN makes every NaN produced by float arithmetic or
+	// conversion the positive quiet NaN (0x7FF8000000000000 for double,
+	// 0x7FC00000 for float), for bit-reproducible output. It adds a
+	// compare and branch after each such operation.
+	CanonicalizeNaN bool
+
+	// ZeroAlloca zero-fills the memory of every alloca, fixed-size ones
+	// on function entry and variable-length ones as they are allocated,
+	// for languages that guarantee zeroed locals
+	ZeroAlloca bool
+
+	// OutlineCold moves basic blocks carrying "cold" metadata, such as
+	// error paths that call a panic handler, out of their function into a
+	// .text.unlikely section, leaving the hot path denser in the
+	// instruction cache. Jumps to and from them are relocated.
+	OutlineCold bool
+
+	// AsmFunctions supplies functions written in assembly, keyed by name,
+	// in the Intel syntax amd64.Assemble accepts. Each is emitted into .text
+	// as a global function. The module may declare one so IR can call it,
+	// but must not define it.
+	AsmFunctions map[string]string
+
+	// BindNow has GenerateDynamicExecutable bind every function taken
+	// from a shared library as the program loads, through GOT entries the
+	// dynamic linker fills before main runs, rather than on the first call
+	// of each through the PLT. A missing function then stops the program
+	// from starting instead of failing when first called.
+	BindNow bool
+
+	// TextSections places functions, keyed by name, in sections of the
+	// given names instead of .text, such as .text.boot or .init.text, for
+	// a linker script to put at the addresses it chooses. Their calls and
+	// jumps are relocated like those in .text.
+	TextSections map[string]string
+
+	// BuildID adds a .note.gnu.build-id holding a hash of the object's
+	// sections and relocations, so identical code gets an identical ID:
+	// "sha1" or "md5". Empty or "none" omits the note.
+	BuildID string
+
+	// TextAlign and DataAlign set the alignment of .text and .data in
+	// bytes. Zero keeps the defaults of 16 and 8. .data is never aligned
+	// less than its most strictly aligned global requires.
+	TextAlign uint64
+	DataAlign uint64
+
+	// Aliases define extra names for functions and globals of the
+	// object. Each is a second symbol at the same address as its target,
+	// so calls through either name reach the same code.
+	Aliases []Alias
+
+	// OmitFramePointer frees RBP in leaf functions: their locals are
+	// addressed from RSP, and the push rbp / mov rbp, rsp / leave frame
+	// setup is left out. Functions that call, use a variable-length
+	// alloca or are variadic keep the frame pointer. Debuggers and
+	// profilers that walk RBP chains skip the leaves' frames.
+	OmitFramePointer bool
+
+	// FunctionAlign starts each function on a multiple of this many bytes,
+	// such as 64 for a cache line, with multi-byte nops filling the gaps
+	// between functions. .text is aligned at least as strictly. Zero packs
+	// functions back to back.
+	FunctionAlign uint64
+
+	// CompressDebug zlib-compresses the contents of the object's .debug_*
+	// sections, marking them SHF_COMPRESSED as gcc -gz does. Linkers,
+	// debuggers and binutils decompress them transparently.
+	CompressDebug bool
+
+	// PoolFloatConstants puts float constants in .rodata, each distinct
+	// value once, and loads them with a single RIP-relative movss/movsd.
+	// Without it they are built in a general register and moved across,
+	// which takes two instructions and a 10-byte immediate.
+	PoolFloatConstants bool
+
+	// CET prepares the object for Intel CET indirect branch tracking:
+	// every function, including the assembly ones, starts with endbr64,
+	// the only instruction an indirect call may land on, and a
+	// .note.gnu.property marks the object IBT-compatible. The linker
+	// enables IBT for an output only when all its inputs are marked.
+	CET bool
+
+	// UnwindTables describes the frame of every function in .eh_frame,
+	// so that exceptions thrown by callees can unwind through it and
+	// debuggers and profilers can walk the stack without frame pointers.
+	// Functions containing invoke or resume always get one, and those
+	// with invokes an LSDA in .gcc_except_table listing their call sites
+	// and landing pads, for the personality routine.
+	UnwindTables bool
+
+	// Personality names the personality routine that decides whether a
+	// function's landing pads handle an exception. Empty means
+	// __gxx_personality_v0, the C++ one: a landingpad's clauses are
+	// type info globals, with null catching everything, and linking
+	// needs libstdc++ (g++ or -lstdc++).
+	Personality string
+
+	// StackProtector is gcc's -fstack-protector: a function with an
+	// array on its stack copies the thread's canary from fs:[0x28] to
+	// the top of its frame on entry, with its allocas right below, and
+	// before returning calls __stack_chk_fail, which aborts, if an
+	// overrun changed it.
+	// The canary and __stack_chk_fail come from glibc.
+	StackProtector bool
+
+	// ReuseLastResult keeps an instruction's 64-bit result in RAX for
+	// the one that follows: when that reads it first, it uses the
+	// register instead of reloading the stack slot just written. The
+	// slot is still written, and anything emitted in between, a call, a
+	// store or a branch target, ends the reuse. Narrower values are
+	// reloaded, which zero-extends them.
+	ReuseLastResult bool
+}
+
+// Alias names a symbol Target that the object defines a second time, as
+// Name. A weak alias gives way to a strong definition of Name elsewhere in
+// the link, as libc's __memcpy_chk-style aliases do.
+type Alias struct {
+	Name   string
+	Target string
+	Weak   bool
+}
+
+// TLSModel selects the thread-local storage access sequence; see
+// amd64.TLSModel
+type TLSModel = amd64.TLSModel
+
+const (
+	TLSLocalExec      = amd64.TLSLocalExec
+	TLSGeneralDynamic = amd64.TLSGeneralDynamic
+)
+
+// CodeModel selects the addressing range assumed for code and data; see
+// amd64.CodeModel
+type CodeModel = amd64.CodeModel
+
+const (
+	CodeModelSmall  = amd64.CodeModelSmall
+	CodeModelMedium = amd64.CodeModelMedium
+	CodeModelLarge  = amd64.CodeModelLarge
+)
+
+// DefaultOptions returns the options used by GenerateObject
+func DefaultOptions() CompileOptions {
+	return CompileOptions{
+		Producer: "arc-core-codegen " + Version,
+	}
+}
+
+// validate rejects option values no object can be built with
+func (o CompileOptions) validate() error {
+	for _, a := range []uint64{o.TextAlign, o.DataAlign, o.FunctionAlign} {
+		if a&(a-1) != 0 {
+			return fmt.Errorf("alignment %d is not a power of two", a)
+		}
+	}
+	switch o.BuildID {
+	case "", "none", "sha1", "md5":
+	default:
+		return fmt.Errorf("unknown build ID style %q", o.BuildID)
+	}
+	for fn, name := range o.TextSections {
+		if name == "" || objectSections[name] || strings.HasPrefix(name, ".rela") {
+			return fmt.Errorf("function %s can't be placed in section %q", fn, name)
+		}
+	}
+	return nil
+}
+
+// objectSections are the sections an object file has for other contents
+// than the code of TextSections
+var objectSections = map[string]bool{
+	".text.unlikely": true, ".data": true, ".data.rel.ro": true, ".bss": true,
+	".rodata": true, ".rodata.str1.1": true, ".tdata": true, ".tbss": true,
+	".eh_frame": true, ".gcc_except_table": true, ".comment": true,
+	".note.GNU-stack": true, ".note.gnu.build-id": true, ".note.gnu.property": true,
+	".symtab": true, ".strtab": true, ".shstrtab": true,
+}
+
+// backend converts the options into the amd64 backend's form
+func (o CompileOptions) backend() amd64.Options {
+	opts := amd64.Options{
+		TLSModel:  o.TLSModel,
+		CodeModel: o.CodeModel,
+		EmitStart: o.EmitStart,
+		NoPIC:     o.NoPIC,
+
+		CanonicalizeNaN: o.CanonicalizeNaN,
+		PoolFloatConsts: o.PoolFloatConstants,
+		ZeroAlloca:      o.ZeroAlloca,
+		OutlineCold:     o.OutlineCold,
+		AsmFunctions:    o.AsmFunctions,
+		TextSections:    o.TextSections,
+
+		OmitFramePointer: o.OmitFramePointer,
+		FunctionAlign:    int(o.FunctionAlign),
+		CET:              o.CET,
+		UnwindTables:     o.UnwindTables,
+		Personality:      o.Personality,
+		StackProtector:   o.StackProtector,
+		ReuseLastResult:  o.ReuseLastResult,
+	}
+	if len(o.CPUFeatures) > 0 {
+		opts.Features = make(map[string]bool)
+		for _, f := range o.CPUFeatures {
+			opts.Features[f] = true
+		}
+	}
+	return opts
+}
@@ -0,0 +1,153 @@
+package codegen
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-codegen/analysis"
+)
+
+// Pass is an analysis or transform run over a module before code
+// generation. A pass that returns an error stops the pipeline.
+type Pass interface {
+	Name() string
+	Run(m *ir.Module) error
+}
+
+// PassManager runs a sequence of passes in order
+type PassManager struct {
+	passes []Pass
+}
+
+// NewPassManager returns a manager running passes in the given order
+func NewPassManager(passes ...Pass) *PassManager {
+	return &PassManager{passes: passes}
+}
+
+// Add appends a pass to the end of the pipeline
+func (pm *PassManager) Add(p Pass) {
+	pm.passes = append(pm.passes, p)
+}
+
+// AddByName appends the registered pass called name
+func (pm *PassManager) AddByName(name string) error {
+	p, ok := LookupPass(name)
+	if !ok {
+		return fmt.Errorf("no pass named %q is registered", name)
+	}
+	pm.Add(p)
+	return nil
+}
+
+// Passes lists the pipeline in run order
+func (pm *PassManager) Passes() []Pass {
+	return append([]Pass(nil), pm.passes...)
+}
+
+// Run applies each pass to m in turn
+func (pm *PassManager) Run(m *ir.Module) error {
+	for _, p := range pm.passes {
+		if err := p.Run(m); err != nil {
+			return fmt.Errorf("pass %s: %w", p.Name(), err)
+		}
+	}
+	return nil
+}
+
+var registry = struct {
+	sync.Mutex
+	passes map[string]Pass
+}{passes: make(map[string]Pass)}
+
+// RegisterPass makes p available to PassManager.AddByName under its name.
+// Names are unique; the built-in passes are registered from the start.
+func RegisterPass(p Pass) error {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, dup := registry.passes[p.Name()]; dup {
+		return fmt.Errorf("a pass named %q is already registered", p.Name())
+	}
+	registry.passes[p.Name()] = p
+	return nil
+}
+
+// LookupPass returns the registered pass called name
+func LookupPass(name string) (Pass, bool) {
+	registry.Lock()
+	defer registry.Unlock()
+	p, ok := registry.passes[name]
+	return p, ok
+}
+
+func init() {
+	RegisterPass(unreachableBlocksPass{})
+	RegisterPass(promoteAllocasPass{})
+}
+
+// DefaultPipeline is the pass sequence Optimize runs at a level. Level 0
+// runs nothing; level 2 also promotes allocas to SSA values.
+func DefaultPipeline(level int) *PassManager {
+	pm := NewPassManager()
+	if level >= 1 {
+		pm.Add(unreachableBlocksPass{})
+	}
+	if level >= 2 {
+		pm.Add(promoteAllocasPass{})
+	}
+	return pm
+}
+
+// GenerateObjectWithPasses runs passes over m, which they may modify, and
+// then compiles it like GenerateObjectWithOptions
+func GenerateObjectWithPasses(m *ir.Module, pm *PassManager, opts CompileOptions) ([]byte, error) {
+	if err := pm.Run(m); err != nil {
+		return nil, err
+	}
+	return GenerateObjectWithOptions(m, opts)
+}
+
+// unreachableBlocksPass deletes blocks that control can't reach from a
+// function's entry, and phi entries for edges from them
+type unreachableBlocksPass struct{}
+
+func (unreachableBlocksPass) Name() string { return "unreachable-blocks" }
+
+func (unreachableBlocksPass) Run(m *ir.Module) error {
+	for _, fn := range m.Functions {
+		if len(fn.Blocks) == 0 {
+			continue
+		}
+		dom, err := analysis.Dominators(fn)
+		if err != nil || len(dom.Blocks()) == len(fn.Blocks) {
+			continue // A terminator it can't follow, or nothing to delete
+		}
+
+		kept := fn.Blocks[:0]
+		for _, block := range fn.Blocks {
+			if dom.Reachable(block) {
+				kept = append(kept, block)
+			}
+		}
+		fn.Blocks = kept
+
+		for _, block := range fn.Blocks {
+			for _, inst := range block.Instructions {
+				phi, ok := inst.(*ir.PhiInst)
+				if !ok {
+					break
+				}
+				incoming := phi.Incoming[:0]
+				ops := phi.Ops[:0]
+				for _, in := range phi.Incoming {
+					if dom.Reachable(in.Block) {
+						incoming = append(incoming, in)
+						ops = append(ops, in.Value)
+					}
+				}
+				phi.Incoming, phi.Ops = incoming, ops
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package codegen
+
+import (
+	"github.com/arc-language/core-builder/ir"
+	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-codegen/analysis"
+)
+
+// promoteAllocasPass turns scalar locals a front end keeps in allocas into
+// SSA values: the loads of one become the value last stored on the way
+// there, with phis where stores on different paths meet. Only an alloca
+// in the entry block holding a single integer, float or pointer qualifies,
+// and only when its address is used by nothing but loads and stores of
+// that type, neither volatile, so no other access to it can be hidden.
+// A load that no store reaches reads undef.
+type promoteAllocasPass struct{}
+
+func (promoteAllocasPass) Name() string { return "promote-allocas" }
+
+func (promoteAllocasPass) Run(m *ir.Module) error {
+	for _, fn := range m.Functions {
+		if len(fn.Blocks) == 0 {
+			continue
+		}
+		dom, err := analysis.Dominators(fn)
+		if err != nil || len(dom.Blocks()) != len(fn.Blocks) {
+			continue // Renaming walks the dominator tree, which must cover every block
+		}
+		allocas := promotableAllocas(fn)
+		if len(allocas) == 0 {
+			continue
+		}
+		promote(fn, dom, allocas)
+	}
+	return nil
+}
+
+// promotableAllocas returns the allocas of fn the pass can promote, in
+// order
+func promotableAllocas(fn *ir.Function) []*ir.AllocaInst {
+	ok := make(map[*ir.AllocaInst]bool)
+	var order []*ir.AllocaInst
+	for _, inst := range fn.Blocks[0].Instructions {
+		a, isAlloca := inst.(*ir.AllocaInst)
+		if !isAlloca || !isPromotableType(a.AllocatedType) {
+			continue
+		}
+		if n, isConst := a.NumElements.(*ir.ConstantInt); a.NumElements != nil && (!isConst || n.Value != 1) {
+			continue
+		}
+		ok[a] = true
+		order = append(order, a)
+	}
+	if len(order) == 0 {
+		return nil
+	}
+
+	// An alloca escapes through any use but as the address of a load or
+	// store of its type
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			for i, op := range inst.Operands() {
+				a, isAlloca := op.(*ir.AllocaInst)
+				if !isAlloca || !ok[a] {
+					continue
+				}
+				switch use := inst.(type) {
+				case *ir.LoadInst:
+					if !use.Volatile && use.Type() != nil && use.Type().Equal(a.AllocatedType) {
+						continue
+					}
+				case *ir.StoreInst:
+					if i == 1 && !use.Volatile && use.Ops[0] != nil && use.Ops[0].Type() != nil && use.Ops[0].Type().Equal(a.AllocatedType) {
+						continue
+					}
+				}
+				ok[a] = false
+			}
+		}
+	}
+
+	promotable := order[:0]
+	for _, a := range order {
+		if ok[a] {
+			promotable = append(promotable, a)
+		}
+	}
+	return promotable
+}
+
+func isPromotableType(t types.Type) bool {
+	return types.IsInteger(t) || types.IsFloat(t) || types.IsPointer(t)
+}
+
+// promote rewrites fn without the given allocas, by the classic SSA
+// construction: phis go in the iterated dominance frontier of the blocks
+// storing to an alloca, then a walk down the dominator tree tracks each
+// alloca's current value, replacing loads with it and feeding it to the
+// phis of each block's successors
+func promote(fn *ir.Function, dom *analysis.DomTree, allocas []*ir.AllocaInst) {
+	index := make(map[*ir.AllocaInst]int, len(allocas))
+	for i, a := range allocas {
+		index[a] = i
+	}
+	// The alloca a load or store accesses, if it is being promoted
+	target := func(inst ir.Instruction) (*ir.AllocaInst, bool) {
+		var ptr ir.Value
+		switch ops := inst.Operands(); inst.(type) {
+		case *ir.LoadInst:
+			if len(ops) == 1 {
+				ptr = ops[0]
+			}
+		case *ir.StoreInst:
+			if len(ops) == 2 {
+				ptr = ops[1]
+			}
+		}
+		a, isAlloca := ptr.(*ir.AllocaInst)
+		if !isAlloca {
+			return nil, false
+		}
+		_, promoted := index[a]
+		return a, promoted
+	}
+
+	// Place the phis
+	phiFor := make(map[*ir.PhiInst]*ir.AllocaInst)
+	placed := make(map[*ir.BasicBlock][]*ir.PhiInst)
+	for _, a := range allocas {
+		var work []*ir.BasicBlock
+		stores := make(map[*ir.BasicBlock]bool)
+		for _, block := range fn.Blocks {
+			for _, inst := range block.Instructions {
+				if s, ok := inst.(*ir.StoreInst); ok && !stores[block] {
+					if t, promoted := target(s); promoted && t == a {
+						stores[block] = true
+						work = append(work, block)
+					}
+				}
+			}
+		}
+		has := make(map[*ir.BasicBlock]bool)
+		for len(work) > 0 {
+			block := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, f := range dom.Frontier(block) {
+				if has[f] {
+					continue
+				}
+				has[f] = true
+				phi := &ir.PhiInst{}
+				phi.Op = ir.OpPhi
+				phi.ValType = a.AllocatedType
+				phi.ValName = a.Name()
+				phiFor[phi] = a
+				placed[f] = append(placed[f], phi)
+				if !stores[f] {
+					stores[f] = true
+					work = append(work, f)
+				}
+			}
+		}
+	}
+
+	// Rename. replaced maps each load to the value it reads.
+	replaced := make(map[ir.Value]ir.Value)
+	resolve := func(v ir.Value) ir.Value {
+		for {
+			r, ok := replaced[v]
+			if !ok {
+				return v
+			}
+			v = r
+		}
+	}
+	current := make([]ir.Value, len(allocas))
+	for i, a := range allocas {
+		undef := &ir.ConstantUndef{}
+		undef.ValType = a.AllocatedType
+		current[i] = undef
+	}
+	var rename func(block *ir.BasicBlock)
+	rename = func(block *ir.BasicBlock) {
+		saved := append([]ir.Value(nil), current...)
+		for _, phi := range placed[block] {
+			current[index[phiFor[phi]]] = phi
+		}
+		kept := block.Instructions[:0]
+		for _, inst := range block.Instructions {
+			if a, ok := inst.(*ir.AllocaInst); ok {
+				if _, promoted := index[a]; promoted {
+					continue
+				}
+			}
+			if a, promoted := target(inst); promoted {
+				if _, isLoad := inst.(*ir.LoadInst); isLoad {
+					replaced[inst] = current[index[a]]
+				} else {
+					current[index[a]] = resolve(inst.Operands()[0])
+				}
+				continue
+			}
+			kept = append(kept, inst)
+		}
+		block.Instructions = kept
+
+		succs, _ := analysis.Successors(fn, block)
+		for _, s := range succs {
+			for _, phi := range placed[s] {
+				phi.AddIncoming(current[index[phiFor[phi]]], block)
+			}
+		}
+		for _, child := range dom.Children(block) {
+			rename(child)
+		}
+		copy(current, saved)
+	}
+	rename(fn.Blocks[0])
+
+	// Drop the phis nothing reads but other new phis, then put the rest at
+	// the top of their blocks, after any already there
+	used := make(map[*ir.PhiInst]bool)
+	var mark func(v ir.Value)
+	mark = func(v ir.Value) {
+		phi, ok := resolve(v).(*ir.PhiInst)
+		if !ok || phiFor[phi] == nil || used[phi] {
+			return
+		}
+		used[phi] = true
+		for _, in := range phi.Incoming {
+			mark(in.Value)
+		}
+	}
+	// Branch conditions and phi incoming values are fields of their
+	// instructions rather than operands
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			for _, op := range inst.Operands() {
+				mark(op)
+			}
+			switch inst := inst.(type) {
+			case *ir.PhiInst:
+				for _, in := range inst.Incoming {
+					mark(in.Value)
+				}
+			case *ir.CondBrInst:
+				mark(inst.Condition)
+			case *ir.SwitchInst:
+				mark(inst.Condition)
+			}
+		}
+	}
+	for _, block := range fn.Blocks {
+		var phis []ir.Instruction
+		for _, phi := range placed[block] {
+			if used[phi] {
+				block.AddInstruction(phi) // Sets its parent
+				phis = append(phis, phi)
+			}
+		}
+		if len(phis) == 0 {
+			continue
+		}
+		rest := block.Instructions[:len(block.Instructions)-len(phis)]
+		at := 0
+		for at < len(rest) {
+			if _, ok := rest[at].(*ir.PhiInst); !ok {
+				break
+			}
+			at++
+		}
+		insts := append([]ir.Instruction(nil), rest[:at]...)
+		insts = append(insts, phis...)
+		block.Instructions = append(insts, rest[at:]...)
+	}
+
+	// Point every use of a load at the value it read
+	for _, block := range fn.Blocks {
+		for _, inst := range block.Instructions {
+			ops := inst.Operands()
+			for i, op := range ops {
+				ops[i] = resolve(op)
+			}
+			switch inst := inst.(type) {
+			case *ir.PhiInst:
+				for i := range inst.Incoming {
+					inst.Incoming[i].Value = resolve(inst.Incoming[i].Value)
+				}
+			case *ir.CondBrInst:
+				inst.Condition = resolve(inst.Condition)
+			case *ir.SwitchInst:
+				inst.Condition = resolve(inst.Condition)
+			}
+		}
+	}
+}
@@ -6,3 +6,5 @@ require (
 	github.com/arc-language/core-builder v0.0.0-20251222230544-91aac0849f4f
 	github.com/arc-language/core-codegen v0.0.0-20251223194237-0e38da0606fa
 )
+
+replace github.com/arc-language/core-codegen => ../
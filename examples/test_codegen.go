@@ -1,21 +1,45 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
 
 	"github.com/arc-language/core-builder/builder"
 	"github.com/arc-language/core-builder/ir"
 	"github.com/arc-language/core-builder/types"
+	"github.com/arc-language/core-codegen/analysis"
 	"github.com/arc-language/core-codegen/codegen"
+	elfwriter "github.com/arc-language/core-codegen/format/elf"
 )
 
+
 type TestCase struct {
 	Name           string
 	BuildFunc      func(*builder.Builder) *ir.Module
 	ExpectedOutput int
+	ExpectAsm      []string // Substrings that must appear in `objdump -d`
+	RejectAsm      []string // Substrings that must not appear in `objdump -d`
+	Options        *codegen.CompileOptions
+	Verify         func(obj []byte) error              // Extra checks on the object file
+	Run            func() error                        // Standalone check; replaces build/link/run
+	LinkC          string                              // C source linked in alongside the object
+	Linker         []string                            // Link command and flags; defaults to gcc
+	ExtraModules   []func(*builder.Builder) *ir.Module // Compiled to separate objects and linked in
+	ExpectSignal   syscall.Signal                      // The program must die of this instead of exiting
 }
 
 func main() {
@@ -215,46 +239,907 @@ func main() {
 			BuildFunc:      buildMaxFunction,
 			ExpectedOutput: 88,
 		},
-	}
+		{
+			Name:           "struct_return_extract",
+			BuildFunc:      buildStructReturnExtract,
+			ExpectedOutput: 42,
+		},
+		{
+			Name:           "struct_return_classes",
+			BuildFunc:      buildStructReturnClasses,
+			ExpectedOutput: 255,
+			LinkC: `struct fpair { float a, b; };
+struct mixed { double d; long l; };
+struct twelve { int a, b, c; };
+struct fpair c_fpair(void) { struct fpair p = {1.5f, 2.5f}; return p; }
+struct mixed c_mixed(void) { struct mixed m = {3.5, 7}; return m; }
+struct twelve c_twelve(void) { struct twelve t = {1, 2, 3}; return t; }
+struct fpair ir_fpair(void);
+struct mixed ir_mixed(void);
+struct twelve ir_twelve(void);
+int c_checks(void) {
+	struct fpair p = ir_fpair();
+	struct mixed m = ir_mixed();
+	struct twelve t = ir_twelve();
+	return (p.a == 1.5f && p.b == 2.5f) | (m.d == 3.5 && m.l == 7) << 1 |
+		(t.a == 1 && t.b == 2 && t.c == 3) << 2;
+}
+`,
+		},
+		{
+			Name:           "unreachable_arm",
+			BuildFunc:      buildUnreachableArm,
+			ExpectedOutput: 7,
+			ExpectAsm:      []string{"ud2"},
+		},
+		{
+			Name:           "undef_store_freeze",
+			BuildFunc:      buildUndefStoreFreeze,
+			ExpectedOutput: 42,
+		},
+		{
+			Name:           "stack_args_mixed_float",
+			BuildFunc:      buildStackArgsMixedFloat,
+			ExpectedOutput: 42,
+		},
+		{
+			Name:           "comment_section",
+			BuildFunc:      buildSimpleReturn,
+			ExpectedOutput: 42,
+			Options:        &codegen.CompileOptions{Producer: "arc-test 1.2.3"},
+			Verify:         verifyCommentSection("arc-test 1.2.3"),
+		},
+		{
+			Name: "string_table_tail_merge",
+			Run:  runStringTableTailMerge,
+		},
+		{
+			Name: "elf32_header",
+			Run:  runElf32Header,
+		},
+		{
+			Name: "elf_osabi",
+			Run:  runElfOSABI,
+		},
+		{
+			Name: "elf_note_byte_order",
+			Run:  runElfNoteByteOrder,
+		},
+		{
+			Name:           "tls_local_exec",
+			BuildFunc:      buildThreadLocal,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"fs:0x0"},
+			LinkC:          tlsDriver,
+		},
+		{
+			Name:           "tls_general_dynamic",
+			BuildFunc:      buildThreadLocal,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"data16 lea rdi"},
+			Options:        &codegen.CompileOptions{TLSModel: codegen.TLSGeneralDynamic},
+			LinkC:          tlsDriver,
+		},
+		{
+			Name: "listing_ret",
+			Run:  runListingRet,
+		},
+		{
+			Name:           "phi_swap_loop",
+			BuildFunc:      buildPhiSwapLoop,
+			ExpectedOutput: 163, // a,b,c = 3,1,2; x,y = 5,4
+		},
+		{
+			Name:           "shift_out_of_range",
+			BuildFunc:      buildShiftOutOfRange,
+			ExpectedOutput: 63, // Every check bit set
+		},
+		{
+			Name:           "start_stub_nostdlib",
+			BuildFunc:      buildSimpleReturn,
+			ExpectedOutput: 42,
+			Options:        &codegen.CompileOptions{EmitStart: true},
+			Linker:         []string{"ld", "-nostdlib", "-static"},
+		},
+		{
+			Name:           "fneg_signed_zero",
+			BuildFunc:      buildFNegSignedZero,
+			ExpectedOutput: 3, // fneg sets the sign on both widths; fsub doesn't
+			ExpectAsm:      []string{"xorpd", "xorps"},
+			Verify:         verifySharedSignMasks,
+		},
+		{
+			Name:           "fcmp_unordered",
+			BuildFunc:      buildFCmpUnordered,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"setp", "setnp"},
+		},
+		{
+			Name:           "long_double",
+			BuildFunc:      buildLongDouble,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"fmulp", "fchs"},
+		},
+		{
+			Name: "declarations_only",
+			Run:  runDeclarationsOnly,
+		},
+		{
+			Name:           "library_link",
+			BuildFunc:      buildLibraryClient,
+			ExpectedOutput: 26, // lib_mul(lib_add(3, 10), 2)
+			ExtraModules:   []func(*builder.Builder) *ir.Module{buildMathLibrary},
+		},
+		{
+			Name:           "gep_pointer_arg",
+			BuildFunc:      buildGEPPointerArg,
+			ExpectedOutput: 102, // sum(1..5)*6 + arr[4-2]*4
+		},
+		{
+			Name:           "ctpop_baseline",
+			BuildFunc:      buildCtpop,
+			ExpectedOutput: 96, // ctpop.i32(-1) + ctpop.i64(-1)
+			RejectAsm:      []string{"popcnt"},
+		},
+		{
+			Name:           "ctpop_popcnt",
+			BuildFunc:      buildCtpop,
+			ExpectedOutput: 96, // ctpop.i32(-1) + ctpop.i64(-1)
+			ExpectAsm:      []string{"popcnt"},
+			Options:        &codegen.CompileOptions{CPUFeatures: []string{"popcnt"}},
+		},
+		{
+			Name:           "indirect_call_table",
+			BuildFunc:      buildIndirectCallTable,
+			ExpectedOutput: 54, // table[1](7) + (&abs)(-5)
+			ExpectAsm:      []string{"call   r11"},
+		},
+		{
+			Name:           "dynamic_alloca",
+			BuildFunc:      buildDynamicAlloca,
+			ExpectedOutput: 61, // vla_sum(10) + vla_sum(3)
+		},
+		{
+			Name:           "unsigned_fp_conversions",
+			BuildFunc:      buildUnsignedFpConversions,
+			ExpectedOutput: 255, // Every check bit set
+		},
+		{
+			Name: "vector_fp_cast_rejected",
+			Run:  runVectorFpCastRejected,
+		},
+		{
+			Name:           "aligned_data",
+			BuildFunc:      buildAlignedData,
+			ExpectedOutput: 12, // pad + big, with big's address 64-byte aligned
+			Options:        &codegen.CompileOptions{DataAlign: 64},
+			Verify:         verifySymbolAlign("big", 64),
+		},
+		{
+			Name:           "code_model_small_nopic",
+			BuildFunc:      buildCodeModel,
+			ExpectedOutput: 23, // twice(table[2]) + table[3]
+			Options:        &codegen.CompileOptions{NoPIC: true},
+			Verify:         verifyRelocType(elf.R_X86_64_32S),
+			Linker:         []string{"gcc", "-no-pie"},
+		},
+		{
+			Name:           "code_model_large",
+			BuildFunc:      buildCodeModel,
+			ExpectedOutput: 23,
+			ExpectAsm:      []string{"movabs"},
+			Options:        &codegen.CompileOptions{CodeModel: codegen.CodeModelLarge},
+			Verify:         verifyRelocType(elf.R_X86_64_64),
+			Linker:         []string{"gcc", "-no-pie"},
+		},
+		{
+			Name:           "variadic_callee",
+			BuildFunc:      buildVariadicCallee,
+			ExpectedOutput: 151, // sum(1..8) + fsum(1.0..10.0) + sum(10, 20, 30) from C
+			LinkC: `long sum(int count, ...);
+int c_calls_sum(void) { return (int)sum(3, 10L, 20L, 30L); }
+`,
+		},
+		{
+			Name:           "extending_load",
+			BuildFunc:      buildExtendingLoad,
+			ExpectedOutput: 100, // sext(-5) + 105, plus zext(0xFFFF) - 65535
+			ExpectAsm:      []string{"movsx  rax,BYTE PTR [rax]", "movzx  rax,WORD PTR [rax]"},
+			RejectAsm:      []string{"movsx  rax,al"},
+		},
+		{
+			Name: "write_object_pipe",
+			Run:  runWriteObjectPipe,
+		},
+		{
+			Name:           "call_relocations",
+			BuildFunc:      buildLocalAndExternCall,
+			ExpectedOutput: 42, // twice(abs(-20)) + inc(1)
+			Verify: verifyCallRelocs(map[string]elf.R_X86_64{
+				"inc":   elf.R_X86_64_PC32,
+				"twice": elf.R_X86_64_PLT32,
+				"abs":   elf.R_X86_64_PLT32,
+			}),
+		},
+		{
+			Name:           "select_pointer",
+			BuildFunc:      buildSelectPointer,
+			ExpectedOutput: 42, // *pick(x) * 10 + *pick(y)
+		},
+		{
+			Name:           "select_struct",
+			BuildFunc:      buildSelectStruct,
+			ExpectedOutput: 82, // {1,2} -> 12, {30,40} -> 70, zero -> 0
+		},
+		{
+			Name:           "pointer_difference",
+			BuildFunc:      buildPointerDiff,
+			ExpectedOutput: 46, // 7*5 + 7 + 3 - (-7/4)
+			ExpectAsm:      []string{"sar    rax,0x2"},
+		},
+		{
+			Name:           "alloca_layout",
+			BuildFunc:      buildAllocaLayout,
+			ExpectedOutput: 42, // a[0] + a[2] + b, plus any misalignment
+		},
+		{
+			Name:           "zero_alloca",
+			BuildFunc:      buildZeroAlloca,
+			ExpectedOutput: 42, // No byte of any alloca read back nonzero
+			ExpectAsm:      []string{"rep stos"},
+			Options:        &codegen.CompileOptions{ZeroAlloca: true},
+		},
+		{
+			Name:           "string_literal_dedup",
+			BuildFunc:      buildStringDedup,
+			ExpectedOutput: 111, // msg1 == msg2, tail == msg1+1, msg2[0] == 'h'
+			Verify:         verifySharedString("msg1", "msg2"),
+		},
+		{
+			Name:           "avx_unsigned_fp_conversions",
+			BuildFunc:      buildUnsignedFpConversions,
+			ExpectedOutput: 255,
+			ExpectAsm:      []string{"vcvtsi2sd", "vcvttsd2si", "vcvttss2si", "vucomisd", "vmovsd", "vmovq"},
+			RejectAsm:      []string{"\tcvt", "\tmovsd", "\tmovss", "\tucomis", "\tcomis", "\tmovq"},
+			Options:        &codegen.CompileOptions{CPUFeatures: []string{"avx"}},
+		},
+		{
+			Name:           "avx_stack_args_mixed_float",
+			BuildFunc:      buildStackArgsMixedFloat,
+			ExpectedOutput: 42,
+			RejectAsm:      []string{"\tmovsd", "\taddsd"},
+			Options:        &codegen.CompileOptions{CPUFeatures: []string{"avx"}},
+		},
+		{
+			Name:           "avx_fneg_signed_zero",
+			BuildFunc:      buildFNegSignedZero,
+			ExpectedOutput: 3,
+			ExpectAsm:      []string{"vxorpd", "vxorps"},
+			Options:        &codegen.CompileOptions{CPUFeatures: []string{"avx"}},
+		},
+		{
+			Name:           "avx_variadic_callee",
+			BuildFunc:      buildVariadicCallee,
+			ExpectedOutput: 151,
+			ExpectAsm:      []string{"vmovaps", "vaddsd"},
+			RejectAsm:      []string{"\tmovaps"},
+			Options:        &codegen.CompileOptions{CPUFeatures: []string{"avx"}},
+			LinkC: `long sum(int count, ...);
+int c_calls_sum(void) { return (int)sum(3, 10L, 20L, 30L); }
+`,
+		},
+		{
+			Name: "hidden_visibility_shared",
+			Run:  runHiddenVisibilityShared,
+		},
+		{
+			Name:           "canonicalize_nan",
+			BuildFunc:      buildNaNBits,
+			ExpectedOutput: 15, // Both widths, the fptrunc and the non-NaN sum
+			Options:        &codegen.CompileOptions{CanonicalizeNaN: true},
+		},
+		{
+			Name:           "nan_not_canonicalized",
+			BuildFunc:      buildNaNBits,
+			ExpectedOutput: 4, // x86 yields the negative default NaN
+		},
+		{
+			Name: "block_symbols",
+			Run:  runBlockSymbols,
+		},
+		{
+			Name: "call_arity_mismatch",
+			Run:  runCallArityMismatch,
+		},
+		{
+			Name: "multi_module_object",
+			Run:  runMultiModuleObject,
+		},
+		{
+			Name:         "trap_intrinsic",
+			BuildFunc:    buildTrap,
+			ExpectAsm:    []string{"ud2"},
+			ExpectSignal: syscall.SIGILL,
+		},
+		{
+			Name:         "debugtrap_intrinsic",
+			BuildFunc:    buildDebugTrap,
+			ExpectAsm:    []string{"int3"},
+			ExpectSignal: syscall.SIGTRAP,
+		},
+		{
+			Name:           "build_id",
+			BuildFunc:      buildSelectPointer,
+			ExpectedOutput: 42,
+			Options:        &codegen.CompileOptions{BuildID: "sha1"},
+			Verify:         verifyBuildID,
+		},
+		{
+			Name: "build_id_inputs",
+			Run:  runBuildIDInputs,
+		},
+		{
+			Name:           "compare_and_branch",
+			BuildFunc:      buildCompareBranch,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"cmp    eax,ecx", "jl "},
+			RejectAsm:      []string{"set"},
+		},
+		{
+			Name:           "nested_extractvalue",
+			BuildFunc:      buildNestedExtract,
+			ExpectedOutput: 47, // s.1[2] * 10 + s.0 + s.1[0]
+		},
+		{
+			Name: "aggregate_index_out_of_range",
+			Run:  runAggregateIndexOutOfRange,
+		},
+		{
+			Name:           "float_double_signatures",
+			BuildFunc:      buildFloatSignatures,
+			ExpectedOutput: 42, // Every result bit-identical to C's
+			LinkC: `#include <string.h>
+float f(float, double);
+double mix(double, float, double, float);
+float stored(void);
+static int same_f(float a, float b) { return memcmp(&a, &b, sizeof a) == 0; }
+static int same_d(double a, double b) { return memcmp(&a, &b, sizeof a) == 0; }
+int main(void) {
+	volatile float x = 1.1f, y = 0.7f;
+	volatile double p = 0.3, q = 1e10;
+	int r = 0;
+	if (same_f(f(x, p), x * 2.5f + (float)p)) r |= 1;
+	if (same_d(mix(q, x, p, y), q * (double)x + p * (double)y)) r |= 2;
+	if (same_f(stored(), 0.1f)) r |= 4;
+	return r == 7 ? 42 : r;
+}
+`,
+		},
+		{
+			Name:           "switch_jump_table",
+			BuildFunc:      buildDenseSwitch,
+			ExpectedOutput: 40, // 1+2+4+8+16 for the cases, 3*3 for the default
+			ExpectAsm:      []string{"jmp    rax"},
+			Verify:         verifyJumpTableRelocs,
+		},
+		{
+			Name:           "asm_functions",
+			BuildFunc:      buildAsmCaller,
+			ExpectedOutput: 42, // triple(bump(sum_to(4))) + 9
+			ExpectAsm:      []string{"inc    eax", "jne", "call"},
+			Options: &codegen.CompileOptions{
+				AsmFunctions: map[string]string{
+					"bump": `
+	mov eax, edi
+	inc eax
+	ret`,
+					"sum_to": `
+	; 1 + 2 + ... + n
+	xor eax, eax
+	test edi, edi
+	jle done
+again:	add eax, edi
+	dec edi
+	jnz again
+done:
+	ret`,
+					"triple": `
+	push rbx
+	mov ebx, edi
+	call twice        # Defined in IR
+	add eax, ebx
+	pop rbx
+	ret`,
+				},
+			},
+		},
+		{
+			Name:           "asm_functions_sse",
+			BuildFunc:      buildAsmCaller,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"cvtsi2sd xmm0,edi", "movsd  QWORD PTR [rsp-0x8],xmm0", "cvttsd2si eax,xmm2"},
+			Options: &codegen.CompileOptions{
+				AsmFunctions: map[string]string{
+					"bump": `
+	cvtsi2sd xmm0, edi
+	mov eax, 1
+	cvtsi2sd xmm1, eax
+	addsd xmm0, xmm1
+	cvttsd2si eax, xmm0
+	ret`,
+					"sum_to": `
+	lea eax, [rdi + 1]
+	imul eax, edi
+	shr eax, 1
+	ret`,
+					"triple": `
+	cvtsi2sd xmm0, edi
+	movapd xmm1, xmm0
+	addsd xmm0, xmm1
+	addsd xmm0, xmm1
+	movsd qword ptr [rsp - 8], xmm0
+	movq rax, xmm0
+	movq xmm2, rax
+	cvttsd2si eax, xmm2
+	ret`,
+				},
+			},
+		},
+		{
+			Name: "asm_errors",
+			Run:  runAsmErrors,
+		},
+		{
+			Name:           "memmove_overlap",
+			BuildFunc:      buildMemmoveOverlap,
+			ExpectedOutput: 123, // 113 for the i32 moves, 10 for the byte move
+			ExpectAsm:      []string{"std", "rep movs"},
+		},
+		{
+			Name:           "fma_instruction",
+			BuildFunc:      buildFMA,
+			ExpectedOutput: 42, // Both results rounded once
+			Options:        &codegen.CompileOptions{CPUFeatures: []string{"fma"}},
+			ExpectAsm:      []string{"vfmadd213sd", "vfmadd213ss"},
+		},
+		{
+			Name:           "fma_libm_fallback",
+			BuildFunc:      buildFMA,
+			ExpectedOutput: 42,
+			RejectAsm:      []string{"mulsd", "mulss"},
+			Verify:         verifyCallRelocs(map[string]elf.R_X86_64{"fma": elf.R_X86_64_PLT32, "fmaf": elf.R_X86_64_PLT32}),
+			Linker:         []string{"gcc", "-Wl,--no-as-needed", "-lm"},
+		},
+		{
+			Name:           "empty_block_fallthrough",
+			BuildFunc:      buildEmptyBlock,
+			ExpectedOutput: 42,
+		},
+		{
+			Name:           "gep_large_offsets",
+			BuildFunc:      buildLargeGEPOffsets,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"movabs rcx,0xfffffffe00000000", "movabs rcx,0x200000000"},
+		},
+		{
+			Name:           "void_side_effects",
+			BuildFunc:      buildVoidSideEffects,
+			ExpectedOutput: 42, // 40 + bump() + bump()
+		},
+		{
+			Name: "return_type_mismatch",
+			Run:  runReturnMismatch,
+		},
+		{
+			Name:           "fence_seq_cst",
+			BuildFunc:      buildSeqCstFence,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"mfence"},
+		},
+		{
+			Name: "weak_fences_emit_nothing",
+			Run:  runWeakFences,
+		},
+		{
+			Name: "relro_function_table",
+			Run:  runRelroTable,
+		},
+		{
+			Name: "disassemble_text",
+			Run:  runDisassembleText,
+		},
+		{
+			Name:           "extern_global",
+			BuildFunc:      buildExternGlobal,
+			ExpectedOutput: 42, // 40 from C, bumped by 2
+			Verify:         verifyExternGlobal,
+			LinkC:          "int shared_counter = 40;\n",
+		},
+		{
+			Name:           "omit_frame_pointer",
+			BuildFunc:      buildLeafFrame,
+			ExpectedOutput: 42,
+			Options:        &codegen.CompileOptions{OmitFramePointer: true},
+			Verify:         verifyLeafFrame,
+		},
+		{
+			Name:           "weak_alias",
+			BuildFunc:      buildAliasCalls,
+			ExpectedOutput: 42, // foo() + bar(), both 21
+			Options: &codegen.CompileOptions{
+				Aliases: []codegen.Alias{{Name: "bar", Target: "foo", Weak: true}},
+			},
+			Verify: verifyWeakAlias,
+		},
+		{
+			Name:           "switch_case_200",
+			BuildFunc:      buildSwitchCase200,
+			ExpectedOutput: 42, // 20 + 20 + 2
+		},
+		{
+			Name: "build_cstring",
+			Run:  runBuildCString,
+		},
+		{
+			Name: "custom_section_layout",
+			Run:  runCustomSectionLayout,
+		},
+		{
+			Name:           "constant_gep_initializer",
+			BuildFunc:      buildConstantGEP,
+			ExpectedOutput: 42,
+			Verify:         verifyConstantGEP,
+		},
+		{
+			Name: "assembly_file_round_trip",
+			Run:  runAssemblyFileRoundTrip,
+		},
+		{
+			Name:           "float_phi_loop",
+			BuildFunc:      buildFloatPhiLoop,
+			ExpectedOutput: 42,
+		},
+		{
+			Name:           "unsigned_divide_range",
+			BuildFunc:      buildUnsignedDivideRange,
+			ExpectedOutput: 42,
+		},
+		{
+			Name:           "function_align",
+			BuildFunc:      buildUnsignedDivideRange,
+			ExpectedOutput: 42,
+			Options:        &codegen.CompileOptions{FunctionAlign: 64},
+			Verify:         verifyFunctionAlign,
+		},
+		{
+			Name:           "same_width_casts",
+			BuildFunc:      buildSameWidthCasts,
+			ExpectedOutput: 42,
+		},
+		{
+			Name: "static_executable",
+			Run:  runStaticExecutable,
+		},
+		{
+			Name: "dynamic_executable",
+			Run:  runDynamicExecutable,
+		},
+		{
+			Name: "executable_entry",
+			Run:  runExecutableEntry,
+		},
+		{
+			Name: "compressed_debug_section",
+			Run:  runCompressedDebugSection,
+		},
+		{
+			Name:           "bitwise_immediates",
+			BuildFunc:      buildBitwiseImmediates,
+			ExpectedOutput: 42,
+		},
+		{
+			Name:           "struct_return_memory",
+			BuildFunc:      buildStructReturnMemory,
+			ExpectedOutput: 42,
+			LinkC: `struct quad { long a, b, c, d; };
+struct quad make_quad(long a, long b, long c, long d) {
+	struct quad q = {a, b, c, d};
+	return q;
+}
+struct quad shifted(long, long, long, long, long, long, long);
+int c_calls_shifted(void) {
+	struct quad q = shifted(10, 20, 30, 40, 50, 60, 70);
+	return q.a == 10 && q.b == 20 && q.c == 30 && q.d == 180;
+}
+`,
+		},
+		{
+			Name:           "struct_build_memory",
+			BuildFunc:      buildStructBuildMemory,
+			ExpectedOutput: 42,
+			LinkC: `struct quad { long a, b, c, d; };
+struct quad mk(long);
+long pick(long);
+int main(void) {
+	struct quad q = mk(10);
+	int ok = q.a == 10 && q.b == 11 && q.c == 12 && q.d == 13;
+	return (ok ? 30 : 0) + pick(5);
+}
+`,
+		},
+		{
+			Name:           "vector_spill",
+			BuildFunc:      buildVectorSpill,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"movaps", "movups", "subps", "mulps", "addpd"},
+		},
+		{
+			Name:           "underaligned_vector_load",
+			BuildFunc:      buildUnderalignedVectorLoad,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"movdqu", "movdqa", "movups", "movaps"},
+		},
+		{
+			Name:           "cet_endbr",
+			BuildFunc:      buildDenseSwitch,
+			ExpectedOutput: 40,
+			ExpectAsm:      []string{"endbr64", "notrack jmp"},
+			Options: &codegen.CompileOptions{
+				CET:          true,
+				AsmFunctions: map[string]string{"forty_two": "mov eax, 42\nret"},
+			},
+			Verify: verifyCET,
+		},
+		{
+			Name:           "float_const_pool",
+			BuildFunc:      buildFloatConstPool,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"movsd  xmm", "movss  xmm"},
+			Options:        &codegen.CompileOptions{PoolFloatConstants: true},
+			Verify:         verifyFloatConstPool,
+		},
+		{
+			Name:           "exceptions",
+			BuildFunc:      buildExceptions,
+			ExpectedOutput: 42,
+			Options:        &codegen.CompileOptions{UnwindTables: true},
+			Linker:         []string{"g++"},
+			Verify:         verifyUnwindTables,
+			LinkC: `// Compiled as C++ by g++
+extern "C" {
+int cleanups;
+int typed(int);
+int pass_through(int);
 
-	passed := 0
-	failed := 0
+void throw_last(long a, long b, long c, long d, long e, long f, long g, long h) {
+	if (h >= 100)
+		throw int(h);
+}
 
-	fmt.Println("=== Running Codegen Tests ===\n")
+void may_throw(int n) {
+	if (n > 0)
+		throw n;
+	if (n < 0)
+		throw "negative";
+}
 
-	for _, test := range tests {
-		fmt.Printf("Running: %-30s ... ", test.Name)
-		
-		if runTest(test) {
-			fmt.Println("✓ PASS")
-			passed++
-		} else {
-			fmt.Println("✗ FAIL")
-			failed++
-		}
+int check_propagation(void) {
+	int ok = typed(3) == 203 && cleanups == 0;
+	try {
+		typed(-1);
+		ok = 0;
+	} catch (const char *s) {
+		ok = ok && s[0] == 'n' && cleanups == 1;
 	}
-
-	fmt.Printf("\n=== Results ===\n")
-	fmt.Printf("Passed: %d/%d\n", passed, len(tests))
-	fmt.Printf("Failed: %d/%d\n", failed, len(tests))
-	
+	try {
+		pass_through(9);
+		ok = 0;
+	} catch (int v) {
+		ok = ok && v == 9;
+	}
+	return ok;
+}
+}
+`,
+		},
+		{
+			Name:         "stack_protector",
+			BuildFunc:    buildStackSmash,
+			Options:      &codegen.CompileOptions{StackProtector: true},
+			ExpectAsm:    []string{"mov    rax,QWORD PTR fs:0x28", "sub    rcx,QWORD PTR fs:0x28"},
+			ExpectSignal: syscall.SIGABRT,
+		},
+		{
+			Name:           "common_symbol",
+			BuildFunc:      buildCommonMain,
+			ExpectedOutput: 42, // 40, bumped twice through the other object
+			ExtraModules:   []func(*builder.Builder) *ir.Module{buildCommonBump},
+			Verify:         verifyCommonSymbol,
+		},
+		{
+			Name:           "icmp_zero_test",
+			BuildFunc:      buildICmpZero,
+			ExpectedOutput: 42, // is_zero(0)*40 + is_zero(7) + is_positive(3)*2
+			ExpectAsm:      []string{"test   eax,eax", "sete", "test   rax,rax", "setg"},
+			RejectAsm:      []string{"cmp    ", "xor    rcx,rcx"},
+		},
+		{
+			Name:           "weak_undefined",
+			BuildFunc:      buildWeakUndefined,
+			ExpectedOutput: 42, // 40 + abs(-2); the absent hook and variable add nothing
+			Verify:         verifyWeakUndefined,
+		},
+		{
+			Name: "dominators_diamond",
+			Run:  runDominatorsDiamond,
+		},
+		{
+			Name: "dominators_loop",
+			Run:  runDominatorsLoop,
+		},
+		{
+			Name: "liveness_loop",
+			Run:  runLivenessLoop,
+		},
+		{
+			Name:           "reuse_last_result",
+			BuildFunc:      buildReuseLastResult,
+			ExpectedOutput: 42, // chain(10, 20, 12)
+			Options:        &codegen.CompileOptions{ReuseLastResult: true},
+			Verify:         verifyReuseLastResult,
+		},
+		{
+			Name:           "switch_critical_edges",
+			BuildFunc:      buildSwitchCriticalEdges,
+			ExpectedOutput: 16, // 1 + 1 + 2 + 3 + 4 + 1 + 4
+			ExpectAsm:      []string{"jmp    rax"},
+		},
+		{
+			Name: "object_metadata",
+			Run:  runObjectMetadata,
+		},
+		{
+			Name:           "narrow_shifts",
+			BuildFunc:      buildNarrowShifts,
+			ExpectedOutput: 42,
+			ExpectAsm:      []string{"shl    al,cl", "shr    al,cl", "sar    al,cl", "shr    ax,cl", "sar    al,0x7"},
+		},
+		{
+			Name: "malformed_ir",
+			Run:  runMalformedIR,
+		},
+		{
+			Name: "fuzz_malformed_ir",
+			Run:  runFuzzMalformedIR,
+		},
+		{
+			Name:           "phi_forward_refs",
+			BuildFunc:      buildPhiForwardRefs,
+			ExpectedOutput: 42,
+		},
+		{
+			Name:           "entry_call_args",
+			BuildFunc:      buildEntryCallArgs,
+			ExpectedOutput: 42,
+		},
+		{
+			Name:           "text_section_boot",
+			BuildFunc:      buildBootStart,
+			ExpectedOutput: 42,
+			Options:        &codegen.CompileOptions{TextSections: map[string]string{"_start": ".text.boot"}},
+			Verify:         verifyTextBoot,
+			Linker:         []string{"ld", "-nostdlib", "-static"},
+		},
+		{
+			Name: "promote_allocas",
+			Run:  runPromoteAllocas,
+		},
+		{
+			Name: "promote_branch_condition",
+			Run:  runPromotedCondition,
+		},
+		{
+			Name:           "trunc_i1",
+			BuildFunc:      buildTruncToI1,
+			ExpectedOutput: 42,
+		},
+		{
+			Name: "custom_pass",
+			Run:  runCustomPass,
+		},
+		{
+			Name: "vector_gep_rejected",
+			Run:  runVectorGEPRejected,
+		},
+		{
+			Name:           "outline_cold_blocks",
+			BuildFunc:      buildColdPath,
+			ExpectedOutput: 42, // check(2) + check(7): one hot, one cold
+			Options:        &codegen.CompileOptions{OutlineCold: true},
+			ExpectAsm:      []string{"<check.cold>:"},
+			Verify:         verifyColdSection,
+		},
+		{
+			Name:           "pointer_int_widths",
+			BuildFunc:      buildPointerIntWidths,
+			ExpectedOutput: 42,
+		},
+		{
+			Name:           "branch_weights",
+			BuildFunc:      buildWeightedBranch,
+			ExpectedOutput: 42,
+		},
+		{
+			Name: "compile_function",
+			Run:  runCompileFunction,
+		},
+		{
+			Name: "branch_weights_layout",
+			Run:  runWeightedBranchLayout,
+		},
+	}
+
+	passed := 0
+	failed := 0
+
+	fmt.Println("=== Running Codegen Tests ===\n")
+
+	for _, test := range tests {
+		fmt.Printf("Running: %-30s ... ", test.Name)
+		
+		if runTest(test) {
+			fmt.Println("✓ PASS")
+			passed++
+		} else {
+			fmt.Println("✗ FAIL")
+			failed++
+		}
+	}
+
+	fmt.Printf("\n=== Results ===\n")
+	fmt.Printf("Passed: %d/%d\n", passed, len(tests))
+	fmt.Printf("Failed: %d/%d\n", failed, len(tests))
+	
 	if failed > 0 {
 		os.Exit(1)
 	}
 }
 
 func runTest(test TestCase) bool {
+	if test.Run != nil {
+		if err := test.Run(); err != nil {
+			fmt.Printf("\n  %v", err)
+			return false
+		}
+		return true
+	}
+
 	// Build IR
 	b := builder.New()
 	m := test.BuildFunc(b)
 
 	// Compile to object file
-	objData, err := codegen.GenerateObject(m)
+	opts := codegen.DefaultOptions()
+	if test.Options != nil {
+		opts = *test.Options
+	}
+	objData, err := codegen.GenerateObjectWithOptions(m, opts)
 	if err != nil {
 		fmt.Printf("\n  Compilation error: %v", err)
 		return false
 	}
 
+	if test.Verify != nil {
+		if err := test.Verify(objData); err != nil {
+			fmt.Printf("\n  Verification failed: %v", err)
+			return false
+		}
+	}
+	if err := checkAssemblyFile(test.BuildFunc(builder.New()), opts, objData); err != nil {
+		fmt.Printf("\n  Assembly file: %v", err)
+		return false
+	}
+
 	// Write object file
 	tmpDir := os.TempDir()
 	objPath := filepath.Join(tmpDir, test.Name+".o")
@@ -272,8 +1157,48 @@ func runTest(test TestCase) bool {
 		os.Remove(exePath)
 	}
 
-	// Link with gcc
-	cmd := exec.Command("gcc", objPath, "-o", exePath)
+	if len(test.ExpectAsm) > 0 || len(test.RejectAsm) > 0 {
+		if err := checkDisassembly(objPath, test.ExpectAsm, test.RejectAsm); err != nil {
+			fmt.Printf("\n  Disassembly check failed: %v", err)
+			dumpObjectFile(objPath)
+			deferredCleanup()
+			return false
+		}
+	}
+
+	// Link (with gcc unless the test picks another linker)
+	linker := []string{"gcc"}
+	if len(test.Linker) > 0 {
+		linker = test.Linker
+	}
+	args := append(linker[1:len(linker):len(linker)], objPath, "-o", exePath)
+	for i, build := range test.ExtraModules {
+		extraObj, err := codegen.GenerateObjectWithOptions(build(builder.New()), opts)
+		if err != nil {
+			fmt.Printf("\n  Compilation error in extra module %d: %v", i, err)
+			deferredCleanup()
+			return false
+		}
+		extraPath := filepath.Join(tmpDir, fmt.Sprintf("%s_%d.o", test.Name, i))
+		if err := os.WriteFile(extraPath, extraObj, 0644); err != nil {
+			fmt.Printf("\n  Write error: %v", err)
+			deferredCleanup()
+			return false
+		}
+		defer os.Remove(extraPath)
+		args = append(args, extraPath)
+	}
+	if test.LinkC != "" {
+		cPath := filepath.Join(tmpDir, test.Name+"_driver.c")
+		if err := os.WriteFile(cPath, []byte(test.LinkC), 0644); err != nil {
+			fmt.Printf("\n  Write error: %v", err)
+			deferredCleanup()
+			return false
+		}
+		defer os.Remove(cPath)
+		args = append(args, cPath, "-pthread")
+	}
+	cmd := exec.Command(linker[0], args...)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		fmt.Printf("\n  Link error: %v\n%s", err, output)
 		dumpObjectFile(objPath)
@@ -287,7 +1212,13 @@ func runTest(test TestCase) bool {
 		// Check if it's an exit code error
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			exitCode := exitErr.ExitCode()
-			if exitCode != test.ExpectedOutput {
+			if test.ExpectSignal != 0 {
+				ws, _ := exitErr.Sys().(syscall.WaitStatus)
+				if !ws.Signaled() || ws.Signal() != test.ExpectSignal {
+					fmt.Printf("\n  Expected signal %v, got %v", test.ExpectSignal, err)
+					success = false
+				}
+			} else if exitCode != test.ExpectedOutput {
 				fmt.Printf("\n  Expected exit code %d, got %d", test.ExpectedOutput, exitCode)
 				success = false
 			}
@@ -306,6 +1237,12 @@ func runTest(test TestCase) bool {
 	}
 
 	// Exit code 0
+	if test.ExpectSignal != 0 {
+		fmt.Printf("\n  Expected signal %v, exited normally", test.ExpectSignal)
+		dumpObjectFile(objPath)
+		deferredCleanup()
+		return false
+	}
 	if test.ExpectedOutput != 0 {
 		fmt.Printf("\n  Expected exit code %d, got 0", test.ExpectedOutput)
 		dumpObjectFile(objPath)
@@ -328,995 +1265,6808 @@ func dumpObjectFile(objPath string) {
 	fmt.Printf("%s\n", output)
 }
 
+func checkDisassembly(objPath string, want, reject []string) error {
+	output, err := exec.Command("objdump", "-d", "-M", "intel", objPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("objdump: %v", err)
+	}
+	for _, w := range want {
+		if !strings.Contains(string(output), w) {
+			return fmt.Errorf("missing %q", w)
+		}
+	}
+	for _, r := range reject {
+		if strings.Contains(string(output), r) {
+			return fmt.Errorf("unexpected %q", r)
+		}
+	}
+	return nil
+}
+
 // ============================================================================
-// Test IR Builders
+// Object Verifiers
 // ============================================================================
 
-func buildSimpleReturn(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("simple_return")
-	
-	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	b.CreateRet(b.ConstInt(types.I32, 42))
-	
-	return m
+func verifyCommentSection(producer string) func([]byte) error {
+	return func(obj []byte) error {
+		f, err := elf.NewFile(bytes.NewReader(obj))
+		if err != nil {
+			return err
+		}
+		sec := f.Section(".comment")
+		if sec == nil {
+			return fmt.Errorf("no .comment section")
+		}
+		if sec.Flags != elf.SHF_MERGE|elf.SHF_STRINGS || sec.Entsize != 1 {
+			return fmt.Errorf(".comment has flags %v, entsize %d", sec.Flags, sec.Entsize)
+		}
+		data, err := sec.Data()
+		if err != nil {
+			return err
+		}
+		if want := "\x00" + producer + "\x00"; string(data) != want {
+			return fmt.Errorf(".comment contains %q, want %q", data, want)
+		}
+		return nil
+	}
 }
 
-func buildAddition(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("addition")
-	
-	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	a := b.ConstInt(types.I32, 7)
-	b2 := b.ConstInt(types.I32, 8)
-	result := b.CreateAdd(a, b2, "result")
-	b.CreateRet(result)
-	
-	return m
+// verifySymbolAlign checks that a data symbol sits on an align-byte
+// boundary and that its section is at least that aligned
+func verifySymbolAlign(name string, align uint64) func([]byte) error {
+	return func(obj []byte) error {
+		f, err := elf.NewFile(bytes.NewReader(obj))
+		if err != nil {
+			return err
+		}
+		syms, err := f.Symbols()
+		if err != nil {
+			return err
+		}
+		for _, sym := range syms {
+			if sym.Name != name {
+				continue
+			}
+			sec := f.Sections[sym.Section]
+			if sec.Addralign < align {
+				return fmt.Errorf("%s has alignment %d, want %d", sec.Name, sec.Addralign, align)
+			}
+			if sym.Value%align != 0 {
+				return fmt.Errorf("%s at offset %#x is not %d-byte aligned", name, sym.Value, align)
+			}
+			return nil
+		}
+		return fmt.Errorf("no symbol %s", name)
+	}
 }
 
-func buildSubtraction(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("subtraction")
-	
-	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	a := b.ConstInt(types.I32, 12)
-	b2 := b.ConstInt(types.I32, 7)
-	result := b.CreateSub(a, b2, "result")
-	b.CreateRet(result)
-	
-	return m
+// verifyRelocType checks that .rela.text holds a relocation of the given type
+func verifyRelocType(want elf.R_X86_64) func([]byte) error {
+	return func(obj []byte) error {
+		f, err := elf.NewFile(bytes.NewReader(obj))
+		if err != nil {
+			return err
+		}
+		sec := f.Section(".rela.text")
+		if sec == nil {
+			return fmt.Errorf("no .rela.text section")
+		}
+		data, err := sec.Data()
+		if err != nil {
+			return err
+		}
+		for off := 0; off+24 <= len(data); off += 24 {
+			info := binary.LittleEndian.Uint64(data[off+8:])
+			if elf.R_X86_64(elf.R_TYPE64(info)) == want {
+				return nil
+			}
+		}
+		return fmt.Errorf("no %v relocation in .rela.text", want)
+	}
 }
 
-func buildMultiplication(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("multiplication")
-	
-	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	a := b.ConstInt(types.I32, 6)
-	b2 := b.ConstInt(types.I32, 4)
-	result := b.CreateMul(a, b2, "result")
-	b.CreateRet(result)
-	
-	return m
+// verifyCallRelocs checks the relocation type used against each symbol
+func verifyCallRelocs(want map[string]elf.R_X86_64) func([]byte) error {
+	return func(obj []byte) error {
+		f, err := elf.NewFile(bytes.NewReader(obj))
+		if err != nil {
+			return err
+		}
+		syms, err := f.Symbols()
+		if err != nil {
+			return err
+		}
+		sec := f.Section(".rela.text")
+		if sec == nil {
+			return fmt.Errorf("no .rela.text section")
+		}
+		data, err := sec.Data()
+		if err != nil {
+			return err
+		}
+		got := make(map[string]elf.R_X86_64)
+		for off := 0; off+24 <= len(data); off += 24 {
+			info := binary.LittleEndian.Uint64(data[off+8:])
+			// Symbols() drops the null symbol at index 0
+			if idx := int(elf.R_SYM64(info)); idx > 0 && idx <= len(syms) {
+				got[syms[idx-1].Name] = elf.R_X86_64(elf.R_TYPE64(info))
+			}
+		}
+		for name, typ := range want {
+			if got[name] != typ {
+				return fmt.Errorf("relocation against %s is %v, want %v", name, got[name], typ)
+			}
+		}
+		return nil
+	}
 }
 
-func buildDivision(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("division")
-	
-	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	a := b.ConstInt(types.I32, 25)
-	b2 := b.ConstInt(types.I32, 5)
-	result := b.CreateSDiv(a, b2, "result")
-	b.CreateRet(result)
-	
-	return m
+// verifyBuildID checks the object has a GNU build-id note holding a SHA-1
+func verifyBuildID(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	sec := f.Section(".note.gnu.build-id")
+	if sec == nil {
+		return fmt.Errorf("no .note.gnu.build-id section")
+	}
+	if sec.Type != elf.SHT_NOTE || sec.Flags&elf.SHF_ALLOC == 0 {
+		return fmt.Errorf("build-id section has type %v, flags %v", sec.Type, sec.Flags)
+	}
+	note, err := sec.Data()
+	if err != nil {
+		return err
+	}
+	if len(note) < 16 {
+		return fmt.Errorf("build-id note is %d bytes", len(note))
+	}
+	namesz := binary.LittleEndian.Uint32(note[0:])
+	descsz := binary.LittleEndian.Uint32(note[4:])
+	typ := binary.LittleEndian.Uint32(note[8:])
+	if namesz != 4 || string(note[12:16]) != "GNU\x00" || typ != 3 {
+		return fmt.Errorf("note header namesz=%d name=%q type=%d", namesz, note[12:16], typ)
+	}
+	desc := note[16:]
+	if uint32(len(desc)) != descsz {
+		return fmt.Errorf("descsz %d but %d bytes follow", descsz, len(desc))
+	}
+	if descsz != sha1.Size {
+		return fmt.Errorf("build-id is %d bytes, want %d", descsz, sha1.Size)
+	}
+	return nil
 }
 
-func buildModulo(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("modulo")
-	
-	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	a := b.ConstInt(types.I32, 23)
-	b2 := b.ConstInt(types.I32, 5)
-	result := b.CreateSRem(a, b2, "result")
-	b.CreateRet(result)
-	
-	return m
+// The build ID is the same for the same module and differs when only a
+// string literal or a call's target does, neither of which is in .text or
+// .data
+func runBuildIDInputs() error {
+	build := func(msg, callee string) (string, error) {
+		b := builder.New()
+		m := b.CreateModule("build_id")
+		s := globalString(b, "msg", msg)
+		var fns []*ir.Function
+		for _, name := range []string{"one", "other"} {
+			fns = append(fns, b.CreateFunction(name, types.I32, nil, false))
+			b.SetInsertPoint(b.CreateBlock("entry"))
+			b.CreateRet(b.ConstInt(types.I32, 1))
+		}
+		b.CreateFunction("main", types.I32, nil, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		first := b.CreateLoad(types.I8, s, "c")
+		call := b.CreateCall(m.GetFunction(callee), nil, "r")
+		b.CreateRet(b.CreateAdd(b.CreateZExt(first, types.I32, "w"), call, "sum"))
+
+		opts := codegen.DefaultOptions()
+		opts.BuildID = "sha1"
+		obj, err := codegen.GenerateObjectWithOptions(m, opts)
+		if err != nil {
+			return "", err
+		}
+		f, err := elf.NewFile(bytes.NewReader(obj))
+		if err != nil {
+			return "", err
+		}
+		note, err := f.Section(".note.gnu.build-id").Data()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%x", note[16:]), nil
+	}
+
+	base, err := build("hi", "one")
+	if err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		msg, callee string
+		same        bool
+	}{
+		{"hi", "one", true},
+		{"ho", "one", false},
+		{"hi", "other", false},
+	} {
+		id, err := build(c.msg, c.callee)
+		if err != nil {
+			return err
+		}
+		if (id == base) != c.same {
+			return fmt.Errorf("build ID with %q calling %s is %s, against %s", c.msg, c.callee, id, base)
+		}
+	}
+	return nil
 }
 
-func buildComparisonEq(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("comparison_eq")
-	
+// verifyJumpTableRelocs checks the jump table's entries are relocated by
+// .rela.rodata, each a PC32 against the .text section symbol
+func verifyJumpTableRelocs(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	sec := f.Section(".rela.rodata")
+	if sec == nil {
+		return fmt.Errorf("no .rela.rodata section")
+	}
+	if target := f.Sections[sec.Info]; target.Name != ".rodata" {
+		return fmt.Errorf(".rela.rodata applies to %s", target.Name)
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return err
+	}
+	if len(data) != 6*24 {
+		return fmt.Errorf("%d jump table relocations, want 6", len(data)/24)
+	}
+	for off := 0; off < len(data); off += 24 {
+		info := binary.LittleEndian.Uint64(data[off+8:])
+		idx := int(elf.R_SYM64(info))
+		if typ := elf.R_X86_64(elf.R_TYPE64(info)); typ != elf.R_X86_64_PC32 {
+			return fmt.Errorf("jump table relocation is %v", typ)
+		}
+		if idx == 0 || idx > len(syms) || elf.ST_TYPE(syms[idx-1].Info) != elf.STT_SECTION ||
+			f.Sections[syms[idx-1].Section].Name != ".text" {
+			return fmt.Errorf("jump table relocation isn't against .text")
+		}
+	}
+	return nil
+}
+
+// verifySharedString checks that two string literals resolve to the same
+// bytes of a mergeable string section
+func verifySharedString(a, b string) func([]byte) error {
+	return func(obj []byte) error {
+		f, err := elf.NewFile(bytes.NewReader(obj))
+		if err != nil {
+			return err
+		}
+		syms, err := f.Symbols()
+		if err != nil {
+			return err
+		}
+		byName := make(map[string]elf.Symbol)
+		for _, sym := range syms {
+			byName[sym.Name] = sym
+		}
+		sa, okA := byName[a]
+		sb, okB := byName[b]
+		if !okA || !okB {
+			return fmt.Errorf("missing symbol %s or %s", a, b)
+		}
+		if sa.Section != sb.Section || sa.Value != sb.Value {
+			return fmt.Errorf("%s and %s have separate storage", a, b)
+		}
+		sec := f.Sections[sa.Section]
+		if sec.Flags&(elf.SHF_MERGE|elf.SHF_STRINGS) != elf.SHF_MERGE|elf.SHF_STRINGS || sec.Entsize != 1 {
+			return fmt.Errorf("%s is in %s with flags %v, entsize %d", a, sec.Name, sec.Flags, sec.Entsize)
+		}
+		return nil
+	}
+}
+
+// ============================================================================
+// Standalone Checks
+// ============================================================================
+
+func runStringTableTailMerge() error {
+	st := elfwriter.NewMergeStringTable()
+	foobar := st.Add("foobar")
+	bar := st.Add("bar")
+	if bar != foobar+3 {
+		return fmt.Errorf("\"bar\" at %d, want %d (inside \"foobar\")", bar, foobar+3)
+	}
+	if want := len("\x00foobar\x00"); len(st.Data) != want {
+		return fmt.Errorf("table is %d bytes, want %d", len(st.Data), want)
+	}
+
+	// The plain table keeps whole-string dedup only
+	plain := elfwriter.NewStringTable()
+	plain.Add("foobar")
+	if plain.Add("bar") == foobar+3 {
+		return fmt.Errorf("plain string table unexpectedly tail-merged")
+	}
+	return nil
+}
+
+func runElf32Header() error {
+	f := elfwriter.NewFile()
+	f.Class = elfwriter.ELFCLASS32
+	f.Machine = elfwriter.EM_386
+	text := f.AddSection(".text", elfwriter.SHT_PROGBITS, elfwriter.SHF_ALLOC|elfwriter.SHF_EXECINSTR, []byte{0xC3})
+	f.AddSymbol("main", elfwriter.MakeSymbolInfo(elfwriter.STB_GLOBAL, elfwriter.STT_FUNC), text, 0, 1)
+
+	var buf bytes.Buffer
+	if err := f.WriteTo(&buf); err != nil {
+		return err
+	}
+	obj := buf.Bytes()
+
+	if obj[elfwriter.EI_CLASS] != elfwriter.ELFCLASS32 || obj[elfwriter.EI_DATA] != elfwriter.ELFDATA2LSB {
+		return fmt.Errorf("e_ident class/data = %d/%d, want 1/1", obj[elfwriter.EI_CLASS], obj[elfwriter.EI_DATA])
+	}
+	if ehsize := binary.LittleEndian.Uint16(obj[40:]); ehsize != 52 {
+		return fmt.Errorf("e_ehsize = %d, want 52", ehsize)
+	}
+	if shentsize := binary.LittleEndian.Uint16(obj[46:]); shentsize != 40 {
+		return fmt.Errorf("e_shentsize = %d, want 40", shentsize)
+	}
+
+	ef, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return fmt.Errorf("debug/elf rejected object: %v", err)
+	}
+	if ef.Class != elf.ELFCLASS32 || ef.Machine != elf.EM_386 {
+		return fmt.Errorf("parsed as %v/%v", ef.Class, ef.Machine)
+	}
+	symtab := ef.Section(".symtab")
+	if symtab == nil || symtab.Entsize != 16 {
+		return fmt.Errorf(".symtab missing or wrong entsize")
+	}
+	syms, err := ef.Symbols()
+	if err != nil {
+		return err
+	}
+	if len(syms) != 1 || syms[0].Name != "main" || syms[0].Size != 1 {
+		return fmt.Errorf("unexpected symbols %+v", syms)
+	}
+	return nil
+}
+
+// An object's OS ABI and e_flags are written into its header as set, and
+// default to 0 (System V, no flags)
+func runElfOSABI() error {
+	write := func(f *elfwriter.File) ([]byte, error) {
+		if f.Machine == 0 {
+			f.Machine = elfwriter.EM_X86_64
+		}
+		f.AddSection(".text", elfwriter.SHT_PROGBITS, elfwriter.SHF_ALLOC|elfwriter.SHF_EXECINSTR, []byte{0xC3})
+		var buf bytes.Buffer
+		if err := f.WriteTo(&buf); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	obj, err := write(elfwriter.NewFile())
+	if err != nil {
+		return err
+	}
+	if abi, flags := obj[elfwriter.EI_OSABI], binary.LittleEndian.Uint32(obj[48:]); abi != elfwriter.ELFOSABI_NONE || flags != 0 {
+		return fmt.Errorf("default OS ABI %d and e_flags %#x, want 0 and 0", abi, flags)
+	}
+
+	f := elfwriter.NewFile()
+	f.OSABI = elfwriter.ELFOSABI_FREEBSD
+	f.Flags = 0x5
+	if obj, err = write(f); err != nil {
+		return err
+	}
+	if abi := obj[elfwriter.EI_OSABI]; abi != elfwriter.ELFOSABI_FREEBSD {
+		return fmt.Errorf("e_ident[EI_OSABI] = %d, want %d", abi, elfwriter.ELFOSABI_FREEBSD)
+	}
+	if flags := binary.LittleEndian.Uint32(obj[48:]); flags != 0x5 {
+		return fmt.Errorf("e_flags = %#x, want 0x5", flags)
+	}
+	ef, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return fmt.Errorf("debug/elf rejected object: %v", err)
+	}
+	if ef.OSABI != elf.ELFOSABI_FREEBSD {
+		return fmt.Errorf("parsed OS ABI %v", ef.OSABI)
+	}
+
+	// The 32-bit header has e_flags at its own offset
+	f = elfwriter.NewFile()
+	f.Class = elfwriter.ELFCLASS32
+	f.Machine = elfwriter.EM_386
+	f.Flags = 0x5
+	if obj, err = write(f); err != nil {
+		return err
+	}
+	if flags := binary.LittleEndian.Uint32(obj[36:]); flags != 0x5 {
+		return fmt.Errorf("ELF32 e_flags = %#x, want 0x5", flags)
+	}
+	return nil
+}
+
+// A note's header words are written in the file's byte order
+func runElfNoteByteOrder() error {
+	f := elfwriter.NewFile()
+	f.Data = elfwriter.ELFDATA2MSB
+	f.AddNoteSection(".note.test", "GNU", 3, []byte{1, 2, 3, 4})
+	var buf bytes.Buffer
+	if err := f.WriteTo(&buf); err != nil {
+		return err
+	}
+	ef, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return fmt.Errorf("debug/elf rejected object: %v", err)
+	}
+	note, err := ef.Section(".note.test").Data()
+	if err != nil {
+		return err
+	}
+	namesz, descsz, typ := binary.BigEndian.Uint32(note), binary.BigEndian.Uint32(note[4:]), binary.BigEndian.Uint32(note[8:])
+	if namesz != 4 || descsz != 4 || typ != 3 {
+		return fmt.Errorf("big-endian note header %d/%d/%d, want 4/4/3", namesz, descsz, typ)
+	}
+	return nil
+}
+
+func runListingRet() error {
+	l, err := codegen.GenerateListing(buildSimpleReturn(builder.New()))
+	if err != nil {
+		return err
+	}
+	if len(l.Functions) != 1 || len(l.Functions[0].Blocks) != 1 {
+		return fmt.Errorf("expected one function with one block")
+	}
+	fn := l.Functions[0]
+	insts := fn.Blocks[0].Instructions
+	if len(insts) != 1 {
+		return fmt.Errorf("expected a single ret, got %d instructions", len(insts))
+	}
+
+	// The ret owns everything from the block start to the function end
+	ret := insts[0]
+	if ret.Start != fn.Blocks[0].Start || ret.End != fn.End || ret.Start >= ret.End {
+		return fmt.Errorf("ret range [%d,%d) not contiguous within function [%d,%d)", ret.Start, ret.End, fn.Start, fn.End)
+	}
+	if fn.Start+len(fn.Prologue) != ret.Start {
+		return fmt.Errorf("prologue ends at %d, ret starts at %d", fn.Start+len(fn.Prologue), ret.Start)
+	}
+	if !bytes.Equal(ret.Bytes, l.Text[ret.Start:ret.End]) {
+		return fmt.Errorf("listing bytes differ from .text")
+	}
+
+	// Decode just the ret's bytes
+	rawPath := filepath.Join(os.TempDir(), "listing_ret.bin")
+	if err := os.WriteFile(rawPath, ret.Bytes, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(rawPath)
+	out, err := exec.Command("objdump", "-D", "-b", "binary", "-m", "i386:x86-64", "-M", "intel", rawPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("objdump: %v", err)
+	}
+	for _, want := range []string{"0x2a", "leave", "ret"} {
+		if !strings.Contains(string(out), want) {
+			return fmt.Errorf("decoded ret bytes missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(string(out), "(bad)") {
+		return fmt.Errorf("ret bytes do not decode:\n%s", out)
+	}
+	return nil
+}
+
+// A module of bodyless declarations is still a valid relocatable object:
+// no .text, an absolute file symbol, and nothing a linker rejects
+func runDeclarationsOnly() error {
+	b := builder.New()
+	m := b.CreateModule("decls")
+	b.DeclareFunction("puts", types.I32, []types.Type{types.NewPointer(types.I8)}, false)
+	b.DeclareFunction("abort", types.Void, nil, false)
+
+	obj, err := codegen.GenerateObject(m)
+	if err != nil {
+		return err
+	}
+	ef, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return fmt.Errorf("debug/elf rejected object: %v", err)
+	}
+	if ef.Section(".text") != nil {
+		return fmt.Errorf("empty .text section emitted")
+	}
+	syms, err := ef.Symbols()
+	if err != nil {
+		return err
+	}
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FILE && sym.Section != elf.SHN_ABS {
+			return fmt.Errorf("file symbol in section %v, want SHN_ABS", sym.Section)
+		}
+	}
+
+	objPath := filepath.Join(os.TempDir(), "declarations_only.o")
+	if err := os.WriteFile(objPath, obj, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(objPath)
+	outPath := objPath + ".r.o"
+	defer os.Remove(outPath)
+	if out, err := exec.Command("ld", "-r", objPath, "-o", outPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("ld -r: %v\n%s", err, out)
+	}
+	return nil
+}
+
+// Hidden symbols of a shared library are bound locally and left out of
+// its dynamic symbol table; the default-visibility api() and zero() are
+// exported. api calls zero and takes its address, both through the PLT or
+// GOT, as the library's zero may be preempted. It does both directly for
+// the internal none(), whose symbol is local so the PC32s link.
+func runHiddenVisibilityShared() error {
+	b := builder.New()
+	m := b.CreateModule("visibility")
+	counter := b.CreateGlobal("counter", types.I32, b.ConstInt(types.I32, 40))
+	counter.Visibility = ir.HiddenVisibility
+
+	helper := b.CreateFunction("helper", types.I32, nil, false)
+	helper.Visibility = ir.HiddenVisibility
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateAdd(b.CreateLoad(types.I32, counter, "v"), b.ConstInt(types.I32, 1), "r"))
+
+	zero := b.CreateFunction("zero", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.ConstInt(types.I32, 0))
+
+	none := b.CreateFunction("none", types.I32, nil, false)
+	none.Linkage = ir.InternalLinkage
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.ConstInt(types.I32, 0))
+
+	b.CreateFunction("api", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	r := b.CreateAdd(b.CreateCall(helper, nil, "h"), b.CreateCall(zero, nil, "z"), "hz")
+	r = b.CreateAdd(r, b.CreateIndirectCall(types.NewFunction(types.I32, nil, false), zero, nil, "iz"), "hzz")
+	r = b.CreateAdd(r, b.CreateCall(none, nil, "n"), "hzzn")
+	r = b.CreateAdd(r, b.CreateIndirectCall(types.NewFunction(types.I32, nil, false), none, nil, "in"), "hzznn")
+	b.CreateRet(b.CreateAdd(r, b.ConstInt(types.I32, 1), "r"))
+
+	obj, err := codegen.GenerateObject(m)
+	if err != nil {
+		return err
+	}
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	for _, sym := range syms {
+		if sym.Name == "none" && elf.ST_BIND(sym.Info) != elf.STB_LOCAL {
+			return fmt.Errorf("internal none is %v, want STB_LOCAL", elf.ST_BIND(sym.Info))
+		}
+		want := elf.STV_DEFAULT
+		if sym.Name == "counter" || sym.Name == "helper" {
+			want = elf.STV_HIDDEN
+		}
+		if sym.Name != "" && elf.ST_TYPE(sym.Info) != elf.STT_FILE && elf.ST_VISIBILITY(sym.Other) != want {
+			return fmt.Errorf("%s has visibility %v, want %v", sym.Name, elf.ST_VISIBILITY(sym.Other), want)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "visibility")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	objPath := filepath.Join(dir, "visibility.o")
+	libPath := filepath.Join(dir, "libvisibility.so")
+	if err := os.WriteFile(objPath, obj, 0644); err != nil {
+		return err
+	}
+	if out, err := exec.Command("gcc", "-shared", objPath, "-o", libPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("gcc -shared: %v\n%s", err, out)
+	}
+
+	lib, err := elf.Open(libPath)
+	if err != nil {
+		return err
+	}
+	defer lib.Close()
+	dynsyms, err := lib.DynamicSymbols()
+	if err != nil {
+		return err
+	}
+	exported := make(map[string]bool)
+	for _, sym := range dynsyms {
+		exported[sym.Name] = true
+	}
+	if !exported["api"] || !exported["zero"] || exported["helper"] || exported["counter"] {
+		return fmt.Errorf("dynamic symbols api/zero/helper/counter = %v/%v/%v/%v, want true/true/false/false",
+			exported["api"], exported["zero"], exported["helper"], exported["counter"])
+	}
+
+	cPath := filepath.Join(dir, "main.c")
+	exePath := filepath.Join(dir, "main")
+	if err := os.WriteFile(cPath, []byte("int api(void);\nint main(void) { return api(); }\n"), 0644); err != nil {
+		return err
+	}
+	if out, err := exec.Command("gcc", cPath, libPath, "-Wl,-rpath,"+dir, "-o", exePath).CombinedOutput(); err != nil {
+		return fmt.Errorf("linking against the library: %v\n%s", err, out)
+	}
+	err = exec.Command(exePath).Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 42 {
+		return fmt.Errorf("api() through the library: %v, want exit code 42", err)
+	}
+	return nil
+}
+
+// Two modules in one object: main in the first calls add3 in the second,
+// and each has an internal helper of the same name. A third module that
+// redefines add3 is rejected unless its definition is weak.
+func runMultiModuleObject() error {
+	helper := func(b *builder.Builder, value int64) *ir.Function {
+		fn := b.CreateFunction("helper", types.I32, nil, false)
+		fn.Linkage = ir.InternalLinkage
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		b.CreateRet(b.ConstInt(types.I32, value))
+		return fn
+	}
+	defineAdd3 := func(b *builder.Builder, name string) *ir.Module {
+		m := b.CreateModule(name)
+		h := helper(b, 30)
+		add3 := b.CreateFunction("add3", types.I32, []types.Type{types.I32}, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		sum := b.CreateAdd(add3.Arguments[0], b.CreateCall(h, nil, "h"), "s")
+		b.CreateRet(b.CreateAdd(sum, b.ConstInt(types.I32, 2), "r"))
+		return m
+	}
+
+	b := builder.New()
+	app := b.CreateModule("app")
+	h := helper(b, 10)
+	add3 := b.DeclareFunction("add3", types.I32, []types.Type{types.I32}, false)
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateCall(add3, []ir.Value{b.CreateCall(h, nil, "h")}, "r"))
+
+	lib := defineAdd3(builder.New(), "lib")
+
+	obj, err := codegen.GenerateObjectMulti([]*ir.Module{app, lib}, codegen.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	if err := verifyCallRelocs(map[string]elf.R_X86_64{"add3": elf.R_X86_64_PLT32})(obj); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "multi")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	objPath := filepath.Join(dir, "multi.o")
+	exePath := filepath.Join(dir, "multi")
+	if err := os.WriteFile(objPath, obj, 0644); err != nil {
+		return err
+	}
+	if out, err := exec.Command("gcc", objPath, "-o", exePath).CombinedOutput(); err != nil {
+		return fmt.Errorf("linking the combined object: %v\n%s", err, out)
+	}
+	err = exec.Command(exePath).Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 42 {
+		return fmt.Errorf("combined program: %v, want exit code 42", err)
+	}
+
+	dup := defineAdd3(builder.New(), "dup")
+	if _, err := codegen.GenerateObjectMulti([]*ir.Module{app, lib, dup}, codegen.DefaultOptions()); err == nil ||
+		!strings.Contains(err.Error(), "add3") {
+		return fmt.Errorf("duplicate add3: got error %v", err)
+	}
+
+	// A weak definition gives way to the strong one
+	weak := defineAdd3(builder.New(), "weak")
+	weak.GetFunction("add3").Linkage = ir.WeakLinkage
+	if _, err := codegen.GenerateObjectMulti([]*ir.Module{weak, app, lib}, codegen.DefaultOptions()); err != nil {
+		return fmt.Errorf("weak add3: %w", err)
+	}
+
+	// A function supplied in assembly clashes with any module's definition
+	opts := codegen.DefaultOptions()
+	opts.AsmFunctions = map[string]string{"add3": "lea eax, [rdi + 32]\nret"}
+	if _, err := codegen.GenerateObjectMulti([]*ir.Module{app, lib}, opts); err == nil ||
+		!strings.Contains(err.Error(), "add3") {
+		return fmt.Errorf("add3 in assembly and in module lib: got error %v", err)
+	}
+
+	// FunctionAlign holds for the functions of every module
+	opts = codegen.DefaultOptions()
+	opts.FunctionAlign = 64
+	obj, err = codegen.GenerateObjectMulti([]*ir.Module{app, lib}, opts)
+	if err != nil {
+		return err
+	}
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Value%64 != 0 {
+			return fmt.Errorf("%s starts at %#x with FunctionAlign 64", sym.Name, sym.Value)
+		}
+	}
+	return nil
+}
+
+// factorial compiled on its own, with nothing else of its module, links
+// with a main compiled from another module that only declares it. Its call
+// to itself is direct, as factorial is named local; without that it would
+// go through the PLT.
+func runCompileFunction() error {
+	fact := buildFactorial(builder.New()).GetFunction("factorial")
+	factObj, err := codegen.GenerateFunctionObject(fact, []string{"factorial"}, codegen.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	if err := verifyCallRelocs(map[string]elf.R_X86_64{"factorial": elf.R_X86_64_PC32})(factObj); err != nil {
+		return err
+	}
+	f, err := elf.NewFile(bytes.NewReader(factObj))
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	for _, sym := range syms {
+		if sym.Name == "main" {
+			return fmt.Errorf("the object of factorial alone defines main")
+		}
+	}
+	viaPLT, err := codegen.GenerateFunctionObject(fact, nil, codegen.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	if err := verifyCallRelocs(map[string]elf.R_X86_64{"factorial": elf.R_X86_64_PLT32})(viaPLT); err != nil {
+		return err
+	}
+
+	b := builder.New()
+	app := b.CreateModule("app")
+	decl := b.DeclareFunction("factorial", types.I32, []types.Type{types.I32}, false)
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	f5 := b.CreateCall(decl, []ir.Value{b.ConstInt(types.I32, 5)}, "f5")
+	b.CreateRet(b.CreateSub(f5, b.ConstInt(types.I32, 78), "r"))
+	if _, err := codegen.GenerateFunctionObject(decl, nil, codegen.DefaultOptions()); err == nil {
+		return fmt.Errorf("compiled the declaration of factorial")
+	}
+	mainObj, err := codegen.GenerateObject(app)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "function")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	factPath, mainPath := filepath.Join(dir, "factorial.o"), filepath.Join(dir, "main.o")
+	exePath := filepath.Join(dir, "program")
+	if err := os.WriteFile(factPath, factObj, 0644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(mainPath, mainObj, 0644); err != nil {
+		return err
+	}
+	if out, err := exec.Command("gcc", mainPath, factPath, "-o", exePath).CombinedOutput(); err != nil {
+		return fmt.Errorf("linking: %v\n%s", err, out)
+	}
+	err = exec.Command(exePath).Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 42 {
+		return fmt.Errorf("running the program: %v, want exit code 42", err)
+	}
+	return nil
+}
+
+// The likely arm of a weighted branch falls through from the branch, and
+// the unlikely one moves to the end of the function
+func runWeightedBranchLayout() error {
+	listing, err := codegen.GenerateListing(buildWeightedBranch(builder.New()))
+	if err != nil {
+		return err
+	}
+	blocks := listing.Functions[0].Blocks
+	var names []string
+	for _, blk := range blocks {
+		names = append(names, blk.Name)
+	}
+	if got := strings.Join(names, ","); got != "entry,likely,unlikely" {
+		return fmt.Errorf("block order %s, want entry,likely,unlikely", got)
+	}
+	entry := blocks[0].Instructions
+	if end := entry[len(entry)-1].End; blocks[1].Start != end {
+		return fmt.Errorf("likely block at %#x, want it right after the branch at %#x", blocks[1].Start, end)
+	}
+	return nil
+}
+
+// Out-of-range extractvalue/insertvalue indices, at the top level and
+// nested, fail compilation with an error instead of panicking
+func runAggregateIndexOutOfRange() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	pair := types.NewStruct("", []types.Type{types.I32, types.NewArray(types.I32, 3)}, false)
+	cases := map[string]func(b *builder.Builder, agg ir.Value){
+		"extract_field": func(b *builder.Builder, agg ir.Value) {
+			b.CreateExtractValue(agg, []int{2}, "e")
+		},
+		"extract_element": func(b *builder.Builder, agg ir.Value) {
+			b.CreateExtractValue(agg, []int{1, 3}, "e")
+		},
+		"extract_negative": func(b *builder.Builder, agg ir.Value) {
+			b.CreateExtractValue(agg, []int{1, -1}, "e")
+		},
+		"insert_element": func(b *builder.Builder, agg ir.Value) {
+			b.CreateInsertValue(agg, b.ConstInt(types.I32, 1), []int{1, 7}, "i")
+		},
+		"index_scalar": func(b *builder.Builder, agg ir.Value) {
+			b.CreateExtractValue(agg, []int{0, 0}, "e")
+		},
+	}
+
+	for name, build := range cases {
+		b := builder.New()
+		m := b.CreateModule("index_" + name)
+		b.CreateFunction("f", types.Void, nil, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		agg := b.CreateInsertValue(b.ConstUndef(pair), b.ConstInt(types.I32, 1), []int{0}, "agg")
+		build(b, agg)
+		b.CreateRetVoid()
+
+		if _, err := codegen.GenerateObject(m); err == nil {
+			return fmt.Errorf("%s compiled without error", name)
+		} else if !strings.Contains(err.Error(), "out of range") && !strings.Contains(err.Error(), "non-aggregate") {
+			return fmt.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// verifyColdSection checks the cold block's code is in .text.unlikely
+// under a local check.cold symbol, and the hot path reaches it through a
+// relocation
+func verifyColdSection(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	cold := f.Section(".text.unlikely")
+	if cold == nil {
+		return fmt.Errorf("no .text.unlikely section")
+	}
+	if cold.Flags&elf.SHF_EXECINSTR == 0 || cold.Size == 0 {
+		return fmt.Errorf(".text.unlikely has flags %v, size %d", cold.Flags, cold.Size)
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	for _, sym := range syms {
+		if sym.Name == "check.cold" {
+			if f.Sections[sym.Section] != cold || elf.ST_BIND(sym.Info) != elf.STB_LOCAL {
+				return fmt.Errorf("check.cold isn't a local symbol in .text.unlikely")
+			}
+			if sym.Size != cold.Size {
+				return fmt.Errorf("check.cold covers %d of %d bytes", sym.Size, cold.Size)
+			}
+			if f.Section(".rela.text.unlikely") == nil {
+				return fmt.Errorf("no .rela.text.unlikely for the jump back")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no check.cold symbol")
+}
+
+// A void function's ret leaves RAX alone; main reads the global bump()
+// updated instead of a return value
+func buildVoidSideEffects(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("void_side_effects")
+	counter := b.CreateGlobal("counter", types.I32, b.ConstInt(types.I32, 40))
+
+	bump := b.CreateFunction("bump", types.Void, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	v := b.CreateLoad(types.I32, counter, "v")
+	b.CreateStore(b.CreateAdd(v, b.ConstInt(types.I32, 1), "n"), counter)
+	b.CreateRetVoid()
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateCall(bump, nil, "")
+	b.CreateCall(bump, nil, "")
+	b.CreateRet(b.CreateLoad(types.I32, counter, "r"))
+	return m
+}
+
+// A ret that doesn't match the function's return type must fail
+// compilation rather than leave RAX undefined or clobber it
+func runReturnMismatch() error {
+	cases := map[string]struct {
+		ret types.Type
+		val func(b *builder.Builder) ir.Value
+	}{
+		"value_from_void": {types.Void, func(b *builder.Builder) ir.Value { return b.ConstInt(types.I32, 1) }},
+		"void_from_i32":   {types.I32, func(b *builder.Builder) ir.Value { return nil }},
+		"i64_from_i32":    {types.I32, func(b *builder.Builder) ir.Value { return b.ConstInt(types.I64, 1) }},
+	}
+	for name, tc := range cases {
+		b := builder.New()
+		m := b.CreateModule("ret_" + name)
+		b.CreateFunction("f", tc.ret, nil, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		if v := tc.val(b); v != nil {
+			b.CreateRet(v)
+		} else {
+			b.CreateRetVoid()
+		}
+
+		_, err := codegen.GenerateObject(m)
+		if err == nil {
+			return fmt.Errorf("%s compiled without error", name)
+		}
+		if !strings.Contains(err.Error(), "in function f") || !strings.Contains(err.Error(), "in a function returning") {
+			return fmt.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// A seq_cst fence between a store and a load is the one x86 needs an
+// instruction for
+func buildSeqCstFence(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("fence_seq_cst")
+	flag := b.CreateGlobal("flag", types.I32, b.ConstInt(types.I32, 0))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateStore(b.ConstInt(types.I32, 42), flag)
+	b.CreateFence(ir.SequentiallyConsistent)
+	b.CreateRet(b.CreateLoad(types.I32, flag, "r"))
+	return m
+}
+
+// Acquire, release and acq_rel fences are free under x86's memory model:
+// a function holding them compiles to the same bytes as one without
+func runWeakFences() error {
+	text := func(fences ...ir.AtomicOrdering) ([]byte, error) {
+		b := builder.New()
+		m := b.CreateModule("fences")
+		flag := b.CreateGlobal("flag", types.I32, b.ConstInt(types.I32, 0))
+		b.CreateFunction("f", types.I32, nil, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		b.CreateStore(b.ConstInt(types.I32, 1), flag)
+		for _, o := range fences {
+			b.CreateFence(o)
+		}
+		b.CreateRet(b.CreateLoad(types.I32, flag, "r"))
+
+		obj, err := codegen.GenerateObject(m)
+		if err != nil {
+			return nil, err
+		}
+		f, err := elf.NewFile(bytes.NewReader(obj))
+		if err != nil {
+			return nil, err
+		}
+		return f.Section(".text").Data()
+	}
+
+	plain, err := text()
+	if err != nil {
+		return err
+	}
+	weak, err := text(ir.Acquire, ir.Release, ir.AcquireRelease)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(plain, weak) {
+		return fmt.Errorf("weak fences emitted code: % x vs % x", weak, plain)
+	}
+	strong, err := text(ir.SequentiallyConsistent)
+	if err != nil {
+		return err
+	}
+	if len(strong) != len(plain)+3 || !bytes.Contains(strong, []byte{0x0F, 0xAE, 0xF0}) {
+		return fmt.Errorf("seq_cst fence isn't a lone mfence: % x", strong)
+	}
+
+	if _, err := text(ir.Monotonic); err == nil {
+		return fmt.Errorf("monotonic fence compiled without error")
+	}
+	return nil
+}
+
+// A constant table of function pointers holds addresses the dynamic loader
+// writes, so it lands in .data.rel.ro rather than .rodata, and a shared
+// library built from it dispatches through the relocated entries
+func runRelroTable() error {
+	b := builder.New()
+	m := b.CreateModule("relro")
+	unary := types.NewFunction(types.I32, []types.Type{types.I32}, false)
+	fnPtr := types.NewPointer(unary)
+
+	var entries []ir.Constant
+	for _, def := range []struct {
+		name string
+		op   func(x ir.Value) ir.Value
+	}{
+		{"inc", func(x ir.Value) ir.Value { return b.CreateAdd(x, b.ConstInt(types.I32, 1), "r") }},
+		{"twice", func(x ir.Value) ir.Value { return b.CreateAdd(x, x, "r") }},
+	} {
+		fn := b.CreateFunction(def.name, types.I32, []types.Type{types.I32}, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		b.CreateRet(def.op(fn.Arguments[0]))
+		entries = append(entries, fn)
+	}
+	ops := b.CreateGlobalConstant("ops", b.ConstArray(fnPtr, entries))
+	ops.Visibility = ir.HiddenVisibility // Addressed PC-relative from api
+
+	api := b.CreateFunction("api", types.I32, []types.Type{types.I64, types.I32}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	slot := b.CreateGEP(fnPtr, ops, []ir.Value{api.Arguments[0]}, "slot")
+	callee := b.CreateLoad(fnPtr, slot, "callee")
+	b.CreateRet(b.CreateIndirectCall(unary, callee, []ir.Value{api.Arguments[1]}, "r"))
+
+	obj, err := codegen.GenerateObject(m)
+	if err != nil {
+		return err
+	}
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	relro := f.Section(".data.rel.ro")
+	if relro == nil {
+		return fmt.Errorf("no .data.rel.ro section")
+	}
+	if relro.Flags != elf.SHF_ALLOC|elf.SHF_WRITE || relro.Size != 16 {
+		return fmt.Errorf(".data.rel.ro has flags %v and size %d", relro.Flags, relro.Size)
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	for _, sym := range syms {
+		if sym.Name == "ops" && f.Sections[sym.Section] != relro {
+			return fmt.Errorf("ops is in %s", f.Sections[sym.Section].Name)
+		}
+	}
+	rela := f.Section(".rela.data.rel.ro")
+	if rela == nil || rela.Size != 2*24 || f.Sections[rela.Info] != relro {
+		return fmt.Errorf("missing or wrong .rela.data.rel.ro: %+v", rela)
+	}
+
+	dir, err := os.MkdirTemp("", "relro")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	objPath := filepath.Join(dir, "relro.o")
+	libPath := filepath.Join(dir, "librelro.so")
+	if err := os.WriteFile(objPath, obj, 0644); err != nil {
+		return err
+	}
+	if out, err := exec.Command("gcc", "-shared", objPath, "-o", libPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("gcc -shared: %v\n%s", err, out)
+	}
+
+	cPath := filepath.Join(dir, "main.c")
+	exePath := filepath.Join(dir, "main")
+	src := "int api(long, int);\nint main(void) { return api(0, 13) + api(1, 14); }\n"
+	if err := os.WriteFile(cPath, []byte(src), 0644); err != nil {
+		return err
+	}
+	if out, err := exec.Command("gcc", cPath, libPath, "-Wl,-rpath,"+dir, "-o", exePath).CombinedOutput(); err != nil {
+		return fmt.Errorf("linking against the library: %v\n%s", err, out)
+	}
+	err = exec.Command(exePath).Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 42 {
+		return fmt.Errorf("api() through the table: %v, want exit code 42", err)
+	}
+	return nil
+}
+
+// The canonical encodings of the arithmetic the backend emits decode back
+// to their instructions without objdump
+func runDisassembleText() error {
+	cases := []struct {
+		code []byte
+		want string
+	}{
+		{[]byte{0x48, 0x01, 0xC8}, "add rax, rcx"},
+		{[]byte{0x48, 0x29, 0xC8}, "sub rax, rcx"},
+		{[]byte{0x48, 0x0F, 0xAF, 0xC1}, "imul rax, rcx"},
+		{[]byte{0x48, 0x21, 0xC8}, "and rax, rcx"},
+		{[]byte{0x48, 0x09, 0xC8}, "or rax, rcx"},
+		{[]byte{0x48, 0x31, 0xC8}, "xor rax, rcx"},
+		{[]byte{0x48, 0x39, 0xC8}, "cmp rax, rcx"},
+		{[]byte{0x48, 0x83, 0xC0, 0x10}, "add rax, 0x10"},
+		{[]byte{0x48, 0x83, 0xE4, 0xF0}, "and rsp, -0x10"},
+		{[]byte{0x48, 0x05, 0x00, 0x00, 0x01, 0x00}, "add rax, 0x10000"},
+		{[]byte{0x48, 0x6B, 0xC0, 0x0C}, "imul rax, rax, 0xc"},
+		{[]byte{0x48, 0xF7, 0xF9}, "idiv rcx"},
+		{[]byte{0x48, 0xF7, 0xF1}, "div rcx"},
+		{[]byte{0x48, 0xF7, 0xD8}, "neg rax"},
+		{[]byte{0x48, 0xF7, 0xD0}, "not rax"},
+		{[]byte{0x48, 0x99}, "cqo"},
+		{[]byte{0x48, 0xD3, 0xE0}, "shl rax, cl"},
+		{[]byte{0x48, 0xD3, 0xE8}, "shr rax, cl"},
+		{[]byte{0x48, 0xC1, 0xF8, 0x3F}, "sar rax, 0x3f"},
+		{[]byte{0x48, 0x63, 0xC0}, "movsxd rax, eax"},
+		{[]byte{0x48, 0x0F, 0xB6, 0xC0}, "movzx rax, al"},
+		{[]byte{0x40, 0x0F, 0xB6, 0xC7}, "movzx eax, dil"},
+		{[]byte{0x48, 0x8B, 0x85, 0xF8, 0xFF, 0xFF, 0xFF}, "mov rax, qword ptr [rbp-0x8]"},
+		{[]byte{0x66, 0x89, 0x01}, "mov word ptr [rcx], ax"},
+		{[]byte{0x48, 0x8D, 0x04, 0x81}, "lea rax, [rcx+rax*4]"},
+		{[]byte{0x0F, 0x94, 0xC0}, "sete al"},
+		{[]byte{0xF2, 0x0F, 0x58, 0xC1}, "addsd xmm0, xmm1"},
+		{[]byte{0xF3, 0x0F, 0x5C, 0xC1}, "subss xmm0, xmm1"},
+		{[]byte{0xF2, 0x0F, 0x59, 0xC1}, "mulsd xmm0, xmm1"},
+		{[]byte{0xF2, 0x0F, 0x5E, 0xC1}, "divsd xmm0, xmm1"},
+		{[]byte{0x66, 0x0F, 0x2E, 0xC1}, "ucomisd xmm0, xmm1"},
+		{[]byte{0xF2, 0x48, 0x0F, 0x2A, 0xC0}, "cvtsi2sd xmm0, rax"},
+		{[]byte{0xC5, 0xFB, 0x58, 0xC1}, "vaddsd xmm0, xmm0, xmm1"},
+		{[]byte{0xC4, 0xE2, 0xF1, 0xA9, 0xC2}, "vfmadd213sd xmm0, xmm1, xmm2"},
+		{[]byte{0xDB, 0xAD, 0xF0, 0xFF, 0xFF, 0xFF}, "fld tbyte ptr [rbp-0x10]"},
+		{[]byte{0xDD, 0x9D, 0xF8, 0xFF, 0xFF, 0xFF}, "fstp qword ptr [rbp-0x8]"},
+		{[]byte{0xDE, 0xC9}, "fmulp st(1), st"},
+		{[]byte{0xD9, 0xE0}, "fchs"},
+		{[]byte{0x0F, 0xAE, 0xF0}, "mfence"},
+	}
+	for _, tc := range cases {
+		got, err := codegen.DisassembleText(tc.code)
+		if err != nil {
+			return fmt.Errorf("% x: %v", tc.code, err)
+		}
+		if len(got) != 1 || got[0] != tc.want {
+			return fmt.Errorf("% x decoded as %q, want %q", tc.code, got, tc.want)
+		}
+	}
+
+	// Branch targets are offsets into the code
+	got, err := codegen.DisassembleText([]byte{0x75, 0x02, 0x90, 0x90, 0xE9, 0xF7, 0xFF, 0xFF, 0xFF})
+	if err != nil {
+		return err
+	}
+	if want := []string{"jne 0x4", "nop", "nop", "jmp 0x0"}; strings.Join(got, "; ") != strings.Join(want, "; ") {
+		return fmt.Errorf("branches decoded as %q, want %q", got, want)
+	}
+
+	// What addOp emits for two variables, found through the listing
+	b := builder.New()
+	m := b.CreateModule("disassemble_add")
+	fn := b.CreateFunction("add", types.I64, []types.Type{types.I64, types.I64}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateAdd(fn.Arguments[0], fn.Arguments[1], "sum"))
+	l, err := codegen.GenerateListing(m)
+	if err != nil {
+		return err
+	}
+	var add []string
+	for _, b := range l.Functions[0].Blocks {
+		for _, inst := range b.Instructions {
+			if strings.Contains(inst.IR, "%sum") {
+				if add, err = codegen.DisassembleText(inst.Bytes); err != nil {
+					return fmt.Errorf("%s: %v", inst.IR, err)
+				}
+			}
+		}
+	}
+	if len(add) == 0 || !strings.Contains(strings.Join(add, "\n"), "add rax, rcx") {
+		return fmt.Errorf("the add lowered to %q, want add rax, rcx among them", add)
+	}
+
+	if _, err := codegen.DisassembleText([]byte{0x48, 0x8B, 0x85, 0xF8}); err == nil || !strings.Contains(err.Error(), "offset 0x0") {
+		return fmt.Errorf("truncated instruction: got error %v", err)
+	}
+	return nil
+}
+
+// extern int shared_counter; defined by the C object linked in
+func buildExternGlobal(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("extern_global")
+	counter := b.CreateGlobal("shared_counter", types.I32, nil)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	v := b.CreateLoad(types.I32, counter, "v")
+	b.CreateStore(b.CreateAdd(v, b.ConstInt(types.I32, 2), "n"), counter)
+	b.CreateRet(b.CreateLoad(types.I32, counter, "r"))
+	return m
+}
+
+// The declared global is an undefined object symbol with no storage here
+func verifyExternGlobal(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	if sec := f.Section(".data"); sec != nil {
+		return fmt.Errorf("a declaration reserved %d bytes of .data", sec.Size)
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	for _, sym := range syms {
+		if sym.Name != "shared_counter" {
+			continue
+		}
+		if sym.Section != elf.SHN_UNDEF || elf.ST_BIND(sym.Info) != elf.STB_GLOBAL || elf.ST_TYPE(sym.Info) != elf.STT_OBJECT {
+			return fmt.Errorf("shared_counter: section %v, binding %v, type %v",
+				sym.Section, elf.ST_BIND(sym.Info), elf.ST_TYPE(sym.Info))
+		}
+		return nil
+	}
+	return fmt.Errorf("no shared_counter symbol")
+}
+
+// A leaf with a local and a stack-passed seventh argument, called from a
+// main that, making a call, keeps its frame pointer
+func buildLeafFrame(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("leaf_frame")
+	params := []types.Type{types.I64, types.I64, types.I64, types.I64, types.I64, types.I64, types.I64}
+	leaf := b.CreateFunction("leaf", types.I64, params, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	slot := b.CreateAlloca(types.I64, "slot")
+	b.CreateStore(leaf.Arguments[6], slot)
+	var sum ir.Value = b.CreateLoad(types.I64, slot, "g")
+	for _, arg := range leaf.Arguments[:6] {
+		sum = b.CreateAdd(sum, arg, "")
+	}
+	b.CreateRet(sum)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	var args []ir.Value
+	for _, v := range []int64{1, 2, 3, 4, 5, 6, 21} {
+		args = append(args, b.ConstInt(types.I64, v))
+	}
+	r := b.CreateCall(leaf, args, "r")
+	b.CreateRet(b.CreateTrunc(r, types.I32, "t"))
+	return m
+}
+
+// leaf starts with its sub rsp, not push rbp; main still pushes RBP
+func verifyLeafFrame(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	text, err := f.Section(".text").Data()
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	starts := make(map[string]byte)
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Value < uint64(len(text)) {
+			starts[sym.Name] = text[sym.Value]
+		}
+	}
+	if op, ok := starts["leaf"]; !ok || op == 0x55 {
+		return fmt.Errorf("leaf begins with %#02x, want no push rbp", op)
+	}
+	if op := starts["main"]; op != 0x55 {
+		return fmt.Errorf("main begins with %#02x, want push rbp", op)
+	}
+	return nil
+}
+
+// foo is defined; bar is only declared, and comes from an alias of foo
+func buildAliasCalls(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("alias_calls")
+	foo := b.CreateFunction("foo", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.ConstInt(types.I32, 21))
+	bar := b.DeclareFunction("bar", types.I32, nil, false)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	x := b.CreateCall(foo, nil, "x")
+	y := b.CreateCall(bar, nil, "y")
+	b.CreateRet(b.CreateAdd(x, y, "r"))
+	return m
+}
+
+// bar is a weak function symbol at foo's address, with foo's size
+func verifyWeakAlias(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]elf.Symbol)
+	for _, sym := range syms {
+		byName[sym.Name] = sym
+	}
+	foo, bar := byName["foo"], byName["bar"]
+	if elf.ST_BIND(bar.Info) != elf.STB_WEAK || elf.ST_TYPE(bar.Info) != elf.STT_FUNC {
+		return fmt.Errorf("bar: binding %v, type %v", elf.ST_BIND(bar.Info), elf.ST_TYPE(bar.Info))
+	}
+	if bar.Section != foo.Section || bar.Value != foo.Value || bar.Size != foo.Size {
+		return fmt.Errorf("bar is at %v+%#x size %d, foo at %v+%#x size %d",
+			bar.Section, bar.Value, bar.Size, foo.Section, foo.Value, foo.Size)
+	}
+	return nil
+}
+
+// Compare-chain switches on i32 and i8 with the case value 200, which a
+// sign-extended imm8 would read as -56
+func buildSwitchCase200(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("switch_case_200")
+	classify := func(name string, t types.Type, cases map[int64]int64) *ir.Function {
+		fn := b.CreateFunction(name, types.I32, []types.Type{t}, false)
+		entry := b.CreateBlock("entry")
+		def := b.CreateBlock("default")
+		b.SetInsertPoint(def)
+		b.CreateRet(b.ConstInt(types.I32, 0))
+
+		x := fn.Arguments[0]
+		sw := &ir.SwitchInst{
+			BaseInstruction: ir.BaseInstruction{
+				Op:  ir.OpSwitch,
+				Ops: []ir.Value{x},
+			},
+			Condition:    x,
+			DefaultBlock: def,
+		}
+		for _, v := range []int64{7, 200, -1} {
+			r, ok := cases[v]
+			if !ok {
+				continue
+			}
+			block := b.CreateBlock(fmt.Sprintf("case%d", v))
+			b.SetInsertPoint(block)
+			b.CreateRet(b.ConstInt(types.I32, r))
+			sw.Cases = append(sw.Cases, ir.SwitchCase{Value: b.ConstInt(t, v), Block: block})
+		}
+		entry.AddInstruction(sw)
+		return fn
+	}
+	wide := classify("classify32", types.I32, map[int64]int64{7: 1, 200: 20, -1: 2})
+	narrow := classify("classify8", types.I8, map[int64]int64{7: 1, 200: 20})
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	x := b.CreateCall(wide, []ir.Value{b.ConstInt(types.I32, 200)}, "x")
+	y := b.CreateCall(narrow, []ir.Value{b.ConstInt(types.I8, 200)}, "y")
+	z := b.CreateCall(wide, []ir.Value{b.ConstInt(types.I32, -1)}, "z")
+	b.CreateRet(b.CreateAdd(b.CreateAdd(x, y, "xy"), z, "r"))
+	return m
+}
+
+// Equal strings give one global, which compiles to a local symbol in the
+// string section
+func runBuildCString() error {
+	b := builder.New()
+	m := b.CreateModule("build_cstring")
+	hello := codegen.BuildCString(b, m, "hello")
+	if again := codegen.BuildCString(b, m, "hello"); again != hello {
+		return fmt.Errorf("the second \"hello\" is %s, not %s", again.Name(), hello.Name())
+	}
+	if other := codegen.BuildCString(b, m, "world"); other == hello {
+		return fmt.Errorf("\"world\" reused %s", hello.Name())
+	}
+	if len(m.Globals) != 2 {
+		return fmt.Errorf("%d globals for two distinct strings", len(m.Globals))
+	}
+
+	b.CreateFunction("first", types.I8, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateLoad(types.I8, hello, "c"))
+	obj, err := codegen.GenerateObject(m)
+	if err != nil {
+		return err
+	}
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	for _, sym := range syms {
+		if sym.Name != hello.Name() {
+			continue
+		}
+		if sec := f.Sections[sym.Section]; sec.Name != ".rodata.str1.1" || elf.ST_BIND(sym.Info) != elf.STB_LOCAL {
+			return fmt.Errorf("%s: section %s, binding %v", sym.Name, sec.Name, elf.ST_BIND(sym.Info))
+		}
+		return nil
+	}
+	return fmt.Errorf("no %s symbol", hello.Name())
+}
+
+// A table of 8-byte entries on a 16-byte boundary, after an odd-sized
+// section that sets no alignment
+func runCustomSectionLayout() error {
+	f := elfwriter.NewFile()
+	f.AddSection(".text", elfwriter.SHT_PROGBITS, elfwriter.SHF_ALLOC|elfwriter.SHF_EXECINSTR, []byte{0x90, 0x90, 0xC3})
+	table := f.AddSection(".table", elfwriter.SHT_PROGBITS, elfwriter.SHF_ALLOC, make([]byte, 24))
+	table.Addralign = 16
+	table.Entsize = 8
+
+	var buf bytes.Buffer
+	if err := f.WriteTo(&buf); err != nil {
+		return err
+	}
+	ef, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	text, tab := ef.Section(".text"), ef.Section(".table")
+	if text.Addralign != 1 {
+		return fmt.Errorf(".text alignment %d, want the default of 1", text.Addralign)
+	}
+	if tab.Addralign != 16 || tab.Entsize != 8 || tab.Size != 24 {
+		return fmt.Errorf(".table: align %d, entsize %d, size %d", tab.Addralign, tab.Entsize, tab.Size)
+	}
+	if tab.Offset%16 != 0 || tab.Offset < text.Offset+text.Size {
+		return fmt.Errorf(".table at file offset %#x, .text ends at %#x", tab.Offset, text.Offset+text.Size)
+	}
+
+	// Partial entries and odd alignments are rejected
+	f = elfwriter.NewFile()
+	f.AddSection(".table", elfwriter.SHT_PROGBITS, elfwriter.SHF_ALLOC, make([]byte, 20)).Entsize = 8
+	if err := f.WriteTo(io.Discard); err == nil || !strings.Contains(err.Error(), "entry size") {
+		return fmt.Errorf("20 bytes of 8-byte entries: got error %v", err)
+	}
+	f = elfwriter.NewFile()
+	f.AddSection(".table", elfwriter.SHT_PROGBITS, elfwriter.SHF_ALLOC, make([]byte, 24)).Addralign = 12
+	if err := f.WriteTo(io.Discard); err == nil || !strings.Contains(err.Error(), "power of two") {
+		return fmt.Errorf("alignment 12: got error %v", err)
+	}
+	return nil
+}
+
+// int arr[5] = {10, 20, 30, 42, 50}; int *p = &arr[3]; main returns *p
+func buildConstantGEP(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("constant_gep")
+	arrType := types.NewArray(types.I32, 5)
+	var elems []ir.Constant
+	for _, v := range []int64{10, 20, 30, 42, 50} {
+		elems = append(elems, b.ConstInt(types.I32, v))
+	}
+	arr := b.CreateGlobal("arr", arrType, b.ConstArray(arrType, elems))
+	third := &ir.ConstantExpr{
+		Op:                ir.OpGetElementPtr,
+		Ops:               []ir.Value{arr},
+		Indices:           []ir.Value{b.ConstInt(types.I64, 0), b.ConstInt(types.I64, 3)},
+		SourceElementType: arrType,
+	}
+	ptr := types.NewPointer(types.I32)
+	p := b.CreateGlobal("p", ptr, third)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	addr := b.CreateLoad(ptr, p, "addr")
+	b.CreateRet(b.CreateLoad(types.I32, addr, "v"))
+	return m
+}
+
+// p is relocated against arr with an addend of 3*4
+func verifyConstantGEP(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	rela := f.Section(".rela.data")
+	if rela == nil {
+		return fmt.Errorf("no .rela.data")
+	}
+	data, err := rela.Data()
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	for ; len(data) >= 24; data = data[24:] {
+		info := binary.LittleEndian.Uint64(data[8:])
+		addend := int64(binary.LittleEndian.Uint64(data[16:]))
+		sym := syms[info>>32-1]
+		if elf.R_X86_64(info&0xFFFFFFFF) == elf.R_X86_64_64 && sym.Name == "arr" && addend == 12 {
+			return nil
+		}
+	}
+	return fmt.Errorf("no R_X86_64_64 against arr+12")
+}
+
+// The factorial module's .s is all instructions, calls through the PLT
+// included, with none left as .byte. runTest puts every module's .s
+// through as; here so does one whose global and callee as would read as
+// a register and an operator
+func runAssemblyFileRoundTrip() error {
+	src, err := codegen.GenerateAssemblyFile(buildFactorial(builder.New()), codegen.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	if strings.Contains(src, ".byte") {
+		return fmt.Errorf("factorial.s has code left as .byte:\n%s", src)
+	}
+
+	opts := codegen.CompileOptions{UnwindTables: true}
+	obj, err := codegen.GenerateObjectWithOptions(buildRegisterNamedGlobal(builder.New()), opts)
+	if err != nil {
+		return err
+	}
+	return checkAssemblyFile(buildRegisterNamedGlobal(builder.New()), opts, obj)
+}
+
+// A global named like a segment register, read and called through
+func buildRegisterNamedGlobal(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("register_named_global")
+	ds := b.CreateGlobal("ds", types.I32, b.ConstInt(types.I32, 40))
+	and := b.DeclareFunction("and", types.I32, nil, false)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	r := b.CreateAdd(b.CreateLoad(types.I32, ds, "v"), b.CreateCall(and, nil, "a"), "r")
+	b.CreateRet(r)
+	return m
+}
+
+// checkAssemblyFile puts m's .s through as and compares the result with
+// obj, m compiled directly: every section's bytes, every relocation and
+// every symbol
+func checkAssemblyFile(m *ir.Module, opts codegen.CompileOptions, obj []byte) error {
+	src, err := codegen.GenerateAssemblyFile(m, opts)
+	if err != nil {
+		return fmt.Errorf("assembly file: %v", err)
+	}
+	dir, err := os.MkdirTemp("", "asmfile")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	srcPath, objPath := filepath.Join(dir, m.Name+".s"), filepath.Join(dir, m.Name+".o")
+	if err := os.WriteFile(srcPath, []byte(src), 0644); err != nil {
+		return err
+	}
+	if out, err := exec.Command("as", "--fatal-warnings", "-o", objPath, srcPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s.s: as: %v\n%s", m.Name, err, out)
+	}
+	assembled, err := os.ReadFile(objPath)
+	if err != nil {
+		return err
+	}
+
+	want, err := objectSummary(obj)
+	if err != nil {
+		return err
+	}
+	got, err := objectSummary(assembled)
+	if err != nil {
+		return fmt.Errorf("%s.s: assembled object: %v", m.Name, err)
+	}
+	if got != want {
+		return fmt.Errorf("%s.s assembles to a different object:\n%s", m.Name, lineDiff(got, want))
+	}
+	return nil
+}
+
+// objectSummary prints what of an object its .s reproduces, sorted so
+// the order as writes things in doesn't matter: the bytes of the sections
+// holding code and data, the relocations against them, and the symbols
+func objectSummary(obj []byte) (string, error) {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return "", err
+	}
+	syms, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return "", err
+	}
+	var lines []string
+	for _, sec := range f.Sections {
+		if sec.Size == 0 {
+			// as starts every file with an empty .data and .bss
+			continue
+		}
+		switch sec.Type {
+		case elf.SHT_PROGBITS, elf.SHT_NOTE:
+			data, err := sec.Data()
+			if err != nil {
+				return "", err
+			}
+			lines = append(lines, fmt.Sprintf("section %s %v % x", sec.Name, sec.Flags, data))
+		case elf.SHT_NOBITS:
+			lines = append(lines, fmt.Sprintf("section %s %v size %d", sec.Name, sec.Flags, sec.Size))
+		case elf.SHT_RELA:
+			data, err := sec.Data()
+			if err != nil {
+				return "", err
+			}
+			for ; len(data) >= 24; data = data[24:] {
+				info := binary.LittleEndian.Uint64(data[8:])
+				sym := syms[info>>32-1]
+				name := sym.Name
+				if elf.ST_TYPE(sym.Info) == elf.STT_SECTION {
+					name = f.Sections[sym.Section].Name
+				}
+				lines = append(lines, fmt.Sprintf("reloc %s %#x %v %s%+d", f.Sections[sec.Info].Name,
+					binary.LittleEndian.Uint64(data), elf.R_X86_64(uint32(info)), name,
+					int64(binary.LittleEndian.Uint64(data[16:]))))
+			}
+		}
+	}
+	for _, sym := range syms {
+		t := elf.ST_TYPE(sym.Info)
+		if t == elf.STT_SECTION || t == elf.STT_FILE {
+			continue
+		}
+		where := "undefined"
+		switch {
+		case sym.Section == elf.SHN_COMMON:
+			where = "common"
+		case sym.Section != elf.SHN_UNDEF && int(sym.Section) < len(f.Sections):
+			where = f.Sections[sym.Section].Name
+		}
+		lines = append(lines, fmt.Sprintf("symbol %s %s %#x+%d %v %v %v", sym.Name, where, sym.Value, sym.Size,
+			elf.ST_BIND(sym.Info), t, elf.ST_VISIBILITY(sym.Other)))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n"), nil
+}
+
+// lineDiff lists the lines only got or only want has
+func lineDiff(got, want string) string {
+	count := make(map[string]int)
+	for _, l := range strings.Split(want, "\n") {
+		count[l]++
+	}
+	for _, l := range strings.Split(got, "\n") {
+		count[l]--
+	}
+	var sb strings.Builder
+	for _, l := range strings.Split(got+"\n"+want, "\n") {
+		switch n := count[l]; {
+		case n < 0:
+			fmt.Fprintf(&sb, "got:  %s\n", l)
+		case n > 0:
+			fmt.Fprintf(&sb, "want: %s\n", l)
+		}
+		count[l] = 0
+	}
+	return sb.String()
+}
+
+// Loop accumulating into an f64 phi, alongside a pair of f32 phis that
+// swap on every back-edge: 0.5 + 16*2.5 + 1.5 = 42.0
+func buildFloatPhiLoop(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("float_phi_loop")
+
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	loop := b.CreateBlock("loop")
+	exit := b.CreateBlock("exit")
+
+	b.SetInsertPoint(entry)
+	b.CreateBr(loop)
+
+	b.SetInsertPoint(loop)
+	i := b.CreatePhi(types.I32, "i")
+	acc := b.CreatePhi(types.F64, "acc")
+	p := b.CreatePhi(types.F32, "p")
+	q := b.CreatePhi(types.F32, "q")
+	sum := b.CreateFAdd(acc, b.ConstFloat(types.F64, 2.5), "sum")
+	next := b.CreateAdd(i, b.ConstInt(types.I32, 1), "next")
+	done := b.CreateICmpSGE(next, b.ConstInt(types.I32, 16), "done")
+	b.CreateCondBr(done, exit, loop)
+
+	i.AddIncoming(b.ConstInt(types.I32, 0), entry)
+	i.AddIncoming(next, loop)
+	acc.AddIncoming(b.ConstFloat(types.F64, 0.5), entry)
+	acc.AddIncoming(sum, loop)
+	p.AddIncoming(b.ConstFloat(types.F32, 1.5), entry)
+	p.AddIncoming(q, loop)
+	q.AddIncoming(b.ConstFloat(types.F32, 0), entry)
+	q.AddIncoming(p, loop)
+
+	// After 15 back-edges the swapped pair has p = 0, q = 1.5
+	b.SetInsertPoint(exit)
+	total := b.CreateFAdd(sum, b.CreateFPExt(q, types.F64, "qd"), "total")
+	b.CreateRet(b.CreateFPToSI(total, types.I32, "r"))
+
+	return m
+}
+
+// Divisions at the top of each width's unsigned range, and a signed and an
+// i8 one, through function arguments so the operands come from the stack.
+// Each check that holds adds 2 to 32.
+func buildUnsignedDivideRange(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("unsigned_divide_range")
+
+	divider := func(name string, t types.Type, op func(l, r ir.Value, n string) *ir.BinaryInst) *ir.Function {
+		fn := b.CreateFunction(name, t, []types.Type{t, t}, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		b.CreateRet(op(fn.Arguments[0], fn.Arguments[1], "r"))
+		return fn
+	}
+	udiv32 := divider("udiv32", types.I32, b.CreateUDiv)
+	udiv64 := divider("udiv64", types.I64, b.CreateUDiv)
+	urem64 := divider("urem64", types.I64, b.CreateURem)
+	sdiv32 := divider("sdiv32", types.I32, b.CreateSDiv)
+	udiv8 := divider("udiv8", types.I8, b.CreateUDiv)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	checks := []struct {
+		fn         *ir.Function
+		t          types.Type
+		l, r, want int64
+	}{
+		{udiv32, types.I32, 0xFFFFFFFF, 3, 0x55555555},
+		{udiv64, types.I64, -1, 3, 0x5555555555555555}, // 0xFFFFFFFFFFFFFFFF / 3
+		{urem64, types.I64, -1, 10, 5},
+		{sdiv32, types.I32, -7, 2, -3},
+		{udiv8, types.I8, 200, 7, 28},
+	}
+	var r ir.Value = b.ConstInt(types.I32, 32)
+	for _, c := range checks {
+		got := b.CreateCall(c.fn, []ir.Value{b.ConstInt(c.t, c.l), b.ConstInt(c.t, c.r)}, c.fn.Name())
+		ok := b.CreateZExt(b.CreateICmpEQ(got, b.ConstInt(c.t, c.want), "eq"), types.I32, "ok")
+		r = b.CreateAdd(r, b.CreateMul(ok, b.ConstInt(types.I32, 2), "two"), "r")
+	}
+	b.CreateRet(r)
+
+	return m
+}
+
+// verifyFunctionAlign checks that every function starts on a 64-byte
+// boundary and that the gaps between them decode as nops
+func verifyFunctionAlign(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	sec := f.Section(".text")
+	if sec.Addralign < 64 {
+		return fmt.Errorf(".text is aligned to %d, want at least 64", sec.Addralign)
+	}
+	text, err := sec.Data()
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	var funcs []elf.Symbol
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && int(sym.Section) < len(f.Sections) && f.Sections[sym.Section] == sec {
+			funcs = append(funcs, sym)
+		}
+	}
+	if len(funcs) < 2 {
+		return fmt.Errorf("found %d functions, want several", len(funcs))
+	}
+	for _, sym := range funcs {
+		if sym.Value%64 != 0 {
+			return fmt.Errorf("%s starts at %#x, not on a 64-byte boundary", sym.Name, sym.Value)
+		}
+		end := uint64(len(text))
+		for _, next := range funcs {
+			if next.Value > sym.Value && next.Value < end {
+				end = next.Value
+			}
+		}
+		if end == uint64(len(text)) {
+			continue
+		}
+		pad, err := codegen.DisassembleText(text[sym.Value+sym.Size : end])
+		if err != nil {
+			return fmt.Errorf("padding after %s: %v", sym.Name, err)
+		}
+		if gap := end - sym.Value - sym.Size; len(pad) > int(gap+8)/9 {
+			return fmt.Errorf("%d bytes of padding after %s take %d instructions", gap, sym.Name, len(pad))
+		}
+		for _, inst := range pad {
+			if !strings.HasPrefix(inst, "nop") {
+				return fmt.Errorf("padding after %s holds %q", sym.Name, inst)
+			}
+		}
+	}
+	return nil
+}
+
+// Casts that keep the width, and an i8 of 0xFF taken from an i64 and
+// zero-extended back, whose upper 56 bits must come out clear. Each check
+// that holds adds 2 to 32.
+func buildSameWidthCasts(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("same_width_casts")
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	wide := b.CreateAlloca(types.I64, "wide")
+	b.CreateStore(b.ConstInt(types.I64, 0x1234567890ABCDFF), wide)
+	w := b.CreateLoad(types.I64, wide, "w")
+	x := b.CreateTrunc(w, types.I32, "x") // 0x90ABCDFF
+
+	byteVal := b.CreateTrunc(w, types.I8, "byte")
+	zext := b.CreateZExt(byteVal, types.I64, "zext")
+	checks := []ir.Value{
+		b.CreateICmpEQ(b.CreateZExt(x, types.I32, "zx"), x, "zx_ok"),
+		b.CreateICmpEQ(b.CreateSExt(w, types.I64, "sw"), w, "sw_ok"),
+		b.CreateICmpEQ(b.CreateTrunc(x, types.I32, "tx"), b.ConstInt(types.I32, 0x90ABCDFF), "tx_ok"),
+		b.CreateICmpEQ(zext, b.ConstInt(types.I64, 0xFF), "zext_ok"),
+		b.CreateICmpEQ(b.CreateLShr(zext, b.ConstInt(types.I64, 8), "high"), b.ConstInt(types.I64, 0), "high_ok"),
+	}
+	var r ir.Value = b.ConstInt(types.I32, 32)
+	for _, ok := range checks {
+		bit := b.CreateZExt(ok, types.I32, "bit")
+		r = b.CreateAdd(r, b.CreateMul(bit, b.ConstInt(types.I32, 2), "two"), "r")
+	}
+	b.CreateRet(r)
+
+	return m
+}
+
+// A module with initialized data, a pointer relocated into it, a call and
+// a large zeroed array last, so its executable has a .bss-like tail
+func buildStaticProgram(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("static_program")
+
+	arrType := types.NewArray(types.I64, 4)
+	var elems []ir.Constant
+	for _, v := range []int64{10, 20, 5, 7} {
+		elems = append(elems, b.ConstInt(types.I64, v))
+	}
+	table := b.CreateGlobal("table", arrType, b.ConstArray(arrType, elems))
+	ptr := types.NewPointer(types.I64)
+	tablePtr := b.CreateGlobal("table_ptr", ptr, table)
+	scratchType := types.NewArray(types.I64, 1024)
+	scratch := b.CreateGlobal("scratch", scratchType, b.ConstZero(scratchType))
+
+	sum := b.CreateFunction("sum", types.I64, []types.Type{ptr}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	var total ir.Value = b.ConstInt(types.I64, 0)
+	for i := int64(0); i < 4; i++ {
+		p := b.CreateGEP(types.I64, sum.Arguments[0], []ir.Value{b.ConstInt(types.I64, i)}, "p")
+		total = b.CreateAdd(total, b.CreateLoad(types.I64, p, "v"), "total")
+	}
+	b.CreateRet(total)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	t := b.CreateCall(sum, []ir.Value{b.CreateLoad(ptr, tablePtr, "t")}, "sum")
+	slot := b.CreateGEP(types.I64, scratch, []ir.Value{b.ConstInt(types.I64, 1000)}, "slot")
+	b.CreateStore(t, slot)
+	b.CreateRet(b.CreateTrunc(b.CreateLoad(types.I64, slot, "r"), types.I32, "r32"))
+
+	return m
+}
+
+// runStaticExecutable builds an executable with no linker, checks its
+// segments are page-aligned the way the kernel needs, and runs it
+func runStaticExecutable() error {
+	exe, err := codegen.GenerateExecutable(buildStaticProgram(builder.New()), "")
+	if err != nil {
+		return err
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(exe))
+	if err != nil {
+		return err
+	}
+	if f.Type != elf.ET_EXEC {
+		return fmt.Errorf("file type %v, want ET_EXEC", f.Type)
+	}
+	var loads []*elf.Prog
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD {
+			loads = append(loads, p)
+		}
+	}
+	if len(loads) != 2 {
+		return fmt.Errorf("%d PT_LOAD segments, want 2", len(loads))
+	}
+	for _, p := range loads {
+		if p.Align != 0x1000 || p.Off%0x1000 != p.Vaddr%0x1000 {
+			return fmt.Errorf("segment at %#x (offset %#x, align %#x) is not page-aligned", p.Vaddr, p.Off, p.Align)
+		}
+	}
+	if text, data := loads[0], loads[1]; text.Flags != elf.PF_R|elf.PF_X || data.Flags != elf.PF_R|elf.PF_W {
+		return fmt.Errorf("segment flags %v and %v, want R+X and R+W", text.Flags, data.Flags)
+	} else if data.Memsz < data.Filesz+8*1000 {
+		return fmt.Errorf("data segment has filesz %#x, memsz %#x; want the zeroed array left to memsz", data.Filesz, data.Memsz)
+	}
+
+	dir, err := os.MkdirTemp("", "static")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "program")
+	if err := os.WriteFile(path, exe, 0755); err != nil {
+		return err
+	}
+	out, err := exec.Command("readelf", "-lW", path).CombinedOutput()
+	if err != nil || strings.Contains(string(out), "Warning") || strings.Contains(string(out), "Error") {
+		return fmt.Errorf("readelf: %v\n%s", err, out)
+	}
+
+	err = exec.Command(path).Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 42 {
+		return fmt.Errorf("running the executable: %v, want exit status 42", err)
+	}
+	return nil
+}
+
+// main calls puts from libc directly, through its PLT entry, and through a
+// pointer loaded from the GOT, then returns abs(-42)
+func buildDynamicPuts(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("dynamic_puts")
+	str := types.NewPointer(types.I8)
+	puts := b.DeclareFunction("puts", types.I32, []types.Type{str}, false)
+	abs := b.DeclareFunction("abs", types.I32, []types.Type{types.I32}, false)
+	b.CreateFunction("main", types.I32, []types.Type{types.I32, types.NewPointer(str)}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	cstr := func(s string) ir.Value {
+		g := codegen.BuildCString(b, m, s)
+		zero := b.ConstInt(types.I64, 0)
+		return b.CreateGEP(g.Initializer.Type(), g, []ir.Value{zero, zero}, "s")
+	}
+	hello := cstr("hello from a shared library")
+	again := cstr("and through a pointer")
+	b.CreateCall(puts, []ir.Value{hello}, "")
+	b.CreateIndirectCall(types.NewFunction(types.I32, []types.Type{str}, false), puts, []ir.Value{again}, "")
+	b.CreateRet(b.CreateCall(abs, []ir.Value{b.ConstInt(types.I32, -42)}, "r"))
+	return m
+}
+
+// A dynamically linked executable runs with libc's puts and abs bound
+// lazily through the PLT, or with BindNow as it loads. Either way the
+// GOT entry of the pointer to puts is filled in at load time.
+func runDynamicExecutable() error {
+	dir, err := os.MkdirTemp("", "dynamic")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	for _, bindNow := range []bool{false, true} {
+		opts := codegen.DefaultOptions()
+		opts.BindNow = bindNow
+		exe, err := codegen.GenerateDynamicExecutable(buildDynamicPuts(builder.New()), nil, opts)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, fmt.Sprintf("program_%v", bindNow))
+		if err := os.WriteFile(path, exe, 0755); err != nil {
+			return err
+		}
+
+		out, err := exec.Command("readelf", "-lW", path).CombinedOutput()
+		if err != nil || !strings.Contains(string(out), "Requesting program interpreter: /lib64/ld-linux-x86-64.so.2") {
+			return fmt.Errorf("readelf -l: %v\n%s", err, out)
+		}
+		out, err = exec.Command("readelf", "-dW", path).CombinedOutput()
+		if err != nil || !strings.Contains(string(out), "Shared library: [libc.so.6]") {
+			return fmt.Errorf("readelf -d: %v\n%s", err, out)
+		}
+		if strings.Contains(string(out), "BIND_NOW") != bindNow {
+			return fmt.Errorf("BindNow %v, but the dynamic section is:\n%s", bindNow, out)
+		}
+		relocs, err := exec.Command("readelf", "-rDW", path).CombinedOutput()
+		if err != nil || !strings.Contains(string(relocs), "R_X86_64_GLOB_DAT") {
+			return fmt.Errorf("readelf -r: %v\n%s", err, relocs)
+		}
+		if lazy := strings.Contains(string(relocs), "R_X86_64_JUMP_SLO"); lazy == bindNow {
+			return fmt.Errorf("BindNow %v, but the relocations are:\n%s", bindNow, relocs)
+		}
+
+		cmd := exec.Command(path)
+		stdout, err := cmd.Output()
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 42 {
+			return fmt.Errorf("BindNow %v: running the executable: %v, want exit status 42", bindNow, err)
+		}
+		if want := "hello from a shared library\nand through a pointer\n"; string(stdout) != want {
+			return fmt.Errorf("BindNow %v: printed %q, want %q", bindNow, stdout, want)
+		}
+	}
+
+	// The jump table's relocations against .text.boot resolve within the
+	// executable rather than being imported
+	opts := codegen.DefaultOptions()
+	opts.TextSections = map[string]string{"_start": ".text.boot"}
+	exe, err := codegen.GenerateDynamicExecutable(buildBootStart(builder.New()), nil, opts)
+	if err != nil {
+		return fmt.Errorf(".text.boot: %v", err)
+	}
+	path := filepath.Join(dir, "boot")
+	if err := os.WriteFile(path, exe, 0755); err != nil {
+		return err
+	}
+	err = exec.Command(path).Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 42 {
+		return fmt.Errorf(".text.boot: running the executable: %v, want exit status 42", err)
+	}
+	return nil
+}
+
+// runExecutableEntry checks that an executable's exit status is what its
+// entry function returns: 42 from run, called instead of main, and 0 from
+// a void function. The module's only data is a global of no size, which
+// run checks has an address.
+func runExecutableEntry() error {
+	b := builder.New()
+	m := b.CreateModule("entry")
+	empty := b.CreateGlobal("empty", types.NewArray(types.I32, 0), b.ConstZero(types.NewArray(types.I32, 0)))
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.ConstInt(types.I32, 1))
+	b.CreateFunction("run", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	found, missing := b.CreateBlock("found"), b.CreateBlock("missing")
+	b.CreateCondBr(b.CreateICmpNE(empty, b.ConstNull(types.NewPointer(types.I8)), "found"), found, missing)
+	b.SetInsertPoint(found)
+	b.CreateRet(b.ConstInt(types.I32, 42))
+	b.SetInsertPoint(missing)
+	b.CreateRet(b.ConstInt(types.I32, 2))
+	b.CreateFunction("idle", types.Void, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRetVoid()
+
+	dir, err := os.MkdirTemp("", "entry")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	for _, tc := range []struct {
+		entry string
+		want  int
+	}{{"run", 42}, {"idle", 0}, {"", 1}} {
+		exe, err := codegen.GenerateExecutable(m, tc.entry)
+		if err != nil {
+			return fmt.Errorf("entry %q: %v", tc.entry, err)
+		}
+		path := filepath.Join(dir, "program")
+		if err := os.WriteFile(path, exe, 0755); err != nil {
+			return err
+		}
+		err = exec.Command(path).Run()
+		status := 0
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			status = exitErr.ExitCode()
+		} else if err != nil {
+			return err
+		}
+		if status != tc.want {
+			return fmt.Errorf("entry %q: exit status %d, want %d", tc.entry, status, tc.want)
+		}
+	}
+	return nil
+}
+
+// runCompressedDebugSection writes a compressed .debug_str and checks that
+// both Go's reader and objcopy get the original bytes back from it
+func runCompressedDebugSection() error {
+	var want []byte
+	for i := 0; i < 64; i++ {
+		want = append(want, fmt.Sprintf("arc-core-codegen\x00main\x00counter_%d\x00", i)...)
+	}
+	f := elfwriter.NewFile()
+	f.AddSection(".text", elfwriter.SHT_PROGBITS, elfwriter.SHF_ALLOC|elfwriter.SHF_EXECINSTR, []byte{0xC3})
+	debug := f.AddSection(".debug_str", elfwriter.SHT_PROGBITS, elfwriter.SHF_MERGE|elfwriter.SHF_STRINGS, want)
+	debug.Compress = true
+	var buf bytes.Buffer
+	if err := f.WriteTo(&buf); err != nil {
+		return err
+	}
+
+	ef, err := elf.NewFile(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	sec := ef.Section(".debug_str")
+	if sec.Flags&elf.SHF_COMPRESSED == 0 || sec.FileSize >= uint64(len(want)) {
+		return fmt.Errorf(".debug_str: flags %v, %d bytes in the file for %d of strings", sec.Flags, sec.FileSize, len(want))
+	}
+	if got, err := sec.Data(); err != nil || !bytes.Equal(got, want) {
+		return fmt.Errorf("decompressed .debug_str: %v\n%q", err, got)
+	}
+
+	dir, err := os.MkdirTemp("", "compress")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	in, out := filepath.Join(dir, "in.o"), filepath.Join(dir, "out.o")
+	if err := os.WriteFile(in, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if msg, err := exec.Command("objcopy", "--decompress-debug-sections", in, out).CombinedOutput(); err != nil {
+		return fmt.Errorf("objcopy: %v\n%s", err, msg)
+	}
+	ef, err = elf.Open(out)
+	if err != nil {
+		return err
+	}
+	defer ef.Close()
+	sec = ef.Section(".debug_str")
+	got, err := sec.Data()
+	if err != nil || sec.Flags&elf.SHF_COMPRESSED != 0 || !bytes.Equal(got, want) {
+		return fmt.Errorf("objcopy's decompressed .debug_str (flags %v): %v\n%q", sec.Flags, err, got)
+	}
+	return nil
+}
+
+// Operations on an i64 with constants at the edges of the sign-extended
+// immediate forms: x & 0xFF keeps a byte, x & -1 keeps everything, and a
+// mask or xor beyond 32 bits must not be truncated. Each check that holds
+// adds 2 to 32.
+func buildBitwiseImmediates(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("bitwise_immediates")
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	slot := b.CreateAlloca(types.I64, "slot")
+	b.CreateStore(b.ConstInt(types.I64, 0x123456789ABCDEF0), slot)
+	x := b.CreateLoad(types.I64, slot, "x")
+	c := func(v int64) ir.Value { return b.ConstInt(types.I64, v) }
+
+	roundTrip := b.CreateSub(b.CreateSub(x, c(-128), "plus128"), c(128), "back")
+	checks := []ir.Value{
+		b.CreateICmpEQ(b.CreateAnd(x, c(0xFF), "low"), c(0xF0), "low_ok"),
+		b.CreateICmpEQ(b.CreateAnd(x, c(-1), "all"), x, "all_ok"),
+		b.CreateICmpEQ(b.CreateAnd(x, c(0xFFFFFFFF), "low32"), c(0x9ABCDEF0), "low32_ok"),
+		b.CreateICmpEQ(roundTrip, x, "sub_ok"),
+		b.CreateICmpEQ(b.CreateXor(x, c(0x7FFFFFFF00000000), "flip"), c(0x6DCBA9879ABCDEF0), "xor_ok"),
+	}
+	var r ir.Value = b.ConstInt(types.I32, 32)
+	for _, ok := range checks {
+		bit := b.CreateZExt(ok, types.I32, "bit")
+		r = b.CreateAdd(r, b.CreateMul(bit, b.ConstInt(types.I32, 2), "two"), "r")
+	}
+	b.CreateRet(r)
+
+	return m
+}
+
+// A 32-byte struct is returned through a buffer the caller passes in RDI,
+// both by C's make_quad to shifted and by shifted to main and to C. With
+// the buffer's address taking a register, shifted's last two arguments
+// arrive on the stack.
+func buildStructReturnMemory(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("struct_return_memory")
+	quad := types.NewStruct("quad", []types.Type{types.I64, types.I64, types.I64, types.I64}, false)
+	i64s := func(n int) []types.Type {
+		ts := make([]types.Type, n)
+		for i := range ts {
+			ts[i] = types.I64
+		}
+		return ts
+	}
+	makeQuad := b.DeclareFunction("make_quad", quad, i64s(4), false)
+	fromC := b.DeclareFunction("c_calls_shifted", types.I32, nil, false)
+
+	// shifted(a..g) = {a, b, c, e+f+g}, modifying make_quad's result
+	shifted := b.CreateFunction("shifted", quad, i64s(7), false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	args := shifted.Arguments
+	q := b.CreateCall(makeQuad, []ir.Value{args[0], args[1], args[2], args[3]}, "q")
+	d := b.CreateAdd(b.CreateAdd(args[4], args[5], "ef"), args[6], "d")
+	b.CreateRet(b.CreateInsertValue(q, d, []int{3}, "q2"))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	var in []ir.Value
+	for v := int64(1); v <= 7; v++ {
+		in = append(in, b.ConstInt(types.I64, v))
+	}
+	res := b.CreateCall(shifted, in, "res")
+	r := ir.Value(b.ConstInt(types.I32, 32))
+	check := func(ok ir.Value) {
+		r = b.CreateAdd(r, b.CreateMul(b.CreateZExt(ok, types.I32, "z"), b.ConstInt(types.I32, 2), "w"), "r")
+	}
+	for i, want := range []int64{1, 2, 3, 18} {
+		field := b.CreateExtractValue(res, []int{i}, "f")
+		check(b.CreateICmpEQ(field, b.ConstInt(types.I64, want), "ok"))
+	}
+	check(b.CreateICmpEQ(b.CreateCall(fromC, nil, "c"), b.ConstInt(types.I32, 1), "ok"))
+	b.CreateRet(r)
+
+	return m
+}
+
+// A 32-byte struct is built from undef one insertvalue at a time and
+// returned in memory, and in pick two insertvalues into the same
+// aggregate each leave it as it was for the other
+func buildStructBuildMemory(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("struct_build_memory")
+	quad := types.NewStruct("quad", []types.Type{types.I64, types.I64, types.I64, types.I64}, false)
+
+	// mk(x) = {x, x+1, x+2, x+3}
+	mk := b.CreateFunction("mk", quad, []types.Type{types.I64}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	q := ir.Value(b.ConstUndef(quad))
+	for i := 0; i < 4; i++ {
+		field := b.CreateAdd(mk.Arguments[0], b.ConstInt(types.I64, int64(i)), "f")
+		q = b.CreateInsertValue(q, field, []int{i}, "q")
+	}
+	b.CreateRet(q)
+
+	// pick(x) = 10*a.b + c.b = 12, for a and c both built on {x}
+	pick := b.CreateFunction("pick", types.I64, []types.Type{types.I64}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	base := b.CreateInsertValue(b.ConstUndef(quad), pick.Arguments[0], []int{0}, "base")
+	a := b.CreateInsertValue(base, b.ConstInt(types.I64, 1), []int{1}, "a")
+	c := b.CreateInsertValue(base, b.ConstInt(types.I64, 2), []int{1}, "c")
+	tens := b.CreateMul(b.CreateExtractValue(a, []int{1}, "ab"), b.ConstInt(types.I64, 10), "tens")
+	b.CreateRet(b.CreateAdd(tens, b.CreateExtractValue(c, []int{1}, "cb"), "r"))
+
+	return m
+}
+
+// Vectors live in their slots across a call that takes and returns one in
+// XMM0; the aligned slots are spilled and reloaded with movaps, which
+// faults on a misaligned address. Loads and stores through pointers use
+// movups, and the lanes are checked as scalars.
+func buildVectorSpill(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("vector_spill")
+	v4f32 := types.NewVector(types.F32, 4)
+	v2f64 := types.NewVector(types.F64, 2)
+	floats := func(name string, t types.Type, n int64, vals ...float64) *ir.Global {
+		arr := types.NewArray(t, n)
+		var elems []ir.Constant
+		for _, v := range vals {
+			elems = append(elems, b.ConstFloat(t.(*types.FloatType), v))
+		}
+		return b.CreateGlobal(name, arr, b.ConstArray(arr, elems))
+	}
+	xs := floats("xs", types.F32, 4, 1, 2, 3, 4)
+	ys := floats("ys", types.F32, 4, 10, 20, 30, 40)
+	ds := floats("ds", types.F64, 2, 0.5, 1.5)
+	out := floats("out", types.F32, 4, 0, 0, 0, 0)
+	outd := floats("outd", types.F64, 2, 0, 0)
+
+	square := b.CreateFunction("square", v4f32, []types.Type{v4f32}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateFMul(square.Arguments[0], square.Arguments[0], "sq"))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	x := b.CreateLoad(v4f32, xs, "x")
+	y := b.CreateLoad(v4f32, ys, "y")
+	d := b.CreateLoad(v2f64, ds, "d")
+	sq := b.CreateCall(square, []ir.Value{x}, "sq")
+	// (x + y) - x*x = {10, 18, 24, 28}, and d + d = {1, 3}
+	b.CreateStore(b.CreateFSub(b.CreateFAdd(x, y, "s"), sq, "t"), out)
+	b.CreateStore(b.CreateFAdd(d, d, "dd"), outd)
+
+	r := ir.Value(b.ConstInt(types.I32, 32))
+	check := func(arr *ir.Global, t types.Type, n int64, lane int64, want int64) {
+		p := b.CreateGEP(types.NewArray(t, n), arr, []ir.Value{b.ConstInt(types.I64, 0), b.ConstInt(types.I64, lane)}, "p")
+		v := b.CreateFPToSI(b.CreateLoad(t, p, "v"), types.I32, "vi")
+		ok := b.CreateZExt(b.CreateICmpEQ(v, b.ConstInt(types.I32, want), "ok"), types.I32, "z")
+		r = b.CreateAdd(r, b.CreateMul(ok, b.ConstInt(types.I32, 2), "w"), "r")
+	}
+	check(out, types.F32, 4, 0, 10)
+	check(out, types.F32, 4, 1, 18)
+	check(out, types.F32, 4, 3, 28)
+	check(outd, types.F64, 2, 0, 1)
+	check(outd, types.F64, 2, 1, 3)
+	b.CreateRet(r)
+
+	return m
+}
+
+// Vectors are loaded from one element into 16-byte aligned arrays, so
+// 4-byte aligned, and stored back to the aligned start of others. The
+// under-aligned loads must use movdqu/movups, since movdqa/movaps would
+// fault; the stores declare 16-byte alignment and may use the aligned forms.
+func buildUnderalignedVectorLoad(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("underaligned_vector_load")
+	v4i32 := types.NewVector(types.I32, 4)
+	v4f32 := types.NewVector(types.F32, 4)
+	array := func(name string, t types.Type, vals ...ir.Constant) *ir.Global {
+		arr := types.NewArray(t, int64(len(vals)))
+		g := b.CreateGlobal(name, arr, b.ConstArray(arr, vals))
+		g.Alignment = 16
+		return g
+	}
+	var ints, floats, zeros, fzeros []ir.Constant
+	for i := 0; i < 5; i++ {
+		ints = append(ints, b.ConstInt(types.I32, int64(10*i)))
+		floats = append(floats, b.ConstFloat(types.F32, float64(i)/2))
+		zeros = append(zeros, b.ConstInt(types.I32, 0))
+		fzeros = append(fzeros, b.ConstFloat(types.F32, 0))
+	}
+	src := array("src", types.I32, ints...)
+	fsrc := array("fsrc", types.F32, floats...)
+	dst := array("dst", types.I32, zeros...)
+	fdst := array("fdst", types.F32, fzeros...)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	elem := func(arr *ir.Global, t types.Type, i int64) ir.Value {
+		return b.CreateGEP(types.NewArray(t, 5), arr, []ir.Value{b.ConstInt(types.I64, 0), b.ConstInt(types.I64, i)}, "p")
+	}
+	move := func(from, to *ir.Global, t, vt types.Type) {
+		v := b.CreateLoad(vt, elem(from, t, 1), "v")
+		v.Align = 4
+		b.CreateStore(v, to).Align = 16
+	}
+	move(src, dst, types.I32, v4i32)
+	move(fsrc, fdst, types.F32, v4f32)
+
+	// dst = {10, 20, 30, 40}, fdst = {0.5, 1, 1.5, 2}
+	r := ir.Value(b.ConstInt(types.I32, 32))
+	check := func(v ir.Value, want int64) {
+		ok := b.CreateZExt(b.CreateICmpEQ(v, b.ConstInt(types.I32, want), "ok"), types.I32, "z")
+		r = b.CreateAdd(r, b.CreateMul(ok, b.ConstInt(types.I32, 2), "w"), "r")
+	}
+	check(b.CreateLoad(types.I32, elem(dst, types.I32, 0), "d0"), 10)
+	check(b.CreateLoad(types.I32, elem(dst, types.I32, 1), "d1"), 20)
+	check(b.CreateLoad(types.I32, elem(dst, types.I32, 3), "d3"), 40)
+	check(b.CreateLoad(types.I32, elem(dst, types.I32, 4), "d4"), 0)
+	f3 := b.CreateLoad(types.F32, elem(fdst, types.F32, 3), "f3")
+	check(b.CreateFPToSI(b.CreateFMul(f3, b.ConstFloat(types.F32, 10), "f30"), types.I32, "fi"), 20)
+	b.CreateRet(r)
+
+	return m
+}
+
+// verifyCET checks that every function, the assembly one included, starts
+// with endbr64 and that the object carries the GNU property note marking it
+// IBT-compatible
+func verifyCET(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	text, err := f.Section(".text").Data()
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	funcs := 0
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC {
+			continue
+		}
+		funcs++
+		insts, err := codegen.DisassembleText(text[sym.Value : sym.Value+sym.Size])
+		if err != nil {
+			return fmt.Errorf("%s: %v", sym.Name, err)
+		}
+		if insts[0] != "endbr64" {
+			return fmt.Errorf("%s starts with %q, want endbr64", sym.Name, insts[0])
+		}
+	}
+	if funcs < 2 {
+		return fmt.Errorf("found %d functions, want main and forty_two", funcs)
+	}
+
+	note := f.Section(".note.gnu.property")
+	if note == nil {
+		return fmt.Errorf("no .note.gnu.property section")
+	}
+	if note.Type != elf.SHT_NOTE || note.Addralign != 8 {
+		return fmt.Errorf(".note.gnu.property has type %v and alignment %d, want SHT_NOTE and 8", note.Type, note.Addralign)
+	}
+	data, err := note.Data()
+	if err != nil {
+		return err
+	}
+	le := binary.LittleEndian
+	if len(data) != 32 || le.Uint32(data) != 4 || le.Uint32(data[4:]) != 16 || le.Uint32(data[8:]) != 5 || string(data[12:16]) != "GNU\x00" {
+		return fmt.Errorf("malformed property note % x", data)
+	}
+	if le.Uint32(data[16:]) != 0xc0000002 || le.Uint32(data[20:]) != 4 || le.Uint32(data[24:])&1 == 0 {
+		return fmt.Errorf("property note doesn't claim IBT: % x", data[16:])
+	}
+
+	// readelf decodes the note the way the linker reads it
+	path := filepath.Join(os.TempDir(), "cet_endbr_check.o")
+	if err := os.WriteFile(path, obj, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	out, err := exec.Command("readelf", "-n", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("readelf: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "x86 feature: IBT") {
+		return fmt.Errorf("readelf doesn't report IBT:\n%s", out)
+	}
+	return nil
+}
+
+// 3.14 as a double twice, in two functions, and as a float, whose bits
+// differ: (3.14 + 3.14) * 5 + 3.14f + 7.5 truncates to 42
+func buildFloatConstPool(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("float_const_pool")
+	pi := func() ir.Value { return b.ConstFloat(types.F64, 3.14) }
+
+	twice := b.CreateFunction("twice", types.F64, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateFAdd(pi(), pi(), "t"))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	t := b.CreateCall(twice, nil, "t")
+	v := b.CreateFMul(t, b.ConstFloat(types.F64, 5), "v")
+	v = b.CreateFAdd(v, b.CreateFPExt(b.ConstFloat(types.F32, 3.14), types.F64, "f"), "v")
+	v = b.CreateFAdd(v, b.ConstFloat(types.F64, 7.5), "v")
+	b.CreateRet(b.CreateFPToSI(v, types.I32, "r"))
+
+	return m
+}
+
+// verifyFloatConstPool checks that .rodata holds each constant once and
+// that no float's bits appear as an immediate in .text
+func verifyFloatConstPool(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	rodata, err := f.Section(".rodata").Data()
+	if err != nil {
+		return err
+	}
+	text, err := f.Section(".text").Data()
+	if err != nil {
+		return err
+	}
+	pi64 := binary.LittleEndian.AppendUint64(nil, math.Float64bits(3.14))
+	pi32 := binary.LittleEndian.AppendUint32(nil, math.Float32bits(3.14))
+	if n := bytes.Count(rodata, pi64); n != 1 {
+		return fmt.Errorf("double 3.14 is in .rodata %d times, want once", n)
+	}
+	if n := bytes.Count(rodata, pi32); n != 1 {
+		return fmt.Errorf("float 3.14 is in .rodata %d times, want once", n)
+	}
+	if bytes.Contains(text, pi64) || bytes.Contains(text, pi32) {
+		return fmt.Errorf("3.14 is built from an immediate in .text")
+	}
+	return nil
+}
+
+// C++ exceptions thrown by the driver unwind into and through generated
+// frames. guarded catches everything from two invokes sharing a landing
+// pad, one with stack arguments, and tells them apart by a phi; typed
+// catches only int, running a cleanup and resuming for anything else;
+// pass_through has no invoke and is only unwound through.
+func buildExceptions(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("exceptions")
+	ptr := types.NewPointer(types.I8)
+	eh := types.NewStruct("eh", []types.Type{ptr, types.I32}, false)
+	i64s := make([]types.Type, 8)
+	for i := range i64s {
+		i64s[i] = types.I64
+	}
+	throwLast := b.DeclareFunction("throw_last", types.Void, i64s, false)
+	mayThrow := b.DeclareFunction("may_throw", types.Void, []types.Type{types.I32}, false)
+	beginCatch := b.DeclareFunction("__cxa_begin_catch", ptr, []types.Type{ptr}, false)
+	endCatch := b.DeclareFunction("__cxa_end_catch", types.Void, nil, false)
+	checkPropagation := b.DeclareFunction("check_propagation", types.I32, nil, false)
+	typeInfoInt := b.CreateGlobal("_ZTIi", ptr, nil)
+	cleanups := b.CreateGlobal("cleanups", types.I32, nil)
+
+	invoke := func(fn *ir.Function, args []ir.Value, normal, unwind *ir.BasicBlock) {
+		inst := &ir.InvokeInst{
+			BaseInstruction: ir.BaseInstruction{Op: ir.OpInvoke, Ops: args},
+			Callee:          fn,
+			CalleeName:      fn.Name(),
+			NormalDest:      normal,
+			UnwindDest:      unwind,
+		}
+		inst.ValType = fn.FuncType.ReturnType
+		b.GetInsertBlock().AddInstruction(inst)
+	}
+	landingPad := func(cleanup bool, clauses ...ir.Value) *ir.LandingPadInst {
+		lp := &ir.LandingPadInst{
+			BaseInstruction: ir.BaseInstruction{Op: ir.OpLandingPad},
+			Cleanup:         cleanup,
+			Clauses:         clauses,
+		}
+		lp.ValType = eh
+		lp.ValName = "lp"
+		b.GetInsertBlock().AddInstruction(lp)
+		return lp
+	}
+	// catchInt ends a catch of an int: its value plus bias
+	catchInt := func(lp ir.Value, bias int64) ir.Value {
+		obj := b.CreateCall(beginCatch, []ir.Value{b.CreateExtractValue(lp, []int{0}, "exc")}, "obj")
+		v := b.CreateLoad(types.I32, obj, "v")
+		b.CreateCall(endCatch, nil, "")
+		return b.CreateAdd(v, b.ConstInt(types.I32, bias), "r")
+	}
+
+	// guarded(n) = n+1 if nothing throws, else thrown*10 + which invoke threw
+	guarded := b.CreateFunction("guarded", types.I32, []types.Type{types.I32}, false)
+	entry := b.CreateBlock("entry")
+	next := b.CreateBlock("next")
+	ok := b.CreateBlock("ok")
+	lpad := b.CreateBlock("lpad")
+	n := guarded.Arguments[0]
+	b.SetInsertPoint(entry)
+	var args []ir.Value
+	for i := int64(1); i < 8; i++ {
+		args = append(args, b.ConstInt(types.I64, i))
+	}
+	invoke(throwLast, append(args, b.CreateSExt(n, types.I64, "h")), next, lpad)
+	b.SetInsertPoint(next)
+	invoke(mayThrow, []ir.Value{n}, ok, lpad)
+	b.SetInsertPoint(ok)
+	b.CreateRet(b.CreateAdd(n, b.ConstInt(types.I32, 1), "n1"))
+	b.SetInsertPoint(lpad)
+	which := b.CreatePhi(types.I32, "which")
+	which.AddIncoming(b.ConstInt(types.I32, 1), entry)
+	which.AddIncoming(b.ConstInt(types.I32, 2), next)
+	lp := landingPad(false, b.ConstNull(ptr))
+	thrown := catchInt(lp, 0)
+	b.CreateRet(b.CreateAdd(b.CreateMul(thrown, b.ConstInt(types.I32, 10), "t10"), which, "res"))
+
+	// typed(n) = n+200 for an int thrown by may_throw(n), 0 if none;
+	// anything else counts a cleanup and propagates
+	typed := b.CreateFunction("typed", types.I32, []types.Type{types.I32}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	ok = b.CreateBlock("ok")
+	lpad = b.CreateBlock("lpad")
+	catchBlock := b.CreateBlock("catch")
+	cleanup := b.CreateBlock("cleanup")
+	invoke(mayThrow, []ir.Value{typed.Arguments[0]}, ok, lpad)
+	b.SetInsertPoint(ok)
+	b.CreateRet(b.ConstInt(types.I32, 0))
+	b.SetInsertPoint(lpad)
+	lp = landingPad(true, typeInfoInt)
+	sel := b.CreateExtractValue(lp, []int{1}, "sel")
+	b.CreateCondBr(b.CreateICmpEQ(sel, b.ConstInt(types.I32, 1), "isint"), catchBlock, cleanup)
+	b.SetInsertPoint(catchBlock)
+	b.CreateRet(catchInt(lp, 200))
+	b.SetInsertPoint(cleanup)
+	count := b.CreateLoad(types.I32, cleanups, "count")
+	b.CreateStore(b.CreateAdd(count, b.ConstInt(types.I32, 1), "count1"), cleanups)
+	resume := &ir.ResumeInst{BaseInstruction: ir.BaseInstruction{Op: ir.OpResume, Ops: []ir.Value{lp}}}
+	b.GetInsertBlock().AddInstruction(resume)
+
+	passThrough := b.CreateFunction("pass_through", types.I32, []types.Type{types.I32}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateCall(mayThrow, []ir.Value{passThrough.Arguments[0]}, "")
+	b.CreateRet(passThrough.Arguments[0])
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	r := ir.Value(b.ConstInt(types.I32, 32))
+	check := func(ok ir.Value) {
+		r = b.CreateAdd(r, b.CreateMul(b.CreateZExt(ok, types.I32, "z"), b.ConstInt(types.I32, 2), "w"), "r")
+	}
+	for _, c := range [][2]int64{{0, 1}, {7, 72}, {300, 3001}} {
+		got := b.CreateCall(guarded, []ir.Value{b.ConstInt(types.I32, c[0])}, "g")
+		check(b.CreateICmpEQ(got, b.ConstInt(types.I32, c[1]), "ok"))
+	}
+	check(b.CreateICmpEQ(b.CreateCall(passThrough, []ir.Value{b.ConstInt(types.I32, 0)}, "p"), b.ConstInt(types.I32, 0), "ok"))
+	check(b.CreateICmpEQ(b.CreateCall(checkPropagation, nil, "c"), b.ConstInt(types.I32, 1), "ok"))
+	b.CreateRet(r)
+
+	return m
+}
+
+// verifyUnwindTables checks with readelf that every function has an FDE,
+// and that those with invokes point at an LSDA
+func verifyUnwindTables(obj []byte) error {
+	path := filepath.Join(os.TempDir(), "unwind_tables.o")
+	if err := os.WriteFile(path, obj, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	out, err := exec.Command("readelf", "--debug-dump=frames", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("readelf: %v\n%s", err, out)
+	}
+	dump := string(out)
+	if fdes := strings.Count(dump, " FDE "); fdes != 4 {
+		return fmt.Errorf("%d FDEs, want one per function:\n%s", fdes, dump)
+	}
+	for _, want := range []string{`"zPLR"`, "DW_CFA_def_cfa_register: r6 (rbp)"} {
+		if !strings.Contains(dump, want) {
+			return fmt.Errorf("no %s in .eh_frame:\n%s", want, dump)
+		}
+	}
+	// Both CIEs have augmentation data, and so do FDEs with an LSDA
+	if strings.Count(dump, "Augmentation data:")-strings.Count(dump, " CIE\n") != 2 {
+		return fmt.Errorf("want LSDA pointers in the two functions with invokes:\n%s", dump)
+	}
+	return nil
+}
+
+// fill(n) memsets n bytes of an 8-byte stack buffer. fill(8) returns
+// normally; fill(64) overruns the canary, so its return aborts in
+// __stack_chk_fail instead of jumping to the overwritten return address.
+func buildStackSmash(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("stack_protector")
+	ptr := types.NewPointer(types.I8)
+	memset := b.DeclareFunction("memset", ptr, []types.Type{ptr, types.I32, types.I64}, false)
+
+	fill := b.CreateFunction("fill", types.I32, []types.Type{types.I64}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	buf := b.CreateAlloca(types.NewArray(types.I8, 8), "buf")
+	b.CreateCall(memset, []ir.Value{buf, b.ConstInt(types.I32, 'A'), fill.Arguments[0]}, "")
+	b.CreateRet(b.CreateZExt(b.CreateLoad(types.I8, buf, "first"), types.I32, "r"))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateCall(fill, []ir.Value{b.ConstInt(types.I64, 8)}, "")
+	b.CreateCall(fill, []ir.Value{b.ConstInt(types.I64, 64)}, "")
+	b.CreateRet(b.ConstInt(types.I32, 0))
+
+	return m
+}
+
+// commonCounter adds the tentative definition `int counter;` to the
+// module being built, as both objects of the common_symbol test have
+func commonCounter(b *builder.Builder) *ir.Global {
+	counter := b.CreateGlobal("counter", types.I32, nil)
+	counter.Linkage = ir.CommonLinkage
+	return counter
+}
+
+func buildCommonMain(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("common_main")
+	counter := commonCounter(b)
+	// `double ratio = 0.0;` compiled with -fcommon is tentative too
+	ratio := b.CreateGlobal("ratio", types.F64, b.ConstFloat(types.F64, 0))
+	ratio.Linkage = ir.CommonLinkage
+	bump := b.DeclareFunction("bump", types.Void, nil, false)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateStore(b.ConstInt(types.I32, 40), counter)
+	b.CreateCall(bump, nil, "")
+	b.CreateCall(bump, nil, "")
+	q := b.CreateFPToSI(b.CreateLoad(types.F64, ratio, "q"), types.I32, "qi")
+	b.CreateRet(b.CreateAdd(b.CreateLoad(types.I32, counter, "c"), q, "r"))
+	return m
+}
+
+func buildCommonBump(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("common_bump")
+	counter := commonCounter(b)
+
+	b.CreateFunction("bump", types.Void, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	v := b.CreateLoad(types.I32, counter, "v")
+	b.CreateStore(b.CreateAdd(v, b.ConstInt(types.I32, 1), "n"), counter)
+	b.CreateRetVoid()
+	return m
+}
+
+// counter is COMMON, its value the alignment, and reserves no .bss here;
+// nor does ratio, initialized to 0.0
+func verifyCommonSymbol(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{".bss", ".data"} {
+		if sec := f.Section(name); sec != nil && sec.Size > 0 {
+			return fmt.Errorf("a common global reserved %d bytes of %s", sec.Size, name)
+		}
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	for _, sym := range syms {
+		if sym.Name != "counter" {
+			continue
+		}
+		if sym.Section != elf.SHN_COMMON || sym.Value != 4 || sym.Size != 4 || elf.ST_BIND(sym.Info) != elf.STB_GLOBAL {
+			return fmt.Errorf("counter: section %v, value %d, size %d, binding %v",
+				sym.Section, sym.Value, sym.Size, elf.ST_BIND(sym.Info))
+		}
+		return nil
+	}
+	return fmt.Errorf("no counter symbol")
+}
+
+// Compares against 0, which test the value with itself rather than
+// loading the 0 to cmp with
+func buildICmpZero(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("icmp_zero")
+
+	isZero := b.CreateFunction("is_zero", types.I32, []types.Type{types.I32}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	eq := b.CreateICmpEQ(isZero.Arguments[0], b.ConstInt(types.I32, 0), "eq")
+	b.CreateRet(b.CreateZExt(eq, types.I32, "r"))
+
+	isPositive := b.CreateFunction("is_positive", types.I32, []types.Type{types.I64}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	gt := b.CreateICmpSGT(isPositive.Arguments[0], b.ConstInt(types.I64, 0), "gt")
+	b.CreateRet(b.CreateZExt(gt, types.I32, "r"))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	z := b.CreateCall(isZero, []ir.Value{b.ConstInt(types.I32, 0)}, "z")
+	nz := b.CreateCall(isZero, []ir.Value{b.ConstInt(types.I32, 7)}, "nz")
+	p := b.CreateCall(isPositive, []ir.Value{b.ConstInt(types.I64, 3)}, "p")
+	r := b.CreateAdd(b.CreateMul(z, b.ConstInt(types.I32, 40), "z40"), nz, "")
+	b.CreateRet(b.CreateAdd(r, b.CreateMul(p, b.ConstInt(types.I32, 2), "p2"), "r"))
+	return m
+}
+
+// Weak references, called or read only if the link resolved them: libc
+// defines abs, and nothing defines absent_hook or absent_var
+func buildWeakUndefined(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("weak_undefined")
+	abs := b.DeclareFunction("abs", types.I32, []types.Type{types.I32}, false)
+	abs.Linkage = ir.ExternalWeakLinkage
+	hook := b.DeclareFunction("absent_hook", types.I32, nil, false)
+	hook.Linkage = ir.ExternalWeakLinkage
+	absentVar := b.CreateGlobal("absent_var", types.I32, nil)
+	absentVar.Linkage = ir.ExternalWeakLinkage
+	ptr := types.NewPointer(types.I8)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	callHook := b.CreateBlock("call_hook")
+	checkVar := b.CreateBlock("check_var")
+	readVar := b.CreateBlock("read_var")
+	checkAbs := b.CreateBlock("check_abs")
+	callAbs := b.CreateBlock("call_abs")
+	done := b.CreateBlock("done")
+
+	b.SetInsertPoint(entry)
+	r := b.CreateAlloca(types.I32, "r")
+	b.CreateStore(b.ConstInt(types.I32, 40), r)
+	b.CreateCondBr(b.CreateICmpNE(hook, b.ConstNull(ptr), "has_hook"), callHook, checkVar)
+
+	b.SetInsertPoint(callHook)
+	h := b.CreateCall(hook, nil, "h")
+	b.CreateStore(b.CreateAdd(b.CreateLoad(types.I32, r, "r0"), h, "r1"), r)
+	b.CreateBr(checkVar)
+
+	b.SetInsertPoint(checkVar)
+	b.CreateCondBr(b.CreateICmpNE(absentVar, b.ConstNull(ptr), "has_var"), readVar, checkAbs)
+
+	b.SetInsertPoint(readVar)
+	v := b.CreateLoad(types.I32, absentVar, "v")
+	b.CreateStore(b.CreateAdd(b.CreateLoad(types.I32, r, "r2"), v, "r3"), r)
+	b.CreateBr(checkAbs)
+
+	b.SetInsertPoint(checkAbs)
+	b.CreateCondBr(b.CreateICmpNE(abs, b.ConstNull(ptr), "has_abs"), callAbs, done)
+
+	b.SetInsertPoint(callAbs)
+	a := b.CreateCall(abs, []ir.Value{b.ConstInt(types.I32, -2)}, "a")
+	b.CreateStore(b.CreateAdd(b.CreateLoad(types.I32, r, "r4"), a, "r5"), r)
+	b.CreateBr(done)
+
+	b.SetInsertPoint(done)
+	b.CreateRet(b.CreateLoad(types.I32, r, "result"))
+	return m
+}
+
+// The weak references are undefined STB_WEAK symbols
+func verifyWeakUndefined(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	want := map[string]bool{"abs": true, "absent_hook": true, "absent_var": true}
+	for _, sym := range syms {
+		if !want[sym.Name] {
+			continue
+		}
+		if sym.Section != elf.SHN_UNDEF || elf.ST_BIND(sym.Info) != elf.STB_WEAK {
+			return fmt.Errorf("%s: section %v, binding %v", sym.Name, sym.Section, elf.ST_BIND(sym.Info))
+		}
+		delete(want, sym.Name)
+	}
+	if len(want) > 0 {
+		return fmt.Errorf("no symbols for %v", want)
+	}
+	return nil
+}
+
+// checkIDoms compares the tree's immediate dominators with want, keyed by
+// block name, "" meaning none
+func checkIDoms(dom *analysis.DomTree, fn *ir.Function, want map[string]string) error {
+	for _, block := range fn.Blocks {
+		got := ""
+		if idom := dom.IDom(block); idom != nil {
+			got = idom.Name()
+		}
+		if got != want[block.Name()] {
+			return fmt.Errorf("idom(%s) = %q, want %q", block.Name(), got, want[block.Name()])
+		}
+	}
+	return nil
+}
+
+// entry branches to left or right, which join at exit; dead is
+// unreachable
+func runDominatorsDiamond() error {
+	b := builder.New()
+	b.CreateModule("diamond")
+	fn := b.CreateFunction("pick", types.I32, []types.Type{types.I1}, false)
+	entry := b.CreateBlock("entry")
+	left := b.CreateBlock("left")
+	right := b.CreateBlock("right")
+	exit := b.CreateBlock("exit")
+	dead := b.CreateBlock("dead")
+
+	b.SetInsertPoint(entry)
+	b.CreateCondBr(fn.Arguments[0], left, right)
+	b.SetInsertPoint(left)
+	b.CreateBr(exit)
+	b.SetInsertPoint(right)
+	b.CreateBr(exit)
+	b.SetInsertPoint(exit)
+	phi := b.CreatePhi(types.I32, "r")
+	phi.AddIncoming(b.ConstInt(types.I32, 1), left)
+	phi.AddIncoming(b.ConstInt(types.I32, 2), right)
+	b.CreateRet(phi)
+	b.SetInsertPoint(dead)
+	b.CreateBr(exit)
+
+	dom, err := analysis.Dominators(fn)
+	if err != nil {
+		return err
+	}
+	if err := checkIDoms(dom, fn, map[string]string{"left": "entry", "right": "entry", "exit": "entry"}); err != nil {
+		return err
+	}
+	switch {
+	case !dom.Dominates(entry, exit) || !dom.Dominates(exit, exit):
+		return fmt.Errorf("entry should dominate exit, and exit itself")
+	case dom.Dominates(left, exit) || dom.Dominates(right, exit):
+		return fmt.Errorf("neither arm should dominate the join")
+	case dom.Reachable(dead) || dom.Dominates(dead, exit):
+		return fmt.Errorf("the unreachable block dominates nothing")
+	case len(dom.Children(entry)) != 3:
+		return fmt.Errorf("entry immediately dominates %d blocks, want 3", len(dom.Children(entry)))
+	}
+	for _, arm := range []*ir.BasicBlock{left, right} {
+		if f := dom.Frontier(arm); len(f) != 1 || f[0] != exit {
+			return fmt.Errorf("frontier of %s is %v, want exit", arm.Name(), f)
+		}
+	}
+	if len(dom.Frontier(entry)) != 0 {
+		return fmt.Errorf("entry's frontier should be empty")
+	}
+	return nil
+}
+
+// A counted loop: entry -> header <-> body, header -> exit, with a
+// nested if in the body whose arms rejoin at latch
+func runDominatorsLoop() error {
+	b := builder.New()
+	b.CreateModule("loop")
+	fn := b.CreateFunction("count", types.I32, []types.Type{types.I32}, false)
+	entry := b.CreateBlock("entry")
+	header := b.CreateBlock("header")
+	body := b.CreateBlock("body")
+	odd := b.CreateBlock("odd")
+	latch := b.CreateBlock("latch")
+	exit := b.CreateBlock("exit")
+
+	b.SetInsertPoint(entry)
+	b.CreateBr(header)
+	b.SetInsertPoint(header)
+	i := b.CreatePhi(types.I32, "i")
+	b.CreateCondBr(b.CreateICmpSLT(i, fn.Arguments[0], "more"), body, exit)
+	b.SetInsertPoint(body)
+	bit := b.CreateAnd(i, b.ConstInt(types.I32, 1), "bit")
+	b.CreateCondBr(b.CreateICmpNE(bit, b.ConstInt(types.I32, 0), "is_odd"), odd, latch)
+	b.SetInsertPoint(odd)
+	b.CreateBr(latch)
+	b.SetInsertPoint(latch)
+	next := b.CreateAdd(i, b.ConstInt(types.I32, 1), "next")
+	b.CreateBr(header)
+	b.SetInsertPoint(exit)
+	b.CreateRet(i)
+	i.AddIncoming(b.ConstInt(types.I32, 0), entry)
+	i.AddIncoming(next, latch)
+
+	dom, err := analysis.Dominators(fn)
+	if err != nil {
+		return err
+	}
+	want := map[string]string{"header": "entry", "body": "header", "odd": "body", "latch": "body", "exit": "header"}
+	if err := checkIDoms(dom, fn, want); err != nil {
+		return err
+	}
+	switch {
+	case !dom.Dominates(header, latch) || dom.Dominates(latch, header):
+		return fmt.Errorf("the header should dominate the latch, not the reverse")
+	case dom.Dominates(body, exit):
+		return fmt.Errorf("the body should not dominate the exit")
+	case len(dom.Predecessors(header)) != 2:
+		return fmt.Errorf("header has %d predecessors, want 2", len(dom.Predecessors(header)))
+	}
+	// The back edge puts the header in the frontier of the loop's blocks
+	for _, block := range []*ir.BasicBlock{body, latch, header} {
+		found := false
+		for _, f := range dom.Frontier(block) {
+			found = found || f == header
+		}
+		if !found {
+			return fmt.Errorf("header is not in the frontier of %s", block.Name())
+		}
+	}
+	if f := dom.Frontier(odd); len(f) != 1 || f[0] != latch {
+		return fmt.Errorf("frontier of odd is %v, want latch", f)
+	}
+
+	// A branch without a target is an error, not a crash
+	odd.Terminator().(*ir.BrInst).Target = nil
+	if _, err := analysis.Dominators(fn); err == nil || !strings.Contains(err.Error(), "odd") {
+		return fmt.Errorf("branch to nil: got error %v", err)
+	}
+	return nil
+}
+
+// Liveness of the array-sum loop in buildGEPPointerArg's sum: the values
+// carried around the back edge are live out of the loop and into its
+// phis, not into the loop block
+func runLivenessLoop() error {
+	m := buildGEPPointerArg(builder.New())
+	fn := m.GetFunction("sum")
+	entry, loop, exit := fn.Blocks[0], fn.Blocks[1], fn.Blocks[2]
+	named := make(map[string]ir.Value)
+	for _, inst := range loop.Instructions {
+		named[inst.Name()] = inst
+	}
+	p, n := fn.Arguments[0], fn.Arguments[1]
+
+	live, err := analysis.ComputeLiveness(fn)
+	if err != nil {
+		return err
+	}
+	check := func(set map[ir.Value]bool, where string, want, not []ir.Value) error {
+		for _, v := range want {
+			if !set[v] {
+				return fmt.Errorf("%s should be live %s", v.Name(), where)
+			}
+		}
+		for _, v := range not {
+			if set[v] {
+				return fmt.Errorf("%s should not be live %s", v.Name(), where)
+			}
+		}
+		return nil
+	}
+	i, acc, i1, acc1 := named["i"], named["acc"], named["i1"], named["acc1"]
+	if err := check(live.LiveOut(loop), "out of the loop", []ir.Value{i1, acc1, p, n}, []ir.Value{i, acc}); err != nil {
+		return err
+	}
+	if err := check(live.LiveIn(loop), "into the loop", []ir.Value{p, n}, []ir.Value{i, acc, i1, acc1}); err != nil {
+		return err
+	}
+	if err := check(live.LiveOut(entry), "out of the entry", []ir.Value{p, n}, []ir.Value{i1, acc1}); err != nil {
+		return err
+	}
+	if err := check(live.LiveIn(exit), "into the exit", []ir.Value{acc1}, []ir.Value{i1, p, n}); err != nil {
+		return err
+	}
+
+	// The pointer stays live to the loop's branch; i1 from its definition
+	// to there, where the back edge hands it to i
+	term := live.Index(loop.Terminator())
+	if iv, _ := live.Interval(p); iv.End != term {
+		return fmt.Errorf("p is live over %v, want it to end at the branch, %d", iv, term)
+	}
+	ivI1, _ := live.Interval(i1)
+	if ivI1.Start != live.Index(i1.(ir.Instruction)) || ivI1.End != term {
+		return fmt.Errorf("i1 is live over %v, want %d to %d", ivI1, live.Index(i1.(ir.Instruction)), term)
+	}
+	ivAcc1, _ := live.Interval(acc1)
+	if ivAcc1.End <= term {
+		return fmt.Errorf("acc1 is live over %v, want it to reach the return", ivAcc1)
+	}
+	if across := live.LiveAcross(i1.(ir.Instruction)); len(across) != 3 {
+		return fmt.Errorf("live across i1: %d values, want p, n and acc1", len(across))
+	}
+	return nil
+}
+
+// a = x + y; b = a + z, where b's add reads a straight from RAX
+func buildReuseLastResult(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("reuse_last_result")
+	chain := b.CreateFunction("chain", types.I64, []types.Type{types.I64, types.I64, types.I64}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	a := b.CreateAdd(chain.Arguments[0], chain.Arguments[1], "a")
+	b.CreateRet(b.CreateAdd(a, chain.Arguments[2], "b"))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	args := []ir.Value{b.ConstInt(types.I64, 10), b.ConstInt(types.I64, 20), b.ConstInt(types.I64, 12)}
+	r := b.CreateCall(chain, args, "r")
+	b.CreateRet(b.CreateTrunc(r, types.I32, "t"))
+	return m
+}
+
+// In chain, each store of RAX is followed by the next use, not a reload
+func verifyReuseLastResult(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	text, err := f.Section(".text").Data()
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	var code []byte
+	for _, sym := range syms {
+		if sym.Name == "chain" {
+			code = text[sym.Value : sym.Value+sym.Size]
+		}
+	}
+	insts, err := codegen.DisassembleText(code)
+	if err != nil {
+		return err
+	}
+	stores := 0
+	for i, inst := range insts {
+		slot, ok := strings.CutPrefix(inst, "mov qword ptr ")
+		if !ok || !strings.HasSuffix(slot, ", rax") {
+			continue
+		}
+		stores++
+		slot = strings.TrimSuffix(slot, ", rax")
+		if i+1 < len(insts) && insts[i+1] == "mov rax, qword ptr "+slot {
+			return fmt.Errorf("%s is reloaded right after its store: %q", slot, insts)
+		}
+	}
+	if stores != 2 {
+		return fmt.Errorf("want the stores of a and b from RAX: %q", insts)
+	}
+	return nil
+}
+
+// A dense switch, so dispatched through a jump table, whose cases 0, 1
+// and 5 go straight to the merge block: each of those edges is critical
+// and its phi copy needs a block of its own
+func buildSwitchCriticalEdges(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("switch_critical_edges")
+	pick := b.CreateFunction("pick", types.I32, []types.Type{types.I32}, false)
+	entry := b.CreateBlock("entry")
+	two := b.CreateBlock("two")
+	three := b.CreateBlock("three")
+	other := b.CreateBlock("other")
+	merge := b.CreateBlock("merge")
+
+	x := pick.Arguments[0]
+	sw := &ir.SwitchInst{
+		BaseInstruction: ir.BaseInstruction{
+			Op:  ir.OpSwitch,
+			Ops: []ir.Value{x},
+		},
+		Condition:    x,
+		DefaultBlock: other,
+	}
+	for v, block := range []*ir.BasicBlock{merge, merge, two, three, nil, merge} {
+		if block != nil {
+			sw.Cases = append(sw.Cases, ir.SwitchCase{Value: b.ConstInt(types.I32, int64(v)), Block: block})
+		}
+	}
+	entry.AddInstruction(sw)
+	for _, block := range []*ir.BasicBlock{two, three, other} {
+		b.SetInsertPoint(block)
+		b.CreateBr(merge)
+	}
+	b.SetInsertPoint(merge)
+	r := b.CreatePhi(types.I32, "r")
+	r.AddIncoming(b.ConstInt(types.I32, 1), entry)
+	r.AddIncoming(b.ConstInt(types.I32, 2), two)
+	r.AddIncoming(b.ConstInt(types.I32, 3), three)
+	r.AddIncoming(b.ConstInt(types.I32, 4), other)
+	b.CreateRet(r)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	var sum ir.Value = b.ConstInt(types.I32, 0)
+	for _, x := range []int64{0, 1, 2, 3, 4, 5, 9} {
+		v := b.CreateCall(pick, []ir.Value{b.ConstInt(types.I32, x)}, "")
+		sum = b.CreateAdd(sum, v, "")
+	}
+	b.CreateRet(sum)
+	return m
+}
+
+// The side-band metadata of the fibonacci object agrees with its symbol
+// table and relocation sections
+func runObjectMetadata() error {
+	obj, md, err := codegen.GenerateObjectWithMetadata(buildFibonacci(builder.New()), codegen.DefaultOptions())
+	if err != nil {
+		return err
+	}
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+
+	described := make(map[string]codegen.MetadataSymbol)
+	for _, ms := range append(md.Defined, md.Undefined...) {
+		described[ms.Name] = ms
+	}
+	bindings := map[elf.SymBind]string{elf.STB_LOCAL: "local", elf.STB_GLOBAL: "global", elf.STB_WEAK: "weak"}
+	named := 0
+	for _, sym := range syms {
+		if sym.Name == "" || elf.ST_TYPE(sym.Info) == elf.STT_SECTION || elf.ST_TYPE(sym.Info) == elf.STT_FILE {
+			continue
+		}
+		named++
+		ms, ok := described[sym.Name]
+		section := ""
+		if sym.Section != elf.SHN_UNDEF && int(sym.Section) < len(f.Sections) {
+			section = f.Sections[sym.Section].Name
+		}
+		if !ok || ms.Section != section || ms.Value != sym.Value || ms.Size != sym.Size || ms.Binding != bindings[elf.ST_BIND(sym.Info)] {
+			return fmt.Errorf("symbol %s (%s+%#x, size %d) described as %+v", sym.Name, section, sym.Value, sym.Size, ms)
+		}
+	}
+	if named != len(described) || len(md.Defined) == 0 {
+		return fmt.Errorf("%d named symbols, %d described", named, len(described))
+	}
+	if fn := described["fibonacci"]; fn.Type != "func" || fn.Section != ".text" {
+		return fmt.Errorf("fibonacci described as %+v", fn)
+	}
+
+	// Each Elf64_Rela of .rela.text, as the metadata lists it
+	rela := f.Section(".rela.text")
+	if rela == nil {
+		return fmt.Errorf("no .rela.text")
+	}
+	data, err := rela.Data()
+	if err != nil {
+		return err
+	}
+	var want []string
+	for ; len(data) >= 24; data = data[24:] {
+		info := binary.LittleEndian.Uint64(data[8:])
+		sym := syms[info>>32-1]
+		target := sym.Name
+		if elf.ST_TYPE(sym.Info) == elf.STT_SECTION {
+			target = f.Sections[sym.Section].Name
+		}
+		want = append(want, fmt.Sprintf(".text+%#x %s %v%+d", binary.LittleEndian.Uint64(data),
+			target, elf.R_X86_64(uint32(info)), int64(binary.LittleEndian.Uint64(data[16:]))))
+	}
+	var got []string
+	for _, r := range md.Relocations {
+		got = append(got, fmt.Sprintf("%s+%#x %s %s%+d", r.Section, r.Offset, r.Target, r.Type, r.Addend))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		return fmt.Errorf("relocations described as\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	out, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(out), `"name":"fibonacci","section":".text"`) {
+		return fmt.Errorf("unexpected JSON: %s", out)
+	}
+	return nil
+}
+
+// i8 and i16 shifts done at their own width, by a count in CL or an
+// immediate, including counts of the width or more
+func buildNarrowShifts(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("narrow_shifts")
+	shifter := func(name string, t types.Type, op func(l, r ir.Value, n string) *ir.BinaryInst) *ir.Function {
+		fn := b.CreateFunction(name, t, []types.Type{t, t}, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		b.CreateRet(op(fn.Arguments[0], fn.Arguments[1], "r"))
+		return fn
+	}
+	shl8 := shifter("shl8", types.I8, b.CreateShl)
+	lshr8 := shifter("lshr8", types.I8, b.CreateLShr)
+	ashr8 := shifter("ashr8", types.I8, b.CreateAShr)
+	lshr16 := shifter("lshr16", types.I16, b.CreateLShr)
+
+	// Constant counts: the 9 takes the sign-fill path, at the i8's width
+	ashr8by9 := b.CreateFunction("ashr8by9", types.I8, []types.Type{types.I8}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateAShr(ashr8by9.Arguments[0], b.ConstInt(types.I8, 9), "r"))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	checks := []struct {
+		fn         *ir.Function
+		t          types.Type
+		l, r, want int64
+	}{
+		{shl8, types.I8, 3, 5, 96},
+		{shl8, types.I8, 0x81, 9, 0},   // Every bit shifted out
+		{lshr8, types.I8, 0x80, 9, 0},  // Not 0x80 shifted in a wider register
+		{ashr8, types.I8, 0x80, 9, -1}, // Sign of bit 7, not of bit 63
+		{lshr16, types.I16, 0x8000, 15, 1},
+	}
+	var r ir.Value = b.ConstInt(types.I32, 30)
+	for _, c := range checks {
+		got := b.CreateCall(c.fn, []ir.Value{b.ConstInt(c.t, c.l), b.ConstInt(c.t, c.r)}, c.fn.Name())
+		ok := b.CreateZExt(b.CreateICmpEQ(got, b.ConstInt(c.t, c.want), "eq"), types.I32, "ok")
+		r = b.CreateAdd(r, b.CreateMul(ok, b.ConstInt(types.I32, 2), "two"), "r")
+	}
+	got := b.CreateCall(ashr8by9, []ir.Value{b.ConstInt(types.I8, -64)}, "by9")
+	ok := b.CreateZExt(b.CreateICmpEQ(got, b.ConstInt(types.I8, -1), "eq"), types.I32, "ok")
+	b.CreateRet(b.CreateAdd(r, b.CreateMul(ok, b.ConstInt(types.I32, 2), "two"), "r"))
+	return m
+}
+
+// runMalformedIR builds one module for each way the fuzzer found to make
+// the backend panic, and checks each is rejected with an error instead
+func runMalformedIR() error {
+	cases := []struct {
+		name  string
+		build func(b *builder.Builder, x, f ir.Value, p *ir.Argument)
+		want  string
+	}{
+		{"opcode of another instruction", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			b.CreateAdd(x, x, "a").Op = ir.OpLoad
+		}, "is a *ir.BinaryInst, not a *ir.LoadInst"},
+		{"missing operand", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			a := b.CreateAdd(x, x, "a")
+			a.Ops = a.Ops[:1]
+		}, "has 1 operands, needs 2"},
+		{"operand with no value", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			st := b.CreateStore(x, b.CreateAlloca(types.I32, "slot"))
+			b.CreateAdd(x, x, "a").Ops[1] = st
+		}, "operand 1 of add instruction a has no value"},
+		{"result with no type", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			b.CreateStore(x, b.CreateAlloca(types.I32, "slot")).Op = ir.OpShl
+		}, "has no type"},
+		{"fadd of an integer", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			b.CreateFAdd(f, f, "s").Ops[0] = x
+		}, "fadd double has a i32 operand"},
+		{"fneg of an integer", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			b.CreateFNeg(x, "n")
+		}, "fneg"},
+		{"fcmp of integers", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			b.CreateFCmp(ir.FCmpOLT, x, x, "c")
+		}, "only floats of one type can be compared"},
+		{"float constant of an integer type", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			b.CreateAdd(x, b.ConstFloat(types.I32, 1.5), "a")
+		}, "float constant 1.5 of type i32"},
+		{"phi of another type", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			from := b.GetInsertBlock()
+			join := b.CreateBlock("join")
+			b.CreateBr(join)
+			b.SetInsertPoint(join)
+			b.CreatePhi(types.F64, "m").AddIncoming(x, from)
+		}, "of another type"},
+		{"struct GEP field out of range", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			pair := types.NewStruct("", []types.Type{types.I32, types.I32}, false)
+			b.CreateGEP(pair, p, []ir.Value{b.ConstInt(types.I64, 0), b.ConstInt(types.I32, 5)}, "q")
+		}, "GEP field 5 of a 2-field struct"},
+		{"ctpop without an argument", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			b.CreateCallByName("llvm.ctpop.i32", types.I32, nil, "n")
+		}, "llvm.ctpop takes"},
+		{"fma of an integer", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			b.CreateCallByName("llvm.fma.f64", types.F64, []ir.Value{f, x, f}, "r")
+		}, "llvm.fma takes"},
+		{"va_copy without a source", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			b.CreateCallByName("llvm.va_copy", types.Void, []ir.Value{p}, "")
+		}, "llvm.va_copy takes"},
+		{"global aligned to 24", func(b *builder.Builder, x, f ir.Value, p *ir.Argument) {
+			b.CreateGlobal("odd", types.I64, b.ConstInt(types.I64, 1)).Alignment = 24
+		}, "in global odd: alignment 24"},
+	}
+
+	for _, tc := range cases {
+		b := builder.New()
+		m := b.CreateModule("malformed")
+		fn := b.CreateFunction("f", types.I32, []types.Type{types.I32, types.F64, types.NewPointer(types.I8)}, true)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		tc.build(b, fn.Arguments[0], fn.Arguments[1], fn.Arguments[2])
+		b.CreateRet(fn.Arguments[0])
+
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			_, err = codegen.GenerateObject(m)
+			return err
+		}()
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			return fmt.Errorf("%s: got %v, want an error containing %q", tc.name, err, tc.want)
+		}
+	}
+	return nil
+}
+
+// fuzzBases are the valid modules the malformed-IR fuzzer mutates
+var fuzzBases = []func(*builder.Builder) *ir.Module{
+	buildFibonacci, buildSimpleLoop, buildNestedLoops, buildArrayOps,
+	buildCastingOps, buildComplexPhi, buildGEPPointerArg, buildStructOps,
+	buildSwitchStatement, buildSelect, buildMemoryOps, buildFloatSignatures,
+	buildFloatPhiLoop, buildStructReturnExtract, buildNestedExtract,
+	buildVariadicCallee, buildDynamicAlloca, buildUnsignedFpConversions,
+	buildNarrowShifts, buildICmpZero, buildFMA, buildVectorSpill,
+}
+
+// runFuzzMalformedIR feeds the backend modules that were valid until an
+// instruction's operands, type or opcode were scrambled. Rejecting one is
+// fine; panicking on one is a bug. The seed is fixed so a failure can be
+// replayed.
+func runFuzzMalformedIR() error {
+	rng := rand.New(rand.NewSource(1912))
+	for iter := 0; iter < 3000; iter++ {
+		m := fuzzBases[rng.Intn(len(fuzzBases))](builder.New())
+		// An operand is replaced only by a value defined before it, or the
+		// mutations could make a chain of non-phi instructions circular
+		var insts []ir.Instruction
+		var defined []int
+		var pool []ir.Value
+		for _, fn := range m.Functions {
+			for _, arg := range fn.Arguments {
+				pool = append(pool, arg)
+			}
+			for _, block := range fn.Blocks {
+				for _, inst := range block.Instructions {
+					insts = append(insts, inst)
+					defined = append(defined, len(pool))
+					pool = append(pool, inst)
+				}
+			}
+		}
+		if len(insts) == 0 {
+			continue
+		}
+		consts := []ir.Value{
+			builder.New().ConstInt(types.I1, 1),
+			builder.New().ConstInt(types.I8, -3),
+			builder.New().ConstInt(types.I32, 7),
+			builder.New().ConstInt(types.I64, 1<<40),
+			builder.New().ConstFloat(types.F32, 1.5),
+			builder.New().ConstFloat(types.F64, -2.25),
+			builder.New().ConstNull(types.NewPointer(types.I8)),
+			builder.New().ConstUndef(types.I32),
+		}
+		typs := []types.Type{types.I1, types.I8, types.I32, types.I64, types.F32, types.F64,
+			types.Void, types.NewPointer(types.I64), types.NewArray(types.I32, 4),
+			types.NewStruct("", []types.Type{types.I32, types.F64}, false)}
+		ops := []ir.Opcode{ir.OpAdd, ir.OpFAdd, ir.OpSDiv, ir.OpShl, ir.OpLoad, ir.OpStore,
+			ir.OpGetElementPtr, ir.OpICmp, ir.OpFCmp, ir.OpRet, ir.OpBr, ir.OpCondBr,
+			ir.OpSwitch, ir.OpTrunc, ir.OpFPToSI, ir.OpSIToFP, ir.OpBitcast, ir.OpPhi,
+			ir.OpSelect, ir.OpCall, ir.OpExtractValue, ir.OpInsertValue, ir.OpAlloca}
+
+		for k := 1 + rng.Intn(3); k > 0; k-- {
+			at := rng.Intn(len(insts))
+			inst := insts[at]
+			base := reflect.ValueOf(inst).Elem().FieldByName("BaseInstruction").Addr().Interface().(*ir.BaseInstruction)
+			switch rng.Intn(4) {
+			case 0:
+				if len(base.Ops) > 0 {
+					v := consts[rng.Intn(len(consts))]
+					if n := defined[at]; n > 0 && rng.Intn(2) == 0 {
+						v = pool[rng.Intn(n)]
+					}
+					base.Ops[rng.Intn(len(base.Ops))] = v
+				}
+			case 1:
+				if len(base.Ops) > 0 {
+					base.Ops = base.Ops[:len(base.Ops)-1]
+				}
+			case 2:
+				base.ValType = typs[rng.Intn(len(typs))]
+			case 3:
+				base.Op = ops[rng.Intn(len(ops))]
+			}
+		}
+
+		if err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("iteration %d: panic: %v", iter, r)
+				}
+			}()
+			codegen.GenerateObject(m)
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The same loop three times over, its blocks in different IR orders, so
+// the back edges' phi copies are compiled before, after and around the
+// header they target. The header dominates both latches, which also read
+// values from a body block laid out after them; the even latch reaches
+// the header on a critical edge once. Each loop returns 109; each that
+// does adds 2 to 36.
+func buildPhiForwardRefs(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("phi_forward_refs")
+
+	loop := func(name string, order []int) *ir.Function {
+		fn := b.CreateFunction(name, types.I32, nil, false)
+		entry := b.CreateBlock("entry")
+		header := b.CreateBlock("header")
+		body := b.CreateBlock("body")
+		even := b.CreateBlock("even")
+		odd := b.CreateBlock("odd")
+		exit := b.CreateBlock("exit")
+		c := func(v int64) ir.Value { return b.ConstInt(types.I32, v) }
+
+		b.SetInsertPoint(entry)
+		b.CreateBr(header)
+
+		b.SetInsertPoint(header)
+		i := b.CreatePhi(types.I32, "i")
+		x := b.CreatePhi(types.I32, "x")
+		y := b.CreatePhi(types.I32, "y")
+		acc := b.CreatePhi(types.I32, "acc")
+		b.CreateCondBr(b.CreateICmpSGE(i, c(10), "done"), exit, body)
+
+		b.SetInsertPoint(body)
+		t := b.CreateMul(acc, c(2), "t")
+		isOdd := b.CreateICmpNE(b.CreateAnd(i, c(1), "bit"), c(0), "is_odd")
+		b.CreateCondBr(isOdd, odd, even)
+
+		// At i == 4 take the header edge straight from here, with a sum
+		// and a rotation instead of the swap
+		b.SetInsertPoint(even)
+		ie := b.CreateAdd(i, c(1), "ie")
+		sum := b.CreateAdd(x, y, "sum")
+		acce := b.CreateAdd(t, c(1), "acce")
+		b.CreateCondBr(b.CreateICmpEQ(i, c(4), "four"), header, odd)
+
+		b.SetInsertPoint(odd)
+		io := b.CreateAdd(i, c(1), "io")
+		acco := b.CreateAdd(t, x, "acco")
+		b.CreateBr(header)
+
+		b.SetInsertPoint(exit)
+		total := b.CreateAdd(b.CreateAdd(acc, x, ""), y, "total")
+		b.CreateRet(b.CreateURem(total, c(256), "r"))
+
+		i.AddIncoming(c(0), entry)
+		i.AddIncoming(io, odd)
+		i.AddIncoming(ie, even)
+		x.AddIncoming(c(1), entry)
+		x.AddIncoming(y, odd)
+		x.AddIncoming(sum, even)
+		y.AddIncoming(c(2), entry)
+		y.AddIncoming(x, odd)
+		y.AddIncoming(x, even)
+		acc.AddIncoming(c(0), entry)
+		acc.AddIncoming(acco, odd)
+		acc.AddIncoming(acce, even)
+
+		blocks := fn.Blocks
+		fn.Blocks = nil
+		for _, k := range order {
+			fn.Blocks = append(fn.Blocks, blocks[k])
+		}
+		return fn
+	}
+	loops := []*ir.Function{
+		loop("in_order", []int{0, 1, 2, 3, 4, 5}),
+		loop("latches_first", []int{0, 4, 3, 2, 1, 5}),
+		loop("reversed", []int{0, 5, 4, 3, 2, 1}),
+	}
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	var r ir.Value = b.ConstInt(types.I32, 36)
+	for _, fn := range loops {
+		ok := b.CreateICmpEQ(b.CreateCall(fn, nil, ""), b.ConstInt(types.I32, 109), "")
+		r = b.CreateAdd(r, b.CreateMul(b.CreateZExt(ok, types.I32, ""), b.ConstInt(types.I32, 2), ""), "")
+	}
+	b.CreateRet(r)
+	return m
+}
+
+// A function whose entry block starts with a call passing its six register
+// arguments on in reverse order: loading each into its outgoing register
+// would clobber one not yet read, were the incoming ones not saved to
+// their slots in the prologue. main passes its own argc through as the
+// first. Each that holds adds 2 to 38.
+func buildEntryCallArgs(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("entry_call_args")
+	six := []types.Type{types.I64, types.I64, types.I64, types.I64, types.I64, types.I64}
+
+	// Horner's rule weights the arguments by position: 321 for 6..1
+	sink := b.CreateFunction("sink", types.I64, six, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	var h ir.Value = b.ConstInt(types.I64, 0)
+	for _, p := range sink.Arguments {
+		h = b.CreateAdd(b.CreateMul(h, b.ConstInt(types.I64, 2), ""), p, "")
+	}
+	b.CreateRet(h)
+
+	// The arguments are read again after the call, from their slots
+	relay := b.CreateFunction("relay", types.I64, six, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	args := relay.Arguments
+	r := b.CreateCall(sink, []ir.Value{args[5], args[4], args[3], args[2], args[1], args[0]}, "r")
+	ends := b.CreateSub(b.CreateAdd(args[0], args[5], ""), b.ConstInt(types.I64, 7), "ends")
+	b.CreateRet(b.CreateAdd(r, ends, ""))
+
+	main := b.CreateFunction("main", types.I32, []types.Type{types.I32, types.NewPointer(types.I8)}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	argc := b.CreateZExt(main.Arguments[0], types.I64, "argc")
+	v := b.CreateCall(relay, []ir.Value{argc, b.ConstInt(types.I64, 2), b.ConstInt(types.I64, 3),
+		b.ConstInt(types.I64, 4), b.ConstInt(types.I64, 5), b.ConstInt(types.I64, 6)}, "v")
+	w := b.CreateCall(sink, []ir.Value{b.ConstInt(types.I64, 1), b.ConstInt(types.I64, 2), b.ConstInt(types.I64, 3),
+		b.ConstInt(types.I64, 4), b.ConstInt(types.I64, 5), b.ConstInt(types.I64, 6)}, "w")
+	var res ir.Value = b.ConstInt(types.I32, 38)
+	for _, ok := range []ir.Value{
+		b.CreateICmpEQ(v, b.ConstInt(types.I64, 321), ""),
+		b.CreateICmpEQ(w, b.ConstInt(types.I64, 120), ""),
+	} {
+		res = b.CreateAdd(res, b.CreateMul(b.CreateZExt(ok, types.I32, ""), b.ConstInt(types.I32, 2), ""), "")
+	}
+	b.CreateRet(res)
+	return m
+}
+
+// A _start of the module's own, for TextSections to place in .text.boot:
+// it calls main in .text and exits with a status picked by a dense switch
+// on the result, whose jump table entries point into .text.boot
+func buildBootStart(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("boot_start")
+
+	main := b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.ConstInt(types.I32, 42))
+
+	b.CreateFunction("_start", types.Void, nil, false)
+	entry := b.CreateBlock("entry")
+	exit := b.CreateBlock("exit")
+	other := b.CreateBlock("other")
+	b.SetInsertPoint(entry)
+	r := b.CreateCall(main, nil, "r")
+	sw := &ir.SwitchInst{
+		BaseInstruction: ir.BaseInstruction{
+			Op:  ir.OpSwitch,
+			Ops: []ir.Value{r},
+		},
+		Condition:    r,
+		DefaultBlock: other,
+	}
+	entry.AddInstruction(sw)
+	b.SetInsertPoint(other)
+	b.CreateBr(exit)
+
+	b.SetInsertPoint(exit)
+	status := b.CreatePhi(types.I32, "status")
+	status.AddIncoming(b.ConstInt(types.I32, 1), other)
+	for v := int64(40); v < 45; v++ {
+		block := b.CreateBlock(fmt.Sprintf("case%d", v))
+		sw.Cases = append(sw.Cases, ir.SwitchCase{Value: b.ConstInt(types.I32, v), Block: block})
+		b.SetInsertPoint(block)
+		b.CreateBr(exit)
+		status.AddIncoming(b.ConstInt(types.I32, v), block)
+	}
+
+	b.SetInsertPoint(exit)
+	b.CreateSyscall([]ir.Value{b.ConstInt(types.I64, 231), b.CreateZExt(status, types.I64, "")}, "")
+	b.CreateUnreachable()
+	return m
+}
+
+// _start is a function in an executable .text.boot, reached from .text
+// only through relocations: its own ones, and the jump table's
+func verifyTextBoot(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	boot := f.Section(".text.boot")
+	if boot == nil || boot.Flags != elf.SHF_ALLOC|elf.SHF_EXECINSTR {
+		return fmt.Errorf("no executable .text.boot section")
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	var bootSym int
+	for i, sym := range syms {
+		switch {
+		case sym.Name == "_start":
+			if f.Sections[sym.Section] != boot || sym.Value != 0 || sym.Size != boot.Size ||
+				elf.ST_TYPE(sym.Info) != elf.STT_FUNC {
+				return fmt.Errorf("_start isn't the function filling .text.boot")
+			}
+		case sym.Name == "main" && f.Sections[sym.Section].Name != ".text":
+			return fmt.Errorf("main is in %s", f.Sections[sym.Section].Name)
+		case elf.ST_TYPE(sym.Info) == elf.STT_SECTION && f.Sections[sym.Section] == boot:
+			bootSym = i + 1 // Symbols() leaves out the null symbol
+		}
+	}
+
+	rela := f.Section(".rela.text.boot")
+	if rela == nil || f.Sections[rela.Info] != boot {
+		return fmt.Errorf("no .rela.text.boot for the call to main")
+	}
+	table := f.Section(".rela.rodata")
+	if table == nil {
+		return fmt.Errorf("no jump table relocations")
+	}
+	data, err := table.Data()
+	if err != nil {
+		return err
+	}
+	for off := 0; off+24 <= len(data); off += 24 {
+		if sym := int(binary.LittleEndian.Uint64(data[off+8:]) >> 32); sym != bootSym {
+			return fmt.Errorf("jump table entry %d refers to symbol %d, not .text.boot", off/24, sym)
+		}
+	}
+	return nil
+}
+
+// buildAllocaCounter is a counting loop as a front end emits it before
+// optimization, with its counter and total in allocas: count(n) adds up
+// the i below n other than 3. main also keeps a local whose address goes
+// through a GEP, which must stay in memory.
+func buildAllocaCounter(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("promote_allocas")
+	count := b.CreateFunction("count", types.I32, []types.Type{types.I32}, false)
+	entry := b.CreateBlock("entry")
+	loop := b.CreateBlock("loop")
+	body := b.CreateBlock("body")
+	add := b.CreateBlock("add")
+	latch := b.CreateBlock("latch")
+	done := b.CreateBlock("done")
+
+	b.SetInsertPoint(entry)
+	i := b.CreateAlloca(types.I32, "i")
+	sum := b.CreateAlloca(types.I32, "sum")
+	b.CreateStore(b.ConstInt(types.I32, 0), i)
+	b.CreateStore(b.ConstInt(types.I32, 0), sum)
+	b.CreateBr(loop)
+
+	b.SetInsertPoint(loop)
+	iv := b.CreateLoad(types.I32, i, "iv")
+	b.CreateCondBr(b.CreateICmpSLT(iv, count.Arguments[0], "more"), body, done)
+
+	b.SetInsertPoint(body)
+	iv = b.CreateLoad(types.I32, i, "iv.body")
+	b.CreateCondBr(b.CreateICmpEQ(iv, b.ConstInt(types.I32, 3), "skip"), latch, add)
+
+	b.SetInsertPoint(add)
+	s := b.CreateLoad(types.I32, sum, "s")
+	b.CreateStore(b.CreateAdd(s, b.CreateLoad(types.I32, i, "iv.add"), "s.next"), sum)
+	b.CreateBr(latch)
+
+	b.SetInsertPoint(latch)
+	iv = b.CreateLoad(types.I32, i, "iv.latch")
+	b.CreateStore(b.CreateAdd(iv, b.ConstInt(types.I32, 1), "iv.next"), i)
+	b.CreateBr(loop)
+
+	b.SetInsertPoint(done)
+	b.CreateRet(b.CreateLoad(types.I32, sum, "total"))
+
+	// 0+1+2+4+5+6 = 18, and 24 from the local kept in memory
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	local := b.CreateAlloca(types.I32, "local")
+	b.CreateStore(b.ConstInt(types.I32, 24), local)
+	p := b.CreateGEP(types.I32, local, []ir.Value{b.ConstInt(types.I64, 0)}, "p")
+	r := b.CreateCall(count, []ir.Value{b.ConstInt(types.I32, 7)}, "r")
+	b.CreateRet(b.CreateAdd(r, b.CreateLoad(types.I32, p, "l"), "result"))
+	return m
+}
+
+// Optimizing at level 2 turns count's counter and total into phis, leaving
+// it no loads or stores, while main's local, whose address escapes into a
+// GEP, stays an alloca. The promoted program still computes 42.
+func runPromoteAllocas() error {
+	// Memory operands count's code addresses through a register other than
+	// the frame's: the loads and stores through an alloca's address
+	indirect := func(m *ir.Module) (int, error) {
+		l, err := codegen.GenerateListing(m)
+		if err != nil {
+			return 0, err
+		}
+		n := 0
+		for _, fn := range l.Functions {
+			if fn.Name != "count" {
+				continue
+			}
+			lines, err := codegen.DisassembleText(l.Text[fn.Start:fn.End])
+			if err != nil {
+				return 0, err
+			}
+			for _, line := range lines {
+				if at := strings.Index(line, "ptr ["); at >= 0 {
+					if base := line[at+5:]; !strings.HasPrefix(base, "rbp") && !strings.HasPrefix(base, "rsp") {
+						n++
+					}
+				}
+			}
+		}
+		return n, nil
+	}
+
+	before, err := indirect(buildAllocaCounter(builder.New()))
+	if err != nil {
+		return err
+	}
+	if before == 0 {
+		return fmt.Errorf("count accesses no alloca before promotion")
+	}
+
+	m := buildAllocaCounter(builder.New())
+	if err := codegen.Optimize(m, 1); err != nil {
+		return err
+	}
+	if entry := m.GetFunction("count").Blocks[0]; entry.Instructions[0].Opcode() != ir.OpAlloca {
+		return fmt.Errorf("level 1 promoted the allocas")
+	}
+	if err := codegen.Optimize(m, 2); err != nil {
+		return err
+	}
+	phis := 0
+	for _, block := range m.GetFunction("count").Blocks {
+		for _, inst := range block.Instructions {
+			switch inst.Opcode() {
+			case ir.OpAlloca, ir.OpLoad, ir.OpStore:
+				return fmt.Errorf("count still has %s after promotion", ir.FormatInstruction(inst))
+			case ir.OpPhi:
+				phis++
+			}
+		}
+	}
+	// i and sum in the loop header, and sum where add and the skip meet
+	if phis != 3 {
+		return fmt.Errorf("count has %d phis after promotion, want 3", phis)
+	}
+	if entry := m.GetFunction("main").Blocks[0]; entry.Instructions[0].Opcode() != ir.OpAlloca {
+		return fmt.Errorf("main's escaping local was promoted")
+	}
+	if after, err := indirect(m); err != nil {
+		return err
+	} else if after != 0 {
+		return fmt.Errorf("count makes %d accesses through a pointer after promotion", after)
+	}
+
+	exe, err := codegen.GenerateExecutable(m, "")
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "promote")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "program")
+	if err := os.WriteFile(path, exe, 0755); err != nil {
+		return err
+	}
+	err = exec.Command(path).Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 42 {
+		return fmt.Errorf("running the promoted program: %v, want exit status 42", err)
+	}
+	return nil
+}
+
+// sign stores a bool to a local on both arms of a diamond and branches on
+// it at the join, so the phi promotion creates there is read by nothing
+// but the branch. It returns 10 for a positive argument and 1 otherwise.
+func buildPromotedCondition(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("promoted_condition")
+	sign := b.CreateFunction("sign", types.I32, []types.Type{types.I32}, false)
+	entry := b.CreateBlock("entry")
+	pos := b.CreateBlock("pos")
+	neg := b.CreateBlock("neg")
+	join := b.CreateBlock("join")
+	yes := b.CreateBlock("yes")
+	no := b.CreateBlock("no")
+
+	b.SetInsertPoint(entry)
+	flag := b.CreateAlloca(types.I1, "flag")
+	b.CreateCondBr(b.CreateICmpSGT(sign.Arguments[0], b.ConstInt(types.I32, 0), "gt"), pos, neg)
+	b.SetInsertPoint(pos)
+	b.CreateStore(b.ConstInt(types.I1, 1), flag)
+	b.CreateBr(join)
+	b.SetInsertPoint(neg)
+	b.CreateStore(b.ConstInt(types.I1, 0), flag)
+	b.CreateBr(join)
+	b.SetInsertPoint(join)
+	// Built by hand, so the condition is the field alone, with no operand
+	// standing for it
+	br := &ir.CondBrInst{Condition: b.CreateLoad(types.I1, flag, "f"), TrueBlock: yes, FalseBlock: no}
+	br.Op = ir.OpCondBr
+	join.AddInstruction(br)
+	b.SetInsertPoint(yes)
+	b.CreateRet(b.ConstInt(types.I32, 10))
+	b.SetInsertPoint(no)
+	b.CreateRet(b.ConstInt(types.I32, 1))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	p := b.CreateCall(sign, []ir.Value{b.ConstInt(types.I32, 5)}, "p")
+	n := b.CreateCall(sign, []ir.Value{b.ConstInt(types.I32, -3)}, "n")
+	r := b.CreateAdd(b.CreateMul(p, b.ConstInt(types.I32, 4), "p4"), b.CreateMul(n, b.ConstInt(types.I32, 2), "n2"), "r")
+	b.CreateRet(r)
+	return m
+}
+
+// A promoted bool that only a branch reads keeps its phi, and the branch
+// goes the way it was stored
+func runPromotedCondition() error {
+	m := buildPromotedCondition(builder.New())
+	if err := codegen.Optimize(m, 2); err != nil {
+		return err
+	}
+	join := m.GetFunction("sign").Blocks[3]
+	phi, ok := join.Instructions[0].(*ir.PhiInst)
+	if !ok {
+		return fmt.Errorf("join starts with %s, want the promoted flag's phi", ir.FormatInstruction(join.Instructions[0]))
+	}
+	if br, ok := join.Instructions[len(join.Instructions)-1].(*ir.CondBrInst); !ok || br.Condition != ir.Value(phi) {
+		return fmt.Errorf("join doesn't branch on the promoted flag")
+	}
+
+	exe, err := codegen.GenerateExecutable(m, "")
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "promote")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "program")
+	if err := os.WriteFile(path, exe, 0755); err != nil {
+		return err
+	}
+	err = exec.Command(path).Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 42 {
+		return fmt.Errorf("running the promoted program: %v, want exit status 42", err)
+	}
+	return nil
+}
+
+// A truncation to i1 keeps only the low bit: lowbit stores trunc(x) to an
+// i1 local and reads it back both as the i1, to branch on, and as the raw
+// byte, which must be exactly 0 or 1. It returns 3 for a set bit, 0 for a
+// clear one.
+func buildTruncToI1(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("trunc_i1")
+	lowbit := b.CreateFunction("lowbit", types.I32, []types.Type{types.I32}, false)
+	entry := b.CreateBlock("entry")
+	set := b.CreateBlock("set")
+	clear := b.CreateBlock("clear")
+	join := b.CreateBlock("join")
+
+	b.SetInsertPoint(entry)
+	slot := b.CreateAlloca(types.I1, "slot")
+	b.CreateStore(b.CreateTrunc(lowbit.Arguments[0], types.I1, "bit"), slot)
+	bit := b.CreateLoad(types.I1, slot, "l")
+	raw := b.CreateZExt(b.CreateLoad(types.I8, slot, "raw"), types.I32, "raw32")
+	b.CreateCondBr(bit, set, clear)
+	b.SetInsertPoint(set)
+	b.CreateBr(join)
+	b.SetInsertPoint(clear)
+	b.CreateBr(join)
+	b.SetInsertPoint(join)
+	taken := b.CreatePhi(types.I32, "taken")
+	taken.AddIncoming(b.ConstInt(types.I32, 1), set)
+	taken.AddIncoming(b.ConstInt(types.I32, 0), clear)
+	b.CreateRet(b.CreateAdd(b.CreateMul(raw, b.ConstInt(types.I32, 2), "raw2"), taken, "r"))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	var r ir.Value = b.ConstInt(types.I32, 32)
+	for _, c := range []struct{ x, want int64 }{{2, 0}, {3, 3}, {0x100, 0}, {-1, 3}, {1, 3}} {
+		got := b.CreateCall(lowbit, []ir.Value{b.ConstInt(types.I32, c.x)}, "got")
+		ok := b.CreateZExt(b.CreateICmpEQ(got, b.ConstInt(types.I32, c.want), "eq"), types.I32, "ok")
+		r = b.CreateAdd(r, b.CreateMul(ok, b.ConstInt(types.I32, 2), "two"), "r")
+	}
+	b.CreateRet(r)
+	return m
+}
+
+// renamePass renames one function, as a front end's own pass might
+type renamePass struct{ from, to string }
+
+func (p renamePass) Name() string { return "rename-" + p.from }
+
+func (p renamePass) Run(m *ir.Module) error {
+	fn := m.GetFunction(p.from)
+	if fn == nil {
+		return fmt.Errorf("no function %s", p.from)
+	}
+	fn.SetName(p.to)
+	return nil
+}
+
+// A registered custom pass runs ahead of code generation, after the
+// built-in unreachable block removal, which drops the only call to an
+// undefined function
+func runCustomPass() error {
+	b := builder.New()
+	m := b.CreateModule("custom_pass")
+	missing := b.DeclareFunction("missing", types.I32, nil, false)
+	helper := b.CreateFunction("helper", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.ConstInt(types.I32, 42))
+	b.SetInsertPoint(b.CreateBlock("dead"))
+	b.CreateRet(b.CreateCall(missing, nil, "m"))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateCall(helper, nil, "r"))
+
+	if err := codegen.RegisterPass(renamePass{from: "helper", to: "renamed_helper"}); err != nil {
+		return err
+	}
+	if err := codegen.RegisterPass(renamePass{from: "helper"}); err == nil {
+		return fmt.Errorf("a second pass with the same name registered")
+	}
+	pm := codegen.DefaultPipeline(1)
+	if err := pm.AddByName("rename-helper"); err != nil {
+		return err
+	}
+	obj, err := codegen.GenerateObjectWithPasses(m, pm, codegen.DefaultOptions())
+	if err != nil {
+		return err
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, sym := range syms {
+		names[sym.Name] = true
+	}
+	switch {
+	case !names["renamed_helper"] || names["helper"]:
+		return fmt.Errorf("helper wasn't renamed: symbols %v", names)
+	case names["missing"]:
+		return fmt.Errorf("the unreachable call to missing was compiled")
+	}
+
+	// A failing pass stops the pipeline and is named in the error
+	_, err = codegen.GenerateObjectWithPasses(m, codegen.NewPassManager(renamePass{from: "helper"}), codegen.DefaultOptions())
+	if err == nil || !strings.Contains(err.Error(), "rename-helper") {
+		return fmt.Errorf("failing pass: got error %v", err)
+	}
+	return nil
+}
+
+// Malformed assembly functions must fail compilation, naming the function
+// and line
+func runAsmErrors() error {
+	cases := map[string]string{
+		"unknown_mnemonic": "nop\nfrobnicate rax",
+		"undefined_label":  "nop\njne nowhere",
+		"size_mismatch":    "nop\nmov rax, ecx",
+		"unsized_memory":   "nop\nmov [rax], 1",
+		"bad_register":     "nop\npush rxx",
+		"xmm_in_integer":   "nop\nadd rax, xmm0",
+		"sse_operands":     "nop\naddsd rax, xmm0",
+	}
+	for name, body := range cases {
+		b := builder.New()
+		m := b.CreateModule("asm_" + name)
+		opts := codegen.DefaultOptions()
+		opts.AsmFunctions = map[string]string{name: body}
+
+		_, err := codegen.GenerateObjectWithOptions(m, opts)
+		if err == nil {
+			return fmt.Errorf("%s assembled without error", name)
+		}
+		if !strings.Contains(err.Error(), name) || !strings.Contains(err.Error(), "line 2") {
+			return fmt.Errorf("%s: error doesn't locate the fault: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Vector fp casts aren't lowered; each must fail compilation with an error
+// rather than panic on a type assertion
+func runVectorFpCastRejected() (err error) {
+	v4f32 := types.NewVector(types.F32, 4)
+	v4f64 := types.NewVector(types.F64, 4)
+	v4i32 := types.NewVector(types.I32, 4)
+
+	casts := map[string]func(b *builder.Builder) ir.Value{
+		"fpext": func(b *builder.Builder) ir.Value {
+			return b.CreateFPExt(b.ConstZero(v4f32), v4f64, "v")
+		},
+		"fptrunc": func(b *builder.Builder) ir.Value {
+			return b.CreateFPTrunc(b.ConstZero(v4f64), v4f32, "v")
+		},
+		"sitofp": func(b *builder.Builder) ir.Value {
+			return b.CreateSIToFP(b.ConstZero(v4i32), v4f32, "v")
+		},
+		"fptosi": func(b *builder.Builder) ir.Value {
+			return b.CreateFPToSI(b.ConstZero(v4f32), v4i32, "v")
+		},
+	}
+
+	for name, cast := range casts {
+		b := builder.New()
+		m := b.CreateModule("vector_" + name)
+		b.CreateFunction("f", types.Void, nil, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		cast(b)
+		b.CreateRetVoid()
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%s panicked: %v", name, r)
+				}
+			}()
+			if _, cerr := codegen.GenerateObject(m); cerr == nil {
+				err = fmt.Errorf("%s on a vector compiled without error", name)
+			}
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Vector GEPs aren't lowered; a vector base or index must fail compilation
+// rather than compute a single address
+func runVectorGEPRejected() (err error) {
+	ptr := types.NewPointer(types.I32)
+	geps := map[string]func(b *builder.Builder){
+		"vector_index": func(b *builder.Builder) {
+			idx := b.ConstZero(types.NewVector(types.I64, 2))
+			b.CreateGEP(types.I32, b.CreateAlloca(types.I32, "x"), []ir.Value{idx}, "p")
+		},
+		"vector_base": func(b *builder.Builder) {
+			base := b.ConstZero(types.NewVector(ptr, 2))
+			b.CreateGEP(types.I32, base, []ir.Value{b.ConstInt(types.I64, 1)}, "p")
+		},
+	}
+	for name, gep := range geps {
+		b := builder.New()
+		m := b.CreateModule("gep_" + name)
+		b.CreateFunction("f", types.Void, nil, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		gep(b)
+		b.CreateRetVoid()
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("%s panicked: %v", name, r)
+				}
+			}()
+			if _, cerr := codegen.GenerateObject(m); cerr == nil {
+				err = fmt.Errorf("%s compiled without error", name)
+			} else if !strings.Contains(cerr.Error(), "vector GEP") {
+				err = fmt.Errorf("%s: unexpected error: %v", name, cerr)
+			}
+		}()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runCallArityMismatch() error {
+	pair := []types.Type{types.I64, types.I64}
+	ptr := types.NewPointer(types.I8)
+
+	calls := map[string]func(b *builder.Builder){
+		"too_few": func(b *builder.Builder) {
+			f := b.DeclareFunction("pair", types.I64, pair, false)
+			b.CreateCall(f, []ir.Value{b.ConstInt(types.I64, 1)}, "r")
+		},
+		"too_many": func(b *builder.Builder) {
+			f := b.DeclareFunction("pair", types.I64, pair, false)
+			one := b.ConstInt(types.I64, 1)
+			b.CreateCall(f, []ir.Value{one, one, one}, "r")
+		},
+		"wrong_type": func(b *builder.Builder) {
+			f := b.DeclareFunction("pair", types.I64, pair, false)
+			b.CreateCall(f, []ir.Value{b.ConstInt(types.I64, 1), b.ConstFloat(types.F64, 2)}, "r")
+		},
+		"variadic_missing_fixed": func(b *builder.Builder) {
+			f := b.DeclareFunction("printf", types.I32, []types.Type{ptr}, true)
+			b.CreateCall(f, nil, "r")
+		},
+		"indirect_too_few": func(b *builder.Builder) {
+			f := b.DeclareFunction("pair", types.I64, pair, false)
+			ft := types.NewFunction(types.I64, pair, false)
+			b.CreateIndirectCall(ft, f, []ir.Value{b.ConstInt(types.I64, 1)}, "r")
+		},
+	}
+
+	for name, call := range calls {
+		b := builder.New()
+		m := b.CreateModule("arity_" + name)
+		b.CreateFunction("f", types.Void, nil, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		call(b)
+		b.CreateRetVoid()
+
+		if _, err := codegen.GenerateObject(m); err == nil {
+			return fmt.Errorf("%s compiled without error", name)
+		} else if !strings.Contains(err.Error(), "call to ") {
+			return fmt.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+
+	// Extra variadic arguments past the fixed ones are fine
+	b := builder.New()
+	m := b.CreateModule("arity_variadic_extra")
+	printf := b.DeclareFunction("printf", types.I32, []types.Type{ptr}, true)
+	b.CreateFunction("f", types.Void, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateCall(printf, []ir.Value{b.ConstNull(ptr), b.ConstInt(types.I64, 1), b.ConstFloat(types.F64, 2)}, "r")
+	b.CreateRetVoid()
+	if _, err := codegen.GenerateObject(m); err != nil {
+		return fmt.Errorf("variadic call with extra arguments: %v", err)
+	}
+	return nil
+}
+
+// WriteObject streams into a pipe read concurrently, producing exactly
+// the bytes GenerateObject returns
+func runWriteObjectPipe() error {
+	want, err := codegen.GenerateObject(buildFactorial(builder.New()))
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		m := buildFactorial(builder.New())
+		pw.CloseWithError(codegen.WriteObject(pw, m, codegen.DefaultOptions()))
+	}()
+	got, err := io.ReadAll(pr)
+	if err != nil {
+		return fmt.Errorf("streaming failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("streamed %d bytes differ from GenerateObject's %d", len(got), len(want))
+	}
+	if _, err := elf.NewFile(bytes.NewReader(got)); err != nil {
+		return fmt.Errorf("debug/elf rejected streamed object: %v", err)
+	}
+
+	// A failed compile reports the error and writes nothing
+	b := builder.New()
+	bad := b.CreateModule("bad")
+	b.CreateFunction("f", types.Void, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateFPExt(b.ConstZero(types.NewVector(types.F32, 4)), types.NewVector(types.F64, 4), "v")
+	b.CreateRetVoid()
+	var buf bytes.Buffer
+	if err := codegen.WriteObject(&buf, bad, codegen.DefaultOptions()); err == nil || buf.Len() != 0 {
+		return fmt.Errorf("failed compile: err=%v, %d bytes written", err, buf.Len())
+	}
+	return nil
+}
+
+// Every block of simple_loop gets a local symbol at the offset the listing
+// reports for it
+func runBlockSymbols() error {
+	m := buildSimpleLoop(builder.New())
+	listing, err := codegen.GenerateListing(m)
+	if err != nil {
+		return err
+	}
+	obj, err := codegen.GenerateObjectWithOptions(m, codegen.CompileOptions{BlockSymbols: true})
+	if err != nil {
+		return err
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]elf.Symbol)
+	for _, sym := range syms {
+		byName[sym.Name] = sym
+	}
+
+	for _, fn := range listing.Functions {
+		for _, blk := range fn.Blocks {
+			name := fn.Name + "." + blk.Name
+			sym, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("no symbol %s", name)
+			}
+			if elf.ST_BIND(sym.Info) != elf.STB_LOCAL {
+				return fmt.Errorf("%s has binding %v, want STB_LOCAL", name, elf.ST_BIND(sym.Info))
+			}
+			if f.Sections[sym.Section].Name != ".text" {
+				return fmt.Errorf("%s is in %s, want .text", name, f.Sections[sym.Section].Name)
+			}
+			if sym.Value != uint64(blk.Start) {
+				return fmt.Errorf("%s at %#x, want %#x", name, sym.Value, blk.Start)
+			}
+		}
+	}
+	if _, ok := byName["main.entry"]; !ok {
+		return fmt.Errorf("no symbol main.entry")
+	}
+
+	// Off by default
+	obj, err = codegen.GenerateObject(m)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(obj, []byte("main.entry")) {
+		return fmt.Errorf("block symbols emitted without BlockSymbols")
+	}
+	return nil
+}
+
+// ============================================================================
+// Test IR Builders
+// ============================================================================
+
+func buildSimpleReturn(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("simple_return")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	b.CreateRet(b.ConstInt(types.I32, 42))
+	
+	return m
+}
+
+func buildAddition(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("addition")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 7)
+	b2 := b.ConstInt(types.I32, 8)
+	result := b.CreateAdd(a, b2, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildSubtraction(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("subtraction")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 12)
+	b2 := b.ConstInt(types.I32, 7)
+	result := b.CreateSub(a, b2, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildMultiplication(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("multiplication")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 6)
+	b2 := b.ConstInt(types.I32, 4)
+	result := b.CreateMul(a, b2, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildDivision(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("division")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 25)
+	b2 := b.ConstInt(types.I32, 5)
+	result := b.CreateSDiv(a, b2, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildModulo(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("modulo")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 23)
+	b2 := b.ConstInt(types.I32, 5)
+	result := b.CreateSRem(a, b2, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildComparisonEq(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("comparison_eq")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 5)
+	b2 := b.ConstInt(types.I32, 5)
+	cmp := b.CreateICmpEQ(a, b2, "cmp")
+	result := b.CreateZExt(cmp, types.I32, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildComparisonNe(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("comparison_ne")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 5)
+	b2 := b.ConstInt(types.I32, 7)
+	cmp := b.CreateICmpNE(a, b2, "cmp")
+	result := b.CreateZExt(cmp, types.I32, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildComparisonLt(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("comparison_lt")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 3)
+	b2 := b.ConstInt(types.I32, 7)
+	cmp := b.CreateICmpSLT(a, b2, "cmp")
+	result := b.CreateZExt(cmp, types.I32, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildComparisonLe(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("comparison_le")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 5)
+	b2 := b.ConstInt(types.I32, 5)
+	cmp := b.CreateICmpSLE(a, b2, "cmp")
+	result := b.CreateZExt(cmp, types.I32, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildComparisonGt(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("comparison_gt")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 3)
+	b2 := b.ConstInt(types.I32, 7)
+	cmp := b.CreateICmpSGT(a, b2, "cmp")
+	result := b.CreateZExt(cmp, types.I32, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildComparisonGe(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("comparison_ge")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 7)
+	b2 := b.ConstInt(types.I32, 7)
+	cmp := b.CreateICmpSGE(a, b2, "cmp")
+	result := b.CreateZExt(cmp, types.I32, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildAllComparisons(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("all_comparisons")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	// Test all 6 major comparison operators and count trues
+	a := b.ConstInt(types.I32, 5)
+	b2 := b.ConstInt(types.I32, 3)
+	
+	eq := b.CreateICmpEQ(a, a, "eq")    // true
+	ne := b.CreateICmpNE(a, b2, "ne")   // true
+	gt := b.CreateICmpSGT(a, b2, "gt")  // true
+	ge := b.CreateICmpSGE(a, a, "ge")   // true
+	lt := b.CreateICmpSLT(b2, a, "lt")  // true
+	le := b.CreateICmpSLE(b2, a, "le")  // true
+	
+	// Extend all to i32
+	eq32 := b.CreateZExt(eq, types.I32, "eq32")
+	ne32 := b.CreateZExt(ne, types.I32, "ne32")
+	gt32 := b.CreateZExt(gt, types.I32, "gt32")
+	ge32 := b.CreateZExt(ge, types.I32, "ge32")
+	lt32 := b.CreateZExt(lt, types.I32, "lt32")
+	le32 := b.CreateZExt(le, types.I32, "le32")
+	
+	// Sum them all
+	sum1 := b.CreateAdd(eq32, ne32, "sum1")
+	sum2 := b.CreateAdd(sum1, gt32, "sum2")
+	sum3 := b.CreateAdd(sum2, ge32, "sum3")
+	sum4 := b.CreateAdd(sum3, lt32, "sum4")
+	result := b.CreateAdd(sum4, le32, "result")
+	
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildIfThenElse(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("if_then_else")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	thenBlock := b.CreateBlock("then")
+	elseBlock := b.CreateBlock("else")
+	merge := b.CreateBlock("merge")
+	
+	b.SetInsertPoint(entry)
+	cond := b.CreateICmpSGT(b.ConstInt(types.I32, 5), b.ConstInt(types.I32, 3), "cond")
+	b.CreateCondBr(cond, thenBlock, elseBlock)
+	
+	b.SetInsertPoint(thenBlock)
+	thenVal := b.ConstInt(types.I32, 10)
+	b.CreateBr(merge)
+	
+	b.SetInsertPoint(elseBlock)
+	elseVal := b.ConstInt(types.I32, 20)
+	b.CreateBr(merge)
+	
+	b.SetInsertPoint(merge)
+	phi := b.CreatePhi(types.I32, "result")
+	phi.AddIncoming(thenVal, thenBlock)
+	phi.AddIncoming(elseVal, elseBlock)
+	b.CreateRet(phi)
+	
+	return m
+}
+
+func buildNestedIf(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("nested_if")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	outer_then := b.CreateBlock("outer_then")
+	inner_then := b.CreateBlock("inner_then")
+	inner_else := b.CreateBlock("inner_else")
+	inner_merge := b.CreateBlock("inner_merge")
+	outer_else := b.CreateBlock("outer_else")
+	final_merge := b.CreateBlock("final_merge")
+	
+	b.SetInsertPoint(entry)
+	cond1 := b.CreateICmpSGT(b.ConstInt(types.I32, 10), b.ConstInt(types.I32, 5), "cond1")
+	b.CreateCondBr(cond1, outer_then, outer_else)
+	
+	b.SetInsertPoint(outer_then)
+	cond2 := b.CreateICmpSLT(b.ConstInt(types.I32, 3), b.ConstInt(types.I32, 7), "cond2")
+	b.CreateCondBr(cond2, inner_then, inner_else)
+	
+	b.SetInsertPoint(inner_then)
+	val1 := b.ConstInt(types.I32, 30)
+	b.CreateBr(inner_merge)
+	
+	b.SetInsertPoint(inner_else)
+	val2 := b.ConstInt(types.I32, 40)
+	b.CreateBr(inner_merge)
+	
+	b.SetInsertPoint(inner_merge)
+	phi1 := b.CreatePhi(types.I32, "inner_result")
+	phi1.AddIncoming(val1, inner_then)
+	phi1.AddIncoming(val2, inner_else)
+	b.CreateBr(final_merge)
+	
+	b.SetInsertPoint(outer_else)
+	val3 := b.ConstInt(types.I32, 50)
+	b.CreateBr(final_merge)
+	
+	b.SetInsertPoint(final_merge)
+	phi2 := b.CreatePhi(types.I32, "result")
+	phi2.AddIncoming(phi1, inner_merge)
+	phi2.AddIncoming(val3, outer_else)
+	b.CreateRet(phi2)
+	
+	return m
+}
+
+func buildSimpleLoop(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("simple_loop")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	loop := b.CreateBlock("loop")
+	exit := b.CreateBlock("exit")
+	
+	b.SetInsertPoint(entry)
+	b.CreateBr(loop)
+	
+	b.SetInsertPoint(loop)
+	i := b.CreatePhi(types.I32, "i")
+	i.AddIncoming(b.ConstInt(types.I32, 0), entry)
+	
+	next := b.CreateAdd(i, b.ConstInt(types.I32, 1), "next")
+	i.AddIncoming(next, loop)
+	
+	cond := b.CreateICmpSLT(next, b.ConstInt(types.I32, 10), "cond")
+	b.CreateCondBr(cond, loop, exit)
+	
+	b.SetInsertPoint(exit)
+	b.CreateRet(next)
+	
+	return m
+}
+
+func buildNestedLoops(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("nested_loops")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	outerLoop := b.CreateBlock("outer_loop")
+	innerLoop := b.CreateBlock("inner_loop")
+	innerExit := b.CreateBlock("inner_exit")
+	outerExit := b.CreateBlock("outer_exit")
+	
+	b.SetInsertPoint(entry)
+	b.CreateBr(outerLoop)
+	
+	// Outer loop: i from 1 to 4
+	b.SetInsertPoint(outerLoop)
+	i := b.CreatePhi(types.I32, "i")
+	sum := b.CreatePhi(types.I32, "sum")
+	i.AddIncoming(b.ConstInt(types.I32, 1), entry)
+	sum.AddIncoming(b.ConstInt(types.I32, 0), entry)
+	
+	b.CreateBr(innerLoop)
+	
+	// Inner loop: j from i to i (just once for simplicity, but demonstrates nesting)
+	b.SetInsertPoint(innerLoop)
+	j := b.CreatePhi(types.I32, "j")
+	innerSum := b.CreatePhi(types.I32, "inner_sum")
+	j.AddIncoming(i, outerLoop)
+	innerSum.AddIncoming(sum, outerLoop)
+	
+	newSum := b.CreateAdd(innerSum, j, "new_sum")
+	nextJ := b.CreateAdd(j, b.ConstInt(types.I32, 1), "next_j")
+	
+	j.AddIncoming(nextJ, innerLoop)
+	innerSum.AddIncoming(newSum, innerLoop)
+	
+	innerCond := b.CreateICmpSLE(nextJ, i, "inner_cond")
+	b.CreateCondBr(innerCond, innerLoop, innerExit)
+	
+	b.SetInsertPoint(innerExit)
+	nextI := b.CreateAdd(i, b.ConstInt(types.I32, 1), "next_i")
+	i.AddIncoming(nextI, innerExit)
+	sum.AddIncoming(newSum, innerExit)
+	
+	outerCond := b.CreateICmpSLE(nextI, b.ConstInt(types.I32, 10), "outer_cond")
+	b.CreateCondBr(outerCond, outerLoop, outerExit)
+	
+	b.SetInsertPoint(outerExit)
+	b.CreateRet(newSum)
+	
+	return m
+}
+
+func buildFactorial(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("factorial")
+	
+	// factorial function
+	factFn := b.CreateFunction("factorial", types.I32, []types.Type{types.I32}, false)
+	factFn.Arguments[0].SetName("n")
+	
+	entry := b.CreateBlock("entry")
+	baseCase := b.CreateBlock("base_case")
+	recursive := b.CreateBlock("recursive")
+	ret := b.CreateBlock("return")
+	
+	b.SetInsertPoint(entry)
+	n := factFn.Arguments[0]
+	isBase := b.CreateICmpSLE(n, b.ConstInt(types.I32, 1), "is_base")
+	b.CreateCondBr(isBase, baseCase, recursive)
+	
+	b.SetInsertPoint(baseCase)
+	b.CreateBr(ret)
+	
+	b.SetInsertPoint(recursive)
+	nMinus1 := b.CreateSub(n, b.ConstInt(types.I32, 1), "n_minus_1")
+	factNMinus1 := b.CreateCall(factFn, []ir.Value{nMinus1}, "fact_n_minus_1")
+	result := b.CreateMul(n, factNMinus1, "result")
+	b.CreateBr(ret)
+	
+	b.SetInsertPoint(ret)
+	phi := b.CreatePhi(types.I32, "retval")
+	phi.AddIncoming(b.ConstInt(types.I32, 1), baseCase)
+	phi.AddIncoming(result, recursive)
+	b.CreateRet(phi)
+	
+	// main function
+	b.CreateFunction("main", types.I32, nil, false)
+	mainEntry := b.CreateBlock("entry")
+	b.SetInsertPoint(mainEntry)
+	
+	fact5 := b.CreateCall(factFn, []ir.Value{b.ConstInt(types.I32, 5)}, "fact5")
+	b.CreateRet(fact5)
+	
+	return m
+}
+
+func buildFibonacci(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("fibonacci")
+	
+	fibFn := b.CreateFunction("fibonacci", types.I32, []types.Type{types.I32}, false)
+	fibFn.Arguments[0].SetName("n")
+	
+	entry := b.CreateBlock("entry")
+	baseCase := b.CreateBlock("base_case")
+	recursive := b.CreateBlock("recursive")
+	ret := b.CreateBlock("return")
+	
+	b.SetInsertPoint(entry)
+	n := fibFn.Arguments[0]
+	isBase := b.CreateICmpSLE(n, b.ConstInt(types.I32, 1), "is_base")
+	b.CreateCondBr(isBase, baseCase, recursive)
+	
+	b.SetInsertPoint(baseCase)
+	b.CreateBr(ret)
+	
+	b.SetInsertPoint(recursive)
+	nMinus1 := b.CreateSub(n, b.ConstInt(types.I32, 1), "n_minus_1")
+	nMinus2 := b.CreateSub(n, b.ConstInt(types.I32, 2), "n_minus_2")
+	fib1 := b.CreateCall(fibFn, []ir.Value{nMinus1}, "fib1")
+	fib2 := b.CreateCall(fibFn, []ir.Value{nMinus2}, "fib2")
+	result := b.CreateAdd(fib1, fib2, "result")
+	b.CreateBr(ret)
+	
+	b.SetInsertPoint(ret)
+	phi := b.CreatePhi(types.I32, "retval")
+	phi.AddIncoming(n, baseCase)
+	phi.AddIncoming(result, recursive)
+	b.CreateRet(phi)
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	mainEntry := b.CreateBlock("entry")
+	b.SetInsertPoint(mainEntry)
+	fib10 := b.CreateCall(fibFn, []ir.Value{b.ConstInt(types.I32, 10)}, "fib10")
+	b.CreateRet(fib10)
+	
+	return m
+}
+
+func buildBitwiseAnd(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("bitwise_and")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 12) // 1100
+	b2 := b.ConstInt(types.I32, 10) // 1010
+	result := b.CreateAnd(a, b2, "result") // 1000 = 8
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildBitwiseOr(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("bitwise_or")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 12) // 1100
+	b2 := b.ConstInt(types.I32, 3)  // 0011
+	result := b.CreateOr(a, b2, "result") // 1111 = 15
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildBitwiseXor(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("bitwise_xor")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 12) // 1100
+	b2 := b.ConstInt(types.I32, 11) // 1011
+	result := b.CreateXor(a, b2, "result") // 0111 = 7
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildShiftLeft(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("shift_left")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 4)
+	shift := b.ConstInt(types.I32, 3)
+	result := b.CreateShl(a, shift, "result") // 4 << 3 = 32
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildShiftRight(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("shift_right")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	a := b.ConstInt(types.I32, 16)
+	shift := b.ConstInt(types.I32, 3)
+	result := b.CreateLShr(a, shift, "result") // 16 >> 3 = 2
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildNegativeNumbers(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("negative_numbers")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	// -3 & 0xFF should give 253 (two's complement)
+	neg := b.ConstInt(types.I32, -3)
+	mask := b.ConstInt(types.I32, 0xFF)
+	result := b.CreateAnd(neg, mask, "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildZeroDivisionCheck(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("zero_division_check")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	checkZero := b.CreateBlock("check_zero")
+	divBlock := b.CreateBlock("divide")
+	noDiv := b.CreateBlock("no_divide")
+	merge := b.CreateBlock("merge")
+	
+	b.SetInsertPoint(entry)
+	divisor := b.ConstInt(types.I32, 5)
+	b.CreateBr(checkZero)
+	
+	b.SetInsertPoint(checkZero)
+	isZero := b.CreateICmpEQ(divisor, b.ConstInt(types.I32, 0), "is_zero")
+	b.CreateCondBr(isZero, noDiv, divBlock)
+	
+	b.SetInsertPoint(divBlock)
+	divResult := b.CreateSDiv(b.ConstInt(types.I32, 50), divisor, "div_result")
+	b.CreateBr(merge)
+	
+	b.SetInsertPoint(noDiv)
+	defaultVal := b.ConstInt(types.I32, 0)
+	b.CreateBr(merge)
+	
+	b.SetInsertPoint(merge)
+	phi := b.CreatePhi(types.I32, "result")
+	phi.AddIncoming(divResult, divBlock)
+	phi.AddIncoming(defaultVal, noDiv)
+	b.CreateRet(phi)
+	
+	return m
+}
+
+func buildComplexExpression(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("complex_expression")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	// (6 * 7) + (12 / 4) - 3 = 42 + 3 - 3 = 42
+	a := b.CreateMul(b.ConstInt(types.I32, 6), b.ConstInt(types.I32, 7), "mul")
+	b2 := b.CreateSDiv(b.ConstInt(types.I32, 12), b.ConstInt(types.I32, 4), "div")
+	c := b.CreateAdd(a, b2, "add")
+	result := b.CreateSub(c, b.ConstInt(types.I32, 3), "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildMultipleArgs(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("multiple_args")
+	
+	// create function: sum(a, b, c, d, e, f, g) = a + b + c + d + e + f + g
+	sumFn := b.CreateFunction("sum", types.I32, 
+		[]types.Type{types.I32, types.I32, types.I32, types.I32, types.I32, types.I32, types.I32}, 
+		false)
+	for i := 0; i < 7; i++ {
+		sumFn.Arguments[i].SetName(fmt.Sprintf("arg%d", i))
+	}
+	
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	// Sum all arguments
+	result := ir.Value(sumFn.Arguments[0])
+	for i := 1; i < 7; i++ {
+		result = b.CreateAdd(result, sumFn.Arguments[i], fmt.Sprintf("sum%d", i))
+	}
+	b.CreateRet(result)
+	
+	// main: call sum(1, 2, 3, 4, 5, 6, 21) = 42
+	b.CreateFunction("main", types.I32, nil, false)
+	mainEntry := b.CreateBlock("entry")
+	b.SetInsertPoint(mainEntry)
+	
+	args := []ir.Value{
+		b.ConstInt(types.I32, 1),
+		b.ConstInt(types.I32, 2),
+		b.ConstInt(types.I32, 3),
+		b.ConstInt(types.I32, 4),
+		b.ConstInt(types.I32, 5),
+		b.ConstInt(types.I32, 6),
+		b.ConstInt(types.I32, 21),
+	}
+	sumResult := b.CreateCall(sumFn, args, "sum_result")
+	b.CreateRet(sumResult)
+	
+	return m
+}
+
+func buildNestedCalls(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("nested_calls")
+	
+	// add(a, b) = a + b
+	addFn := b.CreateFunction("add", types.I32, []types.Type{types.I32, types.I32}, false)
+	addFn.Arguments[0].SetName("a")
+	addFn.Arguments[1].SetName("b")
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	sum := b.CreateAdd(addFn.Arguments[0], addFn.Arguments[1], "sum")
+	b.CreateRet(sum)
+	
+	// mul(a, b) = a * b
+	mulFn := b.CreateFunction("mul", types.I32, []types.Type{types.I32, types.I32}, false)
+	mulFn.Arguments[0].SetName("a")
+	mulFn.Arguments[1].SetName("b")
+	entry2 := b.CreateBlock("entry")
+	b.SetInsertPoint(entry2)
+	prod := b.CreateMul(mulFn.Arguments[0], mulFn.Arguments[1], "prod")
+	b.CreateRet(prod)
+	
+	// main: add(mul(2, 3), mul(5, 2)) + 1 = add(6, 10) + 1 = 16 + 1 = 17
+	b.CreateFunction("main", types.I32, nil, false)
+	mainEntry := b.CreateBlock("entry")
+	b.SetInsertPoint(mainEntry)
+	
+	m1 := b.CreateCall(mulFn, []ir.Value{b.ConstInt(types.I32, 2), b.ConstInt(types.I32, 3)}, "m1")
+	m2 := b.CreateCall(mulFn, []ir.Value{b.ConstInt(types.I32, 5), b.ConstInt(types.I32, 2)}, "m2")
+	a1 := b.CreateCall(addFn, []ir.Value{m1, m2}, "a1")
+	result := b.CreateAdd(a1, b.ConstInt(types.I32, 1), "result")
+	b.CreateRet(result)
+	
+	return m
+}
+
+func buildSelect(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("select")
+	
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
 	b.SetInsertPoint(entry)
 	
-	a := b.ConstInt(types.I32, 5)
-	b2 := b.ConstInt(types.I32, 5)
-	cmp := b.CreateICmpEQ(a, b2, "cmp")
-	result := b.CreateZExt(cmp, types.I32, "result")
+	cond := b.CreateICmpSGT(b.ConstInt(types.I32, 10), b.ConstInt(types.I32, 5), "cond")
+	result := b.CreateSelect(cond, b.ConstInt(types.I32, 100), b.ConstInt(types.I32, 200), "result")
 	b.CreateRet(result)
 	
 	return m
 }
 
-func buildComparisonNe(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("comparison_ne")
+func buildSwitchStatement(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("switch_statement")
 	
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
+	case1 := b.CreateBlock("case1")
+	case2 := b.CreateBlock("case2")
+	case3 := b.CreateBlock("case3")
+	defaultCase := b.CreateBlock("default")
+	merge := b.CreateBlock("merge")
+	
 	b.SetInsertPoint(entry)
+	value := b.ConstInt(types.I32, 2)
 	
-	a := b.ConstInt(types.I32, 5)
-	b2 := b.ConstInt(types.I32, 7)
-	cmp := b.CreateICmpNE(a, b2, "cmp")
-	result := b.CreateZExt(cmp, types.I32, "result")
-	b.CreateRet(result)
+	// Fix: Create constant ints separately and cast them
+	caseVal1 := b.ConstInt(types.I32, 1)
+	caseVal2 := b.ConstInt(types.I32, 2)
+	caseVal3 := b.ConstInt(types.I32, 3)
+	
+	switchInst := &ir.SwitchInst{
+		BaseInstruction: ir.BaseInstruction{
+			Op:  ir.OpSwitch,
+			Ops: []ir.Value{value},
+		},
+		Condition:    value,
+		DefaultBlock: defaultCase,
+		Cases: []ir.SwitchCase{
+			{Value: caseVal1, Block: case1},
+			{Value: caseVal2, Block: case2},
+			{Value: caseVal3, Block: case3},
+		},
+	}
+	entry.AddInstruction(switchInst)
+	
+	b.SetInsertPoint(case1)
+	val1 := b.ConstInt(types.I32, 10)
+	b.CreateBr(merge)
+	
+	b.SetInsertPoint(case2)
+	val2 := b.ConstInt(types.I32, 30)
+	b.CreateBr(merge)
+	
+	b.SetInsertPoint(case3)
+	val3 := b.ConstInt(types.I32, 50)
+	b.CreateBr(merge)
+	
+	b.SetInsertPoint(defaultCase)
+	valDefault := b.ConstInt(types.I32, 0)
+	b.CreateBr(merge)
+	
+	b.SetInsertPoint(merge)
+	phi := b.CreatePhi(types.I32, "result")
+	phi.AddIncoming(val1, case1)
+	phi.AddIncoming(val2, case2)
+	phi.AddIncoming(val3, case3)
+	phi.AddIncoming(valDefault, defaultCase)
+	b.CreateRet(phi)
 	
 	return m
 }
 
-func buildComparisonLt(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("comparison_lt")
+func buildMemoryOps(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("memory_ops")
 	
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
 	b.SetInsertPoint(entry)
 	
-	a := b.ConstInt(types.I32, 3)
-	b2 := b.ConstInt(types.I32, 7)
-	cmp := b.CreateICmpSLT(a, b2, "cmp")
-	result := b.CreateZExt(cmp, types.I32, "result")
-	b.CreateRet(result)
+	// Allocate space for an i32
+	ptr := b.CreateAlloca(types.I32, "ptr")
+	
+	// Store 99 into it
+	b.CreateStore(b.ConstInt(types.I32, 99), ptr)
+	
+	// Load it back
+	loaded := b.CreateLoad(types.I32, ptr, "loaded")
+	
+	b.CreateRet(loaded)
 	
 	return m
 }
 
-func buildComparisonLe(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("comparison_le")
+func buildPointerArithmetic(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("pointer_arithmetic")
 	
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
 	b.SetInsertPoint(entry)
 	
-	a := b.ConstInt(types.I32, 5)
-	b2 := b.ConstInt(types.I32, 5)
-	cmp := b.CreateICmpSLE(a, b2, "cmp")
-	result := b.CreateZExt(cmp, types.I32, "result")
-	b.CreateRet(result)
+	// Create array of 5 elements: [1, 2, 3, 4, 5]
+	arrayType := types.NewArray(types.I32, 5)
+	arrayPtr := b.CreateAlloca(arrayType, "array")
+	
+	// Store values: array[2] = 15
+	idx := b.ConstInt(types.I32, 2)
+	elemPtr := b.CreateGEP(arrayType, arrayPtr, []ir.Value{b.ConstInt(types.I32, 0), idx}, "elem_ptr")
+	b.CreateStore(b.ConstInt(types.I32, 15), elemPtr)
+	
+	// Load it back
+	loaded := b.CreateLoad(types.I32, elemPtr, "loaded")
+	
+	b.CreateRet(loaded)
 	
 	return m
 }
 
-func buildComparisonGt(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("comparison_gt")
+func buildStructOps(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("struct_ops")
+	
+	// Define struct { i32, i32 }
+	structType := types.NewStruct("", []types.Type{types.I32, types.I32}, false)
 	
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
 	b.SetInsertPoint(entry)
 	
-	a := b.ConstInt(types.I32, 3)
-	b2 := b.ConstInt(types.I32, 7)
-	cmp := b.CreateICmpSGT(a, b2, "cmp")
-	result := b.CreateZExt(cmp, types.I32, "result")
+	// Allocate struct
+	structPtr := b.CreateAlloca(structType, "s")
+	
+	// Get pointer to second field
+	field1Ptr := b.CreateGEP(structType, structPtr, 
+		[]ir.Value{b.ConstInt(types.I32, 0), b.ConstInt(types.I32, 1)}, "field1_ptr")
+	
+	// Store 42 in second field
+	b.CreateStore(b.ConstInt(types.I32, 42), field1Ptr)
+	
+	// Load it back
+	loaded := b.CreateLoad(types.I32, field1Ptr, "loaded")
+	
+	b.CreateRet(loaded)
+	
+	return m
+}
+
+func buildArrayOps(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("array_ops")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+	
+	// Array: [5, 10, 15, 20]
+	arrayType := types.NewArray(types.I32, 4)
+	arrayPtr := b.CreateAlloca(arrayType, "array")
+	
+	// Initialize array elements
+	for i := 0; i < 4; i++ {
+		elemPtr := b.CreateGEP(arrayType, arrayPtr, 
+			[]ir.Value{b.ConstInt(types.I32, 0), b.ConstInt(types.I32, int64(i))}, 
+			fmt.Sprintf("elem%d_ptr", i))
+		b.CreateStore(b.ConstInt(types.I32, int64((i+1)*5)), elemPtr)
+	}
+	
+	// Load element at index 1 (should be 10)
+	elem1Ptr := b.CreateGEP(arrayType, arrayPtr, 
+		[]ir.Value{b.ConstInt(types.I32, 0), b.ConstInt(types.I32, 1)}, "elem1_ptr")
+	result := b.CreateLoad(types.I32, elem1Ptr, "result")
+	
 	b.CreateRet(result)
 	
 	return m
 }
 
-func buildComparisonGe(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("comparison_ge")
+func buildCastingOps(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("casting_ops")
 	
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
 	b.SetInsertPoint(entry)
 	
-	a := b.ConstInt(types.I32, 7)
-	b2 := b.ConstInt(types.I32, 7)
-	cmp := b.CreateICmpSGE(a, b2, "cmp")
-	result := b.CreateZExt(cmp, types.I32, "result")
+	// Start with i64 value
+	val64 := b.ConstInt(types.I64, 42)
+	
+	// Truncate to i32
+	val32 := b.CreateTrunc(val64, types.I32, "val32")
+	
+	// Extend back to i64
+	val64Again := b.CreateSExt(val32, types.I64, "val64_again")
+	
+	// Truncate back to i32 for return
+	result := b.CreateTrunc(val64Again, types.I32, "result")
+	
 	b.CreateRet(result)
 	
 	return m
 }
 
-func buildAllComparisons(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("all_comparisons")
+func buildComplexPhi(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("complex_phi")
 	
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
+	path1 := b.CreateBlock("path1")
+	path2 := b.CreateBlock("path2")
+	path3 := b.CreateBlock("path3")
+	merge := b.CreateBlock("merge")
+	
 	b.SetInsertPoint(entry)
+	selector := b.ConstInt(types.I32, 2)
 	
-	// Test all 6 major comparison operators and count trues
-	a := b.ConstInt(types.I32, 5)
-	b2 := b.ConstInt(types.I32, 3)
+	// Branch based on selector
+	cond1 := b.CreateICmpEQ(selector, b.ConstInt(types.I32, 1), "cond1")
+	branch1 := b.CreateBlock("branch1")
+	b.CreateCondBr(cond1, path1, branch1)
 	
-	eq := b.CreateICmpEQ(a, a, "eq")    // true
-	ne := b.CreateICmpNE(a, b2, "ne")   // true
-	gt := b.CreateICmpSGT(a, b2, "gt")  // true
-	ge := b.CreateICmpSGE(a, a, "ge")   // true
-	lt := b.CreateICmpSLT(b2, a, "lt")  // true
-	le := b.CreateICmpSLE(b2, a, "le")  // true
+	b.SetInsertPoint(branch1)
+	cond2 := b.CreateICmpEQ(selector, b.ConstInt(types.I32, 2), "cond2")
+	b.CreateCondBr(cond2, path2, path3)
 	
-	// Extend all to i32
-	eq32 := b.CreateZExt(eq, types.I32, "eq32")
-	ne32 := b.CreateZExt(ne, types.I32, "ne32")
-	gt32 := b.CreateZExt(gt, types.I32, "gt32")
-	ge32 := b.CreateZExt(ge, types.I32, "ge32")
-	lt32 := b.CreateZExt(lt, types.I32, "lt32")
-	le32 := b.CreateZExt(le, types.I32, "le32")
+	b.SetInsertPoint(path1)
+	val1 := b.ConstInt(types.I32, 5)
+	b.CreateBr(merge)
 	
-	// Sum them all
-	sum1 := b.CreateAdd(eq32, ne32, "sum1")
-	sum2 := b.CreateAdd(sum1, gt32, "sum2")
-	sum3 := b.CreateAdd(sum2, ge32, "sum3")
-	sum4 := b.CreateAdd(sum3, lt32, "sum4")
-	result := b.CreateAdd(sum4, le32, "result")
+	b.SetInsertPoint(path2)
+	val2 := b.ConstInt(types.I32, 15)
+	b.CreateBr(merge)
+	
+	b.SetInsertPoint(path3)
+	val3 := b.ConstInt(types.I32, 25)
+	b.CreateBr(merge)
+	
+	b.SetInsertPoint(merge)
+	phi := b.CreatePhi(types.I32, "result")
+	phi.AddIncoming(val1, path1)
+	phi.AddIncoming(val2, path2)
+	phi.AddIncoming(val3, path3)
+	b.CreateRet(phi)
+	
+	return m
+}
+
+func buildEarlyReturn(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("early_return")
+	
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	earlyExit := b.CreateBlock("early_exit")
+	normalPath := b.CreateBlock("normal_path")
+	
+	b.SetInsertPoint(entry)
+	value := b.ConstInt(types.I32, 5)
+	cond := b.CreateICmpSLT(value, b.ConstInt(types.I32, 10), "cond")
+	b.CreateCondBr(cond, earlyExit, normalPath)
 	
-	b.CreateRet(result)
+	b.SetInsertPoint(earlyExit)
+	b.CreateRet(value)
+	
+	b.SetInsertPoint(normalPath)
+	b.CreateRet(b.ConstInt(types.I32, 100))
 	
 	return m
 }
 
-func buildIfThenElse(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("if_then_else")
+func buildMaxFunction(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("max_function")
+	
+	// max(a, b) function
+	maxFn := b.CreateFunction("max", types.I32, []types.Type{types.I32, types.I32}, false)
+	maxFn.Arguments[0].SetName("a")
+	maxFn.Arguments[1].SetName("b")
 	
-	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
 	thenBlock := b.CreateBlock("then")
 	elseBlock := b.CreateBlock("else")
 	merge := b.CreateBlock("merge")
 	
 	b.SetInsertPoint(entry)
-	cond := b.CreateICmpSGT(b.ConstInt(types.I32, 5), b.ConstInt(types.I32, 3), "cond")
+	a := maxFn.Arguments[0]
+	b2 := maxFn.Arguments[1]
+	cond := b.CreateICmpSGT(a, b2, "cond")
 	b.CreateCondBr(cond, thenBlock, elseBlock)
 	
 	b.SetInsertPoint(thenBlock)
-	thenVal := b.ConstInt(types.I32, 10)
 	b.CreateBr(merge)
 	
 	b.SetInsertPoint(elseBlock)
-	elseVal := b.ConstInt(types.I32, 20)
 	b.CreateBr(merge)
 	
 	b.SetInsertPoint(merge)
 	phi := b.CreatePhi(types.I32, "result")
-	phi.AddIncoming(thenVal, thenBlock)
-	phi.AddIncoming(elseVal, elseBlock)
+	phi.AddIncoming(a, thenBlock)
+	phi.AddIncoming(b2, elseBlock)
 	b.CreateRet(phi)
 	
+	// main function
+	b.CreateFunction("main", types.I32, nil, false)
+	mainEntry := b.CreateBlock("entry")
+	b.SetInsertPoint(mainEntry)
+	
+	result := b.CreateCall(maxFn, []ir.Value{b.ConstInt(types.I32, 88), b.ConstInt(types.I32, 42)}, "max_result")
+	b.CreateRet(result)
+	
 	return m
 }
 
-func buildNestedIf(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("nested_if")
-	
+func buildStructReturnExtract(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("struct_return_extract")
+
+	// pair() returns {i64, i64} by value in RAX:RDX
+	pairType := types.NewStruct("", []types.Type{types.I64, types.I64}, false)
+	pairFn := b.CreateFunction("pair", pairType, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+
+	p0 := b.CreateInsertValue(b.ConstUndef(pairType), b.ConstInt(types.I64, 40), []int{0}, "p0")
+	p1 := b.CreateInsertValue(p0, b.ConstInt(types.I64, 2), []int{1}, "p1")
+	b.CreateRet(p1)
+
+	// main: p = pair(); return p.0 + p.1 = 42
+	b.CreateFunction("main", types.I32, nil, false)
+	mainEntry := b.CreateBlock("entry")
+	b.SetInsertPoint(mainEntry)
+
+	p := b.CreateCall(pairFn, nil, "p")
+	first := b.CreateExtractValue(p, []int{0}, "first")
+	second := b.CreateExtractValue(p, []int{1}, "second")
+	sum := b.CreateAdd(first, second, "sum")
+	result := b.CreateTrunc(sum, types.I32, "result")
+	b.CreateRet(result)
+
+	return m
+}
+
+// Small structs returned by value to and from C, by eightbyte class: two
+// floats in XMM0, a double in XMM0 and a long in RAX, and 12 bytes of ints
+// in RAX and the low half of RDX. Bits 0-4 check what main gets from C, and
+// bits 5-7 what C gets from the ir_ functions.
+func buildStructReturnClasses(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("struct_return_classes")
+	fpair := types.NewStruct("", []types.Type{types.F32, types.F32}, false)
+	mixed := types.NewStruct("", []types.Type{types.F64, types.I64}, false)
+	twelve := types.NewStruct("", []types.Type{types.I32, types.I32, types.I32}, false)
+
+	define := func(name string, t types.Type, fields ...ir.Value) {
+		b.CreateFunction(name, t, nil, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		agg := ir.Value(b.ConstUndef(t))
+		for i, f := range fields {
+			agg = b.CreateInsertValue(agg, f, []int{i}, "agg")
+		}
+		b.CreateRet(agg)
+	}
+	define("ir_fpair", fpair, b.ConstFloat(types.F32, 1.5), b.ConstFloat(types.F32, 2.5))
+	define("ir_mixed", mixed, b.ConstFloat(types.F64, 3.5), b.ConstInt(types.I64, 7))
+	define("ir_twelve", twelve, b.ConstInt(types.I32, 1), b.ConstInt(types.I32, 2), b.ConstInt(types.I32, 3))
+
+	cFpair := b.DeclareFunction("c_fpair", fpair, nil, false)
+	cMixed := b.DeclareFunction("c_mixed", mixed, nil, false)
+	cTwelve := b.DeclareFunction("c_twelve", twelve, nil, false)
+	cChecks := b.DeclareFunction("c_checks", types.I32, nil, false)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	p := b.CreateCall(cFpair, nil, "p")
+	mx := b.CreateCall(cMixed, nil, "m")
+	t := b.CreateCall(cTwelve, nil, "t")
+	field := func(agg ir.Value, i int) ir.Value {
+		return b.CreateExtractValue(agg, []int{i}, "f")
+	}
+	checks := []ir.Value{
+		b.CreateFCmp(ir.FCmpOEQ, field(p, 0), b.ConstFloat(types.F32, 1.5), "c"),
+		b.CreateFCmp(ir.FCmpOEQ, field(p, 1), b.ConstFloat(types.F32, 2.5), "c"),
+		b.CreateFCmp(ir.FCmpOEQ, field(mx, 0), b.ConstFloat(types.F64, 3.5), "c"),
+		b.CreateICmpEQ(field(mx, 1), b.ConstInt(types.I64, 7), "c"),
+		b.CreateICmpEQ(field(t, 2), b.ConstInt(types.I32, 3), "c"),
+	}
+	result := b.CreateShl(b.CreateCall(cChecks, nil, "cc"), b.ConstInt(types.I32, int64(len(checks))), "r")
+	for i, c := range checks {
+		bit := b.CreateShl(b.CreateZExt(c, types.I32, "z"), b.ConstInt(types.I32, int64(i)), "bit")
+		result = b.CreateOr(result, bit, "r")
+	}
+	b.CreateRet(result)
+
+	return m
+}
+
+func buildUnreachableArm(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("unreachable_arm")
+
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
-	outer_then := b.CreateBlock("outer_then")
-	inner_then := b.CreateBlock("inner_then")
-	inner_else := b.CreateBlock("inner_else")
-	inner_merge := b.CreateBlock("inner_merge")
-	outer_else := b.CreateBlock("outer_else")
-	final_merge := b.CreateBlock("final_merge")
-	
+	live := b.CreateBlock("live")
+	dead := b.CreateBlock("dead")
+
 	b.SetInsertPoint(entry)
-	cond1 := b.CreateICmpSGT(b.ConstInt(types.I32, 10), b.ConstInt(types.I32, 5), "cond1")
-	b.CreateCondBr(cond1, outer_then, outer_else)
-	
-	b.SetInsertPoint(outer_then)
-	cond2 := b.CreateICmpSLT(b.ConstInt(types.I32, 3), b.ConstInt(types.I32, 7), "cond2")
-	b.CreateCondBr(cond2, inner_then, inner_else)
-	
-	b.SetInsertPoint(inner_then)
-	val1 := b.ConstInt(types.I32, 30)
-	b.CreateBr(inner_merge)
-	
-	b.SetInsertPoint(inner_else)
-	val2 := b.ConstInt(types.I32, 40)
-	b.CreateBr(inner_merge)
-	
-	b.SetInsertPoint(inner_merge)
-	phi1 := b.CreatePhi(types.I32, "inner_result")
-	phi1.AddIncoming(val1, inner_then)
-	phi1.AddIncoming(val2, inner_else)
-	b.CreateBr(final_merge)
-	
-	b.SetInsertPoint(outer_else)
-	val3 := b.ConstInt(types.I32, 50)
-	b.CreateBr(final_merge)
-	
-	b.SetInsertPoint(final_merge)
-	phi2 := b.CreatePhi(types.I32, "result")
-	phi2.AddIncoming(phi1, inner_merge)
-	phi2.AddIncoming(val3, outer_else)
-	b.CreateRet(phi2)
-	
+	cond := b.CreateICmpEQ(b.ConstInt(types.I32, 1), b.ConstInt(types.I32, 1), "cond")
+	b.CreateCondBr(cond, live, dead)
+
+	b.SetInsertPoint(live)
+	b.CreateRet(b.ConstInt(types.I32, 7))
+
+	// The front-end has proven this arm impossible
+	b.SetInsertPoint(dead)
+	b.CreateUnreachable()
+
 	return m
 }
 
-func buildSimpleLoop(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("simple_loop")
-	
+func buildUndefStoreFreeze(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("undef_store_freeze")
+
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+
+	// Store undef, then read it back twice - both loads must agree
+	ptr := b.CreateAlloca(types.I32, "ptr")
+	b.CreateStore(b.ConstUndef(types.I32), ptr)
+	first := b.CreateLoad(types.I32, ptr, "first")
+	second := b.CreateLoad(types.I32, ptr, "second")
+	same := b.CreateICmpEQ(first, second, "same")
+
+	// freeze(undef) pins to the same deterministic value (zero)
+	frozen := b.CreateFreeze(b.ConstUndef(types.I32), "frozen")
+	sum := b.CreateAdd(first, frozen, "sum")
+	hit := b.CreateAdd(sum, b.ConstInt(types.I32, 42), "hit")
+
+	result := b.CreateSelect(same, hit, b.ConstInt(types.I32, 1), "result")
+	b.CreateRet(result)
+
+	return m
+}
+
+func buildStackArgsMixedFloat(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("stack_args_mixed_float")
+
+	// f(a1, a2, a3, d1, a4, a5, a6, d2, a7, a8): the doubles go in XMM0/XMM1,
+	// a1-a6 in registers, and only a7/a8 land on the caller's stack
+	params := []types.Type{
+		types.I64, types.I64, types.I64, types.F64, types.I64,
+		types.I64, types.I64, types.F64, types.I64, types.I64,
+	}
+	fn := b.CreateFunction("mixed", types.I64, params, false)
+	entry := b.CreateBlock("entry")
+	b.SetInsertPoint(entry)
+
+	args := fn.Arguments
+	ints := []ir.Value{args[0], args[1], args[2], args[4], args[5], args[6]}
+	sum := ints[0]
+	for i := 1; i < len(ints); i++ {
+		sum = b.CreateAdd(sum, ints[i], fmt.Sprintf("sum%d", i))
+	}
+
+	// 2*a7 + a8 distinguishes a swapped or misread stack slot
+	a7x2 := b.CreateMul(args[8], b.ConstInt(types.I64, 2), "a7x2")
+	tail := b.CreateAdd(a7x2, args[9], "tail")
+	sum = b.CreateAdd(sum, tail, "with_tail")
+
+	// d1 - d2 is order-sensitive as well
+	diff := b.CreateFSub(args[3], args[7], "diff")
+	diffInt := b.CreateFPToSI(diff, types.I64, "diff_int")
+	total := b.CreateAdd(sum, diffInt, "total")
+	b.CreateRet(total)
+
+	// main: mixed(1, 2, 3, 12.5, 4, 5, 6, 2.5, 5, 1) = 21 + 11 + 10 = 42
+	b.CreateFunction("main", types.I32, nil, false)
+	mainEntry := b.CreateBlock("entry")
+	b.SetInsertPoint(mainEntry)
+
+	callArgs := []ir.Value{
+		b.ConstInt(types.I64, 1),
+		b.ConstInt(types.I64, 2),
+		b.ConstInt(types.I64, 3),
+		b.ConstFloat(types.F64, 12.5),
+		b.ConstInt(types.I64, 4),
+		b.ConstInt(types.I64, 5),
+		b.ConstInt(types.I64, 6),
+		b.ConstFloat(types.F64, 2.5),
+		b.ConstInt(types.I64, 5),
+		b.ConstInt(types.I64, 1),
+	}
+	r := b.CreateCall(fn, callArgs, "r")
+	result := b.CreateTrunc(r, types.I32, "result")
+	b.CreateRet(result)
+
+	return m
+}
+
+// tlsDriver bumps the thread-local counters from main and from a second
+// thread; each must start from the initial image and never see the other's
+// updates
+const tlsDriver = `
+#include <pthread.h>
+int tls_bump(int);
+long tls_scratch_inc(void);
+static void *worker(void *arg) {
+	int r = tls_bump(5);
+	long s = tls_scratch_inc();
+	return (void *)(long)(r == 15 && s == 1);
+}
+int main(void) {
+	pthread_t t;
+	void *ok;
+	tls_bump(1);
+	tls_bump(1);
+	tls_scratch_inc();
+	tls_scratch_inc();
+	pthread_create(&t, 0, worker, 0);
+	pthread_join(t, &ok);
+	if (!ok) return 1;
+	if (tls_bump(0) != 12) return 2;
+	if (tls_scratch_inc() != 3) return 3;
+	return 42;
+}
+`
+
+func buildThreadLocal(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("thread_local")
+
+	// __thread int tls_counter = 10; __thread long tls_scratch;
+	counter := b.CreateGlobal("tls_counter", types.I32, b.ConstInt(types.I32, 10))
+	counter.ThreadLocal = true
+	scratch := b.CreateGlobal("tls_scratch", types.I64, nil)
+	scratch.ThreadLocal = true
+
+	// int tls_bump(int n) { return tls_counter += n; }
+	fn := b.CreateFunction("tls_bump", types.I32, []types.Type{types.I32}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	v := b.CreateLoad(types.I32, counter, "v")
+	sum := b.CreateAdd(v, fn.Arguments[0], "sum")
+	b.CreateStore(sum, counter)
+	b.CreateRet(sum)
+
+	// long tls_scratch_inc(void) { return ++tls_scratch; }
+	b.CreateFunction("tls_scratch_inc", types.I64, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	s := b.CreateLoad(types.I64, scratch, "s")
+	s1 := b.CreateAdd(s, b.ConstInt(types.I64, 1), "s1")
+	b.CreateStore(s1, scratch)
+	b.CreateRet(s1)
+
+	return m
+}
+
+// Loop whose back-edge swaps x/y and rotates a/b/c through phis that read
+// each other, so the edge copies must behave as one parallel move. The
+// back-edge is the false edge of the conditional branch.
+func buildPhiSwapLoop(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("phi_swap_loop")
+
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
 	loop := b.CreateBlock("loop")
 	exit := b.CreateBlock("exit")
-	
+
 	b.SetInsertPoint(entry)
 	b.CreateBr(loop)
-	
+
 	b.SetInsertPoint(loop)
 	i := b.CreatePhi(types.I32, "i")
-	i.AddIncoming(b.ConstInt(types.I32, 0), entry)
-	
+	pa := b.CreatePhi(types.I32, "a")
+	pb := b.CreatePhi(types.I32, "b")
+	pc := b.CreatePhi(types.I32, "c")
+	px := b.CreatePhi(types.I32, "x")
+	py := b.CreatePhi(types.I32, "y")
 	next := b.CreateAdd(i, b.ConstInt(types.I32, 1), "next")
+	done := b.CreateICmpSGE(next, b.ConstInt(types.I32, 6), "done")
+	b.CreateCondBr(done, exit, loop)
+
+	i.AddIncoming(b.ConstInt(types.I32, 0), entry)
 	i.AddIncoming(next, loop)
-	
-	cond := b.CreateICmpSLT(next, b.ConstInt(types.I32, 10), "cond")
-	b.CreateCondBr(cond, loop, exit)
-	
+	pa.AddIncoming(b.ConstInt(types.I32, 1), entry)
+	pa.AddIncoming(pb, loop)
+	pb.AddIncoming(b.ConstInt(types.I32, 2), entry)
+	pb.AddIncoming(pc, loop)
+	pc.AddIncoming(b.ConstInt(types.I32, 3), entry)
+	pc.AddIncoming(pa, loop)
+	px.AddIncoming(b.ConstInt(types.I32, 4), entry)
+	px.AddIncoming(py, loop)
+	py.AddIncoming(b.ConstInt(types.I32, 5), entry)
+	py.AddIncoming(px, loop)
+
+	// a*50 + b*10 + c + (x - y)
+	b.SetInsertPoint(exit)
+	r := b.CreateMul(pa, b.ConstInt(types.I32, 50), "r")
+	r = b.CreateAdd(r, b.CreateMul(pb, b.ConstInt(types.I32, 10), "b10"), "r1")
+	r = b.CreateAdd(r, pc, "r2")
+	r = b.CreateAdd(r, b.CreateSub(px, py, "xy"), "r3")
+	b.CreateRet(r)
+
+	return m
+}
+
+// Shifts by at least the operand width shift every bit out, for both
+// immediate and variable counts
+func buildShiftOutOfRange(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("shift_out_of_range")
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+
+	// Route a constant through memory so it reaches the shift as a
+	// variable count
+	opaque := func(t types.Type, v int64) ir.Value {
+		p := b.CreateAlloca(t, "p")
+		b.CreateStore(b.ConstInt(t, v), p)
+		return b.CreateLoad(t, p, "v")
+	}
+
+	one32 := b.ConstInt(types.I32, 1)
+	one64 := b.ConstInt(types.I64, 1)
+	zero32 := b.ConstInt(types.I32, 0)
+	zero64 := b.ConstInt(types.I64, 0)
+	checks := []ir.Value{
+		b.CreateICmpEQ(b.CreateShl(one32, b.ConstInt(types.I32, 32), "s"), zero32, "c"),
+		b.CreateICmpEQ(b.CreateShl(one64, b.ConstInt(types.I64, 64), "s"), zero64, "c"),
+		b.CreateICmpEQ(b.CreateShl(one32, opaque(types.I32, 32), "s"), zero32, "c"),
+		b.CreateICmpEQ(b.CreateShl(one64, opaque(types.I64, 64), "s"), zero64, "c"),
+		b.CreateICmpEQ(b.CreateLShr(b.ConstInt(types.I64, -1), opaque(types.I64, 70), "s"), zero64, "c"),
+		b.CreateICmpEQ(b.CreateAShr(b.ConstInt(types.I32, -8), opaque(types.I32, 40), "s"), b.ConstInt(types.I32, -1), "c"),
+	}
+
+	result := ir.Value(zero32)
+	for i, c := range checks {
+		bit := b.CreateShl(b.CreateZExt(c, types.I32, "z"), b.ConstInt(types.I32, int64(i)), "bit")
+		result = b.CreateOr(result, bit, "r")
+	}
+	b.CreateRet(result)
+
+	return m
+}
+
+// verifySharedSignMasks checks the three double fnegs share one 16-byte
+// sign mask in .rodata, and the float fneg has the only other
+func verifySharedSignMasks(obj []byte) error {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return err
+	}
+	sec := f.Section(".rodata")
+	if sec == nil {
+		return fmt.Errorf("no .rodata section")
+	}
+	if sec.Size != 32 || sec.Addralign < 16 {
+		return fmt.Errorf(".rodata is %d bytes aligned to %d, want two 16-byte masks", sec.Size, sec.Addralign)
+	}
+	return nil
+}
+
+// fneg(+0.0) is -0.0, while 0.0 - 0.0 is +0.0 and so is fneg(fneg(+0.0));
+// the sign bits are read back through a bitcast
+func buildFNegSignedZero(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("fneg_signed_zero")
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+
+	zero64 := b.ConstFloat(types.F64, 0.0)
+	zero32 := b.ConstFloat(types.F32, 0.0)
+
+	neg64 := b.CreateBitCast(b.CreateFNeg(zero64, "n64"), types.I64, "b64")
+	sign64 := b.CreateTrunc(b.CreateLShr(neg64, b.ConstInt(types.I64, 63), "s"), types.I32, "s64")
+
+	neg32 := b.CreateBitCast(b.CreateFNeg(zero32, "n32"), types.I32, "b32")
+	sign32 := b.CreateLShr(neg32, b.ConstInt(types.I32, 31), "s32")
+
+	sub := b.CreateBitCast(b.CreateFSub(zero64, zero64, "d"), types.I64, "bd")
+	signSub := b.CreateTrunc(b.CreateLShr(sub, b.ConstInt(types.I64, 63), "s"), types.I32, "ssub")
+
+	twice := b.CreateFNeg(b.CreateFNeg(zero64, "n"), "nn")
+	signTwice := b.CreateTrunc(b.CreateLShr(b.CreateBitCast(twice, types.I64, "bt"), b.ConstInt(types.I64, 63), "s"), types.I32, "stwice")
+
+	// sign64 | sign32<<1 | signSub<<2 | signTwice<<3
+	r := b.CreateOr(sign64, b.CreateShl(sign32, b.ConstInt(types.I32, 1), "t"), "r")
+	r = b.CreateOr(r, b.CreateShl(signSub, b.ConstInt(types.I32, 2), "t"), "r")
+	r = b.CreateOr(r, b.CreateShl(signTwice, b.ConstInt(types.I32, 3), "t"), "r")
+	b.CreateRet(r)
+
+	return m
+}
+
+// Long double arithmetic keeps the 64-bit significand of x86_fp80: 3^40
+// needs 64 bits, so the product of forty 3s, computed in a loop on fp80,
+// truncates to the nearest double and leaves an exact remainder of 33 that
+// double arithmetic would lose. Half the smallest subnormal double,
+// 2.5e-324, is also representable, so doubling it gets 5e-324 back. The
+// other checks divide, negate, round-trip a float, and load a long double
+// global through freeze.
+func buildLongDouble(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("long_double")
+	quarter := b.CreateGlobal("quarter", types.F80, b.ConstFloat(types.F80, 0.25))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	entry := b.CreateBlock("entry")
+	loop := b.CreateBlock("loop")
+	done := b.CreateBlock("done")
+
+	b.SetInsertPoint(entry)
+	slot := b.CreateAlloca(types.F80, "slot")
+	one := b.CreateFPExt(b.ConstFloat(types.F64, 1), types.F80, "one")
+	b.CreateBr(loop)
+
+	b.SetInsertPoint(loop)
+	i := b.CreatePhi(types.I32, "i")
+	p := b.CreatePhi(types.F80, "p")
+	next := b.CreateFMul(p, b.ConstFloat(types.F80, 3), "next")
+	i1 := b.CreateAdd(i, b.ConstInt(types.I32, 1), "i1")
+	i.AddIncoming(b.ConstInt(types.I32, 0), entry)
+	i.AddIncoming(i1, loop)
+	p.AddIncoming(one, entry)
+	p.AddIncoming(next, loop)
+	b.CreateCondBr(b.CreateICmpSLT(i1, b.ConstInt(types.I32, 40), "more"), loop, done)
+
+	b.SetInsertPoint(done)
+	b.CreateStore(next, slot)
+	product := b.CreateLoad(types.F80, slot, "product")
+	rounded := b.CreateFPTrunc(product, types.F64, "rounded")
+	rest := b.CreateFSub(product, b.CreateFPExt(rounded, types.F80, "back"), "rest")
+
+	tiny := b.CreateFMul(b.ConstFloat(types.F80, 5e-324), b.ConstFloat(types.F80, 0.5), "half")
+	tiny = b.CreateFMul(tiny, b.ConstFloat(types.F80, 2), "tiny")
+
+	ratio := b.CreateFDiv(b.CreateFNeg(b.CreateFPExt(b.ConstFloat(types.F32, 1.5), types.F80, "x"), "negx"), b.ConstFloat(types.F80, 0.5), "ratio")
+
+	q := b.CreateFreeze(b.CreateLoad(types.F80, quarter, "q"), "qf")
+	sum := b.CreateFAdd(q, q, "sum")
+
+	checks := []ir.Value{
+		b.CreateFCmp(ir.FCmpOEQ, rounded, b.ConstFloat(types.F64, 12157665459056928768), "c0"),
+		b.CreateFCmp(ir.FCmpOEQ, b.CreateFPTrunc(rest, types.F64, "r"), b.ConstFloat(types.F64, 33), "c1"),
+		b.CreateFCmp(ir.FCmpOEQ, b.CreateFPTrunc(tiny, types.F64, "t"), b.ConstFloat(types.F64, 5e-324), "c2"),
+		b.CreateFCmp(ir.FCmpOEQ, b.CreateFPTrunc(ratio, types.F32, "f"), b.ConstFloat(types.F32, -3), "c3"),
+		b.CreateFCmp(ir.FCmpOEQ, b.CreateFPTrunc(sum, types.F64, "s"), b.ConstFloat(types.F64, 0.5), "c4"),
+	}
+	var r ir.Value = b.ConstInt(types.I32, 32)
+	for _, c := range checks {
+		ok := b.CreateZExt(c, types.I32, "ok")
+		r = b.CreateAdd(r, b.CreateMul(ok, b.ConstInt(types.I32, 2), "two"), "r")
+	}
+	b.CreateRet(r)
+	return m
+}
+
+// isnan(x) is fcmp uno x, x, true only for a NaN, at both widths; ordered
+// is its opposite for a pair, and fcmp true and false ignore their
+// operands, NaNs included
+func buildFCmpUnordered(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("fcmp_unordered")
+	isnan := func(name string, t types.Type) *ir.Function {
+		fn := b.CreateFunction(name, types.I32, []types.Type{t}, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		x := fn.Arguments[0]
+		b.CreateRet(b.CreateZExt(b.CreateFCmp(ir.FCmpUNO, x, x, "nan"), types.I32, "r"))
+		return fn
+	}
+	isnan64 := isnan("isnan64", types.F64)
+	isnan32 := isnan("isnan32", types.F32)
+	ordered := b.CreateFunction("ordered", types.I32, []types.Type{types.F64, types.F64}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	ord := b.CreateFCmp(ir.FCmpORD, ordered.Arguments[0], ordered.Arguments[1], "ord")
+	b.CreateRet(b.CreateZExt(ord, types.I32, "r"))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	nan := b.ConstFloat(types.F64, math.NaN())
+	call := func(fn *ir.Function, args ...ir.Value) ir.Value {
+		return b.CreateCall(fn, args, "got")
+	}
+	checks := []struct {
+		got  ir.Value
+		want int64
+	}{
+		{call(isnan64, nan), 1},
+		{call(isnan64, b.ConstFloat(types.F64, 1.5)), 0},
+		{call(isnan64, b.ConstFloat(types.F64, math.Inf(1))), 0},
+		{call(isnan32, b.ConstFloat(types.F32, math.NaN())), 1},
+		{call(isnan32, b.ConstFloat(types.F32, math.Copysign(0, -1))), 0},
+		{call(ordered, nan, b.ConstFloat(types.F64, 1)), 0},
+		{call(ordered, b.ConstFloat(types.F64, 2), b.ConstFloat(types.F64, 1)), 1},
+		{b.CreateZExt(b.CreateFCmp(ir.FCmpTrue, nan, nan, "t"), types.I32, "got"), 1},
+		{b.CreateZExt(b.CreateFCmp(ir.FCmpFalse, b.ConstFloat(types.F64, 1), b.ConstFloat(types.F64, 1), "f"), types.I32, "got"), 0},
+	}
+	var r ir.Value = b.ConstInt(types.I32, 24)
+	for _, c := range checks {
+		ok := b.CreateZExt(b.CreateICmpEQ(c.got, b.ConstInt(types.I32, c.want), "eq"), types.I32, "ok")
+		r = b.CreateAdd(r, b.CreateMul(ok, b.ConstInt(types.I32, 2), "two"), "r")
+	}
+	b.CreateRet(r)
+	return m
+}
+
+// A library translation unit: exported helpers and no main
+func buildMathLibrary(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("mathlib")
+
+	add := b.CreateFunction("lib_add", types.I32, []types.Type{types.I32, types.I32}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateAdd(add.Arguments[0], add.Arguments[1], "sum"))
+
+	mul := b.CreateFunction("lib_mul", types.I32, []types.Type{types.I32, types.I32}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateMul(mul.Arguments[0], mul.Arguments[1], "prod"))
+
+	return m
+}
+
+// Calls into buildMathLibrary's object through declarations
+func buildLibraryClient(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("library_client")
+
+	params := []types.Type{types.I32, types.I32}
+	add := b.DeclareFunction("lib_add", types.I32, params, false)
+	mul := b.DeclareFunction("lib_mul", types.I32, params, false)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	sum := b.CreateCall(add, []ir.Value{b.ConstInt(types.I32, 3), b.ConstInt(types.I32, 10)}, "sum")
+	prod := b.CreateCall(mul, []ir.Value{sum, b.ConstInt(types.I32, 2)}, "prod")
+	b.CreateRet(prod)
+
+	return m
+}
+
+// Single-index GEPs on an i32* argument step by sizeof(i32), including a
+// negative i32 index that has to be sign-extended
+func buildGEPPointerArg(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("gep_pointer_arg")
+	i32Ptr := types.NewPointer(types.I32)
+
+	// int sum(int *p, int n) { int s = 0; for (i = 0; i < n; i++) s += p[i]; return s; }
+	sumFn := b.CreateFunction("sum", types.I32, []types.Type{i32Ptr, types.I32}, false)
+	entry := b.CreateBlock("entry")
+	loop := b.CreateBlock("loop")
+	exit := b.CreateBlock("exit")
+
+	b.SetInsertPoint(entry)
+	b.CreateBr(loop)
+
+	b.SetInsertPoint(loop)
+	i := b.CreatePhi(types.I32, "i")
+	acc := b.CreatePhi(types.I32, "acc")
+	elem := b.CreateGEP(types.I32, sumFn.Arguments[0], []ir.Value{i}, "elem")
+	acc1 := b.CreateAdd(acc, b.CreateLoad(types.I32, elem, "v"), "acc1")
+	i1 := b.CreateAdd(i, b.ConstInt(types.I32, 1), "i1")
+	more := b.CreateICmpSLT(i1, sumFn.Arguments[1], "more")
+	b.CreateCondBr(more, loop, exit)
+	i.AddIncoming(b.ConstInt(types.I32, 0), entry)
+	i.AddIncoming(i1, loop)
+	acc.AddIncoming(b.ConstInt(types.I32, 0), entry)
+	acc.AddIncoming(acc1, loop)
+
 	b.SetInsertPoint(exit)
-	b.CreateRet(next)
-	
+	b.CreateRet(acc1)
+
+	// int back(int *p, int k) { return p[k]; } with k negative
+	backFn := b.CreateFunction("back", types.I32, []types.Type{i32Ptr, types.I32}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	at := b.CreateGEP(types.I32, backFn.Arguments[0], []ir.Value{backFn.Arguments[1]}, "at")
+	b.CreateRet(b.CreateLoad(types.I32, at, "v"))
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	arr := b.CreateArrayAlloca(types.I32, b.ConstInt(types.I32, 5), "arr")
+	for k := int64(0); k < 5; k++ {
+		slot := b.CreateGEP(types.I32, arr, []ir.Value{b.ConstInt(types.I32, k)}, "slot")
+		b.CreateStore(b.ConstInt(types.I32, k+1), slot)
+	}
+	total := b.CreateCall(sumFn, []ir.Value{arr, b.ConstInt(types.I32, 5)}, "total")
+
+	// &arr[4], then index -2 back to arr[2] == 3
+	last := b.CreateGEP(types.I32, arr, []ir.Value{b.ConstInt(types.I32, 4)}, "last")
+	mid := b.CreateCall(backFn, []ir.Value{last, b.ConstInt(types.I32, -2)}, "mid")
+
+	// total*6 + mid*4
+	b.CreateRet(b.CreateAdd(b.CreateMul(total, b.ConstInt(types.I32, 6), "t6"), b.CreateMul(mid, b.ConstInt(types.I32, 4), "m4"), "r"))
+
 	return m
 }
 
-func buildNestedLoops(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("nested_loops")
-	
+// llvm.ctpop on i32 and i64: popcnt when the feature is enabled, a
+// software loop otherwise
+func buildCtpop(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("ctpop")
+
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	outerLoop := b.CreateBlock("outer_loop")
-	innerLoop := b.CreateBlock("inner_loop")
-	innerExit := b.CreateBlock("inner_exit")
-	outerExit := b.CreateBlock("outer_exit")
-	
-	b.SetInsertPoint(entry)
-	b.CreateBr(outerLoop)
-	
-	// Outer loop: i from 1 to 4
-	b.SetInsertPoint(outerLoop)
-	i := b.CreatePhi(types.I32, "i")
-	sum := b.CreatePhi(types.I32, "sum")
-	i.AddIncoming(b.ConstInt(types.I32, 1), entry)
-	sum.AddIncoming(b.ConstInt(types.I32, 0), entry)
-	
-	b.CreateBr(innerLoop)
-	
-	// Inner loop: j from i to i (just once for simplicity, but demonstrates nesting)
-	b.SetInsertPoint(innerLoop)
-	j := b.CreatePhi(types.I32, "j")
-	innerSum := b.CreatePhi(types.I32, "inner_sum")
-	j.AddIncoming(i, outerLoop)
-	innerSum.AddIncoming(sum, outerLoop)
-	
-	newSum := b.CreateAdd(innerSum, j, "new_sum")
-	nextJ := b.CreateAdd(j, b.ConstInt(types.I32, 1), "next_j")
-	
-	j.AddIncoming(nextJ, innerLoop)
-	innerSum.AddIncoming(newSum, innerLoop)
-	
-	innerCond := b.CreateICmpSLE(nextJ, i, "inner_cond")
-	b.CreateCondBr(innerCond, innerLoop, innerExit)
-	
-	b.SetInsertPoint(innerExit)
-	nextI := b.CreateAdd(i, b.ConstInt(types.I32, 1), "next_i")
-	i.AddIncoming(nextI, innerExit)
-	sum.AddIncoming(newSum, innerExit)
-	
-	outerCond := b.CreateICmpSLE(nextI, b.ConstInt(types.I32, 10), "outer_cond")
-	b.CreateCondBr(outerCond, outerLoop, outerExit)
-	
-	b.SetInsertPoint(outerExit)
-	b.CreateRet(newSum)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	c32 := b.CreateCallByName("llvm.ctpop.i32", types.I32, []ir.Value{b.ConstInt(types.I32, -1)}, "c32")
+	c64 := b.CreateCallByName("llvm.ctpop.i64", types.I64, []ir.Value{b.ConstInt(types.I64, -1)}, "c64")
+	b.CreateRet(b.CreateAdd(c32, b.CreateTrunc(c64, types.I32, "t"), "r"))
+
 	return m
 }
 
-func buildFactorial(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("factorial")
-	
-	// factorial function
-	factFn := b.CreateFunction("factorial", types.I32, []types.Type{types.I32}, false)
-	factFn.Arguments[0].SetName("n")
-	
-	entry := b.CreateBlock("entry")
-	baseCase := b.CreateBlock("base_case")
-	recursive := b.CreateBlock("recursive")
-	ret := b.CreateBlock("return")
-	
-	b.SetInsertPoint(entry)
-	n := factFn.Arguments[0]
-	isBase := b.CreateICmpSLE(n, b.ConstInt(types.I32, 1), "is_base")
-	b.CreateCondBr(isBase, baseCase, recursive)
-	
-	b.SetInsertPoint(baseCase)
-	b.CreateBr(ret)
-	
-	b.SetInsertPoint(recursive)
-	nMinus1 := b.CreateSub(n, b.ConstInt(types.I32, 1), "n_minus_1")
-	factNMinus1 := b.CreateCall(factFn, []ir.Value{nMinus1}, "fact_n_minus_1")
-	result := b.CreateMul(n, factNMinus1, "result")
-	b.CreateBr(ret)
-	
-	b.SetInsertPoint(ret)
-	phi := b.CreatePhi(types.I32, "retval")
-	phi.AddIncoming(b.ConstInt(types.I32, 1), baseCase)
-	phi.AddIncoming(result, recursive)
-	b.CreateRet(phi)
-	
-	// main function
+// Calls through function pointers: one loaded from a table of local
+// functions, one holding the address of libc's abs
+func buildIndirectCallTable(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("indirect_call_table")
+	unary := types.NewFunction(types.I32, []types.Type{types.I32}, false)
+	fnPtr := types.NewPointer(unary)
+
+	var table []*ir.Function
+	for _, def := range []struct {
+		name string
+		op   func(x ir.Value) ir.Value
+	}{
+		{"twice", func(x ir.Value) ir.Value { return b.CreateAdd(x, x, "r") }},
+		{"square", func(x ir.Value) ir.Value { return b.CreateMul(x, x, "r") }},
+		{"negate", func(x ir.Value) ir.Value { return b.CreateSub(b.ConstInt(types.I32, 0), x, "r") }},
+	} {
+		fn := b.CreateFunction(def.name, types.I32, []types.Type{types.I32}, false)
+		b.SetInsertPoint(b.CreateBlock("entry"))
+		b.CreateRet(def.op(fn.Arguments[0]))
+		table = append(table, fn)
+	}
+	abs := b.DeclareFunction("abs", types.I32, []types.Type{types.I32}, false)
+
 	b.CreateFunction("main", types.I32, nil, false)
-	mainEntry := b.CreateBlock("entry")
-	b.SetInsertPoint(mainEntry)
-	
-	fact5 := b.CreateCall(factFn, []ir.Value{b.ConstInt(types.I32, 5)}, "fact5")
-	b.CreateRet(fact5)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	slots := b.CreateAlloca(types.NewArray(fnPtr, int64(len(table))), "slots")
+	for i, fn := range table {
+		slot := b.CreateGEP(fnPtr, slots, []ir.Value{b.ConstInt(types.I64, int64(i))}, "slot")
+		b.CreateStore(fn, slot)
+	}
+	entry := b.CreateGEP(fnPtr, slots, []ir.Value{b.ConstInt(types.I64, 1)}, "entry")
+	callee := b.CreateLoad(fnPtr, entry, "callee")
+	viaTable := b.CreateIndirectCall(unary, callee, []ir.Value{b.ConstInt(types.I32, 7)}, "t")
+
+	absPtr := b.CreateAlloca(fnPtr, "abs_ptr")
+	b.CreateStore(abs, absPtr)
+	viaExtern := b.CreateIndirectCall(unary, b.CreateLoad(fnPtr, absPtr, "absfn"), []ir.Value{b.ConstInt(types.I32, -5)}, "a")
+
+	b.CreateRet(b.CreateAdd(viaTable, viaExtern, "r"))
+
 	return m
 }
 
-func buildFibonacci(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("fibonacci")
-	
-	fibFn := b.CreateFunction("fibonacci", types.I32, []types.Type{types.I32}, false)
-	fibFn.Arguments[0].SetName("n")
-	
+// int vla_sum(int n) { int a[n]; for (i..n) a[i] = i+1; for (i..n) s += a[i]; return s; }
+func buildDynamicAlloca(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("dynamic_alloca")
+
+	fn := b.CreateFunction("vla_sum", types.I32, []types.Type{types.I32}, false)
+	n := fn.Arguments[0]
 	entry := b.CreateBlock("entry")
-	baseCase := b.CreateBlock("base_case")
-	recursive := b.CreateBlock("recursive")
-	ret := b.CreateBlock("return")
-	
+	fill := b.CreateBlock("fill")
+	sum := b.CreateBlock("sum")
+	done := b.CreateBlock("done")
+
 	b.SetInsertPoint(entry)
-	n := fibFn.Arguments[0]
-	isBase := b.CreateICmpSLE(n, b.ConstInt(types.I32, 1), "is_base")
-	b.CreateCondBr(isBase, baseCase, recursive)
-	
-	b.SetInsertPoint(baseCase)
-	b.CreateBr(ret)
-	
-	b.SetInsertPoint(recursive)
-	nMinus1 := b.CreateSub(n, b.ConstInt(types.I32, 1), "n_minus_1")
-	nMinus2 := b.CreateSub(n, b.ConstInt(types.I32, 2), "n_minus_2")
-	fib1 := b.CreateCall(fibFn, []ir.Value{nMinus1}, "fib1")
-	fib2 := b.CreateCall(fibFn, []ir.Value{nMinus2}, "fib2")
-	result := b.CreateAdd(fib1, fib2, "result")
-	b.CreateBr(ret)
-	
-	b.SetInsertPoint(ret)
-	phi := b.CreatePhi(types.I32, "retval")
-	phi.AddIncoming(n, baseCase)
-	phi.AddIncoming(result, recursive)
-	b.CreateRet(phi)
-	
+	arr := b.CreateArrayAlloca(types.I32, n, "arr")
+	b.CreateBr(fill)
+
+	b.SetInsertPoint(fill)
+	i := b.CreatePhi(types.I32, "i")
+	i1 := b.CreateAdd(i, b.ConstInt(types.I32, 1), "i1")
+	b.CreateStore(i1, b.CreateGEP(types.I32, arr, []ir.Value{i}, "slot"))
+	b.CreateCondBr(b.CreateICmpSLT(i1, n, "more"), fill, sum)
+	i.AddIncoming(b.ConstInt(types.I32, 0), entry)
+	i.AddIncoming(i1, fill)
+
+	b.SetInsertPoint(sum)
+	j := b.CreatePhi(types.I32, "j")
+	acc := b.CreatePhi(types.I32, "acc")
+	acc1 := b.CreateAdd(acc, b.CreateLoad(types.I32, b.CreateGEP(types.I32, arr, []ir.Value{j}, "at"), "v"), "acc1")
+	j1 := b.CreateAdd(j, b.ConstInt(types.I32, 1), "j1")
+	b.CreateCondBr(b.CreateICmpSLT(j1, n, "more"), sum, done)
+	j.AddIncoming(b.ConstInt(types.I32, 0), fill)
+	j.AddIncoming(j1, sum)
+	acc.AddIncoming(b.ConstInt(types.I32, 0), fill)
+	acc.AddIncoming(acc1, sum)
+
+	b.SetInsertPoint(done)
+	b.CreateRet(acc1)
+
 	b.CreateFunction("main", types.I32, nil, false)
-	mainEntry := b.CreateBlock("entry")
-	b.SetInsertPoint(mainEntry)
-	fib10 := b.CreateCall(fibFn, []ir.Value{b.ConstInt(types.I32, 10)}, "fib10")
-	b.CreateRet(fib10)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	a := b.CreateCall(fn, []ir.Value{b.ConstInt(types.I32, 10)}, "a")
+	c := b.CreateCall(fn, []ir.Value{b.ConstInt(types.I32, 3)}, "c")
+	b.CreateRet(b.CreateAdd(a, c, "r"))
+
 	return m
 }
 
-func buildBitwiseAnd(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("bitwise_and")
-	
+// uitofp/fptoui on values with the top bit set, where the signed
+// conversions would go negative or overflow
+func buildUnsignedFpConversions(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("unsigned_fp_conversions")
+
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	a := b.ConstInt(types.I32, 12) // 1100
-	b2 := b.ConstInt(types.I32, 10) // 1010
-	result := b.CreateAnd(a, b2, "result") // 1000 = 8
+	b.SetInsertPoint(b.CreateBlock("entry"))
+
+	feq := func(l ir.Value, t types.Type, want float64) ir.Value {
+		return b.CreateFCmp(ir.FCmpOEQ, l, b.ConstFloat(t, want), "c")
+	}
+	ieq := func(l ir.Value, t types.Type, want uint64) ir.Value {
+		return b.CreateICmpEQ(l, b.ConstInt(t, int64(want)), "c")
+	}
+	var big uint64 = 0xFFFFFFFFFFFFF800 // Largest double below 2^64
+
+	checks := []ir.Value{
+		feq(b.CreateUIToFP(b.ConstInt(types.I64, -1), types.F64, "d"), types.F64, 18446744073709551616.0),
+		ieq(b.CreateFPToUI(b.CreateUIToFP(b.ConstInt(types.I64, int64(big)), types.F64, "d"), types.I64, "u"), types.I64, big),
+		feq(b.CreateUIToFP(b.ConstInt(types.I32, -1), types.F64, "d"), types.F64, 4294967295.0),
+		ieq(b.CreateFPToUI(b.ConstFloat(types.F64, 3e9), types.I32, "u"), types.I32, 3000000000),
+		feq(b.CreateUIToFP(b.ConstInt(types.I64, -1), types.F32, "f"), types.F32, 18446744073709551616.0),
+		ieq(b.CreateFPToUI(b.ConstFloat(types.F32, 1.5e19), types.I64, "u"), types.I64, 15000000520515485696),
+		// Below 2^63 the signed conversion serves as is
+		ieq(b.CreateFPToSI(b.CreateUIToFP(b.ConstInt(types.I64, 5), types.F64, "d"), types.I64, "s"), types.I64, 5),
+		feq(b.CreateUIToFP(b.ConstInt(types.I64, 1<<40), types.F32, "f"), types.F32, 1<<40),
+	}
+
+	result := ir.Value(b.ConstInt(types.I32, 0))
+	for i, c := range checks {
+		bit := b.CreateShl(b.CreateZExt(c, types.I32, "z"), b.ConstInt(types.I32, int64(i)), "bit")
+		result = b.CreateOr(result, bit, "r")
+	}
 	b.CreateRet(result)
-	
+
 	return m
 }
 
-func buildBitwiseOr(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("bitwise_or")
-	
+func buildAlignedData(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("aligned_data")
+
+	// The one-byte global pushes big off the section start, so only
+	// honoring its alignment puts it on a 64-byte boundary
+	pad := b.CreateGlobal("pad", types.I8, b.ConstInt(types.I8, 5))
+	big := b.CreateGlobal("big", types.I64, b.ConstInt(types.I64, 7))
+	big.Alignment = 64
+
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	a := b.ConstInt(types.I32, 12) // 1100
-	b2 := b.ConstInt(types.I32, 3)  // 0011
-	result := b.CreateOr(a, b2, "result") // 1111 = 15
-	b.CreateRet(result)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+
+	addr := b.CreatePtrToInt(big, types.I64, "addr")
+	low := b.CreateAnd(addr, b.ConstInt(types.I64, 63), "low")
+	p := b.CreateLoad(types.I8, pad, "p")
+	v := b.CreateLoad(types.I64, big, "v")
+	sum := b.CreateAdd(b.CreateZExt(p, types.I64, "pz"), v, "sum")
+	b.CreateRet(b.CreateTrunc(b.CreateAdd(sum, low, "r"), types.I32, "rt"))
+
 	return m
 }
 
-func buildBitwiseXor(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("bitwise_xor")
-	
+// Takes a global's address and a function's address, the two kinds of
+// reference the code model governs
+func buildCodeModel(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("code_model")
+
+	arr := types.NewArray(types.I64, 4)
+	var elems []ir.Constant
+	for _, v := range []int64{3, 5, 7, 9} {
+		elems = append(elems, b.ConstInt(types.I64, v))
+	}
+	table := b.CreateGlobal("table", arr, b.ConstArray(arr, elems))
+
+	unary := types.NewFunction(types.I64, []types.Type{types.I64}, false)
+	twice := b.CreateFunction("twice", types.I64, []types.Type{types.I64}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateAdd(twice.Arguments[0], twice.Arguments[0], "r"))
+
 	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	p2 := b.CreateGEP(types.I64, table, []ir.Value{b.ConstInt(types.I64, 2)}, "p2")
+	p3 := b.CreateGEP(types.I64, table, []ir.Value{b.ConstInt(types.I64, 3)}, "p3")
+	doubled := b.CreateIndirectCall(unary, twice, []ir.Value{b.CreateLoad(types.I64, p2, "x")}, "d")
+	sum := b.CreateAdd(doubled, b.CreateLoad(types.I64, p3, "y"), "sum")
+	b.CreateRet(b.CreateTrunc(sum, types.I32, "r"))
+
+	return m
+}
+
+// defineVarargSum defines name(i32 count, ...) returning the sum of count
+// variadic arguments of type elem, read with va_arg
+func defineVarargSum(b *builder.Builder, name string, elem types.Type) *ir.Function {
+	fn := b.CreateFunction(name, elem, []types.Type{types.I32}, true)
 	entry := b.CreateBlock("entry")
+	loop := b.CreateBlock("loop")
+	body := b.CreateBlock("body")
+	done := b.CreateBlock("done")
+
 	b.SetInsertPoint(entry)
-	
-	a := b.ConstInt(types.I32, 12) // 1100
-	b2 := b.ConstInt(types.I32, 11) // 1011
-	result := b.CreateXor(a, b2, "result") // 0111 = 7
-	b.CreateRet(result)
-	
+	// va_list: { i32 gp_offset, i32 fp_offset, ptr overflow_arg_area, ptr reg_save_area }
+	ap := b.CreateAlloca(types.NewArray(types.I8, 24), "ap")
+	i := b.CreateAlloca(types.I32, "i")
+	acc := b.CreateAlloca(elem, "acc")
+	b.CreateCallByName("llvm.va_start", types.Void, []ir.Value{ap}, "")
+	b.CreateStore(b.ConstInt(types.I32, 0), i)
+	if types.IsFloat(elem) {
+		b.CreateStore(b.ConstFloat(elem, 0), acc)
+	} else {
+		b.CreateStore(b.ConstInt(elem, 0), acc)
+	}
+	b.CreateBr(loop)
+
+	b.SetInsertPoint(loop)
+	iv := b.CreateLoad(types.I32, i, "iv")
+	b.CreateCondBr(b.CreateICmpSLT(iv, fn.Arguments[0], "more"), body, done)
+
+	b.SetInsertPoint(body)
+	arg := b.CreateVAArg(ap, elem, "arg")
+	cur := b.CreateLoad(elem, acc, "cur")
+	if types.IsFloat(elem) {
+		b.CreateStore(b.CreateFAdd(cur, arg, "next"), acc)
+	} else {
+		b.CreateStore(b.CreateAdd(cur, arg, "next"), acc)
+	}
+	b.CreateStore(b.CreateAdd(iv, b.ConstInt(types.I32, 1), "inext"), i)
+	b.CreateBr(loop)
+
+	b.SetInsertPoint(done)
+	b.CreateCallByName("llvm.va_end", types.Void, []ir.Value{ap}, "")
+	b.CreateRet(b.CreateLoad(elem, acc, "total"))
+	return fn
+}
+
+// Eight integers and ten doubles each overflow their registers, so both
+// the save area and the caller's stack are walked
+func buildVariadicCallee(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("variadic_callee")
+	sum := defineVarargSum(b, "sum", types.I64)
+	fsum := defineVarargSum(b, "fsum", types.F64)
+	fromC := b.DeclareFunction("c_calls_sum", types.I32, nil, false)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+
+	ints := []ir.Value{b.ConstInt(types.I32, 8)}
+	for v := int64(1); v <= 8; v++ {
+		ints = append(ints, b.ConstInt(types.I64, v))
+	}
+	floats := []ir.Value{b.ConstInt(types.I32, 10)}
+	for v := 1.0; v <= 10; v++ {
+		floats = append(floats, b.ConstFloat(types.F64, v))
+	}
+
+	s := b.CreateCall(sum, ints, "s")
+	f := b.CreateFPToSI(b.CreateCall(fsum, floats, "f"), types.I64, "fi")
+	c := b.CreateSExt(b.CreateCall(fromC, nil, "c"), types.I64, "ci")
+	total := b.CreateAdd(b.CreateAdd(s, f, "sf"), c, "total")
+	b.CreateRet(b.CreateTrunc(total, types.I32, "r"))
+
 	return m
 }
 
-func buildShiftLeft(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("shift_left")
-	
+// Narrow loads feeding an extend fold into one movsx/movzx from memory
+func buildExtendingLoad(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("extending_load")
+	sb := b.CreateGlobal("signed_byte", types.I8, b.ConstInt(types.I8, -5))
+	uw := b.CreateGlobal("unsigned_word", types.I16, b.ConstInt(types.I16, -1))
+
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	a := b.ConstInt(types.I32, 4)
-	shift := b.ConstInt(types.I32, 3)
-	result := b.CreateShl(a, shift, "result") // 4 << 3 = 32
-	b.CreateRet(result)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	s := b.CreateSExt(b.CreateLoad(types.I8, sb, "sb"), types.I32, "s")
+	z := b.CreateZExt(b.CreateLoad(types.I16, uw, "uw"), types.I32, "z")
+	r := b.CreateAdd(s, b.ConstInt(types.I32, 105), "r")
+	b.CreateRet(b.CreateAdd(r, b.CreateSub(z, b.ConstInt(types.I32, 65535), "zd"), "total"))
+
 	return m
 }
 
-func buildShiftRight(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("shift_right")
-	
+// globalString defines a read-only NUL-terminated string literal
+func globalString(b *builder.Builder, name, s string) *ir.Global {
+	arr := types.NewArray(types.I8, int64(len(s)+1))
+	var elems []ir.Constant
+	for _, c := range []byte(s + "\x00") {
+		elems = append(elems, b.ConstInt(types.I8, int64(c)))
+	}
+	return b.CreateGlobalConstant(name, b.ConstArray(arr, elems))
+}
+
+// Two "hi" literals share storage, and "i" is the tail of them
+func buildStringDedup(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("string_dedup")
+	msg1 := globalString(b, "msg1", "hi")
+	msg2 := globalString(b, "msg2", "hi")
+	tail := globalString(b, "tail", "i")
+
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	a := b.ConstInt(types.I32, 16)
-	shift := b.ConstInt(types.I32, 3)
-	result := b.CreateLShr(a, shift, "result") // 16 >> 3 = 2
-	b.CreateRet(result)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	a1 := b.CreatePtrToInt(msg1, types.I64, "a1")
+	a2 := b.CreatePtrToInt(msg2, types.I64, "a2")
+	at := b.CreatePtrToInt(tail, types.I64, "at")
+
+	same := b.CreateZExt(b.CreateICmpEQ(a1, a2, "same"), types.I32, "samez")
+	next := b.CreateAdd(a1, b.ConstInt(types.I64, 1), "next")
+	merged := b.CreateZExt(b.CreateICmpEQ(at, next, "merged"), types.I32, "mergedz")
+	first := b.CreateLoad(types.I8, msg2, "first")
+	isH := b.CreateZExt(b.CreateICmpEQ(first, b.ConstInt(types.I8, 'h'), "ish"), types.I32, "ishz")
+
+	r := b.CreateAdd(b.CreateMul(same, b.ConstInt(types.I32, 100), "h"), b.CreateMul(merged, b.ConstInt(types.I32, 10), "t"), "ht")
+	b.CreateRet(b.CreateAdd(r, isH, "r"))
+
 	return m
 }
 
-func buildNegativeNumbers(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("negative_numbers")
-	
+// Each check sets a bit: 0/0 as double and as float have the canonical
+// quiet NaN bits, so does an fptrunc of the double NaN, and 1.5+2.5 is
+// still 4
+func buildNaNBits(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("nan_bits")
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	// -3 & 0xFF should give 253 (two's complement)
-	neg := b.ConstInt(types.I32, -3)
-	mask := b.ConstInt(types.I32, 0xFF)
-	result := b.CreateAnd(neg, mask, "result")
+	b.SetInsertPoint(b.CreateBlock("entry"))
+
+	dzero := b.ConstFloat(types.F64, 0)
+	fzero := b.ConstFloat(types.F32, 0)
+	dnan := b.CreateFDiv(dzero, dzero, "dnan")
+	fnan := b.CreateFDiv(fzero, fzero, "fnan")
+	tnan := b.CreateFPTrunc(dnan, types.F32, "tnan")
+	sum := b.CreateFAdd(b.ConstFloat(types.F64, 1.5), b.ConstFloat(types.F64, 2.5), "sum")
+
+	checks := []ir.Value{
+		b.CreateICmpEQ(b.CreateBitCast(dnan, types.I64, "dbits"), b.ConstInt(types.I64, 0x7FF8000000000000), "c0"),
+		b.CreateICmpEQ(b.CreateBitCast(fnan, types.I32, "fbits"), b.ConstInt(types.I32, 0x7FC00000), "c1"),
+		b.CreateFCmp(ir.FCmpOEQ, sum, b.ConstFloat(types.F64, 4), "c2"),
+		b.CreateICmpEQ(b.CreateBitCast(tnan, types.I32, "tbits"), b.ConstInt(types.I32, 0x7FC00000), "c3"),
+	}
+	var result ir.Value = b.ConstInt(types.I32, 0)
+	for i, check := range checks {
+		bit := b.CreateShl(b.CreateZExt(check, types.I32, "z"), b.ConstInt(types.I32, int64(i)), "bit")
+		result = b.CreateOr(result, bit, "acc")
+	}
 	b.CreateRet(result)
-	
+
 	return m
 }
 
-func buildZeroDivisionCheck(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("zero_division_check")
-	
+// main calls two functions of its own and one from libc. Only the hidden
+// inc is called directly: twice could be preempted in a shared library, so
+// it goes through the PLT like abs.
+func buildLocalAndExternCall(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("call_relocs")
+	twice := b.CreateFunction("twice", types.I32, []types.Type{types.I32}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateAdd(twice.Arguments[0], twice.Arguments[0], "r"))
+
+	inc := b.CreateFunction("inc", types.I32, []types.Type{types.I32}, false)
+	inc.Visibility = ir.HiddenVisibility
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateAdd(inc.Arguments[0], b.ConstInt(types.I32, 1), "r"))
+
+	abs := b.DeclareFunction("abs", types.I32, []types.Type{types.I32}, false)
+
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	checkZero := b.CreateBlock("check_zero")
-	divBlock := b.CreateBlock("divide")
-	noDiv := b.CreateBlock("no_divide")
-	merge := b.CreateBlock("merge")
-	
-	b.SetInsertPoint(entry)
-	divisor := b.ConstInt(types.I32, 5)
-	b.CreateBr(checkZero)
-	
-	b.SetInsertPoint(checkZero)
-	isZero := b.CreateICmpEQ(divisor, b.ConstInt(types.I32, 0), "is_zero")
-	b.CreateCondBr(isZero, noDiv, divBlock)
-	
-	b.SetInsertPoint(divBlock)
-	divResult := b.CreateSDiv(b.ConstInt(types.I32, 50), divisor, "div_result")
-	b.CreateBr(merge)
-	
-	b.SetInsertPoint(noDiv)
-	defaultVal := b.ConstInt(types.I32, 0)
-	b.CreateBr(merge)
-	
-	b.SetInsertPoint(merge)
-	phi := b.CreatePhi(types.I32, "result")
-	phi.AddIncoming(divResult, divBlock)
-	phi.AddIncoming(defaultVal, noDiv)
-	b.CreateRet(phi)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	a := b.CreateCall(abs, []ir.Value{b.ConstInt(types.I32, -20)}, "a")
+	t := b.CreateCall(twice, []ir.Value{a}, "t")
+	i := b.CreateCall(inc, []ir.Value{b.ConstInt(types.I32, 1)}, "i")
+	b.CreateRet(b.CreateAdd(t, i, "r"))
+
 	return m
 }
 
-func buildComplexExpression(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("complex_expression")
-	
+// Selects between the addresses of two stack variables, one each way. The
+// flag is loaded from a global so the condition is only known at run time.
+func buildSelectPointer(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("select_pointer")
+	flag := b.CreateGlobal("flag", types.I32, b.ConstInt(types.I32, 1))
+
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	// (6 * 7) + (12 / 4) - 3 = 42 + 3 - 3 = 42
-	a := b.CreateMul(b.ConstInt(types.I32, 6), b.ConstInt(types.I32, 7), "mul")
-	b2 := b.CreateSDiv(b.ConstInt(types.I32, 12), b.ConstInt(types.I32, 4), "div")
-	c := b.CreateAdd(a, b2, "add")
-	result := b.CreateSub(c, b.ConstInt(types.I32, 3), "result")
-	b.CreateRet(result)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	x := b.CreateAlloca(types.I32, "x")
+	y := b.CreateAlloca(types.I32, "y")
+	b.CreateStore(b.ConstInt(types.I32, 4), x)
+	b.CreateStore(b.ConstInt(types.I32, 2), y)
+
+	set := b.CreateICmpNE(b.CreateLoad(types.I32, flag, "f"), b.ConstInt(types.I32, 0), "set")
+	clear := b.CreateICmpEQ(b.CreateLoad(types.I32, flag, "g"), b.ConstInt(types.I32, 0), "clear")
+	p := b.CreateSelect(set, x, y, "p")
+	q := b.CreateSelect(clear, x, y, "q")
+	hi := b.CreateMul(b.CreateLoad(types.I32, p, "pv"), b.ConstInt(types.I32, 10), "hi")
+	b.CreateRet(b.CreateAdd(hi, b.CreateLoad(types.I32, q, "qv"), "r"))
+
 	return m
 }
 
-func buildMultipleArgs(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("multiple_args")
-	
-	// create function: sum(a, b, c, d, e, f, g) = a + b + c + d + e + f + g
-	sumFn := b.CreateFunction("sum", types.I32, 
-		[]types.Type{types.I32, types.I32, types.I32, types.I32, types.I32, types.I32, types.I32}, 
-		false)
-	for i := 0; i < 7; i++ {
-		sumFn.Arguments[i].SetName(fmt.Sprintf("arg%d", i))
+// Selects between {i32, i32} values built with insertvalue, and between
+// one of them and zeroinitializer
+func buildSelectStruct(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("select_struct")
+	flag := b.CreateGlobal("flag", types.I32, b.ConstInt(types.I32, 1))
+	pair := types.NewStruct("", []types.Type{types.I32, types.I32}, false)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	makePair := func(a, c int64) ir.Value {
+		p := b.CreateInsertValue(b.ConstUndef(pair), b.ConstInt(types.I32, a), []int{0}, "p")
+		return b.CreateInsertValue(p, b.ConstInt(types.I32, c), []int{1}, "p")
 	}
-	
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	// Sum all arguments
-	result := ir.Value(sumFn.Arguments[0])
-	for i := 1; i < 7; i++ {
-		result = b.CreateAdd(result, sumFn.Arguments[i], fmt.Sprintf("sum%d", i))
+	s1 := makePair(1, 2)
+	s2 := makePair(30, 40)
+
+	set := b.CreateICmpNE(b.CreateLoad(types.I32, flag, "f"), b.ConstInt(types.I32, 0), "set")
+	clear := b.CreateICmpEQ(b.CreateLoad(types.I32, flag, "g"), b.ConstInt(types.I32, 0), "clear")
+	t := b.CreateSelect(set, s1, s2, "t")
+	f := b.CreateSelect(clear, s1, s2, "f")
+	z := b.CreateSelect(set, b.ConstZero(pair), s2, "z")
+
+	field := func(agg ir.Value, i int) ir.Value {
+		return b.CreateExtractValue(agg, []int{i}, "e")
 	}
-	b.CreateRet(result)
-	
-	// main: call sum(1, 2, 3, 4, 5, 6, 21) = 42
+	r := b.CreateAdd(b.CreateMul(field(t, 0), b.ConstInt(types.I32, 10), "m"), field(t, 1), "r")
+	r = b.CreateAdd(r, b.CreateAdd(field(f, 0), field(f, 1), "s"), "r")
+	r = b.CreateAdd(r, b.CreateAdd(field(z, 0), field(z, 1), "s"), "r")
+	b.CreateRet(r)
+
+	return m
+}
+
+// C pointer subtraction: &a[9] - &a[2] and back in an i32 array, and the
+// same across an array of 12-byte structs, whose size is no power of two.
+// A negative distance that isn't a multiple of the size still rounds
+// toward zero, as sdiv does.
+func buildPointerDiff(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("pointer_diff")
+	ints := types.NewArray(types.I32, 10)
+	triple := types.NewStruct("", []types.Type{types.I32, types.I32, types.I32}, false)
+	triples := types.NewArray(triple, 4)
+
 	b.CreateFunction("main", types.I32, nil, false)
-	mainEntry := b.CreateBlock("entry")
-	b.SetInsertPoint(mainEntry)
-	
-	args := []ir.Value{
-		b.ConstInt(types.I32, 1),
-		b.ConstInt(types.I32, 2),
-		b.ConstInt(types.I32, 3),
-		b.ConstInt(types.I32, 4),
-		b.ConstInt(types.I32, 5),
-		b.ConstInt(types.I32, 6),
-		b.ConstInt(types.I32, 21),
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	a := b.CreateAlloca(ints, "a")
+	t := b.CreateAlloca(triples, "t")
+
+	elem := func(arrType types.Type, arr ir.Value, i int64) ir.Value {
+		return b.CreateGEP(arrType, arr, []ir.Value{b.ConstInt(types.I64, 0), b.ConstInt(types.I64, i)}, "e")
 	}
-	sumResult := b.CreateCall(sumFn, args, "sum_result")
-	b.CreateRet(sumResult)
-	
+	ptrDiff := func(p, q ir.Value, size int64) ir.Value {
+		pi := b.CreatePtrToInt(p, types.I64, "pi")
+		qi := b.CreatePtrToInt(q, types.I64, "qi")
+		return b.CreateSDiv(b.CreateSub(pi, qi, "bytes"), b.ConstInt(types.I64, size), "d")
+	}
+
+	forward := ptrDiff(elem(ints, a, 9), elem(ints, a, 2), 4)
+	backward := ptrDiff(elem(ints, a, 2), elem(ints, a, 9), 4)
+	structs := ptrDiff(elem(triples, t, 3), elem(triples, t, 0), 12)
+	byteAt := func(i int64) ir.Value {
+		return b.CreateGEP(types.I8, a, []ir.Value{b.ConstInt(types.I64, i)}, "byte")
+	}
+	inexact := ptrDiff(byteAt(1), byteAt(8), 4)
+
+	r := b.CreateSub(b.CreateMul(forward, b.ConstInt(types.I64, 5), "m"), backward, "r")
+	r = b.CreateAdd(r, structs, "r")
+	r = b.CreateSub(r, inexact, "r")
+	b.CreateRet(b.CreateTrunc(r, types.I32, "ret"))
+
 	return m
 }
 
-func buildNestedCalls(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("nested_calls")
-	
-	// add(a, b) = a + b
-	addFn := b.CreateFunction("add", types.I32, []types.Type{types.I32, types.I32}, false)
-	addFn.Arguments[0].SetName("a")
-	addFn.Arguments[1].SetName("b")
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	sum := b.CreateAdd(addFn.Arguments[0], addFn.Arguments[1], "sum")
-	b.CreateRet(sum)
-	
-	// mul(a, b) = a * b
-	mulFn := b.CreateFunction("mul", types.I32, []types.Type{types.I32, types.I32}, false)
-	mulFn.Arguments[0].SetName("a")
-	mulFn.Arguments[1].SetName("b")
-	entry2 := b.CreateBlock("entry")
-	b.SetInsertPoint(entry2)
-	prod := b.CreateMul(mulFn.Arguments[0], mulFn.Arguments[1], "prod")
-	b.CreateRet(prod)
-	
-	// main: add(mul(2, 3), mul(5, 2)) + 1 = add(6, 10) + 1 = 16 + 1 = 17
+// Writes every byte of a 12-byte array and then an i64 in the next alloca;
+// the array must read back intact, and the i64 (and an i32 asking for 16)
+// must be aligned
+func buildAllocaLayout(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("alloca_layout")
+	arr := types.NewArray(types.I32, 3)
+
 	b.CreateFunction("main", types.I32, nil, false)
-	mainEntry := b.CreateBlock("entry")
-	b.SetInsertPoint(mainEntry)
-	
-	m1 := b.CreateCall(mulFn, []ir.Value{b.ConstInt(types.I32, 2), b.ConstInt(types.I32, 3)}, "m1")
-	m2 := b.CreateCall(mulFn, []ir.Value{b.ConstInt(types.I32, 5), b.ConstInt(types.I32, 2)}, "m2")
-	a1 := b.CreateCall(addFn, []ir.Value{m1, m2}, "a1")
-	result := b.CreateAdd(a1, b.ConstInt(types.I32, 1), "result")
-	b.CreateRet(result)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	a := b.CreateAlloca(arr, "a")
+	wide := b.CreateAlloca(types.I64, "wide")
+	aligned := b.CreateAlloca(types.I32, "aligned")
+	aligned.Align = 16
+
+	elem := func(i int64) ir.Value {
+		return b.CreateGEP(arr, a, []ir.Value{b.ConstInt(types.I64, 0), b.ConstInt(types.I64, i)}, "e")
+	}
+	for i := int64(0); i < 3; i++ {
+		b.CreateStore(b.ConstInt(types.I32, 10+i), elem(i))
+	}
+	b.CreateStore(b.ConstInt(types.I64, 20), wide)
+
+	r := b.CreateAdd(b.CreateLoad(types.I32, elem(0), "a0"), b.CreateLoad(types.I32, elem(2), "a2"), "r")
+	r = b.CreateAdd(r, b.CreateTrunc(b.CreateLoad(types.I64, wide, "w"), types.I32, "wt"), "r")
+
+	misaligned := b.CreateOr(
+		b.CreateAnd(b.CreatePtrToInt(wide, types.I64, "wp"), b.ConstInt(types.I64, 7), "wm"),
+		b.CreateAnd(b.CreatePtrToInt(aligned, types.I64, "ap"), b.ConstInt(types.I64, 15), "am"), "mis")
+	b.CreateRet(b.CreateAdd(r, b.CreateTrunc(misaligned, types.I32, "mt"), "ret"))
+
 	return m
 }
 
-func buildSelect(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("select")
-	
+// scribble fills its frame with a pattern; reader then runs on the same
+// stack and sums a large array, a small local and a variable-length array
+// without ever storing to them
+func buildZeroAlloca(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("zero_alloca")
+	count := b.CreateGlobal("count", types.I64, b.ConstInt(types.I64, 5))
+	big := types.NewArray(types.I64, 64)
+
+	sumArray := func(arrType types.Type, arr ir.Value, n int64) ir.Value {
+		var sum ir.Value = b.ConstInt(types.I64, 0)
+		for i := int64(0); i < n; i++ {
+			p := b.CreateGEP(arrType, arr, []ir.Value{b.ConstInt(types.I64, 0), b.ConstInt(types.I64, i)}, "p")
+			sum = b.CreateOr(sum, b.CreateLoad(types.I64, p, "v"), "sum")
+		}
+		return sum
+	}
+
+	scribble := b.CreateFunction("scribble", types.Void, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	junk := b.CreateAlloca(big, "junk")
+	for i := int64(0); i < 64; i++ {
+		p := b.CreateGEP(big, junk, []ir.Value{b.ConstInt(types.I64, 0), b.ConstInt(types.I64, i)}, "p")
+		b.CreateStore(b.ConstInt(types.I64, -0x5555555555555556), p)
+	}
+	b.CreateRetVoid()
+
+	reader := b.CreateFunction("reader", types.I64, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	arr := b.CreateAlloca(big, "arr")
+	small := b.CreateAlloca(types.I32, "small")
+	vla := b.CreateArrayAlloca(types.I64, b.CreateLoad(types.I64, count, "n"), "vla")
+	sum := sumArray(big, arr, 64)
+	sum = b.CreateOr(sum, b.CreateZExt(b.CreateLoad(types.I32, small, "s"), types.I64, "sz"), "sum")
+	for i := int64(0); i < 5; i++ {
+		p := b.CreateGEP(types.I64, vla, []ir.Value{b.ConstInt(types.I64, i)}, "p")
+		sum = b.CreateOr(sum, b.CreateLoad(types.I64, p, "v"), "sum")
+	}
+	b.CreateRet(sum)
+
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	cond := b.CreateICmpSGT(b.ConstInt(types.I32, 10), b.ConstInt(types.I32, 5), "cond")
-	result := b.CreateSelect(cond, b.ConstInt(types.I32, 100), b.ConstInt(types.I32, 200), "result")
-	b.CreateRet(result)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateCall(scribble, nil, "")
+	clean := b.CreateICmpEQ(b.CreateCall(reader, nil, "r"), b.ConstInt(types.I64, 0), "clean")
+	b.CreateRet(b.CreateSelect(clean, b.ConstInt(types.I32, 42), b.ConstInt(types.I32, 1), "ret"))
+
 	return m
 }
 
-func buildSwitchStatement(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("switch_statement")
-	
+// The branch to "unlikely" comes first in IR order but is weighted 1:100
+// against; flag is zero, so the likely side runs
+func buildWeightedBranch(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("weighted_branch")
+	flag := b.CreateGlobal("flag", types.I32, b.ConstInt(types.I32, 0))
+
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
-	case1 := b.CreateBlock("case1")
-	case2 := b.CreateBlock("case2")
-	case3 := b.CreateBlock("case3")
-	defaultCase := b.CreateBlock("default")
-	merge := b.CreateBlock("merge")
-	
+	unlikely := b.CreateBlock("unlikely")
+	likely := b.CreateBlock("likely")
+
 	b.SetInsertPoint(entry)
-	value := b.ConstInt(types.I32, 2)
-	
-	// Fix: Create constant ints separately and cast them
-	caseVal1 := b.ConstInt(types.I32, 1)
-	caseVal2 := b.ConstInt(types.I32, 2)
-	caseVal3 := b.ConstInt(types.I32, 3)
-	
-	switchInst := &ir.SwitchInst{
-		BaseInstruction: ir.BaseInstruction{
-			Op:  ir.OpSwitch,
-			Ops: []ir.Value{value},
-		},
-		Condition:    value,
-		DefaultBlock: defaultCase,
-		Cases: []ir.SwitchCase{
-			{Value: caseVal1, Block: case1},
-			{Value: caseVal2, Block: case2},
-			{Value: caseVal3, Block: case3},
-		},
-	}
-	entry.AddInstruction(switchInst)
-	
-	b.SetInsertPoint(case1)
-	val1 := b.ConstInt(types.I32, 10)
-	b.CreateBr(merge)
-	
-	b.SetInsertPoint(case2)
-	val2 := b.ConstInt(types.I32, 30)
-	b.CreateBr(merge)
-	
-	b.SetInsertPoint(case3)
-	val3 := b.ConstInt(types.I32, 50)
-	b.CreateBr(merge)
-	
-	b.SetInsertPoint(defaultCase)
-	valDefault := b.ConstInt(types.I32, 0)
-	b.CreateBr(merge)
-	
-	b.SetInsertPoint(merge)
-	phi := b.CreatePhi(types.I32, "result")
-	phi.AddIncoming(val1, case1)
-	phi.AddIncoming(val2, case2)
-	phi.AddIncoming(val3, case3)
-	phi.AddIncoming(valDefault, defaultCase)
-	b.CreateRet(phi)
-	
+	set := b.CreateICmpNE(b.CreateLoad(types.I32, flag, "f"), b.ConstInt(types.I32, 0), "set")
+	br := b.CreateCondBr(set, unlikely, likely)
+	br.TrueWeight, br.FalseWeight = 1, 100
+
+	b.SetInsertPoint(unlikely)
+	b.CreateRet(b.ConstInt(types.I32, 1))
+
+	b.SetInsertPoint(likely)
+	b.CreateRet(b.ConstInt(types.I32, 42))
+
 	return m
 }
 
-func buildMemoryOps(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("memory_ops")
-	
+// A failed bounds check: index 7 into 4 elements reaches llvm.trap
+func buildTrap(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("trap")
+	index := b.CreateGlobal("index", types.I32, b.ConstInt(types.I32, 7))
+	trap := b.DeclareFunction("llvm.trap", types.Void, nil, false)
+
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
+	fail := b.CreateBlock("fail")
+	ok := b.CreateBlock("ok")
+
 	b.SetInsertPoint(entry)
-	
-	// Allocate space for an i32
-	ptr := b.CreateAlloca(types.I32, "ptr")
-	
-	// Store 99 into it
-	b.CreateStore(b.ConstInt(types.I32, 99), ptr)
-	
-	// Load it back
-	loaded := b.CreateLoad(types.I32, ptr, "loaded")
-	
-	b.CreateRet(loaded)
-	
+	i := b.CreateLoad(types.I32, index, "i")
+	b.CreateCondBr(b.CreateICmpULT(i, b.ConstInt(types.I32, 4), "inbounds"), ok, fail)
+
+	b.SetInsertPoint(fail)
+	b.CreateCall(trap, nil, "")
+	b.CreateUnreachable()
+
+	b.SetInsertPoint(ok)
+	b.CreateRet(b.ConstInt(types.I32, 0))
+
 	return m
 }
 
-func buildPointerArithmetic(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("pointer_arithmetic")
-	
+// llvm.debugtrap is a breakpoint; with no debugger attached it kills the
+// program with SIGTRAP
+func buildDebugTrap(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("debugtrap")
+	debugtrap := b.DeclareFunction("llvm.debugtrap", types.Void, nil, false)
+
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	// Create array of 5 elements: [1, 2, 3, 4, 5]
-	arrayType := types.NewArray(types.I32, 5)
-	arrayPtr := b.CreateAlloca(arrayType, "array")
-	
-	// Store values: array[2] = 15
-	idx := b.ConstInt(types.I32, 2)
-	elemPtr := b.CreateGEP(arrayType, arrayPtr, []ir.Value{b.ConstInt(types.I32, 0), idx}, "elem_ptr")
-	b.CreateStore(b.ConstInt(types.I32, 15), elemPtr)
-	
-	// Load it back
-	loaded := b.CreateLoad(types.I32, elemPtr, "loaded")
-	
-	b.CreateRet(loaded)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateCall(debugtrap, nil, "")
+	b.CreateRet(b.ConstInt(types.I32, 0))
+
 	return m
 }
 
-func buildStructOps(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("struct_ops")
-	
-	// Define struct { i32, i32 }
-	structType := types.NewStruct("", []types.Type{types.I32, types.I32}, false)
-	
+// if (a < b) return 42; return 1; with the fall-through laid out first
+func buildCompareBranch(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("compare_branch")
+	ga := b.CreateGlobal("a", types.I32, b.ConstInt(types.I32, -3))
+	gb := b.CreateGlobal("b", types.I32, b.ConstInt(types.I32, 5))
+
 	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
+	otherwise := b.CreateBlock("otherwise")
+	less := b.CreateBlock("less")
+
 	b.SetInsertPoint(entry)
-	
-	// Allocate struct
-	structPtr := b.CreateAlloca(structType, "s")
-	
-	// Get pointer to second field
-	field1Ptr := b.CreateGEP(structType, structPtr, 
-		[]ir.Value{b.ConstInt(types.I32, 0), b.ConstInt(types.I32, 1)}, "field1_ptr")
-	
-	// Store 42 in second field
-	b.CreateStore(b.ConstInt(types.I32, 42), field1Ptr)
-	
-	// Load it back
-	loaded := b.CreateLoad(types.I32, field1Ptr, "loaded")
-	
-	b.CreateRet(loaded)
-	
+	x := b.CreateLoad(types.I32, ga, "x")
+	y := b.CreateLoad(types.I32, gb, "y")
+	b.CreateCondBr(b.CreateICmpSLT(x, y, "lt"), less, otherwise)
+
+	b.SetInsertPoint(otherwise)
+	b.CreateRet(b.ConstInt(types.I32, 1))
+
+	b.SetInsertPoint(less)
+	b.CreateRet(b.ConstInt(types.I32, 42))
+
 	return m
 }
 
-func buildArrayOps(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("array_ops")
-	
+// {i32, [3 x i32]} filled with insertvalue, read back through indices
+// that cross from the struct into the array
+func buildNestedExtract(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("nested_extract")
+	s := types.NewStruct("", []types.Type{types.I32, types.NewArray(types.I32, 3)}, false)
+
 	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	var agg ir.Value = b.ConstUndef(s)
+	agg = b.CreateInsertValue(agg, b.ConstInt(types.I32, 5), []int{0}, "s")
+	for i, v := range []int64{2, 3, 4} {
+		agg = b.CreateInsertValue(agg, b.ConstInt(types.I32, v), []int{1, i}, "s")
+	}
+
+	last := b.CreateExtractValue(agg, []int{1, 2}, "last")
+	head := b.CreateExtractValue(agg, []int{0}, "head")
+	first := b.CreateExtractValue(agg, []int{1, 0}, "first")
+	r := b.CreateAdd(b.CreateMul(last, b.ConstInt(types.I32, 10), "m"), head, "r")
+	b.CreateRet(b.CreateAdd(r, first, "r"))
+
+	return m
+}
+
+// float f(float a, double b) { return a * 2.5f + (float)b; }
+// double mix(double a, float b, double c, float d) { return a*b + c*d; }
+// float stored(void) { float v; v = 0.1f; return v; }
+func buildFloatSignatures(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("float_signatures")
+
+	f := b.CreateFunction("f", types.F32, []types.Type{types.F32, types.F64}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	scaled := b.CreateFMul(f.Arguments[0], b.ConstFloat(types.F32, 2.5), "scaled")
+	narrow := b.CreateFPTrunc(f.Arguments[1], types.F32, "narrow")
+	b.CreateRet(b.CreateFAdd(scaled, narrow, "r"))
+
+	mix := b.CreateFunction("mix", types.F64, []types.Type{types.F64, types.F32, types.F64, types.F32}, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	ab := b.CreateFMul(mix.Arguments[0], b.CreateFPExt(mix.Arguments[1], types.F64, "bw"), "ab")
+	cd := b.CreateFMul(mix.Arguments[2], b.CreateFPExt(mix.Arguments[3], types.F64, "dw"), "cd")
+	b.CreateRet(b.CreateFAdd(ab, cd, "r"))
+
+	b.CreateFunction("stored", types.F32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	slot := b.CreateAlloca(types.F32, "v")
+	b.CreateStore(b.ConstFloat(types.F32, 0.1), slot)
+	b.CreateRet(b.CreateLoad(types.F32, slot, "r"))
+
+	return m
+}
+
+// A switch over -1..4 with a hole at 3, dense enough for a jump table.
+// Every case returns a different bit; the hole and values out of range
+// either way return the default's 3.
+func buildDenseSwitch(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("dense_switch")
+	classify := b.CreateFunction("classify", types.I32, []types.Type{types.I32}, false)
 	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	// Array: [5, 10, 15, 20]
-	arrayType := types.NewArray(types.I32, 4)
-	arrayPtr := b.CreateAlloca(arrayType, "array")
-	
-	// Initialize array elements
-	for i := 0; i < 4; i++ {
-		elemPtr := b.CreateGEP(arrayType, arrayPtr, 
-			[]ir.Value{b.ConstInt(types.I32, 0), b.ConstInt(types.I32, int64(i))}, 
-			fmt.Sprintf("elem%d_ptr", i))
-		b.CreateStore(b.ConstInt(types.I32, int64((i+1)*5)), elemPtr)
+	def := b.CreateBlock("default")
+	b.SetInsertPoint(def)
+	b.CreateRet(b.ConstInt(types.I32, 3))
+
+	x := classify.Arguments[0]
+	sw := &ir.SwitchInst{
+		BaseInstruction: ir.BaseInstruction{
+			Op:  ir.OpSwitch,
+			Ops: []ir.Value{x},
+		},
+		Condition:    x,
+		DefaultBlock: def,
 	}
-	
-	// Load element at index 1 (should be 10)
-	elem1Ptr := b.CreateGEP(arrayType, arrayPtr, 
-		[]ir.Value{b.ConstInt(types.I32, 0), b.ConstInt(types.I32, 1)}, "elem1_ptr")
-	result := b.CreateLoad(types.I32, elem1Ptr, "result")
-	
-	b.CreateRet(result)
-	
+	for i, v := range []int64{-1, 0, 1, 2, 4} {
+		block := b.CreateBlock(fmt.Sprintf("case%d", i))
+		b.SetInsertPoint(block)
+		b.CreateRet(b.ConstInt(types.I32, 1<<i))
+		sw.Cases = append(sw.Cases, ir.SwitchCase{Value: b.ConstInt(types.I32, v), Block: block})
+	}
+	entry.AddInstruction(sw)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	var sum ir.Value = b.ConstInt(types.I32, 0)
+	for _, v := range []int64{-1, 0, 1, 2, 3, 4, 100, -50} {
+		r := b.CreateCall(classify, []ir.Value{b.ConstInt(types.I32, v)}, "r")
+		sum = b.CreateAdd(sum, r, "sum")
+	}
+	b.CreateRet(sum)
+
 	return m
 }
 
-func buildCastingOps(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("casting_ops")
-	
+// Calls functions supplied as assembly, one of which calls back into IR
+func buildAsmCaller(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("asm_caller")
+	sig := []types.Type{types.I32}
+	bump := b.DeclareFunction("bump", types.I32, sig, false)
+	sumTo := b.DeclareFunction("sum_to", types.I32, sig, false)
+	triple := b.DeclareFunction("triple", types.I32, sig, false)
+
+	twice := b.CreateFunction("twice", types.I32, sig, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	b.CreateRet(b.CreateAdd(twice.Arguments[0], twice.Arguments[0], "r"))
+
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	b.SetInsertPoint(entry)
-	
-	// Start with i64 value
-	val64 := b.ConstInt(types.I64, 42)
-	
-	// Truncate to i32
-	val32 := b.CreateTrunc(val64, types.I32, "val32")
-	
-	// Extend back to i64
-	val64Again := b.CreateSExt(val32, types.I64, "val64_again")
-	
-	// Truncate back to i32 for return
-	result := b.CreateTrunc(val64Again, types.I32, "result")
-	
-	b.CreateRet(result)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	s := b.CreateCall(sumTo, []ir.Value{b.ConstInt(types.I32, 4)}, "s")
+	n := b.CreateCall(bump, []ir.Value{s}, "n")
+	t := b.CreateCall(triple, []ir.Value{n}, "t")
+	b.CreateRet(b.CreateAdd(t, b.ConstInt(types.I32, 9), "r"))
+
 	return m
 }
 
-func buildComplexPhi(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("complex_phi")
-	
+// Shifts an array of five i32s up by one element and then back down, with
+// the length loaded at run time, and three bytes of an i8 array up by one
+// with a constant length. Each move's source and destination overlap.
+func buildMemmoveOverlap(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("memmove_overlap")
+	size := b.CreateGlobal("size", types.I64, b.ConstInt(types.I64, 16))
+	ptr := types.NewPointer(types.I8)
+	memmove := b.DeclareFunction("llvm.memmove.p0.p0.i64", types.Void,
+		[]types.Type{ptr, ptr, types.I64, types.I1}, false)
+
 	b.CreateFunction("main", types.I32, nil, false)
-	entry := b.CreateBlock("entry")
-	path1 := b.CreateBlock("path1")
-	path2 := b.CreateBlock("path2")
-	path3 := b.CreateBlock("path3")
-	merge := b.CreateBlock("merge")
-	
-	b.SetInsertPoint(entry)
-	selector := b.ConstInt(types.I32, 2)
-	
-	// Branch based on selector
-	cond1 := b.CreateICmpEQ(selector, b.ConstInt(types.I32, 1), "cond1")
-	branch1 := b.CreateBlock("branch1")
-	b.CreateCondBr(cond1, path1, branch1)
-	
-	b.SetInsertPoint(branch1)
-	cond2 := b.CreateICmpEQ(selector, b.ConstInt(types.I32, 2), "cond2")
-	b.CreateCondBr(cond2, path2, path3)
-	
-	b.SetInsertPoint(path1)
-	val1 := b.ConstInt(types.I32, 5)
-	b.CreateBr(merge)
-	
-	b.SetInsertPoint(path2)
-	val2 := b.ConstInt(types.I32, 15)
-	b.CreateBr(merge)
-	
-	b.SetInsertPoint(path3)
-	val3 := b.ConstInt(types.I32, 25)
-	b.CreateBr(merge)
-	
-	b.SetInsertPoint(merge)
-	phi := b.CreatePhi(types.I32, "result")
-	phi.AddIncoming(val1, path1)
-	phi.AddIncoming(val2, path2)
-	phi.AddIncoming(val3, path3)
-	b.CreateRet(phi)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	words := types.NewArray(types.I32, 5)
+	a := b.CreateAlloca(words, "a")
+	elem := func(i int64) ir.Value {
+		return b.CreateGEP(words, a, []ir.Value{b.ConstInt(types.I32, 0), b.ConstInt(types.I32, i)}, "e")
+	}
+	for i := int64(0); i < 5; i++ {
+		b.CreateStore(b.ConstInt(types.I32, i+1), elem(i))
+	}
+	n := b.CreateLoad(types.I64, size, "n")
+	b.CreateCall(memmove, []ir.Value{elem(1), elem(0), n, b.ConstInt(types.I1, 0)}, "")
+	b.CreateCall(memmove, []ir.Value{elem(0), elem(1), n, b.ConstInt(types.I1, 0)}, "")
+
+	// 1, 2, 3, 4, 4 weighted by 1, 2, 4, 8, 16
+	var sum ir.Value = b.ConstInt(types.I32, 0)
+	for i := int64(0); i < 5; i++ {
+		v := b.CreateLoad(types.I32, elem(i), "v")
+		sum = b.CreateAdd(sum, b.CreateMul(v, b.ConstInt(types.I32, 1<<i), "w"), "sum")
+	}
+
+	bytes4 := types.NewArray(types.I8, 4)
+	c := b.CreateAlloca(bytes4, "c")
+	byteAt := func(i int64) ir.Value {
+		return b.CreateGEP(bytes4, c, []ir.Value{b.ConstInt(types.I32, 0), b.ConstInt(types.I32, i)}, "b")
+	}
+	for i := int64(0); i < 4; i++ {
+		b.CreateStore(b.ConstInt(types.I8, 10*(i+1)), byteAt(i))
+	}
+	b.CreateCall(memmove, []ir.Value{byteAt(1), byteAt(0), b.ConstInt(types.I64, 3), b.ConstInt(types.I1, 0)}, "")
+	// 10, 10, 20, 30: the last two differ by 10
+	hi := b.CreateZExt(b.CreateLoad(types.I8, byteAt(3), "hi"), types.I32, "hi32")
+	lo := b.CreateZExt(b.CreateLoad(types.I8, byteAt(2), "lo"), types.I32, "lo32")
+	b.CreateRet(b.CreateAdd(sum, b.CreateSub(hi, lo, "d"), "r"))
+
 	return m
 }
 
-func buildEarlyReturn(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("early_return")
-	
+// ptrtoint and inttoptr with integers narrower than a pointer: an i32 -1
+// becomes a pointer with the high half clear, and a pointer converted to
+// i32 or i8 keeps only its low bits
+func buildPointerIntWidths(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("pointer_int_widths")
+	ptr := types.NewPointer(types.I8)
+
 	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+
+	// inttoptr zero-extends: the pointer's high 32 bits are 0
+	p := b.CreateIntToPtr(b.ConstInt(types.I32, -1), ptr, "p")
+	hi := b.CreateLShr(b.CreatePtrToInt(p, types.I64, "p64"), b.ConstInt(types.I64, 32), "hi")
+	hiClear := b.CreateICmpEQ(hi, b.ConstInt(types.I64, 0), "hi_clear")
+
+	// ptrtoint to i32 matches the low half of the full address
+	x := b.CreateAlloca(types.I64, "x")
+	low := b.CreateZExt(b.CreatePtrToInt(x, types.I32, "x32"), types.I64, "low")
+	full := b.CreatePtrToInt(x, types.I64, "x64")
+	masked := b.CreateZExt(b.CreateTrunc(full, types.I32, "t"), types.I64, "masked")
+	lowMatch := b.CreateICmpEQ(low, masked, "low_match")
+
+	// ptrtoint to i8 keeps the last byte: 0x34
+	q := b.CreateIntToPtr(b.ConstInt(types.I64, 0x1234), ptr, "q")
+	tail := b.CreateZExt(b.CreatePtrToInt(q, types.I8, "q8"), types.I32, "tail")
+
+	r := b.CreateAdd(
+		b.CreateSelect(hiClear, b.ConstInt(types.I32, 10), b.ConstInt(types.I32, 0), "a"),
+		b.CreateSelect(lowMatch, b.ConstInt(types.I32, 30), b.ConstInt(types.I32, 0), "b"), "ab")
+	b.CreateRet(b.CreateAdd(r, b.CreateSub(tail, b.ConstInt(types.I32, 0x32), "c"), "r"))
+
+	return m
+}
+
+// A range check whose failure path is marked cold. Out of range indices
+// take it and get i + 15; in range ones get i * 10.
+func buildColdPath(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("cold_path")
+	check := b.CreateFunction("check", types.I32, []types.Type{types.I32}, false)
 	entry := b.CreateBlock("entry")
-	earlyExit := b.CreateBlock("early_exit")
-	normalPath := b.CreateBlock("normal_path")
-	
+	fail := b.CreateBlock("fail")
+	ok := b.CreateBlock("ok")
+	done := b.CreateBlock("done")
+	fail.Metadata = map[string]string{"cold": ""}
+
+	i := check.Arguments[0]
 	b.SetInsertPoint(entry)
-	value := b.ConstInt(types.I32, 5)
-	cond := b.CreateICmpSLT(value, b.ConstInt(types.I32, 10), "cond")
-	b.CreateCondBr(cond, earlyExit, normalPath)
-	
-	b.SetInsertPoint(earlyExit)
-	b.CreateRet(value)
-	
-	b.SetInsertPoint(normalPath)
-	b.CreateRet(b.ConstInt(types.I32, 100))
-	
+	b.CreateCondBr(b.CreateICmpULT(i, b.ConstInt(types.I32, 4), "in_range"), ok, fail)
+
+	b.SetInsertPoint(fail)
+	bad := b.CreateAdd(i, b.ConstInt(types.I32, 15), "bad")
+	b.CreateBr(done)
+
+	b.SetInsertPoint(ok)
+	good := b.CreateMul(i, b.ConstInt(types.I32, 10), "good")
+	b.CreateBr(done)
+
+	b.SetInsertPoint(done)
+	r := b.CreatePhi(types.I32, "r")
+	r.AddIncoming(bad, fail)
+	r.AddIncoming(good, ok)
+	b.CreateRet(r)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	x := b.CreateCall(check, []ir.Value{b.ConstInt(types.I32, 2)}, "x")
+	y := b.CreateCall(check, []ir.Value{b.ConstInt(types.I32, 7)}, "y")
+	b.CreateRet(b.CreateAdd(x, y, "sum"))
+
 	return m
 }
 
-func buildMaxFunction(b *builder.Builder) *ir.Module {
-	m := b.CreateModule("max_function")
-	
-	// max(a, b) function
-	maxFn := b.CreateFunction("max", types.I32, []types.Type{types.I32, types.I32}, false)
-	maxFn.Arguments[0].SetName("a")
-	maxFn.Arguments[1].SetName("b")
-	
+// llvm.fma where a*b+c rounded twice gives 0: (1+e)(1-e) = 1-e*e rounds to
+// 1 on its own, so only a fused multiply-add keeps the -e*e
+func buildFMA(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("fma")
+	fma64 := b.DeclareFunction("llvm.fma.f64", types.F64, []types.Type{types.F64, types.F64, types.F64}, false)
+	fma32 := b.DeclareFunction("llvm.fma.f32", types.F32, []types.Type{types.F32, types.F32, types.F32}, false)
+
+	b.CreateFunction("main", types.I32, nil, false)
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	fused := func(fn *ir.Function, t types.Type, e float64) ir.Value {
+		r := b.CreateCall(fn, []ir.Value{
+			b.ConstFloat(t, 1+e), b.ConstFloat(t, 1-e), b.ConstFloat(t, -1),
+		}, "r")
+		return b.CreateFCmp(ir.FCmpOEQ, r, b.ConstFloat(t, -e*e), "exact")
+	}
+	d := fused(fma64, types.F64, 0x1p-27)
+	f := fused(fma32, types.F32, 0x1p-13)
+	r := b.CreateAdd(
+		b.CreateSelect(d, b.ConstInt(types.I32, 40), b.ConstInt(types.I32, 0), "d"),
+		b.CreateSelect(f, b.ConstInt(types.I32, 2), b.ConstInt(types.I32, 0), "f"), "r")
+	b.CreateRet(r)
+
+	return m
+}
+
+// An empty block serving only as a phi predecessor. It falls through to
+// the next block in IR order even though the branch weights lay it out
+// last, after a second empty block that nothing reaches.
+func buildEmptyBlock(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("empty_block")
+	flag := b.CreateGlobal("flag", types.I32, b.ConstInt(types.I32, 1))
+
+	b.CreateFunction("main", types.I32, nil, false)
 	entry := b.CreateBlock("entry")
-	thenBlock := b.CreateBlock("then")
-	elseBlock := b.CreateBlock("else")
+	empty := b.CreateBlock("empty")
 	merge := b.CreateBlock("merge")
-	
+	b.CreateBlock("dead")
+
 	b.SetInsertPoint(entry)
-	a := maxFn.Arguments[0]
-	b2 := maxFn.Arguments[1]
-	cond := b.CreateICmpSGT(a, b2, "cond")
-	b.CreateCondBr(cond, thenBlock, elseBlock)
-	
-	b.SetInsertPoint(thenBlock)
-	b.CreateBr(merge)
-	
-	b.SetInsertPoint(elseBlock)
-	b.CreateBr(merge)
-	
+	set := b.CreateICmpNE(b.CreateLoad(types.I32, flag, "f"), b.ConstInt(types.I32, 0), "set")
+	br := b.CreateCondBr(set, empty, merge)
+	br.TrueWeight, br.FalseWeight = 1, 100
+
 	b.SetInsertPoint(merge)
-	phi := b.CreatePhi(types.I32, "result")
-	phi.AddIncoming(a, thenBlock)
-	phi.AddIncoming(b2, elseBlock)
-	b.CreateRet(phi)
-	
-	// main function
+	r := b.CreatePhi(types.I32, "r")
+	r.AddIncoming(b.ConstInt(types.I32, 10), entry)
+	r.AddIncoming(b.ConstInt(types.I32, 42), empty)
+	b.CreateRet(r)
+
+	return m
+}
+
+// A 4.8MB array of structs whose last element is reached through two GEPs
+// with byte offsets of -8GB and +8GB, beyond a 32-bit displacement
+func buildLargeGEPOffsets(b *builder.Builder) *ir.Module {
+	m := b.CreateModule("gep_large_offsets")
+	elem := types.NewStruct("", []types.Type{types.I64, types.I32}, false)
+	arrType := types.NewArray(elem, 300000)
+	arr := b.CreateGlobal("arr", arrType, b.ConstZero(arrType))
+
 	b.CreateFunction("main", types.I32, nil, false)
-	mainEntry := b.CreateBlock("entry")
-	b.SetInsertPoint(mainEntry)
-	
-	result := b.CreateCall(maxFn, []ir.Value{b.ConstInt(types.I32, 88), b.ConstInt(types.I32, 42)}, "max_result")
-	b.CreateRet(result)
-	
+	b.SetInsertPoint(b.CreateBlock("entry"))
+	field := func(base ir.Value) ir.Value {
+		return b.CreateGEP(arrType, base, []ir.Value{
+			b.ConstInt(types.I64, 0), b.ConstInt(types.I64, 299999), b.ConstInt(types.I32, 1),
+		}, "field")
+	}
+	b.CreateStore(b.ConstInt(types.I32, 42), field(arr))
+
+	below := b.CreateGEP(types.I8, arr, []ir.Value{b.ConstInt(types.I64, -1<<33)}, "below")
+	back := b.CreateGEP(types.I8, below, []ir.Value{b.ConstInt(types.I64, 1<<33)}, "back")
+	b.CreateRet(b.CreateLoad(types.I32, field(back), "r"))
+
 	return m
-}
\ No newline at end of file
+}
@@ -0,0 +1,227 @@
+package elf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Program header types and flags
+const (
+	PT_NULL      = 0
+	PT_LOAD      = 1
+	PT_DYNAMIC   = 2
+	PT_INTERP    = 3
+	PT_PHDR      = 6
+	PT_GNU_STACK = 0x6474e551
+
+	PF_X = 0x1
+	PF_W = 0x2
+	PF_R = 0x4
+)
+
+// Dynamic section tags and flags
+const (
+	DT_NULL     = 0
+	DT_NEEDED   = 1
+	DT_PLTRELSZ = 2
+	DT_PLTGOT   = 3
+	DT_HASH     = 4
+	DT_STRTAB   = 5
+	DT_SYMTAB   = 6
+	DT_RELA     = 7
+	DT_RELASZ   = 8
+	DT_RELAENT  = 9
+	DT_STRSZ    = 10
+	DT_SYMENT   = 11
+	DT_PLTREL   = 20
+	DT_DEBUG    = 21
+	DT_JMPREL   = 23
+	DT_FLAGS    = 30
+	DT_FLAGS_1  = 0x6ffffffb
+
+	DF_BIND_NOW = 0x8 // In DT_FLAGS
+	DF_1_NOW    = 0x1 // In DT_FLAGS_1
+)
+
+// PageSize is the alignment of loadable segments. The loader maps each
+// segment a page at a time, so a segment's file offset and address must
+// agree modulo PageSize.
+const PageSize = 0x1000
+
+// Executable is an ELF64 executable: the program headers describing its
+// segments and the segments' contents. It has no section headers, which
+// only tools other than the loader read.
+type Executable struct {
+	Machine  uint16
+	Entry    uint64
+	Segments []*Segment
+
+	// Headers describe parts of the segments to the loader, such as the
+	// PT_INTERP and PT_DYNAMIC of a dynamically linked executable. They
+	// come before the PT_LOAD headers, as PT_PHDR and PT_INTERP must.
+	Headers []ProgramHeader
+}
+
+// ProgramHeader is a program header other than PT_LOAD, for the Size
+// bytes at Vaddr, which must lie within a segment's data
+type ProgramHeader struct {
+	Type  uint32
+	Flags uint32
+	Vaddr uint64
+	Size  uint64
+	Align uint64
+}
+
+// Segment is a PT_LOAD segment: Data loaded at Vaddr, then zeros up to
+// MemSize (the .bss). A zero MemSize means len(Data).
+type Segment struct {
+	Vaddr   uint64
+	Flags   uint32 // PF_R, PF_W and PF_X
+	Data    []byte
+	MemSize uint64
+}
+
+// HeaderSize is the size of the ELF header and program headers, which
+// come first in the file. Together with the segments' program headers
+// and Headers there is a PT_GNU_STACK one, asking for a non-executable
+// stack.
+func (e *Executable) HeaderSize() uint64 {
+	return 64 + 56*uint64(len(e.Segments)+len(e.Headers)+1) // Elf64_Ehdr, Elf64_Phdr
+}
+
+// WriteTo writes the executable. Each segment's data goes at the first
+// file offset after what precedes it that is congruent to its address
+// modulo PageSize. Segments must be in address order and not share a
+// page, since the loader could only give a shared page one protection.
+//
+// The first segment is mapped from the start of the file, so the headers
+// are loaded below its data, in the same page. The kernel gives the
+// program their address only when a segment maps them, and a dynamic
+// linker reads them there.
+func (e *Executable) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := e.writeTo(cw)
+	return cw.n, err
+}
+
+// countingWriter tallies the bytes passed through to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (e *Executable) writeTo(w io.Writer) error {
+	offsets := make([]uint64, len(e.Segments))
+	pos := e.HeaderSize()
+	var prevEnd uint64
+	for i, seg := range e.Segments {
+		memSize := max(seg.MemSize, uint64(len(seg.Data)))
+		if i > 0 && seg.Vaddr < (prevEnd+PageSize-1)&^(PageSize-1) {
+			return fmt.Errorf("segment at %#x shares a page with the one before it", seg.Vaddr)
+		}
+		prevEnd = seg.Vaddr + memSize
+
+		pos += (seg.Vaddr - pos) % PageSize
+		offsets[i] = pos
+		pos += uint64(len(seg.Data))
+	}
+
+	var ident [EI_NIDENT]byte
+	ident[EI_MAG0] = ELFMAG0
+	ident[1] = ELFMAG1
+	ident[2] = ELFMAG2
+	ident[3] = ELFMAG3
+	ident[EI_CLASS] = ELFCLASS64
+	ident[EI_DATA] = ELFDATA2LSB
+	ident[EI_VERSION] = EV_CURRENT
+
+	hdr := elfHeader{
+		Ident:     ident,
+		Type:      ET_EXEC,
+		Machine:   e.Machine,
+		Version:   EV_CURRENT,
+		Entry:     e.Entry,
+		Phoff:     64,
+		Ehsize:    64,
+		Phentsize: 56,
+		Phnum:     uint16(len(e.Segments) + len(e.Headers) + 1),
+	}
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, hdr)
+
+	for _, ph := range e.Headers {
+		offset, ok := uint64(0), false
+		for i, seg := range e.Segments {
+			// The first segment's file image starts with the headers
+			start, end := seg.Vaddr, seg.Vaddr+uint64(len(seg.Data))
+			if i == 0 {
+				start -= offsets[0]
+			}
+			if ph.Vaddr >= start && ph.Vaddr+ph.Size <= end {
+				offset, ok = offsets[i]+ph.Vaddr-seg.Vaddr, true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("program header type %#x at %#x is not in a segment", ph.Type, ph.Vaddr)
+		}
+		binary.Write(buf, binary.LittleEndian, elfProgramHeader{
+			Type:   ph.Type,
+			Flags:  ph.Flags,
+			Offset: offset,
+			Vaddr:  ph.Vaddr,
+			Paddr:  ph.Vaddr,
+			Filesz: ph.Size,
+			Memsz:  ph.Size,
+			Align:  ph.Align,
+		})
+	}
+	for i, seg := range e.Segments {
+		// The first segment reaches down to the file's start
+		below := uint64(0)
+		if i == 0 {
+			below = offsets[0]
+		}
+		binary.Write(buf, binary.LittleEndian, elfProgramHeader{
+			Type:   PT_LOAD,
+			Flags:  seg.Flags,
+			Offset: offsets[i] - below,
+			Vaddr:  seg.Vaddr - below,
+			Paddr:  seg.Vaddr - below,
+			Filesz: uint64(len(seg.Data)) + below,
+			Memsz:  max(seg.MemSize, uint64(len(seg.Data))) + below,
+			Align:  PageSize,
+		})
+	}
+	binary.Write(buf, binary.LittleEndian, elfProgramHeader{
+		Type:  PT_GNU_STACK,
+		Flags: PF_R | PF_W,
+		Align: 16,
+	})
+
+	for i, seg := range e.Segments {
+		buf.Write(make([]byte, offsets[i]-uint64(buf.Len())))
+		buf.Write(seg.Data)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+type elfProgramHeader struct {
+	Type   uint32
+	Flags  uint32
+	Offset uint64
+	Vaddr  uint64
+	Paddr  uint64
+	Filesz uint64
+	Memsz  uint64
+	Align  uint64
+}
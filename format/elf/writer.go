@@ -2,7 +2,9 @@ package elf
 
 import (
 	"bytes"
+	"compress/zlib"
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
@@ -16,11 +18,19 @@ const (
 	ELFMAG2     = 'L'
 	ELFMAG3     = 'F'
 	EI_CLASS    = 4
+	ELFCLASS32  = 1
 	ELFCLASS64  = 2
 	EI_DATA     = 5
 	ELFDATA2LSB = 1
+	ELFDATA2MSB = 2
 	EI_VERSION  = 6
 	EV_CURRENT  = 1
+	EI_OSABI    = 7
+
+	// OS ABIs
+	ELFOSABI_NONE    = 0 // System V
+	ELFOSABI_GNU     = 3
+	ELFOSABI_FREEBSD = 9
 
 	// Object file types
 	ET_NONE = 0
@@ -30,6 +40,7 @@ const (
 	ET_CORE = 4
 
 	// Machine types
+	EM_386    = 3
 	EM_X86_64 = 62
 
 	// Section types
@@ -45,12 +56,17 @@ const (
 	SHT_REL      = 9
 
 	// Section flags
-	SHF_WRITE     = 0x1
-	SHF_ALLOC     = 0x2
-	SHF_EXECINSTR = 0x4
-	SHF_MERGE     = 0x10
-	SHF_STRINGS   = 0x20
-	SHF_INFO_LINK = 0x40
+	SHF_WRITE      = 0x1
+	SHF_ALLOC      = 0x2
+	SHF_EXECINSTR  = 0x4
+	SHF_MERGE      = 0x10
+	SHF_STRINGS    = 0x20
+	SHF_INFO_LINK  = 0x40
+	SHF_TLS        = 0x400
+	SHF_COMPRESSED = 0x800
+
+	// Compression formats of SHF_COMPRESSED sections
+	ELFCOMPRESS_ZLIB = 1
 
 	// Symbol binding
 	STB_LOCAL  = 0
@@ -73,8 +89,9 @@ const (
 	STV_PROTECTED = 3
 
 	// Special section indices
-	SHN_UNDEF = 0
-	SHN_ABS   = 0xfff1
+	SHN_UNDEF  = 0
+	SHN_ABS    = 0xfff1
+	SHN_COMMON = 0xfff2 // The symbol's value is its alignment
 
 	// Relocation types for x86-64
 	R_X86_64_NONE   = 0
@@ -83,15 +100,32 @@ const (
 	R_X86_64_GOT32  = 3
 	R_X86_64_PLT32  = 4
 	R_X86_64_COPY   = 5
+	R_X86_64_GOTPCREL = 9
 	R_X86_64_32     = 10
 	R_X86_64_32S    = 11
 	R_X86_64_16     = 12
 	R_X86_64_PC16   = 13
 	R_X86_64_8      = 14
 	R_X86_64_PC8    = 15
+	R_X86_64_TLSGD  = 19
+	R_X86_64_TPOFF32 = 23
 	R_X86_64_PC64   = 24
 )
 
+// Note types in the "GNU" namespace
+const (
+	NT_GNU_BUILD_ID        = 3
+	NT_GNU_PROPERTY_TYPE_0 = 5
+)
+
+// x86 program properties, in an NT_GNU_PROPERTY_TYPE_0 note. The linker
+// ANDs the feature bits of all its inputs, so an output claims a feature
+// only if every object does.
+const (
+	GNU_PROPERTY_X86_FEATURE_1_AND = 0xc0000002
+	GNU_PROPERTY_X86_FEATURE_1_IBT = 0x1
+)
+
 // File represents an ELF object file
 type File struct {
 	Sections     []*Section
@@ -100,6 +134,10 @@ type File struct {
 	ShStrTab     *StringTable
 	DataLayout   string
 	Machine      uint16
+	Class        byte       // ELFCLASS32 or ELFCLASS64
+	Data         byte       // ELFDATA2LSB or ELFDATA2MSB
+	OSABI        byte       // e_ident[EI_OSABI]; ELFOSABI_NONE (System V) by default
+	Flags        uint32     // e_flags, which x86 leaves 0 and others define per target
 	RelaSections []*Section // Track rela sections for link fixup
 }
 
@@ -109,12 +147,17 @@ type Section struct {
 	Type      uint32
 	Flags     uint64
 	Addr      uint64
-	Addralign uint64
-	Entsize   uint64
+	Addralign uint64 // 0 means 1; otherwise a power of two
+	Entsize   uint64 // Size of each entry of a table; 0 fills in the standard sizes
 	Link      uint32
 	Info      uint32
 	Content   []byte
 
+	// Compress stores Content zlib-compressed behind a compression
+	// header, and sets SHF_COMPRESSED. Only sections that aren't loaded,
+	// such as .debug_*, can be compressed.
+	Compress bool
+
 	// Internal
 	Index    uint16
 	nameIdx  uint32
@@ -128,6 +171,7 @@ type Symbol struct {
 	Info    byte // Binding (high 4 bits) | Type (low 4 bits)
 	Other   byte // Visibility
 	Section *Section
+	Shndx   uint16 // Special section index (SHN_ABS, SHN_COMMON) used when Section is nil
 	Value   uint64
 	Size    uint64
 
@@ -146,8 +190,9 @@ type Relocation struct {
 
 // StringTable manages string storage
 type StringTable struct {
-	Data []byte
-	strs map[string]uint32 // Deduplication
+	Data      []byte
+	strs      map[string]uint32 // Deduplication
+	tailMerge bool              // Reuse suffixes of existing strings
 }
 
 func NewStringTable() *StringTable {
@@ -157,6 +202,15 @@ func NewStringTable() *StringTable {
 	}
 }
 
+// NewMergeStringTable creates a string table that also tail-merges, the way
+// SHF_MERGE|SHF_STRINGS sections are merged by the linker: adding "bar"
+// after "foobar" returns the offset of the "bar" inside "foobar".
+func NewMergeStringTable() *StringTable {
+	st := NewStringTable()
+	st.tailMerge = true
+	return st
+}
+
 func (st *StringTable) Add(s string) uint32 {
 	if s == "" {
 		return 0
@@ -167,6 +221,15 @@ func (st *StringTable) Add(s string) uint32 {
 		return idx
 	}
 
+	// Any occurrence of s followed by a NUL is the tail of a stored string
+	if st.tailMerge {
+		if pos := bytes.Index(st.Data, append([]byte(s), 0)); pos >= 0 {
+			idx := uint32(pos)
+			st.strs[s] = idx
+			return idx
+		}
+	}
+
 	idx := uint32(len(st.Data))
 	st.Data = append(st.Data, []byte(s)...)
 	st.Data = append(st.Data, 0)
@@ -180,6 +243,8 @@ func NewFile() *File {
 		StrTab:   NewStringTable(),
 		ShStrTab: NewStringTable(),
 		Machine:  EM_X86_64,
+		Class:    ELFCLASS64,
+		Data:     ELFDATA2LSB,
 	}
 
 	// Section 0 is always the null section
@@ -191,6 +256,19 @@ func NewFile() *File {
 	return f
 }
 
+// byteOrder returns the encoding selected by f.Data
+func (f *File) byteOrder() binary.ByteOrder {
+	if f.Data == ELFDATA2MSB {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// is32 reports whether the file uses the 32-bit (ELFCLASS32) layouts
+func (f *File) is32() bool {
+	return f.Class == ELFCLASS32
+}
+
 // AddSection adds a new section
 func (f *File) AddSection(name string, typ uint32, flags uint64, content []byte) *Section {
 	s := &Section{
@@ -205,6 +283,54 @@ func (f *File) AddSection(name string, typ uint32, flags uint64, content []byte)
 	return s
 }
 
+// AddStringSection adds a mergeable string section (SHF_MERGE|SHF_STRINGS)
+// holding the given NUL-terminated strings. Like the toolchain's .comment,
+// the content starts with an empty string so offset 0 is always "".
+func (f *File) AddStringSection(name string, flags uint64, strs []string) *Section {
+	st := NewMergeStringTable()
+	for _, s := range strs {
+		st.Add(s)
+	}
+
+	s := f.AddSection(name, SHT_PROGBITS, flags|SHF_MERGE|SHF_STRINGS, st.Data)
+	s.Entsize = 1
+	s.Addralign = 1
+	return s
+}
+
+// AddNoteSection adds an allocated SHT_NOTE section holding one note:
+// namesz, descsz and type words, then the NUL-terminated owner name and
+// the descriptor, each padded to four bytes
+func (f *File) AddNoteSection(name, owner string, noteType uint32, desc []byte) *Section {
+	pad := func(b *bytes.Buffer) {
+		for b.Len()%4 != 0 {
+			b.WriteByte(0)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, f.byteOrder(), uint32(len(owner)+1))
+	binary.Write(buf, f.byteOrder(), uint32(len(desc)))
+	binary.Write(buf, f.byteOrder(), noteType)
+	buf.WriteString(owner)
+	buf.WriteByte(0)
+	pad(buf)
+	buf.Write(desc)
+	pad(buf)
+
+	s := f.AddSection(name, SHT_NOTE, SHF_ALLOC, buf.Bytes())
+	s.Addralign = 4
+	return s
+}
+
+// AddNobitsSection adds a section that occupies size bytes in memory but
+// none in the file (.bss, .tbss)
+func (f *File) AddNobitsSection(name string, flags uint64, size uint64) *Section {
+	sec := f.AddSection(name, SHT_NOBITS, flags, nil)
+	sec.size = size
+	return sec
+}
+
 // AddSymbol adds a new symbol
 func (f *File) AddSymbol(name string, info byte, section *Section, value, size uint64) *Symbol {
 	sym := &Symbol{
@@ -227,7 +353,9 @@ func (f *File) AddRelocation(section *Section, offset uint64, symbol *Symbol, re
 	// We'll need to track them separately and create .rela sections later
 }
 
-// WriteTo writes the complete ELF file
+// WriteTo writes the complete ELF file. Sections are written as they are
+// laid out, so w sees the object front to back without it ever being
+// assembled in memory.
 func (f *File) WriteTo(w io.Writer) error {
 	// 1. Add string table sections FIRST (before building string tables)
 	// We need to know their indices before we can reference them
@@ -277,8 +405,13 @@ func (f *File) WriteTo(w io.Writer) error {
 	symTabSec := f.AddSection(".symtab", SHT_SYMTAB, 0, symBuf.Bytes())
 	symTabSec.Link = uint32(strTabSec.Index)
 	symTabSec.Info = uint32(firstGlobal) // Index of first global symbol
-	symTabSec.Addralign = 8
-	symTabSec.Entsize = 24 // sizeof(Elf64_Sym)
+	if f.is32() {
+		symTabSec.Addralign = 4
+		symTabSec.Entsize = 16 // sizeof(Elf32_Sym)
+	} else {
+		symTabSec.Addralign = 8
+		symTabSec.Entsize = 24 // sizeof(Elf64_Sym)
+	}
 
 	// 4. Fix up relocation section links to point to symtab
 	for _, relaSec := range f.RelaSections {
@@ -296,25 +429,45 @@ func (f *File) WriteTo(w io.Writer) error {
 	strTabSec.Content = f.StrTab.Data
 	strTabSec.size = uint64(len(f.StrTab.Data))
 
+	for _, sec := range f.Sections[1:] {
+		if err := f.checkSection(sec); err != nil {
+			return err
+		}
+		if sec.Compress {
+			if err := f.compressSection(sec); err != nil {
+				return err
+			}
+		}
+	}
+
 	// 6. Calculate section offsets
 	headerSize := uint64(64) // sizeof(Elf64_Ehdr)
+	wordSize := uint64(8)
+	if f.is32() {
+		headerSize = 52 // sizeof(Elf32_Ehdr)
+		wordSize = 4
+	}
 	currentOffset := headerSize
 
 	for _, sec := range f.Sections {
-		// Align section
-		if sec.Addralign > 0 {
-			if currentOffset%sec.Addralign != 0 {
-				currentOffset += sec.Addralign - (currentOffset % sec.Addralign)
-			}
+		// Align section; only the null section has no alignment
+		if sec.Addralign > 0 && currentOffset%sec.Addralign != 0 {
+			currentOffset += sec.Addralign - (currentOffset % sec.Addralign)
 		}
 
 		sec.offset = currentOffset
 		if sec.size == 0 {
 			sec.size = uint64(len(sec.Content))
 		}
-		currentOffset += sec.size
+		if sec.Type != SHT_NOBITS {
+			currentOffset += sec.size
+		}
 	}
 
+	// Section header table is word-aligned
+	if currentOffset%wordSize != 0 {
+		currentOffset += wordSize - (currentOffset % wordSize)
+	}
 	shdrOffset := currentOffset
 
 	// 7. Write ELF header (with correct shstrndx)
@@ -334,11 +487,19 @@ func (f *File) WriteTo(w io.Writer) error {
 			written = sec.offset
 		}
 
+		if sec.Type == SHT_NOBITS {
+			continue // Occupies no file space
+		}
 		if _, err := w.Write(sec.Content); err != nil {
 			return err
 		}
 		written += sec.size
 	}
+	if shdrOffset > written {
+		if _, err := w.Write(make([]byte, shdrOffset-written)); err != nil {
+			return err
+		}
+	}
 
 	// 9. Write section headers
 	for _, sec := range f.Sections {
@@ -350,32 +511,148 @@ func (f *File) WriteTo(w io.Writer) error {
 	return nil
 }
 
+// checkSection fills in the alignment and entry size a section leaves
+// unset and rejects values no consumer could use. An Addralign of 0 becomes
+// 1, so every section is laid out under an explicit alignment.
+func (f *File) checkSection(sec *Section) error {
+	if sec.Addralign == 0 {
+		sec.Addralign = 1
+	}
+	if sec.Addralign&(sec.Addralign-1) != 0 {
+		return fmt.Errorf("section %s: alignment %d is not a power of two", sec.Name, sec.Addralign)
+	}
+
+	if sec.Entsize == 0 {
+		switch {
+		case sec.Type == SHT_RELA && f.is32():
+			sec.Entsize = 12 // sizeof(Elf32_Rela)
+		case sec.Type == SHT_RELA:
+			sec.Entsize = 24 // sizeof(Elf64_Rela)
+		case sec.Type == SHT_REL && f.is32():
+			sec.Entsize = 8 // sizeof(Elf32_Rel)
+		case sec.Type == SHT_REL:
+			sec.Entsize = 16 // sizeof(Elf64_Rel)
+		case sec.Flags&SHF_MERGE != 0:
+			// Strings merge byte-wise unless the caller chose a wider
+			// character size; other mergeable data must say
+			if sec.Flags&SHF_STRINGS == 0 {
+				return fmt.Errorf("section %s: SHF_MERGE requires Entsize", sec.Name)
+			}
+			sec.Entsize = 1
+		}
+	}
+
+	// A table must hold whole entries
+	size := sec.size
+	if size == 0 {
+		size = uint64(len(sec.Content))
+	}
+	if sec.Entsize != 0 && size%sec.Entsize != 0 {
+		return fmt.Errorf("section %s: size %d is not a multiple of its entry size %d", sec.Name, size, sec.Entsize)
+	}
+
+	if sec.Compress && (sec.Flags&SHF_ALLOC != 0 || sec.Type == SHT_NOBITS) {
+		return fmt.Errorf("section %s: only sections with contents that aren't loaded can be compressed", sec.Name)
+	}
+	return nil
+}
+
+// compressSection replaces a section's contents with an Elf_Chdr, which
+// records the uncompressed size and alignment, followed by the zlib
+// stream. The section itself is then aligned for the header.
+func (f *File) compressSection(sec *Section) error {
+	buf := new(bytes.Buffer)
+	if f.is32() {
+		binary.Write(buf, f.byteOrder(), elf32CompressionHeader{
+			Type:      ELFCOMPRESS_ZLIB,
+			Size:      uint32(len(sec.Content)),
+			Addralign: uint32(sec.Addralign),
+		})
+		sec.Addralign = 4
+	} else {
+		binary.Write(buf, f.byteOrder(), elfCompressionHeader{
+			Type:      ELFCOMPRESS_ZLIB,
+			Size:      uint64(len(sec.Content)),
+			Addralign: sec.Addralign,
+		})
+		sec.Addralign = 8
+	}
+
+	zw := zlib.NewWriter(buf)
+	if _, err := zw.Write(sec.Content); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	sec.Content = buf.Bytes()
+	sec.size = uint64(len(sec.Content))
+	sec.Flags |= SHF_COMPRESSED
+	sec.Compress = false // Done; writing again mustn't compress twice
+	return nil
+}
+
 func (f *File) writeElfHeader(w io.Writer, shoff uint64, shstrndx uint16) error {
-	var hdr elfHeader
+	var ident [EI_NIDENT]byte
 
 	// Magic number
-	hdr.Ident[EI_MAG0] = ELFMAG0
-	hdr.Ident[1] = ELFMAG1
-	hdr.Ident[2] = ELFMAG2
-	hdr.Ident[3] = ELFMAG3
-	hdr.Ident[EI_CLASS] = ELFCLASS64
-	hdr.Ident[EI_DATA] = ELFDATA2LSB
-	hdr.Ident[EI_VERSION] = EV_CURRENT
+	ident[EI_MAG0] = ELFMAG0
+	ident[1] = ELFMAG1
+	ident[2] = ELFMAG2
+	ident[3] = ELFMAG3
+	ident[EI_CLASS] = f.Class
+	ident[EI_DATA] = f.Data
+	ident[EI_VERSION] = EV_CURRENT
+	ident[EI_OSABI] = f.OSABI
 	// Rest of e_ident is zero
 
-	hdr.Type = ET_REL      // Relocatable object file
+	if f.is32() {
+		var hdr elf32Header
+		hdr.Ident = ident
+		hdr.Type = ET_REL // Relocatable object file
+		hdr.Machine = f.Machine
+		hdr.Version = EV_CURRENT
+		hdr.Flags = f.Flags
+		hdr.Shoff = uint32(shoff)
+		hdr.Ehsize = 52    // sizeof(Elf32_Ehdr)
+		hdr.Shentsize = 40 // sizeof(Elf32_Shdr)
+		hdr.Shnum = uint16(len(f.Sections))
+		hdr.Shstrndx = shstrndx
+		return binary.Write(w, f.byteOrder(), hdr)
+	}
+
+	var hdr elfHeader
+	hdr.Ident = ident
+	hdr.Type = ET_REL // Relocatable object file
 	hdr.Machine = f.Machine
 	hdr.Version = EV_CURRENT
 	hdr.Shoff = shoff
-	hdr.Ehsize = 64                        // sizeof(Elf64_Ehdr)
-	hdr.Shentsize = 64                     // sizeof(Elf64_Shdr)
+	hdr.Flags = f.Flags
+	hdr.Ehsize = 64    // sizeof(Elf64_Ehdr)
+	hdr.Shentsize = 64 // sizeof(Elf64_Shdr)
 	hdr.Shnum = uint16(len(f.Sections))
 	hdr.Shstrndx = shstrndx
 
-	return binary.Write(w, binary.LittleEndian, hdr)
+	return binary.Write(w, f.byteOrder(), hdr)
 }
 
 func (f *File) writeSectionHeader(w io.Writer, sec *Section) error {
+	if f.is32() {
+		shdr := elf32SectionHeader{
+			Name:      sec.nameIdx,
+			Type:      sec.Type,
+			Flags:     uint32(sec.Flags),
+			Addr:      uint32(sec.Addr),
+			Offset:    uint32(sec.offset),
+			Size:      uint32(sec.size),
+			Link:      sec.Link,
+			Info:      sec.Info,
+			Addralign: uint32(sec.Addralign),
+			Entsize:   uint32(sec.Entsize),
+		}
+		return binary.Write(w, f.byteOrder(), shdr)
+	}
+
 	var shdr elfSectionHeader
 
 	shdr.Name = sec.nameIdx
@@ -389,22 +666,34 @@ func (f *File) writeSectionHeader(w io.Writer, sec *Section) error {
 	shdr.Addralign = sec.Addralign
 	shdr.Entsize = sec.Entsize
 
-	return binary.Write(w, binary.LittleEndian, shdr)
+	return binary.Write(w, f.byteOrder(), shdr)
 }
 
 func (f *File) writeSymbol(w io.Writer, sym *Symbol) error {
-	shndx := uint16(SHN_UNDEF)
+	shndx := sym.Shndx
 	if sym.Section != nil {
 		shndx = sym.Section.Index
 	}
+	order := f.byteOrder()
+
+	if f.is32() {
+		// Elf32_Sym puts value/size before info/other/shndx
+		binary.Write(w, order, sym.nameIdx)       // st_name
+		binary.Write(w, order, uint32(sym.Value)) // st_value
+		binary.Write(w, order, uint32(sym.Size))  // st_size
+		w.Write([]byte{sym.Info})                 // st_info
+		w.Write([]byte{sym.Other})                // st_other
+		binary.Write(w, order, shndx)             // st_shndx
+		return nil
+	}
 
 	// Write in correct order for Elf64_Sym
-	binary.Write(w, binary.LittleEndian, sym.nameIdx)  // st_name
-	w.Write([]byte{sym.Info})                          // st_info
-	w.Write([]byte{sym.Other})                         // st_other
-	binary.Write(w, binary.LittleEndian, shndx)        // st_shndx
-	binary.Write(w, binary.LittleEndian, sym.Value)    // st_value
-	binary.Write(w, binary.LittleEndian, sym.Size)     // st_size
+	binary.Write(w, order, sym.nameIdx) // st_name
+	w.Write([]byte{sym.Info})           // st_info
+	w.Write([]byte{sym.Other})          // st_other
+	binary.Write(w, order, shndx)       // st_shndx
+	binary.Write(w, order, sym.Value)   // st_value
+	binary.Write(w, order, sym.Size)    // st_size
 
 	return nil
 }
@@ -443,4 +732,48 @@ type elfSectionHeader struct {
 	Info      uint32
 	Addralign uint64
 	Entsize   uint64
-}
\ No newline at end of file
+}
+
+type elf32Header struct {
+	Ident     [EI_NIDENT]byte
+	Type      uint16
+	Machine   uint16
+	Version   uint32
+	Entry     uint32
+	Phoff     uint32
+	Shoff     uint32
+	Flags     uint32
+	Ehsize    uint16
+	Phentsize uint16
+	Phnum     uint16
+	Shentsize uint16
+	Shnum     uint16
+	Shstrndx  uint16
+}
+
+// elfCompressionHeader is Elf64_Chdr, which begins SHF_COMPRESSED sections
+type elfCompressionHeader struct {
+	Type      uint32
+	Reserved  uint32
+	Size      uint64
+	Addralign uint64
+}
+
+type elf32CompressionHeader struct {
+	Type      uint32
+	Size      uint32
+	Addralign uint32
+}
+
+type elf32SectionHeader struct {
+	Name      uint32
+	Type      uint32
+	Flags     uint32
+	Addr      uint32
+	Offset    uint32
+	Size      uint32
+	Link      uint32
+	Info      uint32
+	Addralign uint32
+	Entsize   uint32
+}